@@ -1,18 +1,868 @@
 package authify
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
 	"github.com/HassanAli101/authify/stores"
 	"github.com/HassanAli101/authify/token"
+	"github.com/HassanAli101/authify/verifier"
+	"github.com/golang-jwt/jwt/v5"
 )
 
+// AdminScope must be granted to the access tokens of administrators,
+// it guards account management such as disabling users over HTTP and gRPC.
+const AdminScope = "users:admin"
+
+// ChallengeTTL is how long the nonce of a login challenge can be answered
+const ChallengeTTL = 60 * time.Second
+
 type Authify struct {
 	Store  stores.Store
 	Tokens token.TokenManager
+
+	// Sessions records logins made through Login, nil disables session tracking
+	Sessions stores.SessionStore
+
+	// Families records the refresh tokens rotated by refreshes, nil disables rotation, see WithTokenFamilies
+	Families stores.TokenFamilyStore
+	// the rotations of the refresh tokens of families, shared by concurrent refreshes
+	familyRefreshes familyRefreshes
+
+	// Nonces tracks the nonces of challenge logins, nil disables them
+	Nonces stores.NonceStore
+
+	// PreciseLoginErrors makes Login return ErrUserNotFound and ErrInvalidPassword as they are,
+	// instead of ErrInvalidCredentials for both. Only meant for trusted, internal deployments.
+	PreciseLoginErrors bool
+
+	// Audit records logins, refreshes, logouts and user creations, nil records nothing
+	Audit stores.AuditLogger
+
+	// Invalidations is told about the changes of users made through Authify, nil tells no one
+	Invalidations stores.InvalidationBus
+
+	// Registration decides who can create users through RegisterUser, Invites keeps the
+	// invites it requires, see WithRegistrationPolicy
+	Registration RegistrationPolicy
+	Invites      stores.InviteStore
 }
 
 func NewAuthify(store stores.Store, tokens token.TokenManager) *Authify {
 	return &Authify{
-		Store:  store,
-		Tokens: tokens,
+		Store:           store,
+		Tokens:          tokens,
+		familyRefreshes: familyRefreshes{window: defaultTokenFamilyGraceWindow},
+	}
+}
+
+// NewVerifier returns a builder of verifier.Verifier, which verifies access tokens without
+// a store. Programs that only verify tokens should import the verifier package directly,
+// this package links the postgres driver.
+func NewVerifier() *verifier.Verifier {
+	return verifier.New()
+}
+
+// Authenticate is the single answer to "is this request authenticated", the middlewares
+// use it too. It returns the user an access token was issued to and the token's role
+// claim, empty when the token has none, after checking, in this order:
+//   - the token's size and signature, made with the configured signing method and the
+//     current or a previous access secret
+//   - its exp and nbf claims, and its iss claim when the token config sets an issuer
+//   - the claims required by the token config, and the values of static ones
+//   - with strict verification, that the user still exists and is not disabled
+//
+// JWTs cannot be revoked and sessions do not end yet, so neither is checked. Opaque tokens
+// are looked up in their token store instead, which also checks they were not revoked.
+func (a *Authify) Authenticate(tokenStr string) (username, role string, err error) {
+	claims, err := a.AuthenticateClaims(tokenStr)
+	if err != nil {
+		return "", "", err
+	}
+	username, err = a.Tokens.UserIdentifier(claims)
+	if err != nil {
+		return "", "", err
+	}
+	// without a RoleReporter, the role is read from the claim named "role"
+	if reporter, ok := a.Tokens.(token.RoleReporter); ok {
+		role = reporter.Role(claims)
+	} else {
+		role, _ = claims["role"].(string)
+	}
+	return username, role, nil
+}
+
+// HasScope reports whether the verified claims of an access token grant scope,
+// see middleware.RequireScope to guard routes with it.
+func HasScope(claims jwt.MapClaims, scope string) bool {
+	return token.HasScopes(claims, scope)
+}
+
+// AuthenticateClaims runs the checks of Authenticate and returns all the token's claims.
+func (a *Authify) AuthenticateClaims(tokenStr string) (jwt.MapClaims, error) {
+	resp, err := a.Tokens.VerifyToken(context.Background(), token.VerifyTokenRequest{Token: tokenStr})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Claims, nil
+}
+
+// AuthenticateSliding runs the checks of AuthenticateClaims and, when the token manager extends
+// sessions on use, see token.JWTManager.WithSlidingExpiration, also returns the replacement of a
+// token close to expiry. replacement is empty otherwise.
+func (a *Authify) AuthenticateSliding(tokenStr string) (claims jwt.MapClaims, replacement string, err error) {
+	if slider, ok := a.Tokens.(token.SlidingVerifier); ok {
+		return slider.VerifyAccessTokenSliding(tokenStr)
+	}
+	claims, err = a.AuthenticateClaims(tokenStr)
+	return claims, "", err
+}
+
+// WithSessionStore makes Login record a session, with the client's device, for every login.
+func (a *Authify) WithSessionStore(sessions stores.SessionStore) *Authify {
+	a.Sessions = sessions
+	return a
+}
+
+// WithChallengeLogin enables challenge logins, see LoginWithProof, tracking their nonces in nonces.
+func (a *Authify) WithChallengeLogin(nonces stores.NonceStore) *Authify {
+	a.Nonces = nonces
+	return a
+}
+
+// WithPreciseLoginErrors sets PreciseLoginErrors, see there.
+func (a *Authify) WithPreciseLoginErrors(precise bool) *Authify {
+	a.PreciseLoginErrors = precise
+	return a
+}
+
+// WithAuditLogger records authentication events in audit, see stores.AuditLogger.
+func (a *Authify) WithAuditLogger(audit stores.AuditLogger) *Authify {
+	a.Audit = audit
+	return a
+}
+
+// WithInvalidationBus publishes on bus the changes of passwords, roles, account status, token
+// versions and of the global not-before time, so the caches of the other replicas sharing the
+// store drop what they hold about them, see token.JWTManager.WithInvalidationBus.
+func (a *Authify) WithInvalidationBus(bus stores.InvalidationBus) *Authify {
+	a.Invalidations = bus
+	return a
+}
+
+// publish tells the invalidation bus, if any, about a change made to username, logging
+// failures: the change itself was made
+func (a *Authify) publish(kind stores.InvalidationKind, username string) {
+	if a.Invalidations == nil {
+		return
+	}
+	if err := a.Invalidations.Publish(context.Background(), stores.Invalidation{Kind: kind, Username: username}); err != nil {
+		log.Printf("failed to publish %s invalidation of %q: %v", kind, username, err)
+	}
+}
+
+// TokenPair is the access and refresh token of a login, along with when they expire.
+type TokenPair = token.TokenPair
+
+// Login checks the user's credentials and issues an access and a refresh token.
+// It is LoginContext without a context, returning the tokens only.
+func (a *Authify) Login(username, password string, device stores.DeviceInfo) (accessToken, refreshToken string, err error) {
+	pair, err := a.LoginContext(context.Background(), username, password, device)
+	if err != nil {
+		return "", "", err
+	}
+	return pair.AccessToken, pair.RefreshToken, nil
+}
+
+// LoginContext checks the user's credentials and issues an access and a refresh token.
+// Credentials that could not have been stored, see stores.StoreConfig.ValidateInput, are
+// rejected before reaching the store, and without being audited.
+// Unknown users and wrong passwords both fail with ErrInvalidCredentials, unless
+// PreciseLoginErrors is set, the precise reason is logged along with the client IP.
+// The device's IP and user agent fill the "ip" and "user_agent" request claims. With a session
+// store, the login is also recorded as a session along with the sanitized device info,
+// and the refresh token carries the session ID in its "sid" claim.
+func (a *Authify) LoginContext(ctx context.Context, username, password string, device stores.DeviceInfo) (*TokenPair, error) {
+	return a.IssueTokens(ctx, token.GenerateTokensRequest{Username: username, Password: password, Device: device})
+}
+
+// IssueTokens is LoginContext for a request of the token manager, which also carries the
+// tenant and extra claims of the access token, see token.GenerateTokensRequest. The session ID
+// of req is set by IssueTokens when a session store is set.
+func (a *Authify) IssueTokens(ctx context.Context, req token.GenerateTokensRequest) (*TokenPair, error) {
+	req.Device = req.Device.Sanitize()
+	if err := a.validateCredentials(req.Username, req.Password); err != nil {
+		return nil, err
+	}
+
+	var session stores.Session
+	if a.Sessions != nil {
+		id, err := stores.NewSessionID()
+		if err != nil {
+			return nil, err
+		}
+		session = stores.Session{ID: id, UserIdentifier: req.Username, Device: req.Device, CreatedAt: time.Now().UTC()}
+		req.SessionID = id
+	}
+	family, err := a.newTokenFamily(req.Username, req.SessionID, req.Device)
+	if err != nil {
+		return nil, err
+	}
+	if family != nil {
+		req.SessionID = family.ID
+		req.RefreshTokenID = family.Tokens[0].JTI
+	}
+
+	pair, err := a.Tokens.IssueTokens(ctx, req)
+	if err != nil {
+		a.auditContext(ctx, stores.EventFailedLogin, req.Username, req.Device.IP, err)
+		return nil, a.loginError(req.Username, req.Device, err)
+	}
+	if a.Sessions != nil {
+		if err := a.Sessions.CreateSession(session); err != nil {
+			a.auditContext(ctx, stores.EventFailedLogin, req.Username, req.Device.IP, err)
+			return nil, err
+		}
+	}
+	if family != nil {
+		family.ExpiresAt = pair.RefreshExpiresAt
+		if err := a.Families.CreateTokenFamily(*family); err != nil {
+			a.auditContext(ctx, stores.EventFailedLogin, req.Username, req.Device.IP, err)
+			return nil, err
+		}
+	}
+	a.auditContext(ctx, stores.EventLogin, req.Username, req.Device.IP, nil)
+	return pair, nil
+}
+
+// validateCredentials checks a username and password like the fields of a new user
+func (a *Authify) validateCredentials(username, password string) error {
+	cfg := a.Store.StoreConfig()
+	passwordColumn := cfg.PasswordColumn()
+	if passwordColumn == "" {
+		passwordColumn = "password"
+	}
+	return cfg.ValidateInput(map[string]any{cfg.IdentifierColumn(): username, passwordColumn: password})
+}
+
+// tokenPair pairs freshly issued tokens with their expiries, read off their verified claims
+func (a *Authify) tokenPair(accessToken, refreshToken string) (*TokenPair, error) {
+	pair := &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken}
+	accessClaims, err := a.Tokens.VerifyAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	refreshClaims, err := a.Tokens.VerifyRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if exp, err := accessClaims.GetExpirationTime(); err == nil && exp != nil {
+		pair.AccessExpiresAt = exp.UTC()
+	}
+	if exp, err := refreshClaims.GetExpirationTime(); err == nil && exp != nil {
+		pair.RefreshExpiresAt = exp.UTC()
+	}
+	return pair, nil
+}
+
+// LoginChallenge is what a client needs to answer a challenge login: a single-use nonce and
+// the settings of the user's password hash, see stores.ChallengeProof for the proof expected.
+type LoginChallenge struct {
+	Nonce     string    `json:"nonce"`
+	Settings  string    `json:"settings"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewLoginChallenge returns a challenge for username to answer within ChallengeTTL.
+// Unknown users get a challenge too, with made-up settings, so it does not reveal them.
+// It fails with ErrChallengeNotSupported unless challenge logins are enabled and the
+// store implements stores.ProofAuthenticator.
+func (a *Authify) NewLoginChallenge(username string) (LoginChallenge, error) {
+	prover, ok := a.Store.(stores.ProofAuthenticator)
+	if !ok || a.Nonces == nil {
+		return LoginChallenge{}, ErrChallengeNotSupported
+	}
+
+	settings, err := prover.PasswordSettings(username)
+	if err != nil {
+		return LoginChallenge{}, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return LoginChallenge{}, err
+	}
+	challenge := LoginChallenge{Nonce: nonce, Settings: settings, ExpiresAt: time.Now().Add(ChallengeTTL).UTC()}
+	if err := a.Nonces.SaveNonce(nonce, challenge.ExpiresAt); err != nil {
+		return LoginChallenge{}, err
+	}
+	return challenge, nil
+}
+
+// LoginWithProof is LoginWithProofContext without a context, returning the tokens only.
+func (a *Authify) LoginWithProof(username, nonce, proof string, device stores.DeviceInfo) (accessToken, refreshToken string, err error) {
+	pair, err := a.LoginWithProofContext(context.Background(), username, nonce, proof, device)
+	if err != nil {
+		return "", "", err
+	}
+	return pair.AccessToken, pair.RefreshToken, nil
+}
+
+// LoginWithProofContext is LoginContext with the proof answering a challenge from
+// NewLoginChallenge instead of the password. The nonce is consumed first, whether the proof
+// checks out or not, so a replayed nonce fails with ErrNonceUsed and a late one with
+// ErrNonceExpired. Wrong proofs and unknown users fail like wrong passwords do in Login.
+func (a *Authify) LoginWithProofContext(ctx context.Context, username, nonce, proof string, device stores.DeviceInfo) (*TokenPair, error) {
+	prover, ok := a.Store.(stores.ProofAuthenticator)
+	issuer, canIssue := a.Tokens.(token.PreauthenticatedIssuer)
+	if !ok || !canIssue || a.Nonces == nil {
+		return nil, ErrChallengeNotSupported
+	}
+
+	device = device.Sanitize()
+	if err := a.Nonces.ConsumeNonce(nonce); err != nil {
+		return nil, err
+	}
+	userData, err := prover.GetUserInfoWithProof(username, nonce, proof)
+	if err != nil {
+		a.auditContext(ctx, stores.EventFailedLogin, username, device.IP, err)
+		return nil, a.loginError(username, device, err)
+	}
+	accessToken, err := issuer.IssueAccessToken(username, userData)
+	var refreshToken string
+	if err == nil {
+		refreshToken, err = a.issueRefreshToken(username, device)
+	}
+	if err != nil {
+		a.auditContext(ctx, stores.EventFailedLogin, username, device.IP, err)
+		return nil, err
+	}
+	a.auditContext(ctx, stores.EventLogin, username, device.IP, nil)
+	return a.tokenPair(accessToken, refreshToken)
+}
+
+// LoginAuthenticated issues an access and a refresh token to a user the caller authenticated by
+// other means than a password, such as an identity provider, see the federation package. The user
+// is looked up in the store, unknown users fail with ErrUserNotFound and disabled ones with
+// ErrAccountDisabled. Stores that cannot look users up, and token managers that cannot issue
+// tokens without a password, fail with ErrLookupNotSupported.
+func (a *Authify) LoginAuthenticated(ctx context.Context, username string, device stores.DeviceInfo) (*TokenPair, error) {
+	getter, ok := a.Store.(stores.UserGetter)
+	issuer, canIssue := a.Tokens.(token.PreauthenticatedIssuer)
+	if !ok || !canIssue {
+		return nil, ErrLookupNotSupported
+	}
+
+	device = device.Sanitize()
+	pair, err := a.loginAuthenticated(getter, issuer, username, device)
+	if err != nil {
+		a.auditContext(ctx, stores.EventFailedLogin, username, device.IP, err)
+		return nil, err
+	}
+	a.auditContext(ctx, stores.EventLogin, username, device.IP, nil)
+	return pair, nil
+}
+
+func (a *Authify) loginAuthenticated(getter stores.UserGetter, issuer token.PreauthenticatedIssuer, username string, device stores.DeviceInfo) (*TokenPair, error) {
+	user, err := getter.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if disabler, ok := a.Store.(stores.UserDisabler); ok {
+		disabled, err := disabler.IsUserDisabled(username)
+		if err != nil {
+			return nil, err
+		}
+		if disabled {
+			return nil, ErrAccountDisabled
+		}
+	}
+
+	userData := make(map[string]any, len(user))
+	for name, val := range user {
+		userData[name] = val
+	}
+	accessToken, err := issuer.IssueAccessToken(username, userData)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := a.issueRefreshToken(username, device)
+	if err != nil {
+		return nil, err
+	}
+	return a.tokenPair(accessToken, refreshToken)
+}
+
+// issueRefreshToken issues the refresh token of a login, recording its session when a
+// session store is set, and its token family when a family store is
+func (a *Authify) issueRefreshToken(username string, device stores.DeviceInfo) (string, error) {
+	var session stores.Session
+	if a.Sessions != nil {
+		id, err := stores.NewSessionID()
+		if err != nil {
+			return "", err
+		}
+		session = stores.Session{ID: id, UserIdentifier: username, Device: device, CreatedAt: time.Now().UTC()}
+	}
+	family, err := a.newTokenFamily(username, session.ID, device)
+	if err != nil {
+		return "", err
+	}
+
+	requestData := token.RequestData(device, session.ID)
+	if family != nil {
+		requestData[token.ClaimSessionID] = family.ID
+		requestData[token.ClaimTokenID] = family.Tokens[0].JTI
+	}
+	refreshToken, err := a.Tokens.GenerateRefreshToken(username, requestData)
+	if err != nil {
+		return "", err
+	}
+
+	if a.Sessions != nil {
+		if err := a.Sessions.CreateSession(session); err != nil {
+			return "", err
+		}
+	}
+	if family != nil {
+		family.ExpiresAt = a.refreshTokenExpiry(refreshToken)
+		if err := a.Families.CreateTokenFamily(*family); err != nil {
+			return "", err
+		}
+	}
+	return refreshToken, nil
+}
+
+// UserExists reports whether a user has value in column, e.g. whether a username is taken.
+// Only unique columns can be checked, others fail with ErrColumnNotQueryable, and stores
+// that do not implement stores.ExistenceChecker fail with ErrLookupNotSupported.
+func (a *Authify) UserExists(ctx context.Context, column, value string) (bool, error) {
+	checker, ok := a.Store.(stores.ExistenceChecker)
+	if !ok {
+		return false, ErrLookupNotSupported
+	}
+	return checker.UserExists(ctx, column, value)
+}
+
+const (
+	// DefaultListUsersLimit is the page size of ListUsers when given none
+	DefaultListUsersLimit = 100
+	// MaxListUsersLimit caps the page size of ListUsers
+	MaxListUsersLimit = 1000
+)
+
+// ListUsers returns a page of users with their non-hidden columns, in primary key order, see
+// stores.UserIterator: at most limit users following the key after, "" for the first page, and
+// the key to pass for the next page, "" after the last one. limit defaults to
+// DefaultListUsersLimit and is capped at MaxListUsersLimit. Stores that do not implement
+// stores.UserIterator fail with ErrListingNotSupported.
+func (a *Authify) ListUsers(ctx context.Context, after string, limit int) ([]map[string]string, string, error) {
+	iterator, ok := a.Store.(stores.UserIterator)
+	if !ok {
+		return nil, "", ErrListingNotSupported
+	}
+	if limit <= 0 {
+		limit = DefaultListUsersLimit
+	}
+	return iterator.ListUsers(ctx, after, min(limit, MaxListUsersLimit))
+}
+
+// ExportUsers writes every user to w as one JSON object per line, with their non-hidden columns
+// and disabled flag, in primary key order. Users are read stores.DefaultIterateBatchSize at a time, so exporting
+// millions of them takes no more memory than a few. Stores that do not implement
+// stores.UserIterator fail with ErrListingNotSupported.
+func (a *Authify) ExportUsers(ctx context.Context, w io.Writer) error {
+	iterator, ok := a.Store.(stores.UserIterator)
+	if !ok {
+		return ErrListingNotSupported
+	}
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	if err := iterator.IterateUsers(ctx, stores.DefaultIterateBatchSize, func(user map[string]string) error {
+		return enc.Encode(user)
+	}); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// Ready reports whether the store can serve requests, failing with ErrStoreUnavailable while
+// its database cannot be reached. Stores that do not implement stores.ReadinessChecker are always ready.
+func (a *Authify) Ready(ctx context.Context) error {
+	checker, ok := a.Store.(stores.ReadinessChecker)
+	if !ok {
+		return nil
+	}
+	return checker.Ready(ctx)
+}
+
+// CreateUser creates a user in the store, honoring ctx when the store implements
+// stores.ContextCreator, and returns the new user, see stores.Store. Fields that are too long,
+// not valid UTF-8 or hold NUL bytes are rejected first, see stores.StoreConfig.ValidateInput.
+func (a *Authify) CreateUser(ctx context.Context, userData map[string]any) (map[string]string, error) {
+	// invalid fields are not audited, they could hold anything
+	if err := a.Store.StoreConfig().ValidateInput(userData); err != nil {
+		return nil, err
+	}
+	var user map[string]string
+	var err error
+	if creator, ok := a.Store.(stores.ContextCreator); ok {
+		user, err = creator.CreateUserContext(ctx, userData)
+	} else {
+		user, err = a.Store.CreateUser(userData)
+	}
+	username, ok := user[a.Store.StoreConfig().IdentifierColumn()]
+	if !ok {
+		username, _ = userData[a.Store.StoreConfig().IdentifierColumn()].(string)
+	}
+	a.auditContext(ctx, stores.EventCreateUser, username, "", err)
+	return user, err
+}
+
+// GenerateServiceToken issues an access token to a service account and returns it with its
+// expiry, see token.JWTManager.GenerateServiceToken. Token managers that cannot issue service
+// tokens fail with ErrServiceAccountsNotSupported.
+func (a *Authify) GenerateServiceToken(ctx context.Context, clientID, clientSecret string, scopes []string) (string, time.Time, error) {
+	issuer, ok := a.Tokens.(token.ServiceTokenIssuer)
+	if !ok {
+		return "", time.Time{}, ErrServiceAccountsNotSupported
+	}
+	accessToken, err := issuer.GenerateServiceToken(clientID, clientSecret, scopes)
+	a.auditContext(ctx, stores.EventServiceToken, clientID, "", err)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	claims, err := a.Tokens.VerifyAccessToken(accessToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var expiresAt time.Time
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		expiresAt = exp.UTC()
+	}
+	return accessToken, expiresAt, nil
+}
+
+// RefreshTokens issues a new access token for the refresh token of req, see token.TokenManager.
+// The IP address of the device of req is recorded in the audit log, along with the request ID of ctx.
+// With a family store, the refresh token is rotated, see WithTokenFamilies.
+func (a *Authify) RefreshTokens(ctx context.Context, req token.RefreshTokensRequest) (*TokenPair, error) {
+	req.Device = req.Device.Sanitize()
+	pair, err := a.refreshTokens(ctx, req)
+	if a.Audit != nil {
+		var username string
+		if err == nil {
+			username, _ = a.Tokens.UserIdentifier(pair.AccessClaims)
+		}
+		a.auditContext(ctx, stores.EventRefresh, username, req.Device.IP, err)
+	}
+	return pair, err
+}
+
+// RefreshToken issues a new access token for a refresh token, see token.TokenManager.
+// The "ip" entry of requestData is recorded in the audit log.
+//
+// Deprecated: use RefreshTokens, which takes the device in place of requestData and returns
+// the claims of the new token in TokenPair.AccessClaims.
+func (a *Authify) RefreshToken(accessToken, refreshToken string, requestData map[string]any) (string, jwt.MapClaims, error) {
+	return a.RefreshTokenContext(context.Background(), accessToken, refreshToken, requestData)
+}
+
+// RefreshTokenContext is RefreshToken, recording the request ID of ctx in the audit log.
+// With a family store, refresh tokens that were consumed, or whose family is compromised, fail
+// with ErrRefreshTokenReused, but the refresh token is not rotated, see WithTokenFamilies.
+//
+// Deprecated: use RefreshTokens.
+func (a *Authify) RefreshTokenContext(ctx context.Context, accessToken, refreshToken string, requestData map[string]any) (string, jwt.MapClaims, error) {
+	ip, _ := requestData["ip"].(string)
+	var newToken string
+	var claims jwt.MapClaims
+	err := a.checkTokenFamily(refreshToken, ip)
+	if err == nil {
+		newToken, claims, err = a.Tokens.RefreshToken(accessToken, refreshToken, requestData)
+	}
+	if a.Audit != nil {
+		var username string
+		if err == nil {
+			username, _ = a.Tokens.UserIdentifier(claims)
+		}
+		a.auditContext(ctx, stores.EventRefresh, username, ip, err)
+	}
+	return newToken, claims, err
+}
+
+// audit records an event in the audit log, failed with the error code of err unless nil
+func (a *Authify) audit(eventType stores.AuthEventType, username, ip string, err error) {
+	a.auditContext(context.Background(), eventType, username, ip, err)
+}
+
+func (a *Authify) auditContext(ctx context.Context, eventType stores.AuthEventType, username, ip string, err error) {
+	if a.Audit == nil {
+		return
+	}
+	a.Audit.LogEvent(ctx, stores.AuthEvent{
+		Type:      eventType,
+		Username:  username,
+		IP:        ip,
+		Time:      time.Now().UTC(),
+		Success:   err == nil,
+		Reason:    string(ErrorCode(err)),
+		RequestID: RequestIDFromContext(ctx),
+	})
+}
+
+// newNonce returns 32 random bytes, base64url encoded
+func newNonce() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// loginError logs a login that failed on the user's credentials and, unless
+// PreciseLoginErrors is set, hides whether the user exists behind ErrInvalidCredentials.
+func (a *Authify) loginError(username string, device stores.DeviceInfo, err error) error {
+	if !errors.Is(err, ErrUserNotFound) && !errors.Is(err, ErrInvalidPassword) {
+		return err
+	}
+	log.Printf("Login failed for %q from %s: %v\n", username, device.IP, err)
+	if a.PreciseLoginErrors {
+		return err
+	}
+	return ErrInvalidCredentials
+}
+
+// ListSessions verifies an access token and returns the sessions of the user it was issued to.
+func (a *Authify) ListSessions(accessToken string) ([]stores.Session, error) {
+	if a.Sessions == nil {
+		return nil, stores.ErrSessionsNotSupported
+	}
+	claims, err := a.AuthenticateClaims(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	userIdentifier, err := a.Tokens.UserIdentifier(claims)
+	if err != nil {
+		return nil, err
+	}
+	return a.Sessions.ListSessions(userIdentifier)
+}
+
+// GetSelf verifies an access token and returns the profile of the user it was issued to,
+// looked up in the store without a password. Fields are named after their jwt_claim
+// mapping, and hidden columns are never returned.
+func (a *Authify) GetSelf(accessToken string) (map[string]string, error) {
+	claims, err := a.AuthenticateClaims(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	userIdentifier, err := a.Tokens.UserIdentifier(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	getter, ok := a.Store.(stores.UserGetter)
+	if !ok {
+		return nil, stores.ErrLookupNotSupported
+	}
+	user, err := getter.GetUserByUsername(userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return a.Store.StoreConfig().ProfileFields(user), nil
+}
+
+// UpdateSelf verifies an access token and changes fields of the profile of the user it was
+// issued to, named after their column. Only columns marked editable in the store config can
+// be changed, others fail with ErrFieldNotEditable, and values taken by another user in a unique
+// column with ErrFieldConflict. Stores that do not implement stores.FieldUpdater fail with
+// ErrUpdatesNotSupported.
+func (a *Authify) UpdateSelf(ctx context.Context, accessToken string, fields map[string]string) error {
+	claims, err := a.AuthenticateClaims(accessToken)
+	if err != nil {
+		return err
+	}
+	userIdentifier, err := a.Tokens.UserIdentifier(claims)
+	if err != nil {
+		return err
+	}
+
+	updater, ok := a.Store.(stores.FieldUpdater)
+	if !ok {
+		return ErrUpdatesNotSupported
+	}
+	return updater.UpdateUserFields(ctx, userIdentifier, fields)
+}
+
+// ChangeRole assigns a new role to a user, if the store supports it. The role is checked
+// against the allowed_roles of the store config, and ErrUserNotFound is returned for unknown users.
+// Tokens issued before the change, and their refreshes, keep the previous role until the next login.
+func (a *Authify) ChangeRole(userIdentifier, newRole string) error {
+	changer, ok := a.Store.(stores.RoleChanger)
+	if !ok {
+		return stores.ErrRolesNotSupported
+	}
+	if err := changer.ChangeRole(userIdentifier, newRole); err != nil {
+		return err
+	}
+	a.publish(stores.InvalidateRole, userIdentifier)
+	return nil
+}
+
+// ChangePassword replaces the password of a user after checking the current one, if the store
+// supports updating users. With token_versions enabled in the store config, every token issued
+// before is revoked, see BumpTokenVersion. With password_history set, ErrPasswordReused is
+// returned for a password among the last ones of the user.
+func (a *Authify) ChangePassword(userIdentifier, currentPassword, newPassword string) error {
+	updater, ok := a.Store.(stores.UserUpdater)
+	if !ok {
+		return stores.ErrUpdatesNotSupported
+	}
+	if err := a.validateCredentials(userIdentifier, newPassword); err != nil {
+		return err
+	}
+	if _, err := a.Store.GetUserInfo(userIdentifier, currentPassword); err != nil {
+		return err
+	}
+	var err error
+	if historian, ok := a.Store.(stores.PasswordHistorian); ok {
+		err = historian.ReplacePassword(userIdentifier, newPassword)
+	} else {
+		err = updater.UpdateUser(userIdentifier, map[string]any{a.Store.StoreConfig().PasswordColumn(): newPassword})
+	}
+	if err != nil {
+		return err
+	}
+	a.publish(stores.InvalidatePassword, userIdentifier)
+	return nil
+}
+
+// BumpTokenVersion revokes every token issued to a user so far, to log them out everywhere.
+// It requires token_versions in the store config. Access tokens are only rejected by managers
+// verifying them against the store, WithStrictVerification for JWTs, while refreshes always are.
+func (a *Authify) BumpTokenVersion(userIdentifier string) error {
+	versioner, ok := a.Store.(stores.TokenVersioner)
+	if !ok {
+		return stores.ErrTokenVersionsDisabled
+	}
+	if err := versioner.BumpTokenVersion(userIdentifier); err != nil {
+		return err
+	}
+	a.publish(stores.InvalidateTokenVersion, userIdentifier)
+	return nil
+}
+
+// Logout verifies an access token and revokes it, along with refreshToken unless empty, which
+// must have been issued to the same user. Single tokens can only be revoked by token managers
+// implementing token.Revoker, opaque tokens, ErrRevocationNotSupported is returned otherwise.
+// With everywhere, every token of the user is revoked instead, see BumpTokenVersion.
+func (a *Authify) Logout(accessToken, refreshToken string, everywhere bool) error {
+	claims, err := a.AuthenticateClaims(accessToken)
+	if err != nil {
+		return err
+	}
+	username, err := a.Tokens.UserIdentifier(claims)
+	if err != nil {
+		return err
+	}
+	err = a.logout(username, accessToken, refreshToken, everywhere)
+	a.audit(stores.EventLogout, username, "", err)
+	return err
+}
+
+// LogoutContext ends the session of a refresh token by revoking it, without the access token
+// issued along with it, which stays valid until it expires. Single tokens can only be revoked
+// by token managers implementing token.Revoker, ErrRevocationNotSupported is returned otherwise.
+func (a *Authify) LogoutContext(ctx context.Context, refreshToken string) error {
+	revoker, ok := a.Tokens.(token.Revoker)
+	if !ok {
+		return ErrRevocationNotSupported
+	}
+	claims, err := a.Tokens.VerifyRefreshToken(refreshToken)
+	if err != nil {
+		return err
+	}
+	username, err := a.Tokens.UserIdentifier(claims)
+	if err != nil {
+		return err
+	}
+	err = revoker.RevokeToken(refreshToken)
+	a.auditContext(ctx, stores.EventLogout, username, "", err)
+	return err
+}
+
+func (a *Authify) logout(username, accessToken, refreshToken string, everywhere bool) error {
+	if everywhere {
+		return a.BumpTokenVersion(username)
+	}
+
+	revoker, ok := a.Tokens.(token.Revoker)
+	if !ok {
+		return ErrRevocationNotSupported
+	}
+	if refreshToken != "" {
+		refreshClaims, err := a.Tokens.VerifyRefreshToken(refreshToken)
+		if err != nil {
+			return err
+		}
+		if owner, err := a.Tokens.UserIdentifier(refreshClaims); err != nil || owner != username {
+			return fmt.Errorf("%w: refresh token was issued to another user", ErrInvalidToken)
+		}
+		if err := revoker.RevokeToken(refreshToken); err != nil {
+			return err
+		}
+	}
+	return revoker.RevokeToken(accessToken)
+}
+
+// InvalidateAllTokens rejects every access and refresh token issued so far, e.g. after a
+// suspected leak of the secrets, without rotating them. Users and service accounts have to
+// log in again. It returns the new global not-before time, and fails with
+// ErrRevocationNotSupported when the token manager is not a token.GlobalInvalidator.
+func (a *Authify) InvalidateAllTokens() (time.Time, error) {
+	invalidator, ok := a.Tokens.(token.GlobalInvalidator)
+	if !ok {
+		return time.Time{}, ErrRevocationNotSupported
+	}
+	notBefore, err := invalidator.InvalidateAllTokens()
+	if err != nil {
+		return time.Time{}, err
+	}
+	a.publish(stores.InvalidateNotBefore, "")
+	return notBefore, nil
+}
+
+// RotateSecrets replaces the secrets signing access and refresh tokens without a restart. With
+// keepOld, tokens signed with the replaced secrets stay valid for a grace window, without it they
+// are rejected at once. It fails with ErrRotationNotSupported when the token manager is not a
+// token.SecretRotator, see token.JWTManager.RotateSecrets.
+func (a *Authify) RotateSecrets(newAccess, newRefresh string, keepOld bool) error {
+	rotator, ok := a.Tokens.(token.SecretRotator)
+	if !ok {
+		return ErrRotationNotSupported
+	}
+	return rotator.RotateSecrets(newAccess, newRefresh, keepOld)
+}
+
+// SetUserDisabled suspends or reactivates a user, if the store supports it.
+// Disabled users can no longer log in or refresh their tokens.
+func (a *Authify) SetUserDisabled(userIdentifier string, disabled bool) error {
+	disabler, ok := a.Store.(stores.UserDisabler)
+	if !ok {
+		return stores.ErrDisablingNotSupported
+	}
+	if err := disabler.SetUserDisabled(userIdentifier, disabled); err != nil {
+		return err
 	}
+	a.publish(stores.InvalidateStatus, userIdentifier)
+	return nil
 }
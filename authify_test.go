@@ -1,11 +1,23 @@
 package authify
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/HassanAli101/authify/stores"
 	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 var testStoreConfig = stores.StoreConfig{
@@ -88,7 +100,7 @@ func setupAuthify() *Authify {
 
 	a := NewAuthify(memStore, jwtManager)
 
-	_ = a.Store.CreateUser(map[string]any{
+	_, _ = a.Store.CreateUser(map[string]any{
 		"username": "alice",
 		"password": "password123",
 		"role":     "user",
@@ -102,7 +114,7 @@ func setupAuthify() *Authify {
 func TestCreateUser(t *testing.T) {
 	a := setupAuthify()
 
-	err := a.Store.CreateUser(map[string]any{
+	_, err := a.Store.CreateUser(map[string]any{
 		"username": "bob",
 		"password": "securepass",
 		"role":     "admin",
@@ -174,6 +186,166 @@ func TestTamperedToken(t *testing.T) {
 	}
 }
 
+// lookupCountingStore counts the account status lookups of strict verification
+type lookupCountingStore struct {
+	*stores.InMemoryUserStore
+	disabledLookups atomic.Int32
+}
+
+func (s *lookupCountingStore) IsUserDisabled(username string) (bool, error) {
+	s.disabledLookups.Add(1)
+	return s.InMemoryUserStore.IsUserDisabled(username)
+}
+
+func TestVerifyTokens(t *testing.T) {
+	store := &lookupCountingStore{InMemoryUserStore: stores.NewInMemoryUserStore(testStoreConfig)}
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(store).
+		WithConfig(testTokenConfig).
+		WithStrictVerification(true).
+		WithVerifyWorkers(2).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	a := NewAuthify(store, jwtManager)
+	for _, user := range []map[string]any{
+		{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"},
+		{"username": "bob", "password": "password123", "role": "admin", "email": "bob@example.com"},
+	} {
+		if _, err := a.Store.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tokens []string
+	for _, username := range []string{"alice", "bob", "alice", "bob", "alice"} {
+		tokenStr, err := a.Tokens.GenerateAccessToken(username, "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tokenStr)
+	}
+	tokens = append(tokens, "not-a-token")
+
+	results := jwtManager.VerifyTokens(tokens)
+	if len(results) != len(tokens) {
+		t.Fatalf("expected %d results, got %d", len(tokens), len(results))
+	}
+	for i, want := range []struct{ username, role string }{{"alice", "user"}, {"bob", "admin"}, {"alice", "user"}, {"bob", "admin"}, {"alice", "user"}} {
+		if got := results[i]; got.Err != nil || got.Username != want.username || got.Role != want.role {
+			t.Errorf("token %d: expected %s with role %s, got %+v", i, want.username, want.role, got)
+		}
+	}
+	if !errors.Is(results[5].Err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for the malformed token, got %v", results[5].Err)
+	}
+	// the status of each user is looked up once for the whole batch
+	if got := store.disabledLookups.Load(); got != 2 {
+		t.Errorf("expected 2 account status lookups, got %d", got)
+	}
+
+	if err := a.SetUserDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	results = jwtManager.VerifyTokens(tokens[:2])
+	if results[0].Err != nil || !errors.Is(results[1].Err, ErrAccountDisabled) {
+		t.Errorf("expected only the token of the disabled user to be rejected, got %v and %v", results[0].Err, results[1].Err)
+	}
+	if results := jwtManager.VerifyTokens(nil); len(results) != 0 {
+		t.Errorf("expected no results for no tokens, got %d", len(results))
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	newManager := func(access, refresh, threshold time.Duration) *token.JWTManager {
+		jwtManager, err := token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(testTokenConfig).
+			WithSlidingExpiration(threshold).
+			Build()
+		if err != nil {
+			t.Fatalf("failed to build manager: %v", err)
+		}
+		if err := jwtManager.SetDurations(access, refresh); err != nil {
+			t.Fatal(err)
+		}
+		return jwtManager
+	}
+	expiry := func(tokenStr string) time.Time {
+		t.Helper()
+		claims := jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(tokenStr, claims); err != nil {
+			t.Fatal(err)
+		}
+		exp, _ := claims.GetExpirationTime()
+		return exp.Time
+	}
+
+	// tokens issued for a minute, within a session of 5 minutes
+	issuer := newManager(time.Minute, 5*time.Minute, time.Second)
+	accessToken, err := issuer.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestData := map[string]any{"ip": "127.0.0.1", "user_agent": "test"}
+	refreshToken, err := issuer.GenerateRefreshToken("alice", requestData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replicas verifying them with 10 minute access tokens and thresholds around the minute left
+	if _, replacement, err := newManager(10*time.Minute, time.Hour, 55*time.Second).VerifyAccessTokenSliding(accessToken); err != nil || replacement != "" {
+		t.Errorf("expected no replacement above the threshold, got %q (%v)", replacement, err)
+	}
+	claims, replacement, err := newManager(10*time.Minute, time.Hour, 65*time.Second).VerifyAccessTokenSliding(accessToken)
+	if err != nil || replacement == "" {
+		t.Fatalf("expected a replacement below the threshold, got %q (%v)", replacement, err)
+	}
+	if claims["username"] != "alice" {
+		t.Errorf("expected the claims of the verified token, got %v", claims)
+	}
+	replaced := expiry(replacement)
+	if !replaced.After(expiry(accessToken)) {
+		t.Errorf("expected the replacement to outlive the token, got %v", replaced)
+	}
+	// the 10 minutes are cut short at the end of the session
+	if replaced.After(expiry(refreshToken)) {
+		t.Errorf("expected the replacement to expire by the refresh token at %v, got %v", expiry(refreshToken), replaced)
+	}
+
+	// tokens issued without sliding do not know when their session ends
+	plain, _ := newManager(time.Minute, 5*time.Minute, 0).GenerateAccessToken("alice", "password123")
+	if _, replacement, _ := newManager(10*time.Minute, time.Hour, 65*time.Second).VerifyAccessTokenSliding(plain); replacement != "" {
+		t.Error("expected tokens without a session expiry to be kept")
+	}
+	// nor are tokens whose session ends before them
+	short, _ := newManager(time.Minute, 30*time.Second, time.Second).GenerateAccessToken("alice", "password123")
+	if _, replacement, _ := newManager(10*time.Minute, time.Hour, 65*time.Second).VerifyAccessTokenSliding(short); replacement != "" {
+		t.Error("expected no replacement past the end of the session")
+	}
+
+	// refreshed tokens carry the expiry of the refresh token
+	_, refreshedClaims, err := issuer.RefreshToken(accessToken, refreshToken, requestData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := refreshedClaims[token.ClaimSessionExpiry]; got != expiry(refreshToken).Unix() {
+		t.Errorf("expected the session to end with the refresh token at %d, got %v", expiry(refreshToken).Unix(), got)
+	}
+
+	a := NewAuthify(memStore, newManager(10*time.Minute, time.Hour, 65*time.Second))
+	if _, replacement, err := a.AuthenticateSliding(accessToken); err != nil || replacement == "" {
+		t.Errorf("expected AuthenticateSliding to replace the token, got %q (%v)", replacement, err)
+	}
+}
+
 // ----------------- Token Refresh Tests -----------------
 func TestRefreshAccessToken(t *testing.T) {
 	a := setupAuthify()
@@ -194,6 +366,146 @@ func TestRefreshAccessToken(t *testing.T) {
 	}
 }
 
+func TestRefreshResolvesClaimsFromStore(t *testing.T) {
+	a := setupScopedAuthify(t, map[string][]string{"admin": {"users:read", "users:write"}, "user": {"users:read"}}, false)
+	access, refresh, err := a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	refreshed := func(t *testing.T, access string) jwt.MapClaims {
+		t.Helper()
+		newAccess, _, err := a.Tokens.RefreshToken(access, refresh, nil)
+		if err != nil {
+			t.Fatalf("failed to refresh: %v", err)
+		}
+		claims, err := a.Tokens.VerifyAccessToken(newAccess)
+		if err != nil {
+			t.Fatalf("expected the refreshed token to verify, got %v", err)
+		}
+		return claims
+	}
+
+	// without the access token, e.g. the refresh_token grant of OAuth2
+	claims := refreshed(t, "")
+	if claims["role"] != "admin" || claims["email"] != "alice@example.com" || claims[token.ClaimScope] != "users:read users:write" {
+		t.Errorf("expected the claims of the store, got %v", claims)
+	}
+
+	if err := a.ChangeRole("alice", "user"); err != nil {
+		t.Fatal(err)
+	}
+	claims = refreshed(t, access)
+	if claims["role"] != "user" || claims[token.ClaimScope] != "users:read" {
+		t.Errorf("expected the role and scopes of a demoted user to follow the store, got %v and %v", claims["role"], claims[token.ClaimScope])
+	}
+}
+
+func TestRefreshDeduplication(t *testing.T) {
+	a := setupAuthify()
+	manager := a.Tokens.(*token.JWTManager)
+	access, refreshToken, _ := a.Login("alice", "password123", stores.DeviceInfo{})
+
+	var wg sync.WaitGroup
+	refreshed := make([]string, 50)
+	for i := range refreshed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newAccess, claims, err := a.Tokens.RefreshToken(access, refreshToken, map[string]any{})
+			if err != nil || claims["username"] != "alice" {
+				t.Errorf("failed to refresh token: %v %v", claims, err)
+			}
+			refreshed[i] = newAccess
+		}()
+	}
+	wg.Wait()
+
+	if n := manager.DeduplicatedRefreshes(); n != 49 {
+		t.Errorf("expected a single refresh to mint a token and 49 to be deduplicated, got %d deduplicated", n)
+	}
+	for _, newAccess := range refreshed {
+		if newAccess != refreshed[0] {
+			t.Fatalf("expected every caller to get the same access token")
+		}
+	}
+	if _, err := a.Tokens.VerifyAccessToken(refreshed[0]); err != nil {
+		t.Errorf("expected the refreshed token to be valid, got %v", err)
+	}
+
+	// late duplicates within the window get the same token, other refresh tokens a new one
+	if newAccess, _, _ := a.Tokens.RefreshToken(access, refreshToken, map[string]any{}); newAccess != refreshed[0] {
+		t.Errorf("expected a late duplicate to get the same access token")
+	}
+	otherRefreshToken, _ := a.Tokens.GenerateRefreshToken("alice", map[string]any{"ip": "10.0.0.1", "user_agent": "other-device"})
+	before := manager.DeduplicatedRefreshes()
+	if _, _, err := a.Tokens.RefreshToken(access, otherRefreshToken, map[string]any{}); err != nil {
+		t.Fatalf("failed to refresh token: %v", err)
+	}
+	if manager.DeduplicatedRefreshes() != before {
+		t.Errorf("expected the refresh of another refresh token not to be deduplicated")
+	}
+
+	manager.WithRefreshDedupWindow(0)
+	access, refreshToken, _ = a.Login("alice", "password123", stores.DeviceInfo{})
+	before = manager.DeduplicatedRefreshes()
+	a.Tokens.RefreshToken(access, refreshToken, map[string]any{})
+	a.Tokens.RefreshToken(access, refreshToken, map[string]any{})
+	if manager.DeduplicatedRefreshes() != before {
+		t.Errorf("expected no deduplication with a zero window")
+	}
+}
+
+func TestRefreshTokenBinding(t *testing.T) {
+	newAuthify := func(mode token.BindingMode) *Authify {
+		a := setupAuthify()
+		manager := a.Tokens.(*token.JWTManager)
+		manager.WithBindingMode(mode).WithRefreshDedupWindow(0)
+		return a
+	}
+	refresh := func(a *Authify, ip, deviceID string, device stores.DeviceInfo) error {
+		access, refreshToken, err := a.Login("alice", "password123", device)
+		if err != nil {
+			t.Fatalf("failed to log in: %v", err)
+		}
+		_, _, err = a.Tokens.RefreshToken(access, refreshToken, map[string]any{"ip": ip, token.RequestDeviceID: deviceID})
+		return err
+	}
+	phone := stores.DeviceInfo{IP: "10.0.0.1", DeviceID: "phone-1"}
+
+	tests := []struct {
+		name     string
+		mode     token.BindingMode
+		ip       string
+		deviceID string
+		device   stores.DeviceInfo
+		want     error
+	}{
+		{"device binding, new network", token.DeviceBinding, "10.9.9.9", "phone-1", phone, nil},
+		{"device binding, other device", token.DeviceBinding, "10.0.0.1", "phone-2", phone, ErrBindingMismatch},
+		{"device binding, no fingerprint at login", token.DeviceBinding, "10.0.0.1", "phone-2", stores.DeviceInfo{IP: "10.0.0.1"}, nil},
+		{"ip binding, same address", token.IPBinding, "10.0.0.1", "", phone, nil},
+		{"ip binding, new network", token.IPBinding, "10.9.9.9", "phone-1", phone, ErrBindingMismatch},
+		{"no binding", token.NoBinding, "10.9.9.9", "phone-2", phone, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := refresh(newAuthify(tt.mode), tt.ip, tt.deviceID, tt.device); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	a := newAuthify(token.DeviceBinding)
+	_, refreshToken, _ := a.Login("alice", "password123", phone)
+	claims, _ := a.Tokens.VerifyRefreshToken(refreshToken)
+	if bound, _ := claims[token.ClaimBinding].(string); bound == "" || strings.Contains(bound, "phone-1") {
+		t.Errorf("expected the bind claim to hold a hash of the fingerprint, got %q", bound)
+	}
+	if code := ErrorCode(ErrBindingMismatch); code != CodeBindingMismatch {
+		t.Errorf("expected %q, got %q", CodeBindingMismatch, code)
+	}
+}
+
 // ----------------- Expired Token Tests -----------------
 func TestExpiredAccessToken(t *testing.T) {
 	memStore := stores.NewInMemoryUserStore(testStoreConfig)
@@ -207,7 +519,7 @@ func TestExpiredAccessToken(t *testing.T) {
 
 	a := NewAuthify(memStore, shortJWT)
 
-	_ = a.Store.CreateUser(map[string]any{
+	_, _ = a.Store.CreateUser(map[string]any{
 		"username": "alice",
 		"password": "password123",
 	})
@@ -234,7 +546,7 @@ func TestAutoRefreshExpiredToken(t *testing.T) {
 
 	a := NewAuthify(memStore, shortJWT)
 
-	_ = a.Store.CreateUser(map[string]any{
+	_, _ = a.Store.CreateUser(map[string]any{
 		"username": "alice",
 		"password": "password123",
 		"email":    "alice@example.com",
@@ -262,3 +574,2377 @@ func TestAutoRefreshExpiredToken(t *testing.T) {
 		t.Errorf("refreshed token missing expected claims: %v", claims)
 	}
 }
+
+// ----------------- Password Hasher Tests -----------------
+func TestArgon2idPasswordHasher(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.PasswordHasher = stores.HasherArgon2id
+	memStore := stores.NewInMemoryUserStore(cfg)
+
+	_, err := memStore.CreateUser(map[string]any{
+		"username": "carol",
+		"password": "argonpass",
+	})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	if _, err := memStore.GetUserInfo("carol", "argonpass"); err != nil {
+		t.Fatalf("failed to authenticate argon2id user: %v", err)
+	}
+	if _, err := memStore.GetUserInfo("carol", "wrongpass"); !errors.Is(err, stores.ErrInvalidPassword) {
+		t.Errorf("expected ErrInvalidPassword, got %v", err)
+	}
+
+	// hashes are self-describing, so switching hashers keeps old users working
+	memStore.WithPasswordHasher(stores.BcryptHasher{})
+	if _, err := memStore.GetUserInfo("carol", "argonpass"); err != nil {
+		t.Errorf("failed to authenticate argon2id user after switching hasher: %v", err)
+	}
+}
+
+// countingHasher records how many hashes it produced, to observe rehashing
+type countingHasher struct {
+	stores.BcryptHasher
+	hashed int
+}
+
+func (h *countingHasher) Hash(password string) (string, error) {
+	h.hashed++
+	return h.BcryptHasher.Hash(password)
+}
+
+func TestRehashOnLoginWhenCostIncreases(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig).
+		WithPasswordHasher(stores.BcryptHasher{Cost: 4})
+
+	_, _ = memStore.CreateUser(map[string]any{
+		"username": "dave",
+		"password": "password123",
+	})
+
+	stronger := &countingHasher{BcryptHasher: stores.BcryptHasher{Cost: 5}}
+	memStore.WithPasswordHasher(stronger)
+
+	for i := 0; i < 2; i++ {
+		if _, err := memStore.GetUserInfo("dave", "password123"); err != nil {
+			t.Fatalf("login %d failed: %v", i+1, err)
+		}
+	}
+
+	if stronger.hashed != 1 {
+		t.Errorf("expected the weak hash to be upgraded exactly once, got %d rehashes", stronger.hashed)
+	}
+}
+
+// blockingHasher holds every hash until release is closed
+type blockingHasher struct {
+	stores.BcryptHasher
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHasher) Hash(password string) (string, error) {
+	h.started <- struct{}{}
+	<-h.release
+	return h.BcryptHasher.Hash(password)
+}
+
+func TestLimitedHasherSaturation(t *testing.T) {
+	blocking := &blockingHasher{
+		BcryptHasher: stores.BcryptHasher{Cost: 4},
+		started:      make(chan struct{}, 1),
+		release:      make(chan struct{}),
+	}
+	limited := stores.NewLimitedHasher(blocking, 1, 0, 50*time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := limited.HashContext(context.Background(), "password123")
+		done <- err
+	}()
+	<-blocking.started
+
+	// the only slot is taken and there is no queue, so the next hash is rejected right away
+	if _, err := limited.Hash("password123"); !errors.Is(err, ErrHashingBusy) {
+		t.Errorf("expected ErrHashingBusy on a saturated pool, got %v", err)
+	}
+
+	// the in-flight hash outlives its timeout, the caller gives up while the slot stays busy
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the blocked hash to time out, got %v", err)
+	}
+	close(blocking.release)
+
+	memStore := stores.NewInMemoryUserStore(testStoreConfig).WithPasswordHasher(
+		stores.NewLimitedHasher(stores.BcryptHasher{Cost: 4}, 1, 1, time.Second))
+	if _, err := memStore.CreateUserContext(context.Background(), map[string]any{
+		"username": "erin",
+		"password": "password123",
+	}); err != nil {
+		t.Fatalf("failed to create user through the limited hasher: %v", err)
+	}
+	if _, err := memStore.GetUserInfo("erin", "password123"); err != nil {
+		t.Errorf("failed to authenticate through the limited hasher: %v", err)
+	}
+}
+
+// ----------------- Generated Columns Tests -----------------
+func TestCreateUserReturningGeneratedColumns(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.Columns = maps.Clone(testStoreConfig.Columns)
+	cfg.Columns["id"] = stores.ColumnConfig{Type: "uuid", Default: stores.DefaultGenerateUUID}
+	cfg.Columns["created_at"] = stores.ColumnConfig{Type: "timestamp", Default: stores.DefaultCurrentTimestamp}
+
+	memStore := stores.NewInMemoryUserStore(cfg)
+
+	created, err := memStore.CreateUserReturning(map[string]any{
+		"username": "erin",
+		"password": "password123",
+	})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	if len(created["id"]) != 36 || strings.Count(created["id"], "-") != 4 {
+		t.Errorf("expected generated uuid, got %q", created["id"])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, created["created_at"]); err != nil {
+		t.Errorf("expected generated timestamp, got %q: %v", created["created_at"], err)
+	}
+	if created["role"] != "user" {
+		t.Errorf("expected default role, got %q", created["role"])
+	}
+	if _, ok := created["password"]; ok {
+		t.Errorf("hidden password column must not be returned")
+	}
+}
+
+// ----------------- Scope Tests -----------------
+func setupScopedAuthify(t *testing.T, rolePermissions map[string][]string, permissionsColumn bool) *Authify {
+	t.Helper()
+
+	cfg := testStoreConfig
+	cfg.RolePermissions = rolePermissions
+	cfg.Columns = maps.Clone(testStoreConfig.Columns)
+	if permissionsColumn {
+		cfg.Columns["permissions"] = stores.ColumnConfig{Type: "text", IsPermissions: true}
+	}
+	memStore := stores.NewInMemoryUserStore(cfg)
+
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(testTokenConfig).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+
+	_, _ = memStore.CreateUser(map[string]any{
+		"username":    "alice",
+		"password":    "password123",
+		"role":        "admin",
+		"email":       "alice@example.com",
+		"permissions": "billing:write, reports:read",
+	})
+
+	return NewAuthify(memStore, jwtManager)
+}
+
+func TestScopes(t *testing.T) {
+	rolePermissions := map[string][]string{
+		"admin": {"users:read", "users:write", "reports:read"},
+	}
+
+	cases := []struct {
+		name              string
+		rolePermissions   map[string][]string
+		permissionsColumn bool
+		want              []string
+	}{
+		{"role mapping", rolePermissions, false, []string{"users:read", "users:write", "reports:read"}},
+		{"permissions column", nil, true, []string{"billing:write", "reports:read"}},
+		{"combined", rolePermissions, true, []string{"users:read", "users:write", "reports:read", "billing:write"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := setupScopedAuthify(t, tc.rolePermissions, tc.permissionsColumn)
+
+			tokenStr, err := a.Tokens.GenerateAccessToken("alice", "password123")
+			if err != nil {
+				t.Fatalf("failed to generate access token: %v", err)
+			}
+			claims, err := a.Tokens.VerifyAccessToken(tokenStr)
+			if err != nil {
+				t.Fatalf("failed to verify access token: %v", err)
+			}
+
+			if got := token.ScopesFromClaims(claims); !slices.Equal(got, tc.want) {
+				t.Errorf("expected scopes %v, got %v", tc.want, got)
+			}
+			if err := a.Tokens.VerifyTokenWithScope(tokenStr, tc.want...); err != nil {
+				t.Errorf("expected granted scopes to pass, got %v", err)
+			}
+			if err := a.Tokens.VerifyTokenWithScope(tokenStr, "users:delete"); !errors.Is(err, token.ErrInsufficientScope) {
+				t.Errorf("expected ErrInsufficientScope, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	cases := []struct {
+		name  string
+		scope any
+		want  bool
+	}{
+		{"space delimited", "users:read users:write", true},
+		{"array", []any{"users:read", "users:write"}, true},
+		{"string array", []string{"users:write"}, true},
+		{"missing", "users:read", false},
+		{"no scope", nil, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"username": "alice"}
+			if tc.scope != nil {
+				claims[token.ClaimScope] = tc.scope
+			}
+			if got := HasScope(claims, "users:write"); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// ----------------- Account Status Tests -----------------
+func TestDisableUserMidSession(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(testTokenConfig).
+		WithStrictVerification(true).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	a := NewAuthify(memStore, jwtManager)
+
+	_, _ = a.Store.CreateUser(map[string]any{
+		"username": "alice",
+		"password": "password123",
+		"email":    "alice@example.com",
+	})
+
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	refreshData := map[string]any{
+		"ip":         "127.0.0.1",
+		"user_agent": "unit-test",
+	}
+	refreshToken, err := a.Tokens.GenerateRefreshToken("alice", refreshData)
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+
+	if err := a.SetUserDisabled("alice", true); err != nil {
+		t.Fatalf("failed to disable user: %v", err)
+	}
+
+	if _, err := a.Tokens.VerifyAccessToken(accessToken); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("expected strict verification to reject a disabled user, got %v", err)
+	}
+	if _, _, err := a.Tokens.RefreshToken(accessToken, refreshToken, refreshData); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("expected refresh to fail for a disabled user, got %v", err)
+	}
+	if _, err := a.Tokens.GenerateAccessToken("alice", "password123"); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("expected login to fail for a disabled user, got %v", err)
+	}
+	// a wrong password is still reported as such, without revealing the account status
+	if _, err := a.Tokens.GenerateAccessToken("alice", "wrong"); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("expected ErrInvalidPassword for a wrong password, got %v", err)
+	}
+
+	if err := a.SetUserDisabled("alice", false); err != nil {
+		t.Fatalf("failed to enable user: %v", err)
+	}
+
+	if _, err := a.Tokens.GenerateAccessToken("alice", "password123"); err != nil {
+		t.Errorf("expected login to work again after re-enabling, got %v", err)
+	}
+	if _, _, err := a.Tokens.RefreshToken(accessToken, refreshToken, refreshData); err != nil {
+		t.Errorf("expected refresh to work again after re-enabling, got %v", err)
+	}
+}
+
+func TestDisabledUserTokenWithoutStrictVerification(t *testing.T) {
+	a := setupAuthify()
+
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	if err := a.SetUserDisabled("alice", true); err != nil {
+		t.Fatalf("failed to disable user: %v", err)
+	}
+
+	// without strict mode, issued access tokens stay valid until they expire
+	if _, err := a.Tokens.VerifyAccessToken(accessToken); err != nil {
+		t.Errorf("expected non-strict verification to accept the token, got %v", err)
+	}
+	if err := a.SetUserDisabled("bob", true); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound for an unknown user, got %v", err)
+	}
+}
+
+// ----------------- Role Tests -----------------
+func TestTokenVersions(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.TokenVersions = true
+	memStore := stores.NewInMemoryUserStore(cfg)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"})
+	newManager := func(strict bool) *token.JWTManager {
+		m, err := token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(testTokenConfig).
+			WithStrictVerification(strict).
+			Build()
+		if err != nil {
+			t.Fatalf("failed to build jwt manager: %v", err)
+		}
+		return m
+	}
+	a := NewAuthify(memStore, newManager(true))
+	stateless := newManager(false)
+
+	login := func(password string) (string, string) {
+		t.Helper()
+		accessToken, refreshToken, err := a.Login("alice", password, stores.DeviceInfo{})
+		if err != nil {
+			t.Fatalf("failed to log in: %v", err)
+		}
+		return accessToken, refreshToken
+	}
+	assertRevoked := func(accessToken, refreshToken string) {
+		t.Helper()
+		if _, err := a.Tokens.VerifyAccessToken(accessToken); !errors.Is(err, ErrTokenVersionMismatch) {
+			t.Errorf("expected ErrTokenVersionMismatch for the access token, got %v", err)
+		}
+		if _, _, err := a.Tokens.RefreshToken(accessToken, refreshToken, nil); !errors.Is(err, ErrTokenVersionMismatch) {
+			t.Errorf("expected ErrTokenVersionMismatch for the refresh token, got %v", err)
+		}
+		// without strict verification access tokens are not looked up, until they expire
+		if _, err := stateless.VerifyAccessToken(accessToken); err != nil {
+			t.Errorf("expected a stateless verification to skip the token version, got %v", err)
+		}
+	}
+
+	accessToken, refreshToken := login("password123")
+	claims, err := a.Tokens.VerifyAccessToken(accessToken)
+	if err != nil || claims[token.ClaimTokenVersion] != float64(0) {
+		t.Fatalf("expected a valid token with version 0, got %v %v", claims, err)
+	}
+	refreshed, _, err := a.Tokens.RefreshToken(accessToken, refreshToken, nil)
+	if err != nil {
+		t.Fatalf("failed to refresh token: %v", err)
+	}
+	if _, err := a.Tokens.VerifyAccessToken(refreshed); err != nil {
+		t.Errorf("expected the refreshed token to be valid, got %v", err)
+	}
+
+	if err := a.ChangePassword("alice", "wrong", "new-password"); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("expected ErrInvalidPassword for a wrong current password, got %v", err)
+	}
+	if err := a.ChangePassword("alice", "password123", "new-password"); err != nil {
+		t.Fatalf("failed to change password: %v", err)
+	}
+	assertRevoked(accessToken, refreshToken)
+	assertRevoked(refreshed, refreshToken)
+
+	accessToken, refreshToken = login("new-password")
+	if _, err := a.Tokens.VerifyAccessToken(accessToken); err != nil {
+		t.Errorf("expected a new login to be valid, got %v", err)
+	}
+	if err := a.BumpTokenVersion("alice"); err != nil {
+		t.Fatalf("failed to bump token version: %v", err)
+	}
+	assertRevoked(accessToken, refreshToken)
+
+	if err := setupAuthify().BumpTokenVersion("alice"); !errors.Is(err, stores.ErrTokenVersionsDisabled) {
+		t.Errorf("expected ErrTokenVersionsDisabled without token_versions, got %v", err)
+	}
+}
+
+func TestChangePasswordHistory(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.PasswordHistory = 2
+	memStore := stores.NewInMemoryUserStore(cfg)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"})
+	a := NewAuthify(memStore, token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour))
+
+	if err := a.ChangePassword("alice", "password123", "password123"); !errors.Is(err, ErrPasswordReused) {
+		t.Errorf("expected ErrPasswordReused for the current password, got %v", err)
+	}
+	if err := a.ChangePassword("alice", "password123", "new-password"); err != nil {
+		t.Fatalf("failed to change password: %v", err)
+	}
+	err := a.ChangePassword("alice", "new-password", "password123")
+	if !errors.Is(err, ErrPasswordReused) || ErrorCode(err) != CodePasswordReused {
+		t.Errorf("expected ErrPasswordReused for the previous password, got %v", err)
+	}
+	if err := a.ChangePassword("alice", "new-password", "newer-password"); err != nil {
+		t.Fatalf("failed to change password: %v", err)
+	}
+	if err := a.ChangePassword("alice", "newer-password", "password123"); err != nil {
+		t.Errorf("expected a password out of the history to be accepted, got %v", err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	for _, username := range []string{"alice", "bob"} {
+		_, _ = memStore.CreateUser(map[string]any{"username": username, "password": "password123", "email": username + "@example.com"})
+	}
+	a := NewAuthify(memStore, token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour).WithStore(memStore))
+
+	accessToken, refreshToken, err := a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	_, otherRefreshToken, _ := a.Login("bob", "password123", stores.DeviceInfo{})
+	if err := a.Logout(accessToken, otherRefreshToken, false); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for the refresh token of another user, got %v", err)
+	}
+
+	if err := a.Logout(accessToken, refreshToken, false); err != nil {
+		t.Fatalf("failed to log out: %v", err)
+	}
+	if _, err := a.Tokens.VerifyAccessToken(accessToken); err == nil {
+		t.Errorf("expected the access token to be revoked")
+	}
+	if _, err := a.Tokens.VerifyRefreshToken(refreshToken); err == nil {
+		t.Errorf("expected the refresh token to be revoked")
+	}
+	if err := a.Logout(accessToken, "", false); err == nil {
+		t.Errorf("expected a revoked token to be rejected")
+	}
+
+	jwtAuthify := setupAuthify()
+	accessToken, refreshToken, _ = jwtAuthify.Login("alice", "password123", stores.DeviceInfo{})
+	if err := jwtAuthify.Logout(accessToken, refreshToken, false); !errors.Is(err, ErrRevocationNotSupported) {
+		t.Errorf("expected ErrRevocationNotSupported for JWTs, got %v", err)
+	}
+	if err := jwtAuthify.Logout(accessToken, refreshToken, true); !errors.Is(err, ErrTokenVersionsDisabled) {
+		t.Errorf("expected ErrTokenVersionsDisabled without token_versions, got %v", err)
+	}
+	if code := ErrorCode(ErrRevocationNotSupported); code != CodeNotSupported {
+		t.Errorf("expected %q, got %q", CodeNotSupported, code)
+	}
+}
+
+func TestLoginContext(t *testing.T) {
+	a := setupAuthify()
+	_, _ = a.Store.CreateUser(map[string]any{"username": "bob", "password": "password123", "role": "user", "email": "bob@example.com"})
+	if err := a.SetUserDisabled("bob", true); err != nil {
+		t.Fatalf("failed to disable bob: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		expected error
+	}{
+		{"wrong password", "alice", "wrongpassword", ErrInvalidCredentials},
+		{"unknown user", "carol", "password123", ErrInvalidCredentials},
+		{"empty password", "alice", "", ErrInvalidCredentials},
+		{"disabled user", "bob", "password123", ErrAccountDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair, err := a.LoginContext(context.Background(), tt.username, tt.password, stores.DeviceInfo{})
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, err)
+			}
+			if pair != nil {
+				t.Errorf("expected no tokens, got %+v", pair)
+			}
+		})
+	}
+
+	before := time.Now().Truncate(time.Second)
+	pair, err := a.LoginContext(context.Background(), "alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if _, err := a.Tokens.VerifyAccessToken(pair.AccessToken); err != nil {
+		t.Errorf("expected a valid access token, got %v", err)
+	}
+	if expected := before.Add(testTokenConfig.AccessToken.Duration); pair.AccessExpiresAt.Before(expected) || pair.AccessExpiresAt.After(expected.Add(2*time.Second)) {
+		t.Errorf("expected the access token to expire around %v, got %v", expected, pair.AccessExpiresAt)
+	}
+	if expected := before.Add(testTokenConfig.RefreshToken.Duration); pair.RefreshExpiresAt.Before(expected) || pair.RefreshExpiresAt.After(expected.Add(2*time.Second)) {
+		t.Errorf("expected the refresh token to expire around %v, got %v", expected, pair.RefreshExpiresAt)
+	}
+}
+
+// requestOnlyTokens implements the request methods of token.TokenManager only, as a third-party
+// manager written against them would, with tokens naming their user
+type requestOnlyTokens struct {
+	token.UnimplementedTokenManager
+}
+
+var _ token.TokenManager = requestOnlyTokens{}
+
+func (requestOnlyTokens) IssueTokens(ctx context.Context, req token.GenerateTokensRequest) (*token.TokenPair, error) {
+	if req.Password != "password123" {
+		return nil, stores.ErrInvalidPassword
+	}
+	return &token.TokenPair{
+		AccessToken:  "access." + req.Username,
+		RefreshToken: "refresh." + req.Username,
+		AccessClaims: jwt.MapClaims{"username": req.Username},
+	}, nil
+}
+
+func (requestOnlyTokens) RefreshTokens(ctx context.Context, req token.RefreshTokensRequest) (*token.TokenPair, error) {
+	username, ok := strings.CutPrefix(req.RefreshToken, "refresh.")
+	if !ok {
+		return nil, token.ErrInvalidToken
+	}
+	return &token.TokenPair{AccessToken: "access." + username, RefreshToken: req.RefreshToken, AccessClaims: jwt.MapClaims{"username": username}}, nil
+}
+
+func (requestOnlyTokens) VerifyToken(ctx context.Context, req token.VerifyTokenRequest) (*token.VerifyTokenResponse, error) {
+	username, ok := strings.CutPrefix(req.Token, "access.")
+	if !ok || req.Refresh {
+		return nil, token.ErrInvalidToken
+	}
+	return &token.VerifyTokenResponse{Claims: jwt.MapClaims{"username": username, "role": "user"}}, nil
+}
+
+func TestRequestOnlyTokenManager(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	a := NewAuthify(memStore, requestOnlyTokens{}).WithSessionStore(stores.NewInMemorySessionStore())
+	ctx := context.Background()
+
+	pair, err := a.LoginContext(ctx, "alice", "password123", stores.DeviceInfo{})
+	if err != nil || pair.AccessToken != "access.alice" {
+		t.Fatalf("expected a login through IssueTokens, got %+v (%v)", pair, err)
+	}
+	if _, err := a.LoginContext(ctx, "alice", "wrongpassword", stores.DeviceInfo{}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+	refreshed, err := a.RefreshTokens(ctx, token.RefreshTokensRequest{RefreshToken: pair.RefreshToken})
+	if err != nil || refreshed.AccessToken != "access.alice" {
+		t.Errorf("expected a refresh through RefreshTokens, got %+v (%v)", refreshed, err)
+	}
+	if username, role, err := a.Authenticate(pair.AccessToken); err != nil || username != "alice" || role != "user" {
+		t.Errorf("expected alice to authenticate through VerifyToken, got %q %q (%v)", username, role, err)
+	}
+
+	// the narrow methods of the embedded UnimplementedTokenManager fail, rather than panic
+	if _, err := a.Tokens.GenerateAccessToken("alice", "password123"); !errors.Is(err, ErrNotImplemented) {
+		t.Errorf("expected ErrNotImplemented, got %v", err)
+	}
+	if _, _, err := a.RefreshToken("", pair.RefreshToken, nil); !errors.Is(err, ErrNotImplemented) {
+		t.Errorf("expected ErrNotImplemented from the deprecated refresh, got %v", err)
+	}
+}
+
+func TestIssueTokensRequest(t *testing.T) {
+	a := setupAuthify()
+	ctx := context.Background()
+
+	pair, err := a.IssueTokens(ctx, token.GenerateTokensRequest{
+		Username:    "alice",
+		Password:    "password123",
+		Tenant:      "acme",
+		ExtraClaims: map[string]any{"plan": "pro", "role": "admin", "username": "mallory"},
+	})
+	if err != nil {
+		t.Fatalf("failed to issue tokens: %v", err)
+	}
+	claims, err := a.AuthenticateClaims(pair.AccessToken)
+	if err != nil {
+		t.Fatalf("failed to verify the access token: %v", err)
+	}
+	if claims[token.ClaimTenant] != "acme" || claims["plan"] != "pro" {
+		t.Errorf("expected the tenant and extra claims, got %v", claims)
+	}
+	if claims["role"] != "user" || claims["username"] != "alice" {
+		t.Errorf("expected the extra claims not to override the manager's, got %v", claims)
+	}
+	if pair.AccessClaims["plan"] != "pro" || pair.AccessExpiresAt.IsZero() || pair.RefreshExpiresAt.IsZero() {
+		t.Errorf("expected the claims and expiries of the pair, got %+v", pair)
+	}
+
+	refreshed, err := a.RefreshTokens(ctx, token.RefreshTokensRequest{AccessToken: pair.AccessToken, RefreshToken: pair.RefreshToken})
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if refreshed.AccessClaims[token.ClaimTenant] != "acme" || refreshed.RefreshToken != pair.RefreshToken {
+		t.Errorf("expected the tenant to be carried over, got %+v", refreshed)
+	}
+
+	verified, err := a.Tokens.VerifyToken(ctx, token.VerifyTokenRequest{Token: refreshed.AccessToken, Scopes: []string{"users:admin"}})
+	if !errors.Is(err, token.ErrInsufficientScope) {
+		t.Errorf("expected ErrInsufficientScope, got %+v (%v)", verified, err)
+	}
+	if _, err := a.IssueTokens(ctx, token.GenerateTokensRequest{Username: "alice", Password: "password123", RememberMe: true}); !errors.Is(err, ErrRequestNotSupported) {
+		t.Errorf("expected ErrRequestNotSupported for remember me, got %v", err)
+	}
+}
+
+func TestLogoutContext(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"})
+	audit := stores.NewInMemoryAuditLog(0)
+	a := NewAuthify(memStore, token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour).WithStore(memStore)).
+		WithAuditLogger(audit)
+
+	pair, err := a.LoginContext(context.Background(), "alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if err := a.LogoutContext(context.Background(), pair.AccessToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for an access token, got %v", err)
+	}
+	if err := a.LogoutContext(context.Background(), pair.RefreshToken); err != nil {
+		t.Fatalf("failed to log out: %v", err)
+	}
+	if _, _, err := a.RefreshToken(pair.AccessToken, pair.RefreshToken, nil); err == nil {
+		t.Errorf("expected the refresh token to be revoked")
+	}
+	if err := a.LogoutContext(context.Background(), pair.RefreshToken); err == nil {
+		t.Errorf("expected a revoked refresh token to be rejected")
+	}
+	if events := audit.Events(); events[len(events)-2].Type != stores.EventLogout || events[len(events)-2].Username != "alice" {
+		t.Errorf("expected the logout to be audited, got %+v", events)
+	}
+
+	jwtAuthify := setupAuthify()
+	_, refreshToken, _ := jwtAuthify.Login("alice", "password123", stores.DeviceInfo{})
+	if err := jwtAuthify.LogoutContext(context.Background(), refreshToken); !errors.Is(err, ErrRevocationNotSupported) {
+		t.Errorf("expected ErrRevocationNotSupported for JWTs, got %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	audit := stores.NewInMemoryAuditLog(0)
+	a := NewAuthify(memStore, token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour).WithStore(memStore)).
+		WithAuditLogger(audit)
+
+	if _, err := a.CreateUser(context.Background(), map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	device := stores.DeviceInfo{IP: "10.0.0.1"}
+	if _, _, err := a.Login("alice", "wrongpassword", device); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	accessToken, refreshToken, err := a.Login("alice", "password123", device)
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	accessToken, _, err = a.RefreshToken(accessToken, refreshToken, map[string]any{"ip": "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if err := a.Logout(accessToken, refreshToken, false); err != nil {
+		t.Fatalf("failed to log out: %v", err)
+	}
+	if _, _, err := a.RefreshToken(accessToken, refreshToken, nil); err == nil {
+		t.Fatalf("expected the revoked refresh token to be rejected")
+	}
+
+	expected := []stores.AuthEvent{
+		{Type: stores.EventCreateUser, Username: "alice", Success: true},
+		{Type: stores.EventFailedLogin, Username: "alice", IP: "10.0.0.1", Reason: string(CodeInvalidPassword)},
+		{Type: stores.EventLogin, Username: "alice", IP: "10.0.0.1", Success: true},
+		{Type: stores.EventRefresh, Username: "alice", IP: "10.0.0.2", Success: true},
+		{Type: stores.EventLogout, Username: "alice", Success: true},
+		{Type: stores.EventRefresh, Reason: string(CodeInvalidToken)},
+	}
+	events := audit.Events()
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected), len(events), events)
+	}
+	for i, event := range events {
+		if event.Time.IsZero() {
+			t.Errorf("event %d has no time", i)
+		}
+		event.Time = time.Time{}
+		if event != expected[i] {
+			t.Errorf("event %d: expected %+v, got %+v", i, expected[i], event)
+		}
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	a := NewAuthify(store, nil)
+	for _, username := range []string{"bob", "alice"} {
+		_, _ = store.CreateUser(map[string]any{"username": username, "password": "password123"})
+	}
+
+	var out bytes.Buffer
+	if err := a.ExportUsers(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"disabled\":\"false\",\"role\":\"user\",\"username\":\"alice\"}\n{\"disabled\":\"false\",\"role\":\"user\",\"username\":\"bob\"}\n"
+	if out.String() != want {
+		t.Errorf("expected %q, got %q", want, out.String())
+	}
+
+	users, next, err := a.ListUsers(context.Background(), "", 1)
+	if err != nil || len(users) != 1 || users[0]["username"] != "alice" || next != "alice" {
+		t.Errorf("unexpected first page %v %q (%v)", users, next, err)
+	}
+
+	fallback := NewAuthify(stores.NewFallbackStore(store, store, false), nil)
+	if err := fallback.ExportUsers(context.Background(), &out); !errors.Is(err, ErrListingNotSupported) {
+		t.Errorf("expected ErrListingNotSupported, got %v", err)
+	}
+	if code := ErrorCode(ErrListingNotSupported); code != CodeNotSupported {
+		t.Errorf("expected %q, got %q", CodeNotSupported, code)
+	}
+}
+
+func TestUserExists(t *testing.T) {
+	storeCfg := testStoreConfig
+	storeCfg.Columns = maps.Clone(testStoreConfig.Columns)
+	storeCfg.Columns["email"] = stores.ColumnConfig{Type: "text", Unique: true}
+	a := NewAuthify(stores.NewInMemoryUserStore(storeCfg), nil)
+	_, _ = a.Store.CreateUser(map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"})
+
+	testCases := []struct {
+		column, value string
+		exists        bool
+		err           error
+	}{
+		{"username", "alice", true, nil},
+		{"username", "bob", false, nil},
+		{"email", "alice@example.com", true, nil},
+		{"email", "bob@example.com", false, nil},
+		{"role", "user", false, ErrColumnNotQueryable},
+		{"password", "password123", false, ErrColumnNotQueryable},
+		{"nickname", "alice", false, ErrColumnNotQueryable},
+	}
+	for _, tc := range testCases {
+		exists, err := a.UserExists(context.Background(), tc.column, tc.value)
+		if exists != tc.exists || !errors.Is(err, tc.err) {
+			t.Errorf("%s=%s: expected %v (%v), got %v (%v)", tc.column, tc.value, tc.exists, tc.err, exists, err)
+		}
+	}
+	if code := ErrorCode(ErrColumnNotQueryable); code != CodeColumnNotQueryable {
+		t.Errorf("expected %q, got %q", CodeColumnNotQueryable, code)
+	}
+}
+
+func TestClaimsEncryption(t *testing.T) {
+	storeCfg := testStoreConfig
+	storeCfg.Columns = maps.Clone(testStoreConfig.Columns)
+	email := storeCfg.Columns["email"]
+	email.Encrypted = true
+	storeCfg.Columns["email"] = email
+	memStore := stores.NewInMemoryUserStore(storeCfg)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+
+	oldKey, newKey := make([]byte, 32), make([]byte, 16)
+	rand.Read(oldKey)
+	rand.Read(newKey)
+	newManager := func(key []byte, previous ...[]byte) *token.JWTManager {
+		m := token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(testTokenConfig).
+			WithRefreshDedupWindow(0)
+		if key != nil {
+			m.WithClaimsEncryption(key)
+		}
+		for _, k := range previous {
+			m.WithPreviousClaimsEncryptionKey(k)
+		}
+		built, err := m.Build()
+		if err != nil {
+			t.Fatalf("failed to build manager: %v", err)
+		}
+		return built
+	}
+	payload := func(tokenStr string) string {
+		raw, err := jwt.NewParser().DecodeSegment(strings.Split(tokenStr, ".")[1])
+		if err != nil {
+			t.Fatalf("failed to decode payload: %v", err)
+		}
+		return string(raw)
+	}
+
+	m := newManager(oldKey)
+	accessToken, err := m.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	if raw := payload(accessToken); strings.Contains(raw, "alice@example.com") || !strings.Contains(raw, `"enc"`) {
+		t.Errorf("expected the email to be encrypted, payload is %s", raw)
+	}
+	claims, err := m.VerifyAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("failed to verify encrypted token: %v", err)
+	}
+	if claims["email"] != "alice@example.com" || claims["username"] != "alice" || claims["role"] != "user" {
+		t.Errorf("expected every claim to round-trip, got %v", claims)
+	}
+	if _, ok := claims[token.ClaimEncrypted]; ok {
+		t.Errorf("expected the enc claim to be replaced by the claims it seals")
+	}
+
+	// refreshed tokens carry the decrypted email over, encrypted again
+	refreshToken, _ := m.GenerateRefreshToken("alice", map[string]any{"ip": "10.0.0.1", "user_agent": "test"})
+	refreshed, refreshedClaims, err := m.RefreshToken(accessToken, refreshToken, nil)
+	if err != nil || refreshedClaims["email"] != "alice@example.com" || strings.Contains(payload(refreshed), "alice@example.com") {
+		t.Errorf("expected the refreshed token to keep the encrypted email, got %v (%v)", refreshedClaims, err)
+	}
+
+	// tokens issued before encryption was enabled stay valid
+	plainToken, _ := newManager(nil).GenerateAccessToken("alice", "password123")
+	if claims, err := m.VerifyAccessToken(plainToken); err != nil || claims["email"] != "alice@example.com" {
+		t.Errorf("expected a plain token to be accepted, got %v (%v)", claims, err)
+	}
+
+	// after a rotation, the previous key still opens older tokens
+	if claims, err := newManager(newKey, oldKey).VerifyAccessToken(accessToken); err != nil || claims["email"] != "alice@example.com" {
+		t.Errorf("expected the previous key to decrypt the token, got %v (%v)", claims, err)
+	}
+	for name, other := range map[string]*token.JWTManager{"unknown key": newManager(newKey), "no key": newManager(nil)} {
+		if _, err := other.VerifyAccessToken(accessToken); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", name, err)
+		}
+	}
+
+	if _, err := token.NewJWTManager().WithAccessSecret("a").WithRefreshSecret("b").WithStore(memStore).WithConfig(testTokenConfig).
+		WithClaimsEncryption([]byte("too short")).Build(); !errors.Is(err, token.ErrInvalidEncryptionKey) {
+		t.Errorf("expected ErrInvalidEncryptionKey, got %v", err)
+	}
+}
+
+func TestChangeRole(t *testing.T) {
+	storeCfg := testStoreConfig
+	storeCfg.AllowedRoles = []string{"user", "admin"}
+	memStore := stores.NewInMemoryUserStore(storeCfg)
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(testTokenConfig).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	a := NewAuthify(memStore, jwtManager)
+	_, _ = a.Store.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+
+	if err := a.ChangeRole("alice", "admin"); err != nil {
+		t.Fatalf("failed to change role: %v", err)
+	}
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	claims, _ := a.Tokens.VerifyAccessToken(accessToken)
+	if claims["role"] != "admin" || claims["email"] != "alice@example.com" {
+		t.Errorf("expected only the role to change, got %v", claims)
+	}
+
+	if err := a.ChangeRole("alice", "superuser"); !errors.Is(err, ErrInvalidRole) || ErrorCode(err) != CodeInvalidRole {
+		t.Errorf("expected ErrInvalidRole for a role outside the allowlist, got %v", err)
+	}
+	if err := a.ChangeRole("alice", ""); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("expected ErrInvalidRole for an empty role, got %v", err)
+	}
+	if err := a.ChangeRole("bob", "user"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound for an unknown user, got %v", err)
+	}
+
+	// creation and updates are held to the same allowlist
+	if _, err := a.Store.CreateUser(map[string]any{"username": "bob", "password": "password123", "role": "amin"}); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("expected ErrInvalidRole when creating a user with a role outside the allowlist, got %v", err)
+	}
+	if _, err := a.Store.CreateUser(map[string]any{"username": "bob", "password": "password123", "role": "admin"}); err != nil {
+		t.Errorf("expected an allowed role to be accepted on creation, got %v", err)
+	}
+	if err := memStore.UpdateUser("bob", map[string]any{"role": "amin"}); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("expected ErrInvalidRole when updating to a role outside the allowlist, got %v", err)
+	}
+	if err := memStore.UpdateUser("bob", map[string]any{"email": "bob@example.com"}); err != nil {
+		t.Errorf("expected updates without a role to be accepted, got %v", err)
+	}
+
+	// without an allowlist any role is accepted
+	if err := setupAuthify().ChangeRole("alice", "superuser"); err != nil {
+		t.Errorf("expected any role to be accepted without allowed_roles, got %v", err)
+	}
+}
+
+// ----------------- Static Claim Tests -----------------
+func TestStaticBooleanClaim(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	tokenCfg := *testTokenConfig
+	tokenCfg.RefreshToken.Claims = maps.Clone(testTokenConfig.RefreshToken.Claims)
+	tokenCfg.RefreshToken.Claims["valid"] = token.ClaimConfig{Source: "static", Value: true}
+
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(&tokenCfg).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+
+	refreshData := map[string]any{"ip": "127.0.0.1", "user_agent": "unit-test"}
+	refreshToken, err := jwtManager.GenerateRefreshToken("alice", refreshData)
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+	claims, err := jwtManager.VerifyRefreshToken(refreshToken)
+	if err != nil {
+		t.Fatalf("failed to verify refresh token: %v", err)
+	}
+	if valid, ok := claims["valid"].(bool); !ok || !valid {
+		t.Errorf("expected a boolean valid claim, got %#v", claims["valid"])
+	}
+
+	signed := func(valid any) string {
+		tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"username":   "alice",
+			"ip":         "127.0.0.1",
+			"user_agent": "unit-test",
+			"valid":      valid,
+			"exp":        time.Now().Add(time.Hour).Unix(),
+		}).SignedString([]byte("supersecret2"))
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return tok
+	}
+
+	// tokens issued with the string form keep verifying during the transition
+	if _, err := jwtManager.VerifyRefreshToken(signed("True")); err != nil {
+		t.Errorf("expected legacy string claim to be accepted, got %v", err)
+	}
+	for _, invalid := range []any{false, "False", "yes"} {
+		if _, err := jwtManager.VerifyRefreshToken(signed(invalid)); !errors.Is(err, token.ErrClaimsInvalid) {
+			t.Errorf("expected ErrClaimsInvalid for valid=%#v, got %v", invalid, err)
+		}
+	}
+}
+
+func TestMinimumTokenVersion(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"})
+	tokenCfg := *testTokenConfig
+	tokenCfg.RefreshToken.Claims = maps.Clone(testTokenConfig.RefreshToken.Claims)
+	tokenCfg.RefreshToken.Claims["valid"] = token.ClaimConfig{Source: "static", Value: true}
+	newManager := func(minimum int) (*token.JWTManager, error) {
+		return token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(&tokenCfg).
+			WithMinimumTokenVersion(minimum).
+			Build()
+	}
+	lenient, err := newManager(0)
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	strict, err := newManager(1)
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	if _, err := newManager(token.CurrentTokenVersion + 1); err == nil {
+		t.Errorf("expected a minimum above the current version to be refused")
+	}
+
+	signed := func(claims jwt.MapClaims) string {
+		claims["username"], claims["ip"], claims["user_agent"] = "alice", "127.0.0.1", "unit-test"
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("supersecret2"))
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return tok
+	}
+	// a token issued before the tkv claim, with the string booleans of that layout
+	legacy := signed(jwt.MapClaims{"valid": "True"})
+
+	if _, _, err := lenient.RefreshToken("", legacy, nil); err != nil {
+		t.Errorf("expected a version 0 refresh token to refresh, got %v", err)
+	}
+	if _, _, err := strict.RefreshToken("", legacy, nil); !errors.Is(err, ErrTokenVersionTooOld) {
+		t.Errorf("expected ErrTokenVersionTooOld once version 0 is cut off, got %v", err)
+	}
+
+	refreshToken, err := strict.GenerateRefreshToken("alice", map[string]any{"ip": "127.0.0.1", "user_agent": "unit-test"})
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+	claims, err := strict.VerifyRefreshToken(refreshToken)
+	if err != nil || claims[token.ClaimTokenFormat] != float64(token.CurrentTokenVersion) || claims["valid"] != true {
+		t.Fatalf("expected a current version token with a boolean valid claim, got %v %v", claims, err)
+	}
+	accessToken, err := strict.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	accessToken, _, err = strict.RefreshToken(accessToken, refreshToken, nil)
+	if err != nil {
+		t.Fatalf("failed to refresh token: %v", err)
+	}
+	if _, err := strict.VerifyAccessToken(accessToken); err != nil {
+		t.Errorf("expected the refreshed token to be valid, got %v", err)
+	}
+
+	// version 1 only accepts real booleans, and unknown versions are invalid
+	if _, err := lenient.VerifyRefreshToken(signed(jwt.MapClaims{"valid": "True", "tkv": 1})); !errors.Is(err, ErrClaimsInvalid) {
+		t.Errorf("expected ErrClaimsInvalid for a string boolean in a version 1 token, got %v", err)
+	}
+	if _, err := lenient.VerifyRefreshToken(signed(jwt.MapClaims{"valid": true, "tkv": 7})); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for an unknown version, got %v", err)
+	}
+}
+
+func TestJWTManagerBuildErrors(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	withMethod := func(method string) *token.TokenConfig {
+		cfg := *testTokenConfig
+		cfg.AccessToken.SigningMethod = method
+		return &cfg
+	}
+	full := func() *token.JWTManager {
+		return token.NewJWTManager().WithAccessSecret("supersecret").WithRefreshSecret("supersecret2").WithStore(memStore).WithConfig(testTokenConfig)
+	}
+
+	testCases := map[string]struct {
+		manager *token.JWTManager
+		want    error
+	}{
+		"complete":          {full(), nil},
+		"HS512":             {full().WithConfig(withMethod("HS512")), nil},
+		"refresh only":      {token.NewJWTManager().WithAccessSecret("supersecret").WithRefreshSecret("supersecret2").WithConfig(testTokenConfig).WithRefreshOnly(), nil},
+		"no config":         {token.NewJWTManager().WithAccessSecret("supersecret").WithRefreshSecret("supersecret2").WithStore(memStore), token.ErrTokenConfigNotProvided},
+		"asymmetric method": {full().WithConfig(withMethod("RS256")), token.ErrUnsupportedSigningMethod},
+		"no method":         {full().WithConfig(withMethod("")), token.ErrUnsupportedSigningMethod},
+		"no access secret":  {full().WithAccessSecret(""), token.ErrAccessTokenSecretNotProvided},
+		"no refresh secret": {full().WithRefreshSecret(""), token.ErrRefreshTokenSecretNotProvided},
+		"verify only":       {token.NewJWTManager().WithAccessSecret("supersecret").WithConfig(testTokenConfig), token.ErrRefreshTokenSecretNotProvided},
+		"no store":          {full().WithStore(nil), stores.ErrStoreNotProvided},
+		"invalid duration":  {full().WithTokenDuration(-time.Minute), token.ErrInvalidDuration},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := tc.manager.Build(); !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	// the error of a verify-only setup points at the verifier package
+	_, err := token.NewJWTManager().WithAccessSecret("supersecret").WithConfig(testTokenConfig).Build()
+	if err == nil || !strings.Contains(err.Error(), "verifier package") {
+		t.Errorf("expected the verify-only error to suggest the verifier package, got %v", err)
+	}
+}
+
+// ----------------- Refresh Only Tests -----------------
+func TestRefreshOnlyManager(t *testing.T) {
+	if _, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithConfig(testTokenConfig).
+		Build(); !errors.Is(err, stores.ErrStoreNotProvided) {
+		t.Fatalf("expected Build to require a store, got %v", err)
+	}
+
+	reissuer, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithConfig(testTokenConfig).
+		WithRefreshOnly().
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build refresh-only manager: %v", err)
+	}
+
+	if _, err := reissuer.GenerateAccessToken("alice", "password123"); !errors.Is(err, stores.ErrStoreNotProvided) {
+		t.Errorf("expected ErrStoreNotProvided when generating without a store, got %v", err)
+	}
+
+	// tokens issued by the login service are reissued without touching a store
+	a := setupAuthify()
+	access, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	refreshData := map[string]any{"ip": "127.0.0.1", "user_agent": "unit-test"}
+	refreshToken, err := a.Tokens.GenerateRefreshToken("alice", refreshData)
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+
+	newAccess, claims, err := reissuer.RefreshToken(access, refreshToken, refreshData)
+	if err != nil {
+		t.Fatalf("failed to refresh without a store: %v", err)
+	}
+	if claims["email"] != "alice@example.com" {
+		t.Errorf("expected claims of the old access token to be kept, got %v", claims)
+	}
+	if _, err := reissuer.VerifyAccessToken(newAccess); err != nil {
+		t.Errorf("failed to verify reissued token: %v", err)
+	}
+}
+
+func TestGenerateTokenWithExpiry(t *testing.T) {
+	a := setupAuthify()
+	m := a.Tokens.(*token.JWTManager)
+
+	tests := []struct {
+		name     string
+		duration time.Duration
+		expected error
+	}{
+		{"shorter", time.Minute, nil},
+		{"longer than the configured lifetime", 12 * time.Hour, nil},
+		{"the maximum", token.DefaultMaxTokenDuration, nil},
+		{"over the maximum", token.DefaultMaxTokenDuration + time.Second, ErrTokenDurationTooLong},
+		{"zero", 0, token.ErrInvalidDuration},
+		{"negative", -time.Minute, token.ErrInvalidDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now().Unix()
+			accessToken, err := m.GenerateTokenWithExpiry("alice", "password123", tt.duration)
+			if !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, err)
+			}
+			if err != nil {
+				return
+			}
+			claims, err := a.Tokens.VerifyAccessToken(accessToken)
+			if err != nil {
+				t.Fatalf("failed to verify token: %v", err)
+			}
+			want := before + int64(tt.duration/time.Second)
+			if exp, _ := claims.GetExpirationTime(); exp == nil || exp.Unix() < want || exp.Unix() > want+2 {
+				t.Errorf("expected the token to expire around %d, got %v", want, claims["exp"])
+			}
+		})
+	}
+
+	if _, err := m.GenerateTokenWithExpiry("alice", "wrongpassword", time.Hour); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("expected ErrInvalidPassword, got %v", err)
+	}
+	if _, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(a.Store).
+		WithConfig(testTokenConfig).
+		WithMaxTokenDuration(-time.Hour).
+		Build(); !errors.Is(err, token.ErrInvalidDuration) {
+		t.Errorf("expected Build to reject a negative maximum, got %v", err)
+	}
+
+	capped, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(a.Store).
+		WithConfig(testTokenConfig).
+		WithMaxTokenDuration(time.Hour).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build manager: %v", err)
+	}
+	if _, err := capped.GenerateTokenWithExpiry("alice", "password123", 2*time.Hour); !errors.Is(err, ErrTokenDurationTooLong) {
+		t.Errorf("expected the configured maximum to apply, got %v", err)
+	}
+}
+
+// ----------------- Secret Rotation Tests -----------------
+func TestSecretRotation(t *testing.T) {
+	a := setupAuthify()
+	oldAccess, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	refreshData := map[string]any{"ip": "127.0.0.1", "user_agent": "unit-test"}
+	oldRefresh, err := a.Tokens.GenerateRefreshToken("alice", refreshData)
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+
+	rotated, err := token.NewJWTManager().
+		WithAccessSecret("rotatedsecret").
+		WithPreviousAccessSecret("supersecret").
+		WithRefreshSecret("rotatedsecret2").
+		WithPreviousRefreshSecret("supersecret2").
+		WithConfig(testTokenConfig).
+		WithStore(a.Store).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build rotated manager: %v", err)
+	}
+
+	if _, err := rotated.VerifyAccessToken(oldAccess); err != nil {
+		t.Errorf("expected token signed with the previous secret to verify, got %v", err)
+	}
+	if got := rotated.PreviousSecretVerifications(); got != 1 {
+		t.Errorf("expected 1 verification with a previous secret, got %d", got)
+	}
+
+	newAccess, _, err := rotated.RefreshToken(oldAccess, oldRefresh, refreshData)
+	if err != nil {
+		t.Fatalf("failed to refresh with tokens signed by the previous secrets: %v", err)
+	}
+
+	// new tokens are signed with the current secret only
+	if _, err := rotated.VerifyAccessToken(newAccess); err != nil {
+		t.Errorf("failed to verify token signed with the current secret: %v", err)
+	}
+	if _, err := a.Tokens.VerifyAccessToken(newAccess); !errors.Is(err, token.ErrInvalidToken) {
+		t.Errorf("expected the new token to be signed with the rotated secret, got %v", err)
+	}
+	// refreshing verified both the old refresh and access tokens with a previous secret
+	if got := rotated.PreviousSecretVerifications(); got != 3 {
+		t.Errorf("expected 3 verifications with a previous secret, got %d", got)
+	}
+
+	stranger, err := token.NewJWTManager().
+		WithAccessSecret("unrelatedsecret").
+		WithRefreshSecret("unrelatedsecret2").
+		WithConfig(testTokenConfig).
+		WithStore(a.Store).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build manager: %v", err)
+	}
+	foreign, err := stranger.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	if _, err := rotated.VerifyAccessToken(foreign); !errors.Is(err, token.ErrInvalidToken) {
+		t.Errorf("expected token signed with an unknown secret to be rejected, got %v", err)
+	}
+}
+
+func TestAdditionalVerifySecrets(t *testing.T) {
+	a := setupAuthify()
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+
+	verifier := func(extra ...string) *token.JWTManager {
+		m, err := token.NewJWTManager().
+			WithAccessSecret("rotatedsecret").
+			WithAdditionalVerifySecrets(extra...).
+			WithRefreshSecret("rotatedsecret2").
+			WithConfig(testTokenConfig).
+			WithStore(a.Store).
+			Build()
+		if err != nil {
+			t.Fatalf("failed to build manager: %v", err)
+		}
+		return m
+	}
+
+	rotated := verifier("", "othersecret", "supersecret")
+	if _, err := rotated.VerifyAccessToken(accessToken); err != nil {
+		t.Errorf("expected a token signed with an additional secret to verify, got %v", err)
+	}
+	if got := rotated.PreviousSecretVerifications(); got != 1 {
+		t.Errorf("expected 1 verification with an additional secret, got %d", got)
+	}
+	if _, err := verifier("othersecret").VerifyAccessToken(accessToken); !errors.Is(err, token.ErrInvalidToken) {
+		t.Errorf("expected a token signed with none of the secrets to be rejected, got %v", err)
+	}
+}
+
+func TestWithTokenDurationString(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	build := func(duration string) (*token.JWTManager, error) {
+		return token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(testTokenConfig).
+			WithTokenDurationString(duration).
+			Build()
+	}
+
+	m, err := build("2h30m")
+	if err != nil {
+		t.Fatalf("failed to build manager: %v", err)
+	}
+	accessToken, err := m.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	claims, err := m.VerifyAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("failed to verify access token: %v", err)
+	}
+	exp, _ := claims.GetExpirationTime()
+	if remaining := time.Until(exp.Time); remaining < 2*time.Hour || remaining > 150*time.Minute {
+		t.Errorf("expected the token to last 2h30m, expires in %v", remaining)
+	}
+
+	for _, duration := range []string{"fifteen minutes", "15", "-5m", "0s"} {
+		if _, err := build(duration); !errors.Is(err, token.ErrInvalidDuration) {
+			t.Errorf("expected ErrInvalidDuration for %q, got %v", duration, err)
+		}
+	}
+}
+
+func TestRotateSecretsAtRuntime(t *testing.T) {
+	a := setupAuthify()
+	a.Tokens.(*token.JWTManager).WithSecretGracePeriod(200 * time.Millisecond)
+	refreshData := map[string]any{"ip": "127.0.0.1", "user_agent": "unit-test"}
+	oldAccess, _ := a.Tokens.GenerateAccessToken("alice", "password123")
+	oldRefresh, _ := a.Tokens.GenerateRefreshToken("alice", refreshData)
+
+	if err := a.RotateSecrets("", "rotatedsecret2", true); !errors.Is(err, token.ErrAccessTokenSecretNotProvided) {
+		t.Errorf("expected ErrAccessTokenSecretNotProvided, got %v", err)
+	}
+	if err := a.RotateSecrets("rotatedsecret", "rotatedsecret2", true); err != nil {
+		t.Fatalf("failed to rotate secrets: %v", err)
+	}
+	if _, err := a.Tokens.VerifyAccessToken(oldAccess); err != nil {
+		t.Errorf("expected the old access token to verify during the grace window, got %v", err)
+	}
+	newAccess, _, err := a.Tokens.RefreshToken(oldAccess, oldRefresh, refreshData)
+	if err != nil {
+		t.Fatalf("failed to refresh with the old tokens during the grace window: %v", err)
+	}
+	signed, err := jwt.Parse(newAccess, func(*jwt.Token) (any, error) { return []byte("rotatedsecret"), nil })
+	if err != nil || !signed.Valid {
+		t.Errorf("expected new tokens to be signed with the new secret, got %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := a.Tokens.VerifyAccessToken(oldAccess); !errors.Is(err, token.ErrInvalidToken) {
+		t.Errorf("expected the old access token to be rejected after the grace window, got %v", err)
+	}
+	if _, err := a.Tokens.VerifyAccessToken(newAccess); err != nil {
+		t.Errorf("expected the new access token to verify, got %v", err)
+	}
+
+	if err := a.RotateSecrets("rotatedagain", "rotatedagain2", false); err != nil {
+		t.Fatalf("failed to rotate secrets: %v", err)
+	}
+	if _, err := a.Tokens.VerifyAccessToken(newAccess); !errors.Is(err, token.ErrInvalidToken) {
+		t.Errorf("expected tokens of the replaced secret to be rejected without keepOld, got %v", err)
+	}
+
+	opaque := NewAuthify(a.Store, token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour))
+	if err := opaque.RotateSecrets("rotated", "rotated2", true); !errors.Is(err, ErrRotationNotSupported) {
+		t.Errorf("expected ErrRotationNotSupported for opaque tokens, got %v", err)
+	}
+}
+
+func TestRotateSecretsConcurrently(t *testing.T) {
+	a := setupAuthify()
+	refreshData := map[string]any{"ip": "127.0.0.1", "user_agent": "unit-test"}
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 20 {
+				if i%2 == 0 {
+					_ = a.RotateSecrets(fmt.Sprintf("secret-%d-%d", i, j), fmt.Sprintf("refresh-%d-%d", i, j), j%2 == 0)
+					continue
+				}
+				// refresh tokens are signed without checking the password, which keeps the loop fast
+				refreshToken, err := a.Tokens.GenerateRefreshToken("alice", refreshData)
+				if err != nil {
+					t.Errorf("failed to generate refresh token: %v", err)
+					return
+				}
+				// a rotation without keepOld may land in between, any other failure is a bug
+				if _, err := a.Tokens.VerifyRefreshToken(refreshToken); err != nil && !errors.Is(err, token.ErrInvalidToken) {
+					t.Errorf("unexpected verification error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ----------------- Token Hardening Tests -----------------
+func TestRefreshTokenUnexpectedClaimTypes(t *testing.T) {
+	a := setupAuthify()
+	refreshData := map[string]any{"ip": "127.0.0.1", "user_agent": "unit-test"}
+	refreshToken, err := a.Tokens.GenerateRefreshToken("alice", refreshData)
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+
+	sign := func(claims jwt.MapClaims) string {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("supersecret"))
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return signed
+	}
+
+	for name, claims := range map[string]jwt.MapClaims{
+		"numeric identifier": {"username": 42, "role": "user"},
+		"other user":         {"username": "bob", "role": "admin"},
+		"numeric scope":      {"username": "alice", "scope": 7},
+	} {
+		if _, _, err := a.Tokens.RefreshToken(sign(claims), refreshToken, refreshData); !errors.Is(err, ErrClaimsInvalid) {
+			t.Errorf("%s: expected ErrClaimsInvalid, got %v", name, err)
+		}
+	}
+
+	// claims of an access token signed with another secret are not carried over
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": "alice", "role": "admin"}).SignedString([]byte("not-the-secret"))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	_, claims, err := a.Tokens.RefreshToken(forged, refreshToken, refreshData)
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if claims["role"] == "admin" {
+		t.Errorf("expected claims of a forged access token to be ignored, got %v", claims)
+	}
+}
+
+func TestOversizedToken(t *testing.T) {
+	a := setupAuthify()
+	huge := strings.Repeat("a", token.MaxTokenLength) + ".b.c"
+	if _, err := a.Tokens.VerifyAccessToken(huge); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for an oversized token, got %v", err)
+	}
+	if _, err := a.Tokens.VerifyAccessToken(strings.Repeat(".", 1000)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for a token with too many segments, got %v", err)
+	}
+}
+
+func TestUnexpectedSigningMethod(t *testing.T) {
+	a := setupAuthify()
+	claims := jwt.MapClaims{"username": "alice", "role": "user", "email": "alice@example.com", "exp": time.Now().Add(time.Minute).Unix()}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	rs256, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(rsaKey)
+	if err != nil {
+		t.Fatalf("failed to sign RS256 token: %v", err)
+	}
+	// signed with the right secret, but not with the configured HS256
+	hs512, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString([]byte("supersecret"))
+	if err != nil {
+		t.Fatalf("failed to sign HS512 token: %v", err)
+	}
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("failed to sign unsigned token: %v", err)
+	}
+
+	for name, tokenStr := range map[string]string{"RS256": rs256, "HS512": hs512, "none": none} {
+		if _, err := a.Tokens.VerifyAccessToken(tokenStr); !errors.Is(err, ErrUnexpectedSigningMethod) {
+			t.Errorf("%s access token: expected ErrUnexpectedSigningMethod, got %v", name, err)
+		}
+		if _, err := a.Tokens.VerifyRefreshToken(tokenStr); !errors.Is(err, ErrUnexpectedSigningMethod) {
+			t.Errorf("%s refresh token: expected ErrUnexpectedSigningMethod, got %v", name, err)
+		}
+	}
+	if code := ErrorCode(ErrUnexpectedSigningMethod); code != CodeInvalidToken {
+		t.Errorf("expected ErrUnexpectedSigningMethod to map to %s, got %s", CodeInvalidToken, code)
+	}
+}
+
+// ----------------- Authenticate Tests -----------------
+func TestAuthenticate(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+
+	newAuthify := func(issuer string) *Authify {
+		tokenCfg := *testTokenConfig
+		tokenCfg.Issuer = issuer
+		jwtManager, err := token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(&tokenCfg).
+			WithStrictVerification(true).
+			Build()
+		if err != nil {
+			t.Fatalf("failed to build jwt manager: %v", err)
+		}
+		return NewAuthify(memStore, jwtManager)
+	}
+
+	a := newAuthify("authify")
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+
+	username, role, err := a.Authenticate(accessToken)
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	if username != "alice" || role != "user" {
+		t.Errorf("expected alice with role user, got %q with role %q", username, role)
+	}
+
+	if _, _, err := newAuthify("someone-else").Authenticate(accessToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for a token of another issuer, got %v", err)
+	}
+	if _, _, err := a.Authenticate("garbage"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+
+	if err := a.SetUserDisabled("alice", true); err != nil {
+		t.Fatalf("failed to disable alice: %v", err)
+	}
+	if _, _, err := a.Authenticate(accessToken); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("expected ErrAccountDisabled with strict verification, got %v", err)
+	}
+}
+
+// ----------------- Token Exchange Tests -----------------
+func TestExchangeToken(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	_, _ = memStore.CreateUser(map[string]any{"username": "billing", "password": "servicepass", "role": "service"})
+
+	newAuthify := func(allowChained bool) *Authify {
+		tokenCfg := *testTokenConfig
+		tokenCfg.Exchange = token.ExchangeConfig{
+			ActorRoles:   []string{"service"},
+			MaxDuration:  30 * time.Second,
+			AllowChained: allowChained,
+		}
+		jwtManager, err := token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(&tokenCfg).
+			Build()
+		if err != nil {
+			t.Fatalf("failed to build jwt manager: %v", err)
+		}
+		return NewAuthify(memStore, jwtManager)
+	}
+	a := newAuthify(false)
+
+	subject, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+
+	exchanged, err := a.Tokens.ExchangeToken(subject, "billing", "servicepass", "invoices", time.Hour)
+	if err != nil {
+		t.Fatalf("failed to exchange token: %v", err)
+	}
+	claims, err := a.Tokens.VerifyAccessToken(exchanged)
+	if err != nil {
+		t.Fatalf("failed to verify exchanged token: %v", err)
+	}
+	act, _ := claims[token.ClaimActor].(map[string]any)
+	if claims["username"] != "alice" || claims["email"] != "alice@example.com" || act[token.ClaimSubject] != "billing" {
+		t.Errorf("expected alice's claims acted on by billing, got %v", claims)
+	}
+	if claims[token.ClaimAudience] != "invoices" {
+		t.Errorf("expected audience invoices, got %v", claims[token.ClaimAudience])
+	}
+	expiry, _ := claims.GetExpirationTime()
+	if lifetime := time.Until(expiry.Time); lifetime > 30*time.Second {
+		t.Errorf("expected the ttl to be capped to 30s, token lives %v", lifetime)
+	}
+
+	// forbidden actor role
+	if _, err := a.Tokens.ExchangeToken(subject, "alice", "password123", "", 0); !errors.Is(err, ErrExchangeForbidden) || ErrorCode(err) != CodeExchangeForbidden {
+		t.Errorf("expected ErrExchangeForbidden for a user role, got %v", err)
+	}
+	if _, err := a.Tokens.ExchangeToken(subject, "billing", "wrong", "", 0); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("expected ErrInvalidPassword for bad actor credentials, got %v", err)
+	}
+
+	// expired subject token
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "alice",
+		"role":     "user",
+		"email":    "alice@example.com",
+		"exp":      time.Now().Add(-time.Minute).Unix(),
+	}).SignedString([]byte("supersecret"))
+	if _, err := a.Tokens.ExchangeToken(expired, "billing", "servicepass", "", 0); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expected ErrTokenExpired for an expired subject token, got %v", err)
+	}
+
+	// exchanged tokens are only exchangeable again when configured
+	if _, err := a.Tokens.ExchangeToken(exchanged, "billing", "servicepass", "", 0); !errors.Is(err, ErrTokenNotExchangeable) {
+		t.Errorf("expected ErrTokenNotExchangeable, got %v", err)
+	}
+	chained, err := newAuthify(true).Tokens.ExchangeToken(exchanged, "billing", "servicepass", "", 0)
+	if err != nil {
+		t.Fatalf("failed to exchange token again: %v", err)
+	}
+	claims, _ = a.Tokens.VerifyAccessToken(chained)
+	act, _ = claims[token.ClaimActor].(map[string]any)
+	if nested, _ := act[token.ClaimActor].(map[string]any); nested[token.ClaimSubject] != "billing" {
+		t.Errorf("expected the previous actor nested in act, got %v", claims[token.ClaimActor])
+	}
+}
+
+func TestAccessTokenAudience(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	cfg := *testTokenConfig
+	cfg.AccessToken.Audience = []string{"billing", "reports"}
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(&cfg).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build manager: %v", err)
+	}
+	a := NewAuthify(memStore, jwtManager)
+
+	accessToken, refreshToken, err := a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	claims, err := a.AuthenticateClaims(accessToken)
+	if err != nil {
+		t.Fatalf("failed to verify token: %v", err)
+	}
+	if !token.HasAudience(claims, "billing") || !token.HasAudience(claims, "reports") || token.HasAudience(claims, "admin") {
+		t.Errorf("expected the audience billing and reports, got %v", claims[token.ClaimAudience])
+	}
+
+	_, claims, err = a.RefreshToken(accessToken, refreshToken, nil)
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if !token.HasAudience(claims, "billing") {
+		t.Errorf("expected refreshed tokens to keep the audience, got %v", claims[token.ClaimAudience])
+	}
+
+	if claims, _ := setupAuthify().Tokens.VerifyRefreshToken(refreshToken); claims[token.ClaimAudience] != nil {
+		t.Errorf("expected no audience on refresh tokens, got %v", claims[token.ClaimAudience])
+	}
+}
+
+func TestClaimNames(t *testing.T) {
+	newAuthify := func(t *testing.T, storeCfg stores.StoreConfig, claims map[string]token.ClaimConfig, user map[string]any, opts ...func(*token.JWTManager)) *Authify {
+		t.Helper()
+		memStore := stores.NewInMemoryUserStore(storeCfg)
+		if _, err := memStore.CreateUser(user); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		cfg := *testTokenConfig
+		cfg.AccessToken.Claims = claims
+		m := token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(&cfg)
+		for _, opt := range opts {
+			opt(m)
+		}
+		built, err := m.Build()
+		if err != nil {
+			t.Fatalf("failed to build manager: %v", err)
+		}
+		return NewAuthify(memStore, built)
+	}
+	login := func(t *testing.T, a *Authify, username string) string {
+		t.Helper()
+		accessToken, _, err := a.Login(username, "password123", stores.DeviceInfo{})
+		if err != nil {
+			t.Fatalf("failed to log in: %v", err)
+		}
+		return accessToken
+	}
+
+	mappedStore := stores.StoreConfig{
+		Name: "accounts",
+		Columns: map[string]stores.ColumnConfig{
+			"username":  {Type: "text", Required: true, PrimaryKey: true, JWTClaim: "sub"},
+			"password":  {Type: "text", Required: true, Hidden: true, IsPassword: true},
+			"user_role": {Type: "text", IsRole: true, JWTClaim: "grp"},
+		},
+	}
+	mappedUser := map[string]any{"username": "alice", "password": "password123", "user_role": "editor"}
+
+	roleless := stores.StoreConfig{
+		Name: "users",
+		Columns: map[string]stores.ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+		},
+	}
+	rolelessUser := map[string]any{"username": "alice", "password": "password123"}
+	rolelessClaims := map[string]token.ClaimConfig{
+		"username": {Source: "db", Column: "username", IsIdentifier: true},
+		"role":     {Source: "db", Column: "role"},
+	}
+
+	t.Run("classic", func(t *testing.T) {
+		a := setupAuthify()
+		username, role, err := a.Authenticate(login(t, a, "alice"))
+		if err != nil || username != "alice" || role != "user" {
+			t.Errorf("expected alice and user, got %q %q %v", username, role, err)
+		}
+	})
+
+	t.Run("jwt_claim mapping", func(t *testing.T) {
+		a := newAuthify(t, mappedStore, map[string]token.ClaimConfig{}, mappedUser)
+		accessToken := login(t, a, "alice")
+		claims, err := a.AuthenticateClaims(accessToken)
+		if err != nil {
+			t.Fatalf("failed to verify token: %v", err)
+		}
+		if claims["sub"] != "alice" || claims["grp"] != "editor" {
+			t.Errorf("expected the sub and grp claims, got %v", claims)
+		}
+		username, role, err := a.Authenticate(accessToken)
+		if err != nil || username != "alice" || role != "editor" {
+			t.Errorf("expected alice and editor, got %q %q %v", username, role, err)
+		}
+	})
+
+	t.Run("builder options", func(t *testing.T) {
+		a := newAuthify(t, mappedStore, map[string]token.ClaimConfig{}, mappedUser, func(m *token.JWTManager) {
+			m.WithUsernameClaim("uid").WithRoleClaim("rl")
+		})
+		accessToken := login(t, a, "alice")
+		username, role, err := a.Authenticate(accessToken)
+		if err != nil || username != "alice" || role != "editor" {
+			t.Errorf("expected alice and editor, got %q %q %v", username, role, err)
+		}
+		if claims, _ := a.AuthenticateClaims(accessToken); claims["uid"] != "alice" || claims["rl"] != "editor" {
+			t.Errorf("expected the uid and rl claims, got %v", claims)
+		}
+	})
+
+	t.Run("role-less", func(t *testing.T) {
+		a := newAuthify(t, roleless, rolelessClaims, rolelessUser)
+		accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+		if err != nil {
+			t.Fatalf("failed to generate token: %v", err)
+		}
+		if _, _, err := a.Authenticate(accessToken); !errors.Is(err, token.ErrMissingRole) || !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected ErrMissingRole while the role is required, got %v", err)
+		}
+		if _, _, err := a.Login("alice", "password123", stores.DeviceInfo{}); !errors.Is(err, token.ErrMissingRole) {
+			t.Errorf("expected logins to fail with ErrMissingRole while the role is required, got %v", err)
+		}
+
+		a = newAuthify(t, roleless, rolelessClaims, rolelessUser, func(m *token.JWTManager) {
+			m.WithRequireRole(false)
+		})
+		username, role, err := a.Authenticate(login(t, a, "alice"))
+		if err != nil || username != "alice" || role != "" {
+			t.Errorf("expected alice without a role, got %q %q %v", username, role, err)
+		}
+	})
+}
+
+func TestClaimValidators(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	_, _ = memStore.CreateUser(map[string]any{"username": "bob", "password": "password123", "role": "admin", "email": "bob@example.com"})
+
+	errNoAdmins := errors.New("admins must use the admin portal")
+	var calls []string
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(testTokenConfig).
+		WithClaimValidator(func(claims jwt.MapClaims) error {
+			calls = append(calls, "role")
+			if claims["role"] == "admin" {
+				return errNoAdmins
+			}
+			return nil
+		}).
+		WithClaimValidator(func(claims jwt.MapClaims) error {
+			calls = append(calls, "email")
+			return nil
+		}).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build manager: %v", err)
+	}
+	a := NewAuthify(memStore, jwtManager)
+
+	accessToken, _, err := a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	calls = nil
+	if _, err := a.AuthenticateClaims(accessToken); err != nil {
+		t.Errorf("expected alice's token to pass the validators, got %v", err)
+	}
+	if !slices.Equal(calls, []string{"role", "email"}) {
+		t.Errorf("expected the validators to run in order, got %v", calls)
+	}
+
+	// Login verifies the tokens it issues, so tokens failing a validator are never handed out
+	calls = nil
+	_, _, err = a.Login("bob", "password123", stores.DeviceInfo{})
+	if !errors.Is(err, errNoAdmins) || !errors.Is(err, ErrClaimsInvalid) {
+		t.Errorf("expected the validator error wrapped in ErrClaimsInvalid, got %v", err)
+	}
+	if !slices.Equal(calls, []string{"role"}) {
+		t.Errorf("expected the validators after a failing one to be skipped, got %v", calls)
+	}
+
+	calls = nil
+	if _, err := a.AuthenticateClaims("not-a-token"); err == nil || len(calls) > 0 {
+		t.Errorf("expected invalid tokens to fail before the validators, got %v and calls %v", err, calls)
+	}
+}
+
+func TestGenerateServiceToken(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	accounts := stores.NewInMemoryServiceAccountStore()
+	secret, err := accounts.CreateServiceAccount("reports-job", []string{"reports:read", "reports:write"})
+	if err != nil {
+		t.Fatalf("failed to create service account: %v", err)
+	}
+	disabledSecret, _ := accounts.CreateServiceAccount("old-job", nil)
+	_ = accounts.SetServiceAccountDisabled("old-job", true)
+
+	cfg := *testTokenConfig
+	cfg.ServiceToken.Duration = 30 * time.Second
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithServiceAccounts(accounts).
+		WithConfig(&cfg).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build manager: %v", err)
+	}
+	a := NewAuthify(memStore, jwtManager)
+
+	tests := []struct {
+		name       string
+		clientID   string
+		secret     string
+		scopes     []string
+		wantScopes string
+		wantErr    error
+	}{
+		{name: "every allowed scope", clientID: "reports-job", secret: secret, wantScopes: "reports:read reports:write"},
+		{name: "requested scopes", clientID: "reports-job", secret: secret, scopes: []string{"reports:read"}, wantScopes: "reports:read"},
+		{name: "scope not allowed", clientID: "reports-job", secret: secret, scopes: []string{"users:admin"}, wantErr: ErrInvalidScope},
+		{name: "wrong secret", clientID: "reports-job", secret: "wrong", wantErr: ErrInvalidClientCredentials},
+		{name: "unknown client", clientID: "nobody", secret: secret, wantErr: ErrInvalidClientCredentials},
+		{name: "disabled account", clientID: "old-job", secret: disabledSecret, wantErr: ErrAccountDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accessToken, expiresAt, err := a.GenerateServiceToken(context.Background(), tt.clientID, tt.secret, tt.scopes)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to generate service token: %v", err)
+			}
+
+			claims, err := a.AuthenticateClaims(accessToken)
+			if err != nil {
+				t.Fatalf("failed to verify service token: %v", err)
+			}
+			if claims[token.ClaimSubject] != tt.clientID || token.TokenUse(claims) != token.TokenUseService {
+				t.Errorf("expected a service token of %s, got %v", tt.clientID, claims)
+			}
+			if claims[token.ClaimScope] != tt.wantScopes {
+				t.Errorf("expected scopes %q, got %v", tt.wantScopes, claims[token.ClaimScope])
+			}
+			if until := time.Until(expiresAt); until <= 0 || until > 30*time.Second {
+				t.Errorf("expected the token to expire within 30s, got %v", expiresAt)
+			}
+			if _, err := a.Tokens.UserIdentifier(claims); err == nil {
+				t.Errorf("expected service tokens to have no user")
+			}
+		})
+	}
+
+	// service tokens cannot lend their claims to a user's refresh
+	serviceToken, _, _ := a.GenerateServiceToken(context.Background(), "reports-job", secret, nil)
+	pair, err := a.LoginContext(context.Background(), "alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if _, _, err := a.RefreshToken(serviceToken, pair.RefreshToken, nil); !errors.Is(err, ErrClaimsInvalid) {
+		t.Errorf("expected ErrClaimsInvalid refreshing with a service token, got %v", err)
+	}
+	if claims, _ := a.AuthenticateClaims(pair.AccessToken); token.TokenUse(claims) != token.TokenUseUser {
+		t.Errorf("expected user tokens to be of use %q, got %v", token.TokenUseUser, claims)
+	}
+
+	// strict verification rejects the tokens of accounts disabled since
+	jwtManager.WithStrictVerification(true)
+	_ = accounts.SetServiceAccountDisabled("reports-job", true)
+	if _, err := a.AuthenticateClaims(serviceToken); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("expected ErrAccountDisabled in strict mode, got %v", err)
+	}
+
+	if _, _, err := setupAuthify().GenerateServiceToken(context.Background(), "reports-job", secret, nil); !errors.Is(err, ErrServiceAccountsNotSupported) {
+		t.Errorf("expected ErrServiceAccountsNotSupported without service accounts, got %v", err)
+	}
+}
+
+func TestInvalidateAllTokens(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	newManager := func(ttl time.Duration) *token.JWTManager {
+		jwtManager, err := token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(testTokenConfig).
+			WithGlobalNotBeforeTTL(ttl).
+			Build()
+		if err != nil {
+			t.Fatalf("failed to build manager: %v", err)
+		}
+		return jwtManager
+	}
+	a := NewAuthify(memStore, newManager(token.DefaultGlobalNotBeforeTTL))
+	// another instance sharing the store, which caches the not-before time for long
+	other := newManager(time.Hour)
+
+	accessToken, refreshToken, err := a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if _, err := other.VerifyAccessToken(accessToken); err != nil {
+		t.Fatalf("expected the token to be valid before the invalidation, got %v", err)
+	}
+
+	notBefore, err := a.InvalidateAllTokens()
+	if err != nil {
+		t.Fatalf("failed to invalidate tokens: %v", err)
+	}
+	if stored, _ := memStore.GetGlobalNotBefore(); !stored.Equal(notBefore) {
+		t.Errorf("expected the not-before time to be stored, got %v", stored)
+	}
+
+	if _, err := a.AuthenticateClaims(accessToken); !errors.Is(err, ErrTokenInvalidatedGlobally) {
+		t.Errorf("expected ErrTokenInvalidatedGlobally, got %v", err)
+	}
+	if ErrorCode(ErrTokenInvalidatedGlobally) != CodeTokenRevoked {
+		t.Errorf("expected code %s, got %s", CodeTokenRevoked, ErrorCode(ErrTokenInvalidatedGlobally))
+	}
+	if _, _, err := a.RefreshToken(accessToken, refreshToken, nil); !errors.Is(err, ErrTokenInvalidatedGlobally) {
+		t.Errorf("expected refreshing to fail with ErrTokenInvalidatedGlobally, got %v", err)
+	}
+
+	// the other instance notices once its cache expires, or is reset
+	if _, err := other.VerifyAccessToken(accessToken); err != nil {
+		t.Errorf("expected the cached not-before time to be used, got %v", err)
+	}
+	other.ResetGlobalNotBeforeCache()
+	if _, err := other.VerifyAccessToken(accessToken); !errors.Is(err, ErrTokenInvalidatedGlobally) {
+		t.Errorf("expected ErrTokenInvalidatedGlobally after a cache reset, got %v", err)
+	}
+
+	// iat has a precision of a second, tokens issued during the second of the call are rejected too
+	time.Sleep(time.Until(notBefore.Truncate(time.Second).Add(time.Second)))
+	accessToken, refreshToken, err = a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in after the invalidation: %v", err)
+	}
+	if _, err := other.VerifyAccessToken(accessToken); err != nil {
+		t.Errorf("expected a new token to be valid, got %v", err)
+	}
+	if _, _, err := a.RefreshToken(accessToken, refreshToken, nil); err != nil {
+		t.Errorf("expected a new refresh token to be valid, got %v", err)
+	}
+}
+
+func TestInvalidationBus(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	bus := stores.NewLocalInvalidationBus()
+	var received []stores.Invalidation
+	bus.Subscribe(func(inv stores.Invalidation) { received = append(received, inv) })
+
+	newManager := func() *token.JWTManager {
+		jwtManager, err := token.NewJWTManager().
+			WithAccessSecret("supersecret").
+			WithRefreshSecret("supersecret2").
+			WithStore(memStore).
+			WithConfig(testTokenConfig).
+			WithGlobalNotBeforeTTL(time.Hour).
+			Build()
+		if err != nil {
+			t.Fatalf("failed to build manager: %v", err)
+		}
+		return jwtManager.WithInvalidationBus(bus)
+	}
+	// two replicas sharing the store and the bus, both caching the not-before time for long
+	a := NewAuthify(memStore, newManager()).WithInvalidationBus(bus)
+	other := newManager()
+
+	accessToken, _, err := a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if _, err := other.VerifyAccessToken(accessToken); err != nil {
+		t.Fatalf("expected the token to be valid before the invalidation, got %v", err)
+	}
+	if _, err := a.InvalidateAllTokens(); err != nil {
+		t.Fatalf("failed to invalidate tokens: %v", err)
+	}
+	if _, err := other.VerifyAccessToken(accessToken); !errors.Is(err, ErrTokenInvalidatedGlobally) {
+		t.Errorf("expected the other replica to drop its cached not-before time, got %v", err)
+	}
+
+	if err := a.ChangeRole("alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ChangePassword("alice", "password123", "newpassword123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetUserDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	// failed changes are not published
+	if err := a.ChangeRole("nobody", "admin"); err == nil {
+		t.Error("expected changing the role of an unknown user to fail")
+	}
+
+	want := []stores.Invalidation{
+		{Kind: stores.InvalidateNotBefore},
+		{Kind: stores.InvalidateRole, Username: "alice"},
+		{Kind: stores.InvalidatePassword, Username: "alice"},
+		{Kind: stores.InvalidateStatus, Username: "alice"},
+	}
+	if !slices.Equal(received, want) {
+		t.Errorf("expected %+v, got %+v", want, received)
+	}
+}
+
+func TestRoleTokenDurations(t *testing.T) {
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	m, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(testTokenConfig).
+		WithTokenDuration(time.Hour).
+		WithRoleTokenDurations(map[string]time.Duration{"admin": 5 * time.Minute}).
+		WithRoleRefreshDurations(map[string]time.Duration{"admin": 30 * time.Minute}).
+		// logins within the same second issue the same tokens, whose refreshes would be deduplicated
+		WithRefreshDedupWindow(0).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build manager: %v", err)
+	}
+	a := NewAuthify(memStore, m)
+	for _, user := range []map[string]any{
+		{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"},
+		{"username": "root", "password": "password123", "role": "admin", "email": "root@example.com"},
+	} {
+		if _, err := memStore.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// lifetime returns exp - iat of a token
+	lifetime := func(t *testing.T, claims jwt.MapClaims) time.Duration {
+		t.Helper()
+		exp, _ := claims.GetExpirationTime()
+		iat, _ := claims.GetIssuedAt()
+		return exp.Sub(iat.Time)
+	}
+	login := func(t *testing.T, username string) (access, refresh string) {
+		t.Helper()
+		access, refresh, err := a.Login(username, "password123", stores.DeviceInfo{})
+		if err != nil {
+			t.Fatalf("failed to log %s in: %v", username, err)
+		}
+		return access, refresh
+	}
+	refreshed := func(t *testing.T, access, refresh string) jwt.MapClaims {
+		t.Helper()
+		refreshed, _, err := a.RefreshToken(access, refresh, nil)
+		if err != nil {
+			t.Fatalf("failed to refresh: %v", err)
+		}
+		claims, err := m.VerifyAccessToken(refreshed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return claims
+	}
+
+	tests := []struct {
+		username string
+		access   time.Duration
+		refresh  time.Duration
+	}{
+		{"alice", time.Hour, testTokenConfig.RefreshToken.Duration},
+		{"root", 5 * time.Minute, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			access, refresh := login(t, tt.username)
+			accessClaims, err := m.VerifyAccessToken(access)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lifetime(t, accessClaims); got != tt.access {
+				t.Errorf("expected the access token to last %v, got %v", tt.access, got)
+			}
+			refreshClaims, err := m.VerifyRefreshToken(refresh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lifetime(t, refreshClaims); got != tt.refresh {
+				t.Errorf("expected the refresh token to last %v, got %v", tt.refresh, got)
+			}
+			if got := lifetime(t, refreshed(t, access, refresh)); got != tt.access {
+				t.Errorf("expected the refreshed token to last %v, got %v", tt.access, got)
+			}
+		})
+	}
+
+	t.Run("refresh uses the role of the store", func(t *testing.T) {
+		access, refresh := login(t, "alice")
+		if err := a.ChangeRole("alice", "admin"); err != nil {
+			t.Fatal(err)
+		}
+		defer a.ChangeRole("alice", "user")
+		claims := refreshed(t, access, refresh)
+		if got := lifetime(t, claims); got != 5*time.Minute || claims["role"] != "admin" {
+			t.Errorf("expected the admin role and lifetime once promoted, got %v and %v", claims["role"], got)
+		}
+	})
+
+	t.Run("refresh drops the role of a demoted user", func(t *testing.T) {
+		access, refresh := login(t, "root")
+		if err := a.ChangeRole("root", "user"); err != nil {
+			t.Fatal(err)
+		}
+		defer a.ChangeRole("root", "admin")
+		claims := refreshed(t, access, refresh)
+		if got := lifetime(t, claims); got != time.Hour || claims["role"] != "user" {
+			t.Errorf("expected the user role and lifetime once demoted, got %v and %v", claims["role"], got)
+		}
+	})
+
+	if _, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(testTokenConfig).
+		WithRoleTokenDurations(map[string]time.Duration{"admin": 0}).
+		Build(); !errors.Is(err, token.ErrInvalidDuration) {
+		t.Errorf("expected ErrInvalidDuration, got %v", err)
+	}
+}
+
+func TestAuditRequestID(t *testing.T) {
+	audit := stores.NewInMemoryAuditLog(0)
+	a := setupAuthify().WithAuditLogger(audit)
+
+	ctx := WithRequestID(context.Background(), "req-123")
+	if _, err := a.LoginContext(ctx, "alice", "password123", stores.DeviceInfo{}); err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if _, err := a.LoginContext(context.Background(), "alice", "password123", stores.DeviceInfo{}); err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+
+	events := audit.Events()
+	if len(events) != 2 || events[0].RequestID != "req-123" || events[1].RequestID != "" {
+		t.Errorf("expected the request ID of the context in the first event only, got %+v", events)
+	}
+}
+
+func TestRegistrationPolicy(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {AdminScope}}
+	memStore := stores.NewInMemoryUserStore(cfg)
+	jwtManager, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(memStore).
+		WithConfig(testTokenConfig).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	a := NewAuthify(memStore, jwtManager)
+	_, _ = memStore.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin", "email": "root@example.com"})
+	_, _ = memStore.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user", "email": "alice@example.com"})
+	adminToken, _ := a.Tokens.GenerateAccessToken("root", "password123")
+	userToken, _ := a.Tokens.GenerateAccessToken("alice", "password123")
+
+	ctx := context.Background()
+	n := 0
+	register := func(reg Registration) error {
+		n++
+		_, err := a.RegisterUser(ctx, map[string]any{
+			"username": fmt.Sprintf("user%d", n),
+			"password": "password123",
+			"role":     "user",
+			"email":    fmt.Sprintf("user%d@example.com", n),
+		}, reg)
+		return err
+	}
+
+	// open
+	if err := register(Registration{}); err != nil {
+		t.Errorf("expected open registration, got %v", err)
+	}
+
+	// closed
+	a.WithRegistrationPolicy(RegistrationClosed, nil)
+	if err := register(Registration{}); !errors.Is(err, ErrRegistrationClosed) || ErrorCode(err) != CodeRegistrationClosed {
+		t.Errorf("expected ErrRegistrationClosed, got %v", err)
+	}
+	if err := register(Registration{AccessToken: userToken}); !errors.Is(err, ErrRegistrationClosed) {
+		t.Errorf("expected ErrRegistrationClosed without the admin scope, got %v", err)
+	}
+	if err := register(Registration{AccessToken: "not-a-token"}); ErrorCode(err) != CodeInvalidToken {
+		t.Errorf("expected an invalid token error, got %v", err)
+	}
+	if err := register(Registration{AccessToken: adminToken}); err != nil {
+		t.Errorf("expected administrators to create users, got %v", err)
+	}
+
+	// invite, without and with a store
+	a.WithRegistrationPolicy(RegistrationInvite, nil)
+	if err := register(Registration{InviteCode: "code"}); !errors.Is(err, ErrInvitesNotSupported) {
+		t.Errorf("expected ErrInvitesNotSupported, got %v", err)
+	}
+	if _, _, err := a.CreateInvite(ctx, 1, time.Time{}); !errors.Is(err, ErrInvitesNotSupported) {
+		t.Errorf("expected ErrInvitesNotSupported, got %v", err)
+	}
+	a.WithRegistrationPolicy(RegistrationInvite, stores.NewInMemoryInviteStore())
+
+	if err := register(Registration{}); !errors.Is(err, ErrInviteRequired) || ErrorCode(err) != CodeInviteRequired {
+		t.Errorf("expected ErrInviteRequired, got %v", err)
+	}
+	if err := register(Registration{InviteCode: "unknown"}); !errors.Is(err, ErrInviteNotFound) || ErrorCode(err) != CodeInvalidInvite {
+		t.Errorf("expected ErrInviteNotFound, got %v", err)
+	}
+	if err := register(Registration{AccessToken: adminToken}); err != nil {
+		t.Errorf("expected administrators to create users without an invite, got %v", err)
+	}
+
+	code, _, err := a.CreateInvite(ctx, 1, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	// invalid fields leave the invite unused
+	if _, err := a.RegisterUser(ctx, map[string]any{"username": "nopassword"}, Registration{InviteCode: code}); !errors.Is(err, ErrMissingField) {
+		t.Errorf("expected ErrMissingField, got %v", err)
+	}
+	// so does a taken username, the use is given back
+	if _, err := a.RegisterUser(ctx, map[string]any{
+		"username": "alice", "password": "password123", "role": "user", "email": "alice2@example.com",
+	}, Registration{InviteCode: code}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("expected ErrUserExists, got %v", err)
+	}
+	if err := register(Registration{InviteCode: code}); err != nil {
+		t.Errorf("expected the invite to create a user, got %v", err)
+	}
+	if err := register(Registration{InviteCode: code}); !errors.Is(err, ErrInviteUsedUp) || ErrorCode(err) != CodeInvalidInvite {
+		t.Errorf("expected ErrInviteUsedUp, got %v", err)
+	}
+
+	expired, _, err := a.CreateInvite(ctx, 1, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	if err := register(Registration{InviteCode: expired}); !errors.Is(err, ErrInviteExpired) || ErrorCode(err) != CodeInvalidInvite {
+		t.Errorf("expected ErrInviteExpired, got %v", err)
+	}
+
+	invites, err := a.ListInvites(ctx)
+	if err != nil || len(invites) != 2 || invites[0].Uses != 1 {
+		t.Errorf("expected the used and the expired invite, got %+v (%v)", invites, err)
+	}
+}
+
+func TestRegistrationInviteRace(t *testing.T) {
+	a := setupAuthify().WithRegistrationPolicy(RegistrationInvite, stores.NewInMemoryInviteStore())
+	code, _, err := a.CreateInvite(context.Background(), 1, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+
+	const racers = 10
+	var created atomic.Int32
+	var wg sync.WaitGroup
+	for i := range racers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.RegisterUser(context.Background(), map[string]any{
+				"username": fmt.Sprintf("racer%d", i),
+				"password": "password123",
+				"role":     "user",
+				"email":    fmt.Sprintf("racer%d@example.com", i),
+			}, Registration{InviteCode: code})
+			if err == nil {
+				created.Add(1)
+			} else if !errors.Is(err, ErrInviteUsedUp) {
+				t.Errorf("expected ErrInviteUsedUp, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created.Load() != 1 {
+		t.Errorf("expected a single user created with the invite, got %d", created.Load())
+	}
+}
+
+func TestParseRegistrationPolicy(t *testing.T) {
+	for name, want := range map[string]RegistrationPolicy{"": RegistrationOpen, "open": RegistrationOpen, "invite": RegistrationInvite, "closed": RegistrationClosed} {
+		if got, err := ParseRegistrationPolicy(name); err != nil || got != want {
+			t.Errorf("expected %v for %q, got %v (%v)", want, name, got, err)
+		}
+	}
+	if _, err := ParseRegistrationPolicy("admin"); err == nil {
+		t.Error("expected an unknown policy to fail")
+	}
+}
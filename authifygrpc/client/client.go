@@ -0,0 +1,452 @@
+// Package client talks to an authify server over the gRPC API served by cmd/grpc,
+// like the client package does over HTTP.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	authifygrpc "github.com/HassanAli101/authify/internal/grpc"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultTimeout  = 10 * time.Second
+	defaultAttempts = 3
+	defaultBackoff  = 100 * time.Millisecond
+)
+
+// Client calls the AuthService of an authify server. It is safe for concurrent use.
+type Client struct {
+	conn   *grpc.ClientConn
+	rpc    authifygrpc.AuthServiceClient
+	health healthpb.HealthClient
+
+	creds    credentials.TransportCredentials
+	dialOpts []grpc.DialOption
+	timeout  time.Duration
+	attempts int
+	backoff  time.Duration
+
+	mu          sync.RWMutex
+	accessToken string
+}
+
+// Option customizes the Client built by NewClient.
+type Option func(*Client)
+
+// WithTLS connects with TLS configured by cfg. Without WithTLS or WithInsecure,
+// the client connects with TLS, verifying the server against the system roots.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.creds = credentials.NewTLS(cfg)
+	}
+}
+
+// WithInsecure connects without TLS, e.g. to a server on localhost or behind a sidecar.
+func WithInsecure() Option {
+	return func(c *Client) {
+		c.creds = insecure.NewCredentials()
+	}
+}
+
+// WithTimeout bounds every call, retries included, 10s by default. Zero disables it,
+// leaving the deadline of the caller's context.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithRetry makes calls failing with codes.Unavailable be tried up to attempts times,
+// waiting backoff before the first retry and twice as long before every next one.
+// The default is 3 attempts, 100ms apart at first. One attempt disables retries.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.attempts = max(attempts, 1)
+		c.backoff = backoff
+	}
+}
+
+// WithAccessToken sets the access token sent along with calls, see SetAccessToken.
+func WithAccessToken(accessToken string) Option {
+	return func(c *Client) {
+		c.accessToken = accessToken
+	}
+}
+
+// WithDialOptions passes opts to grpc.NewClient, after the ones of the client.
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(c *Client) {
+		c.dialOpts = append(c.dialOpts, opts...)
+	}
+}
+
+// NewClient returns a client for the server at target, e.g. "auth.example.com:50051".
+// No connection is made before the first call, see CheckHealth to connect eagerly.
+func NewClient(target string, opts ...Option) (*Client, error) {
+	c := &Client{
+		creds:    credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12}),
+		timeout:  defaultTimeout,
+		attempts: defaultAttempts,
+		backoff:  defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(c.creds),
+		grpc.WithChainUnaryInterceptor(c.withTimeout, c.withRetry, c.withAccessToken, withRequestID),
+	}, c.dialOpts...)
+	conn, err := grpc.NewClient(target, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	c.rpc = authifygrpc.NewAuthServiceClient(conn)
+	c.health = healthpb.NewHealthClient(conn)
+	return c, nil
+}
+
+// Close closes the connection to the server, calls fail afterwards.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// CheckHealth asks the server whether the AuthService is serving, with the standard
+// gRPC health check, connecting first if needed.
+func (c *Client) CheckHealth(ctx context.Context) error {
+	resp, err := c.health.Check(ctx, &healthpb.HealthCheckRequest{Service: authifygrpc.ServiceName})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("authify: service is %s", resp.Status)
+	}
+	return nil
+}
+
+// SetAccessToken sets the access token sent as "authorization: Bearer" metadata with every
+// call, an empty token sends none. Login and Refresh set it to the token they return.
+func (c *Client) SetAccessToken(accessToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accessToken = accessToken
+}
+
+// AccessToken returns the access token sent with calls.
+func (c *Client) AccessToken() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.accessToken
+}
+
+// Tokens are the tokens issued by a login, and when they expire.
+type Tokens struct {
+	AccessToken      string
+	RefreshToken     string
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+}
+
+// Verification is what the server knows about a valid access token.
+type Verification struct {
+	Claims map[string]string
+	Scopes []string
+	// ExpiresAt is when the token expires, zero when it does not
+	ExpiresAt time.Time
+	// RefreshedToken replaces a token close to expiry, when the server extends sessions on use
+	RefreshedToken string
+}
+
+// CreateUser registers a user with a password and returns its non-hidden columns, such as
+// the id generated for it and its default role.
+func (c *Client) CreateUser(ctx context.Context, username, password string) (map[string]string, error) {
+	resp, err := c.rpc.CreateUser(ctx, &authifygrpc.CreateUserRequest{Username: username, Password: password})
+	if err != nil {
+		return nil, translate(err)
+	}
+	return createdUser(resp), nil
+}
+
+// CreateUserWithInvite is CreateUser under the invite registration policy, using up an invite
+// code handed out by an administrator.
+func (c *Client) CreateUserWithInvite(ctx context.Context, username, password, inviteCode string) (map[string]string, error) {
+	resp, err := c.rpc.CreateUser(ctx, &authifygrpc.CreateUserRequest{Username: username, Password: password, InviteCode: inviteCode})
+	if err != nil {
+		return nil, translate(err)
+	}
+	return createdUser(resp), nil
+}
+
+// createdUser returns the user of resp, or its identity when the server predates the user field
+func createdUser(resp *authifygrpc.CreateUserResponse) map[string]string {
+	if resp.User != nil {
+		return resp.User.Fields
+	}
+	return resp.Identity
+}
+
+// Login logs in with the user's password, and sends the access token with the next calls.
+func (c *Client) Login(ctx context.Context, username, password string) (Tokens, error) {
+	resp, err := c.rpc.GenerateToken(ctx, &authifygrpc.GenerateTokenRequest{Username: username, Password: password})
+	if err != nil {
+		return Tokens{}, translate(err)
+	}
+	c.SetAccessToken(resp.AccessToken)
+	return Tokens{
+		AccessToken:      resp.AccessToken,
+		RefreshToken:     resp.RefreshToken,
+		AccessExpiresAt:  time.Unix(resp.AccessExpiresAt, 0).UTC(),
+		RefreshExpiresAt: time.Unix(resp.RefreshExpiresAt, 0).UTC(),
+	}, nil
+}
+
+// FederatedLogin logs in with the ID token of the identity provider the server is configured
+// with, and sends the access token with the next calls.
+func (c *Client) FederatedLogin(ctx context.Context, idToken string) (Tokens, error) {
+	resp, err := c.rpc.FederatedLogin(ctx, &authifygrpc.FederatedLoginRequest{IdToken: idToken})
+	if err != nil {
+		return Tokens{}, translate(err)
+	}
+	c.SetAccessToken(resp.AccessToken)
+	return Tokens{
+		AccessToken:      resp.AccessToken,
+		RefreshToken:     resp.RefreshToken,
+		AccessExpiresAt:  time.Unix(resp.AccessExpiresAt, 0).UTC(),
+		RefreshExpiresAt: time.Unix(resp.RefreshExpiresAt, 0).UTC(),
+	}, nil
+}
+
+// VerifyToken checks an access token, the one sent with calls when accessToken is empty.
+func (c *Client) VerifyToken(ctx context.Context, accessToken string) (Verification, error) {
+	if accessToken == "" {
+		accessToken = c.AccessToken()
+	}
+	resp, err := c.rpc.VerifyToken(ctx, &authifygrpc.VerifyTokenRequest{AccessToken: accessToken})
+	if err != nil {
+		return Verification{}, translate(err)
+	}
+	v := Verification{Claims: resp.Claims, Scopes: resp.Scopes, RefreshedToken: resp.RefreshedToken}
+	if resp.ExpiresAt != 0 {
+		v.ExpiresAt = time.Unix(resp.ExpiresAt, 0).UTC()
+	}
+	return v, nil
+}
+
+// Refresh trades a refresh token for a new access token, which is sent with the next calls.
+// accessToken is the previous access token, it may be expired. Use RefreshTokens with servers
+// rotating refresh tokens.
+func (c *Client) Refresh(ctx context.Context, accessToken, refreshToken string) (string, error) {
+	tokens, err := c.RefreshTokens(ctx, accessToken, refreshToken)
+	return tokens.AccessToken, err
+}
+
+// RefreshTokens is Refresh, also returning the refresh token to use from then on: a new one
+// when the server rotates refresh tokens, which revokes refreshToken, and refreshToken itself
+// otherwise.
+func (c *Client) RefreshTokens(ctx context.Context, accessToken, refreshToken string) (Tokens, error) {
+	resp, err := c.rpc.RefreshToken(ctx, &authifygrpc.RefreshTokenRequest{AccessToken: accessToken, RefreshToken: refreshToken})
+	if err != nil {
+		return Tokens{}, translate(err)
+	}
+	c.SetAccessToken(resp.AccessToken)
+	tokens := Tokens{AccessToken: resp.AccessToken, RefreshToken: resp.RefreshToken}
+	// servers of earlier releases answer without the refresh token and the expiries
+	if tokens.RefreshToken == "" {
+		tokens.RefreshToken = refreshToken
+	}
+	if resp.AccessExpiresAt != 0 {
+		tokens.AccessExpiresAt = time.Unix(resp.AccessExpiresAt, 0).UTC()
+	}
+	if resp.RefreshExpiresAt != 0 {
+		tokens.RefreshExpiresAt = time.Unix(resp.RefreshExpiresAt, 0).UTC()
+	}
+	return tokens, nil
+}
+
+// ServiceToken obtains an access token for a service account with its client credentials,
+// granting scopes or every scope allowed to the account when none are given, and sends it with
+// the next calls. Service tokens come without a refresh token, a new one is asked for once it expires.
+func (c *Client) ServiceToken(ctx context.Context, clientID, clientSecret string, scopes ...string) (accessToken string, expiresAt time.Time, err error) {
+	resp, err := c.rpc.GenerateServiceToken(ctx, &authifygrpc.ServiceTokenRequest{ClientId: clientID, ClientSecret: clientSecret, Scopes: scopes})
+	if err != nil {
+		return "", time.Time{}, translate(err)
+	}
+	c.SetAccessToken(resp.AccessToken)
+	return resp.AccessToken, time.Unix(resp.AccessExpiresAt, 0).UTC(), nil
+}
+
+// InvalidateAllTokens makes the server reject every token issued so far, the one sent with
+// calls included, and returns the time before which tokens are rejected. The access token
+// sent with calls must grant authify.AdminScope.
+func (c *Client) InvalidateAllTokens(ctx context.Context) (time.Time, error) {
+	resp, err := c.rpc.InvalidateAllTokens(ctx, &authifygrpc.Empty{})
+	if err != nil {
+		return time.Time{}, translate(err)
+	}
+	return time.Unix(resp.NotBefore, 0).UTC(), nil
+}
+
+// Capabilities fetches the capabilities document of the server, telling the features it enables
+// and the RPCs it serves.
+func (c *Client) Capabilities(ctx context.Context) (authify.Configuration, error) {
+	resp, err := c.rpc.GetCapabilities(ctx, &authifygrpc.Empty{})
+	if err != nil {
+		return authify.Configuration{}, translate(err)
+	}
+	doc := authify.Configuration{
+		Endpoints:        resp.Endpoints,
+		Features:         make([]authify.Feature, len(resp.Features)),
+		TokenType:        resp.TokenType,
+		GrantTypes:       resp.GrantTypesSupported,
+		RegistrationMode: resp.RegistrationMode,
+	}
+	for i, feature := range resp.Features {
+		doc.Features[i] = authify.Feature(feature)
+	}
+	if policy := resp.PasswordPolicy; policy != nil {
+		doc.PasswordPolicy = authify.PasswordPolicy{Required: policy.Required, MaxLength: int(policy.MaxLength)}
+	}
+	if lifetimes := resp.TokenLifetimes; lifetimes != nil {
+		doc.TokenLifetimes = authify.TokenLifetimes{AccessSeconds: lifetimes.AccessTokenSeconds, RefreshSeconds: lifetimes.RefreshTokenSeconds}
+	}
+	return doc, nil
+}
+
+// TokenSource returns a source of access tokens for username, minted by the server.
+// Pass it to authify.NewTokenTransport to call APIs protected by authify.
+func (c *Client) TokenSource(username, password string) *authify.PasswordTokenSource {
+	return authify.NewPasswordTokenSource(minter{c}, username, password)
+}
+
+// minter adapts a Client to authify.TokenMinter
+type minter struct {
+	c *Client
+}
+
+func (m minter) Login(ctx context.Context, username, password string) (string, string, error) {
+	tokens, err := m.c.Login(ctx, username, password)
+	return tokens.AccessToken, tokens.RefreshToken, err
+}
+
+func (m minter) Refresh(ctx context.Context, accessToken, refreshToken string) (string, error) {
+	return m.c.Refresh(ctx, accessToken, refreshToken)
+}
+
+func (m minter) RefreshTokens(ctx context.Context, accessToken, refreshToken string) (string, string, error) {
+	tokens, err := m.c.RefreshTokens(ctx, accessToken, refreshToken)
+	return tokens.AccessToken, tokens.RefreshToken, err
+}
+
+// withTimeout bounds a call, all its attempts included, by the timeout of the client
+func (c *Client) withTimeout(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// withRetry tries a call again while the server is unavailable, backing off exponentially
+func (c *Client) withRetry(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if status.Code(err) != codes.Unavailable || attempt >= c.attempts {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// withAccessToken attaches the access token of the client, unless the call sets its own
+func (c *Client) withAccessToken(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if accessToken := c.AccessToken(); accessToken != "" && len(md.Get("authorization")) == 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+accessToken)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// withRequestID forwards the request ID of ctx, see authify.WithRequestID, so the server
+// records it in the audit events of the call rather than a new one
+func withRequestID(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if id := authify.RequestIDFromContext(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, authify.RequestIDHeader, id)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// Error is a failed call, carrying the gRPC status and the stable code the server
+// answered with, one of the authify.Code* constants. errors.Is matches it against
+// the sentinel errors of the authify package sharing its code, so callers check
+// errors as they would with the library embedded. Field names the offending input of
+// invalid fields, as reported by the server in a google.rpc.BadRequest detail.
+type Error struct {
+	Status  codes.Code
+	Code    authify.AuthErrorCode
+	Message string
+	Field   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("authify: %s (%s): %s", e.Code, e.Status, e.Message)
+}
+
+// Is reports whether target is an authify error with the code of e. Internal errors
+// match none, as every unknown error maps to authify.CodeInternal.
+func (e *Error) Is(target error) bool {
+	return e.Code != authify.CodeInternal && authify.ErrorCode(target) == e.Code
+}
+
+// translate converts the status errors of the server into an *Error
+func translate(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	apiErr := &Error{Status: st.Code(), Code: authify.CodeInternal, Message: st.Message()}
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			if d.Domain == authifygrpc.ErrorDomain {
+				apiErr.Code = authify.AuthErrorCode(d.Reason)
+			}
+		case *errdetails.BadRequest:
+			if violations := d.GetFieldViolations(); len(violations) > 0 {
+				apiErr.Field = violations[0].GetField()
+			}
+		}
+	}
+	// the deadline of the call, or the timeout of the client, passed before the server answered
+	if apiErr.Code == authify.CodeInternal && st.Code() == codes.DeadlineExceeded {
+		apiErr.Code = authify.CodeTimeout
+	}
+	return apiErr
+}
@@ -0,0 +1,377 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	authifygrpc "github.com/HassanAli101/authify/internal/grpc"
+	"github.com/HassanAli101/authify/middleware"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var testStoreConfig = stores.StoreConfig{
+	Name: "users",
+	Columns: map[string]stores.ColumnConfig{
+		"username": {Type: "text", Required: true, PrimaryKey: true},
+		"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+		"role":     {Type: "text", Default: "user", JWTClaim: "role"},
+	},
+}
+
+var testTokenConfig = &token.TokenConfig{
+	AccessToken: token.AccessTokenConfig{
+		Duration:      time.Minute,
+		SigningMethod: "HS256",
+		Claims: map[string]token.ClaimConfig{
+			"username": {Source: "db", Column: "username", IsIdentifier: true},
+			"role":     {Source: "db", Column: "role"},
+		},
+	},
+	RefreshToken: token.RefreshTokenConfig{
+		Duration: time.Hour,
+		Claims: map[string]token.ClaimConfig{
+			"username": {Source: "db", Column: "username", IsIdentifier: true},
+		},
+	},
+}
+
+// serve registers srv and the health service on a gRPC server listening in memory,
+// and returns a client connected to it
+func serve(t *testing.T, srv authifygrpc.AuthServiceServer, opts ...Option) *Client {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	authifygrpc.RegisterAuthServiceServer(server, srv)
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(authifygrpc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }
+	opts = append([]Option{WithInsecure(), WithDialOptions(grpc.WithContextDialer(dialer))}, opts...)
+	c, err := NewClient("passthrough:///bufnet", opts...)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func newTestServer(t *testing.T) *authifygrpc.AuthifyGRPCServer {
+	t.Helper()
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	tokens, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(store).
+		WithConfig(testTokenConfig).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	return authifygrpc.NewAuthifyGRPCServer(authify.NewAuthify(store, tokens))
+}
+
+func TestClientTokenFlow(t *testing.T) {
+	c := serve(t, newTestServer(t))
+	ctx := context.Background()
+
+	if err := c.CheckHealth(ctx); err != nil {
+		t.Fatalf("expected the server to be healthy, got %v", err)
+	}
+	user, err := c.CreateUser(ctx, "alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if user["username"] != "alice" || user["role"] != "user" || user["password"] != "" {
+		t.Errorf("expected alice with the default role, got %v", user)
+	}
+	tokens, err := c.Login(ctx, "alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if !tokens.AccessExpiresAt.After(time.Now()) || !tokens.RefreshExpiresAt.After(tokens.AccessExpiresAt) {
+		t.Errorf("expected the expiries of the tokens, got %v and %v", tokens.AccessExpiresAt, tokens.RefreshExpiresAt)
+	}
+
+	// the token stored by Login is verified when none is given
+	verification, err := c.VerifyToken(ctx, "")
+	if err != nil || verification.Claims["username"] != "alice" {
+		t.Fatalf("expected the token of alice, got %+v %v", verification, err)
+	}
+	refreshed, err := c.Refresh(ctx, tokens.AccessToken, tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if c.AccessToken() != refreshed {
+		t.Errorf("expected the refreshed token to be sent with the next calls")
+	}
+	// JWT refresh tokens are not rotated
+	pair, err := c.RefreshTokens(ctx, refreshed, tokens.RefreshToken)
+	if err != nil || pair.RefreshToken != tokens.RefreshToken || pair.AccessExpiresAt.IsZero() {
+		t.Errorf("expected the refresh token and the expiry of the new access token, got %+v (%v)", pair, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := serve(t, newTestServer(t))
+	ctx := context.Background()
+	_, _ = c.CreateUser(ctx, "alice", "password123")
+
+	tests := []struct {
+		name     string
+		call     func() error
+		status   codes.Code
+		sentinel error
+	}{
+		{
+			name: "existing user",
+			call: func() error {
+				_, err := c.CreateUser(ctx, "alice", "password123")
+				return err
+			},
+			status:   codes.AlreadyExists,
+			sentinel: authify.ErrUserExists,
+		},
+		{
+			name: "wrong password",
+			call: func() error {
+				_, err := c.Login(ctx, "alice", "wrong")
+				return err
+			},
+			status:   codes.Unauthenticated,
+			sentinel: authify.ErrInvalidCredentials,
+		},
+		{
+			name: "invalid token",
+			call: func() error {
+				_, err := c.VerifyToken(ctx, "not-a-token")
+				return err
+			},
+			status:   codes.Unauthenticated,
+			sentinel: authify.ErrInvalidToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if !errors.Is(err, tt.sentinel) {
+				t.Errorf("expected %v, got %v", tt.sentinel, err)
+			}
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || apiErr.Status != tt.status {
+				t.Errorf("expected status %s, got %v", tt.status, err)
+			}
+			if errors.Is(err, authify.ErrUserNotFound) {
+				t.Errorf("expected %v not to match an error of another code", err)
+			}
+		})
+	}
+}
+
+func TestClientServiceToken(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	accounts := stores.NewInMemoryServiceAccountStore()
+	secret, _ := accounts.CreateServiceAccount("reports-job", []string{"reports:read", "reports:write"})
+	tokens, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(store).
+		WithServiceAccounts(accounts).
+		WithConfig(testTokenConfig).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	c := serve(t, authifygrpc.NewAuthifyGRPCServer(authify.NewAuthify(store, tokens)))
+	ctx := context.Background()
+
+	accessToken, expiresAt, err := c.ServiceToken(ctx, "reports-job", secret, "reports:read")
+	if err != nil {
+		t.Fatalf("failed to obtain a service token: %v", err)
+	}
+	if accessToken == "" || !expiresAt.After(time.Now()) {
+		t.Errorf("expected a token with its expiry, got %q %v", accessToken, expiresAt)
+	}
+	verification, err := c.VerifyToken(ctx, "")
+	if err != nil || verification.Claims[token.ClaimSubject] != "reports-job" || !slices.Equal(verification.Scopes, []string{"reports:read"}) {
+		t.Errorf("expected the reports:read token of reports-job, got %+v %v", verification, err)
+	}
+
+	if _, _, err := c.ServiceToken(ctx, "reports-job", "wrong"); !errors.Is(err, authify.ErrInvalidClientCredentials) {
+		t.Errorf("expected ErrInvalidClientCredentials, got %v", err)
+	}
+	if _, _, err := c.ServiceToken(ctx, "reports-job", secret, "users:admin"); !errors.Is(err, authify.ErrInvalidScope) {
+		t.Errorf("expected ErrInvalidScope, got %v", err)
+	}
+	_ = accounts.SetServiceAccountDisabled("reports-job", true)
+	if _, _, err := c.ServiceToken(ctx, "reports-job", secret); !errors.Is(err, authify.ErrAccountDisabled) {
+		t.Errorf("expected ErrAccountDisabled, got %v", err)
+	}
+}
+
+func TestClientInvalidateAllTokens(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {authify.AdminScope}}
+	store := stores.NewInMemoryUserStore(cfg)
+	_, _ = store.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin"})
+	_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+	tokens, err := token.NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(store).
+		WithConfig(testTokenConfig).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	c := serve(t, authifygrpc.NewAuthifyGRPCServer(authify.NewAuthify(store, tokens)))
+	ctx := context.Background()
+
+	if _, err := c.Login(ctx, "alice", "password123"); err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if _, err := c.InvalidateAllTokens(ctx); !errors.Is(err, authify.ErrInsufficientScope) {
+		t.Errorf("expected ErrInsufficientScope for a user, got %v", err)
+	}
+
+	if _, err := c.Login(ctx, "root", "password123"); err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	notBefore, err := c.InvalidateAllTokens(ctx)
+	if err != nil || time.Since(notBefore) > time.Minute {
+		t.Fatalf("expected the tokens to be invalidated, got %v %v", notBefore, err)
+	}
+	if _, err := c.VerifyToken(ctx, ""); !errors.Is(err, authify.ErrTokenInvalidatedGlobally) {
+		t.Errorf("expected the admin's token to be rejected, got %v", err)
+	}
+}
+
+func TestClientCapabilities(t *testing.T) {
+	ctx := context.Background()
+
+	doc, err := serve(t, newTestServer(t)).Capabilities(ctx)
+	if err != nil {
+		t.Fatalf("failed to fetch the capabilities: %v", err)
+	}
+	if !slices.Contains(doc.Features, authify.FeatureTokenExchange) || !slices.Contains(doc.Endpoints, "ExchangeToken") {
+		t.Errorf("expected token exchange to be served by default, got %v and %v", doc.Features, doc.Endpoints)
+	}
+	if doc.TokenType != "jwt" || doc.TokenLifetimes != (authify.TokenLifetimes{AccessSeconds: 60, RefreshSeconds: 3600}) {
+		t.Errorf("expected jwt tokens with the configured lifetimes, got %q and %+v", doc.TokenType, doc.TokenLifetimes)
+	}
+
+	c := serve(t, newTestServer(t).WithoutFeatures(authify.FeatureTokenExchange))
+	doc, err = c.Capabilities(ctx)
+	if err != nil {
+		t.Fatalf("failed to fetch the capabilities: %v", err)
+	}
+	if slices.Contains(doc.Features, authify.FeatureTokenExchange) || slices.Contains(doc.Endpoints, "ExchangeToken") {
+		t.Errorf("expected token exchange to be left out, got %v and %v", doc.Features, doc.Endpoints)
+	}
+	_, err = c.rpc.ExchangeToken(ctx, &authifygrpc.ExchangeTokenRequest{SubjectToken: "token", ActorUsername: "reports-job"})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected ExchangeToken to be unimplemented, got %v", err)
+	}
+}
+
+func TestClientInvalidFields(t *testing.T) {
+	srv := newTestServer(t)
+	c := serve(t, srv)
+	ctx := context.Background()
+
+	var apiErr *Error
+	_, err := c.CreateUser(ctx, "alice", strings.Repeat("a", 73))
+	if !errors.As(err, &apiErr) || apiErr.Status != codes.InvalidArgument || apiErr.Code != authify.CodeFieldTooLong || apiErr.Field != "password" {
+		t.Errorf("expected InvalidArgument naming the password, got %v", err)
+	}
+	_, err = c.CreateUser(ctx, "al\x00ice", "password123")
+	if !errors.As(err, &apiErr) || apiErr.Status != codes.InvalidArgument || apiErr.Code != authify.CodeInvalidField || apiErr.Field != "username" {
+		t.Errorf("expected InvalidArgument naming the username, got %v", err)
+	}
+
+	// clients cannot marshal invalid UTF-8 in string fields, nor send 1MB over the limit of
+	// cmd/grpc, the server checks them all the same
+	for name, req := range map[string]*authifygrpc.CreateUserRequest{
+		"1MB password":           {Username: "alice", Password: strings.Repeat("a", 1<<20)},
+		"invalid UTF-8 username": {Username: "al\xffice", Password: "password123"},
+	} {
+		if _, err := srv.CreateUser(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+		}
+	}
+}
+
+// flakyServer is unavailable for its first failures calls
+type flakyServer struct {
+	authifygrpc.UnimplementedAuthServiceServer
+	failures int64
+	calls    atomic.Int64
+	auth     atomic.Value // access token in the metadata of the last VerifyToken
+}
+
+func (s *flakyServer) GenerateToken(ctx context.Context, req *authifygrpc.GenerateTokenRequest) (*authifygrpc.TokenResponse, error) {
+	if s.calls.Add(1) <= s.failures {
+		return nil, status.Error(codes.Unavailable, "warming up")
+	}
+	return &authifygrpc.TokenResponse{AccessToken: "access", RefreshToken: "refresh"}, nil
+}
+
+func (s *flakyServer) VerifyToken(ctx context.Context, req *authifygrpc.VerifyTokenRequest) (*authifygrpc.VerifyTokenResponse, error) {
+	s.auth.Store(middleware.AccessTokenFromMetadata(ctx))
+	return &authifygrpc.VerifyTokenResponse{}, nil
+}
+
+func TestClientRetriesUnavailable(t *testing.T) {
+	srv := &flakyServer{failures: 2}
+	c := serve(t, srv, WithRetry(3, time.Millisecond))
+
+	tokens, err := c.Login(context.Background(), "alice", "password123")
+	if err != nil || tokens.AccessToken != "access" {
+		t.Fatalf("expected the third attempt to succeed, got %+v %v", tokens, err)
+	}
+	if calls := srv.calls.Load(); calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+
+	if _, err := c.VerifyToken(context.Background(), "other"); err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if sent := srv.auth.Load(); sent != "access" {
+		t.Errorf("expected the token of the login in the authorization metadata, got %q", sent)
+	}
+
+	srv = &flakyServer{failures: 5}
+	c = serve(t, srv, WithRetry(2, time.Millisecond))
+	var apiErr *Error
+	if _, err := c.Login(context.Background(), "alice", "password123"); !errors.As(err, &apiErr) || apiErr.Status != codes.Unavailable {
+		t.Errorf("expected Unavailable once the attempts are exhausted, got %v", err)
+	}
+	if calls := srv.calls.Load(); calls != 2 {
+		t.Errorf("expected the client to give up after 2 attempts, got %d", calls)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	srv := &flakyServer{failures: 1000}
+	c := serve(t, srv, WithRetry(1000, 10*time.Millisecond), WithTimeout(50*time.Millisecond))
+
+	if _, err := c.Login(context.Background(), "alice", "password123"); !errors.Is(err, authify.ErrTimeout) {
+		t.Errorf("expected ErrTimeout once the timeout passed, got %v", err)
+	}
+}
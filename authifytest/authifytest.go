@@ -0,0 +1,101 @@
+// Package authifytest provides helpers for testing code built on authify: a ready to use
+// Authify backed by the in-memory store, a programmable fake TokenManager, factories of
+// signed access tokens, and conformance suites for Store and TokenManager implementations.
+//
+// Every helper builds its own configs and stores, so tests using them can run in parallel.
+package authifytest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+// Secrets of the JWT manager built by NewTestAuthify, also used to sign the tokens of
+// SignedAccessToken and ExpiredAccessToken
+const (
+	AccessSecret  = "authifytest-access-secret"
+	RefreshSecret = "authifytest-refresh-secret"
+)
+
+// AccessTokenDuration is the lifetime of the access tokens issued by NewTestAuthify
+const AccessTokenDuration = time.Minute
+
+// StoreConfig returns the default schema of the test stores: a username primary key,
+// a hidden password, a role defaulting to "user" and an optional email. Admins are
+// granted users:read, users:write and users:admin, users only users:read.
+func StoreConfig() stores.StoreConfig {
+	return stores.StoreConfig{
+		Name:       "users",
+		BcryptCost: 4, // the minimum, keeping password hashing fast in tests
+		Columns: map[string]stores.ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+			"role":     {Type: "text", Default: "user", JWTClaim: "role"},
+			"email":    {Type: "text", JWTClaim: "email"},
+		},
+		RolePermissions: map[string][]string{
+			"admin": {"users:read", "users:write", authify.AdminScope},
+			"user":  {"users:read"},
+		},
+	}
+}
+
+// TokenConfig returns the token config of NewTestAuthify: access tokens carry the
+// username and role of the user and last AccessTokenDuration, refresh tokens the
+// username and last an hour.
+func TokenConfig() *token.TokenConfig {
+	return &token.TokenConfig{
+		AccessToken: token.AccessTokenConfig{
+			Duration:      AccessTokenDuration,
+			SigningMethod: "HS256",
+			Claims: map[string]token.ClaimConfig{
+				"username": {Source: "db", Column: "username", IsIdentifier: true},
+				"role":     {Source: "db", Column: "role"},
+			},
+		},
+		RefreshToken: token.RefreshTokenConfig{
+			Duration: time.Hour,
+			Claims: map[string]token.ClaimConfig{
+				"username": {Source: "db", Column: "username"},
+			},
+		},
+	}
+}
+
+// NewTestAuthify returns an Authify backed by a fresh in-memory store with the schema of
+// StoreConfig, and a JWT manager using TokenConfig, AccessSecret and RefreshSecret.
+// The store starts empty, see CreateUser, and is closed when the test ends.
+func NewTestAuthify(t testing.TB) *authify.Authify {
+	t.Helper()
+
+	store := stores.NewInMemoryUserStore(StoreConfig())
+	t.Cleanup(func() { store.Close() })
+	tokens, err := token.NewJWTManager().
+		WithConfig(TokenConfig()).
+		WithAccessSecret(AccessSecret).
+		WithRefreshSecret(RefreshSecret).
+		WithStore(store).
+		Build()
+	if err != nil {
+		t.Fatalf("authifytest: failed to build jwt manager: %v", err)
+	}
+	return authify.NewAuthify(store, tokens)
+}
+
+// CreateUser adds a user to the store of a, failing the test if it cannot be created.
+// An empty role leaves the column default.
+func CreateUser(t testing.TB, a *authify.Authify, username, password, role string) {
+	t.Helper()
+
+	data := map[string]any{"username": username, "password": password}
+	if role != "" {
+		data["role"] = role
+	}
+	if _, err := a.Store.CreateUser(data); err != nil {
+		t.Fatalf("authifytest: failed to create user %s: %v", username, err)
+	}
+}
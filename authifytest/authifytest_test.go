@@ -0,0 +1,130 @@
+package authifytest_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/authifytest"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestInMemoryStoreConformance(t *testing.T) {
+	t.Parallel()
+	authifytest.RunStoreConformanceTests(t, func() stores.Store {
+		return stores.NewInMemoryUserStore(authifytest.StoreConfig())
+	})
+}
+
+func TestFallbackStoreConformance(t *testing.T) {
+	t.Parallel()
+	authifytest.RunStoreConformanceTests(t, func() stores.Store {
+		return stores.NewFallbackStore(
+			stores.NewInMemoryUserStore(authifytest.StoreConfig()),
+			stores.NewInMemoryUserStore(authifytest.StoreConfig()),
+			true,
+		)
+	})
+}
+
+func TestJWTManagerConformance(t *testing.T) {
+	t.Parallel()
+	authifytest.RunTokenManagerConformanceTests(t, func(t *testing.T, store stores.Store, accessTTL, refreshTTL time.Duration) token.TokenManager {
+		cfg := authifytest.TokenConfig()
+		cfg.AccessToken.Duration = accessTTL
+		cfg.RefreshToken.Duration = refreshTTL
+		m, err := token.NewJWTManager().
+			WithConfig(cfg).
+			WithAccessSecret(authifytest.AccessSecret).
+			WithRefreshSecret(authifytest.RefreshSecret).
+			WithStore(store).
+			Build()
+		if err != nil {
+			t.Fatalf("failed to build JWT manager: %v", err)
+		}
+		return m
+	})
+}
+
+func TestOpaqueTokenManagerConformance(t *testing.T) {
+	t.Parallel()
+	authifytest.RunTokenManagerConformanceTests(t, func(t *testing.T, store stores.Store, accessTTL, refreshTTL time.Duration) token.TokenManager {
+		return token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), accessTTL, refreshTTL).WithStore(store)
+	})
+}
+
+func TestNewTestAuthify(t *testing.T) {
+	t.Parallel()
+	a := authifytest.NewTestAuthify(t)
+	authifytest.CreateUser(t, a, "alice", "password123", "admin")
+
+	accessToken, _, err := a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	username, role, err := a.Authenticate(accessToken)
+	if err != nil || username != "alice" || role != "admin" {
+		t.Errorf("expected alice as admin, got %q %q (%v)", username, role, err)
+	}
+	if err := a.Tokens.VerifyTokenWithScope(accessToken, authify.AdminScope); err != nil {
+		t.Errorf("expected admins to be granted %s, got %v", authify.AdminScope, err)
+	}
+}
+
+func TestSignedAccessToken(t *testing.T) {
+	t.Parallel()
+	a := authifytest.NewTestAuthify(t)
+
+	signed := authifytest.SignedAccessToken(t, "bob", "user", authifytest.WithScopes("reports:read"), authifytest.WithClaim("email", "bob@example.com"))
+	claims, err := a.AuthenticateClaims(signed)
+	if err != nil {
+		t.Fatalf("expected the signed token to verify, got %v", err)
+	}
+	if claims["username"] != "bob" || claims["role"] != "user" || claims["email"] != "bob@example.com" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+	if !token.HasScopes(claims, "reports:read") {
+		t.Errorf("expected the reports:read scope, got %v", claims[token.ClaimScope])
+	}
+
+	expired := authifytest.ExpiredAccessToken(t, "bob", "user")
+	if _, err := a.AuthenticateClaims(expired); !errors.Is(err, authify.ErrTokenExpired) {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestFakeTokenManager(t *testing.T) {
+	t.Parallel()
+	fake := authifytest.NewFakeTokenManager()
+	a := authify.NewAuthify(stores.NewInMemoryUserStore(authifytest.StoreConfig()), fake)
+
+	fake.VerifyAccessTokenFunc = func(tokenStr string) (jwt.MapClaims, error) {
+		if tokenStr != "good" {
+			return nil, token.ErrInvalidToken
+		}
+		return jwt.MapClaims{"username": "alice", "role": "admin"}, nil
+	}
+
+	username, role, err := a.Authenticate("good")
+	if err != nil || username != "alice" || role != "admin" {
+		t.Errorf("expected the programmed claims, got %q %q (%v)", username, role, err)
+	}
+	if _, _, err := a.Authenticate("bad"); !errors.Is(err, token.ErrInvalidToken) {
+		t.Errorf("expected the programmed error, got %v", err)
+	}
+
+	calls := fake.CallsTo("VerifyAccessToken")
+	if len(calls) != 2 || calls[0].Args[0] != "good" || calls[1].Args[0] != "bad" {
+		t.Errorf("expected two recorded verifications, got %v", calls)
+	}
+	if len(fake.Calls()) != 3 {
+		t.Errorf("expected UserIdentifier to be recorded as well, got %v", fake.Calls())
+	}
+
+	if accessToken, err := fake.GenerateAccessToken("alice", "password123"); err != nil || accessToken != authifytest.FakeAccessToken {
+		t.Errorf("expected the default fake token, got %q (%v)", accessToken, err)
+	}
+}
@@ -0,0 +1,335 @@
+package authifytest
+
+import (
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+// RunStoreConformanceTests checks that a Store implementation behaves like the ones of
+// authify on creation, including the user it returns, duplicates, login, wrong passwords, unknown users, hidden columns, the
+// global not-before time and closing. newStore must return an empty store using the schema of StoreConfig, it is called
+// once per subtest so they do not share users, and each store is closed when its subtest ends.
+func RunStoreConformanceTests(t *testing.T, newStore func() stores.Store) {
+	t.Helper()
+
+	alice := func() map[string]any {
+		return map[string]any{"username": "alice", "password": "password123", "role": "admin", "email": "alice@example.com"}
+	}
+
+	t.Run("close", func(t *testing.T) {
+		if err := newStore().Close(); err != nil {
+			t.Errorf("expected the store to close, got %v", err)
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		user, err := store.CreateUser(alice())
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		want := map[string]string{"username": "alice", "role": "admin", "email": "alice@example.com"}
+		if !maps.Equal(user, want) {
+			t.Errorf("expected the created user %v without its password, got %v", want, user)
+		}
+		if count, err := store.CountUsers(); err != nil || count != 1 {
+			t.Errorf("expected 1 user after creation, got %d (%v)", count, err)
+		}
+	})
+
+	t.Run("missing required field", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		_, err := store.CreateUser(map[string]any{"username": "alice"})
+		if !errors.Is(err, stores.ErrMissingField) {
+			t.Errorf("expected ErrMissingField without a password, got %v", err)
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		if _, err := store.CreateUser(alice()); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		if _, err := store.CreateUser(alice()); !errors.Is(err, stores.ErrUserExists) {
+			t.Errorf("expected ErrUserExists for a duplicate, got %v", err)
+		}
+	})
+
+	t.Run("login", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		if _, err := store.CreateUser(alice()); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		user, err := store.GetUserInfo("alice", "password123")
+		if err != nil {
+			t.Fatalf("expected the right password to be accepted, got %v", err)
+		}
+		if user["username"] != "alice" || user["role"] != "admin" || user["email"] != "alice@example.com" {
+			t.Errorf("unexpected user fields: %v", user)
+		}
+	})
+
+	t.Run("column default", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		created, err := store.CreateUser(map[string]any{"username": "bob", "password": "password123"})
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		if want := map[string]string{"username": "bob", "role": "user"}; !maps.Equal(created, want) {
+			t.Errorf("expected the created user %v with the default role, got %v", want, created)
+		}
+		user, err := store.GetUserInfo("bob", "password123")
+		if err != nil {
+			t.Fatalf("failed to get user: %v", err)
+		}
+		if user["role"] != "user" {
+			t.Errorf("expected the default role, got %v", user["role"])
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		if _, err := store.CreateUser(alice()); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		if _, err := store.GetUserInfo("alice", "wrong"); !errors.Is(err, stores.ErrInvalidPassword) {
+			t.Errorf("expected ErrInvalidPassword, got %v", err)
+		}
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		if _, err := store.GetUserInfo("bob", "password123"); !errors.Is(err, stores.ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+	})
+
+	t.Run("hidden columns", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		if _, err := store.CreateUser(alice()); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		user, err := store.GetUserInfo("alice", "password123")
+		if err != nil {
+			t.Fatalf("failed to get user: %v", err)
+		}
+		if _, ok := user["password"]; ok {
+			t.Errorf("expected the hidden password column to be left out, got %v", user)
+		}
+		if getter, ok := store.(stores.UserGetter); ok {
+			fields, err := getter.GetUserByUsername("alice")
+			if err != nil {
+				t.Fatalf("failed to look user up: %v", err)
+			}
+			if _, ok := fields["password"]; ok {
+				t.Errorf("expected GetUserByUsername to leave out the password, got %v", fields)
+			}
+		}
+	})
+
+	t.Run("global not before", func(t *testing.T) {
+		store := newStore()
+		defer store.Close()
+		notBefore, err := store.GetGlobalNotBefore()
+		if err != nil || !notBefore.IsZero() {
+			t.Fatalf("expected no global not-before time, got %v (%v)", notBefore, err)
+		}
+		want := time.Now()
+		for range 2 {
+			if err := store.SetGlobalNotBefore(want); err != nil {
+				t.Fatalf("failed to set the global not-before time: %v", err)
+			}
+			if got, err := store.GetGlobalNotBefore(); err != nil || !got.Equal(want) {
+				t.Errorf("expected the global not-before time %v, got %v (%v)", want, got, err)
+			}
+			want = want.Add(time.Minute)
+		}
+	})
+}
+
+// NewTokenManager builds the TokenManager under test for RunTokenManagerConformanceTests,
+// authenticating users against store, with access tokens lasting accessTTL and refresh
+// tokens refreshTTL. Negative lifetimes must issue tokens that are already expired.
+type NewTokenManager func(t *testing.T, store stores.Store, accessTTL, refreshTTL time.Duration) token.TokenManager
+
+// RunTokenManagerConformanceTests checks that a TokenManager implementation is interchangeable
+// with the ones of authify: issuing tokens on login, verifying them and their scopes, telling
+// access and refresh tokens apart, refreshing, and expiry. Every subtest builds its own
+// in-memory store, holding alice, an admin, and bob, a user, both with password "password123".
+func RunTokenManagerConformanceTests(t *testing.T, newManager NewTokenManager) {
+	t.Helper()
+
+	setup := func(t *testing.T, accessTTL, refreshTTL time.Duration) (stores.Store, token.TokenManager) {
+		t.Helper()
+		store := stores.NewInMemoryUserStore(StoreConfig())
+		for username, role := range map[string]string{"alice": "admin", "bob": "user"} {
+			if _, err := store.CreateUser(map[string]any{"username": username, "password": "password123", "role": role}); err != nil {
+				t.Fatalf("failed to create %s: %v", username, err)
+			}
+		}
+		return store, newManager(t, store, accessTTL, refreshTTL)
+	}
+	login := func(t *testing.T, m token.TokenManager, username string) (accessToken, refreshToken string) {
+		t.Helper()
+		accessToken, err := m.GenerateAccessToken(username, "password123")
+		if err != nil {
+			t.Fatalf("failed to generate access token for %s: %v", username, err)
+		}
+		refreshToken, err = m.GenerateRefreshToken(username, map[string]any{token.ClaimSessionID: "session-" + username})
+		if err != nil {
+			t.Fatalf("failed to generate refresh token for %s: %v", username, err)
+		}
+		return accessToken, refreshToken
+	}
+
+	t.Run("login", func(t *testing.T) {
+		store, m := setup(t, time.Minute, time.Hour)
+		accessToken, _ := login(t, m, "alice")
+
+		username, role, err := authify.NewAuthify(store, m).Authenticate(accessToken)
+		if err != nil || username != "alice" || role != "admin" {
+			t.Errorf("expected alice as admin, got %q %q (%v)", username, role, err)
+		}
+		claims, err := m.VerifyAccessToken(accessToken)
+		if err != nil {
+			t.Fatalf("failed to verify access token: %v", err)
+		}
+		if expiry, err := claims.GetExpirationTime(); err != nil || expiry == nil || time.Until(expiry.Time) > time.Minute {
+			t.Errorf("expected an expiry within a minute, got %v (%v)", expiry, err)
+		}
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		_, m := setup(t, time.Minute, time.Hour)
+		if _, err := m.GenerateAccessToken("alice", "wrong"); !errors.Is(err, stores.ErrInvalidPassword) {
+			t.Errorf("expected ErrInvalidPassword, got %v", err)
+		}
+		if _, err := m.GenerateAccessToken("carol", "password123"); !errors.Is(err, stores.ErrUserNotFound) {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+	})
+
+	t.Run("invalid tokens", func(t *testing.T) {
+		_, m := setup(t, time.Minute, time.Hour)
+		for _, tokenStr := range []string{"", "garbage", "a.b.c"} {
+			if _, err := m.VerifyAccessToken(tokenStr); !errors.Is(err, token.ErrInvalidToken) {
+				t.Errorf("expected ErrInvalidToken for access token %q, got %v", tokenStr, err)
+			}
+			if _, err := m.VerifyRefreshToken(tokenStr); !errors.Is(err, token.ErrInvalidToken) {
+				t.Errorf("expected ErrInvalidToken for refresh token %q, got %v", tokenStr, err)
+			}
+		}
+	})
+
+	t.Run("token kinds", func(t *testing.T) {
+		_, m := setup(t, time.Minute, time.Hour)
+		accessToken, refreshToken := login(t, m, "alice")
+		if _, err := m.VerifyAccessToken(refreshToken); !errors.Is(err, token.ErrInvalidToken) {
+			t.Errorf("expected refresh tokens to be rejected as access tokens, got %v", err)
+		}
+		if _, err := m.VerifyRefreshToken(accessToken); !errors.Is(err, token.ErrInvalidToken) {
+			t.Errorf("expected access tokens to be rejected as refresh tokens, got %v", err)
+		}
+	})
+
+	t.Run("scopes", func(t *testing.T) {
+		_, m := setup(t, time.Minute, time.Hour)
+		accessToken, _ := login(t, m, "bob")
+		if err := m.VerifyTokenWithScope(accessToken, "users:read"); err != nil {
+			t.Errorf("expected users:read to be granted, got %v", err)
+		}
+		if err := m.VerifyTokenWithScope(accessToken, "users:read", authify.AdminScope); !errors.Is(err, token.ErrInsufficientScope) {
+			t.Errorf("expected ErrInsufficientScope for %s, got %v", authify.AdminScope, err)
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		_, m := setup(t, time.Minute, time.Hour)
+		accessToken, refreshToken := login(t, m, "alice")
+
+		refreshClaims, err := m.VerifyRefreshToken(refreshToken)
+		if err != nil {
+			t.Fatalf("failed to verify refresh token: %v", err)
+		}
+		if refreshClaims[token.ClaimSessionID] != "session-alice" {
+			t.Errorf("expected the session ID in the refresh token, got %v", refreshClaims)
+		}
+
+		newToken, _, err := m.RefreshToken(accessToken, refreshToken, nil)
+		if err != nil {
+			t.Fatalf("failed to refresh: %v", err)
+		}
+		claims, err := m.VerifyAccessToken(newToken)
+		if err != nil {
+			t.Fatalf("failed to verify refreshed token: %v", err)
+		}
+		if username, _ := m.UserIdentifier(claims); username != "alice" || claims["role"] != "admin" {
+			t.Errorf("expected the refreshed token to keep alice's claims, got %v", claims)
+		}
+		if !token.HasScopes(claims, authify.AdminScope) {
+			t.Errorf("expected the refreshed token to keep its scopes, got %v", claims[token.ClaimScope])
+		}
+	})
+
+	t.Run("refresh with another user's access token", func(t *testing.T) {
+		_, m := setup(t, time.Minute, time.Hour)
+		_, refreshToken := login(t, m, "bob")
+		adminToken, _ := login(t, m, "alice")
+		if _, _, err := m.RefreshToken(adminToken, refreshToken, nil); !errors.Is(err, token.ErrClaimsInvalid) {
+			t.Errorf("expected ErrClaimsInvalid, got %v", err)
+		}
+	})
+
+	t.Run("refresh of a disabled user", func(t *testing.T) {
+		store, m := setup(t, time.Minute, time.Hour)
+		accessToken, refreshToken := login(t, m, "bob")
+		if err := store.(stores.UserDisabler).SetUserDisabled("bob", true); err != nil {
+			t.Fatalf("failed to disable bob: %v", err)
+		}
+		if _, _, err := m.RefreshToken(accessToken, refreshToken, nil); !errors.Is(err, stores.ErrAccountDisabled) {
+			t.Errorf("expected ErrAccountDisabled, got %v", err)
+		}
+	})
+
+	t.Run("expired access token", func(t *testing.T) {
+		_, m := setup(t, -time.Minute, time.Hour)
+		accessToken, refreshToken := login(t, m, "alice")
+		if _, err := m.VerifyAccessToken(accessToken); !errors.Is(err, token.ErrTokenExpired) {
+			t.Fatalf("expected ErrTokenExpired, got %v", err)
+		}
+
+		// the claims of expired access tokens are carried over by a refresh
+		_, claims, err := m.RefreshToken(accessToken, refreshToken, nil)
+		if err != nil {
+			t.Fatalf("failed to refresh an expired access token: %v", err)
+		}
+		if claims["role"] != "admin" {
+			t.Errorf("expected the role to be carried over, got %v", claims)
+		}
+	})
+
+	t.Run("expired refresh token", func(t *testing.T) {
+		_, m := setup(t, time.Minute, -time.Minute)
+		accessToken, refreshToken := login(t, m, "alice")
+		if _, err := m.VerifyRefreshToken(refreshToken); !errors.Is(err, token.ErrTokenExpired) {
+			t.Errorf("expected ErrTokenExpired, got %v", err)
+		}
+		if _, _, err := m.RefreshToken(accessToken, refreshToken, nil); !errors.Is(err, token.ErrRefreshTokenExpired) {
+			t.Errorf("expected ErrRefreshTokenExpired, got %v", err)
+		}
+	})
+}
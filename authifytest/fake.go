@@ -0,0 +1,201 @@
+package authifytest
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Fixed tokens returned by the FakeTokenManager methods left unprogrammed
+const (
+	FakeAccessToken  = "fake-access-token"
+	FakeRefreshToken = "fake-refresh-token"
+)
+
+// Call is a method call recorded by FakeTokenManager
+type Call struct {
+	Method string
+	Args   []any
+}
+
+// FakeTokenManager is a token.TokenManager whose responses are programmed by setting
+// its Func fields. It records every call, it is safe for concurrent use.
+//
+// A method whose Func is nil succeeds: the generators return FakeAccessToken or
+// FakeRefreshToken, verification returns empty claims and UserIdentifier the
+// "username" claim. IssueTokens, RefreshTokens and VerifyToken are served by the narrow
+// methods, so they are programmed and recorded through them.
+type FakeTokenManager struct {
+	GenerateAccessTokenFunc  func(userIdentifier, password string) (string, error)
+	GenerateRefreshTokenFunc func(username string, requestData map[string]any) (string, error)
+	VerifyAccessTokenFunc    func(tokenStr string) (jwt.MapClaims, error)
+	VerifyRefreshTokenFunc   func(tokenStr string) (jwt.MapClaims, error)
+	RefreshTokenFunc         func(accessTokenStr, refreshTokenStr string, requestData map[string]any) (string, jwt.MapClaims, error)
+	VerifyTokenWithScopeFunc func(tokenStr string, requiredScopes ...string) error
+	UserIdentifierFunc       func(claims jwt.MapClaims) (string, error)
+	ExchangeTokenFunc        func(subjectToken, actorUsername, actorPassword, audience string, ttl time.Duration) (string, error)
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var _ token.TokenManager = (*FakeTokenManager)(nil)
+
+// NewFakeTokenManager returns a FakeTokenManager with no programmed responses
+func NewFakeTokenManager() *FakeTokenManager {
+	return &FakeTokenManager{}
+}
+
+func (f *FakeTokenManager) record(method string, args ...any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the calls made so far, in order
+func (f *FakeTokenManager) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+// CallsTo returns the calls made so far to method, in order
+func (f *FakeTokenManager) CallsTo(method string) []Call {
+	var calls []Call
+	for _, call := range f.Calls() {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (f *FakeTokenManager) GenerateAccessToken(userIdentifier, password string) (string, error) {
+	f.record("GenerateAccessToken", userIdentifier, password)
+	if f.GenerateAccessTokenFunc != nil {
+		return f.GenerateAccessTokenFunc(userIdentifier, password)
+	}
+	return FakeAccessToken, nil
+}
+
+func (f *FakeTokenManager) GenerateRefreshToken(username string, requestData map[string]any) (string, error) {
+	f.record("GenerateRefreshToken", username, requestData)
+	if f.GenerateRefreshTokenFunc != nil {
+		return f.GenerateRefreshTokenFunc(username, requestData)
+	}
+	return FakeRefreshToken, nil
+}
+
+func (f *FakeTokenManager) VerifyAccessToken(tokenStr string) (jwt.MapClaims, error) {
+	f.record("VerifyAccessToken", tokenStr)
+	if f.VerifyAccessTokenFunc != nil {
+		return f.VerifyAccessTokenFunc(tokenStr)
+	}
+	return jwt.MapClaims{}, nil
+}
+
+func (f *FakeTokenManager) VerifyRefreshToken(tokenStr string) (jwt.MapClaims, error) {
+	f.record("VerifyRefreshToken", tokenStr)
+	if f.VerifyRefreshTokenFunc != nil {
+		return f.VerifyRefreshTokenFunc(tokenStr)
+	}
+	return jwt.MapClaims{}, nil
+}
+
+func (f *FakeTokenManager) RefreshToken(accessTokenStr, refreshTokenStr string, requestData map[string]any) (string, jwt.MapClaims, error) {
+	f.record("RefreshToken", accessTokenStr, refreshTokenStr, requestData)
+	if f.RefreshTokenFunc != nil {
+		return f.RefreshTokenFunc(accessTokenStr, refreshTokenStr, requestData)
+	}
+	return FakeAccessToken, jwt.MapClaims{}, nil
+}
+
+func (f *FakeTokenManager) VerifyTokenWithScope(tokenStr string, requiredScopes ...string) error {
+	f.record("VerifyTokenWithScope", tokenStr, requiredScopes)
+	if f.VerifyTokenWithScopeFunc != nil {
+		return f.VerifyTokenWithScopeFunc(tokenStr, requiredScopes...)
+	}
+	return nil
+}
+
+func (f *FakeTokenManager) UserIdentifier(claims jwt.MapClaims) (string, error) {
+	f.record("UserIdentifier", claims)
+	if f.UserIdentifierFunc != nil {
+		return f.UserIdentifierFunc(claims)
+	}
+	username, ok := claims["username"].(string)
+	if !ok || username == "" {
+		return "", token.ErrMissingUserIdentifier
+	}
+	return username, nil
+}
+
+func (f *FakeTokenManager) ExchangeToken(subjectToken, actorUsername, actorPassword, audience string, ttl time.Duration) (string, error) {
+	f.record("ExchangeToken", subjectToken, actorUsername, actorPassword, audience, ttl)
+	if f.ExchangeTokenFunc != nil {
+		return f.ExchangeTokenFunc(subjectToken, actorUsername, actorPassword, audience, ttl)
+	}
+	return FakeAccessToken, nil
+}
+
+func (f *FakeTokenManager) IssueTokens(ctx context.Context, req token.GenerateTokensRequest) (*token.TokenPair, error) {
+	accessToken, err := f.GenerateAccessToken(req.Username, req.Password)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := f.GenerateRefreshToken(req.Username, token.RequestData(req.Device, req.SessionID))
+	if err != nil {
+		return nil, err
+	}
+	return f.tokenPair(accessToken, refreshToken)
+}
+
+func (f *FakeTokenManager) RefreshTokens(ctx context.Context, req token.RefreshTokensRequest) (*token.TokenPair, error) {
+	accessToken, _, err := f.RefreshToken(req.AccessToken, req.RefreshToken, token.RequestData(req.Device, ""))
+	if err != nil {
+		return nil, err
+	}
+	return f.tokenPair(accessToken, req.RefreshToken)
+}
+
+func (f *FakeTokenManager) VerifyToken(ctx context.Context, req token.VerifyTokenRequest) (*token.VerifyTokenResponse, error) {
+	verify := f.VerifyAccessToken
+	if req.Refresh {
+		verify = f.VerifyRefreshToken
+	}
+	claims, err := verify(req.Token)
+	if err != nil {
+		return nil, err
+	}
+	if !token.HasScopes(claims, req.Scopes...) {
+		return nil, token.ErrInsufficientScope
+	}
+	resp := &token.VerifyTokenResponse{Claims: claims}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		resp.ExpiresAt = exp.UTC()
+	}
+	return resp, nil
+}
+
+// tokenPair verifies freshly issued tokens for their expiries, as the managers of authify do
+func (f *FakeTokenManager) tokenPair(accessToken, refreshToken string) (*token.TokenPair, error) {
+	access, err := f.VerifyToken(context.Background(), token.VerifyTokenRequest{Token: accessToken})
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := f.VerifyToken(context.Background(), token.VerifyTokenRequest{Token: refreshToken, Refresh: true})
+	if err != nil {
+		return nil, err
+	}
+	return &token.TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		AccessExpiresAt:  access.ExpiresAt,
+		RefreshExpiresAt: refresh.ExpiresAt,
+		AccessClaims:     access.Claims,
+	}, nil
+}
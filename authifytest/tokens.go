@@ -0,0 +1,66 @@
+package authifytest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenOption customizes the claims of the tokens made by SignedAccessToken
+type TokenOption func(claims jwt.MapClaims)
+
+// WithClaim sets a claim of the token, overriding the default one of the same name
+func WithClaim(name string, value any) TokenOption {
+	return func(claims jwt.MapClaims) {
+		claims[name] = value
+	}
+}
+
+// WithScopes sets the scope claim of the token
+func WithScopes(scopes ...string) TokenOption {
+	return WithClaim(token.ClaimScope, strings.Join(scopes, " "))
+}
+
+// WithAudience sets the aud claim of the token
+func WithAudience(audience ...string) TokenOption {
+	return WithClaim(token.ClaimAudience, audience)
+}
+
+// WithExpiry makes the token expire at expiry instead of after AccessTokenDuration
+func WithExpiry(expiry time.Time) TokenOption {
+	return WithClaim(token.ClaimExpiry, expiry.Unix())
+}
+
+// SignedAccessToken returns an access token for username and role, signed with AccessSecret,
+// that the Authify of NewTestAuthify accepts without the user existing in its store.
+// Handler tests can use it to authenticate requests without logging in first.
+func SignedAccessToken(t testing.TB, username, role string, opts ...TokenOption) string {
+	t.Helper()
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"username":        username,
+		"role":            role,
+		token.ClaimIssued: now.Unix(),
+		token.ClaimExpiry: now.Add(AccessTokenDuration).Unix(),
+	}
+	for _, opt := range opts {
+		opt(claims)
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(AccessSecret))
+	if err != nil {
+		t.Fatalf("authifytest: failed to sign access token: %v", err)
+	}
+	return signed
+}
+
+// ExpiredAccessToken is SignedAccessToken for a token that expired a minute ago
+func ExpiredAccessToken(t testing.TB, username, role string, opts ...TokenOption) string {
+	t.Helper()
+	opts = append([]TokenOption{WithExpiry(time.Now().Add(-time.Minute))}, opts...)
+	return SignedAccessToken(t, username, role, opts...)
+}
@@ -0,0 +1,40 @@
+package authify
+
+import (
+	"testing"
+
+	"github.com/HassanAli101/authify/token"
+)
+
+// Benchmarks of the token hot paths, compare runs with
+// `go test -run '^$' -bench . -benchmem` and benchstat.
+
+func BenchmarkVerifyToken(b *testing.B) {
+	a := setupAuthify()
+	access, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		b.Fatalf("failed to generate access token: %v", err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := a.Tokens.VerifyAccessToken(access); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGenerateToken issues access tokens to an authenticated user, leaving out the
+// password check, whose hashing cost would dwarf the token itself.
+func BenchmarkGenerateToken(b *testing.B) {
+	a := setupAuthify()
+	issuer := a.Tokens.(token.PreauthenticatedIssuer)
+	user := map[string]any{"username": "alice", "role": "user", "email": "alice@example.com"}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := issuer.IssueAccessToken("alice", user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
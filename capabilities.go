@@ -0,0 +1,194 @@
+package authify
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/HassanAli101/authify/token"
+)
+
+// Feature names an optional feature of a deployment, as listed by its capabilities document.
+type Feature string
+
+const (
+	// FeatureChallengeLogin logs users in with a proof of their password, see LoginWithProof
+	FeatureChallengeLogin Feature = "challenge_login"
+	// FeatureFederatedLogin trades the ID tokens of an identity provider for tokens
+	FeatureFederatedLogin Feature = "federated_login"
+	// FeatureAuthorizationCode signs users in through the authorization code flow of identity providers
+	FeatureAuthorizationCode Feature = "authorization_code"
+	// FeatureOAuth serves the OAuth2 token endpoint, with the password and refresh_token grants
+	FeatureOAuth Feature = "oauth"
+	// FeatureIntrospection serves token introspection (RFC 7662)
+	FeatureIntrospection Feature = "introspection"
+	// FeatureTokenExchange trades a user's access token for one acting on their behalf
+	FeatureTokenExchange Feature = "token_exchange"
+	// FeatureUserExists tells whether a unique field value is taken
+	FeatureUserExists Feature = "user_exists"
+	// FeatureSessions lists the logins of users, it needs a session store
+	FeatureSessions Feature = "sessions"
+	// FeatureRefreshRotation rotates refresh tokens within token families, it needs a family store
+	FeatureRefreshRotation Feature = "refresh_rotation"
+	// FeatureInvites manages the invites of the invite registration policy, it needs an invite store
+	FeatureInvites Feature = "invites"
+	// FeatureSecretRotation replaces the signing secrets at runtime
+	FeatureSecretRotation Feature = "secret_rotation"
+	// FeatureIdempotency makes user creation idempotent with the Idempotency-Key header
+	FeatureIdempotency Feature = "idempotency"
+	// FeatureGateway serves the JSON gateway of the gRPC service
+	FeatureGateway Feature = "gateway"
+	// FeatureLegacyRoutes serves the unversioned routes of earlier releases
+	FeatureLegacyRoutes Feature = "legacy_routes"
+	// FeatureSignupChallenge challenges the clients creating many users, see ChallengeProvider
+	FeatureSignupChallenge Feature = "signup_challenge"
+)
+
+// knownFeatures are the features ParseFeature accepts
+var knownFeatures = []Feature{
+	FeatureChallengeLogin, FeatureFederatedLogin, FeatureAuthorizationCode, FeatureOAuth,
+	FeatureIntrospection, FeatureTokenExchange, FeatureUserExists, FeatureSessions, FeatureInvites,
+	FeatureRefreshRotation, FeatureSecretRotation, FeatureIdempotency, FeatureGateway, FeatureLegacyRoutes, FeatureSignupChallenge,
+}
+
+// ParseFeature returns the feature named name, one of the Feature constants
+func ParseFeature(name string) (Feature, error) {
+	if f := Feature(name); slices.Contains(knownFeatures, f) {
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown feature %q", name)
+}
+
+// Capabilities registers the features a deployment enables and the endpoints it serves, and
+// describes them in its Configuration document. The HTTP and gRPC servers fill one in when they
+// are wired, and serve or refuse each endpoint according to it, so the document and the
+// endpoints available always agree. It is not safe to change once the servers are running.
+type Capabilities struct {
+	auth      *Authify
+	features  map[Feature]bool
+	endpoints []string
+}
+
+// NewCapabilities returns the capabilities of a, with the features a itself enables:
+// FeatureSessions with a session store, FeatureRefreshRotation with a family store and
+// FeatureInvites with an invite store.
+func NewCapabilities(a *Authify) *Capabilities {
+	c := &Capabilities{auth: a, features: make(map[Feature]bool)}
+	if a.Sessions != nil {
+		c.Enable(FeatureSessions)
+	}
+	if a.Families != nil {
+		c.Enable(FeatureRefreshRotation)
+	}
+	if a.Invites != nil {
+		c.Enable(FeatureInvites)
+	}
+	return c
+}
+
+// Enable turns features on
+func (c *Capabilities) Enable(features ...Feature) {
+	for _, f := range features {
+		c.features[f] = true
+	}
+}
+
+// Disable turns features off, whatever enabled them
+func (c *Capabilities) Disable(features ...Feature) {
+	for _, f := range features {
+		delete(c.features, f)
+	}
+}
+
+// Enabled reports whether f is on
+func (c *Capabilities) Enabled(f Feature) bool {
+	return c.features[f]
+}
+
+// Features returns the enabled features, sorted
+func (c *Capabilities) Features() []Feature {
+	return slices.Sorted(maps.Keys(c.features))
+}
+
+// AddEndpoint lists an endpoint served by the deployment, such as "POST /v1/users" or the name of an RPC
+func (c *Capabilities) AddEndpoint(endpoint string) {
+	c.endpoints = append(c.endpoints, endpoint)
+}
+
+// Configuration is the capabilities document of a deployment, the analog of the OIDC discovery
+// document, served at /.well-known/authify-configuration and by the GetCapabilities RPC. It only
+// describes what clients can use: it never carries secrets, nor the addresses of the databases
+// and services behind the deployment.
+type Configuration struct {
+	// Endpoints are the endpoints served, sorted
+	Endpoints []string `json:"endpoints"`
+	// Features are the optional features enabled, sorted
+	Features []Feature `json:"features"`
+	// TokenType is "jwt" or "opaque", empty for other token managers
+	TokenType string `json:"token_type,omitempty"`
+	// GrantTypes are the grants of the OAuth2 token endpoint, none without FeatureOAuth
+	GrantTypes     []string       `json:"grant_types_supported"`
+	PasswordPolicy PasswordPolicy `json:"password_policy"`
+	// RegistrationMode is the registration policy, see RegistrationPolicy.String
+	RegistrationMode string         `json:"registration_mode"`
+	TokenLifetimes   TokenLifetimes `json:"token_lifetimes"`
+}
+
+// PasswordPolicy summarizes what the passwords of new users must be
+type PasswordPolicy struct {
+	// Required is whether users are created with a password
+	Required bool `json:"required"`
+	// MaxLength bounds the bytes of passwords, unbounded when zero
+	MaxLength int `json:"max_length,omitempty"`
+}
+
+// TokenLifetimes are the default lifetimes of issued tokens, zero when the token manager does
+// not tell them, see token.LifetimeReporter. Roles may have lifetimes of their own.
+type TokenLifetimes struct {
+	AccessSeconds  int64 `json:"access_token_seconds,omitempty"`
+	RefreshSeconds int64 `json:"refresh_token_seconds,omitempty"`
+}
+
+// Document returns the capabilities document of the registered features and endpoints
+func (c *Capabilities) Document() Configuration {
+	doc := Configuration{
+		Endpoints:        slices.Sorted(slices.Values(c.endpoints)),
+		Features:         c.Features(),
+		TokenType:        tokenType(c.auth.Tokens),
+		GrantTypes:       []string{},
+		RegistrationMode: c.auth.Registration.String(),
+	}
+	if doc.Endpoints == nil {
+		doc.Endpoints = []string{}
+	}
+	if c.Enabled(FeatureOAuth) {
+		doc.GrantTypes = []string{"password", "refresh_token"}
+	}
+
+	storeCfg := c.auth.Store.StoreConfig()
+	if column := storeCfg.PasswordColumn(); column != "" {
+		doc.PasswordPolicy = PasswordPolicy{
+			Required:  storeCfg.Columns[column].Required,
+			MaxLength: storeCfg.MaxLength(column),
+		}
+	}
+	if reporter, ok := c.auth.Tokens.(token.LifetimeReporter); ok {
+		lifetimes := reporter.Lifetimes()
+		doc.TokenLifetimes = TokenLifetimes{
+			AccessSeconds:  int64(lifetimes.Access.Seconds()),
+			RefreshSeconds: int64(lifetimes.Refresh.Seconds()),
+		}
+	}
+	return doc
+}
+
+// tokenType names the kind of tokens m issues
+func tokenType(m token.TokenManager) string {
+	switch m.(type) {
+	case *token.JWTManager:
+		return "jwt"
+	case *token.OpaqueTokenManager:
+		return "opaque"
+	}
+	return ""
+}
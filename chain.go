@@ -0,0 +1,28 @@
+package authify
+
+import "net/http"
+
+// Chain composes middlewares into one, the first being the outermost: Chain(a, b, c)(h) serves
+// requests through a, then b, then c, then h. The middleware package and most routers follow the
+// func(http.Handler) http.Handler shape. The recommended order of the middlewares of authify and
+// of the embedding application is:
+//
+//	authify.Chain(
+//		middleware.RequestID,                 // first, so every log line and audit event carries the ID
+//		logRequests,                          // logs rejected requests too, with their request ID
+//		cors,                                 // answers preflight requests, which carry no credentials
+//		middleware.RateLimit(limiter, key),   // sheds load before tokens are verified
+//		middleware.RequireScope(a, "reports:read"),
+//	)(reportsHandler)
+//
+// Middlewares that are nil are skipped, so optional ones can be passed as is.
+func Chain(middlewares ...func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			if middlewares[i] != nil {
+				next = middlewares[i](next)
+			}
+		}
+		return next
+	}
+}
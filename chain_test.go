@@ -0,0 +1,36 @@
+package authify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	record := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	handler := Chain(record("request-id"), nil, record("logging"), record("auth"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := []string{"request-id", "logging", "auth", "handler"}; !slices.Equal(order, want) {
+		t.Errorf("expected the middlewares to run in order %v, got %v", want, order)
+	}
+
+	order = nil
+	Chain()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !slices.Equal(order, []string{"handler"}) {
+		t.Errorf("expected an empty chain to serve the handler, got %v", order)
+	}
+}
@@ -0,0 +1,323 @@
+// Package client talks to an authify server over the HTTP API served by httpapi.NewRouter.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/lib"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// maxResponseSize bounds the responses read from the server
+const maxResponseSize = 1 << 20
+
+// Client calls the routes of an authify server mounted at its base URL.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	headers    lib.Headers
+}
+
+// Option customizes the Client built by New.
+type Option func(*Client)
+
+// WithHTTPClient sends the requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithHeaderPrefix sends the authify-* headers under prefix instead, for servers built with
+// httpapi.WithHeaderPrefix.
+func WithHeaderPrefix(prefix string) Option {
+	return func(c *Client) {
+		c.headers = lib.Headers{Prefix: prefix}
+	}
+}
+
+// New returns a client for the server at baseURL, including the path prefix the
+// router is mounted under, e.g. "https://example.com/auth".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Tokens are the tokens issued by a login, and when they expire. The expiries are zero
+// when the server does not report them.
+type Tokens struct {
+	AccessToken      string
+	RefreshToken     string
+	AccessExpiresAt  time.Time
+	RefreshExpiresAt time.Time
+}
+
+// Error is a failed call, carrying the stable code the server answered with,
+// one of the authify.Code* constants.
+type Error struct {
+	Status  int
+	Code    authify.AuthErrorCode
+	Message string
+	// Challenge is the authify-challenge header of challenge_required and challenge_failed
+	// errors, the name of the challenge and what to answer, see httpapi.WithSignupChallenge
+	Challenge string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("authify: %s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+// CreateUser creates a user with a username and password, sent in the authify-username and
+// authify-password headers, and returns the user, see httpapi.NewRouter. When the server asks
+// for a proof of work, CreateUser solves it and sends the request again, which takes a fraction
+// of a second at the default difficulty. Other challenges, such as CAPTCHAs, fail with an *Error
+// carrying the challenge_required code, and are answered with CreateUserWithAnswer.
+func (c *Client) CreateUser(ctx context.Context, username, password string) (map[string]string, error) {
+	user, err := c.CreateUserWithAnswer(ctx, username, password, "", "")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != authify.CodeChallengeRequired {
+		return user, err
+	}
+	name, challenge, _ := strings.Cut(apiErr.Challenge, " ")
+	if name != "pow" {
+		return nil, err
+	}
+	answer, err := authify.SolveProofOfWork(ctx, challenge)
+	if err != nil {
+		return nil, err
+	}
+	return c.CreateUserWithAnswer(ctx, username, password, name, answer)
+}
+
+// CreateUserWithAnswer is CreateUser answering the challenge named challenge, e.g. "captcha"
+// with the token of a CAPTCHA widget, in the header of that name. No challenge is answered when
+// challenge is empty.
+func (c *Client) CreateUserWithAnswer(ctx context.Context, username, password, challenge, answer string) (map[string]string, error) {
+	headers := map[string]string{"username": username, "password": password}
+	if challenge != "" {
+		headers[challenge] = answer
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/v1/users", headers)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var user map[string]string
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, fmt.Errorf("unexpected create user response: %q", body)
+	}
+	return user, nil
+}
+
+// Login logs in with the user's password, sent in the authify-password header.
+func (c *Client) Login(ctx context.Context, username, password string) (Tokens, error) {
+	return c.generateToken(ctx, map[string]string{
+		"username": username,
+		"password": password,
+	})
+}
+
+// LoginWithChallenge logs in against a router in challenge login mode without sending the
+// password: it fetches a challenge, hashes the password with the settings it carries and
+// answers the nonce with the proof, see stores.ChallengeProof.
+func (c *Client) LoginWithChallenge(ctx context.Context, username, password string) (Tokens, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/v1/tokens/challenge", map[string]string{"username": username})
+	if err != nil {
+		return Tokens{}, err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return Tokens{}, err
+	}
+	var challenge authify.LoginChallenge
+	if err := json.Unmarshal(body, &challenge); err != nil {
+		return Tokens{}, fmt.Errorf("decoding login challenge: %w", err)
+	}
+
+	hash, err := stores.HashWithSettings(password, challenge.Settings)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return c.generateToken(ctx, map[string]string{
+		"username": username,
+		"nonce":    challenge.Nonce,
+		"proof":    stores.ChallengeProof(hash, challenge.Nonce),
+	})
+}
+
+// generateToken calls the token route with headers and reads the tokens off its response
+func (c *Client) generateToken(ctx context.Context, headers map[string]string) (Tokens, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/v1/tokens", headers)
+	if err != nil {
+		return Tokens{}, err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	var tokens Tokens
+	for _, line := range strings.Split(string(body), "\n") {
+		if val, ok := strings.CutPrefix(line, "Access Token: "); ok {
+			tokens.AccessToken = val
+		}
+		if val, ok := strings.CutPrefix(line, "Refresh Token: "); ok {
+			tokens.RefreshToken = val
+		}
+		if val, ok := strings.CutPrefix(line, "Access Token Expires At: "); ok {
+			tokens.AccessExpiresAt, _ = time.Parse(time.RFC3339, val)
+		}
+		if val, ok := strings.CutPrefix(line, "Refresh Token Expires At: "); ok {
+			tokens.RefreshExpiresAt, _ = time.Parse(time.RFC3339, val)
+		}
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		return Tokens{}, fmt.Errorf("unexpected token response: %q", body)
+	}
+	return tokens, nil
+}
+
+// Refresh trades a refresh token for a new access token. accessToken is the previous
+// access token, it may be expired. Use RefreshTokens with servers rotating refresh tokens.
+func (c *Client) Refresh(ctx context.Context, accessToken, refreshToken string) (string, error) {
+	tokens, err := c.RefreshTokens(ctx, accessToken, refreshToken)
+	return tokens.AccessToken, err
+}
+
+// RefreshTokens is Refresh, also returning the refresh token to use from then on: a new one
+// when the server rotates refresh tokens, which revokes refreshToken, and refreshToken itself
+// otherwise. The expiries are not reported.
+func (c *Client) RefreshTokens(ctx context.Context, accessToken, refreshToken string) (Tokens, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/v1/tokens/refresh", map[string]string{
+		"access":  accessToken,
+		"refresh": refreshToken,
+	})
+	if err != nil {
+		return Tokens{}, err
+	}
+	body, header, err := c.send(req)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	// routers built WithRefreshRole answer with JSON, others with text
+	var refreshed struct {
+		AccessToken string `json:"access_token"`
+	}
+	if json.Unmarshal(body, &refreshed) != nil {
+		refreshed.AccessToken, _ = strings.CutPrefix(strings.TrimSpace(string(body)), "Token Refreshed! new token is: ")
+	}
+	if refreshed.AccessToken == "" || strings.ContainsAny(refreshed.AccessToken, " \n") {
+		return Tokens{}, fmt.Errorf("unexpected refresh response: %q", body)
+	}
+	tokens := Tokens{AccessToken: refreshed.AccessToken, RefreshToken: refreshToken}
+	if rotated := header.Get(c.headers.Name("refresh")); rotated != "" {
+		tokens.RefreshToken = rotated
+	}
+	return tokens, nil
+}
+
+// Capabilities fetches the capabilities document of the server, telling the features it enables
+// and the routes it serves.
+func (c *Client) Capabilities(ctx context.Context) (authify.Configuration, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/.well-known/authify-configuration", nil)
+	if err != nil {
+		return authify.Configuration{}, err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return authify.Configuration{}, err
+	}
+	var doc authify.Configuration
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return authify.Configuration{}, fmt.Errorf("unexpected capabilities response: %w", err)
+	}
+	return doc, nil
+}
+
+// TokenSource returns a source of access tokens for username, minted by the server.
+// Pass it to authify.NewTokenTransport to call APIs protected by authify.
+func (c *Client) TokenSource(username, password string) *authify.PasswordTokenSource {
+	return authify.NewPasswordTokenSource(minter{c}, username, password)
+}
+
+// minter adapts a Client to authify.TokenMinter
+type minter struct {
+	c *Client
+}
+
+func (m minter) Login(ctx context.Context, username, password string) (string, string, error) {
+	tokens, err := m.c.Login(ctx, username, password)
+	return tokens.AccessToken, tokens.RefreshToken, err
+}
+
+func (m minter) Refresh(ctx context.Context, accessToken, refreshToken string) (string, error) {
+	return m.c.Refresh(ctx, accessToken, refreshToken)
+}
+
+func (m minter) RefreshTokens(ctx context.Context, accessToken, refreshToken string) (string, string, error) {
+	tokens, err := m.c.RefreshTokens(ctx, accessToken, refreshToken)
+	return tokens.AccessToken, tokens.RefreshToken, err
+}
+
+// newRequest builds a request to path, with headers named without their prefix, e.g. "access"
+func (c *Client) newRequest(ctx context.Context, method, path string, headers map[string]string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, val := range headers {
+		req.Header.Set(c.headers.Name(name), val)
+	}
+	return req, nil
+}
+
+// do sends req and returns the response body, or an *Error for non-2xx responses
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	body, _, err := c.send(req)
+	return body, err
+}
+
+// send is do, also returning the headers of the response
+func (c *Client) send(req *http.Request) ([]byte, http.Header, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{Status: resp.StatusCode, Code: authify.CodeInternal, Message: strings.TrimSpace(string(body))}
+		var decoded struct {
+			Code  authify.AuthErrorCode `json:"code"`
+			Error string                `json:"error"`
+		}
+		if json.Unmarshal(body, &decoded) == nil && decoded.Code != "" {
+			apiErr.Code, apiErr.Message = decoded.Code, decoded.Error
+		}
+		apiErr.Challenge = resp.Header.Get(c.headers.Name("challenge"))
+		return nil, nil, apiErr
+	}
+	return body, resp.Header, nil
+}
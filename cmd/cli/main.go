@@ -1,15 +1,24 @@
 // Package main provides a CLI interface for interacting with the Authify
 // authentication system. It allows creating users, generating tokens,
-// verifying tokens, and refreshing tokens directly from the command line.
+// verifying tokens, refreshing tokens, disabling users, changing their roles and managing
+// service accounts directly from the command line, as well as generating its
+// configuration and secrets.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/client"
 	"github.com/HassanAli101/authify/lib"
 	"github.com/HassanAli101/authify/stores"
 	"github.com/HassanAli101/authify/token"
@@ -18,9 +27,17 @@ import (
 var (
 	a   *authify.Authify
 	cfg *lib.Config
+
+	// set when service_accounts is enabled in the store config
+	serviceAccounts *stores.PGServiceAccountStore
+
+	// the database of the users, which the invite store is created from on first use
+	dbStore *stores.AuthifyDB
 )
 
-func init() {
+// setup loads the config, connects to the database and builds the Authify instance the
+// commands run against, exiting on failure
+func setup() {
 	var err error
 
 	cfg, err = lib.ReadEnvVars()
@@ -37,23 +54,77 @@ func init() {
 	if err != nil {
 		log.Fatalf("failed to load token config: %v", err)
 	}
+	if expiration, _ := cfg.AccessTokenDuration(); expiration > 0 {
+		tokenCfg.AccessToken.Duration = expiration
+	}
 
-	dbStore, err := stores.NewAuthifyDB(cfg.DatabaseURL, *storeCfg)
+	dbStore, err = stores.NewAuthifyDB(cfg.DatabaseURL.Reveal(), *storeCfg)
 	if err != nil {
 		log.Fatalf("Error connecting to db: %v", err)
 	}
 
-	jwtManager, err := token.NewJWTManager().
-		WithConfig(tokenCfg).
-		WithAccessSecret(cfg.JWTAccessSecret).
-		WithRefreshSecret(cfg.JWTRefreshSecret).
-		WithStore(dbStore).
-		Build()
-	if err != nil {
-		log.Fatalf("Error creating JWT manager: %v", err)
+	// opaque tokens and token families are kept in the session store, next to the sessions
+	opaque, _ := cfg.OpaqueTokensEnabled()
+	minimumVersion, _ := cfg.MinimumTokenVersion()
+	bindingMode, _ := cfg.BindingMode()
+	claimsKey, previousClaimsKey, _ := cfg.ClaimsEncryptionKeys()
+	var sessions *stores.PGSessionStore
+	if storeCfg.Sessions || storeCfg.RefreshRotation || opaque {
+		sessions, err = dbStore.NewSessionStore()
+		if err != nil {
+			log.Fatalf("Error creating session store: %v", err)
+		}
+	}
+
+	if storeCfg.ServiceAccounts {
+		serviceAccounts, err = dbStore.NewServiceAccountStore()
+		if err != nil {
+			log.Fatalf("Error creating service account store: %v", err)
+		}
+	}
+
+	var tokens token.TokenManager
+	if opaque {
+		tokens = token.NewOpaqueTokenManager(sessions, tokenCfg.AccessToken.Duration, tokenCfg.RefreshToken.Duration).
+			WithStore(dbStore)
+	} else {
+		jwtManager, err := token.NewJWTManager().
+			WithConfig(tokenCfg).
+			WithAccessSecretString(cfg.JWTAccessSecret).
+			WithRefreshSecretString(cfg.JWTRefreshSecret).
+			WithPreviousAccessSecretString(cfg.JWTAccessSecretPrevious).
+			WithPreviousRefreshSecretString(cfg.JWTRefreshSecretPrevious).
+			WithStrictVerification(cfg.StrictVerificationEnabled()).
+			WithMinimumTokenVersion(minimumVersion).
+			WithBindingMode(bindingMode).
+			WithClaimsEncryption(claimsKey).
+			WithPreviousClaimsEncryptionKey(previousClaimsKey).
+			WithStore(dbStore).
+			Build()
+		if err != nil {
+			log.Fatalf("Error creating JWT manager: %v", err)
+		}
+		tokens = jwtManager
 	}
 
-	a = authify.NewAuthify(dbStore, jwtManager)
+	a = authify.NewAuthify(dbStore, tokens)
+
+	if storeCfg.Sessions {
+		a.WithSessionStore(sessions)
+	}
+	if storeCfg.RefreshRotation {
+		a.WithTokenFamilies(sessions)
+	}
+	if storeCfg.AuditLog {
+		audit, err := dbStore.NewAuditLog()
+		if err != nil {
+			log.Fatalf("Error creating audit log: %v\n", err)
+		}
+		a.WithAuditLogger(audit)
+	}
+	// the invite store is created by the commands using it, see requireInvites
+	registration, _ := cfg.Registration()
+	a.WithRegistrationPolicy(registration, nil)
 }
 
 func main() {
@@ -62,6 +133,26 @@ func main() {
 		os.Exit(1)
 	}
 
+	// validate reports on the config and the database instead of failing on the first problem
+	if os.Args[1] == "validate" {
+		handleValidate()
+		return
+	}
+	// init and rotate-secret prepare the config, they do not need it, nor does capabilities,
+	// which asks a running server
+	switch os.Args[1] {
+	case "init":
+		handleInit()
+		return
+	case "rotate-secret":
+		handleRotateSecret()
+		return
+	case "capabilities":
+		handleCapabilities()
+		return
+	}
+	setup()
+
 	switch os.Args[1] {
 
 	case "create-user":
@@ -76,25 +167,113 @@ func main() {
 	case "refresh-token":
 		handleRefreshToken()
 
+	case "whoami":
+		handleWhoAmI()
+
+	case "update-profile":
+		handleUpdateProfile()
+
+	case "sessions":
+		handleSessions()
+
+	case "token-families":
+		handleTokenFamilies()
+
+	case "disable-user":
+		handleSetUserDisabled("disable-user", true)
+
+	case "enable-user":
+		handleSetUserDisabled("enable-user", false)
+
+	case "set-role":
+		handleSetRole()
+
+	case "revoke-tokens":
+		handleRevokeTokens()
+
+	case "invalidate-all-tokens":
+		handleInvalidateAllTokens()
+
+	case "count-users":
+		handleCountUsers()
+
+	case "user-exists":
+		handleUserExists()
+
+	case "export-users":
+		handleExportUsers()
+
+	case "migrate-diff":
+		handleMigrateDiff()
+
+	case "create-service-account":
+		handleCreateServiceAccount()
+
+	case "rotate-service-secret":
+		handleRotateServiceSecret()
+
+	case "create-invite":
+		handleCreateInvite()
+
+	case "list-invites":
+		handleListInvites()
+
+	case "disable-service-account":
+		handleSetServiceAccountDisabled("disable-service-account", true)
+
+	case "enable-service-account":
+		handleSetServiceAccountDisabled("enable-service-account", false)
+
 	default:
 		fmt.Println("Unknown command:", os.Args[1])
 		printUsage()
 		os.Exit(1)
 	}
+
+	if err := a.Store.Close(); err != nil {
+		log.Printf("Error closing store: %v", err)
+	}
 }
 
 func printUsage() {
-	fmt.Println(`
+	fmt.Print(`
 Authify CLI
 
 Usage:
   authify <command> [options]
 
 Commands:
-  create-user     Create a new user
+  create-user     Create a new user under the registration policy, -invite gives the invite code, -local-admin bypasses the policy and -json prints the user as JSON
   generate-token  Generate access & refresh tokens
   verify-token    Verify an access token
-  refresh-token   Refresh an access token
+  refresh-token   Refresh an access token and print both tokens, -json prints them as JSON
+  whoami          Show the profile of an access token's user
+  update-profile  Change editable fields of an access token's user, e.g. -token ... display_name=Alice
+  sessions        List the logins of an access token's user, with their devices
+  token-families  Show the refresh token families of a user and their rotations (refresh_rotation)
+  disable-user    Suspend a user, who can no longer log in or refresh tokens
+  enable-user     Reactivate a disabled user
+  set-role        Change the role of a user
+  revoke-tokens   Revoke every token of a user by bumping its token version (token_versions)
+  invalidate-all-tokens  Reject every token issued so far, of every user and service account
+  count-users     Print the number of users
+  user-exists     Tell whether a unique field value, such as a username, is taken
+  export-users    Print every user as a JSON object per line, hidden columns left out
+  migrate-diff    Print the statements reconciling the users table with the store config, without running them
+  validate        Check the config, the database connection and the users table, exiting 1 on failure
+  init            Write a .env with random JWT secrets and starter store.yml and token.yml, -stdout prints them
+  rotate-secret   Generate a new access or refresh secret, -env-file rewrites the deployment's env file
+  capabilities    Print the capabilities document of the server at -url, its features and routes
+
+Invite commands (REGISTRATION_POLICY=invite):
+  create-invite   Create an invite and print its code, -max-uses (default 1, 0 for unlimited) and -ttl (e.g. 72h)
+  list-invites    List the invites with their uses and expiry
+
+Service account commands (service_accounts):
+  create-service-account   Create a service account and print its client secret
+  rotate-service-secret    Replace the client secret of a service account, the previous one stops working
+  disable-service-account  Suspend a service account, which can no longer obtain tokens
+  enable-service-account   Reactivate a disabled service account
 
 Run "authify <command> -h" for command-specific options.
 `)
@@ -106,6 +285,9 @@ func handleCreateUser() {
 	cmd := flag.NewFlagSet("create-user", flag.ExitOnError)
 	username := cmd.String("username", "", "Username")
 	password := cmd.String("password", "", "Password")
+	invite := cmd.String("invite", "", "Invite code, required by the invite registration policy")
+	localAdmin := cmd.Bool("local-admin", false, "Create the user whatever the registration policy, as an operator of the database")
+	asJSON := cmd.Bool("json", false, "Print the created user as JSON")
 
 	cmd.Parse(os.Args[2:])
 
@@ -113,15 +295,38 @@ func handleCreateUser() {
 		log.Fatal("username and password are required")
 	}
 
-	err := a.Store.CreateUser(map[string]any{
+	userData := map[string]any{
 		"username": *username,
 		"password": *password,
-	})
+	}
+	var user map[string]string
+	var err error
+	if *localAdmin {
+		user, err = a.CreateUser(context.Background(), userData)
+	} else {
+		if a.Registration == authify.RegistrationInvite {
+			requireInvites()
+		}
+		user, err = a.RegisterUser(context.Background(), userData, authify.Registration{InviteCode: *invite})
+	}
 	if err != nil {
 		log.Fatalf("Error creating user: %v", err)
 	}
 
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(user); err != nil {
+			log.Fatalf("Error printing user: %v", err)
+		}
+		return
+	}
 	fmt.Printf("User created: %s\n", *username)
+	for _, name := range slices.Sorted(maps.Keys(user)) {
+		if name != "username" {
+			fmt.Printf("  %s: %s\n", name, user[name])
+		}
+	}
 }
 
 func handleGenerateToken() {
@@ -129,6 +334,10 @@ func handleGenerateToken() {
 	username := cmd.String("username", "", "Username")
 	password := cmd.String("password", "", "Password")
 	ip := cmd.String("ip", "cli", "Client identifier (IP or device)")
+	userAgent := cmd.String("user-agent", "authify-cli", "User agent recorded with the session")
+	deviceName := cmd.String("device-name", "", "Device name recorded with the session")
+	platform := cmd.String("platform", "", "Platform recorded with the session")
+	deviceID := cmd.String("device-id", "", "Device fingerprint the refresh token is bound to with AUTHIFY_TOKEN_BINDING=device")
 
 	cmd.Parse(os.Args[2:])
 
@@ -136,47 +345,48 @@ func handleGenerateToken() {
 		log.Fatal("username and password are required")
 	}
 
-	accessToken, err := a.Tokens.GenerateAccessToken(*username, *password)
-	if err != nil {
-		log.Fatalf("Error generating access token: %v", err)
-	}
-
-	reqData := map[string]any{
-		"ip": *ip,
-	}
-	refreshToken, err := a.Tokens.GenerateRefreshToken(*username, reqData)
+	device := stores.DeviceInfo{IP: *ip, UserAgent: *userAgent, DeviceName: *deviceName, Platform: *platform, DeviceID: *deviceID}
+	pair, err := a.LoginContext(context.Background(), *username, *password, device)
 	if err != nil {
-		log.Fatalf("Error generating refresh token: %v", err)
+		log.Fatalf("Error generating tokens: %v", err)
 	}
 
 	fmt.Println("Access Token:")
-	fmt.Println(accessToken)
+	fmt.Println(pair.AccessToken)
+	fmt.Printf("Expires at: %s\n", pair.AccessExpiresAt.Format(time.RFC3339))
 	fmt.Println("\nRefresh Token:")
-	fmt.Println(refreshToken)
+	fmt.Println(pair.RefreshToken)
+	fmt.Printf("Expires at: %s\n", pair.RefreshExpiresAt.Format(time.RFC3339))
 }
 
 func handleVerifyToken() {
 	cmd := flag.NewFlagSet("verify-token", flag.ExitOnError)
-	token := cmd.String("token", "", "Access token")
+	accessToken := cmd.String("token", "", "Access token")
 
 	cmd.Parse(os.Args[2:])
 
-	if *token == "" {
+	if *accessToken == "" {
 		log.Fatal("token is required")
 	}
 
-	claims, err := a.Tokens.VerifyAccessToken(*token)
+	verified, err := a.Tokens.VerifyToken(context.Background(), token.VerifyTokenRequest{Token: *accessToken})
 	if err != nil {
 		log.Fatalf("Token verification failed: %v", err)
 	}
+	claims := verified.Claims
 
-	fmt.Printf("Token valid\nClaims: %s\n", claims)
+	fmt.Printf("Token valid\nClaims: %s\nScopes: %s\n", claims, strings.Join(token.ScopesFromClaims(claims), " "))
 }
 
 func handleRefreshToken() {
 	cmd := flag.NewFlagSet("refresh-token", flag.ExitOnError)
 	accessToken := cmd.String("access", "", "Access token")
 	refreshToken := cmd.String("refresh", "", "Refresh token")
+	// the defaults are the ones of generate-token, so bound refresh tokens keep working
+	ip := cmd.String("ip", "cli", "Client identifier (IP or device), the one the tokens were generated with")
+	userAgent := cmd.String("user-agent", "authify-cli", "User agent of the client")
+	deviceID := cmd.String("device-id", "", "Device fingerprint the refresh token is bound to, the one the tokens were generated with")
+	asJSON := cmd.Bool("json", false, "Print the tokens and their expiries as JSON")
 
 	cmd.Parse(os.Args[2:])
 
@@ -184,11 +394,432 @@ func handleRefreshToken() {
 		log.Fatal("both access and refresh tokens are required")
 	}
 
-	reqData := map[string]any{}
-	newToken, claims, err := a.Tokens.RefreshToken(*accessToken, *refreshToken, reqData)
+	device := stores.DeviceInfo{IP: *ip, UserAgent: *userAgent, DeviceID: *deviceID}
+	pair, err := a.RefreshTokens(context.Background(), token.RefreshTokensRequest{AccessToken: *accessToken, RefreshToken: *refreshToken, Device: device})
 	if err != nil {
 		log.Fatalf("Token refresh failed: %v", err)
 	}
 
-	fmt.Printf("Token refreshed for user with claims: %s\nNew Access Token:\n%s\n", claims, newToken)
+	// the refresh token is printed too, it is a new one when the token manager rotates them
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(pair); err != nil {
+			log.Fatalf("Error printing tokens: %v", err)
+		}
+		return
+	}
+	fmt.Printf("Token refreshed for user with claims: %s\n", pair.AccessClaims)
+	fmt.Println("\nAccess Token:")
+	fmt.Println(pair.AccessToken)
+	fmt.Printf("Expires at: %s\n", pair.AccessExpiresAt.Format(time.RFC3339))
+	fmt.Println("\nRefresh Token:")
+	fmt.Println(pair.RefreshToken)
+	fmt.Printf("Expires at: %s\n", pair.RefreshExpiresAt.Format(time.RFC3339))
+}
+
+func handleSetUserDisabled(name string, disabled bool) {
+	cmd := flag.NewFlagSet(name, flag.ExitOnError)
+	username := cmd.String("username", "", "Username")
+
+	cmd.Parse(os.Args[2:])
+
+	if *username == "" {
+		log.Fatal("username is required")
+	}
+
+	if err := a.SetUserDisabled(*username, disabled); err != nil {
+		log.Fatalf("Error updating user status: %v", err)
+	}
+
+	if disabled {
+		fmt.Printf("User disabled: %s\n", *username)
+	} else {
+		fmt.Printf("User enabled: %s\n", *username)
+	}
+}
+
+func handleSetRole() {
+	cmd := flag.NewFlagSet("set-role", flag.ExitOnError)
+	username := cmd.String("username", "", "Username")
+	role := cmd.String("role", "", "New role, one of the store config's allowed_roles when set")
+
+	cmd.Parse(os.Args[2:])
+
+	if *username == "" || *role == "" {
+		log.Fatal("username and role are required")
+	}
+
+	if err := a.ChangeRole(*username, *role); err != nil {
+		log.Fatalf("Error changing role: %v", err)
+	}
+
+	fmt.Printf("Role of %s set to %s\n", *username, *role)
+}
+
+func handleRevokeTokens() {
+	cmd := flag.NewFlagSet("revoke-tokens", flag.ExitOnError)
+	username := cmd.String("username", "", "Username")
+
+	cmd.Parse(os.Args[2:])
+
+	if *username == "" {
+		log.Fatal("username is required")
+	}
+
+	if err := a.BumpTokenVersion(*username); err != nil {
+		log.Fatalf("Error revoking tokens: %v", err)
+	}
+
+	fmt.Printf("Tokens of %s revoked\n", *username)
+}
+
+func handleInvalidateAllTokens() {
+	cmd := flag.NewFlagSet("invalidate-all-tokens", flag.ExitOnError)
+	cmd.Parse(os.Args[2:])
+
+	notBefore, err := a.InvalidateAllTokens()
+	if err != nil {
+		log.Fatalf("Error invalidating tokens: %v", err)
+	}
+
+	fmt.Printf("Every token issued before %s is invalidated\n", notBefore.UTC().Format(time.RFC3339))
+}
+
+func handleCreateServiceAccount() {
+	cmd := flag.NewFlagSet("create-service-account", flag.ExitOnError)
+	clientID := cmd.String("client-id", "", "Client ID of the service account")
+	scopes := cmd.String("scopes", "", "Space separated scopes the service account may be granted")
+
+	cmd.Parse(os.Args[2:])
+
+	if *clientID == "" {
+		log.Fatal("client-id is required")
+	}
+
+	secret, err := requireServiceAccounts().CreateServiceAccount(*clientID, strings.Fields(*scopes))
+	if err != nil {
+		log.Fatalf("Error creating service account: %v", err)
+	}
+
+	fmt.Printf("Service account created: %s\n", *clientID)
+	fmt.Println("Client Secret (shown only once):")
+	fmt.Println(secret)
+}
+
+func handleRotateServiceSecret() {
+	cmd := flag.NewFlagSet("rotate-service-secret", flag.ExitOnError)
+	clientID := cmd.String("client-id", "", "Client ID of the service account")
+
+	cmd.Parse(os.Args[2:])
+
+	if *clientID == "" {
+		log.Fatal("client-id is required")
+	}
+
+	secret, err := requireServiceAccounts().RotateServiceAccountSecret(*clientID)
+	if err != nil {
+		log.Fatalf("Error rotating client secret: %v", err)
+	}
+
+	fmt.Println("New Client Secret (shown only once):")
+	fmt.Println(secret)
+}
+
+func handleSetServiceAccountDisabled(name string, disabled bool) {
+	cmd := flag.NewFlagSet(name, flag.ExitOnError)
+	clientID := cmd.String("client-id", "", "Client ID of the service account")
+
+	cmd.Parse(os.Args[2:])
+
+	if *clientID == "" {
+		log.Fatal("client-id is required")
+	}
+
+	if err := requireServiceAccounts().SetServiceAccountDisabled(*clientID, disabled); err != nil {
+		log.Fatalf("Error updating service account status: %v", err)
+	}
+
+	if disabled {
+		fmt.Printf("Service account disabled: %s\n", *clientID)
+	} else {
+		fmt.Printf("Service account enabled: %s\n", *clientID)
+	}
+}
+
+func handleCreateInvite() {
+	cmd := flag.NewFlagSet("create-invite", flag.ExitOnError)
+	maxUses := cmd.Int("max-uses", 1, "Number of users the invite can sign up, 0 for unlimited")
+	ttl := cmd.Duration("ttl", 0, "Lifetime of the invite, e.g. 72h, unlimited when 0")
+
+	cmd.Parse(os.Args[2:])
+
+	if *maxUses < 0 || *ttl < 0 {
+		log.Fatal("max-uses and ttl must not be negative")
+	}
+	var expiresAt time.Time
+	if *ttl > 0 {
+		expiresAt = time.Now().Add(*ttl)
+	}
+
+	requireInvites()
+	code, invite, err := a.CreateInvite(context.Background(), *maxUses, expiresAt)
+	if err != nil {
+		log.Fatalf("Error creating invite: %v", err)
+	}
+
+	fmt.Printf("Invite created: %s\n", invite.ID)
+	if a.Registration != authify.RegistrationInvite {
+		fmt.Printf("The registration policy is %s, invites are only required with REGISTRATION_POLICY=invite\n", a.Registration)
+	}
+	fmt.Println("Invite Code (shown only once):")
+	fmt.Println(code)
+}
+
+func handleListInvites() {
+	cmd := flag.NewFlagSet("list-invites", flag.ExitOnError)
+	cmd.Parse(os.Args[2:])
+
+	requireInvites()
+	invites, err := a.ListInvites(context.Background())
+	if err != nil {
+		log.Fatalf("Error listing invites: %v", err)
+	}
+
+	for _, invite := range invites {
+		uses := fmt.Sprintf("%d/%d", invite.Uses, invite.MaxUses)
+		if invite.MaxUses == 0 {
+			uses = fmt.Sprintf("%d/unlimited", invite.Uses)
+		}
+		expires := "never"
+		if !invite.ExpiresAt.IsZero() {
+			expires = invite.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%s  uses %s  expires %s  created %s\n", invite.ID, uses, expires, invite.CreatedAt.Format(time.RFC3339))
+	}
+}
+
+// requireInvites creates the invite store of the Authify instance, exiting on failure
+func requireInvites() {
+	if a.Invites != nil {
+		return
+	}
+	invites, err := dbStore.NewInviteStore()
+	if err != nil {
+		log.Fatalf("Error creating invite store: %v", err)
+	}
+	a.Invites = invites
+}
+
+// requireServiceAccounts returns the service account store, exiting when service_accounts is not enabled
+func requireServiceAccounts() *stores.PGServiceAccountStore {
+	if serviceAccounts == nil {
+		log.Fatal("service_accounts is not enabled in the store config")
+	}
+	return serviceAccounts
+}
+
+func handleCountUsers() {
+	count, err := a.Store.CountUsers()
+	if err != nil {
+		log.Fatalf("Error counting users: %v", err)
+	}
+
+	fmt.Println(count)
+}
+
+func handleUserExists() {
+	cmd := flag.NewFlagSet("user-exists", flag.ExitOnError)
+	field := cmd.String("field", "username", "Unique column to check")
+	value := cmd.String("value", "", "Value to look for")
+
+	cmd.Parse(os.Args[2:])
+
+	if *value == "" {
+		log.Fatal("value is required")
+	}
+
+	exists, err := a.UserExists(context.Background(), *field, *value)
+	if err != nil {
+		log.Fatalf("Error checking user existence: %v", err)
+	}
+
+	fmt.Println(exists)
+}
+
+func handleCapabilities() {
+	cmd := flag.NewFlagSet("capabilities", flag.ExitOnError)
+	url := cmd.String("url", "", "Base URL of the server, including its path prefix, e.g. https://example.com/auth")
+
+	cmd.Parse(os.Args[2:])
+
+	if *url == "" {
+		log.Fatal("url is required")
+	}
+
+	doc, err := client.New(*url).Capabilities(context.Background())
+	if err != nil {
+		log.Fatalf("Error fetching capabilities: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		log.Fatalf("Error printing capabilities: %v", err)
+	}
+}
+
+func handleExportUsers() {
+	cmd := flag.NewFlagSet("export-users", flag.ExitOnError)
+	output := cmd.String("o", "", "File to write the users to instead of stdout")
+
+	cmd.Parse(os.Args[2:])
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			log.Fatalf("Error creating export file: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := a.ExportUsers(context.Background(), w); err != nil {
+		log.Fatalf("Error exporting users: %v", err)
+	}
+}
+
+func handleMigrateDiff() {
+	differ, ok := a.Store.(stores.SchemaDiffer)
+	if !ok {
+		log.Fatal("store does not support schema diffs")
+	}
+	statements, err := differ.DiffSchema()
+	if err != nil {
+		log.Fatalf("Error diffing schema: %v", err)
+	}
+
+	if len(statements) == 0 {
+		fmt.Println("-- the table matches the store config")
+		return
+	}
+	for _, statement := range statements {
+		fmt.Println(statement)
+	}
+}
+
+func handleValidate() {
+	report := lib.Validate(context.Background())
+	fmt.Print(report)
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func handleWhoAmI() {
+	cmd := flag.NewFlagSet("whoami", flag.ExitOnError)
+	accessToken := cmd.String("token", "", "Access token")
+
+	cmd.Parse(os.Args[2:])
+
+	if *accessToken == "" {
+		log.Fatal("token is required")
+	}
+
+	profile, err := a.GetSelf(*accessToken)
+	if err != nil {
+		log.Fatalf("Error fetching user profile: %v", err)
+	}
+
+	for _, field := range slices.Sorted(maps.Keys(profile)) {
+		fmt.Printf("%s: %s\n", field, profile[field])
+	}
+}
+
+func handleUpdateProfile() {
+	cmd := flag.NewFlagSet("update-profile", flag.ExitOnError)
+	accessToken := cmd.String("token", "", "Access token")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: authify update-profile -token <access token> <column>=<value>...")
+		cmd.PrintDefaults()
+	}
+
+	cmd.Parse(os.Args[2:])
+
+	if *accessToken == "" || cmd.NArg() == 0 {
+		log.Fatal("token and at least one column=value are required")
+	}
+	fields := make(map[string]string, cmd.NArg())
+	for _, arg := range cmd.Args() {
+		column, value, ok := strings.Cut(arg, "=")
+		if !ok || column == "" {
+			log.Fatalf("invalid field %q, expected column=value", arg)
+		}
+		fields[column] = value
+	}
+
+	if err := a.UpdateSelf(context.Background(), *accessToken, fields); err != nil {
+		log.Fatalf("Error updating user profile: %v", err)
+	}
+
+	profile, err := a.GetSelf(*accessToken)
+	if err != nil {
+		log.Fatalf("Error fetching user profile: %v", err)
+	}
+	for _, field := range slices.Sorted(maps.Keys(profile)) {
+		fmt.Printf("%s: %s\n", field, profile[field])
+	}
+}
+
+func handleSessions() {
+	cmd := flag.NewFlagSet("sessions", flag.ExitOnError)
+	accessToken := cmd.String("token", "", "Access token")
+
+	cmd.Parse(os.Args[2:])
+
+	if *accessToken == "" {
+		log.Fatal("token is required")
+	}
+
+	sessions, err := a.ListSessions(*accessToken)
+	if err != nil {
+		log.Fatalf("Error listing sessions: %v", err)
+	}
+
+	for _, session := range sessions {
+		fmt.Printf("%s  %s  %v\n", session.CreatedAt.Format(time.RFC3339), session.ID, session.Device)
+	}
+}
+
+func handleTokenFamilies() {
+	cmd := flag.NewFlagSet("token-families", flag.ExitOnError)
+	username := cmd.String("username", "", "Username")
+
+	cmd.Parse(os.Args[2:])
+
+	if *username == "" {
+		log.Fatal("username is required")
+	}
+
+	families, err := a.TokenFamilies(*username)
+	if err != nil {
+		log.Fatalf("Error listing token families: %v", err)
+	}
+
+	for _, family := range families {
+		fmt.Printf("%s  %s  %v\n", family.CreatedAt.Format(time.RFC3339), family.ID, family.Device)
+		for i, t := range family.Tokens {
+			state := "current"
+			switch {
+			case !t.ConsumedAt.IsZero():
+				state = "rotated " + t.ConsumedAt.Format(time.RFC3339)
+			case !t.RevokedAt.IsZero():
+				state = "revoked " + t.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("  %d. %s  issued %s from %s, %s\n", i+1, t.JTI, t.IssuedAt.Format(time.RFC3339), t.IP, state)
+		}
+		if c := family.Compromise; c != nil {
+			fmt.Printf("  COMPROMISED %s: %s reused from %s\n", c.DetectedAt.Format(time.RFC3339), c.JTI, c.IP)
+		}
+	}
 }
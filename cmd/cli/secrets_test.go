@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HassanAli101/authify/lib"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"github.com/joho/godotenv"
+)
+
+func TestGenerateSecret(t *testing.T) {
+	seen := make(map[string]bool)
+	bytesSeen := make(map[byte]bool)
+	for range 100 {
+		secret, err := generateSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			t.Fatalf("expected a base64 secret, got %q: %v", secret, err)
+		}
+		if len(raw) != 32 {
+			t.Fatalf("expected 256 bits, got %d bytes", len(raw))
+		}
+		if seen[secret] {
+			t.Fatalf("secret %q generated twice", secret)
+		}
+		seen[secret] = true
+		for _, b := range raw {
+			bytesSeen[b] = true
+		}
+	}
+	// 3200 random bytes miss a given value with a probability of about 4e-6
+	if len(bytesSeen) < 250 {
+		t.Errorf("expected the secrets to cover nearly every byte value, got %d", len(bytesSeen))
+	}
+}
+
+func TestScaffold(t *testing.T) {
+	dir := t.TempDir()
+	files, err := scaffoldFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeScaffold(dir, files, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		info, err := os.Stat(filepath.Join(dir, f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o600 {
+			t.Errorf("expected %s to be readable by its owner only, got %v", f.name, info.Mode().Perm())
+		}
+	}
+
+	// ReadEnvVarsFromPath sets the variables of the file, restored after the test
+	for _, key := range []string{"DATABASE_URL", "JWT_SECRET", "JWT_REFRESH_SECRET", "SERVER_PORT", "STORE_CONFIG_FILE_PATH", "TOKEN_CONFIG_FILE_PATH"} {
+		t.Setenv(lib.EnvPrefix+key, "")
+	}
+	cfg, err := lib.ReadEnvVarsFromPath(filepath.Join(dir, ".env"))
+	if err != nil {
+		t.Fatalf("failed to read the scaffolded .env: %v", err)
+	}
+	if cfg.JWTAccessSecret.Reveal() == cfg.JWTRefreshSecret.Reveal() {
+		t.Error("expected distinct access and refresh secrets")
+	}
+	storeCfg, err := lib.LoadStoreConfig(cfg.StoreConfigFilePath)
+	if err != nil {
+		t.Fatalf("failed to load the scaffolded store config: %v", err)
+	}
+	tokenCfg, err := lib.LoadTokenConfig(cfg.TokenConfigFilePath)
+	if err != nil {
+		t.Fatalf("failed to load the scaffolded token config: %v", err)
+	}
+	if _, err := token.NewJWTManager().
+		WithConfig(tokenCfg).
+		WithAccessSecretString(cfg.JWTAccessSecret).
+		WithRefreshSecretString(cfg.JWTRefreshSecret).
+		WithStore(stores.NewInMemoryUserStore(*storeCfg)).
+		Build(); err != nil {
+		t.Errorf("failed to build a jwt manager from the scaffolded config: %v", err)
+	}
+}
+
+func TestScaffoldNoOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	envPath := filepath.Join(dir, ".env")
+	if err := os.WriteFile(envPath, []byte("JWT_SECRET=keep\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	files, err := scaffoldFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeScaffold(dir, files, false)
+	if err == nil || !strings.Contains(err.Error(), envPath) {
+		t.Fatalf("expected the existing .env to be reported, got %v", err)
+	}
+	if data, _ := os.ReadFile(envPath); string(data) != "JWT_SECRET=keep\n" {
+		t.Errorf("expected .env to be left alone, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "store.yml")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written, got %v", err)
+	}
+
+	if err := writeScaffold(dir, files, true); err != nil {
+		t.Fatalf("expected -force to overwrite, got %v", err)
+	}
+	if data, _ := os.ReadFile(envPath); string(data) != files[0].contents {
+		t.Errorf("expected .env to be replaced, got %q", data)
+	}
+}
+
+func TestRotateSecretInFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authify.env")
+	original := "# deployment\nAUTHIFY_JWT_SECRET=old-access\nAUTHIFY_JWT_REFRESH_SECRET=old-refresh\nAUTHIFY_SERVER_PORT=8080\n"
+	if err := os.WriteFile(path, []byte(original), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := generateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation, err := rotateSecretInFile(path, "JWT_SECRET", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.Old != "old-access" || rotation.New != first || rotation.Dropped != "" {
+		t.Errorf("unexpected rotation %+v", rotation)
+	}
+	vars, err := godotenv.Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"AUTHIFY_JWT_SECRET":          first,
+		"AUTHIFY_JWT_SECRET_PREVIOUS": "old-access",
+		"AUTHIFY_JWT_REFRESH_SECRET":  "old-refresh",
+		"AUTHIFY_SERVER_PORT":         "8080",
+	}
+	for name, value := range want {
+		if vars[name] != value {
+			t.Errorf("expected %s=%q, got %q", name, value, vars[name])
+		}
+	}
+	if data, _ := os.ReadFile(path); !strings.HasPrefix(string(data), "# deployment\n") {
+		t.Errorf("expected the comments to be kept, got %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the rewritten file to be readable by its owner only, got %v", info.Mode().Perm())
+	}
+
+	// a second rotation replaces the previous secret in place
+	second, _ := generateSecret()
+	rotation, err = rotateSecretInFile(path, "JWT_SECRET", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.Old != first || rotation.Dropped != "old-access" {
+		t.Errorf("unexpected rotation %+v", rotation)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Count(string(data), "AUTHIFY_JWT_SECRET_PREVIOUS=") != 1 {
+		t.Errorf("expected a single previous secret, got %q", data)
+	}
+
+	if _, err := rotateSecretInFile(path, "CLAIMS_ENCRYPTION_KEY", second); err == nil {
+		t.Error("expected a file without the secret to be rejected")
+	}
+}
+
+func TestRotateSecretUnprefixed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("JWT_REFRESH_SECRET=supersecret2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := secretKey("refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation, err := rotateSecretInFile(path, key, "fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.Name != "JWT_REFRESH_SECRET" || rotation.PreviousName != "JWT_REFRESH_SECRET_PREVIOUS" {
+		t.Errorf("expected the unprefixed names to be kept, got %+v", rotation)
+	}
+	if _, err := secretKey("id"); err == nil {
+		t.Error("expected an unknown secret to be rejected")
+	}
+}
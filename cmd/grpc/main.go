@@ -11,77 +11,290 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/federation"
 	authifygrpc "github.com/HassanAli101/authify/internal/grpc"
 	"github.com/HassanAli101/authify/lib"
+	"github.com/HassanAli101/authify/middleware"
 	"github.com/HassanAli101/authify/stores"
 	"github.com/HassanAli101/authify/token"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 // main is the entry point for the Authify gRPC server.
 //
 // It performs the following steps:
 //  1. Loads configuration values from environment variables.
-//  2. Initializes the database-backed user store.
+//  2. Initializes the database-backed user store, retrying while the database
+//     is not up yet, as set by the DATABASE_* config keys.
 //  3. Builds a JWTManager using the configured secrets and token duration.
-//  4. Constructs the Authify service with its dependencies.
+//  4. Constructs the Authify service with its dependencies, and reloads
+//     token lifetimes and role permissions when the config files change.
 //  5. Creates a TCP listener on port 50051.
-//  6. Registers the Authify gRPC service implementation.
-//  7. Starts serving incoming gRPC requests.
+//  6. Registers the Authify gRPC service implementation, the standard health
+//     service, and server reflection when GRPC_REFLECTION is true.
+//  7. Writes the PID file when PID_FILE is set, logs a startup banner and
+//     starts serving incoming gRPC requests, until SIGINT or SIGTERM, after
+//     which queued audit events are written before the store is closed.
 //
-// If any critical step fails (such as binding the TCP port),
-// the server logs the error and terminates.
+// If any critical step fails (such as reaching the database, after the retries
+// of the DATABASE_* config keys, or binding the TCP port), the server closes
+// what it opened, logs the error and terminates.
 func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run starts the server as described on main, returning the error of the first step that fails,
+// after closing the store if it was opened.
+func run() (err error) {
 	// Load environment-based configuration.
-	cfg, _ := lib.ReadEnvVars()
+	cfg, err := lib.ReadEnvVars()
+	if err != nil {
+		return fmt.Errorf("Error loading config: %w", err)
+	}
 
 	storeCfg, err := lib.LoadStoreConfig(cfg.StoreConfigFilePath)
 	if err != nil {
-		log.Fatalf("Error loading store config: %v", err)
+		return fmt.Errorf("Error loading store config: %w", err)
 	}
 
 	tokenCfg, err := lib.LoadTokenConfig(cfg.TokenConfigFilePath)
 	if err != nil {
-		log.Fatalf("Error loading token config: %v", err)
+		return fmt.Errorf("Error loading token config: %w", err)
+	}
+	if expiration, _ := cfg.AccessTokenDuration(); expiration > 0 {
+		tokenCfg.AccessToken.Duration = expiration
 	}
 
-	// Initialize the user store backed by the configured database.
-	store, _ := stores.NewAuthifyDB(cfg.DatabaseURL, *storeCfg)
+	// Initialize the user store backed by the configured database, retrying while it is not up yet.
+	store, err := stores.NewAuthifyDB(cfg.DatabaseURL.Reveal(), *storeCfg, cfg.DatabaseConnectOptions()...)
+	if err != nil {
+		return fmt.Errorf("Error connecting to db: %w", err)
+	}
+	defer func() {
+		if closeErr := store.Close(); closeErr != nil {
+			log.Printf("Error closing store: %v", closeErr)
+		}
+	}()
 
-	// Build the JWT manager using the configured secrets and token lifetime.
-	jwtManager, _ := token.NewJWTManager().
-		WithConfig(tokenCfg).
-		WithAccessSecret(cfg.JWTAccessSecret).
-		WithRefreshSecret(cfg.JWTRefreshSecret).
-		WithStore(store).
-		Build()
+	// The session store records logins, and keeps the tokens in opaque token mode.
+	opaque, _ := cfg.OpaqueTokensEnabled()
+	minimumVersion, _ := cfg.MinimumTokenVersion()
+	slidingThreshold, _ := cfg.SlidingExpiration()
+	bindingMode, _ := cfg.BindingMode()
+	claimsKey, previousClaimsKey, _ := cfg.ClaimsEncryptionKeys()
+	var sessions *stores.PGSessionStore
+	if storeCfg.Sessions || storeCfg.RefreshRotation || opaque {
+		sessions, err = store.NewSessionStore()
+		if err != nil {
+			return fmt.Errorf("Error creating session store: %w", err)
+		}
+	}
+	// Service accounts obtain JWTs through GenerateServiceToken.
+	var serviceAccounts stores.ServiceAccountStore
+	if storeCfg.ServiceAccounts {
+		serviceAccounts, err = store.NewServiceAccountStore()
+		if err != nil {
+			return fmt.Errorf("Error creating service account store: %w", err)
+		}
+	}
+
+	// Build the opaque token manager, or the JWT manager using the configured secrets and token lifetime.
+	var tokens token.TokenManager
+	if opaque {
+		tokens = token.NewOpaqueTokenManager(sessions, tokenCfg.AccessToken.Duration, tokenCfg.RefreshToken.Duration).
+			WithStore(store)
+	} else {
+		tokens, err = token.NewJWTManager().
+			WithConfig(tokenCfg).
+			WithAccessSecretString(cfg.JWTAccessSecret).
+			WithRefreshSecretString(cfg.JWTRefreshSecret).
+			WithPreviousAccessSecretString(cfg.JWTAccessSecretPrevious).
+			WithPreviousRefreshSecretString(cfg.JWTRefreshSecretPrevious).
+			WithStrictVerification(cfg.StrictVerificationEnabled()).
+			WithMinimumTokenVersion(minimumVersion).
+			WithBindingMode(bindingMode).
+			WithSlidingExpiration(slidingThreshold).
+			WithClaimsEncryption(claimsKey).
+			WithPreviousClaimsEncryptionKey(previousClaimsKey).
+			WithStore(store).
+			WithServiceAccounts(serviceAccounts).
+			Build()
+		if err != nil {
+			return fmt.Errorf("Error creating a jwt manager instance: %w", err)
+		}
+	}
 
 	// Initialize the core Authify service.
-	auth := authify.NewAuthify(store, jwtManager)
+	auth := authify.NewAuthify(store, tokens).WithPreciseLoginErrors(cfg.PreciseLoginErrorsEnabled())
+
+	// Record logins along with their device when the store config asks for it.
+	if storeCfg.Sessions {
+		auth.WithSessionStore(sessions)
+	}
+	// Rotate refresh tokens within token families, detecting the reuse of rotated ones.
+	if storeCfg.RefreshRotation {
+		auth.WithTokenFamilies(sessions)
+	}
+	if storeCfg.AuditLog {
+		audit, err := store.NewAuditLog()
+		if err != nil {
+			return fmt.Errorf("Error creating audit log: %w", err)
+		}
+		if storeCfg.AuditQueue.Async {
+			// Write events in batches in the background, the queued ones are written
+			// once the server stopped, before the store is closed.
+			async := stores.NewAsyncAuditLog(audit, storeCfg.AuditQueue)
+			defer closeAuditLog(async)
+			auth.WithAuditLogger(async)
+		} else {
+			auth.WithAuditLogger(audit)
+		}
+	}
+
+	// Tell the replicas sharing the database about the changes of users, so their caches drop them.
+	if cfg.InvalidationBusEnabled() {
+		invalidations, err := store.NewInvalidationBus()
+		if err != nil {
+			return fmt.Errorf("Error creating invalidation bus: %w", err)
+		}
+		defer invalidations.Close()
+		auth.WithInvalidationBus(invalidations)
+		if jwtManager, ok := tokens.(*token.JWTManager); ok {
+			jwtManager.WithInvalidationBus(invalidations)
+		}
+	}
+
+	// Enforce the registration policy of CreateUser, keeping invites for the invite policy.
+	registration, _ := cfg.Registration()
+	var invites stores.InviteStore
+	if registration == authify.RegistrationInvite {
+		if invites, err = store.NewInviteStore(); err != nil {
+			return fmt.Errorf("Error creating invite store: %w", err)
+		}
+	}
+	auth.WithRegistrationPolicy(registration, invites)
+
+	// Follow the config files for token lifetimes and role permissions, on change or SIGHUP.
+	if reloadable, ok := tokens.(token.Reloadable); ok {
+		reloader := lib.NewReloader(cfg, *storeCfg, *tokenCfg, reloadable)
+		go func() {
+			if err := reloader.Watch(context.Background()); err != nil {
+				log.Printf("Config reloading disabled: %v", err)
+			}
+		}()
+	}
 
 	// Create a TCP listener for incoming gRPC connections.
 	lis, err := net.Listen("tcp", ":50051")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	// Create a new gRPC server instance.
-	server := grpc.NewServer()
+	// Create a new gRPC server instance, refusing oversized requests before decoding them,
+	// and tagging each call with the request ID recorded in its audit events.
+	server := grpc.NewServer(
+		grpc.MaxRecvMsgSize(authifygrpc.MaxRecvMsgSize),
+		grpc.UnaryInterceptor(middleware.RequestIDInterceptor()),
+	)
 
 	// Register the Authify gRPC service implementation with the server.
-	authifygrpc.RegisterAuthServiceServer(
-		server,
-		authifygrpc.NewAuthifyGRPCServer(auth),
-	)
+	// Features turned off by DISABLED_FEATURES answer Unimplemented and are left out of GetCapabilities.
+	userExistsLimit, _ := cfg.UserExistsRateLimit()
+	disabledFeatures, _ := cfg.DisabledFeatureList()
+	service := authifygrpc.NewAuthifyGRPCServer(auth).
+		WithUserExistsRateLimit(userExistsLimit).
+		WithUserExistsToken(cfg.UserExistsTokenRequired()).
+		WithoutFeatures(disabledFeatures...)
+	// Exchange the ID tokens of the configured OpenID Connect provider through FederatedLogin.
+	// The providers of the authorization code flow are served by the HTTP server only.
+	if cfg.FederationConfigFilePath != "" {
+		federationCfg, err := lib.LoadFederationConfig(cfg.FederationConfigFilePath)
+		if err != nil {
+			return fmt.Errorf("Error loading federation config: %w", err)
+		}
+		if federationCfg.Issuer != "" {
+			federator, err := federation.NewOIDCFederator(federationCfg.Issuer, federationCfg.ClientID, auth, federationCfg.Options()...)
+			if err != nil {
+				return fmt.Errorf("Error creating federator: %w", err)
+			}
+			service.WithFederator(federator)
+		}
+	}
+	authifygrpc.RegisterAuthServiceServer(server, service)
 
+	// Answer the standard health checks, e.g. of load balancers and the authifygrpc client.
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(authifygrpc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	// Let tools like grpcurl list and call the services without the protos.
+	// Off by default, as it exposes the API surface to any client.
+	if cfg.GRPCReflectionEnabled() {
+		reflection.Register(server)
+		log.Println("gRPC server reflection enabled")
+	}
+
+	removePIDFile, err := cfg.WritePIDFile()
+	if err != nil {
+		return err
+	}
+	defer removePIDFile()
+
+	tokenMode := lib.TokenModeJWT
+	if opaque {
+		tokenMode = lib.TokenModeOpaque
+	}
+	log.Println(lib.Banner{
+		Service:    "authify-grpc",
+		Store:      "postgres",
+		Table:      storeCfg.Name,
+		Tokens:     tokenMode,
+		AccessTTL:  tokenCfg.AccessToken.Duration,
+		RefreshTTL: tokenCfg.RefreshToken.Duration,
+	})
 	log.Println("gRPC server listening on :50051")
 
-	// Start serving incoming gRPC requests.
-	if err := server.Serve(lis); err != nil {
-		log.Fatal(err)
+	// Stop on SIGINT or SIGTERM, letting the calls in flight finish for SHUTDOWN_TIMEOUT_SECONDS.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(cfg.ServerTimeouts().Shutdown):
+			server.Stop()
+		}
+	}()
+
+	// Start serving incoming gRPC requests, the store is closed once the server stopped.
+	return server.Serve(lis)
+}
+
+// closeAuditLog writes the queued audit events, waiting for them up to the drain_timeout of the store config.
+func closeAuditLog(audit *stores.AsyncAuditLog) {
+	ctx, cancel := context.WithTimeout(context.Background(), audit.DrainTimeout())
+	defer cancel()
+	if err := audit.Close(ctx); err != nil {
+		log.Printf("Error flushing audit log: %v", err)
 	}
 }
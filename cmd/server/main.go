@@ -1,5 +1,5 @@
 // Package main starts the Authify authentication server.
-// It sets up HTTP routes for creating users, generating tokens,
+// It serves the routes of the httpapi package for creating users, generating tokens,
 // verifying tokens, and refreshing tokens. The server reads
 // its configuration (such as database URL, JWT secret, token
 // expiration, server port, and table name) from environment
@@ -9,11 +9,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/federation"
+	"github.com/HassanAli101/authify/httpapi"
+	authifygrpc "github.com/HassanAli101/authify/internal/grpc"
 	"github.com/HassanAli101/authify/lib"
 	"github.com/HassanAli101/authify/stores"
 	"github.com/HassanAli101/authify/token"
@@ -22,176 +30,286 @@ import (
 var (
 	a   *authify.Authify
 	cfg *lib.Config
+	// audit is the asynchronous audit log, when audit_queue.async is set in the store config
+	audit *stores.AsyncAuditLog
+	// invalidations tells the other replicas about the changes of users, with INVALIDATION_BUS
+	invalidations *stores.PGInvalidationBus
 )
 
-// init loads environment variables, establishes a database connection,
-// initializes the JWT manager, and sets up the Authify instance.
-// If any step fails, the application logs the error and exits.
-func init() {
-	var err error
+// setup loads environment variables, establishes a database connection, retrying while
+// the database is not up yet, initializes the JWT manager, and sets up the Authify instance,
+// logging a startup banner. It returns the error of the first step that fails, after closing
+// the database connection if it was established.
+func setup() (err error) {
 	cfg, err = lib.ReadEnvVars()
 	if err != nil {
-		log.Fatalf("Error loading config: %v", err)
-		return
+		return fmt.Errorf("Error loading config: %w", err)
 	}
 
 	storeCfg, err := lib.LoadStoreConfig(cfg.StoreConfigFilePath)
 	if err != nil {
-		log.Fatalf("Error loading store config: %v", err)
+		return fmt.Errorf("Error loading store config: %w", err)
 	}
 
 	tokenCfg, err := lib.LoadTokenConfig(cfg.TokenConfigFilePath)
 	if err != nil {
-		log.Fatalf("failed to load token config: %v", err)
+		return fmt.Errorf("failed to load token config: %w", err)
+	}
+	if expiration, _ := cfg.AccessTokenDuration(); expiration > 0 {
+		tokenCfg.AccessToken.Duration = expiration
 	}
 
-
-	dbStore, err := stores.NewAuthifyDB(cfg.DatabaseURL, *storeCfg)
+	dbStore, err := stores.NewAuthifyDB(cfg.DatabaseURL.Reveal(), *storeCfg, cfg.DatabaseConnectOptions()...)
 	if err != nil {
-		log.Fatalf("Error connecting to db %v\n", err)
-		return
+		return fmt.Errorf("Error connecting to db: %w", err)
 	}
+	defer func() {
+		if err != nil {
+			dbStore.Close()
+		}
+	}()
 
-	jwtManager, err := token.NewJWTManager().
-		WithConfig(tokenCfg).
-		WithAccessSecret(cfg.JWTAccessSecret).
-		WithRefreshSecret(cfg.JWTRefreshSecret).
-		WithStore(dbStore).
-		Build()
-	if err != nil {
-		log.Fatalf("Error creating a jwt manager instance %v\n", err)
+	// opaque tokens, challenge nonces and token families are kept in the session store, next to the sessions
+	opaque, _ := cfg.OpaqueTokensEnabled()
+	minimumVersion, _ := cfg.MinimumTokenVersion()
+	slidingThreshold, _ := cfg.SlidingExpiration()
+	bindingMode, _ := cfg.BindingMode()
+	claimsKey, previousClaimsKey, _ := cfg.ClaimsEncryptionKeys()
+	var sessions *stores.PGSessionStore
+	if storeCfg.Sessions || storeCfg.RefreshRotation || opaque || cfg.ChallengeLoginEnabled() {
+		sessions, err = dbStore.NewSessionStore()
+		if err != nil {
+			return fmt.Errorf("Error creating session store: %w", err)
+		}
+	}
+	// service accounts obtain JWTs through the client_credentials grant
+	var serviceAccounts stores.ServiceAccountStore
+	if storeCfg.ServiceAccounts {
+		serviceAccounts, err = dbStore.NewServiceAccountStore()
+		if err != nil {
+			return fmt.Errorf("Error creating service account store: %w", err)
+		}
 	}
-	a = authify.NewAuthify(dbStore, jwtManager)
-}
 
-// main is the entry point of the application.
-// It registers HTTP handlers for authentication-related routes and
-// starts the server on the configured port. If the server fails to
-// start, it logs the error and terminates the program.
-func main() {
-	http.HandleFunc("/create-user", handleCreateUser)
-	http.HandleFunc("/generate-token", handleGenerateToken)
-	http.HandleFunc("/verify-token", handleVerifyToken)
-	http.HandleFunc("/refresh-token", handleRefreshToken)
-	log.Printf("Server Listening at port %s\n", cfg.ServerPort)
-	err := http.ListenAndServe(":"+cfg.ServerPort, nil)
-	if err != nil {
-		log.Fatalf("Error occured while listening: %v\n", err)
+	var tokens token.TokenManager
+	if opaque {
+		tokens = token.NewOpaqueTokenManager(sessions, tokenCfg.AccessToken.Duration, tokenCfg.RefreshToken.Duration).
+			WithStore(dbStore)
+	} else {
+		jwtManager, err := token.NewJWTManager().
+			WithConfig(tokenCfg).
+			WithAccessSecretString(cfg.JWTAccessSecret).
+			WithRefreshSecretString(cfg.JWTRefreshSecret).
+			WithPreviousAccessSecretString(cfg.JWTAccessSecretPrevious).
+			WithPreviousRefreshSecretString(cfg.JWTRefreshSecretPrevious).
+			WithStrictVerification(cfg.StrictVerificationEnabled()).
+			WithMinimumTokenVersion(minimumVersion).
+			WithBindingMode(bindingMode).
+			WithSlidingExpiration(slidingThreshold).
+			WithClaimsEncryption(claimsKey).
+			WithPreviousClaimsEncryptionKey(previousClaimsKey).
+			WithStore(dbStore).
+			WithServiceAccounts(serviceAccounts).
+			Build()
+		if err != nil {
+			return fmt.Errorf("Error creating a jwt manager instance: %w", err)
+		}
+		tokens = jwtManager
 	}
-}
+	a = authify.NewAuthify(dbStore, tokens).WithPreciseLoginErrors(cfg.PreciseLoginErrorsEnabled())
 
-// handleCreateUser handles the "/createUser" route.
-// It reads the username and password from the request headers,
-// creates a new user in the data store, and responds with a success
-// message or an error. Logs the username when the user is created.
-func handleCreateUser(w http.ResponseWriter, r *http.Request) {
-	userData, err := lib.ParseUserHeaders(r, a.Store.StoreConfig())
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing headers: %v", err), http.StatusBadRequest)
-		return
+	if storeCfg.Sessions {
+		a.WithSessionStore(sessions)
 	}
+	if storeCfg.RefreshRotation {
+		a.WithTokenFamilies(sessions)
+	}
+	if storeCfg.AuditLog {
+		auditLog, err := dbStore.NewAuditLog()
+		if err != nil {
+			return fmt.Errorf("Error creating audit log: %w", err)
+		}
+		if storeCfg.AuditQueue.Async {
+			// events are written in batches in the background, and flushed on shutdown
+			audit = stores.NewAsyncAuditLog(auditLog, storeCfg.AuditQueue)
+			a.WithAuditLogger(audit)
+		} else {
+			a.WithAuditLogger(auditLog)
+		}
+	}
+	if cfg.ChallengeLoginEnabled() {
+		a.WithChallengeLogin(sessions)
+	}
+	if cfg.InvalidationBusEnabled() {
+		invalidations, err = dbStore.NewInvalidationBus()
+		if err != nil {
+			return fmt.Errorf("Error creating invalidation bus: %w", err)
+		}
+		a.WithInvalidationBus(invalidations)
+		if jwtManager, ok := tokens.(*token.JWTManager); ok {
+			jwtManager.WithInvalidationBus(invalidations)
+		}
+	}
+	// invites are only kept for the invite registration policy
+	registration, _ := cfg.Registration()
+	var invites stores.InviteStore
+	if registration == authify.RegistrationInvite {
+		if invites, err = dbStore.NewInviteStore(); err != nil {
+			return fmt.Errorf("Error creating invite store: %w", err)
+		}
+	}
+	a.WithRegistrationPolicy(registration, invites)
 
-	err = a.Store.CreateUser(userData)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating user: %v", err), http.StatusInternalServerError)
-		return
+	tokenMode := lib.TokenModeJWT
+	if opaque {
+		tokenMode = lib.TokenModeOpaque
 	}
+	log.Println(lib.Banner{
+		Service:    "authify-server",
+		Store:      "postgres",
+		Table:      storeCfg.Name,
+		Tokens:     tokenMode,
+		AccessTTL:  tokenCfg.AccessToken.Duration,
+		RefreshTTL: tokenCfg.RefreshToken.Duration,
+	})
 
-	fmt.Fprint(w, "User created!\n")
-	log.Printf("Created user with username: %v\n", userData["username"])
+	// token lifetimes and role permissions follow the config files, on change or SIGHUP
+	if reloadable, ok := tokens.(token.Reloadable); ok {
+		reloader := lib.NewReloader(cfg, *storeCfg, *tokenCfg, reloadable)
+		go func() {
+			if err := reloader.Watch(context.Background()); err != nil {
+				log.Printf("Config reloading disabled: %v\n", err)
+			}
+		}()
+	}
+	return nil
 }
 
-// handleGenerateToken handles the "/generateToken" route.
-// It extracts the username and password from the request headers,
-// generates a JWT token for the user if the credentials are valid,
-// and responds with the token or an error. Logs the username when
-// a token is successfully generated.
-func handleGenerateToken(w http.ResponseWriter, r *http.Request) {
-	ipAddress := r.RemoteAddr
-
-	// Parse all user headers dynamically
-	userData, err := lib.ParseUserHeaders(r, a.Store.StoreConfig())
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error occurred while parsing headers: %v", err), http.StatusBadRequest)
-		return
+// main is the entry point of the application.
+// It serves the httpapi router, including the deprecated unversioned routes and, with
+// REST_GATEWAY, the JSON gateway of the gRPC service, on the configured port, with the timeouts of the *_TIMEOUT_SECONDS config keys
+// so slow clients and hung queries cannot hold connections forever.
+// On SIGINT or SIGTERM, it lets the requests in flight finish for SHUTDOWN_TIMEOUT_SECONDS
+// and writes the queued audit events before closing the store.
+// If the server fails to start, it logs the error and terminates the program.
+func main() {
+	if err := setup(); err != nil {
+		log.Fatal(err)
 	}
-
-	username, ok := userData["username"].(string)
-	if !ok {
-		http.Error(w, "username is required to generate token", http.StatusBadRequest)
-		return
+	timeouts := cfg.ServerTimeouts()
+	userExistsLimit, _ := cfg.UserExistsRateLimit()
+	headers, _ := cfg.Headers()
+	disabledFeatures, _ := cfg.DisabledFeatureList()
+	opts := []httpapi.Option{
+		httpapi.WithLegacyRoutes(),
+		httpapi.WithHeaderPrefix(headers.Prefix),
+		httpapi.WithOAuthClient(cfg.OAuthClientID, cfg.OAuthClientSecret.Reveal()),
+		httpapi.WithRequestTimeout(timeouts.Request),
+		httpapi.WithUserExistsRateLimit(userExistsLimit),
+		httpapi.WithoutFeatures(disabledFeatures...),
 	}
-
-	password, ok := userData["password"].(string)
-	if !ok {
-		http.Error(w, "password is required to generate token", http.StatusBadRequest)
-		return
+	if cfg.UserExistsTokenRequired() {
+		opts = append(opts, httpapi.WithUserExistsToken())
 	}
-
-	// Generate access token
-	accessToken, err := a.Tokens.GenerateAccessToken(username, password)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error occurred while generating token: %v", err), http.StatusInternalServerError)
-		return
+	if cfg.TrustForwardedForEnabled() {
+		opts = append(opts, httpapi.WithTrustedForwardedFor())
 	}
-
-	// Generate refresh token
-	reqData := map[string]any{
-		"ip": ipAddress,
+	if cfg.ChallengeLoginEnabled() {
+		opts = append(opts, httpapi.WithChallengeLogin())
+	}
+	if cfg.RefreshRoleEnabled() {
+		opts = append(opts, httpapi.WithRefreshRole())
+	}
+	if cfg.SecretRotationEnabled() {
+		opts = append(opts, httpapi.WithSecretRotation())
+	}
+	if ttl := cfg.IdempotencyTTL(); ttl > 0 {
+		opts = append(opts, httpapi.WithIdempotency(httpapi.NewInMemoryIdempotencyStore(), ttl))
+	}
+	if provider, threshold, _ := cfg.SignupChallenge(); provider != nil {
+		opts = append(opts, httpapi.WithSignupChallenge(provider, threshold))
+	}
+	gatewayService := authifygrpc.NewAuthifyGRPCServer(a).
+		WithUserExistsRateLimit(userExistsLimit).
+		WithUserExistsToken(cfg.UserExistsTokenRequired()).
+		WithoutFeatures(disabledFeatures...)
+	if cfg.FederationConfigFilePath != "" {
+		federationCfg, err := lib.LoadFederationConfig(cfg.FederationConfigFilePath)
+		if err != nil {
+			log.Fatalf("Error loading federation config: %v", err)
+		}
+		if federationCfg.Issuer != "" {
+			federator, err := federation.NewOIDCFederator(federationCfg.Issuer, federationCfg.ClientID, a, federationCfg.Options()...)
+			if err != nil {
+				log.Fatalf("Error creating federator: %v", err)
+			}
+			opts = append(opts, httpapi.WithFederation(federator))
+			gatewayService.WithFederator(federator)
+		}
+		// browsers sign in with the providers through /auth/{provider}/login
+		for _, provider := range federationCfg.Providers {
+			flow, err := federation.NewCodeFlowFromConfig(provider, a)
+			if err != nil {
+				log.Fatalf("Error creating %s login: %v", provider.Name, err)
+			}
+			opts = append(opts, httpapi.WithCodeFlow(provider.Name, flow))
+		}
+	}
+	// the JSON gateway of the gRPC service is served with, or in place of, the header-based routes
+	switch gatewayMode, _ := cfg.RESTGatewayMode(); gatewayMode {
+	case lib.RESTGatewayAlongside:
+		opts = append(opts, httpapi.WithGateway(gatewayService))
+	case lib.RESTGatewayOnly:
+		opts = append(opts, httpapi.WithGateway(gatewayService), httpapi.WithoutHeaderRoutes())
 	}
-	refreshToken, err := a.Tokens.GenerateRefreshToken(username, reqData)
+	server := &http.Server{
+		Addr:              ":" + cfg.ServerPort,
+		Handler:           httpapi.NewRouter(a, opts...),
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+		MaxHeaderBytes:    httpapi.MaxHeaderBytes,
+	}
+	removePIDFile, err := cfg.WritePIDFile()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error occurred while generating refresh token: %v", err), http.StatusInternalServerError)
-		return
+		log.Fatal(err)
 	}
+	defer removePIDFile()
 
-	fmt.Fprintf(w, "Access Token: %v\nRefresh Token: %v\n", accessToken, refreshToken)
-	log.Printf("Generated token for user with username: %v\n", username)
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
 
-// handleVerifyToken handles the "/verifyToken" route.
-// It extracts the token from the request headers, validates it,
-// and responds with the associated username and role if the token
-// is valid. Logs the username when the token is successfully verified.
-func handleVerifyToken(w http.ResponseWriter, r *http.Request) {
-	accessToken, err := lib.ParseAccessToken(r)
-	if err != nil {
-		fmt.Fprint(w, fmt.Sprintf("Error occured while verifying token: %v\n", err))
-		return
-	}
-	claims, err := a.Tokens.VerifyAccessToken(accessToken)
-	if err != nil {
-		fmt.Fprintf(w, fmt.Sprintf("Error occured while validating token: %v\n", err))
-		return
+	log.Printf("Server Listening at port %s\n", cfg.ServerPort)
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		log.Println("Shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeouts.Shutdown)
+		err = server.Shutdown(shutdownCtx)
+		cancel()
 	}
-	fmt.Fprint(w, fmt.Sprintf("Token validated with claims %v \n", claims))
-	log.Printf("Verified token for user with claims: %v\n", claims)
-}
 
-// handleRefreshToken handles the "/refreshToken" route.
-// It extracts the token from the request headers, attempts to refresh it,
-// and responds with the new token if successful. Logs the username when
-// a token is refreshed.
-func handleRefreshToken(w http.ResponseWriter, r *http.Request) {
-	accessToken, err := lib.ParseAccessToken(r)
-	if err != nil {
-		fmt.Fprint(w, fmt.Sprintf("Error occured while refreshing token: %v\n", err))
-		return
+	// the invalidation bus, the queued audit events, then the store, are closed once the server
+	// stopped serving, before exiting
+	if invalidations != nil {
+		invalidations.Close()
 	}
-	refreshToken, err := lib.ParseRefreshToken(r)
-	if err != nil {
-		fmt.Fprint(w, fmt.Sprintf("Error occured while refreshing token: %v\n", err))
-		return
+	if audit != nil {
+		drainCtx, cancel := context.WithTimeout(context.Background(), audit.DrainTimeout())
+		if closeErr := audit.Close(drainCtx); closeErr != nil {
+			log.Printf("Error flushing audit log: %v\n", closeErr)
+		}
+		cancel()
 	}
-	reqData := map[string]any{
-		"ip": r.RemoteAddr,
-		"user_agent": r.UserAgent(),
+	if closeErr := a.Store.Close(); closeErr != nil {
+		log.Printf("Error closing store: %v\n", closeErr)
 	}
-	newToken, claims, err := a.Tokens.RefreshToken(accessToken, refreshToken, reqData)
-	if err != nil {
-		fmt.Fprintf(w, fmt.Sprintf("Error occured while validating token: %v\n", err))
-		return
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Error occured while listening: %v\n", err)
 	}
-	fmt.Fprint(w, fmt.Sprintf("Token Refreshed! new token is: %v\n", newToken))
-	log.Printf("Refreshed token for user with username: %v\n", claims)
 }
@@ -11,7 +11,7 @@ echo "================================="
 echo "1️⃣ Creating user"
 echo "================================="
 
-curl -s -X POST "$BASE_URL/create-user" \
+curl -s -X POST "$BASE_URL/v1/users" \
   -H "authify-username: $USERNAME" \
   -H "authify-password: $PASSWORD" \
   | tee /tmp/authify_create.out
@@ -21,7 +21,7 @@ echo "================================="
 echo "2️⃣ Generating tokens"
 echo "================================="
 
-TOKEN_RESPONSE=$(curl -s -X POST "$BASE_URL/generate-token" \
+TOKEN_RESPONSE=$(curl -s -X POST "$BASE_URL/v1/tokens" \
   -H "authify-username: $USERNAME" \
   -H "authify-password: $PASSWORD")
 
@@ -40,7 +40,7 @@ echo "================================="
 echo "3️⃣ Verifying token"
 echo "================================="
 
-curl -s -X POST "$BASE_URL/verify-token" \
+curl -s -X POST "$BASE_URL/v1/tokens/verify" \
   -H "authify-access: $ACCESS_TOKEN" \
   -H "authify-refresh: $REFRESH_TOKEN" \
   | tee /tmp/authify_verify.out
@@ -50,7 +50,7 @@ echo "================================="
 echo "4️⃣ Refreshing access token"
 echo "================================="
 
-REFRESH_RESPONSE=$(curl -s -X POST "$BASE_URL/refresh-token" \
+REFRESH_RESPONSE=$(curl -s -X POST "$BASE_URL/v1/tokens/refresh" \
   -H "authify-access: $ACCESS_TOKEN" \
   -H "authify-refresh: $REFRESH_TOKEN")
 
@@ -0,0 +1,281 @@
+package authify
+
+import (
+	"context"
+	"errors"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+var (
+	// User-related errors, shared with every Store implementation
+	ErrUserExists      = stores.ErrUserExists
+	ErrUserNotFound    = stores.ErrUserNotFound
+	ErrInvalidPassword = stores.ErrInvalidPassword
+	ErrMissingField    = stores.ErrMissingField
+	ErrHashingBusy     = stores.ErrHashingBusy
+	ErrAccountDisabled = stores.ErrAccountDisabled
+	ErrFieldTooLong    = stores.ErrFieldTooLong
+	ErrInvalidRole     = stores.ErrInvalidRole
+	ErrPasswordReused  = stores.ErrPasswordReused
+
+	// ErrInvalidFieldValue is returned for input values that are not valid UTF-8 or hold NUL bytes
+	ErrInvalidFieldValue = stores.ErrInvalidFieldValue
+
+	// ErrColumnNotQueryable is returned by UserExists for columns that are not unique
+	ErrColumnNotQueryable = stores.ErrColumnNotQueryable
+
+	// Token-related errors, shared with every TokenManager implementation
+	ErrTokenExpired            = token.ErrTokenExpired
+	ErrTokenNotValidYet        = token.ErrTokenNotValidYet
+	ErrInvalidToken            = token.ErrInvalidToken
+	ErrClaimsInvalid           = token.ErrClaimsInvalid
+	ErrRefreshTokenExpired     = token.ErrRefreshTokenExpired
+	ErrInsufficientScope       = token.ErrInsufficientScope
+	ErrAudienceMismatch        = token.ErrAudienceMismatch
+	ErrUnexpectedSigningMethod = token.ErrUnexpectedSigningMethod
+	ErrExchangeForbidden       = token.ErrExchangeForbidden
+	ErrTokenNotExchangeable    = token.ErrTokenNotExchangeable
+	ErrTokenVersionMismatch    = token.ErrTokenVersionMismatch
+	ErrTokenVersionTooOld      = token.ErrTokenVersionTooOld
+	ErrBindingMismatch         = token.ErrBindingMismatch
+	ErrInvalidScope            = token.ErrInvalidScope
+	ErrTokenUseMismatch        = token.ErrTokenUseMismatch
+
+	// ErrTokenDurationTooLong rejects custom token lifetimes over the maximum, see token.JWTManager.WithMaxTokenDuration
+	ErrTokenDurationTooLong = token.ErrTokenDurationTooLong
+
+	// ErrTokenInvalidatedGlobally rejects the tokens issued before InvalidateAllTokens
+	ErrTokenInvalidatedGlobally = token.ErrTokenInvalidatedGlobally
+
+	// Service account errors, see GenerateServiceToken
+	ErrInvalidClientCredentials    = stores.ErrInvalidClientCredentials
+	ErrServiceAccountExists        = stores.ErrServiceAccountExists
+	ErrServiceAccountNotFound      = stores.ErrServiceAccountNotFound
+	ErrServiceAccountsNotSupported = stores.ErrServiceAccountsNotSupported
+
+	// Challenge login errors, see LoginWithProof
+	ErrChallengeNotSupported = stores.ErrChallengeNotSupported
+	ErrNonceUsed             = stores.ErrNonceUsed
+	ErrNonceExpired          = stores.ErrNonceExpired
+
+	// Errors of features the store or token manager in use lacks
+	ErrUpdatesNotSupported    = stores.ErrUpdatesNotSupported
+	ErrTokenVersionsDisabled  = stores.ErrTokenVersionsDisabled
+	ErrRevocationNotSupported = token.ErrRevocationNotSupported
+	ErrRotationNotSupported   = token.ErrRotationNotSupported
+	ErrNotImplemented         = token.ErrNotImplemented
+	ErrRequestNotSupported    = token.ErrRequestNotSupported
+	ErrLookupNotSupported     = stores.ErrLookupNotSupported
+	ErrListingNotSupported    = stores.ErrListingNotSupported
+
+	// ErrInvalidCredentials is returned by Login in place of ErrUserNotFound and
+	// ErrInvalidPassword, so clients cannot tell which usernames exist
+	ErrInvalidCredentials = errors.New("invalid username or password")
+
+	// ErrTimeout is returned by operations cut short by the deadline of their context
+	ErrTimeout = context.DeadlineExceeded
+
+	// ErrFieldNotEditable and ErrFieldConflict are returned by UpdateSelf, naming the field
+	ErrFieldNotEditable = stores.ErrFieldNotEditable
+	ErrFieldConflict    = stores.ErrFieldConflict
+
+	// ErrStoreUnavailable is returned while the database cannot be reached, see Ready
+	ErrStoreUnavailable = stores.ErrStoreUnavailable
+
+	// ErrInvalidIDToken is returned for ID tokens of an identity provider that fail validation,
+	// see the federation package
+	ErrInvalidIDToken = errors.New("invalid ID token")
+
+	// ErrFederatedLoginFailed is returned when an identity provider sends a user back without
+	// a usable authorization code, or with a state that is not the one of the login, see
+	// federation.CodeFlow
+	ErrFederatedLoginFailed = errors.New("federated login failed")
+
+	// ErrRegistrationClosed and ErrInviteRequired are returned by RegisterUser to clients the
+	// registration policy does not let create users
+	ErrRegistrationClosed = errors.New("registration is closed, only administrators can create users")
+	ErrInviteRequired     = errors.New("registration requires an invite code")
+
+	// Token family errors, see WithTokenFamilies
+	ErrTokenFamiliesNotSupported = stores.ErrTokenFamiliesNotSupported
+	ErrRefreshTokenReused        = stores.ErrRefreshTokenReused
+
+	// Invite errors, see RegisterUser and stores.InviteStore
+	ErrInvitesNotSupported = stores.ErrInvitesNotSupported
+	ErrInviteNotFound      = stores.ErrInviteNotFound
+	ErrInviteExpired       = stores.ErrInviteExpired
+	ErrInviteUsedUp        = stores.ErrInviteUsedUp
+
+	// ErrRateLimited is returned to clients that made too many requests of a rate limited
+	// operation, such as UserExists over HTTP and gRPC
+	ErrRateLimited = errors.New("too many requests, try again later")
+
+	// ErrChallengeRequired and ErrChallengeFailed are returned to clients creating many users,
+	// which must answer the challenge of a ChallengeProvider, see httpapi.WithSignupChallenge
+	ErrChallengeRequired = errors.New("too many users created, answer the challenge to create more")
+	ErrChallengeFailed   = errors.New("challenge failed")
+)
+
+// AuthErrorCode is a stable, machine-readable error code returned to HTTP and gRPC clients,
+// see ErrorCode. Its values never change, clients can branch on them.
+type AuthErrorCode string
+
+// Stable, machine-readable error codes returned to HTTP and gRPC clients.
+const (
+	CodeUserExists            AuthErrorCode = "user_exists"
+	CodeUserNotFound          AuthErrorCode = "user_not_found"
+	CodeInvalidPassword       AuthErrorCode = "invalid_password"
+	CodeMissingField          AuthErrorCode = "missing_field"
+	CodeTokenExpired          AuthErrorCode = "token_expired"
+	CodeTokenNotValidYet      AuthErrorCode = "token_not_valid_yet"
+	CodeInvalidToken          AuthErrorCode = "invalid_token"
+	CodeRefreshTokenExpired   AuthErrorCode = "refresh_token_expired"
+	CodeInsufficientScope     AuthErrorCode = "insufficient_scope"
+	CodeAudienceMismatch      AuthErrorCode = "audience_mismatch"
+	CodeHashingBusy           AuthErrorCode = "hashing_busy"
+	CodeAccountDisabled       AuthErrorCode = "account_disabled"
+	CodeFieldTooLong          AuthErrorCode = "field_too_long"
+	CodeExchangeForbidden     AuthErrorCode = "exchange_forbidden"
+	CodeNotExchangeable       AuthErrorCode = "token_not_exchangeable"
+	CodeInvalidRole           AuthErrorCode = "invalid_role"
+	CodeTimeout               AuthErrorCode = "timeout"
+	CodeInvalidCredentials    AuthErrorCode = "invalid_credentials"
+	CodeChallengeNotSupported AuthErrorCode = "challenge_not_supported"
+	CodeNonceUsed             AuthErrorCode = "nonce_used"
+	CodeNonceExpired          AuthErrorCode = "nonce_expired"
+	CodeTokenRevoked          AuthErrorCode = "token_revoked"
+	CodeTokenVersionTooOld    AuthErrorCode = "token_version_too_old"
+	CodeNotSupported          AuthErrorCode = "not_supported"
+	CodeBindingMismatch       AuthErrorCode = "binding_mismatch"
+	CodeColumnNotQueryable    AuthErrorCode = "column_not_queryable"
+	CodeRateLimited           AuthErrorCode = "rate_limited"
+	CodeInvalidClient         AuthErrorCode = "invalid_client"
+	CodeInvalidScope          AuthErrorCode = "invalid_scope"
+	CodeTokenUseMismatch      AuthErrorCode = "token_use_mismatch"
+	CodeInternal              AuthErrorCode = "internal_error"
+)
+
+// CodePasswordReused is returned for ErrPasswordReused, see ChangePassword.
+const CodePasswordReused AuthErrorCode = "password_reused"
+
+// CodeInvalidField is returned for ErrInvalidFieldValue, see stores.StoreConfig.ValidateInput.
+const CodeInvalidField AuthErrorCode = "invalid_field"
+
+// CodeFieldNotEditable is returned for ErrFieldNotEditable, see UpdateSelf.
+const CodeFieldNotEditable AuthErrorCode = "field_not_editable"
+
+// CodeFieldConflict is returned for ErrFieldConflict, when a unique field value is taken.
+const CodeFieldConflict AuthErrorCode = "field_conflict"
+
+// CodeStoreUnavailable is returned for ErrStoreUnavailable, while the database cannot be reached.
+const CodeStoreUnavailable AuthErrorCode = "store_unavailable"
+
+// CodeInvalidIDToken is returned for ErrInvalidIDToken, see the federation package.
+const CodeInvalidIDToken AuthErrorCode = "invalid_id_token"
+
+// CodeFederatedLoginFailed is returned for ErrFederatedLoginFailed, see federation.CodeFlow.
+const CodeFederatedLoginFailed AuthErrorCode = "federated_login_failed"
+
+// CodeRegistrationClosed and CodeInviteRequired are returned for ErrRegistrationClosed and
+// ErrInviteRequired, CodeInvalidInvite for invite codes that are unknown, expired or used up.
+const (
+	CodeRegistrationClosed AuthErrorCode = "registration_closed"
+	CodeInviteRequired     AuthErrorCode = "invite_required"
+	CodeInvalidInvite      AuthErrorCode = "invalid_invite"
+)
+
+// CodeChallengeRequired and CodeChallengeFailed are returned for ErrChallengeRequired and
+// ErrChallengeFailed, see ChallengeProvider.
+const (
+	CodeChallengeRequired AuthErrorCode = "challenge_required"
+	CodeChallengeFailed   AuthErrorCode = "challenge_failed"
+)
+
+// CodeTokenDurationTooLong is returned for ErrTokenDurationTooLong, see token.ExpiryIssuer.
+const CodeTokenDurationTooLong AuthErrorCode = "token_duration_too_long"
+
+// CodeRefreshTokenReused is returned for ErrRefreshTokenReused, see WithTokenFamilies.
+const CodeRefreshTokenReused AuthErrorCode = "refresh_token_reused"
+
+var errorCodes = []struct {
+	err  error
+	code AuthErrorCode
+}{
+	// ErrRefreshTokenExpired is checked before the generic token errors on purpose
+	{ErrRefreshTokenExpired, CodeRefreshTokenExpired},
+	{ErrUserExists, CodeUserExists},
+	{ErrUserNotFound, CodeUserNotFound},
+	{ErrInvalidPassword, CodeInvalidPassword},
+	{ErrMissingField, CodeMissingField},
+	{ErrTokenExpired, CodeTokenExpired},
+	{ErrTokenNotValidYet, CodeTokenNotValidYet},
+	{ErrInvalidToken, CodeInvalidToken},
+	{ErrClaimsInvalid, CodeInvalidToken},
+	{ErrUnexpectedSigningMethod, CodeInvalidToken},
+	{ErrInsufficientScope, CodeInsufficientScope},
+	{ErrAudienceMismatch, CodeAudienceMismatch},
+	{ErrHashingBusy, CodeHashingBusy},
+	{ErrAccountDisabled, CodeAccountDisabled},
+	{ErrFieldTooLong, CodeFieldTooLong},
+	{ErrExchangeForbidden, CodeExchangeForbidden},
+	{ErrTokenNotExchangeable, CodeNotExchangeable},
+	{ErrInvalidRole, CodeInvalidRole},
+	{ErrTimeout, CodeTimeout},
+	{ErrInvalidCredentials, CodeInvalidCredentials},
+	{ErrChallengeNotSupported, CodeChallengeNotSupported},
+	{ErrNonceUsed, CodeNonceUsed},
+	{ErrNonceExpired, CodeNonceExpired},
+	{ErrTokenVersionMismatch, CodeTokenRevoked},
+	{ErrTokenInvalidatedGlobally, CodeTokenRevoked},
+	{ErrTokenVersionTooOld, CodeTokenVersionTooOld},
+	{ErrUpdatesNotSupported, CodeNotSupported},
+	{ErrTokenVersionsDisabled, CodeNotSupported},
+	{ErrRevocationNotSupported, CodeNotSupported},
+	{ErrBindingMismatch, CodeBindingMismatch},
+	{ErrLookupNotSupported, CodeNotSupported},
+	{ErrListingNotSupported, CodeNotSupported},
+	{ErrColumnNotQueryable, CodeColumnNotQueryable},
+	{ErrRateLimited, CodeRateLimited},
+	{ErrInvalidClientCredentials, CodeInvalidClient},
+	{ErrInvalidScope, CodeInvalidScope},
+	{ErrTokenUseMismatch, CodeTokenUseMismatch},
+	{ErrServiceAccountsNotSupported, CodeNotSupported},
+	{ErrPasswordReused, CodePasswordReused},
+	{ErrRotationNotSupported, CodeNotSupported},
+	{ErrNotImplemented, CodeNotSupported},
+	{ErrRequestNotSupported, CodeNotSupported},
+	{ErrInvalidFieldValue, CodeInvalidField},
+	{ErrStoreUnavailable, CodeStoreUnavailable},
+	{ErrFieldNotEditable, CodeFieldNotEditable},
+	{ErrFieldConflict, CodeFieldConflict},
+	{ErrInvalidIDToken, CodeInvalidIDToken},
+	{ErrFederatedLoginFailed, CodeFederatedLoginFailed},
+	{ErrTokenDurationTooLong, CodeTokenDurationTooLong},
+	{ErrRegistrationClosed, CodeRegistrationClosed},
+	{ErrInviteRequired, CodeInviteRequired},
+	{ErrInviteNotFound, CodeInvalidInvite},
+	{ErrInviteExpired, CodeInvalidInvite},
+	{ErrInviteUsedUp, CodeInvalidInvite},
+	{ErrInvitesNotSupported, CodeNotSupported},
+	{ErrChallengeRequired, CodeChallengeRequired},
+	{ErrChallengeFailed, CodeChallengeFailed},
+	{ErrRefreshTokenReused, CodeRefreshTokenReused},
+	{ErrTokenFamiliesNotSupported, CodeNotSupported},
+}
+
+// ErrorCode maps err to a stable code clients can branch on.
+// Errors that don't wrap one of the sentinels above map to CodeInternal,
+// an empty string is returned for a nil error.
+func ErrorCode(err error) AuthErrorCode {
+	if err == nil {
+		return ""
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
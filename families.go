@@ -0,0 +1,284 @@
+package authify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultTokenFamilyGraceWindow is how long the pair issued by the rotation of a refresh token
+// is handed to the duplicates of that refresh, see WithTokenFamilyGraceWindow
+const defaultTokenFamilyGraceWindow = 10 * time.Second
+
+// familyRefreshes rotates a refresh token once for the concurrent refreshes made with it, e.g.
+// the requests of a browser tab whose access token just expired, and hands the pair the rotation
+// issued to the refreshes made with the consumed token within window, rather than taking them
+// for its reuse
+type familyRefreshes struct {
+	window time.Duration
+	group  singleflight.Group
+
+	mu      sync.Mutex
+	rotated map[string]rotatedPair
+}
+
+// rotatedPair is the pair issued in place of a consumed refresh token
+type rotatedPair struct {
+	pair    *TokenPair
+	expires time.Time
+}
+
+// familyRefreshKey identifies the refreshes made with the refresh token jti of a family
+func familyRefreshKey(familyID, jti string) string {
+	return familyID + "\x00" + jti
+}
+
+// successor returns the pair that replaced the refresh token of key within the grace window
+func (f *familyRefreshes) successor(key string) (*TokenPair, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.rotated[key]
+	if !ok || time.Now().After(r.expires) {
+		return nil, false
+	}
+	return r.pair, true
+}
+
+// store records the pair that replaced the refresh token of key, purging the pairs past their
+// grace window
+func (f *familyRefreshes) store(key string, pair *TokenPair) {
+	if f.window <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rotated == nil {
+		f.rotated = make(map[string]rotatedPair)
+	}
+	now := time.Now()
+	for k, r := range f.rotated {
+		if now.After(r.expires) {
+			delete(f.rotated, k)
+		}
+	}
+	f.rotated[key] = rotatedPair{pair: pair, expires: now.Add(f.window)}
+}
+
+// clonePair returns a copy of pair for a caller, callers may modify its claims
+func clonePair(pair *TokenPair) *TokenPair {
+	c := *pair
+	c.AccessClaims = maps.Clone(pair.AccessClaims)
+	return &c
+}
+
+// WithTokenFamilies rotates refresh tokens on every refresh and records them in families. Each
+// login starts a token family, whose ID its refresh tokens carry in their "sid" claim, the
+// session ID of the login when a session store is set, and each refresh token of the family
+// has its own "jti" claim. A refresh consumes the refresh token it is made with and returns its
+// successor. Refreshing with a consumed token again, as a thief replaying a stolen token would,
+// fails with ErrRefreshTokenReused and compromises the family: its tokens are revoked and the
+// jti and client IP of the reused token are recorded, see TokenFamilies. Access tokens already
+// issued to the family stay valid until they expire.
+//
+// Concurrent refreshes with the same refresh token rotate it once and all get the pair the
+// rotation issued, as do the refreshes made with it within the grace window of the rotation,
+// see WithTokenFamilyGraceWindow, so the parallel requests of a client are not taken for the
+// reuse of a stolen token. That grace is kept by each Authify, refreshes served by other
+// instances sharing the family store have none.
+//
+// Refresh tokens issued before rotation was enabled, which carry no "jti" claim, are refreshed
+// as they are.
+func (a *Authify) WithTokenFamilies(families stores.TokenFamilyStore) *Authify {
+	a.Families = families
+	return a
+}
+
+// WithTokenFamilyGraceWindow sets how long after the rotation of a refresh token the refreshes
+// made with it again get the pair the rotation issued, rather than failing with
+// ErrRefreshTokenReused, 10s by default. Zero disables the grace, refreshes in flight still
+// share the rotation.
+func (a *Authify) WithTokenFamilyGraceWindow(d time.Duration) *Authify {
+	a.familyRefreshes.window = d
+	return a
+}
+
+// TokenFamilies returns the token families of a user with their refresh tokens, oldest first,
+// see WithTokenFamilies. It fails with ErrTokenFamiliesNotSupported without a family store.
+func (a *Authify) TokenFamilies(userIdentifier string) ([]stores.TokenFamily, error) {
+	if a.Families == nil {
+		return nil, ErrTokenFamiliesNotSupported
+	}
+	return a.Families.ListTokenFamilies(userIdentifier)
+}
+
+// newTokenFamily returns the family of a login, with the first refresh token to issue, or nil
+// without a family store. The family takes the ID of the login's session, unless empty. Its
+// expiry is set once the refresh token is issued.
+func (a *Authify) newTokenFamily(username, sessionID string, device stores.DeviceInfo) (*stores.TokenFamily, error) {
+	if a.Families == nil {
+		return nil, nil
+	}
+	id := sessionID
+	if id == "" {
+		var err error
+		if id, err = stores.NewSessionID(); err != nil {
+			return nil, err
+		}
+	}
+	jti, err := stores.NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &stores.TokenFamily{
+		ID:             id,
+		UserIdentifier: username,
+		Device:         device,
+		CreatedAt:      now,
+		Tokens:         []stores.FamilyToken{{JTI: jti, IP: device.IP, IssuedAt: now}},
+	}, nil
+}
+
+// refreshTokens serves RefreshTokens, rotating the refresh token within its family when a
+// family store is set. The refreshes made with the same refresh token share one rotation, see
+// WithTokenFamilies.
+func (a *Authify) refreshTokens(ctx context.Context, req token.RefreshTokensRequest) (*TokenPair, error) {
+	if a.Families == nil {
+		return a.Tokens.RefreshTokens(ctx, req)
+	}
+	familyID, jti := a.refreshTokenFamily(req.RefreshToken)
+	if jti == "" {
+		// the token manager reports invalid tokens, tokens issued without a family are refreshed as they are
+		return a.Tokens.RefreshTokens(ctx, req)
+	}
+
+	key := familyRefreshKey(familyID, jti)
+	val, err, _ := a.familyRefreshes.group.Do(key, func() (any, error) {
+		if pair, ok := a.familyRefreshes.successor(key); ok {
+			return pair, nil
+		}
+		pair, err := a.rotateTokenFamily(ctx, req, familyID, jti)
+		if err != nil {
+			return nil, err
+		}
+		a.familyRefreshes.store(key, pair)
+		return pair, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clonePair(val.(*TokenPair)), nil
+}
+
+// rotateTokenFamily refreshes req, whose refresh token jti of a family is consumed in exchange
+// for the refresh token of the returned pair
+func (a *Authify) rotateTokenFamily(ctx context.Context, req token.RefreshTokensRequest, familyID, jti string) (*TokenPair, error) {
+	next, err := stores.NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+	req.RefreshTokenID = next
+	// the tokens are minted before the rotation is recorded, so a refresh failing on the user,
+	// such as a disabled one, leaves the refresh token usable
+	pair, err := a.Tokens.RefreshTokens(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	err = a.Families.RotateTokenFamily(familyID, jti, stores.FamilyToken{JTI: next, IP: req.Device.IP, IssuedAt: now})
+	if err != nil {
+		a.revokeUnused(pair)
+		return nil, a.familyError(familyID, jti, req.Device.IP, now, err)
+	}
+	return pair, nil
+}
+
+// checkTokenFamily fails unless refreshToken is the current token of its family, or was
+// consumed within the grace window, for the refreshes that cannot rotate it, see
+// RefreshTokenContext
+func (a *Authify) checkTokenFamily(refreshToken, ip string) error {
+	if a.Families == nil {
+		return nil
+	}
+	familyID, jti := a.refreshTokenFamily(refreshToken)
+	if jti == "" {
+		return nil
+	}
+	if _, ok := a.familyRefreshes.successor(familyRefreshKey(familyID, jti)); ok {
+		return nil
+	}
+	family, err := a.Families.GetTokenFamily(familyID)
+	if err == nil {
+		err = family.Check(jti)
+	}
+	if err != nil {
+		return a.familyError(familyID, jti, ip, time.Now().UTC(), err)
+	}
+	return nil
+}
+
+// refreshTokenFamily returns the family ID and jti of a refresh token, empty when it is not
+// part of a family or fails verification
+func (a *Authify) refreshTokenFamily(refreshToken string) (familyID, jti string) {
+	claims, err := a.Tokens.VerifyRefreshToken(refreshToken)
+	if err != nil {
+		return "", ""
+	}
+	familyID, _ = claims[token.ClaimSessionID].(string)
+	jti, _ = claims[token.ClaimTokenID].(string)
+	if familyID == "" {
+		return "", ""
+	}
+	return familyID, jti
+}
+
+// refreshTokenExpiry returns when a freshly issued refresh token expires, zero when it does not
+func (a *Authify) refreshTokenExpiry(refreshToken string) time.Time {
+	claims, err := a.Tokens.VerifyRefreshToken(refreshToken)
+	if err != nil {
+		return time.Time{}
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		return exp.UTC()
+	}
+	return time.Time{}
+}
+
+// familyError returns the error of a refresh with the token jti of a family the family store
+// refused, compromising the family when the token was reused
+func (a *Authify) familyError(familyID, jti, ip string, now time.Time, err error) error {
+	switch {
+	case errors.Is(err, ErrRefreshTokenReused):
+		log.Printf("Refresh token %s of token family %s reused from %s, revoking the family\n", jti, familyID, ip)
+		compromise := stores.FamilyCompromise{JTI: jti, IP: ip, DetectedAt: now}
+		if err := a.Families.CompromiseTokenFamily(familyID, compromise); err != nil {
+			log.Printf("failed to compromise token family %s: %v", familyID, err)
+		}
+		return err
+	case errors.Is(err, stores.ErrTokenFamilyNotFound), errors.Is(err, stores.ErrTokenNotFound):
+		return fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	return err
+}
+
+// revokeUnused revokes the tokens of a refresh that failed after they were minted, when the
+// token manager can
+func (a *Authify) revokeUnused(pair *TokenPair) {
+	revoker, ok := a.Tokens.(token.Revoker)
+	if !ok {
+		return
+	}
+	for _, tokenStr := range []string{pair.AccessToken, pair.RefreshToken} {
+		if err := revoker.RevokeToken(tokenStr); err != nil {
+			log.Printf("failed to revoke the tokens of a refused refresh: %v", err)
+		}
+	}
+}
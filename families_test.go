@@ -0,0 +1,199 @@
+package authify
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+func TestTokenFamilies(t *testing.T) {
+	jwtAuthify := setupAuthify()
+	opaqueAuthify := NewAuthify(jwtAuthify.Store, token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour).WithStore(jwtAuthify.Store))
+
+	for name, a := range map[string]*Authify{"jwt": jwtAuthify, "opaque": opaqueAuthify} {
+		t.Run(name, func(t *testing.T) {
+			testTokenFamilies(t, a)
+		})
+	}
+}
+
+func testTokenFamilies(t *testing.T, a *Authify) {
+	ctx := context.Background()
+	if _, err := a.TokenFamilies("alice"); !errors.Is(err, ErrTokenFamiliesNotSupported) {
+		t.Fatalf("expected ErrTokenFamiliesNotSupported without a family store, got %v", err)
+	}
+	// without grace, replaying a consumed token is detected right away
+	a.WithTokenFamilies(stores.NewInMemorySessionStore()).WithTokenFamilyGraceWindow(0)
+
+	pair, err := a.LoginContext(ctx, "alice", "password123", stores.DeviceInfo{IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	claims, err := a.Tokens.VerifyRefreshToken(pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("failed to verify refresh token: %v", err)
+	}
+	familyID, _ := claims[token.ClaimSessionID].(string)
+	if familyID == "" {
+		t.Fatalf("expected the refresh token to name its family, got %v", claims)
+	}
+
+	// three rotations, each refresh consuming the refresh token of the previous one
+	refreshTokens := []string{pair.RefreshToken}
+	jtis := []any{claims[token.ClaimTokenID]}
+	for i := range 3 {
+		previous := refreshTokens[len(refreshTokens)-1]
+		pair, err := a.RefreshTokens(ctx, token.RefreshTokensRequest{AccessToken: pair.AccessToken, RefreshToken: previous, Device: stores.DeviceInfo{IP: "10.0.0.2"}})
+		if err != nil {
+			t.Fatalf("refresh %d failed: %v", i+1, err)
+		}
+		if pair.RefreshToken == previous {
+			t.Fatalf("refresh %d: expected the refresh token to be rotated", i+1)
+		}
+		claims, err := a.Tokens.VerifyRefreshToken(pair.RefreshToken)
+		if err != nil {
+			t.Fatalf("refresh %d: failed to verify the rotated refresh token: %v", i+1, err)
+		}
+		if claims[token.ClaimSessionID] != familyID {
+			t.Errorf("refresh %d: expected the rotated token to stay in family %s, got %v", i+1, familyID, claims)
+		}
+		refreshTokens = append(refreshTokens, pair.RefreshToken)
+		jtis = append(jtis, claims[token.ClaimTokenID])
+	}
+
+	// replaying a consumed token compromises the family, whose current token is refused from then on
+	_, err = a.RefreshTokens(ctx, token.RefreshTokensRequest{RefreshToken: refreshTokens[1], Device: stores.DeviceInfo{IP: "192.0.2.9"}})
+	if !errors.Is(err, ErrRefreshTokenReused) || ErrorCode(err) != CodeRefreshTokenReused {
+		t.Fatalf("expected ErrRefreshTokenReused for a consumed token, got %v", err)
+	}
+	if _, err := a.RefreshTokens(ctx, token.RefreshTokensRequest{RefreshToken: refreshTokens[3], Device: stores.DeviceInfo{IP: "10.0.0.2"}}); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("expected the current token of a compromised family to be refused, got %v", err)
+	}
+	if _, _, err := a.RefreshToken("", refreshTokens[3], map[string]any{"ip": "10.0.0.2"}); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("expected RefreshToken to refuse the tokens of a compromised family, got %v", err)
+	}
+
+	families, err := a.TokenFamilies("alice")
+	if err != nil {
+		t.Fatalf("failed to list token families: %v", err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("expected the family of the login, got %+v", families)
+	}
+	family := families[0]
+	if family.ID != familyID || family.UserIdentifier != "alice" || family.Device.IP != "10.0.0.1" || !family.ExpiresAt.Equal(pair.RefreshExpiresAt) {
+		t.Errorf("unexpected token family %+v", family)
+	}
+	if len(family.Tokens) != 4 {
+		t.Fatalf("expected the login token and three rotations, got %+v", family.Tokens)
+	}
+	for i, tok := range family.Tokens {
+		if tok.JTI != jtis[i] {
+			t.Errorf("token %d: expected jti %v, got %s", i, jtis[i], tok.JTI)
+		}
+		ip := "10.0.0.2"
+		if i == 0 {
+			ip = "10.0.0.1"
+		}
+		if tok.IP != ip || tok.IssuedAt.IsZero() {
+			t.Errorf("token %d: expected it issued to %s, got %+v", i, ip, tok)
+		}
+		consumed := i < 3
+		if consumed == tok.ConsumedAt.IsZero() || consumed != tok.RevokedAt.IsZero() {
+			t.Errorf("token %d: expected consumed=%v and otherwise revoked, got %+v", i, consumed, tok)
+		}
+	}
+	if c := family.Compromise; c == nil || c.JTI != jtis[1] || c.IP != "192.0.2.9" || c.DetectedAt.IsZero() {
+		t.Errorf("expected the reuse of %v from 192.0.2.9 to be recorded, got %+v", jtis[1], c)
+	}
+
+	// a new login starts a new family
+	pair, err = a.LoginContext(ctx, "alice", "password123", stores.DeviceInfo{IP: "10.0.0.3"})
+	if err != nil {
+		t.Fatalf("failed to log in again: %v", err)
+	}
+	if _, err := a.RefreshTokens(ctx, token.RefreshTokensRequest{RefreshToken: pair.RefreshToken}); err != nil {
+		t.Errorf("expected the refresh token of a new login to work, got %v", err)
+	}
+	if families, err := a.TokenFamilies("alice"); err != nil || len(families) != 2 || families[1].Compromise != nil {
+		t.Errorf("expected a second, sound family, got %+v (%v)", families, err)
+	}
+}
+
+func TestTokenFamiliesLegacyToken(t *testing.T) {
+	a := setupAuthify().WithTokenFamilies(stores.NewInMemorySessionStore())
+
+	// tokens issued before rotation was enabled carry no jti, they are refreshed as they are
+	refreshToken, err := a.Tokens.GenerateRefreshToken("alice", token.RequestData(stores.DeviceInfo{}, ""))
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+	for range 2 {
+		pair, err := a.RefreshTokens(context.Background(), token.RefreshTokensRequest{RefreshToken: refreshToken})
+		if err != nil {
+			t.Fatalf("expected a legacy refresh token to be refreshed, got %v", err)
+		}
+		if pair.RefreshToken != refreshToken {
+			t.Errorf("expected a legacy refresh token to be returned as is")
+		}
+	}
+}
+
+func TestTokenFamiliesConcurrentRefresh(t *testing.T) {
+	jwtAuthify := setupAuthify()
+	opaqueAuthify := NewAuthify(jwtAuthify.Store, token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour).WithStore(jwtAuthify.Store))
+
+	for name, a := range map[string]*Authify{"jwt": jwtAuthify, "opaque": opaqueAuthify} {
+		t.Run(name, func(t *testing.T) {
+			a.WithTokenFamilies(stores.NewInMemorySessionStore())
+			ctx := context.Background()
+			pair, err := a.LoginContext(ctx, "alice", "password123", stores.DeviceInfo{})
+			if err != nil {
+				t.Fatalf("failed to log in: %v", err)
+			}
+
+			// the requests of a browser tab whose access token just expired
+			const refreshes = 5
+			pairs := make([]*TokenPair, refreshes)
+			errs := make([]error, refreshes)
+			var wg sync.WaitGroup
+			for i := range refreshes {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					pairs[i], errs[i] = a.RefreshTokens(ctx, token.RefreshTokensRequest{AccessToken: pair.AccessToken, RefreshToken: pair.RefreshToken})
+				}()
+			}
+			wg.Wait()
+			// and one arriving within the grace window
+			late, err := a.RefreshTokens(ctx, token.RefreshTokensRequest{AccessToken: pair.AccessToken, RefreshToken: pair.RefreshToken})
+			if err != nil {
+				t.Fatalf("expected a refresh within the grace window to succeed, got %v", err)
+			}
+
+			for i, err := range errs {
+				if err != nil {
+					t.Fatalf("refresh %d failed: %v", i, err)
+				}
+				if pairs[i].AccessToken != late.AccessToken || pairs[i].RefreshToken != late.RefreshToken {
+					t.Errorf("refresh %d: expected the pair of the single rotation, got %+v and %+v", i, pairs[i], late)
+				}
+			}
+			families, err := a.TokenFamilies("alice")
+			if err != nil || len(families) != 1 {
+				t.Fatalf("expected the family of the login, got %+v (%v)", families, err)
+			}
+			if family := families[0]; len(family.Tokens) != 2 || family.Compromise != nil {
+				t.Errorf("expected a single rotation and no compromise, got %+v", family)
+			}
+			if _, err := a.RefreshTokens(ctx, token.RefreshTokensRequest{RefreshToken: late.RefreshToken}); err != nil {
+				t.Errorf("expected the rotated refresh token to work, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package federation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"golang.org/x/oauth2"
+)
+
+// DefaultScopes are requested by code flows without scopes of their own, besides openid
+var DefaultScopes = []string{"email", "profile"}
+
+// CodeFlow signs users in through the OAuth2 authorization code flow of an OpenID Connect
+// provider: Start redirects them to the provider, which sends them back to the redirect URL with
+// a code, exchanged by Finish for an ID token validated like the ones of ExchangeIDTokenFrom.
+// The authorization and token endpoints are discovered from the issuer of the federator.
+type CodeFlow struct {
+	federator    *OIDCFederator
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+}
+
+// LoginSession is what a login started by CodeFlow.Start must remember until its callback,
+// typically in a cookie of the browser: the state sent back by the provider, the nonce of the
+// ID token and the PKCE verifier of the code.
+type LoginSession struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewCodeFlow returns the authorization code flow of the issuer of f, authenticating as the
+// client ID of f with clientSecret. redirectURL is the callback registered with the provider,
+// scopes are requested besides openid, DefaultScopes when none are given.
+func NewCodeFlow(f *OIDCFederator, clientSecret, redirectURL string, scopes ...string) *CodeFlow {
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	return &CodeFlow{
+		federator:    f,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		scopes:       append([]string{"openid"}, scopes...),
+	}
+}
+
+// NewCodeFlowFromConfig returns the code flow of a provider of Config.Providers, signing its users in to auth.
+func NewCodeFlowFromConfig(cfg Config, auth *authify.Authify) (*CodeFlow, error) {
+	f, err := NewOIDCFederator(cfg.Issuer, cfg.ClientID, auth, cfg.Options()...)
+	if err != nil {
+		return nil, err
+	}
+	return NewCodeFlow(f, cfg.ClientSecret.Reveal(), cfg.RedirectURL, cfg.Scopes...), nil
+}
+
+// Start returns the URL of the provider to redirect the user to, and the session to keep until
+// the callback. It fails when the discovery document of the issuer cannot be fetched.
+func (c *CodeFlow) Start(ctx context.Context) (string, LoginSession, error) {
+	config, err := c.config(ctx)
+	if err != nil {
+		return "", LoginSession{}, err
+	}
+	state, err := randomToken()
+	if err != nil {
+		return "", LoginSession{}, err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", LoginSession{}, err
+	}
+	session := LoginSession{State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier()}
+	url := config.AuthCodeURL(state, oauth2.S256ChallengeOption(session.Verifier), oauth2.SetAuthURLParam("nonce", nonce))
+	return url, session, nil
+}
+
+// Finish exchanges the code the provider sent back with state for an ID token and issues the
+// tokens of its user, provisioned on their first sign in with WithAutoProvision. A state or a
+// nonce other than the ones of session, or a code the provider refuses, fail with
+// authify.ErrFederatedLoginFailed, an invalid ID token with authify.ErrInvalidIDToken.
+func (c *CodeFlow) Finish(ctx context.Context, session LoginSession, state, code string, device stores.DeviceInfo) (*authify.TokenPair, error) {
+	if session.State == "" || subtle.ConstantTimeCompare([]byte(state), []byte(session.State)) != 1 {
+		return nil, fmt.Errorf("%w: the state is not the one of the login", authify.ErrFederatedLoginFailed)
+	}
+	if code == "" {
+		return nil, fmt.Errorf("%w: no authorization code", authify.ErrFederatedLoginFailed)
+	}
+	config, err := c.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.federator.client)
+	tok, err := config.Exchange(ctx, code, oauth2.VerifierOption(session.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", authify.ErrFederatedLoginFailed, err)
+	}
+	idToken, _ := tok.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, fmt.Errorf("%w: the token response has no id_token", authify.ErrFederatedLoginFailed)
+	}
+	claims, err := c.federator.verify(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(session.Nonce)) != 1 {
+		return nil, fmt.Errorf("%w: the nonce is not the one of the login", authify.ErrInvalidIDToken)
+	}
+	return c.federator.signIn(ctx, claims, device)
+}
+
+// config returns the OAuth2 config of the client, with the endpoints of the discovery document
+func (c *CodeFlow) config(ctx context.Context) (*oauth2.Config, error) {
+	doc, err := c.federator.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return nil, fmt.Errorf("discovery document of %s names no authorization or token endpoint", c.federator.issuer)
+	}
+	return &oauth2.Config{
+		ClientID:     c.federator.clientID,
+		ClientSecret: c.clientSecret,
+		Endpoint:     oauth2.Endpoint{AuthURL: doc.AuthorizationEndpoint, TokenURL: doc.TokenEndpoint},
+		RedirectURL:  c.redirectURL,
+		Scopes:       c.scopes,
+	}, nil
+}
+
+// randomToken returns 32 random bytes, base64url encoded, which no one can guess
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,101 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestCodeFlow(t *testing.T) {
+	ctx := context.Background()
+	issuer := newTestIssuer(t)
+	auth := newTestAuthify(t)
+	flow, err := NewCodeFlowFromConfig(Config{
+		Name:          "test",
+		Issuer:        issuer.URL,
+		ClientID:      "client-1",
+		ClientSecret:  "secret-1",
+		RedirectURL:   "https://app.example.com/auth/test/callback",
+		AutoProvision: true,
+		DefaultRole:   "viewer",
+	}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, session, err := flow.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := issuer.authorize(t, authURL, "carol@example.com", nil)
+	pair, err := flow.Finish(ctx, session, state, code, stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("expected the code to be exchanged, got %v", err)
+	}
+	claims, err := auth.Tokens.VerifyAccessToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["username"] != "carol@example.com" || claims["role"] != "viewer" {
+		t.Errorf("expected carol to be provisioned with the default role, got %v", claims)
+	}
+
+	// the user signs in again as the existing user
+	authURL, session, _ = flow.Start(ctx)
+	code, state = issuer.authorize(t, authURL, "carol@example.com", nil)
+	if _, err := flow.Finish(ctx, session, state, code, stores.DeviceInfo{}); err != nil {
+		t.Fatalf("expected the second login to succeed, got %v", err)
+	}
+	if count, _ := auth.Store.(*stores.InMemoryUserStore).CountUsers(); count != 1 {
+		t.Errorf("expected a single user, got %d", count)
+	}
+}
+
+func TestCodeFlowRejects(t *testing.T) {
+	ctx := context.Background()
+	issuer := newTestIssuer(t)
+	auth := newTestAuthify(t)
+	f, err := NewOIDCFederator(issuer.URL, "client-1", auth, WithAutoProvision(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow := NewCodeFlow(f, "secret-1", "https://app.example.com/auth/test/callback")
+
+	tests := []struct {
+		name string
+		// tamper changes the session, state and code the callback receives
+		tamper func(session *LoginSession, state, code *string)
+		claims jwt.MapClaims
+		want   error
+	}{
+		{"other state", func(s *LoginSession, state, code *string) { *state = "forged" }, nil, authify.ErrFederatedLoginFailed},
+		{"no session", func(s *LoginSession, state, code *string) { *s = LoginSession{} }, nil, authify.ErrFederatedLoginFailed},
+		{"other verifier", func(s *LoginSession, state, code *string) {
+			s.Verifier = "stolen-code-used-without-the-verifier-of-the-login"
+		}, nil, authify.ErrFederatedLoginFailed},
+		{"unknown code", func(s *LoginSession, state, code *string) { *code = "code-unknown" }, nil, authify.ErrFederatedLoginFailed},
+		{"no code", func(s *LoginSession, state, code *string) { *code = "" }, nil, authify.ErrFederatedLoginFailed},
+		{"replayed ID token", func(s *LoginSession, state, code *string) {}, jwt.MapClaims{"nonce": "of-another-login"}, authify.ErrInvalidIDToken},
+		{"unverified email", func(s *LoginSession, state, code *string) {}, jwt.MapClaims{"email_verified": false}, authify.ErrInvalidIDToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authURL, session, err := flow.Start(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, state := issuer.authorize(t, authURL, "mallory@example.com", tt.claims)
+			tt.tamper(&session, &state, &code)
+			if _, err := flow.Finish(ctx, session, state, code, stores.DeviceInfo{}); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+	if count, _ := auth.Store.(*stores.InMemoryUserStore).CountUsers(); count != 0 {
+		t.Errorf("expected no user to be provisioned, got %d", count)
+	}
+}
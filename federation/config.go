@@ -0,0 +1,100 @@
+package federation
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HassanAli101/authify/secrets"
+)
+
+// Config is the federation section operators configure in YAML, see lib.LoadFederationConfig
+// and config-examples/federation.yml.
+type Config struct {
+	// Name identifies a provider in the paths of its login routes, e.g. google serves
+	// /auth/google/login and /auth/google/callback. Required for the providers.
+	Name string `yaml:"name"`
+	// Issuer is the URL of the identity provider, e.g. https://accounts.google.com,
+	// its keys are discovered from Issuer + "/.well-known/openid-configuration"
+	Issuer string `yaml:"issuer"`
+	// ClientID is the audience ID tokens must be issued to
+	ClientID string `yaml:"client_id"`
+	// JWKSURL skips the discovery of the keys of the issuer
+	JWKSURL string `yaml:"jwks_url"`
+	// JWKSCacheTTL is how long fetched keys are used before being fetched again, DefaultJWKSCacheTTL by default
+	JWKSCacheTTL time.Duration `yaml:"jwks_cache_ttl"`
+	// AutoProvision creates the users signing in for the first time, with DefaultRole
+	AutoProvision bool   `yaml:"auto_provision"`
+	DefaultRole   string `yaml:"default_role"`
+	// Claims maps claims of the ID token to the columns of the users they fill, one of them must
+	// be the identifier column. Without it, the email claim is the identifier.
+	Claims map[string]string `yaml:"claims"`
+
+	// ClientSecret and RedirectURL enable the authorization code flow of the provider, see
+	// NewCodeFlow. RedirectURL is the callback route as the provider redirects browsers to it.
+	ClientSecret secrets.SecretString `yaml:"client_secret"`
+	RedirectURL  string               `yaml:"redirect_url"`
+	// Scopes requested besides openid, DefaultScopes when empty
+	Scopes []string `yaml:"scopes"`
+
+	// Providers users sign in with through the authorization code flow, besides the issuer
+	// above, whose ID tokens are exchanged directly
+	Providers []Config `yaml:"providers"`
+}
+
+// Validate checks that the issuer and client ID are set, unless only providers are configured,
+// and that every provider has a unique name and the settings of the authorization code flow.
+func (c Config) Validate() error {
+	if c.Issuer != "" || len(c.Providers) == 0 {
+		if err := c.validateIssuer(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for i, p := range c.Providers {
+		if p.Name == "" {
+			return fmt.Errorf("federation provider %d has no name", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("federation provider %s is configured twice", p.Name)
+		}
+		names[p.Name] = true
+		if len(p.Providers) > 0 {
+			return fmt.Errorf("federation provider %s must not have providers", p.Name)
+		}
+		if err := p.validateIssuer(); err != nil {
+			return fmt.Errorf("provider %s: %w", p.Name, err)
+		}
+		if p.ClientSecret == "" || p.RedirectURL == "" {
+			return fmt.Errorf("provider %s: federation client_secret and redirect_url are required", p.Name)
+		}
+	}
+	return nil
+}
+
+func (c Config) validateIssuer() error {
+	if c.Issuer == "" {
+		return fmt.Errorf("federation issuer is required")
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("federation client_id is required")
+	}
+	if c.JWKSCacheTTL < 0 {
+		return fmt.Errorf("federation jwks_cache_ttl must not be negative, got %s", c.JWKSCacheTTL)
+	}
+	return nil
+}
+
+// Options returns the options configuring a federator like c, see NewOIDCFederator.
+func (c Config) Options() []Option {
+	opts := []Option{WithClaimMapping(c.Claims)}
+	if c.JWKSURL != "" {
+		opts = append(opts, WithJWKSURL(c.JWKSURL))
+	}
+	if c.JWKSCacheTTL > 0 {
+		opts = append(opts, WithJWKSCacheTTL(c.JWKSCacheTTL))
+	}
+	if c.AutoProvision {
+		opts = append(opts, WithAutoProvision(c.DefaultRole))
+	}
+	return opts
+}
@@ -0,0 +1,310 @@
+// Package federation lets users sign in with an external OpenID Connect identity provider,
+// such as Google: the ID token it issued is validated and exchanged for the tokens of authify.
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Defaults of the options of NewOIDCFederator
+const (
+	DefaultJWKSCacheTTL = time.Hour
+	// DefaultJWKSRefreshInterval is the minimum wait between two fetches of the keys
+	// caused by ID tokens signed with an unknown key
+	DefaultJWKSRefreshInterval = 10 * time.Second
+	// DefaultLeeway tolerates that much clock skew with the identity provider
+	DefaultLeeway = 30 * time.Second
+
+	// ClaimEmail is the claim identifying users when no claim is mapped to the identifier column
+	ClaimEmail = "email"
+	// ClaimEmailVerified is checked whenever the email claim is mapped: ID tokens identifying
+	// users by email must have it set to true, others are only rejected when it is false
+	ClaimEmailVerified = "email_verified"
+
+	defaultTimeout = 10 * time.Second
+)
+
+// signingMethods are the algorithms ID tokens may be signed with, all asymmetric
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// OIDCFederator validates the ID tokens of an OpenID Connect issuer and signs their users in.
+type OIDCFederator struct {
+	issuer        string
+	clientID      string
+	auth          *authify.Authify
+	client        *http.Client
+	jwksURL       string
+	claims        map[string]string
+	autoProvision bool
+	defaultRole   string
+	leeway        time.Duration
+	now           func() time.Time
+	keys          *keySet
+
+	// discovered is the discovery document of the issuer, fetched once
+	discoverMu sync.Mutex
+	discovered *discovery
+}
+
+// discovery is the part of the discovery document of an issuer authify uses
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	JWKSURI               string `json:"jwks_uri"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// Option customizes the federator built by NewOIDCFederator.
+type Option func(*OIDCFederator)
+
+// WithHTTPClient fetches the discovery document and the keys of the issuer with client,
+// a client with a 10s timeout by default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(f *OIDCFederator) {
+		f.client = client
+	}
+}
+
+// WithJWKSURL fetches the keys of the issuer from url instead of the jwks_uri of its discovery document.
+func WithJWKSURL(url string) Option {
+	return func(f *OIDCFederator) {
+		f.jwksURL = url
+	}
+}
+
+// WithJWKSCacheTTL sets how long the keys of the issuer are used before being fetched again,
+// DefaultJWKSCacheTTL by default.
+func WithJWKSCacheTTL(ttl time.Duration) Option {
+	return func(f *OIDCFederator) {
+		f.keys.ttl = ttl
+	}
+}
+
+// WithJWKSRefreshInterval sets the minimum wait between two fetches of the keys caused by ID
+// tokens signed with a key the federator does not know, DefaultJWKSRefreshInterval by default.
+func WithJWKSRefreshInterval(d time.Duration) Option {
+	return func(f *OIDCFederator) {
+		f.keys.refreshInterval = d
+	}
+}
+
+// WithClaimMapping fills the columns of users with claims of their ID tokens, claims map to
+// columns. The claim mapped to the identifier column of the store identifies the user, the email
+// claim is mapped to it when none is. The other columns are only filled when users are provisioned.
+func WithClaimMapping(claims map[string]string) Option {
+	return func(f *OIDCFederator) {
+		for claim, column := range claims {
+			f.claims[claim] = column
+		}
+	}
+}
+
+// WithAutoProvision creates the users signing in for the first time, with their mapped claims,
+// role defaultRole unless empty, and a random password, so they can only sign in through the
+// identity provider until they set one. Without it, unknown users fail with ErrUserNotFound.
+func WithAutoProvision(defaultRole string) Option {
+	return func(f *OIDCFederator) {
+		f.autoProvision = true
+		f.defaultRole = defaultRole
+	}
+}
+
+// WithLeeway tolerates d of clock skew when checking the expiry of ID tokens, DefaultLeeway by default.
+func WithLeeway(d time.Duration) Option {
+	return func(f *OIDCFederator) {
+		f.leeway = d
+	}
+}
+
+// NewOIDCFederator returns a federator accepting the ID tokens issued by issuerURL to clientID,
+// whose users sign in to auth. The keys of the issuer are discovered and fetched on first use.
+// It fails when issuerURL or clientID is empty, claims are mapped to unknown columns, or no
+// claim identifies users.
+func NewOIDCFederator(issuerURL, clientID string, auth *authify.Authify, opts ...Option) (*OIDCFederator, error) {
+	if issuerURL == "" || clientID == "" {
+		return nil, errors.New("an issuer URL and a client ID are required")
+	}
+	f := &OIDCFederator{
+		issuer:   strings.TrimSuffix(issuerURL, "/"),
+		clientID: clientID,
+		auth:     auth,
+		client:   &http.Client{Timeout: defaultTimeout},
+		claims:   make(map[string]string),
+		leeway:   DefaultLeeway,
+		now:      time.Now,
+	}
+	f.keys = &keySet{ttl: DefaultJWKSCacheTTL, refreshInterval: DefaultJWKSRefreshInterval, url: f.keysURL}
+	for _, opt := range opts {
+		opt(f)
+	}
+	f.keys.client, f.keys.now = f.client, func() time.Time { return f.now() }
+
+	cfg := auth.Store.StoreConfig()
+	for claim, column := range f.claims {
+		if _, ok := cfg.Columns[column]; !ok {
+			return nil, fmt.Errorf("claim %s is mapped to %s, which is not a column of the store", claim, column)
+		}
+	}
+	identifier := cfg.IdentifierColumn()
+	if f.identifierClaim() == "" {
+		if _, mapped := f.claims[ClaimEmail]; mapped {
+			return nil, fmt.Errorf("no claim is mapped to the identifier column %s", identifier)
+		}
+		f.claims[ClaimEmail] = identifier
+	}
+	return f, nil
+}
+
+// identifierClaim returns the claim mapped to the identifier column
+func (f *OIDCFederator) identifierClaim() string {
+	identifier := f.auth.Store.StoreConfig().IdentifierColumn()
+	for claim, column := range f.claims {
+		if column == identifier {
+			return claim
+		}
+	}
+	return ""
+}
+
+// ExchangeIDToken is ExchangeIDTokenFrom without a device.
+func (f *OIDCFederator) ExchangeIDToken(ctx context.Context, idToken string) (*authify.TokenPair, error) {
+	return f.ExchangeIDTokenFrom(ctx, idToken, stores.DeviceInfo{})
+}
+
+// ExchangeIDTokenFrom validates idToken, signed by a key of the issuer, issued by it to the
+// client ID and not expired, and issues the tokens of its user, see authify.Authify.LoginAuthenticated.
+// Invalid ID tokens fail with authify.ErrInvalidIDToken. Users are provisioned on their first
+// sign in with WithAutoProvision, they fail with authify.ErrUserNotFound otherwise.
+func (f *OIDCFederator) ExchangeIDTokenFrom(ctx context.Context, idToken string, device stores.DeviceInfo) (*authify.TokenPair, error) {
+	claims, err := f.verify(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+	return f.signIn(ctx, claims, device)
+}
+
+// signIn issues the tokens of the user of verified ID token claims, provisioning it if need be
+func (f *OIDCFederator) signIn(ctx context.Context, claims jwt.MapClaims, device stores.DeviceInfo) (*authify.TokenPair, error) {
+	userData, err := f.userData(claims)
+	if err != nil {
+		return nil, err
+	}
+	identifier := f.auth.Store.StoreConfig().IdentifierColumn()
+	username, _ := userData[identifier].(string)
+
+	pair, err := f.auth.LoginAuthenticated(ctx, username, device)
+	if !errors.Is(err, stores.ErrUserNotFound) || !f.autoProvision {
+		return pair, err
+	}
+	if err := f.provision(ctx, userData); err != nil && !errors.Is(err, stores.ErrUserExists) {
+		return nil, fmt.Errorf("failed to provision federated user: %w", err)
+	}
+	return f.auth.LoginAuthenticated(ctx, username, device)
+}
+
+// verify checks the signature, issuer, audience and expiry of idToken, returning its claims
+func (f *OIDCFederator) verify(ctx context.Context, idToken string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return f.keys.key(ctx, kid)
+	},
+		jwt.WithValidMethods(signingMethods),
+		jwt.WithIssuer(f.issuer),
+		jwt.WithAudience(f.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(f.leeway),
+		jwt.WithTimeFunc(f.now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", authify.ErrInvalidIDToken, err)
+	}
+	return claims, nil
+}
+
+// userData maps the claims to the columns of the user, all of them strings
+func (f *OIDCFederator) userData(claims jwt.MapClaims) (map[string]any, error) {
+	identifier := f.auth.Store.StoreConfig().IdentifierColumn()
+	userData := make(map[string]any, len(f.claims))
+	for claim, column := range f.claims {
+		val, ok := claims[claim]
+		if !ok {
+			continue
+		}
+		if claim == ClaimEmail {
+			// an email identifying users must be verified, whoever controls an unverified one
+			// would otherwise sign in as its owner
+			verified, isBool := claims[ClaimEmailVerified].(bool)
+			if !verified && (isBool || column == identifier) {
+				return nil, fmt.Errorf("%w: the email of the ID token is not verified", authify.ErrInvalidIDToken)
+			}
+		}
+		userData[column] = fmt.Sprint(val)
+	}
+	if username, _ := userData[identifier].(string); username == "" {
+		return nil, fmt.Errorf("%w: the %s claim is missing", authify.ErrInvalidIDToken, f.identifierClaim())
+	}
+	return userData, nil
+}
+
+// provision creates the user of userData, with the default role and a random password
+func (f *OIDCFederator) provision(ctx context.Context, userData map[string]any) error {
+	cfg := f.auth.Store.StoreConfig()
+	if f.defaultRole != "" {
+		userData[cfg.RoleColumn()] = f.defaultRole
+	}
+	if column := cfg.PasswordColumn(); column != "" {
+		password, err := randomToken()
+		if err != nil {
+			return err
+		}
+		userData[column] = password
+	}
+	_, err := f.auth.CreateUser(ctx, userData)
+	return err
+}
+
+// keysURL returns the JWKS URL set with WithJWKSURL, or the jwks_uri of the discovery document
+func (f *OIDCFederator) keysURL(ctx context.Context) (string, error) {
+	if f.jwksURL != "" {
+		return f.jwksURL, nil
+	}
+	doc, err := f.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	if doc.JWKSURI == "" {
+		return "", fmt.Errorf("discovery document of %s names no jwks_uri", f.issuer)
+	}
+	return doc.JWKSURI, nil
+}
+
+// discover fetches the discovery document of the issuer, once it succeeds
+func (f *OIDCFederator) discover(ctx context.Context) (*discovery, error) {
+	f.discoverMu.Lock()
+	defer f.discoverMu.Unlock()
+	if f.discovered != nil {
+		return f.discovered, nil
+	}
+
+	var doc discovery
+	if err := getJSON(ctx, f.client, f.issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != f.issuer {
+		return nil, fmt.Errorf("discovery document of %s names issuer %q", f.issuer, doc.Issuer)
+	}
+	f.discovered = &doc
+	return f.discovered, nil
+}
@@ -0,0 +1,294 @@
+package federation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testStoreConfig = stores.StoreConfig{
+	Name: "users",
+	Columns: map[string]stores.ColumnConfig{
+		"username": {Type: "text", Required: true, PrimaryKey: true},
+		"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+		"role":     {Type: "text", Default: "user"},
+	},
+}
+
+// testIssuer is a fake OpenID Connect provider serving its discovery document and keys
+type testIssuer struct {
+	*httptest.Server
+	key        *rsa.PrivateKey
+	kid        string
+	keyFetches atomic.Int32
+
+	// codes are the ID tokens of the authorization codes issued by authorize, with their PKCE challenge
+	codesMu sync.Mutex
+	codes   map[string]issuedCode
+}
+
+type issuedCode struct {
+	idToken   string
+	challenge string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key, kid: "key-1", codes: make(map[string]issuedCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"jwks_uri":               issuer.URL + "/keys",
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		issuer.codesMu.Lock()
+		code, ok := issuer.codes[r.PostFormValue("code")]
+		delete(issuer.codes, r.PostFormValue("code"))
+		issuer.codesMu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if clientID != "client-1" || clientSecret != "secret-1" || !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "provider-token", "token_type": "Bearer", "id_token": code.idToken})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		issuer.keyFetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": issuer.kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// idToken signs an ID token of the issuer for email, with claims overriding the defaults
+func (i *testIssuer) idToken(t *testing.T, kid, email string, claims jwt.MapClaims) string {
+	t.Helper()
+	all := jwt.MapClaims{
+		"iss":            i.URL,
+		"aud":            "client-1",
+		"sub":            "1234",
+		"email":          email,
+		"email_verified": true,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+	for name, val := range claims {
+		all[name] = val
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, all)
+	tok.Header["kid"] = kid
+	signed, err := tok.SignedString(i.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// authorize signs email in at the authorization URL of a login, returning the code and state
+// the provider sends back to the callback. claims override the defaults of the ID token.
+func (i *testIssuer) authorize(t *testing.T, authURL, email string, claims jwt.MapClaims) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != "client-1" || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	all := jwt.MapClaims{"nonce": query.Get("nonce")}
+	for name, val := range claims {
+		all[name] = val
+	}
+	i.codesMu.Lock()
+	code = fmt.Sprintf("code-%d", len(i.codes))
+	i.codes[code] = issuedCode{idToken: i.idToken(t, i.kid, email, all), challenge: query.Get("code_challenge")}
+	i.codesMu.Unlock()
+	return code, query.Get("state")
+}
+
+func newTestAuthify(t *testing.T) *authify.Authify {
+	t.Helper()
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	tokens, err := token.NewJWTManager().
+		WithConfig(&token.TokenConfig{
+			AccessToken: token.AccessTokenConfig{
+				Duration:      time.Minute,
+				SigningMethod: "HS256",
+				Claims: map[string]token.ClaimConfig{
+					"username": {Source: "db", Column: "username", IsIdentifier: true},
+					"role":     {Source: "db", Column: "role"},
+				},
+			},
+			RefreshToken: token.RefreshTokenConfig{
+				Duration: time.Hour,
+				Claims: map[string]token.ClaimConfig{
+					"username": {Source: "db", Column: "username", IsIdentifier: true},
+				},
+			},
+		}).
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(store).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	return authify.NewAuthify(store, tokens)
+}
+
+func TestExchangeIDToken(t *testing.T) {
+	ctx := context.Background()
+	issuer := newTestIssuer(t)
+	auth := newTestAuthify(t)
+	if _, err := auth.CreateUser(ctx, map[string]any{"username": "alice@example.com", "password": "password123"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewOIDCFederator(issuer.URL, "client-1", auth, WithJWKSRefreshInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := f.ExchangeIDToken(ctx, issuer.idToken(t, issuer.kid, "alice@example.com", nil))
+	if err != nil {
+		t.Fatalf("expected the ID token to be exchanged, got %v", err)
+	}
+	claims, err := auth.Tokens.VerifyAccessToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["username"] != "alice@example.com" {
+		t.Errorf("expected the token of alice, got %v", claims["username"])
+	}
+
+	tests := []struct {
+		name    string
+		idToken string
+		want    error
+	}{
+		{"wrong audience", issuer.idToken(t, issuer.kid, "alice@example.com", jwt.MapClaims{"aud": "client-2"}), authify.ErrInvalidIDToken},
+		{"wrong issuer", issuer.idToken(t, issuer.kid, "alice@example.com", jwt.MapClaims{"iss": "https://evil.example.com"}), authify.ErrInvalidIDToken},
+		{"expired", issuer.idToken(t, issuer.kid, "alice@example.com", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), authify.ErrInvalidIDToken},
+		{"unverified email", issuer.idToken(t, issuer.kid, "alice@example.com", jwt.MapClaims{"email_verified": false}), authify.ErrInvalidIDToken},
+		{"email not known to be verified", issuer.idToken(t, issuer.kid, "alice@example.com", jwt.MapClaims{"email_verified": nil}), authify.ErrInvalidIDToken},
+		{"email verified as a string", issuer.idToken(t, issuer.kid, "alice@example.com", jwt.MapClaims{"email_verified": "true"}), authify.ErrInvalidIDToken},
+		{"unknown key", issuer.idToken(t, "key-2", "alice@example.com", nil), authify.ErrInvalidIDToken},
+		{"unknown user", issuer.idToken(t, issuer.kid, "bob@example.com", nil), stores.ErrUserNotFound},
+		{"not a token", "not-a-token", authify.ErrInvalidIDToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := f.ExchangeIDToken(ctx, tt.idToken); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestExchangeIDTokenRefetchesKeys(t *testing.T) {
+	ctx := context.Background()
+	issuer := newTestIssuer(t)
+	auth := newTestAuthify(t)
+	if _, err := auth.CreateUser(ctx, map[string]any{"username": "alice@example.com", "password": "password123"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewOIDCFederator(issuer.URL, "client-1", auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ExchangeIDToken(ctx, issuer.idToken(t, issuer.kid, "alice@example.com", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider rotated its key: the keys are fetched again for the unknown kid
+	issuer.kid = "key-2"
+	f.now = func() time.Time { return time.Now().Add(DefaultJWKSRefreshInterval) }
+	if _, err := f.ExchangeIDToken(ctx, issuer.idToken(t, "key-2", "alice@example.com", nil)); err != nil {
+		t.Fatalf("expected the rotated key to be fetched, got %v", err)
+	}
+	if got := issuer.keyFetches.Load(); got != 2 {
+		t.Fatalf("expected 2 fetches of the keys, got %d", got)
+	}
+
+	// other unknown kids do not fetch them again before the refresh interval
+	if _, err := f.ExchangeIDToken(ctx, issuer.idToken(t, "key-3", "alice@example.com", nil)); !errors.Is(err, authify.ErrInvalidIDToken) {
+		t.Errorf("expected ErrInvalidIDToken, got %v", err)
+	}
+	if got := issuer.keyFetches.Load(); got != 2 {
+		t.Errorf("expected no fetch within the refresh interval, got %d fetches", got)
+	}
+}
+
+func TestExchangeIDTokenAutoProvision(t *testing.T) {
+	ctx := context.Background()
+	issuer := newTestIssuer(t)
+	auth := newTestAuthify(t)
+	f, err := NewOIDCFederator(issuer.URL, "client-1", auth, WithAutoProvision("viewer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idToken := issuer.idToken(t, issuer.kid, "carol@example.com", nil)
+	for range 2 {
+		if _, err := f.ExchangeIDToken(ctx, idToken); err != nil {
+			t.Fatalf("expected the user to be provisioned, got %v", err)
+		}
+	}
+	user, err := auth.Store.(stores.UserGetter).GetUserByUsername("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user["role"] != "viewer" {
+		t.Errorf("expected the default role, got %v", user["role"])
+	}
+}
+
+func TestNewOIDCFederatorValidatesClaims(t *testing.T) {
+	auth := newTestAuthify(t)
+	if _, err := NewOIDCFederator("", "client-1", auth); err == nil {
+		t.Error("expected an error without issuer")
+	}
+	if _, err := NewOIDCFederator("https://issuer.example.com", "client-1", auth, WithClaimMapping(map[string]string{"name": "display_name"})); err == nil {
+		t.Error("expected an error for a claim mapped to an unknown column")
+	}
+	if _, err := NewOIDCFederator("https://issuer.example.com", "client-1", auth, WithClaimMapping(map[string]string{"email": "role"})); err == nil {
+		t.Error("expected an error when no claim is mapped to the identifier column")
+	}
+}
@@ -0,0 +1,61 @@
+package authify
+
+import (
+	"strings"
+	"testing"
+)
+
+// Seed inputs found while hardening the parsers live in testdata/fuzz,
+// `go test` replays them on every run, `go test -fuzz FuzzVerifyToken` explores further.
+
+func FuzzVerifyToken(f *testing.F) {
+	a := setupAuthify()
+	access, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		f.Fatalf("failed to generate access token: %v", err)
+	}
+	f.Add(access)
+	f.Add("")
+	f.Add("a.b.c")
+	f.Add(strings.Repeat("a", 10000))
+
+	f.Fuzz(func(t *testing.T, tokenStr string) {
+		claims, err := a.Tokens.VerifyAccessToken(tokenStr)
+		if err == nil && claims == nil {
+			t.Errorf("verified %q without returning claims", tokenStr)
+		}
+		if _, err := a.Tokens.VerifyRefreshToken(tokenStr); err == nil && tokenStr == access {
+			t.Errorf("access token verified as a refresh token")
+		}
+	})
+}
+
+func FuzzRefreshToken(f *testing.F) {
+	a := setupAuthify()
+	access, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		f.Fatalf("failed to generate access token: %v", err)
+	}
+	refreshData := map[string]any{"ip": "127.0.0.1", "user_agent": "fuzz"}
+	refresh, err := a.Tokens.GenerateRefreshToken("alice", refreshData)
+	if err != nil {
+		f.Fatalf("failed to generate refresh token: %v", err)
+	}
+	f.Add(access, refresh)
+	f.Add("", refresh)
+	f.Add(access, "")
+	f.Add("a.b.c", refresh)
+
+	f.Fuzz(func(t *testing.T, accessStr, refreshStr string) {
+		_, claims, err := a.Tokens.RefreshToken(accessStr, refreshStr, refreshData)
+		if err != nil {
+			return
+		}
+		if claims["username"] != "alice" {
+			t.Errorf("refreshed a token for unexpected user %v", claims["username"])
+		}
+		if claims["role"] != nil && claims["role"] != "user" {
+			t.Errorf("refreshed a token with unexpected role %v", claims["role"])
+		}
+	})
+}
@@ -0,0 +1,45 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/HassanAli101/authify"
+)
+
+// capabilities returns the features enabled by the options of the router: the ones of the
+// Authify instance, the routes served unless turned off, and the ones turned on by options,
+// less the ones of WithoutFeatures
+func (h *handler) capabilities() *authify.Capabilities {
+	caps := authify.NewCapabilities(h.auth)
+	caps.Enable(authify.FeatureOAuth, authify.FeatureIntrospection, authify.FeatureTokenExchange, authify.FeatureUserExists)
+
+	optional := map[authify.Feature]bool{
+		authify.FeatureChallengeLogin:    h.opts.challengeLogin,
+		authify.FeatureFederatedLogin:    h.opts.federator != nil,
+		authify.FeatureAuthorizationCode: len(h.opts.codeFlows) > 0,
+		authify.FeatureSecretRotation:    h.opts.secretRotation,
+		authify.FeatureIdempotency:       h.opts.idempotency != nil,
+		authify.FeatureGateway:           h.opts.gateway != nil,
+		authify.FeatureLegacyRoutes:      h.opts.legacyRoutes,
+		authify.FeatureSignupChallenge:   h.opts.signupChallenge != nil,
+	}
+	for feature, on := range optional {
+		if on {
+			caps.Enable(feature)
+		}
+	}
+	caps.Disable(h.opts.disabledFeatures...)
+	return caps
+}
+
+// configuration handles the "GET /.well-known/authify-configuration" route.
+// It responds with the capabilities document of the router, see authify.Configuration, listing
+// the routes it serves relative to its path prefix, so clients can tell what the deployment
+// supports without probing its routes.
+func (h *handler) configuration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.caps.Document()); err != nil {
+		logf(r.Context(), "Error writing configuration response: %v\n", err)
+	}
+}
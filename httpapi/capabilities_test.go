@@ -0,0 +1,154 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// fetchConfiguration returns the capabilities document of router
+func fetchConfiguration(t *testing.T, router http.Handler) authify.Configuration {
+	t.Helper()
+	rec := doRequest(router, http.MethodGet, "/.well-known/authify-configuration", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the capabilities document, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var doc authify.Configuration
+	if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+		t.Fatalf("failed to decode the capabilities document: %v", err)
+	}
+	return doc
+}
+
+func TestCapabilitiesFollowFeatures(t *testing.T) {
+	// probes are the routes of optional features, requested without credentials: served ones
+	// fail on the missing input, the others with route_not_found
+	probes := []struct {
+		feature  authify.Feature
+		endpoint string
+	}{
+		{authify.FeatureChallengeLogin, "GET /v1/tokens/challenge"},
+		{authify.FeatureTokenExchange, "POST /v1/tokens/exchange"},
+		{authify.FeatureOAuth, "POST /v1/oauth/token"},
+		{authify.FeatureIntrospection, "POST /v1/introspect"},
+		{authify.FeatureUserExists, "GET /v1/users/exists"},
+		{authify.FeatureSessions, "GET /v1/sessions"},
+		{authify.FeatureInvites, "GET /admin/invites"},
+		{authify.FeatureSecretRotation, "POST /admin/rotateSecrets"},
+	}
+
+	testCases := map[string]struct {
+		withStores bool
+		opts       []Option
+		enabled    []authify.Feature
+	}{
+		"defaults": {
+			enabled: []authify.Feature{authify.FeatureIntrospection, authify.FeatureOAuth, authify.FeatureTokenExchange, authify.FeatureUserExists},
+		},
+		"optional features on": {
+			withStores: true,
+			opts:       []Option{WithChallengeLogin(), WithSecretRotation()},
+			enabled: []authify.Feature{
+				authify.FeatureChallengeLogin, authify.FeatureIntrospection, authify.FeatureInvites, authify.FeatureOAuth,
+				authify.FeatureSecretRotation, authify.FeatureSessions, authify.FeatureTokenExchange, authify.FeatureUserExists,
+			},
+		},
+		"features off": {
+			withStores: true,
+			opts:       []Option{WithSecretRotation(), WithoutFeatures(authify.FeatureIntrospection, authify.FeatureOAuth, authify.FeatureSessions, authify.FeatureSecretRotation)},
+			enabled:    []authify.Feature{authify.FeatureInvites, authify.FeatureTokenExchange, authify.FeatureUserExists},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			store := stores.NewInMemoryUserStore(testStoreConfig)
+			a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute))
+			if tc.withStores {
+				sessions := stores.NewInMemorySessionStore()
+				a.WithSessionStore(sessions).WithChallengeLogin(sessions).
+					WithRegistrationPolicy(authify.RegistrationInvite, stores.NewInMemoryInviteStore())
+			}
+			router := NewRouter(a, tc.opts...)
+
+			doc := fetchConfiguration(t, router)
+			if !slices.Equal(doc.Features, tc.enabled) {
+				t.Errorf("expected the features %v, got %v", tc.enabled, doc.Features)
+			}
+			for _, probe := range probes {
+				method, path, _ := strings.Cut(probe.endpoint, " ")
+				rec := doRequest(router, method, path, nil)
+				routed := !strings.Contains(rec.Body.String(), string(codeRouteNotFound))
+				listed := slices.Contains(doc.Endpoints, probe.endpoint)
+				want := slices.Contains(tc.enabled, probe.feature)
+				if routed != want || listed != want {
+					t.Errorf("%s: expected routed and listed to be %v, got routed %v (%d) and listed %v", probe.endpoint, want, routed, rec.Code, listed)
+				}
+			}
+
+			wantGrants := []string{}
+			if slices.Contains(tc.enabled, authify.FeatureOAuth) {
+				wantGrants = []string{"password", "refresh_token"}
+			}
+			if !slices.Equal(doc.GrantTypes, wantGrants) {
+				t.Errorf("expected the grant types %v, got %v", wantGrants, doc.GrantTypes)
+			}
+		})
+	}
+}
+
+func TestCapabilitiesDocument(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute)).WithRegistrationPolicy(authify.RegistrationClosed, nil)
+	router := NewRouter(a, WithPathPrefix("/auth"), WithLegacyRoutes(), WithOAuthClient("client", "oauth-client-secret"))
+
+	rec := doRequest(router, http.MethodGet, "/auth/.well-known/authify-configuration", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the capabilities document under the prefix, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	for _, secret := range []string{"supersecret", "oauth-client-secret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("expected the document to leave out the secrets, got %s", body)
+		}
+	}
+
+	var doc authify.Configuration
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("failed to decode the capabilities document: %v", err)
+	}
+	if doc.TokenType != "jwt" || doc.RegistrationMode != "closed" {
+		t.Errorf("expected jwt tokens and closed registration, got %q and %q", doc.TokenType, doc.RegistrationMode)
+	}
+	if doc.TokenLifetimes != (authify.TokenLifetimes{AccessSeconds: 60, RefreshSeconds: 3600}) {
+		t.Errorf("expected the configured lifetimes, got %+v", doc.TokenLifetimes)
+	}
+	if !doc.PasswordPolicy.Required || doc.PasswordPolicy.MaxLength != 72 {
+		t.Errorf("expected a required password of at most 72 bytes, got %+v", doc.PasswordPolicy)
+	}
+	if !slices.Contains(doc.Endpoints, "POST /v1/users") || !slices.Contains(doc.Features, authify.FeatureLegacyRoutes) {
+		t.Errorf("expected the routes relative to the prefix and the legacy routes, got %v and %v", doc.Endpoints, doc.Features)
+	}
+}
+
+func TestGatewayCapabilities(t *testing.T) {
+	router, _ := newGatewayTest(t)
+
+	rec, caps := postJSON(t, router, "/v2/capabilities", `{}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the capabilities of the gRPC service, got %d: %s", rec.Code, rec.Body.String())
+	}
+	endpoints, _ := caps["endpoints"].([]any)
+	if !slices.Contains(endpoints, any("ExchangeToken")) || slices.Contains(endpoints, any("FederatedLogin")) {
+		t.Errorf("expected the RPCs served without federated login, got %v", endpoints)
+	}
+	if rec, _ := postJSON(t, router, "/v2/federated/login", `{"id_token": "token"}`, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the RPC left out of the capabilities not to be routed, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,111 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/client"
+	"github.com/HassanAli101/authify/stores"
+)
+
+func TestChallengeLogin(t *testing.T) {
+	alice := map[string]string{"authify-username": "alice", "authify-password": "password123"}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			nonces := stores.NewInMemorySessionStore()
+			a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute)).WithChallengeLogin(nonces)
+			router := NewRouter(a, WithChallengeLogin())
+			if rec := doRequest(router, http.MethodPost, "/v1/users", alice); rec.Code != http.StatusCreated {
+				t.Fatalf("failed to create user: %s", rec.Body.String())
+			}
+			srv := httptest.NewServer(router)
+			t.Cleanup(srv.Close)
+			c := client.New(srv.URL)
+			ctx := context.Background()
+
+			t.Run("login", func(t *testing.T) {
+				tokens, err := c.LoginWithChallenge(ctx, "alice", "password123")
+				if err != nil {
+					t.Fatalf("challenge login failed: %v", err)
+				}
+				if username, _, err := a.Authenticate(tokens.AccessToken); err != nil || username != "alice" {
+					t.Errorf("expected an access token for alice, got %q (%v)", username, err)
+				}
+			})
+
+			t.Run("wrong-password", func(t *testing.T) {
+				_, err := c.LoginWithChallenge(ctx, "alice", "wrong")
+				assertClientError(t, err, http.StatusUnauthorized, authify.CodeInvalidCredentials)
+				_, err = c.LoginWithChallenge(ctx, "bob", "password123")
+				assertClientError(t, err, http.StatusUnauthorized, authify.CodeInvalidCredentials)
+			})
+
+			t.Run("replayed-nonce", func(t *testing.T) {
+				rec := doRequest(router, http.MethodGet, "/v1/tokens/challenge", map[string]string{"authify-username": "alice"})
+				var challenge authify.LoginChallenge
+				if err := json.NewDecoder(rec.Body).Decode(&challenge); err != nil {
+					t.Fatalf("failed to decode challenge: %v (%d)", err, rec.Code)
+				}
+				hash, err := stores.HashWithSettings("password123", challenge.Settings)
+				if err != nil {
+					t.Fatalf("failed to hash: %v", err)
+				}
+				answer := map[string]string{
+					"authify-username": "alice",
+					"authify-nonce":    challenge.Nonce,
+					"authify-proof":    stores.ChallengeProof(hash, challenge.Nonce),
+				}
+
+				if rec := doRequest(router, http.MethodPost, "/v1/tokens", answer); rec.Code != http.StatusOK {
+					t.Fatalf("expected the first answer to log in, got %d (%s)", rec.Code, rec.Body.String())
+				}
+				rec = doRequest(router, http.MethodPost, "/v1/tokens", answer)
+				assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeNonceUsed)
+			})
+
+			t.Run("expired-nonce", func(t *testing.T) {
+				if err := nonces.SaveNonce("stale", time.Now().Add(-time.Second)); err != nil {
+					t.Fatalf("failed to save nonce: %v", err)
+				}
+				rec := doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{
+					"authify-username": "alice", "authify-nonce": "stale", "authify-proof": "whatever",
+				})
+				assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeNonceExpired)
+			})
+
+			t.Run("password-refused", func(t *testing.T) {
+				rec := doRequest(router, http.MethodPost, "/v1/tokens", alice)
+				assertErrorResponse(t, rec, http.StatusBadRequest, authify.CodeMissingField)
+			})
+		})
+	}
+}
+
+func TestChallengeLoginDisabled(t *testing.T) {
+	router := newTestRouter(t)
+	rec := doRequest(router, http.MethodGet, "/v1/tokens/challenge", map[string]string{"authify-username": "alice"})
+	assertErrorResponse(t, rec, http.StatusNotFound, codeRouteNotFound)
+
+	// the router option alone is not enough, the Authify instance needs a nonce store
+	router = newTestRouter(t, WithChallengeLogin())
+	rec = doRequest(router, http.MethodGet, "/v1/tokens/challenge", map[string]string{"authify-username": "alice"})
+	assertErrorResponse(t, rec, http.StatusNotImplemented, authify.CodeChallengeNotSupported)
+}
+
+func assertClientError(t *testing.T, err error, status int, code authify.AuthErrorCode) {
+	t.Helper()
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected a client.Error, got %v", err)
+	}
+	if apiErr.Status != status || apiErr.Code != code {
+		t.Errorf("expected %d %q, got %d %q (%s)", status, code, apiErr.Status, apiErr.Code, apiErr.Message)
+	}
+}
@@ -0,0 +1,95 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// errorResponse is the JSON body returned for every failed request.
+// Code is stable across releases, Error is a human readable description.
+// Field names the offending input of invalid fields, see stores.FieldError.
+type errorResponse struct {
+	Code  authify.AuthErrorCode `json:"code"`
+	Error string                `json:"error"`
+	Field string                `json:"field,omitempty"`
+}
+
+var statusByCode = map[authify.AuthErrorCode]int{
+	authify.CodeUserExists:            http.StatusConflict,
+	authify.CodeUserNotFound:          http.StatusNotFound,
+	authify.CodeInvalidPassword:       http.StatusUnauthorized,
+	authify.CodeMissingField:          http.StatusBadRequest,
+	authify.CodeTokenExpired:          http.StatusUnauthorized,
+	authify.CodeTokenNotValidYet:      http.StatusUnauthorized,
+	authify.CodeInvalidToken:          http.StatusUnauthorized,
+	authify.CodeRefreshTokenExpired:   http.StatusUnauthorized,
+	authify.CodeInsufficientScope:     http.StatusForbidden,
+	authify.CodeAudienceMismatch:      http.StatusForbidden,
+	authify.CodeHashingBusy:           http.StatusServiceUnavailable,
+	authify.CodeAccountDisabled:       http.StatusForbidden,
+	authify.CodeFieldTooLong:          http.StatusBadRequest,
+	authify.CodeExchangeForbidden:     http.StatusForbidden,
+	authify.CodeNotExchangeable:       http.StatusForbidden,
+	authify.CodeInvalidRole:           http.StatusBadRequest,
+	authify.CodeTimeout:               http.StatusServiceUnavailable,
+	authify.CodeInvalidCredentials:    http.StatusUnauthorized,
+	authify.CodeChallengeNotSupported: http.StatusNotImplemented,
+	authify.CodeNonceUsed:             http.StatusUnauthorized,
+	authify.CodeTokenRevoked:          http.StatusUnauthorized,
+	authify.CodeTokenVersionTooOld:    http.StatusUnauthorized,
+	authify.CodeNonceExpired:          http.StatusUnauthorized,
+	authify.CodeNotSupported:          http.StatusNotImplemented,
+	authify.CodeBindingMismatch:       http.StatusUnauthorized,
+	authify.CodeColumnNotQueryable:    http.StatusBadRequest,
+	authify.CodeRateLimited:           http.StatusTooManyRequests,
+	authify.CodeInvalidClient:         http.StatusUnauthorized,
+	authify.CodeInvalidScope:          http.StatusBadRequest,
+	authify.CodeTokenUseMismatch:      http.StatusForbidden,
+	authify.CodePasswordReused:        http.StatusBadRequest,
+	authify.CodeInvalidField:          http.StatusBadRequest,
+	authify.CodeStoreUnavailable:      http.StatusServiceUnavailable,
+	authify.CodeFieldNotEditable:      http.StatusForbidden,
+	authify.CodeFieldConflict:         http.StatusConflict,
+	authify.CodeInvalidIDToken:        http.StatusUnauthorized,
+	authify.CodeFederatedLoginFailed:  http.StatusUnauthorized,
+	authify.CodeTokenDurationTooLong:  http.StatusBadRequest,
+	authify.CodeRegistrationClosed:    http.StatusForbidden,
+	authify.CodeInviteRequired:        http.StatusForbidden,
+	authify.CodeInvalidInvite:         http.StatusForbidden,
+	authify.CodeChallengeRequired:     http.StatusPreconditionRequired,
+	authify.CodeChallengeFailed:       http.StatusForbidden,
+	authify.CodeRefreshTokenReused:    http.StatusUnauthorized,
+}
+
+// writeError responds with a JSON errorResponse and the status matching err's code.
+func writeError(w http.ResponseWriter, err error) {
+	code := authify.ErrorCode(err)
+	status, ok := statusByCode[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	resp := errorResponse{Code: code, Error: err.Error()}
+	var fieldErr *stores.FieldError
+	if errors.As(err, &fieldErr) {
+		resp.Field = fieldErr.Field
+	}
+	writeJSONResponse(w, status, resp)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code authify.AuthErrorCode, message string) {
+	writeJSONResponse(w, status, errorResponse{Code: code, Error: message})
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, resp errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// responses of timed out requests are discarded, see withTimeout
+	if err := json.NewEncoder(w).Encode(resp); err != nil && !errors.Is(err, http.ErrHandlerTimeout) {
+		log.Printf("Error writing error response: %v\n", err)
+	}
+}
@@ -0,0 +1,128 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/federation"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// Federator exchanges the ID tokens of an identity provider for authify tokens,
+// as federation.OIDCFederator does.
+type Federator interface {
+	ExchangeIDTokenFrom(ctx context.Context, idToken string, device stores.DeviceInfo) (*authify.TokenPair, error)
+}
+
+// WithFederation mounts "POST /v1/federated/login", signing in the users of the ID token
+// sent in the authify-id-token header through f, see federation.NewOIDCFederator.
+func WithFederation(f Federator) Option {
+	return func(o *options) {
+		o.federator = f
+	}
+}
+
+// federatedLogin handles the "POST /v1/federated/login" route.
+// It exchanges the ID token of the authify-id-token header for an access and a refresh token,
+// responded like generateToken does. Logs the device when the user signed in.
+func (h *handler) federatedLogin(w http.ResponseWriter, r *http.Request) {
+	idToken, err := h.opts.headers.ParseIDToken(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	device := h.deviceFromRequest(r)
+	pair, err := h.opts.federator.ExchangeIDTokenFrom(r.Context(), idToken, device)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occurred while exchanging ID token: %w", err))
+		return
+	}
+
+	writeTokenPair(w, r, pair)
+	logf(r.Context(), "Generated token for federated user from %v\n", device.Sanitize())
+}
+
+// CodeFlow signs users in through the authorization code flow of an identity provider,
+// as federation.CodeFlow does.
+type CodeFlow interface {
+	Start(ctx context.Context) (string, federation.LoginSession, error)
+	Finish(ctx context.Context, session federation.LoginSession, state, code string, device stores.DeviceInfo) (*authify.TokenPair, error)
+}
+
+// loginCookieMaxAge is how long users have to sign in with the provider once redirected to it
+const loginCookieMaxAge = 10 * time.Minute
+
+// WithCodeFlow mounts "GET /auth/{provider}/login" and "GET /auth/{provider}/callback" for the
+// identity provider named provider, see federation.NewCodeFlow. The callback route, under the
+// prefix of WithPathPrefix, must be the redirect URL of the flow.
+func WithCodeFlow(provider string, flow CodeFlow) Option {
+	return func(o *options) {
+		if o.codeFlows == nil {
+			o.codeFlows = make(map[string]CodeFlow)
+		}
+		o.codeFlows[provider] = flow
+	}
+}
+
+// codeFlowLogin handles the "GET /auth/{provider}/login" route of provider.
+// It redirects the browser to the identity provider, remembering the login in a cookie
+// scoped to the routes of the provider.
+func (h *handler) codeFlowLogin(w http.ResponseWriter, r *http.Request, provider string, flow CodeFlow) {
+	url, session, err := flow.Start(r.Context())
+	if err != nil {
+		writeError(w, fmt.Errorf("Error starting login with %s: %w", provider, err))
+		return
+	}
+	http.SetCookie(w, h.loginCookie(provider, strings.Join([]string{session.State, session.Nonce, session.Verifier}, "."), int(loginCookieMaxAge.Seconds())))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// codeFlowCallback handles the "GET /auth/{provider}/callback" route of provider.
+// It exchanges the code the identity provider sent back for an access and a refresh token,
+// responded like generateToken does. Logs the device when the user signed in.
+func (h *handler) codeFlowCallback(w http.ResponseWriter, r *http.Request, provider string, flow CodeFlow) {
+	cookie := h.loginCookie(provider, "", -1)
+	var session federation.LoginSession
+	if c, err := r.Cookie(cookie.Name); err == nil {
+		parts := strings.Split(c.Value, ".")
+		if len(parts) == 3 {
+			session = federation.LoginSession{State: parts[0], Nonce: parts[1], Verifier: parts[2]}
+		}
+	}
+	// a login session answers a single callback
+	http.SetCookie(w, cookie)
+
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		writeError(w, fmt.Errorf("%w: %s refused the login: %s", authify.ErrFederatedLoginFailed, provider, reason))
+		return
+	}
+	device := h.deviceFromRequest(r)
+	pair, err := flow.Finish(r.Context(), session, query.Get("state"), query.Get("code"), device)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occurred while signing in with %s: %w", provider, err))
+		return
+	}
+
+	writeTokenPair(w, r, pair)
+	logf(r.Context(), "Generated token for %s user from %v\n", provider, device.Sanitize())
+}
+
+// loginCookie returns the cookie keeping the login session of provider for maxAge seconds,
+// deleted when maxAge is negative
+func (h *handler) loginCookie(provider, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     "authify_login_" + provider,
+		Value:    value,
+		Path:     h.opts.prefix + "/auth/" + provider,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
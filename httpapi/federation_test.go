@@ -0,0 +1,85 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/federation"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// stubFederator accepts the ID token "valid" only
+type stubFederator struct{}
+
+func (stubFederator) ExchangeIDTokenFrom(ctx context.Context, idToken string, device stores.DeviceInfo) (*authify.TokenPair, error) {
+	if idToken != "valid" {
+		return nil, authify.ErrInvalidIDToken
+	}
+	return &authify.TokenPair{AccessToken: "access", RefreshToken: "refresh", AccessExpiresAt: time.Now().Add(time.Minute), RefreshExpiresAt: time.Now().Add(time.Hour)}, nil
+}
+
+func TestFederatedLogin(t *testing.T) {
+	router := newTestRouter(t, WithFederation(stubFederator{}))
+
+	if rec := doRequest(router, http.MethodPost, "/v1/federated/login", map[string]string{"authify-id-token": "valid"}); rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := doRequest(router, http.MethodPost, "/v1/federated/login", map[string]string{"authify-id-token": "forged"})
+	assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeInvalidIDToken)
+	rec = doRequest(router, http.MethodPost, "/v1/federated/login", nil)
+	assertErrorResponse(t, rec, http.StatusBadRequest, authify.CodeMissingField)
+}
+
+func TestFederatedLoginDisabled(t *testing.T) {
+	router := newTestRouter(t)
+	if rec := doRequest(router, http.MethodPost, "/v1/federated/login", map[string]string{"authify-id-token": "valid"}); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without WithFederation, got %d", rec.Code)
+	}
+}
+
+// stubCodeFlow redirects to the provider with the state "state-1", and accepts the code "code-1"
+type stubCodeFlow struct{}
+
+func (stubCodeFlow) Start(ctx context.Context) (string, federation.LoginSession, error) {
+	return "https://provider.example.com/authorize?state=state-1", federation.LoginSession{State: "state-1", Nonce: "nonce-1", Verifier: "verifier-1"}, nil
+}
+
+func (stubCodeFlow) Finish(ctx context.Context, session federation.LoginSession, state, code string, device stores.DeviceInfo) (*authify.TokenPair, error) {
+	if session.State == "" || state != session.State || session.Verifier != "verifier-1" || code != "code-1" {
+		return nil, authify.ErrFederatedLoginFailed
+	}
+	return stubFederator{}.ExchangeIDTokenFrom(ctx, "valid", device)
+}
+
+func TestCodeFlowRoutes(t *testing.T) {
+	router := newTestRouter(t, WithCodeFlow("test", stubCodeFlow{}))
+
+	rec := doRequest(router, http.MethodGet, "/auth/test/login", nil)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://provider.example.com/authorize?state=state-1" {
+		t.Fatalf("expected a redirect to the provider, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "authify_login_test" || !cookies[0].HttpOnly || !cookies[0].Secure || cookies[0].Path != "/auth/test" {
+		t.Fatalf("expected an HttpOnly secure cookie scoped to the provider, got %v", cookies)
+	}
+	cookie := map[string]string{"Cookie": cookies[0].Name + "=" + cookies[0].Value}
+
+	rec = doRequest(router, http.MethodGet, "/auth/test/callback?state=state-1&code=code-1", cookie)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if cleared := rec.Result().Cookies(); len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+		t.Errorf("expected the login cookie to be cleared, got %v", cleared)
+	}
+
+	rec = doRequest(router, http.MethodGet, "/auth/test/callback?state=state-1&code=code-1", nil)
+	assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeFederatedLoginFailed)
+	rec = doRequest(router, http.MethodGet, "/auth/test/callback?error=access_denied", cookie)
+	assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeFederatedLoginFailed)
+	if rec := doRequest(router, http.MethodGet, "/auth/other/login", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown provider, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,187 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/HassanAli101/authify"
+	authifygrpc "github.com/HassanAli101/authify/internal/grpc"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// codeInvalidBody is reported by the gateway for request bodies that are not the JSON of the
+// RPC's request message
+const codeInvalidBody authify.AuthErrorCode = "invalid_body"
+
+// gatewayRoutes maps the RPCs of the AuthService to the paths the gateway serves them at,
+// every RPC is a POST of its request message
+var gatewayRoutes = map[string]string{
+	"CreateUser":           "/v2/users",
+	"UserExists":           "/v2/users/exists",
+	"SetUserStatus":        "/v2/users/status",
+	"ChangeRole":           "/v2/users/role",
+	"GenerateToken":        "/v2/tokens",
+	"VerifyToken":          "/v2/tokens/verify",
+	"RefreshToken":         "/v2/tokens/refresh",
+	"ExchangeToken":        "/v2/tokens/exchange",
+	"GenerateServiceToken": "/v2/tokens/service",
+	"Logout":               "/v2/tokens/logout",
+	"FederatedLogin":       "/v2/federated/login",
+	"GetCapabilities":      "/v2/capabilities",
+	"GetSelf":              "/v2/me",
+	"UpdateSelf":           "/v2/me/update",
+	"ChangePassword":       "/v2/me/password",
+	"ListSessions":         "/v2/sessions",
+	"InvalidateAllTokens":  "/v2/admin/invalidateAllTokens",
+}
+
+// gatewayMetadata lists the headers passed on to the RPCs as metadata, along with the access
+// header, see gatewayContext
+var gatewayMetadata = []string{"authorization", "user-agent"}
+
+// Responses are named after the proto fields, as the JSON of the /v1 routes, and carry every
+// field so false and zero values are not left out. int64 fields, such as the expiries of
+// tokens, are strings as in any ProtoJSON.
+var (
+	gatewayMarshal   = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+	gatewayUnmarshal = protojson.UnmarshalOptions{}
+)
+
+// WithGateway mounts a JSON gateway of the gRPC service srv under /v2, see gatewayRoutes, so
+// HTTP clients can make the calls of gRPC ones with the same messages. Bodies are the ProtoJSON of
+// the request messages, the authorization, authify-access and user-agent headers are passed as
+// metadata, and errors get the JSON body of the other routes, with the code of their ErrorInfo.
+func WithGateway(srv authifygrpc.AuthServiceServer) Option {
+	return func(o *options) {
+		o.gateway = srv
+	}
+}
+
+// WithoutHeaderRoutes leaves out the routes reading their input from authify-* headers, /v1,
+// /admin and the legacy ones, for deployments only serving the gateway of WithGateway.
+func WithoutHeaderRoutes() Option {
+	return func(o *options) {
+		o.withoutHeaderRoutes = true
+	}
+}
+
+// mountGateway registers the gateway routes of the RPCs the gRPC service serves, as listed by its
+// GetCapabilities, so the RPCs of the features it turns off are not routed. Every RPC is routed
+// when the service does not implement GetCapabilities.
+func (h *handler) mountGateway(route func(method, path string, handler http.Handler)) {
+	var served map[string]bool
+	if caps, err := h.opts.gateway.GetCapabilities(context.Background(), &authifygrpc.Empty{}); err == nil {
+		served = make(map[string]bool)
+		for _, endpoint := range caps.Endpoints {
+			served[endpoint] = true
+		}
+	}
+	for _, method := range authifygrpc.ServiceDesc.Methods {
+		if served != nil && !served[method.MethodName] {
+			continue
+		}
+		if path, ok := gatewayRoutes[method.MethodName]; ok {
+			route(http.MethodPost, path, h.gatewayMethod(method))
+		}
+	}
+}
+
+// gatewayMethod serves method, decoding the request message from the body and calling the
+// generated handler as the gRPC server would, without interceptors
+func (h *handler) gatewayMethod(method grpc.MethodDesc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidBody, fmt.Sprintf("failed to read request body: %v", err))
+			return
+		}
+		var decodeErr error
+		dec := func(req any) error {
+			// an empty body is an empty message, as for RPCs without fields
+			if len(bytes.TrimSpace(body)) == 0 {
+				return nil
+			}
+			decodeErr = gatewayUnmarshal.Unmarshal(body, req.(proto.Message))
+			return decodeErr
+		}
+
+		resp, err := method.Handler(h.opts.gateway, h.gatewayContext(r), dec, nil)
+		if decodeErr != nil {
+			writeJSONError(w, http.StatusBadRequest, codeInvalidBody, fmt.Sprintf("invalid request body: %v", decodeErr))
+			return
+		}
+		if err != nil {
+			writeStatusError(w, err)
+			return
+		}
+		out, err := gatewayMarshal.Marshal(resp.(proto.Message))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+}
+
+// gatewayContext is the context of the RPC made for r, carrying its headers as metadata and
+// its client address as peer, so sessions and rate limits see the HTTP client. The access header
+// is passed as authify-access whatever its prefix, see WithHeaderPrefix.
+func (h *handler) gatewayContext(r *http.Request) context.Context {
+	md := metadata.MD{}
+	for _, name := range gatewayMetadata {
+		if values := r.Header.Values(name); len(values) > 0 {
+			md.Set(name, values...)
+		}
+	}
+	if values := r.Header.Values(h.opts.headers.Name("access")); len(values) > 0 {
+		md.Set("authify-access", values...)
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	return peer.NewContext(ctx, &peer.Peer{Addr: gatewayAddr(h.deviceFromRequest(r).IP)})
+}
+
+// gatewayAddr is the address of an HTTP client, as a net.Addr
+type gatewayAddr string
+
+func (a gatewayAddr) Network() string { return "tcp" }
+func (a gatewayAddr) String() string  { return string(a) }
+
+// writeStatusError responds with the JSON errorResponse of a gRPC status error: its code is the
+// reason of the ErrorInfo set by the server, and its field the first BadRequest violation.
+// Statuses without ErrorInfo, such as unimplemented RPCs, get the closest authify code.
+func writeStatusError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	resp := errorResponse{Error: st.Message()}
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.ErrorInfo:
+			resp.Code = authify.AuthErrorCode(detail.Reason)
+		case *errdetails.BadRequest:
+			if violations := detail.GetFieldViolations(); len(violations) > 0 {
+				resp.Field = violations[0].Field
+			}
+		}
+	}
+	if resp.Code == "" {
+		resp.Code = authify.CodeInternal
+		if st.Code() == codes.Unimplemented {
+			resp.Code = authify.CodeNotSupported
+		}
+	}
+	httpStatus, ok := statusByCode[resp.Code]
+	if !ok {
+		httpStatus = http.StatusInternalServerError
+	}
+	writeJSONResponse(w, httpStatus, resp)
+}
@@ -0,0 +1,242 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	authifygrpc "github.com/HassanAli101/authify/internal/grpc"
+	"github.com/HassanAli101/authify/stores"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newGatewayTest serves one gRPC service both through the gateway of a router and over gRPC,
+// in memory, and returns the router and a gRPC client of the service
+func newGatewayTest(t *testing.T, opts ...Option) (http.Handler, authifygrpc.AuthServiceClient) {
+	t.Helper()
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute))
+	service := authifygrpc.NewAuthifyGRPCServer(a)
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	authifygrpc.RegisterAuthServiceServer(server, service)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }
+	conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	router := NewRouter(a, append([]Option{WithGateway(service)}, opts...)...)
+	return router, authifygrpc.NewAuthServiceClient(conn)
+}
+
+// postJSON posts body to the gateway route path and decodes its JSON response
+func postJSON(t *testing.T, router http.Handler, path, body string, headers map[string]string) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	var resp map[string]any
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode response of %s: %v (%s)", path, err, rec.Body.String())
+		}
+	}
+	return rec, resp
+}
+
+// asJSON is the JSON the gateway renders msg with
+func asJSON(t *testing.T, msg proto.Message) map[string]any {
+	t.Helper()
+	out, err := gatewayMarshal.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func sortedKeys(m map[string]any) []string {
+	return slices.Sorted(maps.Keys(m))
+}
+
+func TestGatewayRoutesEveryRPC(t *testing.T) {
+	for _, method := range authifygrpc.ServiceDesc.Methods {
+		if _, ok := gatewayRoutes[method.MethodName]; !ok {
+			t.Errorf("RPC %s has no gateway route", method.MethodName)
+		}
+	}
+	if len(gatewayRoutes) != len(authifygrpc.ServiceDesc.Methods) {
+		t.Errorf("expected %d gateway routes, got %d", len(authifygrpc.ServiceDesc.Methods), len(gatewayRoutes))
+	}
+}
+
+// TestGatewayParity makes the same calls through the gateway, for alice, and over gRPC, for bob,
+// and expects the same responses
+func TestGatewayParity(t *testing.T) {
+	ctx := context.Background()
+	router, client := newGatewayTest(t)
+
+	// create
+	rec, created := postJSON(t, router, "/v2/users", `{"username": "alice", "password": "password123"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create user: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	createResp, err := client.CreateUser(ctx, &authifygrpc.CreateUserRequest{Username: "bob", Password: "password123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := created["identity"], asJSON(t, createResp)["identity"]; !sameKeys(got, want) {
+		t.Errorf("create user: expected the identity %v, got %v", want, got)
+	}
+	if got, want := created["user"], asJSON(t, createResp)["user"]; !sameKeys(got, want) {
+		t.Errorf("create user: expected the user %v, got %v", want, got)
+	}
+
+	// login
+	rec, login := postJSON(t, router, "/v2/tokens", `{"username": "alice", "password": "password123", "device_info": {"device_name": "laptop"}}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	loginResp, err := client.GenerateToken(ctx, &authifygrpc.GenerateTokenRequest{Username: "bob", Password: "password123", DeviceInfo: &authifygrpc.DeviceInfo{DeviceName: "laptop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedKeys(login), sortedKeys(asJSON(t, loginResp)); !slices.Equal(got, want) {
+		t.Errorf("login: expected the fields %v, got %v", want, got)
+	}
+	if login["access_token"] == "" || login["refresh_token"] == "" {
+		t.Fatalf("login: expected tokens, got %v", login)
+	}
+
+	// verify
+	rec, verified := postJSON(t, router, "/v2/tokens/verify", `{"access_token": "`+login["access_token"].(string)+`"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	verifyResp, err := client.VerifyToken(ctx, &authifygrpc.VerifyTokenRequest{AccessToken: loginResp.AccessToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := asJSON(t, verifyResp)
+	if !sameKeys(verified["claims"], want["claims"]) {
+		t.Errorf("verify: expected the claims %v, got %v", want["claims"], verified["claims"])
+	}
+	if claims := verified["claims"].(map[string]any); claims["username"] != "alice" || claims["role"] != "user" {
+		t.Errorf("verify: expected the claims of alice, got %v", claims)
+	}
+
+	// refresh
+	body := `{"access_token": "` + login["access_token"].(string) + `", "refresh_token": "` + login["refresh_token"].(string) + `"}`
+	rec, refreshed := postJSON(t, router, "/v2/tokens/refresh", body, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	refreshResp, err := client.RefreshToken(ctx, &authifygrpc.RefreshTokenRequest{AccessToken: loginResp.AccessToken, RefreshToken: loginResp.RefreshToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = asJSON(t, refreshResp)
+	if got := sortedKeys(refreshed); !slices.Equal(got, sortedKeys(want)) {
+		t.Errorf("refresh: expected the fields %v, got %v", sortedKeys(want), got)
+	}
+	if refreshed["role"] != want["role"] || refreshed["access_token"] == "" {
+		t.Errorf("refresh: expected a token of role %v, got %v", want["role"], refreshed)
+	}
+
+	// errors get the code of the gRPC ErrorInfo
+	rec, _ = postJSON(t, router, "/v2/tokens", `{"username": "alice", "password": "wrong"}`, nil)
+	_, err = client.GenerateToken(ctx, &authifygrpc.GenerateTokenRequest{Username: "bob", Password: "wrong"})
+	assertErrorResponse(t, rec, http.StatusUnauthorized, errorReason(t, err))
+}
+
+// sameKeys reports whether two decoded JSON objects have the same fields
+func sameKeys(a, b any) bool {
+	am, aok := a.(map[string]any)
+	bm, bok := b.(map[string]any)
+	return aok && bok && slices.Equal(sortedKeys(am), sortedKeys(bm))
+}
+
+func errorReason(t *testing.T, err error) authify.AuthErrorCode {
+	t.Helper()
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return authify.AuthErrorCode(info.Reason)
+		}
+	}
+	t.Fatalf("expected an ErrorInfo in %v", err)
+	return ""
+}
+
+func TestGatewayMetadata(t *testing.T) {
+	router, _ := newGatewayTest(t)
+	postJSON(t, router, "/v2/users", `{"username": "alice", "password": "password123"}`, nil)
+	_, login := postJSON(t, router, "/v2/tokens", `{"username": "alice", "password": "password123"}`, nil)
+
+	// the authorization header is passed on as metadata
+	rec, self := postJSON(t, router, "/v2/me", ``, map[string]string{"Authorization": "Bearer " + login["access_token"].(string)})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if fields := self["fields"].(map[string]any); fields["username"] != "alice" {
+		t.Errorf("expected the profile of alice, got %v", fields)
+	}
+
+	rec, _ = postJSON(t, router, "/v2/admin/invalidateAllTokens", ``, map[string]string{"Authorization": "Bearer " + login["access_token"].(string)})
+	assertErrorResponse(t, rec, http.StatusForbidden, authify.CodeInsufficientScope)
+}
+
+func TestGatewayErrors(t *testing.T) {
+	router, _ := newGatewayTest(t)
+
+	rec, _ := postJSON(t, router, "/v2/users", `{"username": `, nil)
+	assertErrorResponse(t, rec, http.StatusBadRequest, codeInvalidBody)
+
+	rec, _ = postJSON(t, router, "/v2/users", `{"name": "alice"}`, nil)
+	assertErrorResponse(t, rec, http.StatusBadRequest, codeInvalidBody)
+
+	rec, _ = postJSON(t, router, "/v2/tokens/verify", `{"access_token": "not-a-token"}`, nil)
+	assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeInvalidToken)
+
+	// RPCs of features the server does not enable, federated login without a federator, are not routed
+	rec, _ = postJSON(t, router, "/v2/federated/login", `{"id_token": "token"}`, nil)
+	assertErrorResponse(t, rec, http.StatusNotFound, codeRouteNotFound)
+
+	rec = doRequest(router, http.MethodGet, "/v2/users", nil)
+	assertErrorResponse(t, rec, http.StatusMethodNotAllowed, codeMethodNotAllowed)
+}
+
+func TestWithoutHeaderRoutes(t *testing.T) {
+	router, _ := newGatewayTest(t, WithLegacyRoutes(), WithoutHeaderRoutes())
+
+	for _, path := range []string{"/v1/users", "/create-user"} {
+		rec := doRequest(router, http.MethodPost, path, map[string]string{"authify-username": "alice", "authify-password": "password123"})
+		assertErrorResponse(t, rec, http.StatusNotFound, codeRouteNotFound)
+	}
+	if rec, _ := postJSON(t, router, "/v2/users", `{"username": "alice", "password": "password123"}`, nil); rec.Code != http.StatusOK {
+		t.Errorf("expected the gateway to be served, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,351 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/lib"
+	"github.com/HassanAli101/authify/middleware"
+	"github.com/HassanAli101/authify/secrets"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// createUser handles the "POST /v1/users" route.
+// It reads the username and password from the request headers,
+// creates a new user in the data store, and responds with a 201 carrying the user's non-hidden
+// columns, defaults and generated values included, e.g. {"id": "...", "role": "user", "username": "alice"},
+// and a Location header of /v1/users/{username}, or an error.
+// The registration policy is enforced, see authify.RegisterUser: the authify-invite header
+// carries the invite code, and an administrator's bearer token lifts the policy.
+// Requests with an Idempotency-Key header are run once, see WithIdempotency, and clients
+// creating many users must answer a challenge, see WithSignupChallenge.
+// Logs the username when the user is created.
+func (h *handler) createUser(w http.ResponseWriter, r *http.Request) {
+	if !h.checkSignupChallenge(w, r) {
+		return
+	}
+	userData, err := h.opts.headers.ParseUserHeaders(r, h.auth.Store.StoreConfig())
+	if err != nil {
+		writeError(w, fmt.Errorf("Error parsing headers: %w", err))
+		return
+	}
+	reg := authify.Registration{InviteCode: h.opts.headers.Get(r, "invite")}
+	// clients without a token register as anyone else
+	reg.AccessToken, _ = middleware.AccessTokenFromRequest(r)
+
+	h.idempotent(w, r, userFingerprint(h.auth.Store.StoreConfig(), userData), func(w http.ResponseWriter) {
+		user, err := h.auth.RegisterUser(r.Context(), userData, reg)
+		if err != nil {
+			writeError(w, fmt.Errorf("Error creating user: %w", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", h.opts.prefix+"/v1/users/"+url.PathEscape(user["username"]))
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(user); err != nil {
+			logf(r.Context(), "Error writing create user response: %v\n", err)
+		}
+		logf(r.Context(), "Created user with username: %v\n", userData["username"])
+	})
+}
+
+// generateToken handles the "POST /v1/tokens" route.
+// It extracts the username and password from the request headers,
+// generates a JWT token for the user if the credentials are valid,
+// and responds with the token or an error. Logs the username and
+// device when a token is successfully generated.
+func (h *handler) generateToken(w http.ResponseWriter, r *http.Request) {
+	if h.caps.Enabled(authify.FeatureChallengeLogin) {
+		h.generateTokenWithProof(w, r)
+		return
+	}
+
+	// Parse all user headers dynamically
+	userData, err := h.opts.headers.ParseUserHeaders(r, h.auth.Store.StoreConfig())
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occurred while parsing headers: %w", err))
+		return
+	}
+
+	username, ok := userData["username"].(string)
+	if !ok {
+		writeError(w, lib.ErrMissingUsernameHeader)
+		return
+	}
+
+	rawPassword, ok := userData["password"].(string)
+	if !ok {
+		writeError(w, lib.ErrMissingPasswordHeader)
+		return
+	}
+	// held as a secret from here on, so it cannot end up in a log line by mistake
+	password := secrets.SecretString(rawPassword)
+
+	device := h.deviceFromRequest(r)
+	pair, err := h.auth.LoginContext(r.Context(), username, password.Reveal(), device)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occurred while generating token: %w", err))
+		return
+	}
+
+	writeTokenPair(w, r, pair)
+	logf(r.Context(), "Generated token for user with username: %v from %v\n", username, device.Sanitize())
+}
+
+// generateTokenWithProof is generateToken in challenge login mode: the authify-nonce and
+// authify-proof headers answer a challenge from "GET /v1/tokens/challenge" in place of the password.
+func (h *handler) generateTokenWithProof(w http.ResponseWriter, r *http.Request) {
+	username := h.opts.headers.Get(r, "username")
+	if username == "" {
+		writeError(w, lib.ErrMissingUsernameHeader)
+		return
+	}
+	nonce, proof := h.opts.headers.Get(r, "nonce"), h.opts.headers.Get(r, "proof")
+	if nonce == "" || proof == "" {
+		writeError(w, lib.ErrMissingProofHeader)
+		return
+	}
+
+	device := h.deviceFromRequest(r)
+	pair, err := h.auth.LoginWithProofContext(r.Context(), username, nonce, proof, device)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occurred while generating token: %w", err))
+		return
+	}
+
+	writeTokenPair(w, r, pair)
+	logf(r.Context(), "Generated token with a challenge proof for user with username: %v from %v\n", username, device.Sanitize())
+}
+
+// writeTokenPair responds with the tokens of a login and their expiries, as JSON when the
+// client accepts it, and as "Name: value" lines otherwise.
+func writeTokenPair(w http.ResponseWriter, r *http.Request, pair *authify.TokenPair) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(pair); err != nil {
+			logf(r.Context(), "Error writing token response: %v\n", err)
+		}
+		return
+	}
+	fmt.Fprintf(w, "Access Token: %v\nRefresh Token: %v\nAccess Token Expires At: %v\nRefresh Token Expires At: %v\n",
+		pair.AccessToken, pair.RefreshToken,
+		pair.AccessExpiresAt.Format(time.RFC3339), pair.RefreshExpiresAt.Format(time.RFC3339))
+}
+
+// loginChallenge handles the "GET /v1/tokens/challenge" route.
+// It responds with a nonce and the settings of the password hash of the user named by the
+// authify-username header, as JSON. The nonce answers one login within authify.ChallengeTTL.
+func (h *handler) loginChallenge(w http.ResponseWriter, r *http.Request) {
+	username := h.opts.headers.Get(r, "username")
+	if username == "" {
+		writeError(w, lib.ErrMissingUsernameHeader)
+		return
+	}
+
+	challenge, err := h.auth.NewLoginChallenge(username)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error creating login challenge: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(challenge); err != nil {
+		logf(r.Context(), "Error writing login challenge response: %v\n", err)
+	}
+}
+
+// deviceFromRequest describes the client of r: its address, honoring X-Forwarded-For
+// when the router trusts it, its User-Agent, and the optional authify-device-name,
+// authify-platform and authify-device-id headers.
+func (h *handler) deviceFromRequest(r *http.Request) stores.DeviceInfo {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if h.opts.trustForwardedFor {
+		// the last entry was appended by the proxy in front of us, earlier ones come from the client
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if last := strings.TrimSpace(hops[len(hops)-1]); last != "" {
+			ip = last
+		}
+	}
+
+	return stores.DeviceInfo{
+		IP:         ip,
+		UserAgent:  r.UserAgent(),
+		DeviceName: h.opts.headers.Get(r, "device-name"),
+		Platform:   h.opts.headers.Get(r, "platform"),
+		DeviceID:   h.opts.headers.Get(r, "device-id"),
+	}
+}
+
+// verifyToken handles the "POST /v1/tokens/verify" route.
+// It extracts the token from the request headers, validates it,
+// and responds with the associated username and role if the token
+// is valid, as JSON along with its expiry when the client accepts it.
+// The headers of middleware.SetTokenHeaders tell its remaining lifetime
+// and carry its replacement when sessions slide, see authify.Authify.AuthenticateSliding.
+// Logs the username when the token is successfully verified.
+func (h *handler) verifyToken(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.opts.headers.ParseAccessToken(r)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occured while verifying token: %w", err))
+		return
+	}
+	claims, refreshed, err := h.auth.AuthenticateSliding(accessToken)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occured while validating token: %w", err))
+		return
+	}
+	middleware.SetTokenHeaders(w, r, claims, refreshed)
+	logf(r.Context(), "Verified token for user with claims: %v\n", claims)
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		fmt.Fprintf(w, "Token validated with claims %v \n", claims)
+		return
+	}
+
+	resp := verifyResponse{Claims: claims, RefreshedToken: refreshed}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		resp.ExpiresAt = exp.Time.UTC()
+		resp.ExpiresIn = max(int64(time.Until(exp.Time).Seconds()), 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logf(r.Context(), "Error writing verify response: %v\n", err)
+	}
+}
+
+// verifyResponse is the JSON answer of the verify route: the claims of the token, when it
+// expires and the seconds left until then, and its replacement when sessions slide
+type verifyResponse struct {
+	Claims         jwt.MapClaims `json:"claims"`
+	ExpiresAt      time.Time     `json:"expires_at"`
+	ExpiresIn      int64         `json:"expires_in"`
+	RefreshedToken string        `json:"refreshed_token,omitempty"`
+}
+
+// refreshToken handles the "POST /v1/tokens/refresh" route.
+// It extracts the token from the request headers, attempts to refresh it,
+// and responds with the new token if successful, as JSON along with the role of
+// its user with WithRefreshRole. When the refresh rotates the refresh token, which the token
+// manager or authify.WithTokenFamilies can do, the one sent is consumed and its replacement is
+// sent in the authify-refresh header, and in the JSON.
+// Logs the username when a token is refreshed.
+func (h *handler) refreshToken(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.opts.headers.ParseAccessToken(r)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occured while refreshing token: %w", err))
+		return
+	}
+	refreshToken, err := h.opts.headers.ParseRefreshToken(r)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occured while refreshing token: %w", err))
+		return
+	}
+	pair, err := h.auth.RefreshTokens(r.Context(), token.RefreshTokensRequest{AccessToken: accessToken, RefreshToken: refreshToken, Device: h.deviceFromRequest(r)})
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occured while validating token: %w", err))
+		return
+	}
+	newToken, claims := pair.AccessToken, pair.AccessClaims
+	var rotated string
+	if pair.RefreshToken != refreshToken {
+		rotated = pair.RefreshToken
+		w.Header().Set(h.opts.headers.Name("refresh"), rotated)
+	}
+	if h.opts.refreshRole {
+		w.Header().Set("Content-Type", "application/json")
+		resp := refreshResponse{AccessToken: newToken, RefreshToken: rotated, Role: token.RoleFromClaims(h.auth.Tokens, claims)}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logf(r.Context(), "Error writing refresh response: %v\n", err)
+		}
+	} else {
+		fmt.Fprintf(w, "Token Refreshed! new token is: %v\n", newToken)
+	}
+	logf(r.Context(), "Refreshed token for user with username: %v\n", claims)
+}
+
+// refreshResponse is the body of "POST /v1/tokens/refresh" with WithRefreshRole
+type refreshResponse struct {
+	AccessToken string `json:"access_token"`
+	// RefreshToken replaces the refresh token sent, when the token manager rotates them
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Role         string `json:"role"`
+}
+
+// exchangeToken handles the "POST /v1/tokens/exchange" route (RFC 8693 token exchange).
+// A service authenticates with its own authify-username and authify-password headers and
+// trades the user's access token, sent in authify-access, for a token acting on the user's
+// behalf. The optional authify-audience and authify-ttl (seconds) headers set the audience
+// and lifetime of the new token. Logs the actor and the user when a token is exchanged.
+func (h *handler) exchangeToken(w http.ResponseWriter, r *http.Request) {
+	subjectToken, err := h.opts.headers.ParseAccessToken(r)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occurred while exchanging token: %w", err))
+		return
+	}
+	actor, err := h.opts.headers.ParseUserHeaders(r, h.auth.Store.StoreConfig())
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occurred while parsing headers: %w", err))
+		return
+	}
+	actorUsername, ok := actor["username"].(string)
+	if !ok {
+		writeError(w, lib.ErrMissingUsernameHeader)
+		return
+	}
+	rawActorPassword, ok := actor["password"].(string)
+	if !ok {
+		writeError(w, lib.ErrMissingPasswordHeader)
+		return
+	}
+	actorPassword := secrets.SecretString(rawActorPassword)
+
+	var ttl time.Duration
+	if header := h.opts.headers.Get(r, "ttl"); header != "" {
+		seconds, err := strconv.Atoi(header)
+		if err != nil || seconds <= 0 {
+			writeError(w, lib.ErrInvalidTTLHeader)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	exchanged, err := h.auth.Tokens.ExchangeToken(subjectToken, actorUsername, actorPassword.Reveal(), h.opts.headers.Get(r, "audience"), ttl)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error occurred while exchanging token: %w", err))
+		return
+	}
+	fmt.Fprintf(w, "Exchanged Token: %v\n", exchanged)
+	logf(r.Context(), "Exchanged token for actor with username: %v\n", actorUsername)
+}
+
+// readyResponse is the body returned by the readiness route once the store can serve requests
+type readyResponse struct {
+	Status string `json:"status"`
+}
+
+// ready handles the "GET /readyz" route, for readiness probes.
+// It responds with {"status": "ready"}, or a 503 with the store_unavailable code while the
+// database cannot be reached, see authify.Ready. It requires no token.
+func (h *handler) ready(w http.ResponseWriter, r *http.Request) {
+	if err := h.auth.Ready(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(readyResponse{Status: "ready"}); err != nil {
+		logf(r.Context(), "Error writing readiness response: %v\n", err)
+	}
+}
@@ -0,0 +1,665 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/authifytest"
+	"github.com/HassanAli101/authify/middleware"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var testStoreConfig = stores.StoreConfig{
+	Name: "users",
+	Columns: map[string]stores.ColumnConfig{
+		"username": {Type: "text", Required: true, PrimaryKey: true},
+		"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+		"role":     {Type: "text", Default: "user"},
+	},
+}
+
+func testTokenConfig(accessDuration time.Duration) *token.TokenConfig {
+	return &token.TokenConfig{
+		AccessToken: token.AccessTokenConfig{
+			Duration:      accessDuration,
+			SigningMethod: "HS256",
+			Claims: map[string]token.ClaimConfig{
+				"username": {Source: "db", Column: "username", IsIdentifier: true},
+				"role":     {Source: "db", Column: "role"},
+			},
+		},
+		RefreshToken: token.RefreshTokenConfig{
+			Duration: time.Hour,
+			Claims: map[string]token.ClaimConfig{
+				"username": {Source: "db", Column: "username", IsIdentifier: true},
+			},
+		},
+	}
+}
+
+func newTestJWTManager(t *testing.T, store stores.Store, accessDuration time.Duration) *token.JWTManager {
+	t.Helper()
+	m, err := token.NewJWTManager().
+		WithConfig(testTokenConfig(accessDuration)).
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(store).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	return m
+}
+
+// ----------------- Fake postgres connection -----------------
+
+var (
+	insertColsRe = regexp.MustCompile(`^INSERT INTO "\w+" \(([^)]*)\)`)
+	selectColsRe = regexp.MustCompile(`^SELECT (.*) FROM "\w+" WHERE`)
+	updateRe     = regexp.MustCompile(`^UPDATE "\w+" SET (.*) WHERE "\w+"=\$(\d+)`)
+	assignRe     = regexp.MustCompile(`"(\w+)"=\$(\d+)`)
+	deleteRe     = regexp.MustCompile(`^DELETE FROM "\w+" WHERE "\w+"=\$1`)
+	settingsRe   = regexp.MustCompile(`^(INSERT INTO|SELECT "value" FROM) "\w+_settings"`)
+)
+
+const pgUniqueViolationCode = "23505"
+
+// fakeConn stands in for postgres by keeping rows in memory, keyed by username.
+type fakeConn struct {
+	rows map[string]map[string]any
+
+	// defaults fills the columns left out of inserts, like the DEFAULT clauses of a table
+	defaults map[string]any
+
+	// settings holds the rows of the settings table, such as the global not-before time
+	settings map[string]string
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{rows: make(map[string]map[string]any)}
+}
+
+func splitColumns(s string) []string {
+	cols := strings.Split(s, ",")
+	for i, c := range cols {
+		cols[i] = strings.Trim(strings.TrimSpace(c), `"`)
+	}
+	return cols
+}
+
+func (c *fakeConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if settingsRe.MatchString(sql) {
+		if c.settings == nil {
+			c.settings = make(map[string]string)
+		}
+		c.settings[args[0].(string)] = args[1].(string)
+		return pgconn.NewCommandTag("INSERT 0 1"), nil
+	}
+	if match := updateRe.FindStringSubmatch(sql); match != nil {
+		return c.update(match[1], match[2], args)
+	}
+	if deleteRe.MatchString(sql) {
+		username := args[0].(string)
+		if _, ok := c.rows[username]; !ok {
+			return pgconn.NewCommandTag("DELETE 0"), nil
+		}
+		delete(c.rows, username)
+		return pgconn.NewCommandTag("DELETE 1"), nil
+	}
+
+	match := insertColsRe.FindStringSubmatch(sql)
+	if match == nil {
+		return pgconn.CommandTag{}, nil
+	}
+	if _, err := c.insert(match[1], args); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+// insert adds the row of an INSERT of the given columns, with the defaults of the missing ones
+func (c *fakeConn) insert(columns string, args []any) (map[string]any, error) {
+	row := make(map[string]any)
+	for col, val := range c.defaults {
+		row[col] = val
+	}
+	for i, col := range splitColumns(columns) {
+		row[col] = args[i]
+	}
+
+	username := row["username"].(string)
+	if _, exists := c.rows[username]; exists {
+		return nil, &pgconn.PgError{Code: pgUniqueViolationCode, Detail: "Key (username) already exists."}
+	}
+	c.rows[username] = row
+	return row, nil
+}
+
+// update applies `"col"=$n` assignments to the row whose username is bound to the $where placeholder
+func (c *fakeConn) update(assignments, where string, args []any) (pgconn.CommandTag, error) {
+	row, ok := c.rows[args[placeholderIndex(where)].(string)]
+	if !ok {
+		return pgconn.NewCommandTag("UPDATE 0"), nil
+	}
+	for _, assign := range assignRe.FindAllStringSubmatch(assignments, -1) {
+		row[assign[1]] = args[placeholderIndex(assign[2])]
+	}
+	return pgconn.NewCommandTag("UPDATE 1"), nil
+}
+
+func placeholderIndex(n string) int {
+	i, _ := strconv.Atoi(n)
+	return i - 1
+}
+
+func (c *fakeConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if strings.HasPrefix(sql, "SELECT COUNT(*) ") {
+		return &fakeRows{cols: []string{"count"}, values: [][]any{{int64(len(c.rows))}}}, nil
+	}
+
+	if settingsRe.MatchString(sql) {
+		rows := &fakeRows{cols: []string{"value"}}
+		if value, ok := c.settings[args[0].(string)]; ok {
+			rows.values = [][]any{{value}}
+		}
+		return rows, nil
+	}
+
+	if match := insertColsRe.FindStringSubmatch(sql); match != nil {
+		_, returning, ok := strings.Cut(sql, " RETURNING ")
+		if !ok {
+			return nil, errors.New("unexpected query: " + sql)
+		}
+		row, err := c.insert(match[1], args)
+		if err != nil {
+			return nil, err
+		}
+		rows := &fakeRows{cols: splitColumns(returning)}
+		values := make([]any, len(rows.cols))
+		for i, col := range rows.cols {
+			values[i] = row[col]
+		}
+		rows.values = [][]any{values}
+		return rows, nil
+	}
+
+	match := selectColsRe.FindStringSubmatch(sql)
+	if match == nil {
+		return nil, errors.New("unexpected query: " + sql)
+	}
+
+	rows := &fakeRows{cols: splitColumns(match[1])}
+	if row, ok := c.rows[args[0].(string)]; ok {
+		values := make([]any, len(rows.cols))
+		for i, col := range rows.cols {
+			values[i] = row[col]
+		}
+		rows.values = [][]any{values}
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	cols   []string
+	values [][]any
+	pos    int
+}
+
+func (r *fakeRows) Close()                        {}
+func (r *fakeRows) Err() error                    { return nil }
+func (r *fakeRows) CommandTag() pgconn.CommandTag { return pgconn.CommandTag{} }
+func (r *fakeRows) RawValues() [][]byte           { return nil }
+func (r *fakeRows) Conn() *pgx.Conn               { return nil }
+
+func (r *fakeRows) FieldDescriptions() []pgconn.FieldDescription {
+	fds := make([]pgconn.FieldDescription, len(r.cols))
+	for i, col := range r.cols {
+		fds[i] = pgconn.FieldDescription{Name: col}
+	}
+	return fds
+}
+
+func (r *fakeRows) Next() bool {
+	if r.pos >= len(r.values) {
+		return false
+	}
+	r.pos++
+	return true
+}
+
+func (r *fakeRows) Values() ([]any, error) {
+	return r.values[r.pos-1], nil
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	if len(dest) == 1 {
+		switch d := dest[0].(type) {
+		case pgx.RowScanner:
+			return d.ScanRow(r)
+		case *int64:
+			*d = r.values[r.pos-1][0].(int64)
+			return nil
+		case *string:
+			*d = r.values[r.pos-1][0].(string)
+			return nil
+		}
+	}
+	return errors.New("fakeRows only supports RowScanner, count and setting destinations")
+}
+
+// ----------------- Error matrix -----------------
+
+func testStores(t *testing.T) map[string]stores.Store {
+	t.Helper()
+	pgStore, err := stores.NewAuthifyDBFromConn(newFakeConn(), testStoreConfig)
+	if err != nil {
+		t.Fatalf("failed to create pg store: %v", err)
+	}
+	memStore := stores.NewInMemoryUserStore(testStoreConfig)
+	t.Cleanup(func() {
+		memStore.Close()
+		pgStore.Close()
+	})
+	return map[string]stores.Store{
+		"memstore": memStore,
+		"pgstore":  pgStore,
+	}
+}
+
+// TestPGStoreConformance runs the store conformance suite against the postgres store on fakeConn
+func TestPGStoreConformance(t *testing.T) {
+	authifytest.RunStoreConformanceTests(t, func() stores.Store {
+		cfg := authifytest.StoreConfig()
+		conn := newFakeConn()
+		conn.defaults = make(map[string]any)
+		for name, col := range cfg.Columns {
+			if col.Default != "" {
+				conn.defaults[name] = col.Default
+			}
+		}
+		store, err := stores.NewAuthifyDBFromConn(conn, cfg)
+		if err != nil {
+			t.Fatalf("failed to create pg store: %v", err)
+		}
+		return store
+	})
+}
+
+func doRequest(handler http.Handler, method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func assertErrorResponse(t *testing.T, rec *httptest.ResponseRecorder, status int, code authify.AuthErrorCode) {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("expected status %d, got %d (%s)", status, rec.Code, rec.Body.String())
+	}
+	var body errorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode error response: %v", err)
+	}
+	if body.Code != code {
+		t.Errorf("expected code %q, got %q (%s)", code, body.Code, body.Error)
+	}
+}
+
+// countingHasher counts the comparisons made through it. Stores compare the hashes of
+// existing users with the hasher matching their format, so only dummy comparisons,
+// against a hash of its own, reach it.
+type countingHasher struct {
+	stores.BcryptHasher
+	compares atomic.Int64
+}
+
+func (h *countingHasher) Compare(hash, password string) error {
+	h.compares.Add(1)
+	return h.BcryptHasher.Compare(hash, password)
+}
+
+func TestLoginErrorsAreIndistinguishable(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			hasher := &countingHasher{BcryptHasher: stores.BcryptHasher{Cost: 4}}
+			switch s := store.(type) {
+			case *stores.InMemoryUserStore:
+				s.WithPasswordHasher(hasher)
+			case *stores.AuthifyDB:
+				s.WithPasswordHasher(hasher)
+			}
+			router := NewRouter(authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute)))
+
+			if rec := doRequest(router, http.MethodPost, "/v1/users", map[string]string{"authify-username": "alice", "authify-password": "password123"}); rec.Code != http.StatusCreated {
+				t.Fatalf("failed to create user: %s", rec.Body.String())
+			}
+
+			notFound := doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "bob", "authify-password": "password123"})
+			if hasher.compares.Load() != 1 {
+				t.Errorf("expected a dummy password comparison for an unknown user, got %d comparisons", hasher.compares.Load())
+			}
+			wrongPassword := doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "alice", "authify-password": "wrong"})
+
+			if notFound.Code != wrongPassword.Code || notFound.Body.String() != wrongPassword.Body.String() {
+				t.Errorf("expected identical responses, got %d %s and %d %s",
+					notFound.Code, notFound.Body.String(), wrongPassword.Code, wrongPassword.Body.String())
+			}
+			assertErrorResponse(t, notFound, http.StatusUnauthorized, authify.CodeInvalidCredentials)
+		})
+	}
+}
+
+func TestCreateUserResponse(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.Columns = maps.Clone(testStoreConfig.Columns)
+	cfg.Columns["id"] = stores.ColumnConfig{Type: "uuid", Unique: true, Generator: stores.GeneratorUUIDv7}
+	store := stores.NewInMemoryUserStore(cfg)
+	router := NewRouter(authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute)), WithPathPrefix("/auth"))
+
+	rec := doRequest(router, http.MethodPost, "/auth/v1/users", map[string]string{"authify-username": "alice smith", "authify-password": "password123"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create user: %d %s", rec.Code, rec.Body.String())
+	}
+	if location := rec.Header().Get("Location"); location != "/auth/v1/users/alice%20smith" {
+		t.Errorf("expected the location of the user, got %q", location)
+	}
+	var user map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+		t.Fatalf("failed to decode create user response: %v", err)
+	}
+	if user["username"] != "alice smith" || len(user["id"]) != 36 || user["role"] != "user" || len(user) != 3 {
+		t.Errorf("expected the username, generated id and default role, got %v", user)
+	}
+}
+
+func TestCreateUserInvalidFields(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.Columns = maps.Clone(testStoreConfig.Columns)
+	cfg.Columns["email"] = stores.ColumnConfig{Type: "text", MaxLength: 64}
+	store := stores.NewInMemoryUserStore(cfg)
+	router := NewRouter(authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute)))
+
+	testCases := map[string]struct {
+		headers map[string]string
+		code    authify.AuthErrorCode
+		field   string
+	}{
+		"1MB password": {
+			headers: map[string]string{"authify-username": "alice", "authify-password": strings.Repeat("a", 1<<20)},
+			code:    authify.CodeFieldTooLong,
+			field:   "password",
+		},
+		"password over the bcrypt limit": {
+			headers: map[string]string{"authify-username": "alice", "authify-password": strings.Repeat("a", 73)},
+			code:    authify.CodeFieldTooLong,
+			field:   "password",
+		},
+		"invalid UTF-8 username": {
+			headers: map[string]string{"authify-username": "al\xffice", "authify-password": "password123"},
+			code:    authify.CodeInvalidField,
+			field:   "username",
+		},
+		"NUL in email": {
+			headers: map[string]string{"authify-username": "alice", "authify-password": "password123", "authify-email": "alice\x00@example.com"},
+			code:    authify.CodeInvalidField,
+			field:   "email",
+		},
+		"email over max_length": {
+			headers: map[string]string{"authify-username": "alice", "authify-password": "password123", "authify-email": strings.Repeat("a", 65)},
+			code:    authify.CodeFieldTooLong,
+			field:   "email",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rec := doRequest(router, http.MethodPost, "/v1/users", tc.headers)
+			var body errorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("failed to decode error response: %v", err)
+			}
+			if rec.Code != http.StatusBadRequest || body.Code != tc.code || body.Field != tc.field {
+				t.Errorf("expected a 400 with code %s naming %s, got %d %+v", tc.code, tc.field, rec.Code, body)
+			}
+		})
+	}
+	if count, _ := store.CountUsers(); count != 0 {
+		t.Errorf("expected no user to be created, got %d", count)
+	}
+
+	rec := doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "alice", "authify-password": strings.Repeat("a", 1<<20)})
+	assertErrorResponse(t, rec, http.StatusBadRequest, authify.CodeFieldTooLong)
+}
+
+func TestGenerateTokenExpiries(t *testing.T) {
+	router := newTestRouter(t)
+	alice := map[string]string{"authify-username": "alice", "authify-password": "password123"}
+	if rec := doRequest(router, http.MethodPost, "/v1/users", alice); rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create user: %s", rec.Body.String())
+	}
+
+	rec := doRequest(router, http.MethodPost, "/v1/tokens", alice)
+	if !strings.Contains(rec.Body.String(), "Access Token Expires At: ") || !strings.Contains(rec.Body.String(), "Refresh Token Expires At: ") {
+		t.Errorf("expected the expiries in the text response, got %s", rec.Body.String())
+	}
+
+	rec = doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{
+		"authify-username": "alice", "authify-password": "password123", "Accept": "application/json",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	var pair authify.TokenPair
+	if err := json.NewDecoder(rec.Body).Decode(&pair); err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+	if pair.AccessToken == "" || pair.RefreshToken == "" {
+		t.Errorf("expected both tokens, got %+v", pair)
+	}
+	if until := time.Until(pair.AccessExpiresAt); until <= 0 || until > time.Minute {
+		t.Errorf("expected the access token to expire within a minute, got %v", pair.AccessExpiresAt)
+	}
+	if !pair.RefreshExpiresAt.After(pair.AccessExpiresAt) {
+		t.Errorf("expected the refresh token to outlive the access token, got %v", pair.RefreshExpiresAt)
+	}
+}
+
+func TestVerifyTokenExpiry(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	manager := newTestJWTManager(t, store, time.Minute).WithSlidingExpiration(2 * time.Minute)
+	router := NewRouter(authify.NewAuthify(store, manager))
+	alice := map[string]string{"authify-username": "alice", "authify-password": "password123"}
+	if rec := doRequest(router, http.MethodPost, "/v1/users", alice); rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create user: %s", rec.Body.String())
+	}
+	alice["Accept"] = "application/json"
+	var pair authify.TokenPair
+	if err := json.NewDecoder(doRequest(router, http.MethodPost, "/v1/tokens", alice).Body).Decode(&pair); err != nil {
+		t.Fatalf("failed to decode token response: %v", err)
+	}
+
+	// every token is within the threshold, but a replacement lasting as long is not worth sending
+	headers := map[string]string{"authify-access": pair.AccessToken, "Accept": "application/json"}
+	rec := doRequest(router, http.MethodPost, "/v1/tokens/verify", headers)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	var resp verifyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode verify response: %v", err)
+	}
+	if !resp.ExpiresAt.Equal(pair.AccessExpiresAt.Truncate(time.Second)) {
+		t.Errorf("expected the token to expire at %v, got %v", pair.AccessExpiresAt, resp.ExpiresAt)
+	}
+	if resp.ExpiresIn <= 0 || resp.ExpiresIn > 60 {
+		t.Errorf("expected the token to expire within a minute, got %d", resp.ExpiresIn)
+	}
+	if got := rec.Header().Get(middleware.TokenExpiresInHeader); got != strconv.FormatInt(resp.ExpiresIn, 10) {
+		t.Errorf("expected the header to match expires_in %d, got %q", resp.ExpiresIn, got)
+	}
+	if resp.RefreshedToken != "" || rec.Header().Get(middleware.RefreshedTokenHeader) != "" {
+		t.Errorf("expected no replacement, got %q", resp.RefreshedToken)
+	}
+
+	if err := manager.SetDurations(5*time.Minute, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	rec = doRequest(router, http.MethodPost, "/v1/tokens/verify", headers)
+	resp = verifyResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode verify response: %v", err)
+	}
+	if resp.RefreshedToken == "" || rec.Header().Get(middleware.RefreshedTokenHeader) != resp.RefreshedToken {
+		t.Fatalf("expected the replacement in the body and headers, got %q", resp.RefreshedToken)
+	}
+	headers["authify-access"] = resp.RefreshedToken
+	rec = doRequest(router, http.MethodPost, "/v1/tokens/verify", headers)
+	resp = verifyResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode verify response: %v", err)
+	}
+	if resp.ExpiresIn <= 60 {
+		t.Errorf("expected the replacement to last longer, got %d seconds", resp.ExpiresIn)
+	}
+}
+
+func TestGenerateTokenBadCredentials(t *testing.T) {
+	router := newTestRouter(t, WithLegacyRoutes())
+	if rec := doRequest(router, http.MethodPost, "/v1/users", map[string]string{"authify-username": "alice", "authify-password": "password123"}); rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create user: %s", rec.Body.String())
+	}
+
+	for _, path := range []string{"/v1/tokens", "/generate-token"} {
+		t.Run(path, func(t *testing.T) {
+			rec := doRequest(router, http.MethodPost, path, map[string]string{"authify-username": "alice", "authify-password": "wrong"})
+			if strings.Contains(rec.Body.String(), "Token") {
+				t.Errorf("expected no token in the response, got %s", rec.Body.String())
+			}
+			dec := json.NewDecoder(rec.Body)
+			var body errorResponse
+			if err := dec.Decode(&body); err != nil {
+				t.Fatalf("failed to decode error response: %v", err)
+			}
+			if rec.Code != http.StatusUnauthorized || body.Code != authify.CodeInvalidCredentials {
+				t.Errorf("expected 401 %q, got %d %q", authify.CodeInvalidCredentials, rec.Code, body.Code)
+			}
+			if dec.More() {
+				t.Errorf("expected a single error response, got more after %+v", body)
+			}
+		})
+	}
+}
+
+func TestErrorMatrix(t *testing.T) {
+	alice := map[string]string{"authify-username": "alice", "authify-password": "password123"}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute))
+			router := NewRouter(a)
+			// login failures are only told apart with precise errors, see TestLoginErrorsAreIndistinguishable
+			preciseRouter := NewRouter(authify.NewAuthify(store, a.Tokens).WithPreciseLoginErrors(true))
+
+			if rec := doRequest(router, http.MethodPost, "/v1/users", alice); rec.Code != http.StatusCreated {
+				t.Fatalf("failed to create user: %s", rec.Body.String())
+			}
+
+			t.Run("user-exists", func(t *testing.T) {
+				_, err := store.CreateUser(map[string]any{"username": "alice", "password": "x"})
+				if !errors.Is(err, authify.ErrUserExists) {
+					t.Errorf("expected ErrUserExists, got %v", err)
+				}
+				rec := doRequest(router, http.MethodPost, "/v1/users", alice)
+				assertErrorResponse(t, rec, http.StatusConflict, authify.CodeUserExists)
+			})
+
+			t.Run("user-not-found", func(t *testing.T) {
+				_, err := store.GetUserInfo("bob", "password123")
+				if !errors.Is(err, authify.ErrUserNotFound) {
+					t.Errorf("expected ErrUserNotFound, got %v", err)
+				}
+				rec := doRequest(preciseRouter, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "bob", "authify-password": "password123"})
+				assertErrorResponse(t, rec, http.StatusNotFound, authify.CodeUserNotFound)
+			})
+
+			t.Run("invalid-password", func(t *testing.T) {
+				_, err := store.GetUserInfo("alice", "wrong")
+				if !errors.Is(err, authify.ErrInvalidPassword) {
+					t.Errorf("expected ErrInvalidPassword, got %v", err)
+				}
+				rec := doRequest(preciseRouter, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "alice", "authify-password": "wrong"})
+				assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeInvalidPassword)
+			})
+
+			t.Run("token-expired", func(t *testing.T) {
+				expired, err := newTestJWTManager(t, store, -time.Minute).GenerateAccessToken("alice", "password123")
+				if err != nil {
+					t.Fatalf("failed to generate token: %v", err)
+				}
+				_, err = a.Tokens.VerifyAccessToken(expired)
+				if !errors.Is(err, authify.ErrTokenExpired) {
+					t.Errorf("expected ErrTokenExpired, got %v", err)
+				}
+				rec := doRequest(router, http.MethodPost, "/v1/tokens/verify", map[string]string{"authify-access": expired})
+				assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeTokenExpired)
+			})
+
+			t.Run("exchange-forbidden", func(t *testing.T) {
+				accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+				if err != nil {
+					t.Fatalf("failed to generate token: %v", err)
+				}
+				// no role may act on behalf of users without an exchange config
+				rec := doRequest(router, http.MethodPost, "/v1/tokens/exchange", map[string]string{
+					"authify-access":   accessToken,
+					"authify-username": "alice",
+					"authify-password": "password123",
+				})
+				assertErrorResponse(t, rec, http.StatusForbidden, authify.CodeExchangeForbidden)
+			})
+		})
+	}
+}
+
+// readinessStore reports err as its readiness, see stores.ReadinessChecker
+type readinessStore struct {
+	stores.Store
+	err error
+}
+
+func (s *readinessStore) Ready(ctx context.Context) error { return s.err }
+
+func TestReadyz(t *testing.T) {
+	memstore := stores.NewInMemoryUserStore(testStoreConfig)
+	down := &readinessStore{Store: memstore, err: stores.ErrStoreUnavailable}
+
+	router := NewRouter(authify.NewAuthify(down, newTestJWTManager(t, down, time.Minute)))
+	assertErrorResponse(t, doRequest(router, http.MethodGet, "/readyz", nil), http.StatusServiceUnavailable, authify.CodeStoreUnavailable)
+
+	// stores that cannot tell are always ready
+	for _, store := range []stores.Store{memstore, &readinessStore{Store: memstore}} {
+		router := NewRouter(authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute)))
+		rec := doRequest(router, http.MethodGet, "/readyz", nil)
+		var resp readyResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK || resp.Status != "ready" {
+			t.Errorf("expected a ready response, got %d: %v", rec.Code, resp)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// IdempotencyKeyHeader is the request header making "POST /v1/users" idempotent, see WithIdempotency
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// MaxIdempotencyKeyLength bounds the Idempotency-Key header, longer keys are rejected
+const MaxIdempotencyKeyLength = 255
+
+// Codes of failed idempotent requests
+const (
+	codeInvalidIdempotencyKey authify.AuthErrorCode = "invalid_idempotency_key"
+	codeIdempotencyKeyInUse   authify.AuthErrorCode = "idempotency_key_in_use"
+	codeIdempotencyKeyReused  authify.AuthErrorCode = "idempotency_key_reused"
+)
+
+var (
+	// ErrIdempotencyKeyInUse is returned by IdempotencyStore.Begin while the first request of a key is running
+	ErrIdempotencyKeyInUse = errors.New("a request with this idempotency key is in progress")
+	// ErrIdempotencyKeyReused is returned by IdempotencyStore.Begin for a key first used with another request
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used with a different request")
+)
+
+// IdempotentResponse is the response recorded for an idempotency key, replayed to repeated requests.
+type IdempotentResponse struct {
+	Status      int
+	ContentType string
+	// Location is the Location header of the response, such as the URL of a created user
+	Location string
+	Body     []byte
+}
+
+// IdempotencyStore records the responses of idempotent requests, keyed by their Idempotency-Key.
+// Implementations must be safe for concurrent use, and shared by the replicas of a deployment for
+// retries reaching another replica to be recognized.
+type IdempotencyStore interface {
+	// Begin claims key for a request identified by fingerprint, for ttl. It returns the response
+	// recorded for key, or nil once the caller claimed it, who must then Complete or Release it.
+	// It fails with ErrIdempotencyKeyInUse while key is claimed, and with ErrIdempotencyKeyReused
+	// when key was claimed with another fingerprint.
+	Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*IdempotentResponse, error)
+	// Complete records the response of the request holding key, kept for ttl from now
+	Complete(ctx context.Context, key string, resp IdempotentResponse, ttl time.Duration) error
+	// Release forgets key, so the request can be retried, e.g. after a server error
+	Release(ctx context.Context, key string) error
+}
+
+// WithIdempotency lets clients retry "POST /v1/users" safely: requests carrying an Idempotency-Key
+// header are run once, and repeated with the same key and the same authify-* headers within ttl,
+// they get the response of the first one, with an "Idempotent-Replayed: true" header, instead of
+// creating the user again. The same key with different headers gets a 422, and a 409 while the
+// first request is still running. Responses of server errors are not recorded, so the request can
+// be retried. Passwords are not part of the comparison, they are not kept, not even hashed.
+func WithIdempotency(store IdempotencyStore, ttl time.Duration) Option {
+	return func(o *options) {
+		o.idempotency = store
+		o.idempotencyTTL = ttl
+	}
+}
+
+// idempotent serves the request with run once per idempotency key, replaying the recorded
+// response when the key was used before. Requests without the header are served as usual.
+func (h *handler) idempotent(w http.ResponseWriter, r *http.Request, fingerprint string, run func(w http.ResponseWriter)) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if !h.caps.Enabled(authify.FeatureIdempotency) || key == "" {
+		run(w)
+		return
+	}
+	if len(key) > MaxIdempotencyKeyLength {
+		writeJSONError(w, http.StatusBadRequest, codeInvalidIdempotencyKey, fmt.Sprintf("%s exceeds %d bytes", IdempotencyKeyHeader, MaxIdempotencyKeyLength))
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	recorded, err := h.opts.idempotency.Begin(ctx, key, fingerprint, h.opts.idempotencyTTL)
+	switch {
+	case errors.Is(err, ErrIdempotencyKeyInUse):
+		writeJSONError(w, http.StatusConflict, codeIdempotencyKeyInUse, err.Error())
+		return
+	case errors.Is(err, ErrIdempotencyKeyReused):
+		writeJSONError(w, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, err.Error())
+		return
+	case err != nil:
+		writeError(w, fmt.Errorf("Error checking idempotency key: %w", err))
+		return
+	case recorded != nil:
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Header().Set("Content-Type", recorded.ContentType)
+		if recorded.Location != "" {
+			w.Header().Set("Location", recorded.Location)
+		}
+		w.WriteHeader(recorded.Status)
+		w.Write(recorded.Body)
+		return
+	}
+
+	rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		if err := h.opts.idempotency.Release(ctx, key); err != nil {
+			logf(r.Context(), "Error releasing idempotency key: %v\n", err)
+		}
+	}()
+	run(rec)
+
+	if rec.status >= http.StatusInternalServerError {
+		return
+	}
+	resp := IdempotentResponse{
+		Status:      rec.status,
+		ContentType: rec.Header().Get("Content-Type"),
+		Location:    rec.Header().Get("Location"),
+		Body:        rec.body,
+	}
+	if err := h.opts.idempotency.Complete(ctx, key, resp, h.opts.idempotencyTTL); err != nil {
+		logf(r.Context(), "Error recording idempotent response: %v\n", err)
+		return
+	}
+	completed = true
+}
+
+// userFingerprint identifies the fields a user is created with, leaving out passwords
+func userFingerprint(storeCfg stores.StoreConfig, userData map[string]any) string {
+	hash := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(userData)) {
+		if storeCfg.Columns[name].IsPassword {
+			continue
+		}
+		fmt.Fprintf(hash, "%d:%s=%v\n", len(name), name, userData[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotencyRecorder keeps a copy of the response written through it
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        []byte
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body = append(r.body, b...)
+	return r.ResponseWriter.Write(b)
+}
+
+// InMemoryIdempotencyStore keeps the responses of idempotent requests in memory, for single-instance deployments.
+type InMemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]idempotencyEntry
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	resp        *IdempotentResponse // nil while the request runs
+	expiresAt   time.Time
+}
+
+// NewInMemoryIdempotencyStore returns an empty store.
+func NewInMemoryIdempotencyStore() *InMemoryIdempotencyStore {
+	return &InMemoryIdempotencyStore{entries: make(map[string]idempotencyEntry), now: time.Now}
+}
+
+func (s *InMemoryIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, ttl time.Duration) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expiresAt) {
+		switch {
+		case entry.fingerprint != fingerprint:
+			return nil, ErrIdempotencyKeyReused
+		case entry.resp == nil:
+			return nil, ErrIdempotencyKeyInUse
+		}
+		return entry.resp, nil
+	}
+	s.entries[key] = idempotencyEntry{fingerprint: fingerprint, expiresAt: now.Add(ttl)}
+	return nil, nil
+}
+
+func (s *InMemoryIdempotencyStore) Complete(ctx context.Context, key string, resp IdempotentResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return fmt.Errorf("idempotency key was not claimed")
+	}
+	entry.resp = &resp
+	entry.expiresAt = s.now().Add(ttl)
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *InMemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// sweep drops the expired entries, at most once a minute
+func (s *InMemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateUserIdempotency(t *testing.T) {
+	router := newTestRouter(t, WithIdempotency(NewInMemoryIdempotencyStore(), time.Hour))
+	alice := map[string]string{"authify-username": "alice", "authify-password": "password123", IdempotencyKeyHeader: "signup-1"}
+
+	first := doRequest(router, http.MethodPost, "/v1/users", alice)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", first.Code, first.Body.String())
+	}
+
+	t.Run("same key and headers replay the response", func(t *testing.T) {
+		rec := doRequest(router, http.MethodPost, "/v1/users", alice)
+		if rec.Code != http.StatusCreated || rec.Body.String() != first.Body.String() {
+			t.Errorf("expected the first response, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("expected the response to be marked as replayed")
+		}
+		if rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("expected the content type to be replayed, got %q", rec.Header().Get("Content-Type"))
+		}
+		if rec.Header().Get("Location") != "/v1/users/alice" {
+			t.Errorf("expected the location to be replayed, got %q", rec.Header().Get("Location"))
+		}
+	})
+
+	t.Run("same key and other headers", func(t *testing.T) {
+		bob := map[string]string{"authify-username": "bob", "authify-password": "password123", IdempotencyKeyHeader: "signup-1"}
+		assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/users", bob), http.StatusUnprocessableEntity, codeIdempotencyKeyReused)
+	})
+
+	t.Run("other key creates again", func(t *testing.T) {
+		retry := map[string]string{"authify-username": "alice", "authify-password": "password123", IdempotencyKeyHeader: "signup-2"}
+		assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/users", retry), http.StatusConflict, "user_exists")
+	})
+
+	t.Run("without key", func(t *testing.T) {
+		retry := map[string]string{"authify-username": "alice", "authify-password": "password123"}
+		assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/users", retry), http.StatusConflict, "user_exists")
+	})
+
+	t.Run("key too long", func(t *testing.T) {
+		long := map[string]string{"authify-username": "carol", "authify-password": "password123", IdempotencyKeyHeader: strings.Repeat("k", MaxIdempotencyKeyLength+1)}
+		assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/users", long), http.StatusBadRequest, codeInvalidIdempotencyKey)
+	})
+}
+
+func TestCreateUserIdempotencyDisabled(t *testing.T) {
+	router := newTestRouter(t)
+	alice := map[string]string{"authify-username": "alice", "authify-password": "password123", IdempotencyKeyHeader: "signup-1"}
+	if rec := doRequest(router, http.MethodPost, "/v1/users", alice); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/users", alice), http.StatusConflict, "user_exists")
+}
+
+func TestInMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryIdempotencyStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	if resp, err := store.Begin(ctx, "key", "a", time.Minute); resp != nil || err != nil {
+		t.Fatalf("expected the key to be claimed, got %v, %v", resp, err)
+	}
+	if _, err := store.Begin(ctx, "key", "a", time.Minute); !errors.Is(err, ErrIdempotencyKeyInUse) {
+		t.Errorf("expected ErrIdempotencyKeyInUse while the request runs, got %v", err)
+	}
+
+	// a released key, e.g. after a server error, can be claimed again
+	if err := store.Release(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Begin(ctx, "key", "a", time.Minute); err != nil {
+		t.Fatalf("expected the released key to be claimed again, got %v", err)
+	}
+	if err := store.Complete(ctx, "key", IdempotentResponse{Status: http.StatusOK, Body: []byte("{}")}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := store.Begin(ctx, "key", "a", time.Minute); err != nil || resp == nil || resp.Status != http.StatusOK {
+		t.Errorf("expected the recorded response, got %v, %v", resp, err)
+	}
+	if _, err := store.Begin(ctx, "key", "b", time.Minute); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("expected ErrIdempotencyKeyReused, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if resp, err := store.Begin(ctx, "key", "b", time.Minute); resp != nil || err != nil {
+		t.Errorf("expected the expired key to be claimed anew, got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,60 @@
+package httpapi
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/HassanAli101/authify/token"
+)
+
+// introspect handles the "POST /v1/introspect" route.
+// It implements token introspection (RFC 7662): the token form parameter is verified
+// and its claims are returned along with "active": true, while invalid or expired
+// tokens only yield {"active": false} and never an error status.
+// Access and refresh tokens are both accepted, the token_type_hint parameter
+// ("access_token" or "refresh_token") decides which verification is tried first.
+// Callers authenticate like OAuth2 clients when the router was built WithOAuthClient.
+func (h *handler) introspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeOAuthError(w, http.StatusMethodNotAllowed, oauthInvalidRequest, "introspection endpoint only accepts POST")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidRequest, err.Error())
+		return
+	}
+
+	if !h.authenticateOAuthClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="authify"`)
+		writeOAuthError(w, http.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+		return
+	}
+
+	tokenStr := r.PostForm.Get("token")
+	if tokenStr == "" {
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidRequest, "token is required")
+		return
+	}
+
+	kinds := []bool{false, true}
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		slices.Reverse(kinds)
+	}
+
+	for _, refresh := range kinds {
+		verified, err := h.auth.Tokens.VerifyToken(r.Context(), token.VerifyTokenRequest{Token: tokenStr, Refresh: refresh})
+		if err != nil {
+			continue
+		}
+
+		resp := maps.Clone(verified.Claims)
+		resp["active"] = true
+		writeOAuthJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	writeOAuthJSON(w, http.StatusOK, map[string]any{"active": false})
+}
@@ -0,0 +1,90 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+)
+
+func TestIntrospect(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute))
+	router := NewRouter(a)
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	refreshToken, err := a.Tokens.GenerateRefreshToken("alice", nil)
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+	expired, err := newTestJWTManager(t, store, -time.Minute).GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate expired token: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		hint   string
+		active bool
+	}{
+		{"access token", accessToken, "", true},
+		{"refresh token with hint", refreshToken, "refresh_token", true},
+		{"refresh token without hint", refreshToken, "", true},
+		{"access token with wrong hint", accessToken, "refresh_token", true},
+		{"expired token", expired, "", false},
+		{"garbage", "not-a-token", "access_token", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{"token": {tc.token}}
+			if tc.hint != "" {
+				form.Set("token_type_hint", tc.hint)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/v1/introspect", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var body map[string]any
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if body["active"] != tc.active {
+				t.Errorf("expected active=%v, got %v", tc.active, body)
+			}
+			if tc.active && (body["username"] != "alice" || body["exp"] == nil || body["iat"] == nil) {
+				t.Errorf("expected the token claims in the response, got %v", body)
+			}
+			if !tc.active && len(body) != 1 {
+				t.Errorf("expected only the active field for an inactive token, got %v", body)
+			}
+		})
+	}
+
+	t.Run("missing token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/introspect", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+)
+
+// createInviteRequest is the body accepted by the invite creation route
+type createInviteRequest struct {
+	MaxUses    *int  `json:"max_uses"`
+	TTLSeconds int64 `json:"ttl_seconds"`
+}
+
+// createInviteResponse is the body returned by the invite creation route, the only one
+// carrying the code of the invite
+type createInviteResponse struct {
+	Code string `json:"code"`
+	stores.Invite
+}
+
+// listInvitesResponse is the body returned by the invite listing route
+type listInvitesResponse struct {
+	Invites []stores.Invite `json:"invites"`
+}
+
+// createInvite handles the "POST /admin/invites" route.
+// It is mounted behind middleware.RequireScope with authify.AdminScope, reads
+// {"max_uses": 1, "ttl_seconds": 86400} from the body, both optional and unlimited when zero,
+// max_uses defaulting to a single use, and responds with the invite and its code, see
+// authify.CreateInvite.
+func (h *handler) createInvite(w http.ResponseWriter, r *http.Request) {
+	var req createInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, fmt.Errorf("%w: max_uses, ttl_seconds", stores.ErrMissingField))
+		return
+	}
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+	if maxUses < 0 || req.TTLSeconds < 0 {
+		writeError(w, fmt.Errorf("%w: max_uses and ttl_seconds must not be negative", stores.ErrMissingField))
+		return
+	}
+
+	var expiresAt time.Time
+	if req.TTLSeconds > 0 {
+		expiresAt = time.Now().Add(time.Duration(req.TTLSeconds) * time.Second)
+	}
+	code, invite, err := h.auth.CreateInvite(r.Context(), maxUses, expiresAt)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error creating invite: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(createInviteResponse{Code: code, Invite: invite}); err != nil {
+		logf(r.Context(), "Error writing create invite response: %v\n", err)
+	}
+	logf(r.Context(), "Created invite %v\n", invite.ID)
+}
+
+// listInvites handles the "GET /admin/invites" route.
+// It is mounted behind middleware.RequireScope with authify.AdminScope, and responds with
+// every invite, without their codes, see authify.ListInvites.
+func (h *handler) listInvites(w http.ResponseWriter, r *http.Request) {
+	invites, err := h.auth.ListInvites(r.Context())
+	if err != nil {
+		writeError(w, fmt.Errorf("Error listing invites: %w", err))
+		return
+	}
+	if invites == nil {
+		invites = []stores.Invite{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(listInvitesResponse{Invites: invites}); err != nil {
+		logf(r.Context(), "Error writing invite list response: %v\n", err)
+	}
+}
@@ -0,0 +1,83 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+)
+
+func TestRegistrationInvites(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {authify.AdminScope}}
+	store := stores.NewInMemoryUserStore(cfg)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	a := authify.NewAuthify(store, tokens).WithRegistrationPolicy(authify.RegistrationInvite, stores.NewInMemoryInviteStore())
+	router := NewRouter(a)
+
+	_, _ = store.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin"})
+	_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+	adminToken := generateToken(t, tokens, "root")
+	userToken := generateToken(t, tokens, "alice")
+
+	admin := func(method, accessToken, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/invites", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	signUp := func(username string, headers map[string]string) *httptest.ResponseRecorder {
+		all := map[string]string{"authify-username": username, "authify-password": "password123"}
+		for k, v := range headers {
+			all[k] = v
+		}
+		return doRequest(router, http.MethodPost, "/v1/users", all)
+	}
+
+	assertErrorResponse(t, admin(http.MethodPost, userToken, `{}`), http.StatusForbidden, authify.CodeInsufficientScope)
+	assertErrorResponse(t, admin(http.MethodPost, adminToken, `{"max_uses": -1}`), http.StatusBadRequest, authify.CodeMissingField)
+
+	rec := admin(http.MethodPost, adminToken, "")
+	var single createInviteResponse
+	if err := json.NewDecoder(rec.Body).Decode(&single); err != nil || rec.Code != http.StatusCreated || single.MaxUses != 1 {
+		t.Fatalf("expected an empty body to create a single use invite, got %d %+v (%v)", rec.Code, single, err)
+	}
+
+	rec = admin(http.MethodPost, adminToken, `{"max_uses": 1, "ttl_seconds": 3600}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected the invite to be created, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created createInviteResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || created.Code == "" || created.MaxUses != 1 || created.ExpiresAt.IsZero() {
+		t.Fatalf("unexpected invite response %+v (%v)", created, err)
+	}
+
+	assertErrorResponse(t, signUp("bob", nil), http.StatusForbidden, authify.CodeInviteRequired)
+	assertErrorResponse(t, signUp("bob", map[string]string{"authify-invite": "unknown"}), http.StatusForbidden, authify.CodeInvalidInvite)
+	if rec := signUp("bob", map[string]string{"authify-invite": created.Code}); rec.Code != http.StatusCreated {
+		t.Fatalf("expected bob to sign up with the invite, got %d: %s", rec.Code, rec.Body.String())
+	}
+	assertErrorResponse(t, signUp("carol", map[string]string{"authify-invite": created.Code}), http.StatusForbidden, authify.CodeInvalidInvite)
+	if rec := signUp("carol", map[string]string{"Authorization": "Bearer " + adminToken}); rec.Code != http.StatusCreated {
+		t.Errorf("expected an administrator to create carol without an invite, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = admin(http.MethodGet, adminToken, "")
+	var list listInvitesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil || len(list.Invites) != 2 || list.Invites[1].Uses != 1 {
+		t.Errorf("expected the used invite, got %+v (%v)", list, err)
+	}
+	if strings.Contains(rec.Body.String(), created.Code) {
+		t.Error("expected the invite listing to leave out the codes")
+	}
+
+	a.WithRegistrationPolicy(authify.RegistrationClosed, nil)
+	assertErrorResponse(t, signUp("dave", map[string]string{"authify-invite": created.Code}), http.StatusForbidden, authify.CodeRegistrationClosed)
+	assertErrorResponse(t, admin(http.MethodGet, adminToken, ""), http.StatusNotImplemented, authify.CodeNotSupported)
+}
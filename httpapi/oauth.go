@@ -0,0 +1,211 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/secrets"
+	"github.com/HassanAli101/authify/token"
+)
+
+// OAuth2 error codes, as defined in RFC 6749 section 5.2
+const (
+	oauthInvalidRequest       = "invalid_request"
+	oauthInvalidClient        = "invalid_client"
+	oauthInvalidGrant         = "invalid_grant"
+	oauthUnsupportedGrantType = "unsupported_grant_type"
+	oauthInvalidScope         = "invalid_scope"
+	oauthServerError          = "server_error"
+)
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type oauthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// oauthToken handles the "POST /v1/oauth/token" route.
+// It implements the OAuth2 password, refresh_token and client_credentials grants (RFC 6749
+// sections 4.3, 6 and 4.4) on top of the regular token manager, so that stock OAuth2 clients
+// can authenticate. When the router was built WithOAuthClient, the client of the password and
+// refresh_token grants must authenticate with those credentials using HTTP Basic auth or the
+// client_id/client_secret form fields. Service accounts authenticate the same way with their
+// own credentials in the client_credentials grant.
+func (h *handler) oauthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeOAuthError(w, http.StatusMethodNotAllowed, oauthInvalidRequest, "token endpoint only accepts POST")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidRequest, err.Error())
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	// service accounts are the client of the grant, they do not use the configured one
+	if grantType == "client_credentials" {
+		h.clientCredentialsGrant(w, r)
+		return
+	}
+
+	if !h.authenticateOAuthClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="authify"`)
+		writeOAuthError(w, http.StatusUnauthorized, oauthInvalidClient, "client authentication failed")
+		return
+	}
+
+	switch grantType {
+	case "password":
+		h.passwordGrant(w, r)
+	case "refresh_token":
+		h.refreshTokenGrant(w, r)
+	case "":
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidRequest, "grant_type is required")
+	default:
+		writeOAuthError(w, http.StatusBadRequest, oauthUnsupportedGrantType, "only password, refresh_token and client_credentials grants are supported")
+	}
+}
+
+func (h *handler) passwordGrant(w http.ResponseWriter, r *http.Request) {
+	username := r.PostForm.Get("username")
+	password := secrets.SecretString(r.PostForm.Get("password"))
+	if username == "" || password == "" {
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidRequest, "username and password are required")
+		return
+	}
+
+	device := h.deviceFromRequest(r)
+	pair, err := h.auth.LoginContext(r.Context(), username, password.Reveal(), device)
+	if err != nil {
+		logf(r.Context(), "OAuth password grant failed for %s: %v\n", username, err)
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidGrant, "invalid username or password")
+		return
+	}
+
+	writeOAuthToken(w, oauthTokenResponse{
+		AccessToken:  pair.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(pair.AccessExpiresAt).Seconds()),
+		RefreshToken: pair.RefreshToken,
+	})
+	logf(r.Context(), "Generated token for user with username: %v from %v via oauth password grant\n", username, device.Sanitize())
+}
+
+func (h *handler) refreshTokenGrant(w http.ResponseWriter, r *http.Request) {
+	refreshToken := r.PostForm.Get("refresh_token")
+	if refreshToken == "" {
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidRequest, "refresh_token is required")
+		return
+	}
+
+	pair, err := h.auth.RefreshTokens(r.Context(), token.RefreshTokensRequest{RefreshToken: refreshToken, Device: h.deviceFromRequest(r)})
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidGrant, err.Error())
+		return
+	}
+
+	resp := oauthTokenResponse{AccessToken: pair.AccessToken, TokenType: "Bearer"}
+	// token managers rotating refresh tokens revoked the one sent (RFC 6749 section 6)
+	if pair.RefreshToken != refreshToken {
+		resp.RefreshToken = pair.RefreshToken
+	}
+	if !pair.AccessExpiresAt.IsZero() {
+		resp.ExpiresIn = int64(time.Until(pair.AccessExpiresAt).Seconds())
+	}
+	writeOAuthToken(w, resp)
+	logf(r.Context(), "Refreshed token for user with claims: %v via oauth refresh_token grant\n", pair.AccessClaims)
+}
+
+// clientCredentialsGrant issues a service token to the service account authenticating as the
+// client, with the scopes of the space-delimited scope field or every scope allowed to it.
+// No refresh token is issued.
+func (h *handler) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret := oauthClientCredentials(r)
+	if clientID == "" || clientSecret == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="authify"`)
+		writeOAuthError(w, http.StatusUnauthorized, oauthInvalidClient, "client_id and client_secret are required")
+		return
+	}
+
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	accessToken, expiresAt, err := h.auth.GenerateServiceToken(r.Context(), clientID, clientSecret, scopes)
+	switch {
+	case errors.Is(err, authify.ErrInvalidClientCredentials), errors.Is(err, authify.ErrAccountDisabled):
+		logf(r.Context(), "OAuth client_credentials grant failed for %s: %v\n", clientID, err)
+		w.Header().Set("WWW-Authenticate", `Basic realm="authify"`)
+		writeOAuthError(w, http.StatusUnauthorized, oauthInvalidClient, err.Error())
+		return
+	case errors.Is(err, authify.ErrInvalidScope):
+		writeOAuthError(w, http.StatusBadRequest, oauthInvalidScope, err.Error())
+		return
+	case errors.Is(err, authify.ErrServiceAccountsNotSupported):
+		writeOAuthError(w, http.StatusBadRequest, oauthUnsupportedGrantType, err.Error())
+		return
+	case err != nil:
+		logf(r.Context(), "OAuth client_credentials grant failed for %s: %v\n", clientID, err)
+		writeOAuthError(w, http.StatusInternalServerError, oauthServerError, "failed to issue the token")
+		return
+	}
+
+	writeOAuthToken(w, oauthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(time.Until(expiresAt).Seconds()),
+	})
+	logf(r.Context(), "Generated service token for client %v via oauth client_credentials grant\n", clientID)
+}
+
+// authenticateOAuthClient checks the client credentials when they are configured,
+// client authentication is optional otherwise.
+func (h *handler) authenticateOAuthClient(r *http.Request) bool {
+	if h.opts.oauthClientID == "" {
+		return true
+	}
+
+	clientID, clientSecret := oauthClientCredentials(r)
+	idMatch := secrets.ConstantTimeEquals(clientID, h.opts.oauthClientID)
+	secretMatch := h.opts.oauthClientSecret.Equals(clientSecret)
+	return idMatch && secretMatch
+}
+
+// oauthClientCredentials reads the credentials of the client from HTTP Basic auth,
+// or the client_id/client_secret form fields
+func oauthClientCredentials(r *http.Request) (clientID, clientSecret string) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	return clientID, clientSecret
+}
+
+func writeOAuthToken(w http.ResponseWriter, resp oauthTokenResponse) {
+	writeOAuthJSON(w, http.StatusOK, resp)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	writeOAuthJSON(w, status, oauthErrorResponse{Error: code, ErrorDescription: description})
+}
+
+func writeOAuthJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error writing oauth response: %v\n", err)
+	}
+}
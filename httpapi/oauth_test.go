@@ -0,0 +1,242 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+func setupOAuthServer(t *testing.T) (*httptest.Server, *oauth2.Config, *authify.Authify) {
+	t.Helper()
+	return setupOAuthServerWith(t, func(store stores.Store) token.TokenManager {
+		return newTestJWTManager(t, store, time.Minute)
+	})
+}
+
+// setupOAuthServerWith is setupOAuthServer with the token manager newManager returns
+func setupOAuthServerWith(t *testing.T, newManager func(store stores.Store) token.TokenManager) (*httptest.Server, *oauth2.Config, *authify.Authify) {
+	t.Helper()
+
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	a := authify.NewAuthify(store, newManager(store))
+
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	srv := httptest.NewServer(NewRouter(a, WithOAuthClient("grafana", "grafana-secret")))
+	t.Cleanup(srv.Close)
+
+	return srv, &oauth2.Config{
+		ClientID:     "grafana",
+		ClientSecret: "grafana-secret",
+		Endpoint: oauth2.Endpoint{
+			TokenURL:  srv.URL + "/v1/oauth/token",
+			AuthStyle: oauth2.AuthStyleInHeader,
+		},
+	}, a
+}
+
+func TestOAuthPasswordAndRefreshGrant(t *testing.T) {
+	managers := map[string]func(store stores.Store) token.TokenManager{
+		"jwt": func(store stores.Store) token.TokenManager { return newTestJWTManager(t, store, time.Minute) },
+		"opaque": func(store stores.Store) token.TokenManager {
+			return token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour).WithStore(store)
+		},
+	}
+	for name, newManager := range managers {
+		t.Run(name, func(t *testing.T) {
+			_, conf, a := setupOAuthServerWith(t, newManager)
+			ctx := context.Background()
+
+			tok, err := conf.PasswordCredentialsToken(ctx, "alice", "password123")
+			if err != nil {
+				t.Fatalf("password grant failed: %v", err)
+			}
+			if tok.AccessToken == "" || tok.RefreshToken == "" {
+				t.Fatalf("expected access and refresh tokens, got %+v", tok)
+			}
+			if tok.TokenType != "Bearer" || tok.Expiry.IsZero() {
+				t.Errorf("expected bearer token with expiry, got type %q expiry %v", tok.TokenType, tok.Expiry)
+			}
+			if _, err := a.Tokens.VerifyAccessToken(tok.AccessToken); err != nil {
+				t.Errorf("issued access token does not verify: %v", err)
+			}
+
+			// an expired token makes the token source use the refresh_token grant, which sends no access token
+			expired := &oauth2.Token{RefreshToken: tok.RefreshToken, Expiry: time.Now().Add(-time.Minute)}
+			refreshed, err := conf.TokenSource(ctx, expired).Token()
+			if err != nil {
+				t.Fatalf("refresh_token grant failed: %v", err)
+			}
+			if refreshed.AccessToken == "" || refreshed.RefreshToken == "" || refreshed.Expiry.IsZero() {
+				t.Errorf("expected a refreshed token with a refresh token and an expiry, got %+v", refreshed)
+			}
+			claims, err := a.Tokens.VerifyAccessToken(refreshed.AccessToken)
+			if err != nil {
+				t.Fatalf("refreshed access token does not verify: %v", err)
+			}
+			if role := token.RoleFromClaims(a.Tokens, claims); role != "user" {
+				t.Errorf("expected the refreshed token to carry the role of the store, got %q", role)
+			}
+		})
+	}
+}
+
+func TestOAuthErrors(t *testing.T) {
+	srv, conf, _ := setupOAuthServer(t)
+	ctx := context.Background()
+
+	_, err := conf.PasswordCredentialsToken(ctx, "alice", "wrong")
+	assertOAuthError(t, err, http.StatusBadRequest, "invalid_grant")
+
+	badClient := *conf
+	badClient.ClientSecret = "nope"
+	_, err = badClient.PasswordCredentialsToken(ctx, "alice", "password123")
+	assertOAuthError(t, err, http.StatusUnauthorized, "invalid_client")
+
+	resp, err := http.PostForm(srv.URL+"/v1/oauth/token", map[string][]string{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {"grafana"},
+		"client_secret": {"grafana-secret"},
+	})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for unsupported grant, got %d", resp.StatusCode)
+	}
+}
+
+func TestOAuthClientCredentialsGrant(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	accounts := stores.NewInMemoryServiceAccountStore()
+	secret, err := accounts.CreateServiceAccount("reports-job", []string{"reports:read", "reports:write"})
+	if err != nil {
+		t.Fatalf("failed to create service account: %v", err)
+	}
+	a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute).WithServiceAccounts(accounts))
+	// the configured client only authenticates the password and refresh_token grants
+	srv := httptest.NewServer(NewRouter(a, WithOAuthClient("grafana", "grafana-secret")))
+	t.Cleanup(srv.Close)
+
+	conf := clientcredentials.Config{
+		ClientID:     "reports-job",
+		ClientSecret: secret,
+		TokenURL:     srv.URL + "/v1/oauth/token",
+		Scopes:       []string{"reports:read"},
+		AuthStyle:    oauth2.AuthStyleInHeader,
+	}
+	tok, err := conf.Token(context.Background())
+	if err != nil {
+		t.Fatalf("client_credentials grant failed: %v", err)
+	}
+	if tok.AccessToken == "" || tok.RefreshToken != "" || tok.Expiry.IsZero() {
+		t.Errorf("expected an access token with an expiry and no refresh token, got %+v", tok)
+	}
+	claims, err := a.AuthenticateClaims(tok.AccessToken)
+	if err != nil {
+		t.Fatalf("issued service token does not verify: %v", err)
+	}
+	if claims[token.ClaimSubject] != "reports-job" || claims[token.ClaimScope] != "reports:read" {
+		t.Errorf("expected a reports:read token of reports-job, got %v", claims)
+	}
+
+	wrongSecret := conf
+	wrongSecret.ClientSecret = "nope"
+	_, err = wrongSecret.Token(context.Background())
+	assertOAuthError(t, err, http.StatusUnauthorized, "invalid_client")
+
+	wrongScope := conf
+	wrongScope.Scopes = []string{"users:admin"}
+	_, err = wrongScope.Token(context.Background())
+	assertOAuthError(t, err, http.StatusBadRequest, "invalid_scope")
+
+	_ = accounts.SetServiceAccountDisabled("reports-job", true)
+	_, err = conf.Token(context.Background())
+	assertOAuthError(t, err, http.StatusUnauthorized, "invalid_client")
+}
+
+func assertOAuthError(t *testing.T, err error, status int, code string) {
+	t.Helper()
+	retrieveErr, ok := err.(*oauth2.RetrieveError)
+	if !ok {
+		t.Fatalf("expected *oauth2.RetrieveError, got %T: %v", err, err)
+	}
+	if retrieveErr.Response.StatusCode != status || retrieveErr.ErrorCode != code {
+		t.Errorf("expected %d %s, got %d %s", status, code, retrieveErr.Response.StatusCode, retrieveErr.ErrorCode)
+	}
+}
+
+// TestFailedLoginsDoNotLeakSecrets checks that rejected credentials never show up
+// in the server logs or in the error responses sent back to the client.
+func TestFailedLoginsDoNotLeakSecrets(t *testing.T) {
+	const password = "hunter2-do-not-log"
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute))
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	router := NewRouter(a, WithOAuthClient("grafana", "grafana-secret"))
+
+	var bodies []string
+	for _, username := range []string{"alice", "mallory"} {
+		rec := doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{
+			"authify-username": username,
+			"authify-password": password,
+		})
+		if rec.Code == http.StatusOK {
+			t.Fatalf("expected login of %s to fail", username)
+		}
+		bodies = append(bodies, rec.Body.String())
+	}
+
+	form := url.Values{"grant_type": {"password"}, "username": {"alice"}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/v1/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("grafana", password)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for wrong client secret, got %d", rec.Code)
+	}
+	bodies = append(bodies, rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("grafana", "grafana-secret")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for wrong password, got %d", rec.Code)
+	}
+	bodies = append(bodies, rec.Body.String())
+
+	if strings.Contains(logs.String(), password) {
+		t.Errorf("password found in logs: %s", logs.String())
+	}
+	for _, body := range bodies {
+		if strings.Contains(body, password) {
+			t.Errorf("password found in response: %s", body)
+		}
+	}
+}
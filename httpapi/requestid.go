@@ -0,0 +1,17 @@
+package httpapi
+
+import (
+	"context"
+	"log"
+
+	"github.com/HassanAli101/authify"
+)
+
+// logf logs like log.Printf, prefixed with the request ID of ctx when it has one, so the
+// lines of a request can be told apart, see middleware.RequestID
+func logf(ctx context.Context, format string, args ...any) {
+	if id := authify.RequestIDFromContext(ctx); id != "" {
+		format, args = "request_id=%s "+format, append([]any{id}, args...)
+	}
+	log.Printf(format, args...)
+}
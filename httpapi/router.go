@@ -0,0 +1,378 @@
+// Package httpapi exposes an Authify instance over HTTP.
+// NewRouter returns an http.Handler that can be served on its own, as cmd/server does,
+// or mounted inside an existing application.
+package httpapi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	authifygrpc "github.com/HassanAli101/authify/internal/grpc"
+	"github.com/HassanAli101/authify/lib"
+	"github.com/HassanAli101/authify/middleware"
+	"github.com/HassanAli101/authify/secrets"
+)
+
+// Codes reported by the router itself, in the same JSON format as handler errors
+const (
+	codeRouteNotFound    authify.AuthErrorCode = "route_not_found"
+	codeMethodNotAllowed authify.AuthErrorCode = "method_not_allowed"
+)
+
+const (
+	// MaxHeaderBytes is the http.Server MaxHeaderBytes cmd/server serves the router with, the
+	// authify-* headers and tokens fit in it with room to spare, unlike in the 1MB of net/http
+	MaxHeaderBytes = 64 << 10
+
+	// MaxBodyBytes bounds request bodies, larger ones fail to decode
+	MaxBodyBytes = 64 << 10
+)
+
+type options struct {
+	prefix            string
+	legacyRoutes      bool
+	oauthClientID     string
+	oauthClientSecret secrets.SecretString
+	trustForwardedFor bool
+	requestTimeout    time.Duration
+	challengeLogin    bool
+	refreshRole       bool
+	userExistsLimit   int
+	userExistsToken   bool
+	secretRotation    bool
+	idempotency       IdempotencyStore
+	idempotencyTTL    time.Duration
+	federator         Federator
+	codeFlows         map[string]CodeFlow
+	disabledFeatures  []authify.Feature
+	signupChallenge   authify.ChallengeProvider
+	signupThreshold   int
+
+	gateway             authifygrpc.AuthServiceServer
+	withoutHeaderRoutes bool
+	headers             lib.Headers
+}
+
+// Option customizes the router built by NewRouter.
+type Option func(*options)
+
+// WithPathPrefix mounts every route under prefix, e.g. "/auth" serves "/auth/v1/users".
+func WithPathPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = "/" + strings.Trim(prefix, "/")
+		if o.prefix == "/" {
+			o.prefix = ""
+		}
+	}
+}
+
+// WithLegacyRoutes also mounts the unversioned paths served before /v1 (/create-user,
+// /generate-token, /verify-token, /refresh-token, /oauth/token, /introspect and
+// /users/{username}/status). They accept any method, as they used to, and their
+// responses carry a "Deprecation: true" header.
+func WithLegacyRoutes() Option {
+	return func(o *options) {
+		o.legacyRoutes = true
+	}
+}
+
+// WithOAuthClient requires OAuth2 clients of the token and introspection endpoints
+// to authenticate with these credentials, client authentication is optional otherwise.
+func WithOAuthClient(clientID, clientSecret string) Option {
+	return func(o *options) {
+		o.oauthClientID = clientID
+		o.oauthClientSecret = secrets.SecretString(clientSecret)
+	}
+}
+
+// WithTrustedForwardedFor takes the client address recorded with sessions from the
+// X-Forwarded-For header, as appended by a reverse proxy. Only use it behind a proxy
+// that sets the header, clients could claim any address otherwise.
+func WithTrustedForwardedFor() Option {
+	return func(o *options) {
+		o.trustForwardedFor = true
+	}
+}
+
+// WithRequestTimeout bounds every request with a context deadline of d, requests still
+// running when it fires get a 503 with the timeout code. Store operations accepting a
+// context are cancelled along with the request.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.requestTimeout = d
+	}
+}
+
+// WithChallengeLogin switches token generation to challenge logins: clients fetch a nonce from
+// "GET /v1/tokens/challenge" and answer it on "POST /v1/tokens" with the authify-nonce and
+// authify-proof headers instead of authify-password, see authify.Authify.LoginWithProof.
+// The Authify instance needs WithChallengeLogin too.
+func WithChallengeLogin() Option {
+	return func(o *options) {
+		o.challengeLogin = true
+	}
+}
+
+// WithRefreshRole makes "POST /v1/tokens/refresh" respond with JSON holding the new access token
+// and the role of its user, so clients can keep the role they cached at login up to date.
+func WithRefreshRole() Option {
+	return func(o *options) {
+		o.refreshRole = true
+	}
+}
+
+// WithUserExistsRateLimit allows each client perMinute requests of "GET /v1/users/exists",
+// lib.DefaultUserExistsRateLimit by default, 0 lifts the limit. The route tells whether
+// a username is taken, unlimited it lets anyone enumerate the users.
+func WithUserExistsRateLimit(perMinute int) Option {
+	return func(o *options) {
+		o.userExistsLimit = perMinute
+	}
+}
+
+// WithUserExistsToken requires a valid access token on "GET /v1/users/exists", for
+// deployments whose signup forms are only shown to authenticated clients.
+func WithUserExistsToken() Option {
+	return func(o *options) {
+		o.userExistsToken = true
+	}
+}
+
+// WithSecretRotation mounts "POST /admin/rotateSecrets", replacing the signing secrets of the
+// token manager at runtime, see authify.Authify.RotateSecrets. The route requires the admin
+// scope, and leaves it off unless the secrets must be rotatable without a restart.
+func WithSecretRotation() Option {
+	return func(o *options) {
+		o.secretRotation = true
+	}
+}
+
+// WithHeaderPrefix reads the authify-* request headers under prefix instead, e.g. "x-myapp-"
+// for x-myapp-access, x-myapp-username and x-myapp-password, and names the response headers of
+// the middlewares the same way, see middleware.HeaderPrefix. The Authorization header is unchanged.
+func WithHeaderPrefix(prefix string) Option {
+	return func(o *options) {
+		o.headers = lib.Headers{Prefix: strings.ToLower(prefix)}
+	}
+}
+
+// WithoutFeatures turns features off, along with their routes, which then get a 404 like any
+// unknown route and are left out of the capabilities document, e.g. authify.FeatureIntrospection
+// or authify.FeatureTokenExchange for deployments that do not use them.
+func WithoutFeatures(features ...authify.Feature) Option {
+	return func(o *options) {
+		o.disabledFeatures = append(o.disabledFeatures, features...)
+	}
+}
+
+// handler serves the authify routes on top of an Authify instance
+type handler struct {
+	auth *authify.Authify
+	opts options
+	// caps are the features enabled by the options, which decide the routes served
+	caps *authify.Capabilities
+	// signups counts the user creations of every client address, see WithSignupChallenge
+	signups *middleware.RateLimiter
+}
+
+// router wraps the ServeMux so unknown routes and wrong methods get JSON errors
+type router struct {
+	mux *http.ServeMux
+}
+
+// NewRouter returns a handler serving the authify HTTP API:
+//
+//	POST  /v1/users                    create a user from authify-* headers, idempotent with WithIdempotency
+//	POST  /v1/tokens                   generate an access and refresh token
+//	GET   /v1/tokens/challenge         nonce for a challenge login, with WithChallengeLogin
+//	POST  /v1/tokens/verify            verify an access token
+//	POST  /v1/tokens/refresh           refresh an access token
+//	POST  /v1/federated/login          trade an identity provider's ID token for tokens, with WithFederation
+//	GET   /auth/{provider}/login       redirect to an identity provider, with WithCodeFlow
+//	GET   /auth/{provider}/callback    trade the provider's authorization code for tokens, with WithCodeFlow
+//	POST  /v1/tokens/exchange          trade a user's access token for one acting on their behalf
+//	POST  /v1/oauth/token              OAuth2 password and refresh_token grants
+//	POST  /v1/introspect               token introspection (RFC 7662)
+//	GET   /v1/users/exists             whether a unique field value is taken, rate limited
+//	PATCH /v1/users/{username}/status  disable or enable a user (users:admin scope)
+//	GET   /v1/me                       profile of the bearer token's user
+//	GET   /v1/sessions                 logins of the bearer token's user, with their devices
+//	POST  /admin/invalidateAllTokens   reject every token issued so far (users:admin scope)
+//	GET   /admin/users                 page through the users, ?after=&limit= (users:admin scope)
+//	GET   /admin/users/export          every user as JSON lines (users:admin scope)
+//	GET   /admin/users/{username}/tokenFamilies  refresh token families of a user, with a token family store (users:admin scope)
+//	POST  /admin/rotateSecrets         replace the signing secrets, with WithSecretRotation (users:admin scope)
+//	POST  /admin/invites               create an invite for the invite registration policy (users:admin scope)
+//	GET   /admin/invites               list the invites (users:admin scope)
+//	POST  /v2/...                      JSON gateway of the gRPC service, with WithGateway
+//	GET   /.well-known/authify-configuration  capabilities document of the deployment
+//
+// The routes of optional features are only served when the features are on, see
+// authify.Capabilities and WithoutFeatures, the capabilities document lists the ones served.
+// WithoutHeaderRoutes leaves out the /v1, /admin and legacy routes, which read their input from
+// authify-* headers, or the headers under the prefix of WithHeaderPrefix.
+// Requests with a wrong method get a 405, unknown paths a 404, both with a JSON body.
+// Every request is tagged with a request ID, see middleware.RequestID, which prefixes its log
+// lines and is recorded in its audit events.
+func NewRouter(a *authify.Authify, opts ...Option) http.Handler {
+	h := &handler{auth: a, opts: options{userExistsLimit: lib.DefaultUserExistsRateLimit}}
+	for _, opt := range opts {
+		opt(&h.opts)
+	}
+	h.caps = h.capabilities()
+	if h.caps.Enabled(authify.FeatureSignupChallenge) {
+		h.signups = middleware.NewRateLimiter(h.opts.signupThreshold, time.Hour)
+	}
+
+	setUserStatus := middleware.RequireScope(a, authify.AdminScope)(http.HandlerFunc(h.setUserStatus))
+	invalidateAllTokens := middleware.RequireScope(a, authify.AdminScope)(http.HandlerFunc(h.invalidateAllTokens))
+	var userExists http.Handler = http.HandlerFunc(h.userExists)
+	if h.opts.userExistsLimit > 0 {
+		limiter := middleware.NewRateLimiter(h.opts.userExistsLimit, time.Minute)
+		userExists = middleware.RateLimit(limiter, func(r *http.Request) string { return h.deviceFromRequest(r).IP })(userExists)
+	}
+
+	mux := http.NewServeMux()
+	// route serves handler and lists it in the capabilities document, the features of the
+	// optional routes are checked before they are routed
+	route := func(method, path string, handler http.Handler) {
+		mux.Handle(fmt.Sprintf("%s %s%s", method, h.opts.prefix, path), handler)
+		h.caps.AddEndpoint(method + " " + path)
+	}
+	enabled := h.caps.Enabled
+
+	if !h.opts.withoutHeaderRoutes {
+		route(http.MethodPost, "/v1/users", http.HandlerFunc(h.createUser))
+		route(http.MethodPost, "/v1/tokens", http.HandlerFunc(h.generateToken))
+		if enabled(authify.FeatureChallengeLogin) {
+			route(http.MethodGet, "/v1/tokens/challenge", http.HandlerFunc(h.loginChallenge))
+		}
+		route(http.MethodPost, "/v1/tokens/verify", http.HandlerFunc(h.verifyToken))
+		route(http.MethodPost, "/v1/tokens/refresh", http.HandlerFunc(h.refreshToken))
+		if enabled(authify.FeatureTokenExchange) {
+			route(http.MethodPost, "/v1/tokens/exchange", http.HandlerFunc(h.exchangeToken))
+		}
+		if enabled(authify.FeatureFederatedLogin) {
+			route(http.MethodPost, "/v1/federated/login", http.HandlerFunc(h.federatedLogin))
+		}
+		if enabled(authify.FeatureOAuth) {
+			route(http.MethodPost, "/v1/oauth/token", http.HandlerFunc(h.oauthToken))
+		}
+		if enabled(authify.FeatureIntrospection) {
+			route(http.MethodPost, "/v1/introspect", http.HandlerFunc(h.introspect))
+		}
+		if enabled(authify.FeatureUserExists) {
+			route(http.MethodGet, "/v1/users/exists", userExists)
+		}
+		route(http.MethodPatch, "/v1/users/{username}/status", setUserStatus)
+		route(http.MethodGet, "/v1/me", http.HandlerFunc(h.me))
+		route(http.MethodPatch, "/v1/me", http.HandlerFunc(h.updateMe))
+		if enabled(authify.FeatureSessions) {
+			route(http.MethodGet, "/v1/sessions", http.HandlerFunc(h.sessions))
+		}
+		route(http.MethodPost, "/admin/invalidateAllTokens", invalidateAllTokens)
+		route(http.MethodGet, "/admin/users", middleware.RequireScope(a, authify.AdminScope)(http.HandlerFunc(h.listUsers)))
+		route(http.MethodGet, "/admin/users/export", middleware.RequireScope(a, authify.AdminScope)(http.HandlerFunc(h.exportUsers)))
+		if enabled(authify.FeatureRefreshRotation) {
+			route(http.MethodGet, "/admin/users/{username}/tokenFamilies", middleware.RequireScope(a, authify.AdminScope)(http.HandlerFunc(h.tokenFamilies)))
+		}
+		if enabled(authify.FeatureInvites) {
+			route(http.MethodPost, "/admin/invites", middleware.RequireScope(a, authify.AdminScope)(http.HandlerFunc(h.createInvite)))
+			route(http.MethodGet, "/admin/invites", middleware.RequireScope(a, authify.AdminScope)(http.HandlerFunc(h.listInvites)))
+		}
+		if enabled(authify.FeatureSecretRotation) {
+			route(http.MethodPost, "/admin/rotateSecrets", middleware.RequireScope(a, authify.AdminScope)(http.HandlerFunc(h.rotateSecrets)))
+		}
+
+		if enabled(authify.FeatureLegacyRoutes) {
+			// the deprecated aliases are left out of the capabilities document
+			legacy := func(path string, handler http.Handler) {
+				mux.Handle(h.opts.prefix+path, deprecated(handler))
+			}
+			legacy("/create-user", http.HandlerFunc(h.createUser))
+			legacy("/generate-token", http.HandlerFunc(h.generateToken))
+			legacy("/verify-token", http.HandlerFunc(h.verifyToken))
+			legacy("/refresh-token", http.HandlerFunc(h.refreshToken))
+			if enabled(authify.FeatureOAuth) {
+				legacy("/oauth/token", http.HandlerFunc(h.oauthToken))
+			}
+			if enabled(authify.FeatureIntrospection) {
+				legacy("/introspect", http.HandlerFunc(h.introspect))
+			}
+			mux.Handle(fmt.Sprintf("%s %s/users/{username}/status", http.MethodPatch, h.opts.prefix), deprecated(setUserStatus))
+		}
+	}
+	if enabled(authify.FeatureAuthorizationCode) {
+		for provider, flow := range h.opts.codeFlows {
+			route(http.MethodGet, "/auth/"+provider+"/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.codeFlowLogin(w, r, provider, flow)
+			}))
+			route(http.MethodGet, "/auth/"+provider+"/callback", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.codeFlowCallback(w, r, provider, flow)
+			}))
+		}
+	}
+	if enabled(authify.FeatureGateway) {
+		h.mountGateway(route)
+	}
+	route(http.MethodGet, "/readyz", http.HandlerFunc(h.ready))
+	route(http.MethodGet, "/.well-known/authify-configuration", http.HandlerFunc(h.configuration))
+
+	var rt http.Handler = &router{mux: mux}
+	if h.opts.requestTimeout > 0 {
+		rt = withTimeout(rt, h.opts.requestTimeout)
+	}
+	return middleware.RequestID(middleware.HeaderPrefix(h.opts.headers.Prefix)(rt))
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	}
+	if _, pattern := rt.mux.Handler(r); pattern != "" {
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+
+	// No route matched: let the mux decide between 404, 405 and path cleaning redirects,
+	// and only replace the plain text errors with JSON ones.
+	rec := &responseRecorder{header: make(http.Header), status: http.StatusOK}
+	rt.mux.ServeHTTP(rec, r)
+
+	switch rec.status {
+	case http.StatusNotFound:
+		writeJSONError(w, http.StatusNotFound, codeRouteNotFound, fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path))
+	case http.StatusMethodNotAllowed:
+		w.Header().Set("Allow", rec.header.Get("Allow"))
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+	default:
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// deprecated marks the responses of legacy routes
+func deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseRecorder buffers the mux's own responses to unmatched requests
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header         { return r.header }
+func (r *responseRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *responseRecorder) WriteHeader(status int)      { r.status = status }
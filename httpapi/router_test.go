@@ -0,0 +1,209 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/client"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+func newTestRouter(t *testing.T, opts ...Option) http.Handler {
+	t.Helper()
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	return NewRouter(authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute)), opts...)
+}
+
+// tokenFlow creates a user, then generates, verifies and refreshes its tokens through the given paths,
+// returning the refresh response
+func tokenFlow(t *testing.T, router http.Handler, method string, paths [4]string) *httptest.ResponseRecorder {
+	t.Helper()
+	alice := map[string]string{"authify-username": "alice", "authify-password": "password123"}
+
+	if rec := doRequest(router, method, paths[0], alice); rec.Code != http.StatusCreated {
+		t.Fatalf("create user: expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	accessToken, refreshToken := loginTokens(t, router, method, paths[1], alice)
+	if rec := doRequest(router, method, paths[2], map[string]string{"authify-access": accessToken}); rec.Code != http.StatusOK {
+		t.Errorf("verify token: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := doRequest(router, method, paths[3], map[string]string{"authify-access": accessToken, "authify-refresh": refreshToken})
+	if rec.Code != http.StatusOK {
+		t.Errorf("refresh token: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	return rec
+}
+
+// loginTokens logs a user in through path and returns the tokens of the plain text response
+func loginTokens(t *testing.T, router http.Handler, method, path string, headers map[string]string) (accessToken, refreshToken string) {
+	t.Helper()
+	rec := doRequest(router, method, path, headers)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("generate token: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if v, ok := strings.CutPrefix(line, "Access Token: "); ok {
+			accessToken = v
+		}
+		if v, ok := strings.CutPrefix(line, "Refresh Token: "); ok {
+			refreshToken = v
+		}
+	}
+	return accessToken, refreshToken
+}
+
+func TestRouterVersionedRoutes(t *testing.T) {
+	router := newTestRouter(t)
+	tokenFlow(t, router, http.MethodPost, [4]string{"/v1/users", "/v1/tokens", "/v1/tokens/verify", "/v1/tokens/refresh"})
+
+	if rec := doRequest(router, http.MethodPost, "/create-user", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected legacy routes to be off by default, got %d", rec.Code)
+	}
+}
+
+func TestRouterRefreshRole(t *testing.T) {
+	rec := tokenFlow(t, newTestRouter(t, WithRefreshRole()), http.MethodPost, [4]string{"/v1/users", "/v1/tokens", "/v1/tokens/verify", "/v1/tokens/refresh"})
+
+	var resp refreshResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("expected a JSON refresh response, got %q: %v", rec.Body.String(), err)
+	}
+	if resp.AccessToken == "" || resp.Role != "user" {
+		t.Errorf("expected a new token and the user role, got %+v", resp)
+	}
+}
+
+func TestRouterRefreshRoleFollowsStore(t *testing.T) {
+	managers := map[string]func(store stores.Store) token.TokenManager{
+		"jwt": func(store stores.Store) token.TokenManager { return newTestJWTManager(t, store, time.Minute) },
+		"opaque": func(store stores.Store) token.TokenManager {
+			return token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour).WithStore(store)
+		},
+	}
+	for name, newManager := range managers {
+		t.Run(name, func(t *testing.T) {
+			store := stores.NewInMemoryUserStore(testStoreConfig)
+			a := authify.NewAuthify(store, newManager(store))
+			router := NewRouter(a, WithRefreshRole())
+			if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "admin"}); err != nil {
+				t.Fatal(err)
+			}
+			accessToken, refreshToken := loginTokens(t, router, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "alice", "authify-password": "password123"})
+			if err := a.ChangeRole("alice", "user"); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := doRequest(router, http.MethodPost, "/v1/tokens/refresh", map[string]string{"authify-access": accessToken, "authify-refresh": refreshToken})
+			var resp refreshResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("expected a JSON refresh response, got %q: %v", rec.Body.String(), err)
+			}
+			if resp.Role != "user" {
+				t.Errorf("expected the role held by the store once demoted, got %q", resp.Role)
+			}
+			claims, err := a.Tokens.VerifyAccessToken(resp.AccessToken)
+			if err != nil || token.RoleFromClaims(a.Tokens, claims) != "user" {
+				t.Errorf("expected the refreshed token to carry the new role, got %v (%v)", claims, err)
+			}
+		})
+	}
+}
+
+func TestRouterRefreshRotation(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	a := authify.NewAuthify(store, token.NewOpaqueTokenManager(stores.NewInMemorySessionStore(), time.Minute, time.Hour).WithStore(store))
+	srv := httptest.NewServer(NewRouter(a))
+	t.Cleanup(srv.Close)
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := client.New(srv.URL)
+	tokens, err := c.Login(context.Background(), "alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	refreshed, err := c.RefreshTokens(context.Background(), tokens.AccessToken, tokens.RefreshToken)
+	if err != nil || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("expected the refresh token to be rotated, got %+v (%v)", refreshed, err)
+	}
+	if _, err := c.RefreshTokens(context.Background(), tokens.AccessToken, tokens.RefreshToken); err == nil {
+		t.Error("expected the rotated refresh token to be revoked")
+	}
+	if _, err := c.RefreshTokens(context.Background(), refreshed.AccessToken, refreshed.RefreshToken); err != nil {
+		t.Errorf("expected the new refresh token to refresh, got %v", err)
+	}
+}
+
+func TestRouterLegacyRoutes(t *testing.T) {
+	router := newTestRouter(t, WithLegacyRoutes())
+	// legacy routes keep accepting any method
+	tokenFlow(t, router, http.MethodGet, [4]string{"/create-user", "/generate-token", "/verify-token", "/refresh-token"})
+
+	rec := doRequest(router, http.MethodPost, "/verify-token", nil)
+	if rec.Header().Get("Deprecation") != "true" {
+		t.Errorf("expected legacy routes to be flagged as deprecated, got headers %v", rec.Header())
+	}
+}
+
+func TestRouterPathPrefix(t *testing.T) {
+	router := newTestRouter(t, WithPathPrefix("/auth/"), WithLegacyRoutes())
+	tokenFlow(t, router, http.MethodPost, [4]string{"/auth/v1/users", "/auth/v1/tokens", "/auth/v1/tokens/verify", "/auth/v1/tokens/refresh"})
+
+	if rec := doRequest(router, http.MethodPost, "/auth/generate-token", nil); rec.Code == http.StatusNotFound {
+		t.Errorf("expected legacy routes under the prefix, got %d", rec.Code)
+	}
+	assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/users", nil), http.StatusNotFound, codeRouteNotFound)
+}
+
+func TestRouterErrors(t *testing.T) {
+	router := newTestRouter(t)
+
+	rec := doRequest(router, http.MethodGet, "/v1/tokens", nil)
+	if allow := rec.Header().Get("Allow"); allow != http.MethodPost {
+		t.Errorf("expected Allow: POST, got %q", allow)
+	}
+	assertErrorResponse(t, rec, http.StatusMethodNotAllowed, codeMethodNotAllowed)
+
+	assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/unknown", nil), http.StatusNotFound, codeRouteNotFound)
+}
+
+func TestRouterHeaderPrefix(t *testing.T) {
+	router := newTestRouter(t, WithHeaderPrefix("X-MyApp-"))
+	alice := map[string]string{"x-myapp-username": "alice", "x-myapp-password": "password123"}
+
+	if rec := doRequest(router, http.MethodPost, "/v1/users", alice); rec.Code != http.StatusCreated {
+		t.Fatalf("create user: expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "alice", "authify-password": "password123"}), http.StatusBadRequest, authify.CodeMissingField)
+
+	rec := doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{"x-myapp-username": "alice", "x-myapp-password": "password123", "Accept": "application/json"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("generate token: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var pair authify.TokenPair
+	if err := json.Unmarshal(rec.Body.Bytes(), &pair); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := doRequest(router, http.MethodPost, "/v1/tokens/verify", map[string]string{"x-myapp-access": pair.AccessToken}); rec.Code != http.StatusOK {
+		t.Errorf("verify token: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	assertErrorResponse(t, doRequest(router, http.MethodPost, "/v1/tokens/verify", map[string]string{"authify-access": pair.AccessToken}), http.StatusBadRequest, authify.CodeMissingField)
+	if rec := doRequest(router, http.MethodPost, "/v1/tokens/refresh", map[string]string{"x-myapp-access": pair.AccessToken, "x-myapp-refresh": pair.RefreshToken}); rec.Code != http.StatusOK {
+		t.Errorf("refresh token: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// routes behind the middlewares read the prefixed access header too
+	if rec := doRequest(router, http.MethodGet, "/v1/me", map[string]string{"x-myapp-access": pair.AccessToken}); rec.Code != http.StatusOK {
+		t.Errorf("me: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,60 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/middleware"
+	"github.com/HassanAli101/authify/token"
+)
+
+// WithSignupChallenge lets every client address create perHour users on "POST /v1/users", after
+// which the client must answer a challenge of provider for each user it creates during the rest
+// of the hour, e.g. authify.NewProofOfWork or authify.NewCaptchaVerifier. Challenged requests get
+// a 428 with the challenge_required code and the challenge in the authify-challenge header, as
+// the name of the provider and the challenge, e.g. "pow 20:...". Clients answer in the header
+// named after the provider, e.g. authify-pow, and wrong answers get a 403 with challenge_failed.
+// The counts are kept in memory, per instance. Administrators are never challenged.
+func WithSignupChallenge(provider authify.ChallengeProvider, perHour int) Option {
+	return func(o *options) {
+		o.signupChallenge = provider
+		o.signupThreshold = perHour
+	}
+}
+
+// checkSignupChallenge counts the user creation of r, and once its client went over the threshold
+// of WithSignupChallenge, verifies the answer r carries. It responds and returns false when the
+// creation must not go on.
+func (h *handler) checkSignupChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !h.caps.Enabled(authify.FeatureSignupChallenge) {
+		return true
+	}
+	if accessToken, err := middleware.AccessTokenFromRequest(r); err == nil {
+		if claims, err := h.auth.AuthenticateClaims(accessToken); err == nil && token.HasScopes(claims, authify.AdminScope) {
+			return true
+		}
+	}
+	ip := h.deviceFromRequest(r).IP
+	if _, err := h.signups.Allow(ip); err == nil {
+		return true
+	}
+
+	provider := h.opts.signupChallenge
+	err := authify.ErrChallengeRequired
+	if answer := h.opts.headers.Get(r, provider.Name()); answer != "" {
+		if err = provider.Verify(r.Context(), answer, ip); err == nil {
+			return true
+		}
+	}
+	// refused clients get a new challenge to answer, wrong answers included
+	challenge, challengeErr := provider.Challenge(r.Context())
+	if challengeErr != nil {
+		writeError(w, fmt.Errorf("Error creating challenge: %w", challengeErr))
+		return false
+	}
+	w.Header().Set(h.opts.headers.Name("challenge"), strings.TrimSpace(provider.Name()+" "+challenge))
+	writeError(w, fmt.Errorf("Error creating user: %w", err))
+	return false
+}
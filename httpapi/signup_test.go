@@ -0,0 +1,169 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/client"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// newSignupTest returns a router challenging the clients creating more than threshold users
+// with provider, and a function creating users with extra headers
+func newSignupTest(t *testing.T, provider authify.ChallengeProvider, threshold int) (http.Handler, func(username string, headers map[string]string) *httptest.ResponseRecorder) {
+	t.Helper()
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	router := NewRouter(authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute)), WithSignupChallenge(provider, threshold))
+	signUp := func(username string, headers map[string]string) *httptest.ResponseRecorder {
+		all := map[string]string{"authify-username": username, "authify-password": "password123"}
+		for k, v := range headers {
+			all[k] = v
+		}
+		return doRequest(router, http.MethodPost, "/v1/users", all)
+	}
+	return router, signUp
+}
+
+// powChallenge returns the proof of work challenge of a challenge_required response
+func powChallenge(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	challenge, ok := strings.CutPrefix(rec.Header().Get("authify-challenge"), "pow ")
+	if !ok || challenge == "" {
+		t.Fatalf("expected a proof of work challenge, got %q", rec.Header().Get("authify-challenge"))
+	}
+	return challenge
+}
+
+func TestSignupChallengeThreshold(t *testing.T) {
+	pow, err := authify.NewProofOfWork(8)
+	if err != nil {
+		t.Fatalf("failed to create proof of work: %v", err)
+	}
+	router, signUp := newSignupTest(t, pow, 2)
+
+	for _, username := range []string{"alice", "bob"} {
+		if rec := signUp(username, nil); rec.Code != http.StatusCreated {
+			t.Fatalf("expected %s to be created below the threshold, got %d: %s", username, rec.Code, rec.Body.String())
+		}
+	}
+	rec := signUp("carol", nil)
+	assertErrorResponse(t, rec, http.StatusPreconditionRequired, authify.CodeChallengeRequired)
+
+	answer, err := authify.SolveProofOfWork(context.Background(), powChallenge(t, rec))
+	if err != nil {
+		t.Fatalf("failed to solve the proof of work: %v", err)
+	}
+	if rec := signUp("carol", map[string]string{"authify-pow": answer}); rec.Code != http.StatusCreated {
+		t.Fatalf("expected carol to be created with a proof of work, got %d: %s", rec.Code, rec.Body.String())
+	}
+	assertErrorResponse(t, signUp("dave", map[string]string{"authify-pow": answer}), http.StatusForbidden, authify.CodeChallengeFailed)
+
+	if doc := fetchConfiguration(t, router); !slices.Contains(doc.Features, authify.FeatureSignupChallenge) {
+		t.Errorf("expected the capabilities to list the signup challenge, got %v", doc.Features)
+	}
+
+	// the client solves proofs of work on its own
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+	user, err := client.New(srv.URL).CreateUser(context.Background(), "erin", "password123")
+	if err != nil || user["username"] != "erin" {
+		t.Fatalf("expected the client to create erin, got %v (%v)", user, err)
+	}
+}
+
+func TestSignupChallengeInvalidProof(t *testing.T) {
+	pow, err := authify.NewProofOfWork(8)
+	if err != nil {
+		t.Fatalf("failed to create proof of work: %v", err)
+	}
+	_, signUp := newSignupTest(t, pow, 0)
+	challenge := powChallenge(t, signUp("alice", nil))
+
+	// a counter whose hash starts with a non-zero byte misses any difficulty of 8 bits or more
+	wrong := challenge + ":0"
+	for counter := 1; sha256.Sum256([]byte(wrong))[0] == 0; counter++ {
+		wrong = challenge + ":" + strconv.Itoa(counter)
+	}
+	solved, err := authify.SolveProofOfWork(context.Background(), challenge)
+	if err != nil {
+		t.Fatalf("failed to solve the proof of work: %v", err)
+	}
+	// lowering the difficulty breaks the signature of the challenge
+	forged := strings.Replace(solved, "8:", "1:", 1)
+
+	for name, answer := range map[string]string{
+		"wrong counter": wrong,
+		"forged":        forged,
+		"malformed":     "not a proof of work",
+		"no counter":    challenge,
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := signUp("alice", map[string]string{"authify-pow": answer})
+			assertErrorResponse(t, rec, http.StatusForbidden, authify.CodeChallengeFailed)
+			if powChallenge(t, rec) == challenge {
+				t.Errorf("expected a new challenge for the next attempt")
+			}
+		})
+	}
+}
+
+func TestSignupChallengeCaptcha(t *testing.T) {
+	var success bool
+	var form map[string]string
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = map[string]string{"secret": r.PostForm.Get("secret"), "response": r.PostForm.Get("response"), "remoteip": r.PostForm.Get("remoteip")}
+		if !success {
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+			return
+		}
+		w.Write([]byte(`{"success": true}`))
+	}))
+	t.Cleanup(verifier.Close)
+	_, signUp := newSignupTest(t, authify.NewCaptchaVerifier(verifier.URL, "site-secret"), 0)
+
+	rec := signUp("alice", nil)
+	assertErrorResponse(t, rec, http.StatusPreconditionRequired, authify.CodeChallengeRequired)
+	if got := rec.Header().Get("authify-challenge"); got != "captcha" {
+		t.Errorf("expected a CAPTCHA challenge, got %q", got)
+	}
+
+	assertErrorResponse(t, signUp("alice", map[string]string{"authify-captcha": "bad-token"}), http.StatusForbidden, authify.CodeChallengeFailed)
+	if want := map[string]string{"secret": "site-secret", "response": "bad-token", "remoteip": "192.0.2.1"}; form["secret"] != want["secret"] || form["response"] != want["response"] || form["remoteip"] != want["remoteip"] {
+		t.Errorf("expected the verification to carry %v, got %v", want, form)
+	}
+
+	success = true
+	if rec := signUp("alice", map[string]string{"authify-captcha": "good-token"}); rec.Code != http.StatusCreated {
+		t.Errorf("expected alice to be created with a valid CAPTCHA, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	verifier.Close()
+	assertErrorResponse(t, signUp("bob", map[string]string{"authify-captcha": "good-token"}), http.StatusInternalServerError, authify.CodeInternal)
+}
+
+func TestSignupChallengeAdmin(t *testing.T) {
+	pow, err := authify.NewProofOfWork(8)
+	if err != nil {
+		t.Fatalf("failed to create proof of work: %v", err)
+	}
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {authify.AdminScope}}
+	store := stores.NewInMemoryUserStore(cfg)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	router := NewRouter(authify.NewAuthify(store, tokens), WithSignupChallenge(pow, 0))
+	_, _ = store.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin"})
+
+	headers := map[string]string{"authify-username": "alice", "authify-password": "password123", "Authorization": "Bearer " + generateToken(t, tokens, "root")}
+	if rec := doRequest(router, http.MethodPost, "/v1/users", headers); rec.Code != http.StatusCreated {
+		t.Errorf("expected administrators not to be challenged, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,88 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify"
+)
+
+// withTimeout runs next with a deadline of d on the request context, which handlers pass
+// on to store operations that accept one. When the deadline fires before next has
+// responded, the client gets a 503 with the timeout code right away, and whatever next
+// writes afterwards is discarded, as with http.TimeoutHandler.
+func withTimeout(next http.Handler, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{header: make(http.Header), status: http.StatusOK}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.body.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				writeJSONError(w, http.StatusServiceUnavailable, authify.CodeTimeout, fmt.Sprintf("request did not complete within %v", d))
+			}
+		}
+	})
+}
+
+// timeoutWriter buffers the response of a handler run by withTimeout,
+// refusing writes once the request has timed out
+type timeoutWriter struct {
+	mu          sync.Mutex
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	return tw.body.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut && !tw.wroteHeader {
+		tw.status = status
+		tw.wroteHeader = true
+	}
+}
@@ -0,0 +1,50 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// slowStore hangs on user creation until the caller's context is done,
+// like a database query stuck behind a lock
+type slowStore struct {
+	stores.Store
+	released chan error
+}
+
+func (s *slowStore) CreateUserContext(ctx context.Context, data map[string]any) (map[string]string, error) {
+	<-ctx.Done()
+	s.released <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	store := &slowStore{Store: stores.NewInMemoryUserStore(testStoreConfig), released: make(chan error, 1)}
+	a := authify.NewAuthify(store, newTestJWTManager(t, store, time.Minute))
+	router := NewRouter(a, WithRequestTimeout(50*time.Millisecond))
+
+	start := time.Now()
+	rec := doRequest(router, http.MethodPost, "/v1/users", map[string]string{"authify-username": "alice", "authify-password": "password123"})
+	assertErrorResponse(t, rec, http.StatusServiceUnavailable, authify.CodeTimeout)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the timeout to answer promptly, took %v", elapsed)
+	}
+
+	select {
+	case err := <-store.released:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected the store call to see the deadline, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the store call to be released by the deadline")
+	}
+
+	// requests completing in time are answered as usual
+	rec = doRequest(router, http.MethodGet, "/v1/unknown", nil)
+	assertErrorResponse(t, rec, http.StatusNotFound, codeRouteNotFound)
+}
@@ -0,0 +1,276 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/middleware"
+	"github.com/HassanAli101/authify/stores"
+)
+
+// userStatus is the body accepted and returned by the user status route
+type userStatus struct {
+	Username string `json:"username,omitempty"`
+	Disabled *bool  `json:"disabled"`
+}
+
+// setUserStatus handles the "PATCH /v1/users/{username}/status" route.
+// It is mounted behind middleware.RequireScope with authify.AdminScope, reads
+// {"disabled": true|false} from the body and suspends or reactivates the user.
+// Disabled users can no longer log in or refresh their tokens.
+func (h *handler) setUserStatus(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	var status userStatus
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil || status.Disabled == nil {
+		writeError(w, fmt.Errorf("%w: disabled", stores.ErrMissingField))
+		return
+	}
+
+	if err := h.auth.SetUserDisabled(username, *status.Disabled); err != nil {
+		writeError(w, fmt.Errorf("Error updating user status: %w", err))
+		return
+	}
+
+	status.Username = username
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logf(r.Context(), "Error writing user status response: %v\n", err)
+	}
+	logf(r.Context(), "Set disabled=%v for user with username: %v\n", *status.Disabled, username)
+}
+
+// invalidateAllTokensResponse is the body returned by the token invalidation route
+type invalidateAllTokensResponse struct {
+	NotBefore time.Time `json:"not_before"`
+}
+
+// invalidateAllTokens handles the "POST /admin/invalidateAllTokens" route.
+// It is mounted behind middleware.RequireScope with authify.AdminScope, and rejects every
+// token issued so far, the caller's included, see authify.InvalidateAllTokens.
+func (h *handler) invalidateAllTokens(w http.ResponseWriter, r *http.Request) {
+	notBefore, err := h.auth.InvalidateAllTokens()
+	if err != nil {
+		writeError(w, fmt.Errorf("Error invalidating tokens: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(invalidateAllTokensResponse{NotBefore: notBefore.UTC()}); err != nil {
+		logf(r.Context(), "Error writing token invalidation response: %v\n", err)
+	}
+	logf(r.Context(), "Invalidated every token issued before %v\n", notBefore.UTC())
+}
+
+// listUsersResponse is the body returned by the user listing route
+type listUsersResponse struct {
+	Users []map[string]string `json:"users"`
+	Next  string              `json:"next,omitempty"`
+}
+
+// listUsers handles the "GET /admin/users?after=alice&limit=100" route.
+// It is mounted behind middleware.RequireScope with authify.AdminScope, and responds with a page
+// of users in primary key order and the after parameter of the next page, if any, see
+// authify.ListUsers.
+func (h *handler) listUsers(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+			writeError(w, fmt.Errorf("%w: limit must be a positive integer", stores.ErrMissingField))
+			return
+		}
+	}
+
+	users, next, err := h.auth.ListUsers(r.Context(), r.URL.Query().Get("after"), limit)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error listing users: %w", err))
+		return
+	}
+	if users == nil {
+		users = []map[string]string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(listUsersResponse{Users: users, Next: next}); err != nil {
+		logf(r.Context(), "Error writing user list response: %v\n", err)
+	}
+}
+
+// exportUsers handles the "GET /admin/users/export" route.
+// It is mounted behind middleware.RequireScope with authify.AdminScope, and streams every user
+// as a JSON object per line, see authify.ExportUsers. Failures past the first users can only
+// cut the response short, they are logged.
+func (h *handler) exportUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.auth.Store.(stores.UserIterator); !ok {
+		writeError(w, authify.ErrListingNotSupported)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := h.auth.ExportUsers(r.Context(), w); err != nil {
+		logf(r.Context(), "Error exporting users: %v\n", err)
+		return
+	}
+	logf(r.Context(), "Exported users\n")
+}
+
+// tokenFamiliesResponse is the body returned by the token family route
+type tokenFamiliesResponse struct {
+	Families []stores.TokenFamily `json:"families"`
+}
+
+// tokenFamilies handles the "GET /admin/users/{username}/tokenFamilies" route.
+// It is mounted behind middleware.RequireScope with authify.AdminScope, and responds with the
+// token families of the user, oldest first, with the chain of their refresh tokens and the
+// reuse that compromised them, if any, see authify.TokenFamilies.
+func (h *handler) tokenFamilies(w http.ResponseWriter, r *http.Request) {
+	families, err := h.auth.TokenFamilies(r.PathValue("username"))
+	if err != nil {
+		writeError(w, fmt.Errorf("Error listing token families: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokenFamiliesResponse{Families: families}); err != nil {
+		logf(r.Context(), "Error writing token families response: %v\n", err)
+	}
+}
+
+// rotateSecretsRequest is the body accepted by the secret rotation route
+type rotateSecretsRequest struct {
+	AccessSecret  string `json:"access_secret"`
+	RefreshSecret string `json:"refresh_secret"`
+	KeepOld       bool   `json:"keep_old"`
+}
+
+// rotateSecrets handles the "POST /admin/rotateSecrets" route, mounted WithSecretRotation.
+// It is mounted behind middleware.RequireScope with authify.AdminScope, reads
+// {"access_secret": ..., "refresh_secret": ..., "keep_old": true|false} from the body and
+// replaces the signing secrets, see authify.RotateSecrets. It responds with a 204.
+func (h *handler) rotateSecrets(w http.ResponseWriter, r *http.Request) {
+	var req rotateSecretsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AccessSecret == "" || req.RefreshSecret == "" {
+		writeError(w, fmt.Errorf("%w: access_secret, refresh_secret", stores.ErrMissingField))
+		return
+	}
+
+	if err := h.auth.RotateSecrets(req.AccessSecret, req.RefreshSecret, req.KeepOld); err != nil {
+		writeError(w, fmt.Errorf("Error rotating secrets: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	logf(r.Context(), "Rotated the signing secrets, keep_old=%v\n", req.KeepOld)
+}
+
+// userExistsResponse is the body returned by the user exists route
+type userExistsResponse struct {
+	Exists bool `json:"exists"`
+}
+
+// userExists handles the "GET /v1/users/exists?field=username&value=alice" route.
+// It responds with {"exists": true|false}, only unique fields can be checked. The route is
+// rate limited per client by NewRouter, and requires an access token with WithUserExistsToken.
+func (h *handler) userExists(w http.ResponseWriter, r *http.Request) {
+	if h.opts.userExistsToken {
+		accessToken, err := middleware.AccessTokenFromRequest(r)
+		if err == nil {
+			_, err = h.auth.AuthenticateClaims(accessToken)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	field, value := r.URL.Query().Get("field"), r.URL.Query().Get("value")
+	if field == "" || value == "" {
+		writeError(w, fmt.Errorf("%w: the field and value query parameters are required", stores.ErrMissingField))
+		return
+	}
+
+	exists, err := h.auth.UserExists(r.Context(), field, value)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error checking user existence: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(userExistsResponse{Exists: exists}); err != nil {
+		logf(r.Context(), "Error writing user exists response: %v\n", err)
+	}
+}
+
+// me handles the "GET /v1/me" route.
+// It verifies the bearer access token and responds with the caller's profile as JSON,
+// using the jwt_claim names of the columns and leaving hidden columns out.
+func (h *handler) me(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := middleware.AccessTokenFromRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	profile, err := h.auth.GetSelf(accessToken)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error fetching user profile: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(profile); err != nil {
+		logf(r.Context(), "Error writing user profile response: %v\n", err)
+	}
+}
+
+// updateMe handles the "PATCH /v1/me" route.
+// It reads the fields to change from the body, e.g. {"display_name": "Alice"}, named after their
+// column, and changes them on the profile of the bearer token's user, see authify.UpdateSelf.
+// It responds with the updated profile, like "GET /v1/me".
+func (h *handler) updateMe(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := middleware.AccessTokenFromRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var fields map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil || len(fields) == 0 {
+		writeError(w, fmt.Errorf("%w: a JSON object of the fields to change is required", stores.ErrMissingField))
+		return
+	}
+
+	if err := h.auth.UpdateSelf(r.Context(), accessToken, fields); err != nil {
+		writeError(w, fmt.Errorf("Error updating user profile: %w", err))
+		return
+	}
+	h.me(w, r)
+}
+
+// sessions handles the "GET /v1/sessions" route.
+// It responds with the sessions of the bearer token's user as JSON, including
+// the device each login came from. It requires a session store.
+func (h *handler) sessions(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := middleware.AccessTokenFromRequest(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sessions, err := h.auth.ListSessions(accessToken)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error listing sessions: %w", err))
+		return
+	}
+	if sessions == nil {
+		sessions = []stores.Session{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		logf(r.Context(), "Error writing sessions response: %v\n", err)
+	}
+}
@@ -0,0 +1,514 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+func TestSetUserStatus(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {authify.AdminScope}}
+
+	pgStore, err := stores.NewAuthifyDBFromConn(newFakeConn(), cfg)
+	if err != nil {
+		t.Fatalf("failed to create pg store: %v", err)
+	}
+	testCases := map[string]stores.Store{
+		"memstore": stores.NewInMemoryUserStore(cfg),
+		"pgstore":  pgStore,
+	}
+
+	for name, store := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tokens := newTestJWTManager(t, store, time.Minute)
+			router := NewRouter(authify.NewAuthify(store, tokens))
+
+			_, _ = store.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin"})
+			_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+			adminToken := generateToken(t, tokens, "root")
+			userToken := generateToken(t, tokens, "alice")
+
+			setStatus := func(accessToken, username, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPatch, "/v1/users/"+username+"/status", strings.NewReader(body))
+				req.Header.Set("Authorization", "Bearer "+accessToken)
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+				return rec
+			}
+
+			rec := setStatus(userToken, "alice", `{"disabled": true}`)
+			assertErrorResponse(t, rec, http.StatusForbidden, authify.CodeInsufficientScope)
+
+			rec = setStatus(adminToken, "alice", `{"disabled": true}`)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected admin to disable alice, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var status userStatus
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil || status.Username != "alice" || !*status.Disabled {
+				t.Errorf("unexpected status response %+v (%v)", status, err)
+			}
+
+			rec = doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "alice", "authify-password": "password123"})
+			assertErrorResponse(t, rec, http.StatusForbidden, authify.CodeAccountDisabled)
+
+			assertErrorResponse(t, setStatus(adminToken, "alice", `{}`), http.StatusBadRequest, authify.CodeMissingField)
+			assertErrorResponse(t, setStatus(adminToken, "bob", `{"disabled": true}`), http.StatusNotFound, authify.CodeUserNotFound)
+
+			if rec := setStatus(adminToken, "alice", `{"disabled": false}`); rec.Code != http.StatusOK {
+				t.Fatalf("expected admin to enable alice, got %d: %s", rec.Code, rec.Body.String())
+			}
+			rec = doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{"authify-username": "alice", "authify-password": "password123"})
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected login to work again after re-enabling, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestInvalidateAllTokens(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {authify.AdminScope}}
+	store := stores.NewInMemoryUserStore(cfg)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	router := NewRouter(authify.NewAuthify(store, tokens))
+
+	_, _ = store.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin"})
+	_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+	adminToken := generateToken(t, tokens, "root")
+	userToken := generateToken(t, tokens, "alice")
+
+	invalidate := func(accessToken string) *httptest.ResponseRecorder {
+		return doRequest(router, http.MethodPost, "/admin/invalidateAllTokens", map[string]string{"Authorization": "Bearer " + accessToken})
+	}
+
+	assertErrorResponse(t, invalidate(userToken), http.StatusForbidden, authify.CodeInsufficientScope)
+
+	rec := invalidate(adminToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected admin to invalidate the tokens, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp invalidateAllTokensResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || time.Since(resp.NotBefore) > time.Minute {
+		t.Errorf("unexpected invalidation response %+v (%v)", resp, err)
+	}
+
+	// the admin's own token is gone too
+	assertErrorResponse(t, invalidate(adminToken), http.StatusUnauthorized, authify.CodeTokenRevoked)
+	rec = doRequest(router, http.MethodGet, "/v1/me", map[string]string{"Authorization": "Bearer " + userToken})
+	assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeTokenRevoked)
+}
+
+func TestListUsers(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {authify.AdminScope}}
+	store := stores.NewInMemoryUserStore(cfg)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	router := NewRouter(authify.NewAuthify(store, tokens))
+
+	_, _ = store.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin"})
+	for _, username := range []string{"carol", "alice", "bob"} {
+		_, _ = store.CreateUser(map[string]any{"username": username, "password": "password123"})
+	}
+	adminToken := generateToken(t, tokens, "root")
+	admin := map[string]string{"Authorization": "Bearer " + adminToken}
+
+	assertErrorResponse(t, doRequest(router, http.MethodGet, "/admin/users", map[string]string{"Authorization": "Bearer " + generateToken(t, tokens, "alice")}), http.StatusForbidden, authify.CodeInsufficientScope)
+	assertErrorResponse(t, doRequest(router, http.MethodGet, "/admin/users?limit=many", admin), http.StatusBadRequest, authify.CodeMissingField)
+
+	var usernames []string
+	path := "/admin/users?limit=3"
+	for path != "" {
+		rec := doRequest(router, http.MethodGet, path, admin)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+		}
+		var page listUsersResponse
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("failed to decode user list: %v", err)
+		}
+		for _, user := range page.Users {
+			if _, ok := user["password"]; ok {
+				t.Errorf("expected the password to be left out, got %v", user)
+			}
+			usernames = append(usernames, user["username"])
+		}
+		path = ""
+		if page.Next != "" {
+			path = "/admin/users?limit=3&after=" + page.Next
+		}
+	}
+	if want := []string{"alice", "bob", "carol", "root"}; !slices.Equal(usernames, want) {
+		t.Errorf("expected %v, got %v", want, usernames)
+	}
+
+	rec := doRequest(router, http.MethodGet, "/admin/users/export", admin)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected an ndjson export, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 4 || !strings.Contains(lines[0], `"username":"alice"`) {
+		t.Errorf("expected a line per user, got %q", rec.Body.String())
+	}
+}
+
+func TestRotateSecrets(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {authify.AdminScope}}
+	store := stores.NewInMemoryUserStore(cfg)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	a := authify.NewAuthify(store, tokens)
+
+	_, _ = store.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin"})
+	_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+	adminToken := generateToken(t, tokens, "root")
+	userToken := generateToken(t, tokens, "alice")
+
+	rotate := func(router http.Handler, accessToken, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/rotateSecrets", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	body := `{"access_secret": "rotated", "refresh_secret": "rotated2", "keep_old": true}`
+
+	// the route is only mounted WithSecretRotation
+	assertErrorResponse(t, rotate(NewRouter(a), adminToken, body), http.StatusNotFound, codeRouteNotFound)
+
+	router := NewRouter(a, WithSecretRotation())
+	assertErrorResponse(t, rotate(router, userToken, body), http.StatusForbidden, authify.CodeInsufficientScope)
+	assertErrorResponse(t, rotate(router, adminToken, `{"access_secret": "rotated"}`), http.StatusBadRequest, authify.CodeMissingField)
+
+	if rec := rotate(router, adminToken, body); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected admin to rotate the secrets, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// tokens signed before stay valid with keep_old
+	rec := doRequest(router, http.MethodGet, "/v1/me", map[string]string{"Authorization": "Bearer " + userToken})
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the old token to be accepted during the grace window, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	body = `{"access_secret": "rotated-again", "refresh_secret": "rotated-again2"}`
+	if rec := rotate(router, adminToken, body); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected admin to rotate the secrets, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(router, http.MethodGet, "/v1/me", map[string]string{"Authorization": "Bearer " + userToken})
+	assertErrorResponse(t, rec, http.StatusUnauthorized, authify.CodeInvalidToken)
+}
+
+func generateToken(t *testing.T, tokens token.TokenManager, username string) string {
+	t.Helper()
+	accessToken, err := tokens.GenerateAccessToken(username, "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token for %s: %v", username, err)
+	}
+	return accessToken
+}
+
+func TestMe(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.Columns = maps.Clone(testStoreConfig.Columns)
+	cfg.Columns["role"] = stores.ColumnConfig{Type: "text", Default: "user", JWTClaim: "user_role"}
+
+	pgStore, err := stores.NewAuthifyDBFromConn(newFakeConn(), cfg)
+	if err != nil {
+		t.Fatalf("failed to create pg store: %v", err)
+	}
+	testCases := map[string]stores.Store{
+		"memstore": stores.NewInMemoryUserStore(cfg),
+		"pgstore":  pgStore,
+	}
+
+	for name, store := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tokens := newTestJWTManager(t, store, time.Minute)
+			router := NewRouter(authify.NewAuthify(store, tokens))
+			_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123", "role": "user"})
+
+			me := func(accessToken string) *httptest.ResponseRecorder {
+				return doRequest(router, http.MethodGet, "/v1/me", map[string]string{"Authorization": "Bearer " + accessToken})
+			}
+
+			t.Run("valid token", func(t *testing.T) {
+				rec := me(generateToken(t, tokens, "alice"))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+				}
+				var profile map[string]string
+				if err := json.NewDecoder(rec.Body).Decode(&profile); err != nil {
+					t.Fatalf("failed to decode profile: %v", err)
+				}
+				want := map[string]string{"username": "alice", "user_role": "user"}
+				if !maps.Equal(profile, want) {
+					t.Errorf("expected profile %v, got %v", want, profile)
+				}
+			})
+
+			t.Run("expired token", func(t *testing.T) {
+				expired, err := newTestJWTManager(t, store, -time.Minute).GenerateAccessToken("alice", "password123")
+				if err != nil {
+					t.Fatalf("failed to generate token: %v", err)
+				}
+				assertErrorResponse(t, me(expired), http.StatusUnauthorized, authify.CodeTokenExpired)
+			})
+
+			t.Run("missing token", func(t *testing.T) {
+				rec := doRequest(router, http.MethodGet, "/v1/me", nil)
+				assertErrorResponse(t, rec, http.StatusBadRequest, authify.CodeMissingField)
+			})
+
+			t.Run("deleted user", func(t *testing.T) {
+				deleter, ok := store.(stores.UserDeleter)
+				if !ok {
+					t.Skip("store cannot delete users")
+				}
+				_, _ = store.CreateUser(map[string]any{"username": "bob", "password": "password123"})
+				accessToken := generateToken(t, tokens, "bob")
+				if err := deleter.DeleteUser("bob"); err != nil {
+					t.Fatalf("failed to delete user: %v", err)
+				}
+				assertErrorResponse(t, me(accessToken), http.StatusNotFound, authify.CodeUserNotFound)
+			})
+		})
+	}
+}
+
+func TestUpdateMe(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.Columns = maps.Clone(testStoreConfig.Columns)
+	cfg.Columns["email"] = stores.ColumnConfig{Type: "text", Unique: true, Editable: true}
+	cfg.Columns["display_name"] = stores.ColumnConfig{Type: "text", Editable: true}
+	store := stores.NewInMemoryUserStore(cfg)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	router := NewRouter(authify.NewAuthify(store, tokens))
+	_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"})
+	_, _ = store.CreateUser(map[string]any{"username": "bob", "password": "password123", "email": "bob@example.com"})
+	aliceToken := generateToken(t, tokens, "alice")
+
+	updateMe := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/v1/me", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := updateMe(`{"display_name": "Alice"}`)
+	var profile map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&profile); err != nil || rec.Code != http.StatusOK || profile["display_name"] != "Alice" {
+		t.Fatalf("expected the updated profile, got %d: %v", rec.Code, profile)
+	}
+
+	cases := map[string]struct {
+		body   string
+		status int
+		code   authify.AuthErrorCode
+		field  string
+	}{
+		"role":            {`{"role": "admin"}`, http.StatusForbidden, authify.CodeFieldNotEditable, "role"},
+		"other user":      {`{"username": "bob", "display_name": "Bob"}`, http.StatusForbidden, authify.CodeFieldNotEditable, "username"},
+		"duplicate email": {`{"email": "bob@example.com"}`, http.StatusConflict, authify.CodeFieldConflict, "email"},
+		"empty":           {`{}`, http.StatusBadRequest, authify.CodeMissingField, ""},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rec := updateMe(tc.body)
+			var resp errorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != tc.status || resp.Code != tc.code || resp.Field != tc.field {
+				t.Errorf("expected %d %s naming %q, got %d: %+v", tc.status, tc.code, tc.field, rec.Code, resp)
+			}
+		})
+	}
+
+	bob, _ := store.GetUserByUsername("bob")
+	alice, _ := store.GetUserByUsername("alice")
+	if bob["display_name"] != "" || alice["display_name"] != "Alice" || alice["email"] != "alice@example.com" {
+		t.Errorf("expected only alice's display name to change, got %v and %v", alice, bob)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	sessions := stores.NewInMemorySessionStore()
+	a := authify.NewAuthify(store, tokens).WithSessionStore(sessions)
+	_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+
+	login := func(router http.Handler) (string, string) {
+		rec := doRequest(router, http.MethodPost, "/v1/tokens", map[string]string{
+			"authify-username":    "alice",
+			"authify-password":    "password123",
+			"authify-device-name": "Alice's phone",
+			"authify-platform":    "android",
+			"User-Agent":          "Mozilla/5.0\x00\x1b[31m" + strings.Repeat("x", 2*stores.MaxUserAgentLength),
+			"X-Forwarded-For":     "10.0.0.1, 203.0.113.7",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("generate token: expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var accessToken, refreshToken string
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if v, ok := strings.CutPrefix(line, "Access Token: "); ok {
+				accessToken = v
+			}
+			if v, ok := strings.CutPrefix(line, "Refresh Token: "); ok {
+				refreshToken = v
+			}
+		}
+		return accessToken, refreshToken
+	}
+
+	accessToken, refreshToken := login(NewRouter(a, WithTrustedForwardedFor()))
+
+	recorded, err := sessions.ListSessions("alice")
+	if err != nil || len(recorded) != 1 {
+		t.Fatalf("expected one recorded session, got %v (%v)", recorded, err)
+	}
+	session := recorded[0]
+	device := session.Device
+	if device.IP != "203.0.113.7" {
+		t.Errorf("expected the address appended by the proxy, got %q", device.IP)
+	}
+	if !strings.HasPrefix(device.UserAgent, "Mozilla/5.0[31m") || len(device.UserAgent) > stores.MaxUserAgentLength {
+		t.Errorf("expected a sanitized, truncated user agent, got %q", device.UserAgent)
+	}
+	if device.DeviceName != "Alice's phone" || device.Platform != "android" {
+		t.Errorf("expected device name and platform from the headers, got %+v", device)
+	}
+
+	claims, err := tokens.VerifyRefreshToken(refreshToken)
+	if err != nil {
+		t.Fatalf("failed to verify refresh token: %v", err)
+	}
+	if claims[token.ClaimSessionID] != session.ID {
+		t.Errorf("expected the refresh token to carry session %s, got %v", session.ID, claims[token.ClaimSessionID])
+	}
+
+	router := NewRouter(a)
+	rec := doRequest(router, http.MethodGet, "/v1/sessions", map[string]string{"Authorization": "Bearer " + accessToken})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list sessions: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var listed []stores.Session
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatalf("failed to decode sessions: %v", err)
+	}
+	if len(listed) != 1 || listed[0].ID != session.ID || listed[0].Device != device {
+		t.Errorf("expected the recorded session, got %+v", listed)
+	}
+
+	// X-Forwarded-For is ignored unless the router trusts it
+	login(router)
+	recorded, _ = sessions.ListSessions("alice")
+	if ip := recorded[len(recorded)-1].Device.IP; ip != "192.0.2.1" {
+		t.Errorf("expected the remote address, got %q", ip)
+	}
+}
+
+func TestTokenFamilies(t *testing.T) {
+	cfg := testStoreConfig
+	cfg.RolePermissions = map[string][]string{"admin": {authify.AdminScope}}
+	store := stores.NewInMemoryUserStore(cfg)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	a := authify.NewAuthify(store, tokens)
+	_, _ = store.CreateUser(map[string]any{"username": "root", "password": "password123", "role": "admin"})
+	_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+	adminToken := generateToken(t, tokens, "root")
+
+	families := func(router http.Handler, accessToken string) *httptest.ResponseRecorder {
+		return doRequest(router, http.MethodGet, "/admin/users/alice/tokenFamilies", map[string]string{"Authorization": "Bearer " + accessToken})
+	}
+	if rec := families(NewRouter(a), adminToken); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the route to be left out without a family store, got %d", rec.Code)
+	}
+
+	a.WithTokenFamilies(stores.NewInMemorySessionStore()).WithTokenFamilyGraceWindow(0)
+	router := NewRouter(a)
+	pair, err := a.LoginContext(context.Background(), "alice", "password123", stores.DeviceInfo{IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		return doRequest(router, http.MethodPost, "/v1/tokens/refresh", map[string]string{"authify-access": pair.AccessToken, "authify-refresh": refreshToken})
+	}
+	rec := refresh(pair.RefreshToken)
+	rotated := rec.Header().Get("authify-refresh")
+	if rec.Code != http.StatusOK || rotated == "" || rotated == pair.RefreshToken {
+		t.Fatalf("expected the refresh token to be rotated, got %d: %s", rec.Code, rec.Body.String())
+	}
+	assertErrorResponse(t, refresh(pair.RefreshToken), http.StatusUnauthorized, authify.CodeRefreshTokenReused)
+	assertErrorResponse(t, refresh(rotated), http.StatusUnauthorized, authify.CodeRefreshTokenReused)
+
+	assertErrorResponse(t, families(router, generateToken(t, tokens, "alice")), http.StatusForbidden, authify.CodeInsufficientScope)
+	rec = families(router, adminToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list token families: expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var listed tokenFamiliesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil {
+		t.Fatalf("failed to decode token families: %v", err)
+	}
+	if len(listed.Families) != 1 || len(listed.Families[0].Tokens) != 2 || listed.Families[0].Compromise == nil {
+		t.Fatalf("expected the compromised family of the login, got %+v", listed)
+	}
+	if c := listed.Families[0].Compromise; c.IP != "192.0.2.1" || c.JTI != listed.Families[0].Tokens[0].JTI {
+		t.Errorf("expected the reuse of the first token from the remote address, got %+v", c)
+	}
+}
+
+func TestUserExists(t *testing.T) {
+	store := stores.NewInMemoryUserStore(testStoreConfig)
+	tokens := newTestJWTManager(t, store, time.Minute)
+	a := authify.NewAuthify(store, tokens)
+	_, _ = store.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+
+	exists := func(router http.Handler, query string, headers map[string]string) *httptest.ResponseRecorder {
+		return doRequest(router, http.MethodGet, "/v1/users/exists?"+query, headers)
+	}
+
+	router := NewRouter(a, WithUserExistsRateLimit(3))
+	for query, want := range map[string]bool{"field=username&value=alice": true, "field=username&value=bob": false} {
+		rec := exists(router, query, nil)
+		var resp userExistsResponse
+		if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&resp) != nil || resp.Exists != want {
+			t.Errorf("%s: expected exists=%v, got %d: %s", query, want, rec.Code, rec.Body.String())
+		}
+	}
+	// only unique columns can be checked, and rejected checks count towards the limit too
+	assertErrorResponse(t, exists(router, "field=role&value=admin", nil), http.StatusBadRequest, authify.CodeColumnNotQueryable)
+
+	rec := exists(router, "field=username&value=alice", nil)
+	assertErrorResponse(t, rec, http.StatusTooManyRequests, authify.CodeRateLimited)
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("expected Retry-After: 60, got %q", retryAfter)
+	}
+	// clients are limited separately
+	req := httptest.NewRequest(http.MethodGet, "/v1/users/exists?field=username&value=alice", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	other := httptest.NewRecorder()
+	router.ServeHTTP(other, req)
+	if other.Code != http.StatusOK {
+		t.Errorf("expected another client to be allowed, got %d: %s", other.Code, other.Body.String())
+	}
+
+	router = NewRouter(a, WithUserExistsRateLimit(0), WithUserExistsToken())
+	assertErrorResponse(t, exists(router, "field=username&value=alice", nil), http.StatusBadRequest, authify.CodeMissingField)
+	assertErrorResponse(t, exists(router, "field=username&value=alice", map[string]string{"Authorization": "Bearer garbage"}),
+		http.StatusUnauthorized, authify.CodeInvalidToken)
+	headers := map[string]string{"Authorization": "Bearer " + generateToken(t, tokens, "alice")}
+	for range 20 {
+		if rec := exists(router, "field=username&value=alice", headers); rec.Code != http.StatusOK {
+			t.Fatalf("expected unlimited checks with a token, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package authifygrpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/HassanAli101/authify"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rpcFeatures are the features the RPCs of optional features belong to, the other RPCs are always served
+var rpcFeatures = map[string]authify.Feature{
+	"FederatedLogin": authify.FeatureFederatedLogin,
+	"ExchangeToken":  authify.FeatureTokenExchange,
+	"UserExists":     authify.FeatureUserExists,
+	"ListSessions":   authify.FeatureSessions,
+}
+
+// FeatureOf returns the feature the RPC named method belongs to, empty for the RPCs always served
+func FeatureOf(method string) authify.Feature {
+	return rpcFeatures[method]
+}
+
+// WithoutFeatures turns features off, their RPCs then fail with Unimplemented and are left out of
+// GetCapabilities, e.g. authify.FeatureTokenExchange for deployments that do not use it.
+func (s *AuthifyGRPCServer) WithoutFeatures(features ...authify.Feature) *AuthifyGRPCServer {
+	s.disabledFeatures = append(s.disabledFeatures, features...)
+	return s
+}
+
+// Capabilities returns the features the server enables and the RPCs it serves: the features of
+// its Authify instance, token exchange and UserExists unless turned off, and federated login
+// with a federator.
+func (s *AuthifyGRPCServer) Capabilities() *authify.Capabilities {
+	caps := authify.NewCapabilities(s.auth)
+	caps.Enable(authify.FeatureTokenExchange, authify.FeatureUserExists)
+	if s.federator != nil {
+		caps.Enable(authify.FeatureFederatedLogin)
+	}
+	caps.Disable(s.disabledFeatures...)
+
+	for _, method := range ServiceDesc.Methods {
+		if feature := FeatureOf(method.MethodName); feature == "" || caps.Enabled(feature) {
+			caps.AddEndpoint(method.MethodName)
+		}
+	}
+	return caps
+}
+
+// requireFeature fails with Unimplemented when feature is off, as for RPCs the server does not know
+func (s *AuthifyGRPCServer) requireFeature(feature authify.Feature) error {
+	if !s.Capabilities().Enabled(feature) {
+		return status.Error(codes.Unimplemented, fmt.Sprintf("%s is not enabled", feature))
+	}
+	return nil
+}
+
+// GetCapabilities returns the capabilities document of the server, see authify.Configuration.
+// It needs no credentials.
+func (s *AuthifyGRPCServer) GetCapabilities(ctx context.Context, req *Empty) (*Capabilities, error) {
+	doc := s.Capabilities().Document()
+	features := make([]string, len(doc.Features))
+	for i, feature := range doc.Features {
+		features[i] = string(feature)
+	}
+	return &Capabilities{
+		Endpoints:           doc.Endpoints,
+		Features:            features,
+		TokenType:           doc.TokenType,
+		GrantTypesSupported: doc.GrantTypes,
+		PasswordPolicy: &PasswordPolicy{
+			Required:  doc.PasswordPolicy.Required,
+			MaxLength: int32(doc.PasswordPolicy.MaxLength),
+		},
+		RegistrationMode: doc.RegistrationMode,
+		TokenLifetimes: &TokenLifetimes{
+			AccessTokenSeconds:  doc.TokenLifetimes.AccessSeconds,
+			RefreshTokenSeconds: doc.TokenLifetimes.RefreshSeconds,
+		},
+	}, nil
+}
@@ -0,0 +1,97 @@
+package authifygrpc
+
+import (
+	"errors"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// ErrorDomain identifies authify in the ErrorInfo details of gRPC statuses
+const ErrorDomain = "authify"
+
+var grpcCodeByCode = map[authify.AuthErrorCode]codes.Code{
+	authify.CodeUserExists:            codes.AlreadyExists,
+	authify.CodeUserNotFound:          codes.NotFound,
+	authify.CodeInvalidPassword:       codes.Unauthenticated,
+	authify.CodeMissingField:          codes.InvalidArgument,
+	authify.CodeTokenExpired:          codes.Unauthenticated,
+	authify.CodeTokenNotValidYet:      codes.Unauthenticated,
+	authify.CodeInvalidToken:          codes.Unauthenticated,
+	authify.CodeRefreshTokenExpired:   codes.Unauthenticated,
+	authify.CodeInsufficientScope:     codes.PermissionDenied,
+	authify.CodeAudienceMismatch:      codes.PermissionDenied,
+	authify.CodeHashingBusy:           codes.Unavailable,
+	authify.CodeAccountDisabled:       codes.PermissionDenied,
+	authify.CodeFieldTooLong:          codes.InvalidArgument,
+	authify.CodeExchangeForbidden:     codes.PermissionDenied,
+	authify.CodeNotExchangeable:       codes.PermissionDenied,
+	authify.CodeInvalidRole:           codes.InvalidArgument,
+	authify.CodeTimeout:               codes.DeadlineExceeded,
+	authify.CodeInvalidCredentials:    codes.Unauthenticated,
+	authify.CodeChallengeNotSupported: codes.Unimplemented,
+	authify.CodeNonceUsed:             codes.Unauthenticated,
+	authify.CodeTokenRevoked:          codes.Unauthenticated,
+	authify.CodeTokenVersionTooOld:    codes.Unauthenticated,
+	authify.CodeNonceExpired:          codes.Unauthenticated,
+	authify.CodeNotSupported:          codes.Unimplemented,
+	authify.CodeBindingMismatch:       codes.Unauthenticated,
+	authify.CodeColumnNotQueryable:    codes.InvalidArgument,
+	authify.CodeRateLimited:           codes.ResourceExhausted,
+	authify.CodeInvalidClient:         codes.Unauthenticated,
+	authify.CodeInvalidScope:          codes.InvalidArgument,
+	authify.CodeTokenUseMismatch:      codes.PermissionDenied,
+	authify.CodePasswordReused:        codes.InvalidArgument,
+	authify.CodeInvalidField:          codes.InvalidArgument,
+	authify.CodeStoreUnavailable:      codes.Unavailable,
+	authify.CodeFieldNotEditable:      codes.PermissionDenied,
+	authify.CodeFieldConflict:         codes.AlreadyExists,
+	authify.CodeInvalidIDToken:        codes.Unauthenticated,
+	authify.CodeFederatedLoginFailed:  codes.Unauthenticated,
+	authify.CodeTokenDurationTooLong:  codes.InvalidArgument,
+	authify.CodeRegistrationClosed:    codes.PermissionDenied,
+	authify.CodeInviteRequired:        codes.PermissionDenied,
+	authify.CodeInvalidInvite:         codes.PermissionDenied,
+	authify.CodeChallengeRequired:     codes.FailedPrecondition,
+	authify.CodeChallengeFailed:       codes.PermissionDenied,
+	authify.CodeRefreshTokenReused:    codes.Unauthenticated,
+}
+
+// toStatusError converts err into a gRPC status error whose details carry
+// an ErrorInfo with authify.ErrorCode(err) as the reason.
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	code := authify.ErrorCode(err)
+	grpcCode, ok := grpcCodeByCode[code]
+	if !ok {
+		grpcCode = codes.Internal
+	}
+
+	st := status.New(grpcCode, err.Error())
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Reason: string(code),
+		Domain: ErrorDomain,
+	}}
+	// invalid fields are named the way google.rpc.BadRequest does
+	var fieldErr *stores.FieldError
+	if errors.As(err, &fieldErr) {
+		details = append(details, &errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+				Field:       fieldErr.Field,
+				Description: fieldErr.Err.Error(),
+			}},
+		})
+	}
+	withDetails, detailErr := st.WithDetails(details...)
+	if detailErr != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
@@ -3,81 +3,441 @@ package authifygrpc
 import (
 	"context"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/lib"
+	"github.com/HassanAli101/authify/middleware"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
+// ServiceName is the full name of the AuthService, under which the server reports its health
+const ServiceName = "authify.AuthService"
+
+// ServiceDesc describes the RPCs of the AuthService, which the gateway of httpapi.WithGateway
+// serves over HTTP
+var ServiceDesc = &_AuthService_serviceDesc
+
+// MaxRecvMsgSize is the grpc.MaxRecvMsgSize cmd/grpc serves with. Requests only carry a few
+// short fields and tokens, so anything larger is refused before it is decoded.
+const MaxRecvMsgSize = 64 << 10
+
 type AuthifyGRPCServer struct {
 	UnimplementedAuthServiceServer
 	auth *authify.Authify
+
+	// userExistsLimit limits the UserExists calls of every client, nil lifts the limit
+	userExistsLimit *middleware.RateLimiter
+	userExistsToken bool
+
+	// federator serves FederatedLogin, which is unimplemented without one
+	federator Federator
+
+	// disabledFeatures are turned off by WithoutFeatures, see Capabilities
+	disabledFeatures []authify.Feature
+}
+
+// Federator exchanges the ID tokens of an identity provider for authify tokens,
+// as federation.OIDCFederator does.
+type Federator interface {
+	ExchangeIDTokenFrom(ctx context.Context, idToken string, device stores.DeviceInfo) (*authify.TokenPair, error)
 }
 
+// NewAuthifyGRPCServer serves a, allowing every client lib.DefaultUserExistsRateLimit
+// UserExists calls per minute.
 func NewAuthifyGRPCServer(a *authify.Authify) *AuthifyGRPCServer {
-	return &AuthifyGRPCServer{auth: a}
+	s := &AuthifyGRPCServer{auth: a}
+	return s.WithUserExistsRateLimit(lib.DefaultUserExistsRateLimit)
 }
 
-func (s *AuthifyGRPCServer) CreateUser(ctx context.Context, req *CreateUserRequest) (*Empty, error) {
+// WithUserExistsRateLimit allows every client, by peer address, perMinute UserExists calls,
+// 0 lifts the limit. Unlimited, UserExists lets anyone enumerate the users.
+func (s *AuthifyGRPCServer) WithUserExistsRateLimit(perMinute int) *AuthifyGRPCServer {
+	s.userExistsLimit = nil
+	if perMinute > 0 {
+		s.userExistsLimit = middleware.NewRateLimiter(perMinute, time.Minute)
+	}
+	return s
+}
+
+// WithUserExistsToken requires a valid access token in the metadata of UserExists calls.
+func (s *AuthifyGRPCServer) WithUserExistsToken(required bool) *AuthifyGRPCServer {
+	s.userExistsToken = required
+	return s
+}
+
+// WithFederator serves FederatedLogin with f, see federation.NewOIDCFederator.
+func (s *AuthifyGRPCServer) WithFederator(f Federator) *AuthifyGRPCServer {
+	s.federator = f
+	return s
+}
+
+func (s *AuthifyGRPCServer) CreateUser(ctx context.Context, req *CreateUserRequest) (*CreateUserResponse, error) {
 
 	userData := map[string]any{
 		"username": req.Username,
 		"password": req.Password,
 	}
 
-	if err := s.auth.Store.CreateUser(userData); err != nil {
-		return nil, err
+	reg := authify.Registration{
+		AccessToken: middleware.AccessTokenFromMetadata(ctx),
+		InviteCode:  req.InviteCode,
+	}
+	user, err := s.auth.RegisterUser(ctx, userData, reg)
+	if err != nil {
+		return nil, toStatusError(err)
 	}
 
-	return &Empty{}, nil
+	return &CreateUserResponse{Identity: user, User: &User{Fields: user}}, nil
 }
 
 func (s *AuthifyGRPCServer) GenerateToken(ctx context.Context, req *GenerateTokenRequest) (*TokenResponse, error) {
 
-	access, err := s.auth.Tokens.GenerateAccessToken(req.Username, req.Password)
+	pair, err := s.auth.LoginContext(ctx, req.Username, req.Password, deviceFromRequest(ctx, req.GetDeviceInfo(), req.Device))
 	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &TokenResponse{
+		AccessToken:      pair.AccessToken,
+		RefreshToken:     pair.RefreshToken,
+		AccessExpiresAt:  pair.AccessExpiresAt.Unix(),
+		RefreshExpiresAt: pair.RefreshExpiresAt.Unix(),
+	}, nil
+}
+
+func (s *AuthifyGRPCServer) FederatedLogin(ctx context.Context, req *FederatedLoginRequest) (*TokenResponse, error) {
+	if err := s.requireFeature(authify.FeatureFederatedLogin); err != nil {
 		return nil, err
 	}
+	pair, err := s.federator.ExchangeIDTokenFrom(ctx, req.IdToken, deviceFromRequest(ctx, req.GetDeviceInfo(), ""))
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &TokenResponse{
+		AccessToken:      pair.AccessToken,
+		RefreshToken:     pair.RefreshToken,
+		AccessExpiresAt:  pair.AccessExpiresAt.Unix(),
+		RefreshExpiresAt: pair.RefreshExpiresAt.Unix(),
+	}, nil
+}
+
+func (s *AuthifyGRPCServer) VerifyToken(ctx context.Context, req *VerifyTokenRequest) (*VerifyTokenResponse, error) {
+
+	claims, refreshed, err := s.auth.AuthenticateSliding(req.AccessToken)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
 
-	reqData := map[string]any{
-		"ip": req.Device,
+	resp := &VerifyTokenResponse{
+		Claims:         toStringMap(claims),
+		Scopes:         token.ScopesFromClaims(claims),
+		RefreshedToken: refreshed,
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		resp.ExpiresAt = exp.Unix()
+		resp.ExpiresIn = max(int64(time.Until(exp.Time).Seconds()), 0)
 	}
+	return resp, nil
+}
+
+func (s *AuthifyGRPCServer) RefreshToken(ctx context.Context, req *RefreshTokenRequest) (*TokenResponse, error) {
 
-	refresh, err := s.auth.Tokens.GenerateRefreshToken(req.Username, reqData)
+	pair, err := s.auth.RefreshTokens(ctx, token.RefreshTokensRequest{
+		AccessToken:  req.AccessToken,
+		RefreshToken: req.RefreshToken,
+		Device:       deviceFromRequest(ctx, req.GetDeviceInfo(), ""),
+	})
 	if err != nil {
-		return nil, err
+		return nil, toStatusError(err)
 	}
 
+	// the refresh token is a new one when the token manager rotates them
 	return &TokenResponse{
-		AccessToken:  access,
-		RefreshToken: refresh,
+		AccessToken:      pair.AccessToken,
+		RefreshToken:     pair.RefreshToken,
+		Role:             token.RoleFromClaims(s.auth.Tokens, pair.AccessClaims),
+		AccessExpiresAt:  pair.AccessExpiresAt.Unix(),
+		RefreshExpiresAt: pair.RefreshExpiresAt.Unix(),
 	}, nil
 }
 
-func (s *AuthifyGRPCServer) VerifyToken(ctx context.Context, req *VerifyTokenRequest) (*VerifyTokenResponse, error) {
+// SetUserStatus suspends or reactivates a user. The caller must present an access token
+// granting authify.AdminScope in the request metadata.
+func (s *AuthifyGRPCServer) SetUserStatus(ctx context.Context, req *SetUserStatusRequest) (*UserStatusResponse, error) {
 
-	claims, err := s.auth.Tokens.VerifyAccessToken(req.AccessToken)
+	claims, err := s.auth.AuthenticateClaims(middleware.AccessTokenFromMetadata(ctx))
 	if err != nil {
-		return nil, err
+		return nil, toStatusError(err)
+	}
+	if !token.HasScopes(claims, authify.AdminScope) {
+		return nil, toStatusError(token.ErrInsufficientScope)
 	}
 
-	return &VerifyTokenResponse{
-		Claims: toStringMap(claims),
+	if err := s.auth.SetUserDisabled(req.Username, req.Disabled); err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &UserStatusResponse{
+		Username: req.Username,
+		Disabled: req.Disabled,
 	}, nil
 }
 
-func (s *AuthifyGRPCServer) RefreshToken(ctx context.Context, req *RefreshTokenRequest) (*TokenResponse, error) {
+// ChangeRole assigns a new role to a user. Like SetUserStatus, the caller must present
+// an access token granting authify.AdminScope in the request metadata.
+func (s *AuthifyGRPCServer) ChangeRole(ctx context.Context, req *ChangeRoleRequest) (*ChangeRoleResponse, error) {
+
+	claims, err := s.auth.AuthenticateClaims(middleware.AccessTokenFromMetadata(ctx))
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	if !token.HasScopes(claims, authify.AdminScope) {
+		return nil, toStatusError(token.ErrInsufficientScope)
+	}
+
+	if err := s.auth.ChangeRole(req.Username, req.Role); err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &ChangeRoleResponse{
+		Username: req.Username,
+		Role:     req.Role,
+	}, nil
+}
 
-	reqData := map[string]any{}
+// InvalidateAllTokens rejects every token issued so far, the caller's included. Like
+// SetUserStatus, the caller must present an access token granting authify.AdminScope.
+func (s *AuthifyGRPCServer) InvalidateAllTokens(ctx context.Context, req *Empty) (*InvalidateAllTokensResponse, error) {
 
-	access, _, err := s.auth.Tokens.RefreshToken(req.AccessToken, req.RefreshToken, reqData)
+	claims, err := s.auth.AuthenticateClaims(middleware.AccessTokenFromMetadata(ctx))
 	if err != nil {
+		return nil, toStatusError(err)
+	}
+	if !token.HasScopes(claims, authify.AdminScope) {
+		return nil, toStatusError(token.ErrInsufficientScope)
+	}
+
+	notBefore, err := s.auth.InvalidateAllTokens()
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &InvalidateAllTokensResponse{
+		NotBefore: notBefore.Unix(),
+	}, nil
+}
+
+// ChangePassword replaces the password of the access token's user after checking the current one.
+// The token is read from the request, or the request metadata when the field is empty.
+func (s *AuthifyGRPCServer) ChangePassword(ctx context.Context, req *ChangePasswordRequest) (*Empty, error) {
+
+	accessToken := req.AccessToken
+	if accessToken == "" {
+		accessToken = middleware.AccessTokenFromMetadata(ctx)
+	}
+
+	username, _, err := s.auth.Authenticate(accessToken)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	if err := s.auth.ChangePassword(username, req.CurrentPassword, req.NewPassword); err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &Empty{}, nil
+}
+
+// Logout revokes the access token, and the refresh token when given, or every token of the
+// user with everywhere set. The token is read like in ChangePassword.
+func (s *AuthifyGRPCServer) Logout(ctx context.Context, req *LogoutRequest) (*Empty, error) {
+
+	accessToken := req.AccessToken
+	if accessToken == "" {
+		accessToken = middleware.AccessTokenFromMetadata(ctx)
+	}
+
+	if err := s.auth.Logout(accessToken, req.RefreshToken, req.Everywhere); err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &Empty{}, nil
+}
+
+// GetSelf returns the profile of the user the access token was issued to.
+// The token is read from the request, or the request metadata when the field is empty.
+func (s *AuthifyGRPCServer) GetSelf(ctx context.Context, req *GetSelfRequest) (*GetSelfResponse, error) {
+
+	accessToken := req.AccessToken
+	if accessToken == "" {
+		accessToken = middleware.AccessTokenFromMetadata(ctx)
+	}
+
+	fields, err := s.auth.GetSelf(accessToken)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &GetSelfResponse{
+		Fields: fields,
+	}, nil
+}
+
+// UpdateSelf changes the editable fields of the profile of the user the access token was issued
+// to, and returns the updated profile. The token is read from the request, or the request
+// metadata when the field is empty.
+func (s *AuthifyGRPCServer) UpdateSelf(ctx context.Context, req *UpdateSelfRequest) (*GetSelfResponse, error) {
+
+	accessToken := req.AccessToken
+	if accessToken == "" {
+		accessToken = middleware.AccessTokenFromMetadata(ctx)
+	}
+
+	if len(req.Fields) == 0 {
+		return nil, toStatusError(fmt.Errorf("%w: fields", stores.ErrMissingField))
+	}
+	if err := s.auth.UpdateSelf(ctx, accessToken, req.Fields); err != nil {
+		return nil, toStatusError(err)
+	}
+
+	fields, err := s.auth.GetSelf(accessToken)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return &GetSelfResponse{
+		Fields: fields,
+	}, nil
+}
+
+func (s *AuthifyGRPCServer) ListSessions(ctx context.Context, req *ListSessionsRequest) (*ListSessionsResponse, error) {
+	if err := s.requireFeature(authify.FeatureSessions); err != nil {
 		return nil, err
 	}
 
+	accessToken := req.AccessToken
+	if accessToken == "" {
+		accessToken = middleware.AccessTokenFromMetadata(ctx)
+	}
+
+	sessions, err := s.auth.ListSessions(accessToken)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	resp := &ListSessionsResponse{}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &Session{
+			Id:         session.ID,
+			CreatedAt:  session.CreatedAt.Unix(),
+			DeviceInfo: toDeviceInfo(session.Device),
+		})
+	}
+	return resp, nil
+}
+
+// ExchangeToken trades the user's subject token for a token acting on their behalf,
+// the actor authenticating with its own credentials.
+func (s *AuthifyGRPCServer) ExchangeToken(ctx context.Context, req *ExchangeTokenRequest) (*TokenResponse, error) {
+	if err := s.requireFeature(authify.FeatureTokenExchange); err != nil {
+		return nil, err
+	}
+
+	ttl := time.Duration(req.TtlSeconds) * time.Second
+	exchanged, err := s.auth.Tokens.ExchangeToken(req.SubjectToken, req.ActorUsername, req.ActorPassword, req.Audience, ttl)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
+	return &TokenResponse{
+		AccessToken: exchanged,
+	}, nil
+}
+
+// GenerateServiceToken issues an access token to a service account, see authify.Authify.GenerateServiceToken.
+func (s *AuthifyGRPCServer) GenerateServiceToken(ctx context.Context, req *ServiceTokenRequest) (*TokenResponse, error) {
+
+	accessToken, expiresAt, err := s.auth.GenerateServiceToken(ctx, req.ClientId, req.ClientSecret, req.Scopes)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+
 	return &TokenResponse{
-		AccessToken: access,
+		AccessToken:     accessToken,
+		AccessExpiresAt: expiresAt.Unix(),
 	}, nil
 }
 
+// deviceFromRequest reads the client's device from the device info of a request message,
+// falling back to the legacy device field of GenerateToken, then the peer address, for its IP,
+// and to the user-agent metadata sent by gRPC clients for its user agent.
+// UserExists tells whether a unique field value is taken, see authify.Authify.UserExists.
+// Clients are rate limited by peer address, the device info they could send is not trusted.
+func (s *AuthifyGRPCServer) UserExists(ctx context.Context, req *UserExistsRequest) (*UserExistsResponse, error) {
+	if err := s.requireFeature(authify.FeatureUserExists); err != nil {
+		return nil, err
+	}
+
+	if s.userExistsLimit != nil {
+		if _, err := s.userExistsLimit.Allow(deviceFromRequest(ctx, nil, "").IP); err != nil {
+			return nil, toStatusError(err)
+		}
+	}
+	if s.userExistsToken {
+		if _, err := s.auth.AuthenticateClaims(middleware.AccessTokenFromMetadata(ctx)); err != nil {
+			return nil, toStatusError(err)
+		}
+	}
+	if req.Field == "" || req.Value == "" {
+		return nil, toStatusError(fmt.Errorf("%w: field and value are required", authify.ErrMissingField))
+	}
+
+	exists, err := s.auth.UserExists(ctx, req.Field, req.Value)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return &UserExistsResponse{Exists: exists}, nil
+}
+
+func deviceFromRequest(ctx context.Context, info *DeviceInfo, legacyDevice string) stores.DeviceInfo {
+	device := stores.DeviceInfo{
+		IP:         info.GetIp(),
+		UserAgent:  info.GetUserAgent(),
+		DeviceName: info.GetDeviceName(),
+		Platform:   info.GetPlatform(),
+		DeviceID:   info.GetDeviceId(),
+	}
+	if device.IP == "" {
+		device.IP = legacyDevice
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && device.UserAgent == "" {
+		if ua := md.Get("user-agent"); len(ua) > 0 {
+			device.UserAgent = ua[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok && device.IP == "" {
+		device.IP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(device.IP); err == nil {
+			device.IP = host
+		}
+	}
+	return device
+}
+
+func toDeviceInfo(d stores.DeviceInfo) *DeviceInfo {
+	return &DeviceInfo{
+		Ip:         d.IP,
+		UserAgent:  d.UserAgent,
+		DeviceName: d.DeviceName,
+		Platform:   d.Platform,
+	}
+}
+
 func toStringMap(in map[string]any) map[string]string {
 	out := make(map[string]string)
 
@@ -86,4 +446,4 @@ func toStringMap(in map[string]any) map[string]string {
 	}
 
 	return out
-}
\ No newline at end of file
+}
@@ -0,0 +1,788 @@
+package lib
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/secrets"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// EnvPrefix is prepended to every configuration key, so that authify's
+	// variables do not collide with other services sharing the environment.
+	EnvPrefix = "AUTHIFY_"
+
+	// ConfigFileEnv names the variable pointing at an optional YAML config file.
+	ConfigFileEnv = EnvPrefix + "CONFIG"
+
+	// EnvFileEnv names the variable pointing at the .env file read by ReadEnvVars,
+	// ".env" in the working directory when unset.
+	EnvFileEnv = EnvPrefix + "ENV_FILE"
+
+	defaultEnvFile = ".env"
+
+	// Values of TOKEN_MODE, see OpaqueTokensEnabled
+	TokenModeJWT    = "jwt"
+	TokenModeOpaque = "opaque"
+
+	// Values of REST_GATEWAY, see RESTGatewayMode
+	RESTGatewayOff       = "off"
+	RESTGatewayAlongside = "alongside"
+	RESTGatewayOnly      = "only"
+
+	fileSuffix = "_FILE"
+)
+
+// Config holds the values read by ReadEnvVars. Secrets, including the database URL
+// which carries the database password, are redacted when a Config is printed or logged.
+type Config struct {
+	DatabaseURL         secrets.SecretString `yaml:"database_url"`
+	JWTAccessSecret     secrets.SecretString `yaml:"jwt_secret"`
+	JWTRefreshSecret    secrets.SecretString `yaml:"jwt_refresh_secret"`
+	ServerPort          string               `yaml:"server_port"`
+	StoreConfigFilePath string               `yaml:"store_config_file_path"`
+	TokenConfigFilePath string               `yaml:"token_config_file_path"`
+
+	// Optional identity provider users can sign in with, see LoadFederationConfig
+	FederationConfigFilePath string `yaml:"federation_config_file_path"`
+
+	// Connection parameters in the libpq variables, used in place of DATABASE_URL when it is
+	// unset, as injected by managed Postgres services and CI systems, see DatabaseURLFromParts
+	PGHost     string               `yaml:"pghost"`
+	PGPort     string               `yaml:"pgport"`
+	PGUser     string               `yaml:"pguser"`
+	PGPassword secrets.SecretString `yaml:"pgpassword"`
+	PGDatabase string               `yaml:"pgdatabase"`
+	PGSSLMode  string               `yaml:"pgsslmode"`
+
+	// Optional client credentials required by the OAuth2 token endpoint when set
+	OAuthClientID     string               `yaml:"oauth_client_id"`
+	OAuthClientSecret secrets.SecretString `yaml:"oauth_client_secret"`
+
+	// Optional secrets replaced by a rotation, still accepted when verifying tokens
+	JWTAccessSecretPrevious  secrets.SecretString `yaml:"jwt_secret_previous"`
+	JWTRefreshSecretPrevious secrets.SecretString `yaml:"jwt_refresh_secret_previous"`
+
+	// Optional base64 encoded AES key (16, 24 or 32 bytes) encrypting the claims of encrypted columns,
+	// and the key it replaced, still used to decrypt older tokens, see ClaimsEncryptionKeys
+	ClaimsEncryptionKey         secrets.SecretString `yaml:"claims_encryption_key"`
+	ClaimsEncryptionKeyPrevious secrets.SecretString `yaml:"claims_encryption_key_previous"`
+
+	// Optional "true" to check the user's status on every access token verification
+	StrictVerification string `yaml:"strict_verification"`
+
+	// Optional "true" to record the client address from X-Forwarded-For, behind a reverse proxy
+	TrustForwardedFor string `yaml:"trust_forwarded_for"`
+
+	// Optional "true" to register gRPC server reflection, for tools like grpcurl
+	GRPCReflection string `yaml:"grpc_reflection"`
+
+	// Optional "true" to tell unknown users from wrong passwords in login errors
+	PreciseLoginErrors string `yaml:"precise_login_errors"`
+
+	// Optional "true" to log in with challenge proofs instead of passwords on the token route
+	ChallengeLogin string `yaml:"challenge_login"`
+
+	// Optional "true" to tell the replicas sharing the database about the changes of users,
+	// see InvalidationBusEnabled
+	InvalidationBus string `yaml:"invalidation_bus"`
+
+	// Optional "true" to answer token refreshes with JSON holding the new token and the user's role
+	RefreshRole string `yaml:"refresh_role"`
+
+	// Optional "true" to serve the admin route rotating the signing secrets at runtime
+	SecretRotation string `yaml:"secret_rotation"`
+
+	// Optional lifetime of access tokens overriding the duration of the token config, as a
+	// Go duration ("15m", "2h30m") or, for older setups, a whole number of minutes
+	TokenExpiration        string `yaml:"token_expiration"`
+	TokenExpirationMinutes string `yaml:"token_expiration_time_minutes"`
+
+	// Optional remaining lifetime, as a Go duration, below which verified access tokens are
+	// replaced, see SlidingExpiration
+	SlidingExpirationThreshold string `yaml:"sliding_expiration"`
+
+	// Optional minimum format version of accepted tokens, see token.JWTManager.WithMinimumTokenVersion
+	MinTokenVersion string `yaml:"minimum_token_version"`
+
+	// Optional binding of refresh tokens, "none" (the default), "ip" or "device", see BindingMode
+	TokenBinding string `yaml:"token_binding"`
+
+	// Optional requests per minute and client allowed to check whether a user exists, see
+	// UserExistsRateLimit, and "true" to require an access token for it
+	UserExistsLimit string `yaml:"user_exists_rate_limit"`
+	UserExistsToken string `yaml:"user_exists_require_token"`
+
+	// Optional number of seconds the responses of user creations with an Idempotency-Key are kept,
+	// see IdempotencyTTL
+	IdempotencyTTLSeconds string `yaml:"idempotency_ttl_seconds"`
+
+	// Optional kind of tokens issued, "jwt" (the default) or "opaque"
+	TokenMode string `yaml:"token_mode"`
+
+	// Optional policy of user creations, "open" (the default), "invite" or "closed", see Registration
+	RegistrationPolicy string `yaml:"registration_policy"`
+
+	// Optional comma separated features turned off in the HTTP and gRPC servers, along with their
+	// endpoints, e.g. "introspection,token_exchange", see DisabledFeatureList
+	DisabledFeatures string `yaml:"disabled_features"`
+
+	// Optional challenge of the clients creating many users, "off" (the default), "pow" or
+	// "captcha", with its settings, see SignupChallenge
+	SignupChallengeMode      string               `yaml:"signup_challenge"`
+	SignupChallengeThreshold string               `yaml:"signup_challenge_threshold"`
+	SignupPoWDifficulty      string               `yaml:"signup_pow_difficulty"`
+	CaptchaVerifyURL         string               `yaml:"captcha_verify_url"`
+	CaptchaSecret            secrets.SecretString `yaml:"captcha_secret"`
+
+	// Optional REST gateway of the gRPC service served by cmd/server, see RESTGatewayMode
+	RESTGateway string `yaml:"rest_gateway"`
+
+	// Optional prefix of the request headers read by the HTTP routes, "authify-" by default,
+	// see HeaderPrefix
+	HeaderPrefix string `yaml:"header_prefix"`
+
+	// Optional file the servers write their process ID to, see WritePIDFile
+	PIDFile string `yaml:"pid_file"`
+
+	// Optional HTTP server timeouts, in seconds, see ServerTimeouts for their defaults
+	ReadHeaderTimeoutSeconds string `yaml:"read_header_timeout_seconds"`
+	ReadTimeoutSeconds       string `yaml:"read_timeout_seconds"`
+	WriteTimeoutSeconds      string `yaml:"write_timeout_seconds"`
+	IdleTimeoutSeconds       string `yaml:"idle_timeout_seconds"`
+	RequestTimeoutSeconds    string `yaml:"request_timeout_seconds"`
+	ShutdownTimeoutSeconds   string `yaml:"shutdown_timeout_seconds"`
+
+	// Optional reaching of the database at startup, see DatabaseConnectOptions: the timeout of
+	// every attempt and the wait before the first retry, in seconds, and the number of retries
+	DatabaseConnectTimeoutSeconds string `yaml:"database_connect_timeout_seconds"`
+	DatabaseRetryIntervalSeconds  string `yaml:"database_retry_interval_seconds"`
+	DatabaseStartupRetries        string `yaml:"database_startup_retries"`
+}
+
+// Defaults of ServerTimeouts, used for unset or invalid values. The write timeout
+// leaves the server time to answer requests that hit the request timeout.
+const (
+	DefaultReadHeaderTimeout = 5 * time.Second
+	DefaultReadTimeout       = 15 * time.Second
+	DefaultWriteTimeout      = 30 * time.Second
+	DefaultIdleTimeout       = 60 * time.Second
+	DefaultRequestTimeout    = 10 * time.Second
+	DefaultShutdownTimeout   = 15 * time.Second
+)
+
+// DefaultDatabaseStartupRetries is the number of times the servers retry reaching the database
+// at startup when DATABASE_STARTUP_RETRIES is unset, about half a minute with the default interval.
+const DefaultDatabaseStartupRetries = 5
+
+// DefaultSignupChallengeThreshold is the number of users a client address can create per hour
+// before SIGNUP_CHALLENGE challenges it, when SIGNUP_CHALLENGE_THRESHOLD is unset.
+const DefaultSignupChallengeThreshold = 5
+
+// DefaultUserExistsRateLimit is the number of existence checks a client can make per minute
+// when USER_EXISTS_RATE_LIMIT is unset, enough for a signup form and too few to enumerate users.
+const DefaultUserExistsRateLimit = 10
+
+// ServerTimeouts bounds how long the HTTP server waits on clients and handlers.
+type ServerTimeouts struct {
+	ReadHeader time.Duration // reading the request headers
+	Read       time.Duration // reading the whole request
+	Write      time.Duration // from the end of the request headers to the end of the response
+	Idle       time.Duration // keep-alive connections waiting for their next request
+	Request    time.Duration // deadline of the request context, answered with a 503 once it fires
+	Shutdown   time.Duration // requests in flight on SIGINT or SIGTERM, before the server exits anyway
+}
+
+// StrictVerificationEnabled reports whether STRICT_VERIFICATION is set to a true value
+func (c *Config) StrictVerificationEnabled() bool {
+	strict, _ := strconv.ParseBool(c.StrictVerification)
+	return strict
+}
+
+// TrustForwardedForEnabled reports whether TRUST_FORWARDED_FOR is set to a true value
+func (c *Config) TrustForwardedForEnabled() bool {
+	trust, _ := strconv.ParseBool(c.TrustForwardedFor)
+	return trust
+}
+
+// ServerTimeouts reads the *_TIMEOUT_SECONDS keys, falling back to the defaults
+// for unset, invalid or non-positive values.
+func (c *Config) ServerTimeouts() ServerTimeouts {
+	return ServerTimeouts{
+		ReadHeader: secondsOrDefault(c.ReadHeaderTimeoutSeconds, DefaultReadHeaderTimeout),
+		Read:       secondsOrDefault(c.ReadTimeoutSeconds, DefaultReadTimeout),
+		Write:      secondsOrDefault(c.WriteTimeoutSeconds, DefaultWriteTimeout),
+		Idle:       secondsOrDefault(c.IdleTimeoutSeconds, DefaultIdleTimeout),
+		Request:    secondsOrDefault(c.RequestTimeoutSeconds, DefaultRequestTimeout),
+		Shutdown:   secondsOrDefault(c.ShutdownTimeoutSeconds, DefaultShutdownTimeout),
+	}
+}
+
+func secondsOrDefault(val string, def time.Duration) time.Duration {
+	seconds, err := strconv.ParseFloat(val, 64)
+	if err != nil || seconds <= 0 {
+		return def
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// DatabaseConnectOptions reads DATABASE_CONNECT_TIMEOUT_SECONDS, DATABASE_RETRY_INTERVAL_SECONDS
+// and DATABASE_STARTUP_RETRIES for stores.NewAuthifyDB. Unset or invalid values fall back to the
+// defaults of the stores package, and to DefaultDatabaseStartupRetries; 0 retries tries once.
+func (c *Config) DatabaseConnectOptions() []stores.ConnectOption {
+	retries, err := strconv.Atoi(c.DatabaseStartupRetries)
+	if err != nil || retries < 0 {
+		retries = DefaultDatabaseStartupRetries
+	}
+	return []stores.ConnectOption{
+		stores.WithConnectTimeout(secondsOrDefault(c.DatabaseConnectTimeoutSeconds, stores.DefaultConnectTimeout)),
+		stores.WithRetryInterval(secondsOrDefault(c.DatabaseRetryIntervalSeconds, stores.DefaultRetryInterval)),
+		stores.WithStartupRetries(retries),
+	}
+}
+
+// GRPCReflectionEnabled reports whether GRPC_REFLECTION is set to a true value
+func (c *Config) GRPCReflectionEnabled() bool {
+	enabled, _ := strconv.ParseBool(c.GRPCReflection)
+	return enabled
+}
+
+// PreciseLoginErrorsEnabled reports whether PRECISE_LOGIN_ERRORS is set to a true value
+func (c *Config) PreciseLoginErrorsEnabled() bool {
+	precise, _ := strconv.ParseBool(c.PreciseLoginErrors)
+	return precise
+}
+
+// ChallengeLoginEnabled reports whether CHALLENGE_LOGIN is set to a true value
+func (c *Config) ChallengeLoginEnabled() bool {
+	enabled, _ := strconv.ParseBool(c.ChallengeLogin)
+	return enabled
+}
+
+// InvalidationBusEnabled reports whether INVALIDATION_BUS is set to a true value, for servers
+// running as replicas: their changes of users are then sent to the others over postgres
+// LISTEN/NOTIFY, which drop what they cached about them, see stores.PGInvalidationBus.
+func (c *Config) InvalidationBusEnabled() bool {
+	enabled, _ := strconv.ParseBool(c.InvalidationBus)
+	return enabled
+}
+
+// RefreshRoleEnabled reports whether REFRESH_ROLE is set to a true value
+func (c *Config) RefreshRoleEnabled() bool {
+	enabled, _ := strconv.ParseBool(c.RefreshRole)
+	return enabled
+}
+
+// SecretRotationEnabled reports whether SECRET_ROTATION is set to a true value
+func (c *Config) SecretRotationEnabled() bool {
+	enabled, _ := strconv.ParseBool(c.SecretRotation)
+	return enabled
+}
+
+// DatabaseURLFromParts builds a postgres connection string from PGHOST, PGPORT (5432 by default),
+// PGUSER, PGPASSWORD, PGDATABASE and PGSSLMODE, the latter two optional. It fails with
+// ErrMissingDatabaseURL, naming the missing variables, unless PGHOST, PGUSER and PGDATABASE are set.
+func (c *Config) DatabaseURLFromParts() (secrets.SecretString, error) {
+	var missing []string
+	for _, part := range []struct{ name, value string }{{"PGHOST", c.PGHost}, {"PGUSER", c.PGUser}, {"PGDATABASE", c.PGDatabase}} {
+		if part.value == "" {
+			missing = append(missing, part.name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w, nor are %s", ErrMissingDatabaseURL, strings.Join(missing, ", "))
+	}
+	port := c.PGPort
+	if port == "" {
+		port = "5432"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("%w: PGPORT %q is not a port number", ErrInvalidDatabaseURL, port)
+	}
+
+	dsn := url.URL{Scheme: "postgres", Host: net.JoinHostPort(c.PGHost, port), Path: "/" + c.PGDatabase}
+	if c.PGPassword != "" {
+		dsn.User = url.UserPassword(c.PGUser, c.PGPassword.Reveal())
+	} else {
+		dsn.User = url.User(c.PGUser)
+	}
+	if c.PGSSLMode != "" {
+		dsn.RawQuery = url.Values{"sslmode": {c.PGSSLMode}}.Encode()
+	}
+	return secrets.SecretString(dsn.String()), nil
+}
+
+// ClaimsEncryptionKeys decodes CLAIMS_ENCRYPTION_KEY and CLAIMS_ENCRYPTION_KEY_PREVIOUS, nil when
+// unset. Keys that are not base64 encoded 16, 24 or 32 bytes fail with ErrInvalidEncryptionKey.
+func (c *Config) ClaimsEncryptionKeys() (current, previous []byte, err error) {
+	keys := make([][]byte, 2)
+	for i, key := range []struct {
+		name  string
+		value secrets.SecretString
+	}{{"CLAIMS_ENCRYPTION_KEY", c.ClaimsEncryptionKey}, {"CLAIMS_ENCRYPTION_KEY_PREVIOUS", c.ClaimsEncryptionKeyPrevious}} {
+		if key.value == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(key.value.Reveal())
+		if err != nil || (len(decoded) != 16 && len(decoded) != 24 && len(decoded) != 32) {
+			return nil, nil, fmt.Errorf("%w: %s is not a base64 encoded 16, 24 or 32 byte key", ErrInvalidEncryptionKey, key.name)
+		}
+		keys[i] = decoded
+	}
+	return keys[0], keys[1], nil
+}
+
+// UserExistsRateLimit returns the requests per minute and client set by USER_EXISTS_RATE_LIMIT,
+// DefaultUserExistsRateLimit when unset and 0 for no limit. Values that are not a whole number
+// of at least 0 fail with ErrInvalidRateLimit.
+func (c *Config) UserExistsRateLimit() (int, error) {
+	if c.UserExistsLimit == "" {
+		return DefaultUserExistsRateLimit, nil
+	}
+	limit, err := strconv.Atoi(c.UserExistsLimit)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("%w: USER_EXISTS_RATE_LIMIT %q is not a number of requests per minute", ErrInvalidRateLimit, c.UserExistsLimit)
+	}
+	return limit, nil
+}
+
+// UserExistsTokenRequired reports whether USER_EXISTS_REQUIRE_TOKEN is set to a true value
+func (c *Config) UserExistsTokenRequired() bool {
+	required, _ := strconv.ParseBool(c.UserExistsToken)
+	return required
+}
+
+// IdempotencyTTL returns how long IDEMPOTENCY_TTL_SECONDS keeps the responses of user creations
+// with an Idempotency-Key header, 0 when unset, invalid or not positive, which turns the header off.
+func (c *Config) IdempotencyTTL() time.Duration {
+	return secondsOrDefault(c.IdempotencyTTLSeconds, 0)
+}
+
+// OpaqueTokensEnabled reports whether TOKEN_MODE selects opaque tokens, kept server-side
+// in the session store, over JWTs. Values other than "jwt" and "opaque" fail with ErrInvalidTokenMode.
+func (c *Config) OpaqueTokensEnabled() (bool, error) {
+	switch c.TokenMode {
+	case "", TokenModeJWT:
+		return false, nil
+	case TokenModeOpaque:
+		return true, nil
+	}
+	return false, fmt.Errorf("%w: TOKEN_MODE %q is neither %q nor %q", ErrInvalidTokenMode, c.TokenMode, TokenModeJWT, TokenModeOpaque)
+}
+
+// Headers returns the request headers of the HTTP routes under HEADER_PREFIX, e.g. "x-myapp-"
+// to read x-myapp-access rather than authify-access, DefaultHeaderPrefix when unset.
+// Prefixes with characters not allowed in header names fail with ErrInvalidHeaderPrefix.
+func (c *Config) Headers() (Headers, error) {
+	for _, r := range c.HeaderPrefix {
+		if !isHeaderNameChar(r) {
+			return Headers{}, fmt.Errorf("%w: HEADER_PREFIX %q has the character %q", ErrInvalidHeaderPrefix, c.HeaderPrefix, r)
+		}
+	}
+	return Headers{Prefix: strings.ToLower(c.HeaderPrefix)}, nil
+}
+
+// isHeaderNameChar reports whether r may appear in a header name, a token of RFC 9110
+func isHeaderNameChar(r rune) bool {
+	return r < 0x80 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+}
+
+// RESTGatewayMode returns how REST_GATEWAY serves the JSON gateway of the gRPC service next to
+// the header-based routes: RESTGatewayOff (the default) leaves it out, RESTGatewayAlongside serves
+// both and RESTGatewayOnly drops the header-based routes. Other values fail with ErrInvalidRESTGateway.
+func (c *Config) RESTGatewayMode() (string, error) {
+	switch c.RESTGateway {
+	case "", RESTGatewayOff:
+		return RESTGatewayOff, nil
+	case RESTGatewayAlongside, RESTGatewayOnly:
+		return c.RESTGateway, nil
+	}
+	return RESTGatewayOff, fmt.Errorf("%w: REST_GATEWAY %q is none of %q, %q and %q", ErrInvalidRESTGateway, c.RESTGateway, RESTGatewayOff, RESTGatewayAlongside, RESTGatewayOnly)
+}
+
+// AccessTokenDuration returns the access token lifetime set by TOKEN_EXPIRATION, which takes
+// precedence, or TOKEN_EXPIRATION_TIME_MINUTES, and zero when neither is set.
+// Unparseable or non-positive values fail with ErrInvalidTokenExpiration.
+func (c *Config) AccessTokenDuration() (time.Duration, error) {
+	if c.TokenExpiration != "" {
+		d, err := time.ParseDuration(c.TokenExpiration)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("%w: TOKEN_EXPIRATION %q is not a positive duration", ErrInvalidTokenExpiration, c.TokenExpiration)
+		}
+		return d, nil
+	}
+	if c.TokenExpirationMinutes != "" {
+		minutes, err := strconv.Atoi(c.TokenExpirationMinutes)
+		if err != nil || minutes <= 0 {
+			return 0, fmt.Errorf("%w: TOKEN_EXPIRATION_TIME_MINUTES %q is not a positive number of minutes", ErrInvalidTokenExpiration, c.TokenExpirationMinutes)
+		}
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	return 0, nil
+}
+
+// SlidingExpiration returns the threshold set by SLIDING_EXPIRATION, see
+// token.JWTManager.WithSlidingExpiration, zero when unset. Unparseable or non-positive values
+// fail with ErrInvalidSlidingExpiration.
+func (c *Config) SlidingExpiration() (time.Duration, error) {
+	if c.SlidingExpirationThreshold == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.SlidingExpirationThreshold)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: SLIDING_EXPIRATION %q is not a positive duration", ErrInvalidSlidingExpiration, c.SlidingExpirationThreshold)
+	}
+	return d, nil
+}
+
+// MinimumTokenVersion returns the version set by MINIMUM_TOKEN_VERSION, 0 when unset.
+// Values that are not a whole number between 0 and token.CurrentTokenVersion fail with ErrInvalidTokenVersion.
+func (c *Config) MinimumTokenVersion() (int, error) {
+	if c.MinTokenVersion == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(c.MinTokenVersion)
+	if err != nil || version < 0 || version > token.CurrentTokenVersion {
+		return 0, fmt.Errorf("%w: MINIMUM_TOKEN_VERSION %q is not a version between 0 and %d",
+			ErrInvalidTokenVersion, c.MinTokenVersion, token.CurrentTokenVersion)
+	}
+	return version, nil
+}
+
+// BindingMode returns the binding of refresh tokens set by TOKEN_BINDING, token.NoBinding when
+// unset. Values other than "none", "ip" and "device" fail with ErrInvalidBindingMode.
+func (c *Config) BindingMode() (token.BindingMode, error) {
+	mode, err := token.ParseBindingMode(c.TokenBinding)
+	if err != nil {
+		return token.NoBinding, fmt.Errorf("%w: TOKEN_BINDING: %v", ErrInvalidBindingMode, err)
+	}
+	return mode, nil
+}
+
+// Registration returns the registration policy set by REGISTRATION_POLICY, authify.RegistrationOpen
+// when unset. Values other than "open", "invite" and "closed" fail with ErrInvalidRegistrationPolicy.
+func (c *Config) Registration() (authify.RegistrationPolicy, error) {
+	policy, err := authify.ParseRegistrationPolicy(c.RegistrationPolicy)
+	if err != nil {
+		return authify.RegistrationOpen, fmt.Errorf("%w: REGISTRATION_POLICY: %v", ErrInvalidRegistrationPolicy, err)
+	}
+	return policy, nil
+}
+
+// DisabledFeatureList returns the features turned off by DISABLED_FEATURES, none when unset.
+// Names other than the ones of the authify.Feature constants fail with ErrInvalidFeature.
+func (c *Config) DisabledFeatureList() ([]authify.Feature, error) {
+	var disabled []authify.Feature
+	for _, name := range strings.Split(c.DisabledFeatures, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		feature, err := authify.ParseFeature(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: DISABLED_FEATURES: %v", ErrInvalidFeature, err)
+		}
+		disabled = append(disabled, feature)
+	}
+	return disabled, nil
+}
+
+// Values of SIGNUP_CHALLENGE, see SignupChallenge
+const (
+	SignupChallengeOff     = "off"
+	SignupChallengePoW     = "pow"
+	SignupChallengeCaptcha = "captcha"
+)
+
+// SignupChallenge returns the provider set by SIGNUP_CHALLENGE, see httpapi.WithSignupChallenge,
+// nil when unset or "off", and the users a client address can create per hour before it is
+// challenged, SIGNUP_CHALLENGE_THRESHOLD or DefaultSignupChallengeThreshold. "pow" asks for
+// proofs of work of SIGNUP_POW_DIFFICULTY bits, authify.DefaultProofOfWorkDifficulty by default,
+// and "captcha" verifies the tokens of CAPTCHA widgets with CAPTCHA_VERIFY_URL and
+// CAPTCHA_SECRET. Invalid values fail with ErrInvalidSignupChallenge.
+func (c *Config) SignupChallenge() (authify.ChallengeProvider, int, error) {
+	threshold := DefaultSignupChallengeThreshold
+	if c.SignupChallengeThreshold != "" {
+		var err error
+		threshold, err = strconv.Atoi(c.SignupChallengeThreshold)
+		if err != nil || threshold < 0 {
+			return nil, 0, fmt.Errorf("%w: SIGNUP_CHALLENGE_THRESHOLD %q is not a number of users per hour", ErrInvalidSignupChallenge, c.SignupChallengeThreshold)
+		}
+	}
+
+	switch c.SignupChallengeMode {
+	case "", SignupChallengeOff:
+		return nil, threshold, nil
+	case SignupChallengePoW:
+		difficulty := authify.DefaultProofOfWorkDifficulty
+		if c.SignupPoWDifficulty != "" {
+			var err error
+			if difficulty, err = strconv.Atoi(c.SignupPoWDifficulty); err != nil {
+				return nil, 0, fmt.Errorf("%w: SIGNUP_POW_DIFFICULTY %q is not a number of bits", ErrInvalidSignupChallenge, c.SignupPoWDifficulty)
+			}
+		}
+		pow, err := authify.NewProofOfWork(difficulty)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: SIGNUP_POW_DIFFICULTY: %v", ErrInvalidSignupChallenge, err)
+		}
+		return pow, threshold, nil
+	case SignupChallengeCaptcha:
+		if u, err := url.Parse(c.CaptchaVerifyURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, 0, fmt.Errorf("%w: CAPTCHA_VERIFY_URL %q is not an http(s) URL", ErrInvalidSignupChallenge, c.CaptchaVerifyURL)
+		}
+		return authify.NewCaptchaVerifier(c.CaptchaVerifyURL, c.CaptchaSecret.Reveal()), threshold, nil
+	}
+	return nil, 0, fmt.Errorf("%w: SIGNUP_CHALLENGE %q is none of %q, %q and %q", ErrInvalidSignupChallenge, c.SignupChallengeMode, SignupChallengeOff, SignupChallengePoW, SignupChallengeCaptcha)
+}
+
+// configKey ties an environment key (without prefix) to the Config field it fills
+// and the error reported when no source provides a value, a nil error marks the key optional.
+type configKey struct {
+	name    string
+	field   func(*Config) *string
+	missing error
+}
+
+var configKeys = []configKey{
+	// DATABASE_URL is required unless the PG* keys below can replace it, see ReadEnvVarsFromPath
+	{"DATABASE_URL", func(c *Config) *string { return (*string)(&c.DatabaseURL) }, nil},
+	{"JWT_SECRET", func(c *Config) *string { return (*string)(&c.JWTAccessSecret) }, ErrMissingJWTSecret},
+	{"JWT_REFRESH_SECRET", func(c *Config) *string { return (*string)(&c.JWTRefreshSecret) }, ErrMissingJWTRefreshSecret},
+	{"SERVER_PORT", func(c *Config) *string { return &c.ServerPort }, ErrMissingServerPort},
+	{"STORE_CONFIG_FILE_PATH", func(c *Config) *string { return &c.StoreConfigFilePath }, ErrMissingStoreConfig},
+	{"TOKEN_CONFIG_FILE_PATH", func(c *Config) *string { return &c.TokenConfigFilePath }, ErrMissingTokenConfig},
+	{"FEDERATION_CONFIG_FILE_PATH", func(c *Config) *string { return &c.FederationConfigFilePath }, nil},
+	{"PGHOST", func(c *Config) *string { return &c.PGHost }, nil},
+	{"PGPORT", func(c *Config) *string { return &c.PGPort }, nil},
+	{"PGUSER", func(c *Config) *string { return &c.PGUser }, nil},
+	{"PGPASSWORD", func(c *Config) *string { return (*string)(&c.PGPassword) }, nil},
+	{"PGDATABASE", func(c *Config) *string { return &c.PGDatabase }, nil},
+	{"PGSSLMODE", func(c *Config) *string { return &c.PGSSLMode }, nil},
+	{"OAUTH_CLIENT_ID", func(c *Config) *string { return &c.OAuthClientID }, nil},
+	{"OAUTH_CLIENT_SECRET", func(c *Config) *string { return (*string)(&c.OAuthClientSecret) }, nil},
+	{"JWT_SECRET_PREVIOUS", func(c *Config) *string { return (*string)(&c.JWTAccessSecretPrevious) }, nil},
+	{"JWT_REFRESH_SECRET_PREVIOUS", func(c *Config) *string { return (*string)(&c.JWTRefreshSecretPrevious) }, nil},
+	{"CLAIMS_ENCRYPTION_KEY", func(c *Config) *string { return (*string)(&c.ClaimsEncryptionKey) }, nil},
+	{"CLAIMS_ENCRYPTION_KEY_PREVIOUS", func(c *Config) *string { return (*string)(&c.ClaimsEncryptionKeyPrevious) }, nil},
+	{"STRICT_VERIFICATION", func(c *Config) *string { return &c.StrictVerification }, nil},
+	{"TRUST_FORWARDED_FOR", func(c *Config) *string { return &c.TrustForwardedFor }, nil},
+	{"GRPC_REFLECTION", func(c *Config) *string { return &c.GRPCReflection }, nil},
+	{"PRECISE_LOGIN_ERRORS", func(c *Config) *string { return &c.PreciseLoginErrors }, nil},
+	{"CHALLENGE_LOGIN", func(c *Config) *string { return &c.ChallengeLogin }, nil},
+	{"INVALIDATION_BUS", func(c *Config) *string { return &c.InvalidationBus }, nil},
+	{"REFRESH_ROLE", func(c *Config) *string { return &c.RefreshRole }, nil},
+	{"SECRET_ROTATION", func(c *Config) *string { return &c.SecretRotation }, nil},
+	{"TOKEN_EXPIRATION", func(c *Config) *string { return &c.TokenExpiration }, nil},
+	{"TOKEN_EXPIRATION_TIME_MINUTES", func(c *Config) *string { return &c.TokenExpirationMinutes }, nil},
+	{"USER_EXISTS_RATE_LIMIT", func(c *Config) *string { return &c.UserExistsLimit }, nil},
+	{"USER_EXISTS_REQUIRE_TOKEN", func(c *Config) *string { return &c.UserExistsToken }, nil},
+	{"IDEMPOTENCY_TTL_SECONDS", func(c *Config) *string { return &c.IdempotencyTTLSeconds }, nil},
+	{"TOKEN_MODE", func(c *Config) *string { return &c.TokenMode }, nil},
+	{"REGISTRATION_POLICY", func(c *Config) *string { return &c.RegistrationPolicy }, nil},
+	{"DISABLED_FEATURES", func(c *Config) *string { return &c.DisabledFeatures }, nil},
+	{"REST_GATEWAY", func(c *Config) *string { return &c.RESTGateway }, nil},
+	{"SIGNUP_CHALLENGE", func(c *Config) *string { return &c.SignupChallengeMode }, nil},
+	{"SIGNUP_CHALLENGE_THRESHOLD", func(c *Config) *string { return &c.SignupChallengeThreshold }, nil},
+	{"SIGNUP_POW_DIFFICULTY", func(c *Config) *string { return &c.SignupPoWDifficulty }, nil},
+	{"CAPTCHA_VERIFY_URL", func(c *Config) *string { return &c.CaptchaVerifyURL }, nil},
+	{"CAPTCHA_SECRET", func(c *Config) *string { return (*string)(&c.CaptchaSecret) }, nil},
+	{"HEADER_PREFIX", func(c *Config) *string { return &c.HeaderPrefix }, nil},
+	{"PID_FILE", func(c *Config) *string { return &c.PIDFile }, nil},
+	{"SLIDING_EXPIRATION", func(c *Config) *string { return &c.SlidingExpirationThreshold }, nil},
+	{"MINIMUM_TOKEN_VERSION", func(c *Config) *string { return &c.MinTokenVersion }, nil},
+	{"TOKEN_BINDING", func(c *Config) *string { return &c.TokenBinding }, nil},
+	{"READ_HEADER_TIMEOUT_SECONDS", func(c *Config) *string { return &c.ReadHeaderTimeoutSeconds }, nil},
+	{"READ_TIMEOUT_SECONDS", func(c *Config) *string { return &c.ReadTimeoutSeconds }, nil},
+	{"WRITE_TIMEOUT_SECONDS", func(c *Config) *string { return &c.WriteTimeoutSeconds }, nil},
+	{"IDLE_TIMEOUT_SECONDS", func(c *Config) *string { return &c.IdleTimeoutSeconds }, nil},
+	{"REQUEST_TIMEOUT_SECONDS", func(c *Config) *string { return &c.RequestTimeoutSeconds }, nil},
+	{"SHUTDOWN_TIMEOUT_SECONDS", func(c *Config) *string { return &c.ShutdownTimeoutSeconds }, nil},
+	{"DATABASE_CONNECT_TIMEOUT_SECONDS", func(c *Config) *string { return &c.DatabaseConnectTimeoutSeconds }, nil},
+	{"DATABASE_RETRY_INTERVAL_SECONDS", func(c *Config) *string { return &c.DatabaseRetryIntervalSeconds }, nil},
+	{"DATABASE_STARTUP_RETRIES", func(c *Config) *string { return &c.DatabaseStartupRetries }, nil},
+}
+
+// ReadEnvVars loads configuration values from the .env file named by AUTHIFY_ENV_FILE,
+// or .env in the working directory, see ReadEnvVarsFromPath.
+func ReadEnvVars() (*Config, error) {
+	path := os.Getenv(EnvFileEnv)
+	if path == "" {
+		path = defaultEnvFile
+	}
+	return ReadEnvVarsFromPath(path)
+}
+
+// ReadEnvVarsFromPath loads configuration values from the given .env files, the system
+// environment and an optional YAML file named by AUTHIFY_CONFIG. Variables of later
+// files override the ones of earlier files, and are only used when the environment
+// does not set them. Missing files are skipped.
+// For every key the first source that provides a value wins, in this order:
+//   - AUTHIFY_<KEY>
+//   - AUTHIFY_<KEY>_FILE (contents of the file, trailing newlines trimmed)
+//   - <KEY> (legacy, unprefixed name)
+//   - <KEY>_FILE
+//   - the YAML config file
+//
+// All missing or unreadable keys are reported together in a single error, which
+// wraps ErrEnvNotFound and lists the files tried when none of them was found.
+func ReadEnvVarsFromPath(paths ...string) (*Config, error) {
+	cfg := &Config{}
+	var errs []error
+
+	// Missing files are fine, values may come from the environment or config file.
+	loaded, err := loadEnvFiles(paths)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if path := os.Getenv(ConfigFileEnv); path != "" {
+		if err := loadConfigFile(path, cfg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	missing := false
+	for _, key := range configKeys {
+		val, found, err := lookupEnv(key.name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if found {
+			*key.field(cfg) = val
+		}
+		if *key.field(cfg) == "" && key.missing != nil {
+			errs = append(errs, key.missing)
+			missing = true
+		}
+	}
+
+	if cfg.DatabaseURL == "" {
+		dsn, err := cfg.DatabaseURLFromParts()
+		if err != nil {
+			errs = append(errs, err)
+			missing = missing || errors.Is(err, ErrMissingDatabaseURL)
+		}
+		cfg.DatabaseURL = dsn
+	}
+	if _, err := cfg.AccessTokenDuration(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.OpaqueTokensEnabled(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.RESTGatewayMode(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.Headers(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.MinimumTokenVersion(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.SlidingExpiration(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.BindingMode(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.Registration(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.DisabledFeatureList(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.UserExistsRateLimit(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, err := cfg.SignupChallenge(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, err := cfg.ClaimsEncryptionKeys(); err != nil {
+		errs = append(errs, err)
+	}
+	if missing && loaded == 0 && len(paths) > 0 {
+		errs = append(errs, fmt.Errorf("%w, tried %s", ErrEnvNotFound, strings.Join(paths, ", ")))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return cfg, nil
+}
+
+// loadEnvFiles sets the variables of the given .env files that the environment leaves
+// empty, later files overriding earlier ones, and returns how many files were found.
+func loadEnvFiles(paths []string) (loaded int, err error) {
+	vars := make(map[string]string)
+	for _, path := range paths {
+		fileVars, err := godotenv.Read(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("%s: %w", path, err)
+		}
+		maps.Copy(vars, fileVars)
+		loaded++
+	}
+
+	for name, val := range vars {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, val)
+		}
+	}
+	return loaded, nil
+}
+
+// lookupEnv resolves a key against the prefixed and legacy environment variables,
+// including their _FILE variants. found is false when none of them are set.
+func lookupEnv(key string) (val string, found bool, err error) {
+	for _, name := range []string{EnvPrefix + key, key} {
+		if val := os.Getenv(name); val != "" {
+			return val, true, nil
+		}
+		if path := os.Getenv(name + fileSuffix); path != "" {
+			val, err := readSecretFile(path)
+			if err != nil {
+				return "", false, fmt.Errorf("%s%s: %w", name, fileSuffix, err)
+			}
+			return val, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// readSecretFile returns the contents of a mounted secret, without the trailing
+// newline most editors and secret managers append.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", ConfigFileEnv, err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("%s: %w", ConfigFileEnv, err)
+	}
+	return nil
+}
@@ -2,27 +2,45 @@ package lib
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/HassanAli101/authify/stores"
 )
 
 var (
-	// User-related errors
-	ErrUserExists      = errors.New("user already exists")
-	ErrUserNotFound    = errors.New("user not found")
-	ErrInvalidPassword = errors.New("invalid password for user")
+	// User-related errors, aliases of the store errors so errors.Is matches either
+	ErrUserExists      = stores.ErrUserExists
+	ErrUserNotFound    = stores.ErrUserNotFound
+	ErrInvalidPassword = stores.ErrInvalidPassword
 
 	// Config / request errors
 	ErrMissingDatabaseURL        = errors.New("DATABASE_URL is not set")
+	ErrInvalidDatabaseURL        = errors.New("invalid database connection parameters")
 	ErrMissingJWTSecret          = errors.New("JWT_SECRET is not set")
 	ErrMissingJWTRefreshSecret   = errors.New("JWT_REFRESH_SECRET is not set")
 	ErrMissingTokenExpiration    = errors.New("TOKEN_EXPIRATION_TIME_MINUTES is not set")
-	ErrInvalidTokenExpiration    = errors.New("invalid TOKEN_EXPIRATION_TIME_MINUTES")
+	ErrInvalidTokenExpiration    = errors.New("invalid token expiration")
+	ErrInvalidTokenVersion       = errors.New("invalid minimum token version")
+	ErrInvalidSlidingExpiration  = errors.New("invalid sliding expiration")
+	ErrInvalidTokenMode          = errors.New("invalid token mode")
+	ErrInvalidBindingMode        = errors.New("invalid token binding mode")
+	ErrInvalidRegistrationPolicy = errors.New("invalid registration policy")
+	ErrInvalidFeature            = errors.New("invalid feature")
+	ErrInvalidRESTGateway        = errors.New("invalid REST gateway mode")
+	ErrInvalidHeaderPrefix       = errors.New("invalid header prefix")
+	ErrInvalidRateLimit          = errors.New("invalid rate limit")
+	ErrInvalidSignupChallenge    = errors.New("invalid signup challenge")
+	ErrInvalidEncryptionKey      = errors.New("invalid claims encryption key")
 	ErrMissingServerPort         = errors.New("SERVER_PORT is not set")
 	ErrMissingStoreConfig        = errors.New("STORE_CONFIG_FILE_PATH is not set")
 	ErrMissingTokenConfig        = errors.New("TOKEN_CONFIG_FILE_PATH is not set")
 	ErrMissingTableName          = errors.New("TABLE_NAME is not set")
-	ErrMissingUsernameHeader     = errors.New("username is missing in the request, please have a look at docs")
-	ErrMissingPasswordHeader     = errors.New("password is missing in the request, please have a look at docs")
-	ErrMissingAccessTokenHeader  = errors.New("access token is missing in the request, please have a look at docs")
-	ErrMissingRefreshTokenHeader = errors.New("refresh token is missing in the request, please have a look at docs")
-	ErrEnvNotFound               = errors.New("no .env file found and DATABASE_URL is missing")
+	ErrMissingUsernameHeader     = fmt.Errorf("%w: username is missing in the request, please have a look at docs", stores.ErrMissingField)
+	ErrMissingPasswordHeader     = fmt.Errorf("%w: password is missing in the request, please have a look at docs", stores.ErrMissingField)
+	ErrMissingAccessTokenHeader  = fmt.Errorf("%w: access token is missing in the request, please have a look at docs", stores.ErrMissingField)
+	ErrMissingRefreshTokenHeader = fmt.Errorf("%w: refresh token is missing in the request, please have a look at docs", stores.ErrMissingField)
+	ErrMissingIDTokenHeader      = fmt.Errorf("%w: ID token is missing in the request, please have a look at docs", stores.ErrMissingField)
+	ErrMissingProofHeader        = fmt.Errorf("%w: nonce and proof are required in challenge login mode, please have a look at docs", stores.ErrMissingField)
+	ErrInvalidTTLHeader          = fmt.Errorf("%w: ttl must be a positive number of seconds", stores.ErrMissingField)
+	ErrEnvNotFound               = errors.New("no env file found and required variables are missing")
 )
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce groups the events of a single save, editors often write a file in several steps
+const reloadDebounce = 100 * time.Millisecond
+
+// Reloader applies configuration changes to a running server without a restart. On Reload it
+// re-reads the environment, the store config and the token config, validates them, and swaps
+// what can change at runtime into the token manager: token lifetimes and role permissions.
+// An invalid config is rejected as a whole, the previous one staying active.
+//
+// Everything else is left as it was, with a warning: secrets are never reloaded, and column
+// changes are only reported, they take a restart along with auto_migrate or migrate-diff.
+type Reloader struct {
+	tokens token.Reloadable
+
+	mu       sync.Mutex
+	cfg      *Config
+	storeCfg stores.StoreConfig
+	tokenCfg token.TokenConfig
+}
+
+// NewReloader returns a reloader for a server started with cfg and the store and token configs
+// loaded from its files, the access token duration override of cfg applied.
+func NewReloader(cfg *Config, storeCfg stores.StoreConfig, tokenCfg token.TokenConfig, tokens token.Reloadable) *Reloader {
+	return &Reloader{tokens: tokens, cfg: cfg, storeCfg: storeCfg, tokenCfg: tokenCfg}
+}
+
+// Reload reads the configuration again and applies it, see Reloader. It returns an error,
+// changing nothing, when the new configuration cannot be read or is invalid.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := ReadEnvVars()
+	if err != nil {
+		return err
+	}
+	storeCfg, err := LoadStoreConfig(cfg.StoreConfigFilePath)
+	if err != nil {
+		return fmt.Errorf("loading store config: %w", err)
+	}
+	tokenCfg, err := LoadTokenConfig(cfg.TokenConfigFilePath)
+	if err != nil {
+		return fmt.Errorf("loading token config: %w", err)
+	}
+	if expiration, _ := cfg.AccessTokenDuration(); expiration > 0 {
+		tokenCfg.AccessToken.Duration = expiration
+	}
+
+	// the durations are validated by SetDurations, before anything is swapped
+	if err := r.tokens.SetDurations(tokenCfg.AccessToken.Duration, tokenCfg.RefreshToken.Duration); err != nil {
+		return fmt.Errorf("invalid token config %s: %w", cfg.TokenConfigFilePath, err)
+	}
+	r.tokens.SetRolePermissions(storeCfg.RolePermissions)
+
+	r.warnUnreloadable(cfg, *storeCfg, *tokenCfg)
+	log.Printf("Reloaded config: access tokens last %v, refresh tokens %v, %d roles with permissions\n",
+		tokenCfg.AccessToken.Duration, tokenCfg.RefreshToken.Duration, len(storeCfg.RolePermissions))
+
+	r.cfg, r.storeCfg, r.tokenCfg = cfg, *storeCfg, *tokenCfg
+	return nil
+}
+
+// warnUnreloadable logs the changes Reload does not apply
+func (r *Reloader) warnUnreloadable(cfg *Config, storeCfg stores.StoreConfig, tokenCfg token.TokenConfig) {
+	if cfg.DatabaseURL != r.cfg.DatabaseURL ||
+		cfg.JWTAccessSecret != r.cfg.JWTAccessSecret ||
+		cfg.JWTRefreshSecret != r.cfg.JWTRefreshSecret ||
+		cfg.JWTAccessSecretPrevious != r.cfg.JWTAccessSecretPrevious ||
+		cfg.JWTRefreshSecretPrevious != r.cfg.JWTRefreshSecretPrevious ||
+		cfg.OAuthClientSecret != r.cfg.OAuthClientSecret {
+		log.Printf("Warning: secrets or the database URL changed, they are not reloaded, restart to apply them\n")
+	}
+
+	if !reflect.DeepEqual(storeCfg.Columns, r.storeCfg.Columns) {
+		added, removed := diffKeys(r.storeCfg.Columns, storeCfg.Columns)
+		log.Printf("Warning: store columns changed (added %v, removed %v), the schema is not migrated at runtime, "+
+			"restart with auto_migrate or apply the statements of migrate-diff\n", added, removed)
+	}
+	storeCfg.Columns, storeCfg.RolePermissions = r.storeCfg.Columns, r.storeCfg.RolePermissions
+	if !reflect.DeepEqual(storeCfg, r.storeCfg) {
+		log.Printf("Warning: store config settings other than role_permissions changed, restart to apply them\n")
+	}
+
+	tokenCfg.AccessToken.Duration, tokenCfg.RefreshToken.Duration = r.tokenCfg.AccessToken.Duration, r.tokenCfg.RefreshToken.Duration
+	if !reflect.DeepEqual(tokenCfg, r.tokenCfg) {
+		log.Printf("Warning: token config settings other than durations changed, restart to apply them\n")
+	}
+}
+
+// diffKeys returns the keys only found in after, then the ones only found in before, sorted
+func diffKeys[V any](before, after map[string]V) (added, removed []string) {
+	for _, name := range slices.Sorted(maps.Keys(after)) {
+		if _, ok := before[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(before)) {
+		if _, ok := after[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
+
+// Watch calls Reload on SIGHUP and whenever the store or token config file changes, until ctx
+// is done. Failed reloads are logged, the previous config staying active. Watch returns an error
+// when the files cannot be watched.
+func (r *Reloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// directories are watched rather than files, editors and config mounts replace files by renaming
+	r.mu.Lock()
+	files := map[string]bool{}
+	for _, path := range []string{r.cfg.StoreConfigFilePath, r.cfg.TokenConfigFilePath} {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		files[abs] = true
+	}
+	r.mu.Unlock()
+	for path := range files {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("watching %s: %w", path, err)
+		}
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	reload := func() {
+		if err := r.Reload(); err != nil {
+			log.Printf("Config reload failed, keeping the previous config: %v\n", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hangup:
+			reload()
+		case event := <-watcher.Events:
+			if files[event.Name] && !event.Has(fsnotify.Chmod) {
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			reload()
+		case err := <-watcher.Errors:
+			log.Printf("Config watcher error: %v\n", err)
+		}
+	}
+}
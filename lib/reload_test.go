@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+const reloadStoreConfig = `name: users
+bcrypt_cost: 4
+columns:
+  username: {type: text, required: true, primary_key: true}
+  password: {type: text, required: true, hidden: true, is_password: true}
+  role: {type: text, default: user}
+role_permissions:
+  user: [%s]
+`
+
+const reloadTokenConfig = `access_token:
+  duration: %s
+  signing_method: HS256
+  claims:
+    username: {source: db, column: username, is_identifier: true}
+    role: {source: db, column: role}
+refresh_token:
+  duration: 24h
+`
+
+// setupReload writes the config files in a temp directory, points the environment at them
+// and returns a JWT manager built from them, along with its reloader
+func setupReload(t *testing.T) (*token.JWTManager, *Reloader, string) {
+	t.Helper()
+	clearConfigEnv(t)
+	setRequiredEnv(t)
+	t.Setenv(EnvPrefix+"TOKEN_EXPIRATION", "")
+	t.Setenv(EnvPrefix+"TOKEN_EXPIRATION_TIME_MINUTES", "")
+
+	dir := t.TempDir()
+	writeConfig(t, filepath.Join(dir, "store.yml"), fmt.Sprintf(reloadStoreConfig, "read"))
+	writeConfig(t, filepath.Join(dir, "token.yml"), fmt.Sprintf(reloadTokenConfig, "10m"))
+	t.Setenv(EnvPrefix+"STORE_CONFIG_FILE_PATH", filepath.Join(dir, "store.yml"))
+	t.Setenv(EnvPrefix+"TOKEN_CONFIG_FILE_PATH", filepath.Join(dir, "token.yml"))
+
+	cfg, err := ReadEnvVars()
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	storeCfg, err := LoadStoreConfig(cfg.StoreConfigFilePath)
+	if err != nil {
+		t.Fatalf("failed to load store config: %v", err)
+	}
+	tokenCfg, err := LoadTokenConfig(cfg.TokenConfigFilePath)
+	if err != nil {
+		t.Fatalf("failed to load token config: %v", err)
+	}
+
+	store := stores.NewInMemoryUserStore(*storeCfg)
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	m, err := token.NewJWTManager().
+		WithConfig(tokenCfg).
+		WithAccessSecret("access-secret").
+		WithRefreshSecret("refresh-secret").
+		WithStore(store).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build jwt manager: %v", err)
+	}
+	return m, NewReloader(cfg, *storeCfg, *tokenCfg, m), dir
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+// issuedToken logs alice in and returns the lifetime and scope of her access token
+func issuedToken(t *testing.T, m *token.JWTManager) (time.Duration, string) {
+	t.Helper()
+	accessToken, err := m.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	claims, err := m.VerifyAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("failed to verify token: %v", err)
+	}
+	issued, _ := claims.GetIssuedAt()
+	expiry, _ := claims.GetExpirationTime()
+	scope, _ := claims[token.ClaimScope].(string)
+	return expiry.Sub(issued.Time), scope
+}
+
+func TestReloaderWatchesConfigFiles(t *testing.T) {
+	m, reloader, dir := setupReload(t)
+	if lifetime, scope := issuedToken(t, m); lifetime != 10*time.Minute || scope != "read" {
+		t.Fatalf("expected a 10m token with the read scope, got %v %q", lifetime, scope)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- reloader.Watch(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("watch failed: %v", err)
+		}
+	})
+
+	// the files are written again until the watcher, started concurrently, picks them up
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		writeConfig(t, filepath.Join(dir, "store.yml"), fmt.Sprintf(reloadStoreConfig, "read, write"))
+		writeConfig(t, filepath.Join(dir, "token.yml"), fmt.Sprintf(reloadTokenConfig, "2h"))
+		time.Sleep(200 * time.Millisecond)
+
+		lifetime, scope := issuedToken(t, m)
+		if lifetime == 2*time.Hour && scope == "read write" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the reloaded 2h lifetime and scopes, got %v %q", lifetime, scope)
+		}
+	}
+}
+
+func TestReloaderKeepsConfigOnError(t *testing.T) {
+	m, reloader, dir := setupReload(t)
+
+	writeConfig(t, filepath.Join(dir, "token.yml"), fmt.Sprintf(reloadTokenConfig, "-5m"))
+	if err := reloader.Reload(); !errors.Is(err, token.ErrInvalidDuration) {
+		t.Errorf("expected ErrInvalidDuration, got %v", err)
+	}
+	writeConfig(t, filepath.Join(dir, "store.yml"), "columns: [not, a, map]")
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("expected an error for a malformed store config")
+	}
+
+	if lifetime, scope := issuedToken(t, m); lifetime != 10*time.Minute || scope != "read" {
+		t.Errorf("expected the previous config to stay active, got %v %q", lifetime, scope)
+	}
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+)
+
+// Banner describes a server at startup, logged once so operators can tell what a deployment runs.
+type Banner struct {
+	Service    string // name of the binary, e.g. "authify-server"
+	Store      string // kind of user store, e.g. "postgres"
+	Table      string
+	Tokens     string // TokenModeJWT or TokenModeOpaque
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	TLS        bool
+}
+
+// String formats the banner as a single line of key=value pairs, along with the Version of the binary.
+func (b Banner) String() string {
+	tls := "off"
+	if b.TLS {
+		tls = "on"
+	}
+	return fmt.Sprintf("%s starting version=%s store=%s table=%s tokens=%s access_ttl=%s refresh_ttl=%s tls=%s",
+		b.Service, Version(), b.Store, b.Table, b.Tokens, b.AccessTTL, b.RefreshTTL, tls)
+}
+
+// Version returns the module version the running binary was built from, "(devel)" for builds
+// of a source checkout.
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "(devel)"
+	}
+	return info.Main.Version
+}
+
+// WritePIDFile writes the process ID to the file set by PID_FILE, for service managers that track
+// the server by it, and returns a function removing the file at shutdown. Nothing is written when
+// PID_FILE is unset.
+func (c *Config) WritePIDFile() (remove func(), err error) {
+	if c.PIDFile == "" {
+		return func() {}, nil
+	}
+	if err := os.WriteFile(c.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return nil, fmt.Errorf("writing PID_FILE: %w", err)
+	}
+	return func() { os.Remove(c.PIDFile) }, nil
+}
+
+// ValidationCheck is a step of Validate, failed when Err is set
+type ValidationCheck struct {
+	Name     string
+	Err      error
+	Warnings []string
+}
+
+// ValidationReport is the outcome of Validate, its checks in the order they ran
+type ValidationReport struct {
+	Checks []ValidationCheck
+}
+
+// OK reports whether every check passed, warnings aside
+func (r ValidationReport) OK() bool {
+	for _, check := range r.Checks {
+		if check.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// String lists the checks, one per line, followed by their warnings
+func (r ValidationReport) String() string {
+	var b strings.Builder
+	for _, check := range r.Checks {
+		if check.Err != nil {
+			fmt.Fprintf(&b, "FAIL %s: %v\n", check.Name, check.Err)
+		} else {
+			fmt.Fprintf(&b, "ok   %s\n", check.Name)
+		}
+		for _, warning := range check.Warnings {
+			fmt.Fprintf(&b, "WARN %s: %s\n", check.Name, warning)
+		}
+	}
+	return b.String()
+}
+
+// Validate checks a deployment without serving it: the config keys read by ReadEnvVars, the
+// store and token config files, the database connection and the schema of the users table, see
+// stores.SchemaVerifier. Checks stop at the first one failing, as the next ones depend on it.
+// The table is neither created nor migrated, whatever auto_create and auto_migrate are set to.
+func Validate(ctx context.Context) ValidationReport {
+	var report ValidationReport
+	check := func(name string, err error, warnings ...string) bool {
+		report.Checks = append(report.Checks, ValidationCheck{Name: name, Err: err, Warnings: warnings})
+		return err == nil
+	}
+
+	cfg, err := ReadEnvVars()
+	if !check("config keys", err) {
+		return report
+	}
+	storeCfg, err := LoadStoreConfig(cfg.StoreConfigFilePath)
+	if !check("store config "+cfg.StoreConfigFilePath, err) {
+		return report
+	}
+	_, err = LoadTokenConfig(cfg.TokenConfigFilePath)
+	if !check("token config "+cfg.TokenConfigFilePath, err) {
+		return report
+	}
+
+	readOnly := *storeCfg
+	readOnly.AutoCreate, readOnly.AutoMigrate = false, false
+	db, err := stores.NewAuthifyDB(cfg.DatabaseURL.Reveal(), readOnly)
+	if !check("database connection", err) {
+		return report
+	}
+	defer db.Close()
+
+	schema, err := db.VerifySchema(ctx)
+	if err == nil && !schema.OK() {
+		err = errors.New(strings.Join(schema.Errors, "; "))
+	}
+	check("schema of table "+storeCfg.Name, err, schema.Warnings...)
+	return report
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	banner := Banner{
+		Service:    "authify-server",
+		Store:      "postgres",
+		Table:      "users",
+		Tokens:     TokenModeJWT,
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: 72 * time.Hour,
+	}
+	want := "authify-server starting version=" + Version() +
+		" store=postgres table=users tokens=jwt access_ttl=15m0s refresh_ttl=72h0m0s tls=off"
+	if got := banner.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	banner.TLS = true
+	if got := banner.String(); !strings.HasSuffix(got, " tls=on") {
+		t.Errorf("expected tls=on, got %q", got)
+	}
+}
+
+func TestWritePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authify.pid")
+	remove, err := (&Config{PIDFile: path}).WritePIDFile()
+	if err != nil {
+		t.Fatalf("failed to write PID file: %v", err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(contents)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("expected the process ID, got %q %v", contents, err)
+	}
+	remove()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the PID file to be removed, got %v", err)
+	}
+
+	remove, err = (&Config{}).WritePIDFile()
+	if err != nil {
+		t.Fatalf("expected nothing to be written without PID_FILE, got %v", err)
+	}
+	remove()
+}
+
+func TestValidationReport(t *testing.T) {
+	report := ValidationReport{Checks: []ValidationCheck{
+		{Name: "config keys"},
+		{Name: "schema of table users", Warnings: []string{`column "age" is text, the config expects integer`}},
+	}}
+	if !report.OK() {
+		t.Errorf("expected warnings alone to pass")
+	}
+	want := "ok   config keys\nok   schema of table users\nWARN schema of table users: column \"age\" is text, the config expects integer\n"
+	if got := report.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	report.Checks = append(report.Checks, ValidationCheck{Name: "database connection", Err: errors.New("connection refused")})
+	if report.OK() {
+		t.Errorf("expected a failed check to fail the report")
+	}
+	if got := report.String(); !strings.HasSuffix(got, "FAIL database connection: connection refused\n") {
+		t.Errorf("expected the failure to be reported, got %q", got)
+	}
+}
@@ -6,74 +6,61 @@ import (
 	"os"
 	"strings"
 
+	"github.com/HassanAli101/authify/federation"
+	"github.com/HassanAli101/authify/secrets"
 	"github.com/HassanAli101/authify/stores"
 	"github.com/HassanAli101/authify/token"
-	"github.com/joho/godotenv"
 	"gopkg.in/yaml.v2"
 )
 
-type Config struct {
-	DatabaseURL         string
-	JWTAccessSecret     string
-	JWTRefreshSecret    string
-	ServerPort          string
-	StoreConfigFilePath string
-	TokenConfigFilePath string
-}
-
-// ReadEnvVars loads configuration values from a .env file or system environment variables.
-func ReadEnvVars() (*Config, error) {
-	if err := godotenv.Load(); err != nil {
-		if os.Getenv("DATABASE_URL") == "" {
-			return nil, ErrEnvNotFound
-		}
-	}
-
-	cfg := &Config{}
-
-	cfg.DatabaseURL = os.Getenv("DATABASE_URL")
-	if cfg.DatabaseURL == "" {
-		return nil, ErrMissingDatabaseURL
-	}
-
-	cfg.JWTAccessSecret = os.Getenv("JWT_SECRET")
-	if cfg.JWTAccessSecret == "" {
-		return nil, ErrMissingJWTSecret
-	}
-
-	cfg.JWTRefreshSecret = os.Getenv("JWT_REFRESH_SECRET")
-	if cfg.JWTRefreshSecret == "" {
-		return nil, ErrMissingJWTRefreshSecret
-	}
+// MaxHeaderValueLength bounds the authify-* user headers read by ParseUserHeaders
+const MaxHeaderValueLength = 1 << 10
 
-	cfg.ServerPort = os.Getenv("SERVER_PORT")
-	if cfg.ServerPort == "" {
-		return nil, ErrMissingServerPort
-	}
+// DefaultHeaderPrefix starts the names of the request headers authify reads, e.g. authify-access
+const DefaultHeaderPrefix = "authify-"
 
-	cfg.StoreConfigFilePath = os.Getenv("STORE_CONFIG_FILE_PATH")
-	if cfg.StoreConfigFilePath == "" {
-		return nil, ErrMissingStoreConfig
-	}
+// Headers names and parses the request headers of authify under Prefix, for teams with header
+// conventions of their own: Headers{Prefix: "x-myapp-"} reads the access token from
+// x-myapp-access rather than authify-access. The zero value uses DefaultHeaderPrefix, as do
+// ParseUserHeaders, ParseAccessToken, ParseRefreshToken and ParseIDToken.
+type Headers struct {
+	Prefix string
+}
 
-	cfg.TokenConfigFilePath = os.Getenv("TOKEN_CONFIG_FILE_PATH")
-	if cfg.TokenConfigFilePath == "" {
-		return nil, ErrMissingTokenConfig
+// Name returns the header carrying name, e.g. "authify-access" for "access"
+func (h Headers) Name(name string) string {
+	prefix := h.Prefix
+	if prefix == "" {
+		prefix = DefaultHeaderPrefix
 	}
+	return prefix + strings.ToLower(name)
+}
 
-	return cfg, nil
+// Get returns the value of the header carrying name in r, see Name
+func (h Headers) Get(r *http.Request, name string) string {
+	return r.Header.Get(h.Name(name))
 }
 
-// ParseUsernamePassword extracts username and password from HTTP headers.
+// ParseUserHeaders extracts the user columns of storeCfg from HTTP headers.
+// Values longer than MaxHeaderValueLength are rejected with a *stores.FieldError wrapping
+// stores.ErrFieldTooLong, the other checks are left to stores.StoreConfig.ValidateInput.
 func ParseUserHeaders(r *http.Request, storeCfg stores.StoreConfig) (map[string]any, error) {
+	return Headers{}.ParseUserHeaders(r, storeCfg)
+}
+
+// ParseUserHeaders reads a header for each column of storeCfg, see the package function
+func (h Headers) ParseUserHeaders(r *http.Request, storeCfg stores.StoreConfig) (map[string]any, error) {
 	userData := make(map[string]any)
 
 	for name, cfg := range storeCfg.Columns {
-		headerName := fmt.Sprintf("authify-%s", strings.ToLower(name))
+		headerName := h.Name(name)
 		val := r.Header.Get(headerName)
 
 		if cfg.Required && val == "" {
-			return nil, fmt.Errorf("missing required header: %s", headerName)
+			return nil, fmt.Errorf("%w: header %s", stores.ErrMissingField, headerName)
+		}
+		if len(val) > MaxHeaderValueLength {
+			return nil, &stores.FieldError{Field: name, Err: fmt.Errorf("%w, header %s exceeds %d bytes", stores.ErrFieldTooLong, headerName, MaxHeaderValueLength)}
 		}
 
 		if val != "" {
@@ -84,25 +71,79 @@ func ParseUserHeaders(r *http.Request, storeCfg stores.StoreConfig) (map[string]
 	return userData, nil
 }
 
-// ParseToken extracts access and refresh tokens from HTTP headers.
-func ParseAccessToken(r *http.Request) (string, error) {
-	accessToken := r.Header.Get("authify-access")
+// ParseUsernamePassword extracts the credentials of the authify-username and authify-password
+// headers, failing with ErrMissingUsernameHeader or ErrMissingPasswordHeader when one is missing.
+// Values longer than MaxHeaderValueLength are rejected as in ParseUserHeaders.
+func ParseUsernamePassword(r *http.Request) (string, string, error) {
+	return Headers{}.ParseUsernamePassword(r)
+}
+
+// ParseUsernamePassword reads the username and password headers under the prefix
+func (h Headers) ParseUsernamePassword(r *http.Request) (string, string, error) {
+	username, err := h.parseCredential(r, "username", ErrMissingUsernameHeader)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := h.parseCredential(r, "password", ErrMissingPasswordHeader)
+	if err != nil {
+		return "", "", err
+	}
+	return username, password, nil
+}
 
-	if accessToken == "" {
-		return "", ErrMissingAccessTokenHeader
+func (h Headers) parseCredential(r *http.Request, name string, missing error) (string, error) {
+	headerName := h.Name(name)
+	val := r.Header.Get(headerName)
+	if val == "" {
+		return "", missing
+	}
+	if len(val) > MaxHeaderValueLength {
+		return "", &stores.FieldError{Field: name, Err: fmt.Errorf("%w, header %s exceeds %d bytes", stores.ErrFieldTooLong, headerName, MaxHeaderValueLength)}
 	}
+	return val, nil
+}
 
-	return accessToken, nil
+// ParseToken extracts access and refresh tokens from HTTP headers.
+// Tokens longer than token.MaxTokenLength are rejected with token.ErrInvalidToken.
+func ParseAccessToken(r *http.Request) (string, error) {
+	return Headers{}.ParseAccessToken(r)
 }
 
 func ParseRefreshToken(r *http.Request) (string, error) {
-	refreshToken := r.Header.Get("authify-refresh")
+	return Headers{}.ParseRefreshToken(r)
+}
 
-	if refreshToken == "" {
-		return "", ErrMissingRefreshTokenHeader
+// ParseIDToken extracts the ID token of an identity provider, see the federation package.
+func ParseIDToken(r *http.Request) (string, error) {
+	return Headers{}.ParseIDToken(r)
+}
+
+// ParseAccessToken reads the access token of the access header under the prefix
+func (h Headers) ParseAccessToken(r *http.Request) (string, error) {
+	return parseTokenHeader(r, h.Name("access"), ErrMissingAccessTokenHeader)
+}
+
+// ParseRefreshToken reads the refresh token of the refresh header under the prefix
+func (h Headers) ParseRefreshToken(r *http.Request) (string, error) {
+	return parseTokenHeader(r, h.Name("refresh"), ErrMissingRefreshTokenHeader)
+}
+
+// ParseIDToken reads the ID token of the id-token header under the prefix
+func (h Headers) ParseIDToken(r *http.Request) (string, error) {
+	return parseTokenHeader(r, h.Name("id-token"), ErrMissingIDTokenHeader)
+}
+
+func parseTokenHeader(r *http.Request, headerName string, missing error) (string, error) {
+	tokenStr := r.Header.Get(headerName)
+
+	if tokenStr == "" {
+		return "", missing
+	}
+	if len(tokenStr) > token.MaxTokenLength {
+		return "", fmt.Errorf("%w: header %s exceeds %d bytes", token.ErrInvalidToken, headerName, token.MaxTokenLength)
 	}
 
-	return refreshToken, nil
+	return tokenStr, nil
 }
 
 func LoadStoreConfig(path string) (*stores.StoreConfig, error) {
@@ -115,10 +156,57 @@ func LoadStoreConfig(path string) (*stores.StoreConfig, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", path, err)
+	}
 
 	return &cfg, nil
 }
 
+// LoadFederationConfig reads the identity providers users can sign in with, see federation.Config.
+// The client secret of a provider is read from FEDERATION_<NAME>_CLIENT_SECRET when set, e.g.
+// AUTHIFY_FEDERATION_GOOGLE_CLIENT_SECRET or its _FILE variant, so it can be kept out of the file.
+func LoadFederationConfig(path string) (*federation.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg federation.Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	for i, p := range cfg.Providers {
+		secret, found, err := lookupEnv(FederationClientSecretKey(p.Name))
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			cfg.Providers[i].ClientSecret = secrets.SecretString(secret)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid federation config %s: %w", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// FederationClientSecretKey returns the configuration key of the client secret of the provider
+// named name, FEDERATION_GOOGLE_CLIENT_SECRET for google.
+func FederationClientSecretKey(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+	return "FEDERATION_" + name + "_CLIENT_SECRET"
+}
+
 func LoadTokenConfig(path string) (*token.TokenConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
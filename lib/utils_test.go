@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+var headerStoreConfig = stores.StoreConfig{
+	Columns: map[string]stores.ColumnConfig{
+		"username": {Type: "text", Required: true, PrimaryKey: true},
+		"password": {Type: "text", Required: true, IsPassword: true},
+		"email":    {Type: "text"},
+	},
+}
+
+func TestParseUserHeadersTooLong(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/users", nil)
+	r.Header.Set("authify-username", "alice")
+	r.Header.Set("authify-password", "password123")
+	r.Header.Set("authify-email", strings.Repeat("a", MaxHeaderValueLength+1))
+
+	if _, err := ParseUserHeaders(r, headerStoreConfig); !errors.Is(err, stores.ErrFieldTooLong) {
+		t.Errorf("expected ErrFieldTooLong, got %v", err)
+	}
+
+	r.Header.Set("authify-email", "alice@example.com")
+	userData, err := ParseUserHeaders(r, headerStoreConfig)
+	if err != nil {
+		t.Fatalf("failed to parse headers: %v", err)
+	}
+	if userData["email"] != "alice@example.com" {
+		t.Errorf("expected email to be parsed, got %v", userData)
+	}
+}
+
+func TestParseUsernamePassword(t *testing.T) {
+	tests := []struct {
+		name, username, password string
+		wantErr                  error
+	}{
+		{"both", "alice", "password123", nil},
+		{"no username", "", "password123", ErrMissingUsernameHeader},
+		{"no password", "alice", "", ErrMissingPasswordHeader},
+		{"neither", "", "", ErrMissingUsernameHeader},
+		{"too long", "alice", strings.Repeat("a", MaxHeaderValueLength+1), stores.ErrFieldTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/tokens", nil)
+			if tt.username != "" {
+				r.Header.Set("authify-username", tt.username)
+			}
+			if tt.password != "" {
+				r.Header.Set("authify-password", tt.password)
+			}
+			username, password, err := ParseUsernamePassword(r)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil || username != tt.username || password != tt.password {
+				t.Errorf("expected %q/%q, got %q/%q (%v)", tt.username, tt.password, username, password, err)
+			}
+		})
+	}
+}
+
+func TestParseTokenTooLong(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/tokens/verify", nil)
+	r.Header.Set("authify-access", strings.Repeat("a", token.MaxTokenLength+1))
+	r.Header.Set("authify-refresh", strings.Repeat("a", token.MaxTokenLength+1))
+
+	if _, err := ParseAccessToken(r); !errors.Is(err, token.ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for an oversized access token, got %v", err)
+	}
+	if _, err := ParseRefreshToken(r); !errors.Is(err, token.ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken for an oversized refresh token, got %v", err)
+	}
+}
+
+func TestHeadersPrefix(t *testing.T) {
+	headers := Headers{Prefix: "x-myapp-"}
+	r := httptest.NewRequest("POST", "/v1/users", nil)
+	r.Header.Set("x-myapp-username", "alice")
+	r.Header.Set("x-myapp-password", "password123")
+	r.Header.Set("x-myapp-access", "access-token")
+	r.Header.Set("authify-refresh", "refresh-token")
+
+	userData, err := headers.ParseUserHeaders(r, headerStoreConfig)
+	if err != nil || userData["username"] != "alice" {
+		t.Errorf("expected the prefixed user headers to be parsed, got %v (%v)", userData, err)
+	}
+	if got, err := headers.ParseAccessToken(r); err != nil || got != "access-token" {
+		t.Errorf("expected the prefixed access token, got %q (%v)", got, err)
+	}
+	if _, err := headers.ParseRefreshToken(r); !errors.Is(err, ErrMissingRefreshTokenHeader) {
+		t.Errorf("expected authify-refresh to be ignored, got %v", err)
+	}
+	if _, err := ParseUserHeaders(r, headerStoreConfig); !errors.Is(err, stores.ErrMissingField) {
+		t.Errorf("expected the default prefix to miss the prefixed headers, got %v", err)
+	}
+}
+
+func TestLoadStoreConfigDefaultRole(t *testing.T) {
+	const storeYAML = `
+name: users
+columns:
+  username: {type: text, primary_key: true}
+  role: {type: text, default: %s}
+allowed_roles: [user, admin]
+`
+	if _, err := LoadStoreConfig(writeFile(t, "store.yml", fmt.Sprintf(storeYAML, "user"))); err != nil {
+		t.Errorf("expected an allowed default role to load, got %v", err)
+	}
+	if _, err := LoadStoreConfig(writeFile(t, "store.yml", fmt.Sprintf(storeYAML, "amin"))); !errors.Is(err, stores.ErrInvalidRole) {
+		t.Errorf("expected ErrInvalidRole for a default role outside allowed_roles, got %v", err)
+	}
+}
+
+func TestLoadFederationConfigProviders(t *testing.T) {
+	const federationYAML = `
+providers:
+  - name: google
+    issuer: https://accounts.google.com
+    client_id: client-1
+    redirect_url: https://app.example.com/auth/google/callback
+    auto_provision: true
+    default_role: user
+`
+	path := writeFile(t, "federation.yml", federationYAML)
+	if _, err := LoadFederationConfig(path); err == nil {
+		t.Error("expected a provider without client secret to be rejected")
+	}
+
+	t.Setenv(EnvPrefix+"FEDERATION_GOOGLE_CLIENT_SECRET", "secret-1")
+	cfg, err := LoadFederationConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Providers) != 1 || cfg.Providers[0].ClientSecret.Reveal() != "secret-1" || cfg.Providers[0].DefaultRole != "user" {
+		t.Errorf("expected the provider with the secret of the environment, got %+v", cfg.Providers)
+	}
+
+	if _, err := LoadFederationConfig(writeFile(t, "federation.yml", federationYAML+federationYAML[len("\nproviders:\n"):])); err == nil || !strings.Contains(err.Error(), "twice") {
+		t.Error("expected a provider configured twice to be rejected")
+	}
+}
+
+func FuzzParseUserHeaders(f *testing.F) {
+	f.Add("alice", "password123")
+	f.Add("", "")
+	f.Add(strings.Repeat("a", MaxHeaderValueLength+1), "password123")
+
+	f.Fuzz(func(t *testing.T, username, password string) {
+		r := httptest.NewRequest("POST", "/v1/users", nil)
+		r.Header.Set("authify-username", username)
+		r.Header.Set("authify-password", password)
+
+		userData, err := ParseUserHeaders(r, headerStoreConfig)
+		if err != nil {
+			return
+		}
+		for name, val := range userData {
+			if s, ok := val.(string); !ok || s == "" || len(s) > MaxHeaderValueLength {
+				t.Errorf("unexpected value for %s: %q", name, val)
+			}
+		}
+	})
+}
+
+func FuzzParseToken(f *testing.F) {
+	f.Add("eyJhbGciOiJIUzI1NiJ9.e30.sig")
+	f.Add("")
+	f.Add(strings.Repeat(".", token.MaxTokenLength+1))
+
+	f.Fuzz(func(t *testing.T, tokenStr string) {
+		r := httptest.NewRequest("POST", "/v1/tokens/verify", nil)
+		r.Header.Set("authify-access", tokenStr)
+		r.Header.Set("authify-refresh", tokenStr)
+
+		if got, err := ParseAccessToken(r); err == nil && (got == "" || len(got) > token.MaxTokenLength) {
+			t.Errorf("accepted access token of length %d", len(got))
+		}
+		if got, err := ParseRefreshToken(r); err == nil && (got == "" || len(got) > token.MaxTokenLength) {
+			t.Errorf("accepted refresh token of length %d", len(got))
+		}
+	})
+}
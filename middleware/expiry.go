@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// TokenExpiresInHeader is the response header in which the middlewares tell how many seconds
+	// the verified access token has left, see ExpiresInHeader to rename it
+	TokenExpiresInHeader = "X-Authify-Token-Expires-In"
+
+	// RefreshedTokenHeader is the response header carrying the replacement of an access token
+	// close to expiry, see SlidingAuthenticator
+	RefreshedTokenHeader = "X-Authify-Refreshed-Token"
+)
+
+// SlidingAuthenticator is an Authenticator extending sessions on use, such as *authify.Authify
+// with a token manager built token.JWTManager.WithSlidingExpiration. The middlewares send the
+// replacement of a token close to expiry in the RefreshedTokenHeader response header, and
+// clients should use it from then on.
+type SlidingAuthenticator interface {
+	AuthenticateSliding(tokenStr string) (claims jwt.MapClaims, replacement string, err error)
+}
+
+// ExpiresInHeader makes the middlewares behind it tell the remaining lifetime of the verified
+// token in the header name instead of TokenExpiresInHeader, e.g. for gateways setting cache
+// headers from it. An empty name leaves the header out.
+func ExpiresInHeader(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), expiresInKey, name)))
+		})
+	}
+}
+
+// authenticate verifies accessToken with a, returning the replacement of the token when a
+// extends sessions on use
+func authenticate(a Authenticator, accessToken string) (jwt.MapClaims, string, error) {
+	if slider, ok := a.(SlidingAuthenticator); ok {
+		return slider.AuthenticateSliding(accessToken)
+	}
+	claims, err := a.AuthenticateClaims(accessToken)
+	return claims, "", err
+}
+
+// SetTokenHeaders sets the response headers describing a verified access token: its remaining
+// lifetime, in whole seconds, and its replacement, if any
+func SetTokenHeaders(w http.ResponseWriter, r *http.Request, claims jwt.MapClaims, replacement string) {
+	name, set := r.Context().Value(expiresInKey).(string)
+	if !set {
+		name = TokenExpiresInHeader
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil && name != "" {
+		w.Header().Set(name, strconv.FormatInt(max(int64(time.Until(exp.Time).Seconds()), 0), 10))
+	}
+	if replacement != "" {
+		w.Header().Set(RefreshedTokenHeader, replacement)
+		w.Header().Set("Cache-Control", "no-store")
+	}
+}
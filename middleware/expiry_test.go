@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// slidingAuthenticator accepts every token, expiring in expiresIn, and replaces it with replacement
+type slidingAuthenticator struct {
+	expiresIn   time.Duration
+	replacement string
+}
+
+func (s slidingAuthenticator) AuthenticateClaims(tokenStr string) (jwt.MapClaims, error) {
+	return jwt.MapClaims{"username": "alice", "scope": "users:read", "exp": float64(time.Now().Add(s.expiresIn).Unix())}, nil
+}
+
+func (s slidingAuthenticator) AuthenticateSliding(tokenStr string) (jwt.MapClaims, string, error) {
+	claims, err := s.AuthenticateClaims(tokenStr)
+	return claims, s.replacement, err
+}
+
+func TestTokenHeaders(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(RequireScope(slidingAuthenticator{expiresIn: time.Minute, replacement: "new-token"}, "users:read")(ok))
+	if left, err := strconv.Atoi(rec.Header().Get(TokenExpiresInHeader)); err != nil || left < 58 || left > 60 {
+		t.Errorf("expected about 60 seconds left, got %q", rec.Header().Get(TokenExpiresInHeader))
+	}
+	if got := rec.Header().Get(RefreshedTokenHeader); got != "new-token" {
+		t.Errorf("expected the replacement token, got %q", got)
+	}
+
+	rec = serve(ExpiresInHeader("X-Token-TTL")(RequireScope(slidingAuthenticator{expiresIn: time.Minute}, "users:read")(ok)))
+	if rec.Header().Get("X-Token-TTL") == "" || rec.Header().Get(TokenExpiresInHeader) != "" {
+		t.Errorf("expected the renamed header only, got headers %v", rec.Header())
+	}
+	if rec.Header().Get(RefreshedTokenHeader) != "" {
+		t.Errorf("expected no replacement, got %q", rec.Header().Get(RefreshedTokenHeader))
+	}
+
+	rec = serve(ExpiresInHeader("")(RequireScope(slidingAuthenticator{expiresIn: time.Minute}, "users:read")(ok)))
+	if rec.Header().Get(TokenExpiresInHeader) != "" {
+		t.Errorf("expected the header to be left out, got headers %v", rec.Header())
+	}
+}
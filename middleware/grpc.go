@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+
+	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RequireScopeInterceptor is the gRPC counterpart of RequireScope.
+// It reads the access token from the "authorization" (bearer) or "authify-access" metadata,
+// failing with Unauthenticated when it is missing or invalid, and PermissionDenied
+// when it does not grant every required scope.
+// Verified claims are available to handlers through ClaimsFromContext.
+func RequireScopeInterceptor(a Authenticator, scopes ...string) grpc.UnaryServerInterceptor {
+	return requireClaimsInterceptor(a, func(claims jwt.MapClaims) error {
+		if !token.HasScopes(claims, scopes...) {
+			return token.ErrInsufficientScope
+		}
+		return nil
+	})
+}
+
+// RequireAudienceInterceptor is the gRPC counterpart of RequireAudience, failing with
+// PermissionDenied when the "aud" claim of the token does not name audience.
+func RequireAudienceInterceptor(a Authenticator, audience string) grpc.UnaryServerInterceptor {
+	return requireClaimsInterceptor(a, func(claims jwt.MapClaims) error {
+		if !token.HasAudience(claims, audience) {
+			return token.ErrAudienceMismatch
+		}
+		return nil
+	})
+}
+
+// RequireTokenUseInterceptor is the gRPC counterpart of RequireTokenUse, failing with
+// PermissionDenied for the tokens of the other kind.
+func RequireTokenUseInterceptor(a Authenticator, use string) grpc.UnaryServerInterceptor {
+	return requireClaimsInterceptor(a, func(claims jwt.MapClaims) error {
+		return checkTokenUse(claims, use)
+	})
+}
+
+// requireClaimsInterceptor authenticates the access token of the call and fails with
+// PermissionDenied when check rejects its claims
+func requireClaimsInterceptor(a Authenticator, check func(claims jwt.MapClaims) error) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		accessToken := AccessTokenFromMetadata(ctx)
+		if accessToken == "" {
+			return nil, status.Error(codes.Unauthenticated, "access token is missing in the request metadata")
+		}
+
+		claims, err := a.AuthenticateClaims(accessToken)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		if err := check(claims); err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+
+		return handler(WithClaims(ctx, claims), req)
+	}
+}
+
+// AccessTokenFromMetadata extracts the access token from the "authorization" bearer metadata,
+// falling back to "authify-access". An empty string is returned when there is none.
+func AccessTokenFromMetadata(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get("authorization"); len(values) > 0 {
+		scheme, accessToken, ok := strings.Cut(values[0], " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return accessToken
+		}
+		return ""
+	}
+	if values := md.Get("authify-access"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/HassanAli101/authify/lib"
+)
+
+// HeaderPrefix makes the middlewares behind it read and write their authify-* headers under
+// prefix, e.g. x-myapp-access and x-myapp-refresh with "x-myapp-", for applications with
+// header conventions of their own. The Authorization header is read as usual.
+func HeaderPrefix(prefix string) func(http.Handler) http.Handler {
+	headers := lib.Headers{Prefix: prefix}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), headersKey, headers)))
+		})
+	}
+}
+
+// headersOf returns the headers set by HeaderPrefix for r, the authify-* ones otherwise
+func headersOf(r *http.Request) lib.Headers {
+	headers, _ := r.Context().Value(headersKey).(lib.Headers)
+	return headers
+}
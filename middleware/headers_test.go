@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeaderPrefix(t *testing.T) {
+	a := newTestAuthify(t)
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	refreshToken, err := a.Tokens.GenerateRefreshToken("alice", map[string]any{"ip": "127.0.0.1", "user_agent": "test"})
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+	handler := HeaderPrefix("x-myapp-")(RequireScope(a, "users:read")(RefreshNearExpiry(a, 2*time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+
+	req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+	req.Header.Set("x-myapp-access", accessToken)
+	req.Header.Set("x-myapp-refresh", refreshToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the prefixed access header to be read, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("x-myapp-new-access") == "" || rec.Header().Get(NewAccessTokenHeader) != "" {
+		t.Errorf("expected the new access token under the prefix, got headers %v", rec.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/reports", nil)
+	req.Header.Set("authify-access", accessToken)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected authify-access to be ignored under another prefix, got %d", rec.Code)
+	}
+}
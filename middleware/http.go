@@ -0,0 +1,137 @@
+// Package middleware provides net/http middlewares and gRPC interceptors
+// that protect application endpoints with authify access tokens.
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrMalformedAuthorization is returned when the Authorization header is not a bearer token
+var ErrMalformedAuthorization = fmt.Errorf("%w: malformed Authorization header, expected a bearer token", token.ErrInvalidToken)
+
+// Authenticator verifies access tokens for the middlewares. It is implemented by
+// *authify.Authify, and by *verifier.Verifier for services checking tokens without a store.
+type Authenticator interface {
+	AuthenticateClaims(tokenStr string) (jwt.MapClaims, error)
+}
+
+type contextKey int
+
+const (
+	claimsKey contextKey = iota
+	headersKey
+	expiresInKey
+)
+
+// ClaimsFromContext returns the verified access token claims stored by the middlewares.
+func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+	claims, ok := ctx.Value(claimsKey).(jwt.MapClaims)
+	return claims, ok
+}
+
+// WithClaims returns a copy of ctx carrying claims, for handlers tested without the middleware.
+func WithClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// RequireScope authenticates the request's access token with a.AuthenticateClaims and responds
+// with 401 when it is missing or invalid, and 403 when it does not grant every required scope.
+// The token is read from the Authorization bearer header, or the authify-access header, see
+// HeaderPrefix. Verified claims are available to next through ClaimsFromContext, and the
+// response tells how long the token has left, see SetTokenHeaders.
+func RequireScope(a Authenticator, scopes ...string) func(http.Handler) http.Handler {
+	return requireClaims(a, func(claims jwt.MapClaims) error {
+		if !token.HasScopes(claims, scopes...) {
+			return token.ErrInsufficientScope
+		}
+		return nil
+	})
+}
+
+// RequireAudience is RequireScope for the audience of the token: it responds with 403 when
+// the "aud" claim does not name audience, so resource servers sharing an issuer only accept
+// the tokens minted for them.
+func RequireAudience(a Authenticator, audience string) func(http.Handler) http.Handler {
+	return requireClaims(a, func(claims jwt.MapClaims) error {
+		if !token.HasAudience(claims, audience) {
+			return token.ErrAudienceMismatch
+		}
+		return nil
+	})
+}
+
+// RequireTokenUse is RequireScope for the kind of the token, token.TokenUseUser or
+// token.TokenUseService: it responds with 403 to the tokens of the other kind, e.g. so that
+// routes for background jobs only accept the tokens of service accounts.
+func RequireTokenUse(a Authenticator, use string) func(http.Handler) http.Handler {
+	return requireClaims(a, func(claims jwt.MapClaims) error {
+		return checkTokenUse(claims, use)
+	})
+}
+
+// checkTokenUse fails with token.ErrTokenUseMismatch unless claims are of a token of kind use
+func checkTokenUse(claims jwt.MapClaims, use string) error {
+	if got := token.TokenUse(claims); got != use {
+		return fmt.Errorf("%w: got a %s token, need a %s token", token.ErrTokenUseMismatch, got, use)
+	}
+	return nil
+}
+
+// requireClaims authenticates the request's access token and responds with 403 when check
+// rejects its claims. Accepted requests get the headers of SetTokenHeaders.
+func requireClaims(a Authenticator, check func(claims jwt.MapClaims) error) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accessToken, err := AccessTokenFromRequest(r)
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err)
+				return
+			}
+
+			claims, replacement, err := authenticate(a, accessToken)
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err)
+				return
+			}
+
+			if err := check(claims); err != nil {
+				writeError(w, http.StatusForbidden, err)
+				return
+			}
+			SetTokenHeaders(w, r, claims, replacement)
+
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// AccessTokenFromRequest extracts the access token from the Authorization bearer header,
+// falling back to the authify-access header used by the authify server, or the access header
+// under the prefix set by HeaderPrefix.
+func AccessTokenFromRequest(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, accessToken, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") && accessToken != "" {
+			return accessToken, nil
+		}
+		return "", ErrMalformedAuthorization
+	}
+	return headersOf(r).ParseAccessToken(r)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":  string(authify.ErrorCode(err)),
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/authifytest"
+	"github.com/HassanAli101/authify/token"
+	"github.com/HassanAli101/authify/verifier"
+)
+
+// newTestAuthify returns an Authify whose store holds alice, with the role user
+func newTestAuthify(t *testing.T) *authify.Authify {
+	t.Helper()
+	a := authifytest.NewTestAuthify(t)
+	authifytest.CreateUser(t, a, "alice", "password123", "user")
+	return a
+}
+
+func TestRequireScope(t *testing.T) {
+	a := newTestAuthify(t)
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, found := ClaimsFromContext(r.Context()); !found || claims["username"] != "alice" {
+			t.Errorf("expected verified claims in context, got %v", claims)
+		}
+	})
+
+	cases := []struct {
+		name   string
+		scopes []string
+		header string
+		want   int
+	}{
+		{"granted", []string{"users:read"}, "Bearer " + accessToken, http.StatusOK},
+		{"missing scope", []string{"users:write"}, "Bearer " + accessToken, http.StatusForbidden},
+		{"signed token", []string{"reports:read"}, "Bearer " + authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithScopes("reports:read")), http.StatusOK},
+		{"expired token", []string{"users:read"}, "Bearer " + authifytest.ExpiredAccessToken(t, "alice", "user", authifytest.WithScopes("users:read")), http.StatusUnauthorized},
+		{"invalid token", []string{"users:read"}, "Bearer garbage", http.StatusUnauthorized},
+		{"no token", []string{"users:read"}, "", http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+
+			RequireScope(a, tc.scopes...)(ok).ServeHTTP(rec, req)
+
+			if rec.Code != tc.want {
+				t.Errorf("expected status %d, got %d: %s", tc.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireAudience(t *testing.T) {
+	a := newTestAuthify(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"audience", authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithAudience("billing")), http.StatusOK},
+		{"one of several audiences", authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithAudience("reports", "billing")), http.StatusOK},
+		{"audience string", authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithClaim("aud", "billing")), http.StatusOK},
+		{"other audience", authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithAudience("reports")), http.StatusForbidden},
+		{"no audience", authifytest.SignedAccessToken(t, "alice", "user"), http.StatusForbidden},
+		{"invalid token", "garbage", http.StatusUnauthorized},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/invoices", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rec := httptest.NewRecorder()
+
+			RequireAudience(a, "billing")(ok).ServeHTTP(rec, req)
+
+			if rec.Code != tc.want {
+				t.Errorf("expected status %d, got %d: %s", tc.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireTokenUse(t *testing.T) {
+	a := newTestAuthify(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	userToken := authifytest.SignedAccessToken(t, "alice", "user")
+	serviceToken := authifytest.SignedAccessToken(t, "alice", "user",
+		authifytest.WithClaim(token.ClaimTokenUse, token.TokenUseService), authifytest.WithClaim(token.ClaimSubject, "reports-job"))
+
+	cases := []struct {
+		name  string
+		use   string
+		token string
+		want  int
+	}{
+		{"service token on a service route", token.TokenUseService, serviceToken, http.StatusOK},
+		{"user token on a service route", token.TokenUseService, userToken, http.StatusForbidden},
+		{"user token on a user route", token.TokenUseUser, userToken, http.StatusOK},
+		{"service token on a user route", token.TokenUseUser, serviceToken, http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/jobs", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rec := httptest.NewRecorder()
+
+			RequireTokenUse(a, tc.use)(ok).ServeHTTP(rec, req)
+
+			if rec.Code != tc.want {
+				t.Errorf("expected status %d, got %d: %s", tc.want, rec.Code, rec.Body.String())
+			}
+			if tc.want == http.StatusForbidden && !strings.Contains(rec.Body.String(), string(authify.CodeTokenUseMismatch)) {
+				t.Errorf("expected code %s, got %s", authify.CodeTokenUseMismatch, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireScopeWithVerifier(t *testing.T) {
+	v, err := verifier.New().WithAccessSecret(authifytest.AccessSecret).Build()
+	if err != nil {
+		t.Fatalf("failed to build verifier: %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := map[string]struct {
+		token string
+		want  int
+	}{
+		"granted":       {authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithScopes("reports:read")), http.StatusOK},
+		"missing scope": {authifytest.SignedAccessToken(t, "alice", "user"), http.StatusForbidden},
+		"expired token": {authifytest.ExpiredAccessToken(t, "alice", "user", authifytest.WithScopes("reports:read")), http.StatusUnauthorized},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rec := httptest.NewRecorder()
+
+			RequireScope(v, "reports:read")(ok).ServeHTTP(rec, req)
+
+			if rec.Code != tc.want {
+				t.Errorf("expected status %d, got %d: %s", tc.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify"
+)
+
+// RateLimiter allows every key, e.g. a client address, limit requests per window.
+// Windows are fixed and start with the first request of a key. It is safe for concurrent use.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	windows   map[string]rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// NewRateLimiter returns a limiter allowing limit requests per window and key.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		window:  window,
+		now:     time.Now,
+		windows: make(map[string]rateWindow),
+	}
+}
+
+// Allow counts a request of key and fails with authify.ErrRateLimited once key used up
+// its window. retryAfter is how long until the window of key ends.
+func (l *RateLimiter) Allow(key string) (retryAfter time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		w = rateWindow{start: now}
+	}
+	retryAfter = w.start.Add(l.window).Sub(now)
+	if w.count >= l.limit {
+		return retryAfter, fmt.Errorf("%w, retry in %s", authify.ErrRateLimited, retryAfter.Round(time.Second))
+	}
+	w.count++
+	l.windows[key] = w
+	return retryAfter, nil
+}
+
+// sweep drops the ended windows, at most once per window, so keys seen once are not kept forever
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// RateLimit responds with 429 and a Retry-After header to the requests exceeding the limits of l,
+// counted per key of the request, e.g. the client address.
+func RateLimit(l *RateLimiter, key func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			retryAfter, err := l.Allow(key(r))
+			if err != nil {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for range 2 {
+		if _, err := l.Allow("alice"); err != nil {
+			t.Fatalf("expected a request within the limit to be allowed, got %v", err)
+		}
+	}
+	now = now.Add(20 * time.Second)
+	retryAfter, err := l.Allow("alice")
+	if !errors.Is(err, authify.ErrRateLimited) || retryAfter != 40*time.Second {
+		t.Errorf("expected ErrRateLimited with 40s to wait, got %v (%v)", retryAfter, err)
+	}
+	if _, err := l.Allow("bob"); err != nil {
+		t.Errorf("expected keys to be limited separately, got %v", err)
+	}
+
+	now = now.Add(40 * time.Second)
+	if _, err := l.Allow("alice"); err != nil {
+		t.Errorf("expected a new window once the previous one ended, got %v", err)
+	}
+	now = now.Add(time.Minute)
+	_, _ = l.Allow("carol")
+	if _, ok := l.windows["bob"]; ok {
+		t.Errorf("expected the ended window of bob to be swept")
+	}
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+// NewAccessTokenHeader is the response header carrying the access token minted by
+// RefreshNearExpiry, new-access under the prefix set by HeaderPrefix
+const NewAccessTokenHeader = "authify-new-access"
+
+// NewRefreshTokenHeader is the response header carrying the refresh token RefreshNearExpiry
+// rotated, new-refresh under the prefix set by HeaderPrefix
+const NewRefreshTokenHeader = "authify-new-refresh"
+
+// refreshCookie names the cookie RefreshNearExpiry reads the refresh token from,
+// when the request has no authify-refresh header
+const refreshCookie = "authify-refresh"
+
+// RefreshNearExpiry extends sessions without a separate refresh round-trip: when the request's
+// access token is valid but expires within threshold, and the request also carries a valid
+// refresh token (authify-refresh header or cookie), a new access token is returned in the
+// authify-new-access response header. When the refresh rotates the refresh token, see
+// authify.WithTokenFamilies, its replacement is returned in the authify-new-refresh header and
+// must be used from then on. The headers follow HeaderPrefix.
+// The request is always passed on to next, whether a token was minted or not,
+// so it should be paired with RequireScope to reject unauthenticated requests.
+func RefreshNearExpiry(a *authify.Authify, threshold time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if pair, refreshToken := refreshNearExpiry(a, threshold, r); pair != nil {
+				w.Header().Set(headersOf(r).Name("new-access"), pair.AccessToken)
+				if pair.RefreshToken != refreshToken {
+					w.Header().Set(headersOf(r).Name("new-refresh"), pair.RefreshToken)
+				}
+				w.Header().Set("Cache-Control", "no-store")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// refreshNearExpiry returns the tokens of a refresh for r along with the refresh token it was
+// made with, or nil when its access token is invalid, not near expiry, or it has no valid
+// refresh token
+func refreshNearExpiry(a *authify.Authify, threshold time.Duration, r *http.Request) (*authify.TokenPair, string) {
+	accessToken, err := AccessTokenFromRequest(r)
+	if err != nil {
+		return nil, ""
+	}
+	claims, err := a.AuthenticateClaims(accessToken)
+	if err != nil {
+		return nil, ""
+	}
+	expiry, err := claims.GetExpirationTime()
+	if err != nil || expiry == nil || time.Until(expiry.Time) > threshold {
+		return nil, ""
+	}
+
+	refreshToken := refreshTokenFromRequest(r)
+	if refreshToken == "" {
+		return nil, ""
+	}
+	pair, err := a.RefreshTokens(r.Context(), token.RefreshTokensRequest{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		Device:       stores.DeviceInfo{IP: r.RemoteAddr, UserAgent: r.UserAgent()},
+	})
+	if err != nil {
+		log.Printf("Unable to refresh access token near expiry: %v", err)
+		return nil, ""
+	}
+	return pair, refreshToken
+}
+
+// refreshTokenFromRequest reads the refresh token from the authify-refresh header, falling back
+// to the cookie of the same name. An empty string is returned when there is none.
+func refreshTokenFromRequest(r *http.Request) string {
+	if refreshToken, err := headersOf(r).ParseRefreshToken(r); err == nil {
+		return refreshToken
+	}
+	if cookie, err := r.Cookie(refreshCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
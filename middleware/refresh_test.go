@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+func TestRefreshNearExpiry(t *testing.T) {
+	a := newTestAuthify(t)
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	refreshToken, err := a.Tokens.GenerateRefreshToken("alice", map[string]any{"ip": "127.0.0.1", "user_agent": "test"})
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+
+	// access tokens of authifytest last a minute
+	cases := []struct {
+		name      string
+		threshold time.Duration
+		access    string
+		header    string
+		cookie    string
+		refreshed bool
+	}{
+		{"near expiry", 2 * time.Minute, accessToken, refreshToken, "", true},
+		{"refresh token in cookie", 2 * time.Minute, accessToken, "", refreshToken, true},
+		{"not near expiry", 10 * time.Second, accessToken, refreshToken, "", false},
+		{"no refresh token", 2 * time.Minute, accessToken, "", "", false},
+		{"invalid refresh token", 2 * time.Minute, accessToken, "garbage", "", false},
+		{"access token as refresh token", 2 * time.Minute, accessToken, accessToken, "", false},
+		{"invalid access token", 2 * time.Minute, "garbage", refreshToken, "", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.access)
+			if tc.header != "" {
+				req.Header.Set("authify-refresh", tc.header)
+			}
+			if tc.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "authify-refresh", Value: tc.cookie})
+			}
+			rec := httptest.NewRecorder()
+			called := false
+
+			RefreshNearExpiry(a, tc.threshold)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})).ServeHTTP(rec, req)
+
+			if !called {
+				t.Fatal("expected the request to reach the next handler")
+			}
+			newToken := rec.Header().Get(NewAccessTokenHeader)
+			if tc.refreshed != (newToken != "") {
+				t.Fatalf("expected refreshed=%v, got header %q", tc.refreshed, newToken)
+			}
+			if rotated := rec.Header().Get(NewRefreshTokenHeader); rotated != "" {
+				t.Errorf("expected the refresh token to be kept without rotation, got %q", rotated)
+			}
+			if newToken == "" {
+				return
+			}
+			claims, err := a.AuthenticateClaims(newToken)
+			if err != nil || claims["username"] != "alice" {
+				t.Errorf("expected a valid access token for alice, got %v (%v)", claims, err)
+			}
+		})
+	}
+}
+
+func TestRefreshNearExpiryRotation(t *testing.T) {
+	a := newTestAuthify(t).WithTokenFamilies(stores.NewInMemorySessionStore()).WithTokenFamilyGraceWindow(0)
+	pair, err := a.LoginContext(context.Background(), "alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+	req.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+	req.Header.Set("authify-refresh", pair.RefreshToken)
+	rec := httptest.NewRecorder()
+	RefreshNearExpiry(a, 2*time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+
+	rotated := rec.Header().Get(NewRefreshTokenHeader)
+	if rec.Header().Get(NewAccessTokenHeader) == "" || rotated == "" || rotated == pair.RefreshToken {
+		t.Fatalf("expected a new access token and the rotated refresh token, got %v", rec.Header())
+	}
+	if _, err := a.RefreshTokens(context.Background(), token.RefreshTokensRequest{RefreshToken: rotated}); err != nil {
+		t.Errorf("expected the rotated refresh token to work, got %v", err)
+	}
+	if _, err := a.RefreshTokens(context.Background(), token.RefreshTokensRequest{RefreshToken: pair.RefreshToken}); !errors.Is(err, authify.ErrRefreshTokenReused) {
+		t.Errorf("expected the consumed refresh token to be refused, got %v", err)
+	}
+}
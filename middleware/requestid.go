@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/HassanAli101/authify"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestID tags each request with the ID of its X-Request-ID header, or a new one when it is
+// missing or invalid, see authify.ValidRequestID. The ID is echoed in the response header and
+// available to next through authify.RequestIDFromContext, which records it in audit events.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(authify.RequestIDHeader)
+		if !authify.ValidRequestID(id) {
+			id = authify.NewRequestID()
+		}
+		w.Header().Set(authify.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(authify.WithRequestID(r.Context(), id)))
+	})
+}
+
+// RequestIDInterceptor is the gRPC counterpart of RequestID, reading the "x-request-id"
+// metadata and sending the ID back in the response header metadata.
+func RequestIDInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		id := ""
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(authify.RequestIDHeader); len(values) > 0 {
+				id = values[0]
+			}
+		}
+		if !authify.ValidRequestID(id) {
+			id = authify.NewRequestID()
+		}
+		grpc.SetHeader(ctx, metadata.Pairs(authify.RequestIDHeader, id))
+		return handler(authify.WithRequestID(ctx, id), req)
+	}
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HassanAli101/authify"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"sent by the client", "req-123", true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("a", authify.MaxRequestIDLength+1), false},
+		{"with a line break", "req\nforged log line", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var seen string
+			handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = authify.RequestIDFromContext(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				req.Header.Set(authify.RequestIDHeader, tc.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			echoed := rec.Header().Get(authify.RequestIDHeader)
+			if seen == "" || echoed != seen {
+				t.Fatalf("expected the request ID %q in the context to be echoed, got %q", seen, echoed)
+			}
+			if kept := seen == tc.header; kept != tc.keep {
+				t.Errorf("expected the header to be kept: %v, got request ID %q", tc.keep, seen)
+			}
+		})
+	}
+}
+
+func TestRequestIDInterceptor(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "req-123"))
+	var seen string
+	_, err := RequestIDInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req any) (any, error) {
+		seen = authify.RequestIDFromContext(ctx)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != "req-123" {
+		t.Errorf("expected the request ID of the metadata, got %q", seen)
+	}
+}
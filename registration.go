@@ -0,0 +1,133 @@
+package authify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+)
+
+// RegistrationPolicy decides who can create users through RegisterUser.
+type RegistrationPolicy int
+
+const (
+	// RegistrationOpen lets anyone create users, the default
+	RegistrationOpen RegistrationPolicy = iota
+	// RegistrationInvite requires an invite code, see CreateInvite, or an administrator's token
+	RegistrationInvite
+	// RegistrationClosed only lets administrators create users
+	RegistrationClosed
+)
+
+// String returns the name of the policy, as accepted by ParseRegistrationPolicy
+func (p RegistrationPolicy) String() string {
+	switch p {
+	case RegistrationInvite:
+		return "invite"
+	case RegistrationClosed:
+		return "closed"
+	}
+	return "open"
+}
+
+// ParseRegistrationPolicy parses the names returned by RegistrationPolicy.String, an empty name is RegistrationOpen.
+func ParseRegistrationPolicy(name string) (RegistrationPolicy, error) {
+	for _, policy := range []RegistrationPolicy{RegistrationOpen, RegistrationInvite, RegistrationClosed} {
+		if name == policy.String() {
+			return policy, nil
+		}
+	}
+	if name == "" {
+		return RegistrationOpen, nil
+	}
+	return RegistrationOpen, fmt.Errorf("unknown registration policy %q, expected open, invite or closed", name)
+}
+
+// Registration is what the caller of RegisterUser presents, besides the fields of the new user.
+type Registration struct {
+	// AccessToken of an administrator, granting AdminScope, creates users whatever the policy
+	AccessToken string
+	// InviteCode is used up by the creation of the user under RegistrationInvite
+	InviteCode string
+}
+
+// WithRegistrationPolicy makes RegisterUser enforce policy, invites keeping the invites of
+// RegistrationInvite. invites may be nil for the other policies.
+func (a *Authify) WithRegistrationPolicy(policy RegistrationPolicy, invites stores.InviteStore) *Authify {
+	a.Registration = policy
+	a.Invites = invites
+	return a
+}
+
+// RegisterUser creates a user on behalf of a client, like CreateUser once the registration policy
+// lets the client: under RegistrationInvite the invite code of reg is used up, unless reg carries
+// the access token of an administrator, and under RegistrationClosed only administrators can create
+// users. Missing or invalid invites fail with ErrInviteRequired, ErrInviteNotFound, ErrInviteExpired
+// and ErrInviteUsedUp, other clients of a closed registration with ErrRegistrationClosed. The fields
+// of the user are validated before the invite is used, and the use is given back when the creation
+// fails afterwards, e.g. because the username is taken.
+func (a *Authify) RegisterUser(ctx context.Context, userData map[string]any, reg Registration) (map[string]string, error) {
+	if a.Registration == RegistrationOpen {
+		return a.CreateUser(ctx, userData)
+	}
+
+	if reg.AccessToken != "" {
+		claims, err := a.AuthenticateClaims(reg.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		if token.HasScopes(claims, AdminScope) {
+			return a.CreateUser(ctx, userData)
+		}
+	}
+	if a.Registration == RegistrationClosed {
+		return nil, ErrRegistrationClosed
+	}
+
+	if reg.InviteCode == "" {
+		return nil, ErrInviteRequired
+	}
+	if a.Invites == nil {
+		return nil, ErrInvitesNotSupported
+	}
+	storeCfg := a.Store.StoreConfig()
+	if err := storeCfg.ValidateInput(userData); err != nil {
+		return nil, err
+	}
+	if err := storeCfg.CheckRequired(userData); err != nil {
+		return nil, err
+	}
+	invite, err := a.Invites.ConsumeInvite(ctx, reg.InviteCode)
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.CreateUser(ctx, userData)
+	if err != nil {
+		if releaseErr := a.Invites.ReleaseInvite(ctx, invite.ID); releaseErr != nil {
+			log.Printf("failed to give back a use of invite %s: %v", invite.ID, releaseErr)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateInvite records an invite signing up maxUses users, unlimited when zero, until expiresAt,
+// forever when zero, and returns its code, see stores.InviteStore. It fails with
+// ErrInvitesNotSupported without an invite store, see WithRegistrationPolicy.
+func (a *Authify) CreateInvite(ctx context.Context, maxUses int, expiresAt time.Time) (string, stores.Invite, error) {
+	if a.Invites == nil {
+		return "", stores.Invite{}, ErrInvitesNotSupported
+	}
+	return a.Invites.CreateInvite(ctx, maxUses, expiresAt)
+}
+
+// ListInvites returns every invite, see CreateInvite.
+func (a *Authify) ListInvites(ctx context.Context) ([]stores.Invite, error) {
+	if a.Invites == nil {
+		return nil, ErrInvitesNotSupported
+	}
+	return a.Invites.ListInvites(ctx)
+}
@@ -0,0 +1,50 @@
+package authify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// RequestIDHeader is the header correlating the logs and audit events of a request, read from
+// clients and echoed in responses by middleware.RequestID. gRPC calls carry it in the
+// "x-request-id" metadata.
+const RequestIDHeader = "X-Request-ID"
+
+// MaxRequestIDLength bounds the request IDs accepted from clients, longer ones are replaced
+const MaxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id, recorded in the audit
+// events of the calls made with it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID set by WithRequestID, or an empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns 16 random bytes, hex encoded.
+func NewRequestID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// ValidRequestID reports whether a request ID sent by a client can be kept: it must be at most
+// MaxRequestIDLength bytes of printable ASCII, so it cannot forge or break log lines.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+// Package secrets keeps secrets, such as signing keys and passwords, out of logs,
+// error messages and timing side channels.
+package secrets
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Redacted replaces the value of a SecretString whenever it is formatted
+const Redacted = "[REDACTED]"
+
+// SecretString holds a secret that formats as Redacted with every fmt verb, and in JSON
+// and YAML output, so it cannot leak through a log line or a wrapped error.
+// An empty SecretString formats as an empty string, so unset secrets are still visible.
+// Reveal returns the value where it is actually needed.
+type SecretString string
+
+// Reveal returns the plaintext secret
+func (s SecretString) Reveal() string { return string(s) }
+
+// Equals compares s with a candidate in constant time, see ConstantTimeEquals
+func (s SecretString) Equals(candidate string) bool {
+	return ConstantTimeEquals(string(s), candidate)
+}
+
+func (s SecretString) String() string {
+	if s == "" {
+		return ""
+	}
+	return Redacted
+}
+
+func (s SecretString) GoString() string { return fmt.Sprintf("secrets.SecretString(%q)", s.String()) }
+
+// Format redacts s with every verb, including %q, %x and %#v
+func (s SecretString) Format(f fmt.State, verb rune) {
+	if verb == 'v' && f.Flag('#') {
+		io.WriteString(f, s.GoString())
+		return
+	}
+	io.WriteString(f, s.String())
+}
+
+func (s SecretString) MarshalJSON() ([]byte, error) { return json.Marshal(s.String()) }
+
+func (s SecretString) MarshalYAML() (any, error) { return s.String(), nil }
+
+// ConstantTimeEquals reports whether a and b are equal in a time that depends on neither
+// their contents nor their lengths, for comparing secrets such as API keys, CSRF tokens
+// or client secrets with the value sent by a client.
+func ConstantTimeEquals(a, b string) bool {
+	// comparing digests hides the length of the secret, subtle.ConstantTimeCompare returns
+	// early on a length mismatch
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// Zero overwrites b, e.g. a key copied out of a SecretString, once it is no longer needed.
+// Go strings are immutable and cannot be cleared, so secrets should be copied to byte
+// slices as late as possible and zeroed right after use.
+func Zero(b []byte) {
+	clear(b)
+}
@@ -0,0 +1,90 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const plaintext = "hunter2-signing-key"
+
+func TestSecretStringRedaction(t *testing.T) {
+	s := SecretString(plaintext)
+	wrapped := struct {
+		Name   string
+		Secret SecretString
+	}{"config", s}
+
+	outputs := map[string]string{
+		"%v":     fmt.Sprintf("%v", s),
+		"%s":     fmt.Sprintf("%s", s),
+		"%q":     fmt.Sprintf("%q", s),
+		"%x":     fmt.Sprintf("%x", s),
+		"%#v":    fmt.Sprintf("%#v", s),
+		"struct": fmt.Sprintf("%+v", wrapped),
+		"error":  fmt.Errorf("%w: secret %v", errors.New("failed"), s).Error(),
+	}
+	jsonOut, _ := json.Marshal(wrapped)
+	outputs["json"] = string(jsonOut)
+	yamlOut, _ := yaml.Marshal(wrapped)
+	outputs["yaml"] = string(yamlOut)
+
+	for name, out := range outputs {
+		if strings.Contains(out, plaintext) || !strings.Contains(out, Redacted) {
+			t.Errorf("%s: expected the secret to be redacted, got %q", name, out)
+		}
+	}
+
+	if s.Reveal() != plaintext {
+		t.Errorf("expected Reveal to return the secret")
+	}
+	if got := fmt.Sprint(SecretString("")); got != "" {
+		t.Errorf("expected an empty secret to format as empty, got %q", got)
+	}
+}
+
+func TestSecretStringUnmarshal(t *testing.T) {
+	var cfg struct {
+		Secret SecretString `yaml:"secret"`
+	}
+	if err := yaml.Unmarshal([]byte("secret: "+plaintext), &cfg); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if cfg.Secret.Reveal() != plaintext {
+		t.Errorf("expected %q, got %q", plaintext, cfg.Secret.Reveal())
+	}
+}
+
+func TestConstantTimeEquals(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{plaintext, plaintext, true},
+		{plaintext, plaintext + "x", false},
+		{plaintext, "", false},
+		{"", "", true},
+	}
+	for _, tc := range cases {
+		if got := ConstantTimeEquals(tc.a, tc.b); got != tc.want {
+			t.Errorf("ConstantTimeEquals(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+	if !SecretString(plaintext).Equals(plaintext) {
+		t.Error("expected Equals to match the secret")
+	}
+}
+
+func TestZero(t *testing.T) {
+	key := []byte(plaintext)
+	Zero(key)
+	for _, b := range key {
+		if b != 0 {
+			t.Fatalf("expected key to be zeroed, got %q", key)
+		}
+	}
+}
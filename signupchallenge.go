@@ -0,0 +1,250 @@
+package authify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify/secrets"
+)
+
+// ChallengeProvider challenges the clients creating many users, e.g. the scripts of bots filling
+// the users table of an open registration, see httpapi.WithSignupChallenge. Clients are told the
+// Name of the provider and the challenge to answer, and send their answer in the request header
+// named after the provider, e.g. authify-pow.
+type ChallengeProvider interface {
+	// Name names the challenge and the header carrying answers, e.g. "pow"
+	Name() string
+	// Challenge returns what the client must answer, empty when there is nothing to solve,
+	// e.g. for a CAPTCHA the client shows to its user.
+	Challenge(ctx context.Context) (string, error)
+	// Verify checks the answer of the client at clientIP, failing with ErrChallengeFailed
+	// when it is wrong.
+	Verify(ctx context.Context, answer, clientIP string) error
+}
+
+const (
+	// DefaultProofOfWorkDifficulty is the number of leading zero bits of the proofs of work of
+	// NewProofOfWork, about a million hashes, a fraction of a second for a legitimate client
+	DefaultProofOfWorkDifficulty = 20
+	// MaxProofOfWorkDifficulty bounds the difficulties of NewProofOfWork and SolveProofOfWork
+	MaxProofOfWorkDifficulty = 32
+
+	// proofOfWorkTTL is how long clients have to answer a proof of work challenge
+	proofOfWorkTTL = 5 * time.Minute
+)
+
+// ProofOfWork is a hashcash-style ChallengeProvider. Its challenges are
+// "<difficulty>:<expiry>:<nonce>:<mac>", and answers append ":<counter>" to them, such that the
+// SHA-256 hash of the answer starts with difficulty zero bits, see SolveProofOfWork. Challenges
+// are signed rather than stored, so issuing them costs no memory, and each is accepted once
+// within 5 minutes. The answers seen are kept in memory, so the challenges of an instance are
+// only accepted by that instance.
+type ProofOfWork struct {
+	difficulty int
+	key        []byte
+	now        func() time.Time
+
+	mu   sync.Mutex
+	used map[string]time.Time // expiry by challenge
+}
+
+// NewProofOfWork returns a provider of challenges of difficulty leading zero bits, between 1 and
+// MaxProofOfWorkDifficulty. Every bit doubles the work of clients.
+func NewProofOfWork(difficulty int) (*ProofOfWork, error) {
+	if difficulty < 1 || difficulty > MaxProofOfWorkDifficulty {
+		return nil, fmt.Errorf("proof of work difficulty %d is not between 1 and %d", difficulty, MaxProofOfWorkDifficulty)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &ProofOfWork{difficulty: difficulty, key: key, now: time.Now, used: make(map[string]time.Time)}, nil
+}
+
+// Name is "pow", answers are sent in the authify-pow header
+func (p *ProofOfWork) Name() string {
+	return "pow"
+}
+
+// Challenge returns a new signed challenge
+func (p *ProofOfWork) Challenge(ctx context.Context) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	stamp := fmt.Sprintf("%d:%d:%s", p.difficulty, p.now().Add(proofOfWorkTTL).Unix(), hex.EncodeToString(nonce))
+	return stamp + ":" + p.sign(stamp), nil
+}
+
+// Verify checks that answer solves a challenge of p that has not expired nor been answered before
+func (p *ProofOfWork) Verify(ctx context.Context, answer, clientIP string) error {
+	challenge, counter, ok := cutLast(answer, ":")
+	parts := strings.Split(challenge, ":")
+	if !ok || counter == "" || len(parts) != 4 {
+		return fmt.Errorf("%w: malformed proof of work", ErrChallengeFailed)
+	}
+	stamp := strings.Join(parts[:3], ":")
+	if !hmac.Equal([]byte(p.sign(stamp)), []byte(parts[3])) {
+		return fmt.Errorf("%w: unknown proof of work challenge", ErrChallengeFailed)
+	}
+	difficulty, _ := strconv.Atoi(parts[0])
+	expiry, _ := strconv.ParseInt(parts[1], 10, 64)
+	now := p.now()
+	if now.Unix() >= expiry {
+		return fmt.Errorf("%w: proof of work challenge expired", ErrChallengeFailed)
+	}
+	// challenges issued before the difficulty was raised are not accepted anymore
+	if difficulty < p.difficulty {
+		return fmt.Errorf("%w: proof of work challenge too easy", ErrChallengeFailed)
+	}
+	if proofOfWorkBits(answer) < difficulty {
+		return fmt.Errorf("%w: wrong proof of work", ErrChallengeFailed)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for used, usedExpiry := range p.used {
+		if !now.Before(usedExpiry) {
+			delete(p.used, used)
+		}
+	}
+	if _, ok := p.used[challenge]; ok {
+		return fmt.Errorf("%w: proof of work already used", ErrChallengeFailed)
+	}
+	p.used[challenge] = time.Unix(expiry, 0)
+	return nil
+}
+
+// sign returns the hex encoded HMAC of stamp
+func (p *ProofOfWork) sign(stamp string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(stamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SolveProofOfWork answers a challenge of ProofOfWork, trying counters until the SHA-256 hash of
+// the answer starts with the zero bits the challenge asks for. It stops when ctx is done.
+func SolveProofOfWork(ctx context.Context, challenge string) (string, error) {
+	difficultyStr, _, _ := strings.Cut(challenge, ":")
+	difficulty, err := strconv.Atoi(difficultyStr)
+	if err != nil || difficulty < 1 || difficulty > MaxProofOfWorkDifficulty {
+		return "", fmt.Errorf("unsupported proof of work challenge %q", challenge)
+	}
+	for counter := uint64(0); ; counter++ {
+		if counter%(1<<16) == 0 {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+		}
+		answer := challenge + ":" + strconv.FormatUint(counter, 10)
+		if proofOfWorkBits(answer) >= difficulty {
+			return answer, nil
+		}
+	}
+}
+
+// proofOfWorkBits counts the leading zero bits of the SHA-256 hash of answer
+func proofOfWorkBits(answer string) int {
+	sum := sha256.Sum256([]byte(answer))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// cutLast slices s around the last instance of sep, see strings.Cut
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// CaptchaVerifier is a ChallengeProvider checking the response tokens of CAPTCHA widgets with
+// the verification endpoint of their service, such as the siteverify endpoints of reCAPTCHA,
+// hCaptcha and Turnstile. Clients show the widget to their user, and send the token it yields in
+// the authify-captcha header. The token is POSTed to the endpoint as the "response" form field,
+// along with "secret" and "remoteip", and the endpoint answers {"success": true} for valid ones.
+type CaptchaVerifier struct {
+	verifyURL  string
+	secret     secrets.SecretString
+	httpClient *http.Client
+}
+
+// NewCaptchaVerifier returns a verifier POSTing tokens to verifyURL with secret, the secret key
+// of the site registered with the CAPTCHA service.
+func NewCaptchaVerifier(verifyURL, secret string) *CaptchaVerifier {
+	return &CaptchaVerifier{
+		verifyURL:  verifyURL,
+		secret:     secrets.SecretString(secret),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// WithHTTPClient sends the verifications with hc, a client with a 10 seconds timeout by default.
+func (v *CaptchaVerifier) WithHTTPClient(hc *http.Client) *CaptchaVerifier {
+	v.httpClient = hc
+	return v
+}
+
+// Name is "captcha", tokens are sent in the authify-captcha header
+func (v *CaptchaVerifier) Name() string {
+	return "captcha"
+}
+
+// Challenge is empty, the client gets its challenge from the CAPTCHA service
+func (v *CaptchaVerifier) Challenge(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// Verify asks the verification endpoint about token. Tokens it rejects fail with
+// ErrChallengeFailed, an endpoint that cannot be reached or answers with an error status
+// fails with another error.
+func (v *CaptchaVerifier) Verify(ctx context.Context, token, clientIP string) error {
+	form := url.Values{"secret": {v.secret.Reveal()}, "response": {token}, "remoteip": {clientIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("CAPTCHA verification failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("CAPTCHA verification failed with status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected CAPTCHA verification response: %w", err)
+	}
+	if !result.Success {
+		if len(result.ErrorCodes) > 0 {
+			return fmt.Errorf("%w: CAPTCHA rejected: %s", ErrChallengeFailed, strings.Join(result.ErrorCodes, ", "))
+		}
+		return fmt.Errorf("%w: CAPTCHA rejected", ErrChallengeFailed)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package stores
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AuthEventType is the kind of an AuthEvent.
+type AuthEventType string
+
+const (
+	EventLogin       AuthEventType = "login"
+	EventFailedLogin AuthEventType = "failed_login"
+	EventRefresh     AuthEventType = "refresh"
+	EventLogout      AuthEventType = "logout"
+	EventCreateUser  AuthEventType = "create"
+	// EventServiceToken records a service account obtaining a token, with its client ID as Username
+	EventServiceToken AuthEventType = "service_token"
+)
+
+// AuthEvent is an entry of the audit log. Failed events carry the error code of their
+// failure in Reason, one of the authify.Code* constants, the precise one even when
+// the client was answered with a vaguer one.
+type AuthEvent struct {
+	Type     AuthEventType `json:"type"`
+	Username string        `json:"username"` // empty when a failed refresh does not tell
+	IP       string        `json:"ip"`
+	Time     time.Time     `json:"time"`
+	Success  bool          `json:"success"`
+	Reason   string        `json:"reason,omitempty"`
+	// RequestID correlates the event with the logs of the request it was recorded in, see authify.RequestIDFromContext
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// AuditLogger records authentication events, it is optional and set on Authify with
+// WithAuditLogger. LogEvent must not fail the operation it records, implementations
+// report their own errors, and must be safe for concurrent use.
+type AuditLogger interface {
+	LogEvent(ctx context.Context, event AuthEvent)
+}
+
+// InMemoryAuditLog keeps the latest events in memory, e.g. for tests and single-instance deployments.
+type InMemoryAuditLog struct {
+	mu     sync.RWMutex
+	limit  int
+	events []AuthEvent
+}
+
+// NewInMemoryAuditLog returns a log keeping the latest limit events, every event when limit is 0.
+func NewInMemoryAuditLog(limit int) *InMemoryAuditLog {
+	return &InMemoryAuditLog{limit: limit}
+}
+
+func (l *InMemoryAuditLog) LogEvent(ctx context.Context, event AuthEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+	if l.limit > 0 && len(l.events) > l.limit {
+		l.events = slices.Delete(l.events, 0, len(l.events)-l.limit)
+	}
+}
+
+// LogEvents appends events in order, it never fails.
+func (l *InMemoryAuditLog) LogEvents(ctx context.Context, events []AuthEvent) error {
+	for _, event := range events {
+		l.LogEvent(ctx, event)
+	}
+	return nil
+}
+
+// Events returns the events kept, oldest first.
+func (l *InMemoryAuditLog) Events() []AuthEvent {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return slices.Clone(l.events)
+}
@@ -0,0 +1,338 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow policies of AuditQueueConfig, applied when the queue of an AsyncAuditLog is full
+const (
+	// OverflowBlock makes LogEvent wait for room in the queue, slowing down logins rather than losing events
+	OverflowBlock = "block"
+	// OverflowDropOldest discards the oldest queued event to make room, counted in AuditQueueStats.Dropped
+	OverflowDropOldest = "drop_oldest"
+)
+
+// Defaults of AuditQueueConfig, used for its zero fields
+const (
+	defaultAuditQueueSize     = 10000
+	defaultAuditWorkers       = 1
+	defaultAuditBatchSize     = 100
+	defaultAuditFlushInterval = 500 * time.Millisecond
+	defaultAuditDrainTimeout  = 10 * time.Second
+
+	// a batch the sink failed to write is retried after this, doubled up to maxAuditRetryBackoff
+	auditRetryBackoff    = 100 * time.Millisecond
+	maxAuditRetryBackoff = 5 * time.Second
+)
+
+// AuditQueueConfig controls the AsyncAuditLog the audit log is written through, see NewAsyncAuditLog.
+type AuditQueueConfig struct {
+	// Async writes events in the background, LogEvent only queues them
+	Async bool `yaml:"async"`
+	// QueueSize bounds the events waiting to be written, shared among the workers
+	QueueSize int `yaml:"queue_size"`
+	// Workers is the number of goroutines writing events, the events of a username
+	// are always written by the same one, in the order they were logged
+	Workers int `yaml:"workers"`
+	// BatchSize and FlushInterval bound how many events are written at once, and how long they wait for it
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// Overflow is OverflowBlock, the default, or OverflowDropOldest
+	Overflow string `yaml:"overflow"`
+	// DrainTimeout is how long a shutting down server waits for queued events to be written
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+func (c AuditQueueConfig) withDefaults() AuditQueueConfig {
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultAuditQueueSize
+	}
+	if c.Workers <= 0 {
+		c.Workers = defaultAuditWorkers
+	}
+	c.Workers = min(c.Workers, c.QueueSize)
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultAuditBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultAuditFlushInterval
+	}
+	if c.Overflow == "" {
+		c.Overflow = OverflowBlock
+	}
+	if c.DrainTimeout <= 0 {
+		c.DrainTimeout = defaultAuditDrainTimeout
+	}
+	return c
+}
+
+func (c AuditQueueConfig) validate() error {
+	if c.Overflow != "" && c.Overflow != OverflowBlock && c.Overflow != OverflowDropOldest {
+		return fmt.Errorf("audit_queue.overflow must be %s or %s, got %q", OverflowBlock, OverflowDropOldest, c.Overflow)
+	}
+	if c.QueueSize < 0 || c.Workers < 0 || c.BatchSize < 0 {
+		return fmt.Errorf("audit_queue sizes must not be negative")
+	}
+	return nil
+}
+
+// BatchAuditLogger is implemented by audit logs able to write several events at once, and to
+// report failing to do so, so AsyncAuditLog can retry them.
+type BatchAuditLogger interface {
+	AuditLogger
+	LogEvents(ctx context.Context, events []AuthEvent) error
+}
+
+// AuditQueueStats are the counters of an AsyncAuditLog, e.g. for metrics.
+type AuditQueueStats struct {
+	Depth   int    // events logged but not written yet, including the batches being written
+	Written uint64 // events written by the sink
+	Dropped uint64 // events discarded, by OverflowDropOldest or because shutdown did not wait for them
+}
+
+// AsyncAuditLog queues events in memory and writes them to its sink in batches from
+// background workers, so logins do not wait for the audit log. Batches the sink fails
+// to write are retried until they succeed, or the log is closed.
+type AsyncAuditLog struct {
+	sink   BatchAuditLogger
+	cfg    AuditQueueConfig
+	queues []chan AuthEvent
+	flush  []chan struct{}
+
+	// mu guards closed, so no event is sent once the queues are closed
+	mu     sync.RWMutex
+	closed bool
+	// stop is closed when Close gives up on the queued events
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+
+	// pending counts the events logged and neither written nor dropped,
+	// drained is closed whenever it falls to 0
+	pendingMu sync.Mutex
+	pending   int
+	drained   chan struct{}
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+}
+
+var _ AuditLogger = (*AsyncAuditLog)(nil)
+
+// NewAsyncAuditLog starts the workers of an asynchronous log writing to sink, configured
+// by cfg. Close it on shutdown so the queued events are written.
+func NewAsyncAuditLog(sink BatchAuditLogger, cfg AuditQueueConfig) *AsyncAuditLog {
+	cfg = cfg.withDefaults()
+	l := &AsyncAuditLog{
+		sink:    sink,
+		cfg:     cfg,
+		queues:  make([]chan AuthEvent, cfg.Workers),
+		flush:   make([]chan struct{}, cfg.Workers),
+		stop:    make(chan struct{}),
+		drained: make(chan struct{}),
+	}
+	close(l.drained)
+	for i := range l.queues {
+		l.queues[i] = make(chan AuthEvent, max(cfg.QueueSize/cfg.Workers, 1))
+		l.flush[i] = make(chan struct{}, 1)
+		l.workers.Add(1)
+		go l.work(l.queues[i], l.flush[i])
+	}
+	return l
+}
+
+// LogEvent queues event, waiting for room in the queue or dropping the oldest event
+// when it is full, as set by AuditQueueConfig.Overflow. Events logged once the
+// log is closed are dropped.
+func (l *AsyncAuditLog) LogEvent(ctx context.Context, event AuthEvent) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		log.Printf("dropped %s audit event of %q: audit log is closed", event.Type, event.Username)
+		return
+	}
+
+	l.addPending(1)
+	queue := l.queues[l.shard(event.Username)]
+	if l.cfg.Overflow == OverflowDropOldest {
+		for {
+			select {
+			case queue <- event:
+				return
+			default:
+			}
+			select {
+			case <-queue:
+				l.drop(1)
+			default:
+			}
+		}
+	}
+	select {
+	case queue <- event:
+	case <-l.stop:
+		l.drop(1)
+	}
+}
+
+// shard picks the worker of username, so its events are written in order
+func (l *AsyncAuditLog) shard(username string) int {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return int(h.Sum32() % uint32(len(l.queues)))
+}
+
+// Flush has the workers write every queued event now, and waits until they are
+// written, failing with the error of ctx if it is done before.
+func (l *AsyncAuditLog) Flush(ctx context.Context) error {
+	for _, flush := range l.flush {
+		select {
+		case flush <- struct{}{}:
+		default:
+		}
+	}
+	l.pendingMu.Lock()
+	drained := l.drained
+	l.pendingMu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d audit events not written: %w", l.Stats().Depth, ctx.Err())
+	}
+}
+
+// Close flushes the queued events, waiting for them as long as ctx allows, then stops the
+// workers. Events still not written are dropped, and Close fails with the error of Flush.
+// Events logged afterwards are dropped too.
+func (l *AsyncAuditLog) Close(ctx context.Context) error {
+	err := l.Flush(ctx)
+
+	l.stopOnce.Do(func() { close(l.stop) })
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		for _, queue := range l.queues {
+			close(queue)
+		}
+	}
+	l.mu.Unlock()
+	l.workers.Wait()
+	return err
+}
+
+// DrainTimeout is how long the queue is waited for on shutdown, see AuditQueueConfig.
+func (l *AsyncAuditLog) DrainTimeout() time.Duration {
+	return l.cfg.DrainTimeout
+}
+
+// Stats returns the current counters of the log.
+func (l *AsyncAuditLog) Stats() AuditQueueStats {
+	l.pendingMu.Lock()
+	depth := l.pending
+	l.pendingMu.Unlock()
+	return AuditQueueStats{Depth: depth, Written: l.written.Load(), Dropped: l.dropped.Load()}
+}
+
+func (l *AsyncAuditLog) addPending(n int) {
+	l.pendingMu.Lock()
+	defer l.pendingMu.Unlock()
+	if l.pending == 0 && n > 0 {
+		l.drained = make(chan struct{})
+	}
+	l.pending += n
+	if l.pending == 0 {
+		close(l.drained)
+	}
+}
+
+func (l *AsyncAuditLog) drop(n int) {
+	l.dropped.Add(uint64(n))
+	l.addPending(-n)
+}
+
+// work writes the events of queue in batches, once BatchSize of them are queued,
+// FlushInterval elapsed or a flush is requested, until queue is closed.
+func (l *AsyncAuditLog) work(queue <-chan AuthEvent, flush <-chan struct{}) {
+	defer l.workers.Done()
+	ticker := time.NewTicker(l.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AuthEvent, 0, l.cfg.BatchSize)
+	write := func() {
+		if len(batch) > 0 {
+			l.write(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case event, ok := <-queue:
+			if !ok {
+				write()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= l.cfg.BatchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case <-flush:
+			for drained := false; !drained; {
+				select {
+				case event, ok := <-queue:
+					if !ok {
+						drained = true
+						continue
+					}
+					batch = append(batch, event)
+					if len(batch) >= l.cfg.BatchSize {
+						write()
+					}
+				default:
+					drained = true
+				}
+			}
+			write()
+		}
+	}
+}
+
+// write hands batch to the sink, retrying with backoff until it succeeds,
+// or dropping it once Close gave up on the queued events.
+func (l *AsyncAuditLog) write(batch []AuthEvent) {
+	backoff := auditRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := l.sink.LogEvents(context.Background(), batch)
+		if err == nil {
+			l.written.Add(uint64(len(batch)))
+			l.addPending(-len(batch))
+			return
+		}
+
+		select {
+		case <-l.stop:
+			log.Printf("dropped %d audit events on shutdown: %v", len(batch), err)
+			l.drop(len(batch))
+			return
+		default:
+		}
+		log.Printf("failed to write %d audit events (attempt %d), retrying in %s: %v", len(batch), attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-l.stop:
+			timer.Stop()
+		}
+		backoff = min(backoff*2, maxAuditRetryBackoff)
+	}
+}
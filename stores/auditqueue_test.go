@@ -0,0 +1,177 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink is a BatchAuditLogger keeping the events written, which blocks its first
+// write until released when stalled, and fails every write until failUntil
+type recordingSink struct {
+	InMemoryAuditLog
+	mu        sync.Mutex
+	calls     int
+	started   chan struct{}
+	release   chan struct{}
+	failUntil time.Time
+}
+
+func (s *recordingSink) LogEvents(ctx context.Context, events []AuthEvent) error {
+	s.mu.Lock()
+	s.calls++
+	first := s.calls == 1
+	failing := time.Now().Before(s.failUntil)
+	s.mu.Unlock()
+
+	if first && s.release != nil {
+		close(s.started)
+		<-s.release
+	}
+	if failing {
+		return errors.New("connection refused")
+	}
+	return s.InMemoryAuditLog.LogEvents(ctx, events)
+}
+
+func sequencedEvent(username string, seq int) AuthEvent {
+	return AuthEvent{Type: EventLogin, Username: username, Reason: strconv.Itoa(seq), Success: true}
+}
+
+func TestAsyncAuditLogOrderPerUsername(t *testing.T) {
+	sink := &recordingSink{}
+	audit := NewAsyncAuditLog(sink, AuditQueueConfig{Workers: 4, BatchSize: 7, FlushInterval: 10 * time.Millisecond})
+
+	const perUser = 50
+	users := []string{"alice", "bob", "carol", "dave", "erin"}
+	var wg sync.WaitGroup
+	for _, username := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range perUser {
+				audit.LogEvent(context.Background(), sequencedEvent(username, seq))
+			}
+		}()
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := audit.Close(ctx); err != nil {
+		t.Fatalf("expected every event to be written, got %v", err)
+	}
+
+	next := map[string]int{}
+	for _, event := range sink.Events() {
+		if want := strconv.Itoa(next[event.Username]); event.Reason != want {
+			t.Fatalf("expected event %s of %s, got %s", want, event.Username, event.Reason)
+		}
+		next[event.Username]++
+	}
+	for _, username := range users {
+		if next[username] != perUser {
+			t.Errorf("expected %d events of %s, got %d", perUser, username, next[username])
+		}
+	}
+	if stats := audit.Stats(); stats.Depth != 0 || stats.Dropped != 0 || stats.Written != uint64(perUser*len(users)) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAsyncAuditLogDropOldest(t *testing.T) {
+	sink := &recordingSink{started: make(chan struct{}), release: make(chan struct{})}
+	audit := NewAsyncAuditLog(sink, AuditQueueConfig{QueueSize: 4, BatchSize: 1, Overflow: OverflowDropOldest})
+
+	// the worker holds event 0 in the stalled sink, 1 to 10 go through a queue of 4
+	audit.LogEvent(context.Background(), sequencedEvent("alice", 0))
+	<-sink.started
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for seq := 1; seq <= 10; seq++ {
+			audit.LogEvent(context.Background(), sequencedEvent("alice", seq))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected LogEvent not to block with drop_oldest")
+	}
+
+	if stats := audit.Stats(); stats.Dropped != 6 || stats.Depth != 5 {
+		t.Errorf("expected 6 dropped events and 5 pending, got %+v", stats)
+	}
+
+	close(sink.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := audit.Close(ctx); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	var got []string
+	for _, event := range sink.Events() {
+		got = append(got, event.Reason)
+	}
+	if want := []string{"0", "7", "8", "9", "10"}; !slices.Equal(got, want) {
+		t.Errorf("expected the newest events to be kept, %v, got %v", want, got)
+	}
+}
+
+func TestAsyncAuditLogCloseFlushes(t *testing.T) {
+	tests := []struct {
+		name        string
+		outage      time.Duration
+		drain       time.Duration
+		wantWritten int
+		wantErr     bool
+	}{
+		{"sink recovers within the drain timeout", 300 * time.Millisecond, 5 * time.Second, 20, false},
+		{"sink down past the drain timeout", time.Hour, 200 * time.Millisecond, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{failUntil: time.Now().Add(tt.outage)}
+			audit := NewAsyncAuditLog(sink, AuditQueueConfig{Workers: 2, BatchSize: 3, FlushInterval: time.Hour})
+			for seq := range 20 {
+				audit.LogEvent(context.Background(), sequencedEvent(fmt.Sprintf("user%d", seq%4), seq))
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.drain)
+			defer cancel()
+			err := audit.Close(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if got := len(sink.Events()); got != tt.wantWritten {
+				t.Errorf("expected %d events written, got %d", tt.wantWritten, got)
+			}
+			stats := audit.Stats()
+			if stats.Depth != 0 || stats.Written+stats.Dropped != 20 {
+				t.Errorf("expected every event to be written or dropped once closed, got %+v", stats)
+			}
+
+			audit.LogEvent(context.Background(), sequencedEvent("late", 0))
+			if audit.Stats().Dropped != stats.Dropped+1 {
+				t.Error("expected events logged after Close to be dropped")
+			}
+		})
+	}
+}
+
+func TestAuditQueueConfigValidate(t *testing.T) {
+	cfg := loadTestConfig("users")
+	cfg.AuditQueue.Overflow = "drop_newest"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an unknown overflow policy to be rejected")
+	}
+	cfg.AuditQueue.Overflow = OverflowDropOldest
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected drop_oldest to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package stores
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/blowfish"
+)
+
+// Challenge logins let clients prove they know a user's password without sending it.
+// The server hands out a single-use nonce along with the settings of the user's bcrypt
+// hash (version, cost and salt, i.e. its first 29 characters), the client hashes the
+// password with them, which reproduces the stored hash, and answers with
+//
+//	proof = hex(HMAC-SHA256(key = stored hash, message = nonce))
+//
+// The server computes the same proof from the stored hash. Since the hash is the key,
+// anyone holding a stored hash can answer challenges for its user: with challenge logins
+// enabled, the users table must be protected like plaintext passwords.
+
+const (
+	// bcryptSettingsLength is the length of "$2a$10$" followed by the 22 characters of the salt
+	bcryptSettingsLength = 29
+	bcryptSaltLength     = 22
+	// bcryptMaxPasswordLength is the number of password bytes bcrypt accepts
+	bcryptMaxPasswordLength = 72
+)
+
+var (
+	// bcryptEncoding is the base64 variant of bcrypt hashes, without padding
+	bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+	// bcryptMagic is encrypted by the expensive key setup to produce the digest
+	bcryptMagic = []byte("OrpheanBeholderScryDoubt")
+)
+
+// ProofAuthenticator is implemented by stores supporting challenge logins, see ChallengeProof.
+// PasswordSettings returns the settings of a user's password hash, made-up but stable ones for
+// unknown users so the challenge does not reveal which users exist. GetUserInfoWithProof
+// is GetUserInfo with the proof answering nonce instead of the password.
+type ProofAuthenticator interface {
+	PasswordSettings(userIdentifier string) (string, error)
+	GetUserInfoWithProof(userIdentifier, nonce, proof string) (map[string]any, error)
+}
+
+// NonceStore tracks the nonces of login challenges, the session stores of this package implement it.
+// ConsumeNonce removes a nonce, failing with ErrNonceUsed when it is unknown or was already
+// consumed and with ErrNonceExpired when it is past its expiry, so each nonce answers one login.
+type NonceStore interface {
+	SaveNonce(nonce string, expiresAt time.Time) error
+	ConsumeNonce(nonce string) error
+}
+
+// PasswordSettings returns the part of a bcrypt hash a client needs to hash a password the
+// same way: its version, cost and salt. Other hashes fail with ErrChallengeNotSupported.
+func PasswordSettings(hash string) (string, error) {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil || len(hash) <= bcryptSettingsLength {
+		return "", fmt.Errorf("%w: the password is not a bcrypt hash", ErrChallengeNotSupported)
+	}
+	return hash[:bcryptSettingsLength], nil
+}
+
+// HashWithSettings hashes password with the settings returned by PasswordSettings,
+// which gives back the hash they were taken from when the password is right.
+func HashWithSettings(password, settings string) (string, error) {
+	parts := strings.Split(settings, "$")
+	if len(settings) != bcryptSettingsLength || len(parts) != 4 || parts[0] != "" || !strings.HasPrefix(parts[1], "2") {
+		return "", fmt.Errorf("%w: malformed password settings", ErrChallengeNotSupported)
+	}
+	cost, err := strconv.Atoi(parts[2])
+	if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return "", fmt.Errorf("%w: invalid bcrypt cost %q", ErrChallengeNotSupported, parts[2])
+	}
+	salt, err := bcryptEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid bcrypt salt", ErrChallengeNotSupported)
+	}
+	if len(password) > bcryptMaxPasswordLength {
+		return "", bcrypt.ErrPasswordTooLong
+	}
+
+	// the key is expanded with its trailing NUL, as the C implementations do
+	key := append([]byte(password), 0)
+	c, err := blowfish.NewSaltedCipher(key, salt)
+	if err != nil {
+		return "", err
+	}
+	for i := uint64(0); i < 1<<cost; i++ {
+		blowfish.ExpandKey(key, c)
+		blowfish.ExpandKey(salt, c)
+	}
+
+	digest := make([]byte, len(bcryptMagic))
+	copy(digest, bcryptMagic)
+	for i := 0; i < len(digest); i += blowfish.BlockSize {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(digest[i:i+blowfish.BlockSize], digest[i:i+blowfish.BlockSize])
+		}
+	}
+	// only 23 of the 24 bytes make it into the hash, again like the C implementations
+	return settings + bcryptEncoding.EncodeToString(digest[:23]), nil
+}
+
+// ChallengeProof returns the proof answering nonce for the user whose password hashes to hash.
+func ChallengeProof(hash, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(hash))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkChallengeProof compares proof with the one expected for hash in constant time
+func checkChallengeProof(hash, nonce, proof string) error {
+	if _, err := PasswordSettings(hash); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(ChallengeProof(hash, nonce)), []byte(proof)) != 1 {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// fakeSettingsKey derives the salts handed out for unknown users. It is random per process,
+// so restarts and replicas give unknown users different salts, unlike real ones.
+var fakeSettingsKey = sync.OnceValue(func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+})
+
+// fakePasswordSettings returns bcrypt settings with the given cost and a salt derived from
+// userIdentifier, for challenges of users that do not exist
+func fakePasswordSettings(userIdentifier string, cost int) string {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	mac := hmac.New(sha256.New, fakeSettingsKey())
+	mac.Write([]byte(userIdentifier))
+	salt := bcryptEncoding.EncodeToString(mac.Sum(nil)[:16])
+	return fmt.Sprintf("$2a$%02d$%s", cost, salt[:bcryptSaltLength])
+}
@@ -0,0 +1,96 @@
+package stores
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashWithSettings(t *testing.T) {
+	for _, password := range []string{"", "password123", "pässwörd", strings.Repeat("x", 72)} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), 4)
+		if err != nil {
+			t.Fatalf("failed to hash: %v", err)
+		}
+		settings, err := PasswordSettings(string(hash))
+		if err != nil {
+			t.Fatalf("failed to read settings: %v", err)
+		}
+
+		got, err := HashWithSettings(password, settings)
+		if err != nil {
+			t.Fatalf("failed to hash with settings: %v", err)
+		}
+		if got != string(hash) {
+			t.Errorf("expected %q to hash back to %s, got %s", password, hash, got)
+		}
+		if got, _ := HashWithSettings(password+"!", settings); got == string(hash) && len(password) < 72 {
+			t.Errorf("expected another password to hash differently")
+		}
+	}
+
+	if _, err := PasswordSettings("$argon2id$v=19$m=65536,t=1,p=4$c2FsdA$a2V5"); !errors.Is(err, ErrChallengeNotSupported) {
+		t.Errorf("expected ErrChallengeNotSupported for argon2id hashes, got %v", err)
+	}
+	if _, err := HashWithSettings("password123", "$2a$99$abc"); !errors.Is(err, ErrChallengeNotSupported) {
+		t.Errorf("expected ErrChallengeNotSupported for malformed settings, got %v", err)
+	}
+}
+
+func TestPasswordSettingsOfUnknownUsers(t *testing.T) {
+	store := NewInMemoryUserStore(StoreConfig{
+		BcryptCost: 4,
+		Columns: map[string]ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+		},
+	})
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	alice, err := store.PasswordSettings("alice")
+	if err != nil {
+		t.Fatalf("failed to read settings: %v", err)
+	}
+	bob, err := store.PasswordSettings("bob")
+	if err != nil {
+		t.Fatalf("failed to read settings of an unknown user: %v", err)
+	}
+	// the made-up settings look like real ones and stay the same across challenges
+	if len(bob) != len(alice) || bob[:7] != alice[:7] {
+		t.Errorf("expected settings shaped like %q, got %q", alice, bob)
+	}
+	if again, _ := store.PasswordSettings("bob"); again != bob {
+		t.Errorf("expected stable settings for unknown users, got %q then %q", bob, again)
+	}
+	if _, err := HashWithSettings("password123", bob); err != nil {
+		t.Errorf("expected usable settings for unknown users, got %v", err)
+	}
+}
+
+func TestInMemoryNonces(t *testing.T) {
+	s := NewInMemorySessionStore()
+	if err := s.SaveNonce("fresh", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("failed to save nonce: %v", err)
+	}
+	if err := s.SaveNonce("stale", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("failed to save nonce: %v", err)
+	}
+
+	if err := s.ConsumeNonce("fresh"); err != nil {
+		t.Errorf("expected the nonce to be consumed, got %v", err)
+	}
+	if err := s.ConsumeNonce("fresh"); !errors.Is(err, ErrNonceUsed) {
+		t.Errorf("expected ErrNonceUsed for a replayed nonce, got %v", err)
+	}
+	if err := s.ConsumeNonce("stale"); !errors.Is(err, ErrNonceExpired) {
+		t.Errorf("expected ErrNonceExpired, got %v", err)
+	}
+	if err := s.ConsumeNonce("unknown"); !errors.Is(err, ErrNonceUsed) {
+		t.Errorf("expected ErrNonceUsed for an unknown nonce, got %v", err)
+	}
+}
@@ -1,15 +1,180 @@
 package stores
 
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type Store interface {
-	CreateUser(data map[string]any) error
+	// CreateUser returns the new user: its non-hidden columns, including the defaults and the
+	// values generated for the columns it was created without
+	CreateUser(data map[string]any) (map[string]string, error)
 	GetUserInfo(userIdentifier, password string) (map[string]any, error)
+	// CountUsers returns the number of users, soft-deleted ones excluded
+	CountUsers() (int, error)
 	StoreConfig() StoreConfig
+	// Close releases the resources of the store, such as its database connections.
+	// The store must not be used afterwards.
+	Close() error
+	// GetGlobalNotBefore returns the time before which every token is rejected, the zero time
+	// until SetGlobalNotBefore is first called. Token managers check it on each verification.
+	GetGlobalNotBefore() (time.Time, error)
+	SetGlobalNotBefore(t time.Time) error
+}
+
+// ContextCreator is implemented by stores whose user creation honors the caller's context,
+// e.g. to stop waiting for a saturated password hasher once the request is cancelled.
+type ContextCreator interface {
+	CreateUserContext(ctx context.Context, data map[string]any) (map[string]string, error)
+}
+
+// ReturningCreator is implemented by stores that can report the values of a freshly
+// created user, including the columns generated on creation (uuid and timestamp defaults).
+// Hidden columns are never returned. Store.CreateUser returns the same, the interface is
+// kept for existing callers.
+type ReturningCreator interface {
+	CreateUserReturning(data map[string]any) (map[string]string, error)
+}
+
+// UserDeleter is implemented by stores that can remove users.
+// With soft_delete enabled, deleted users are only hidden, keeping their usernames reserved,
+// and RestoreUser brings them back.
+type UserDeleter interface {
+	DeleteUser(userIdentifier string) error
+	RestoreUser(userIdentifier string) error
+}
+
+// UserDisabler is implemented by stores that can suspend accounts without deleting them.
+// Disabled users fail GetUserInfo with ErrAccountDisabled, even with the right password.
+type UserDisabler interface {
+	SetUserDisabled(userIdentifier string, disabled bool) error
+	IsUserDisabled(userIdentifier string) (bool, error)
+}
+
+// UserGetter is implemented by stores that can look a user up without checking its password.
+// Only non-hidden columns are returned.
+type UserGetter interface {
+	GetUserByUsername(username string) (map[string]string, error)
+}
+
+// ExistenceChecker is implemented by stores that can tell whether a value is taken, e.g. for
+// signup forms to report a taken username early. Only columns marked unique or primary_key
+// can be checked, others fail with ErrColumnNotQueryable so the check cannot reveal arbitrary
+// user data. Soft-deleted users count, as their values still cannot be reused.
+type ExistenceChecker interface {
+	UserExists(ctx context.Context, column, value string) (bool, error)
+}
+
+// UserIterator is implemented by stores that can go through all their users without loading them
+// at once, e.g. to export tables of millions of users. Users come in the order of their primary
+// key, with their non-hidden columns, soft-deleted ones left out. ListUsers returns the page of
+// at most limit users following the primary key after, "" for the first page, and the key to
+// pass for the next page, "" after the last one. IterateUsers calls fn for every user, fetching
+// batchSize users at a time, and stops at the first error fn returns, which it returns.
+type UserIterator interface {
+	ListUsers(ctx context.Context, after string, limit int) (users []map[string]string, next string, err error)
+	IterateUsers(ctx context.Context, batchSize int, fn func(user map[string]string) error) error
+}
+
+// ReadinessChecker is implemented by stores that can tell whether they are able to serve
+// requests, failing with ErrStoreUnavailable when they are not, e.g. for readiness probes.
+type ReadinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// FieldUpdater is implemented by stores that let users change the columns marked editable
+// of their own profile. Other columns fail with ErrFieldNotEditable, and values taken by
+// another user in a unique column with ErrFieldConflict, both in a FieldError naming the column.
+type FieldUpdater interface {
+	UpdateUserFields(ctx context.Context, username string, fields map[string]string) error
+}
+
+// RoleChanger is implemented by stores that can change the role of a user alone,
+// checking the new role against AllowedRoles.
+type RoleChanger interface {
+	ChangeRole(userIdentifier, newRole string) error
+}
+
+// UserUpdater is implemented by stores that can modify existing users.
+// Password columns present in data are hashed before being persisted.
+type UserUpdater interface {
+	UpdateUser(userIdentifier string, data map[string]any) error
+}
+
+// SchemaDiffer is implemented by stores that can report how their table drifted from the
+// store config, as the DDL statements an operator would run to reconcile them.
+type SchemaDiffer interface {
+	DiffSchema() ([]string, error)
+}
+
+// SchemaVerifier is implemented by stores that can check their table against the store config
+// without changing it, e.g. to validate a deployment before it starts serving.
+type SchemaVerifier interface {
+	VerifySchema(ctx context.Context) (SchemaReport, error)
+}
+
+// TokenVersioner is implemented by stores keeping a token version per user, with token_versions
+// enabled in the store config. Tokens carry the version of their user when issued, bumping it
+// invalidates every token issued before. Changing a password through UpdateUser bumps it too.
+// Stores without token_versions fail with ErrTokenVersionsDisabled.
+type TokenVersioner interface {
+	TokenVersion(userIdentifier string) (int, error)
+	BumpTokenVersion(userIdentifier string) error
+}
+
+// PasswordHistorian is implemented by stores that can replace a password while refusing the
+// last ones of the user, as many as password_history in the store config, with ErrPasswordReused.
+// The hashes of previous passwords are kept beside the users, older ones are pruned. Without
+// password_history, ReplacePassword only sets the password, like UpdateUser.
+type PasswordHistorian interface {
+	ReplacePassword(userIdentifier, newPassword string) error
 }
 
 type StoreConfig struct {
-	Name       string                  `yaml:"name"`
-	AutoCreate bool                    `yaml:"auto_create"`
-	Columns    map[string]ColumnConfig `yaml:"columns"`
+	Name           string `yaml:"name"`
+	AutoCreate     bool   `yaml:"auto_create"`
+	AutoMigrate    bool   `yaml:"auto_migrate"`    // add missing columns on startup, see NewAuthifyDBFromConn
+	PasswordHasher string `yaml:"password_hasher"` // bcrypt | argon2id
+	BcryptCost     int    `yaml:"bcrypt_cost"`
+	SoftDelete     bool   `yaml:"soft_delete"`    // keep deleted users, marked by a deleted_at timestamp
+	Sessions       bool   `yaml:"sessions"`       // record logins in a "<name>_sessions" table
+	TokenVersions  bool   `yaml:"token_versions"` // keep a "token_version" per user, see TokenVersioner
+	AuditLog       bool   `yaml:"audit_log"`      // record authentication events in the AuditTable table
+	// AuditQueue controls writing the audit log in the background, see AsyncAuditLog
+	AuditQueue AuditQueueConfig `yaml:"audit_queue"`
+	// ServiceAccounts keeps service accounts in a "<name>_service_accounts" table, see ServiceAccountStore
+	ServiceAccounts bool `yaml:"service_accounts"`
+	// RefreshRotation rotates refresh tokens on every refresh, recording them in a
+	// "<name>_sessions_families" table, see TokenFamilyStore
+	RefreshRotation bool `yaml:"refresh_rotation"`
+	// PasswordHistory is how many of a user's last passwords, the current one included,
+	// ReplacePassword refuses to reuse, 0 keeps no history, see PasswordHistorian
+	PasswordHistory int `yaml:"password_history"`
+
+	// MaxInputBytes bounds the total bytes of the fields written or logged in with at once,
+	// DefaultMaxInputBytes when 0, see ValidateInput
+	MaxInputBytes int `yaml:"max_input_bytes"`
+
+	// Optional limits on concurrent password hashing, see LimitedHasher
+	HashConcurrency int                     `yaml:"hash_concurrency"`
+	HashQueue       int                     `yaml:"hash_queue"`
+	HashTimeout     time.Duration           `yaml:"hash_timeout"`
+	Columns         map[string]ColumnConfig `yaml:"columns"`
+
+	// Retry controls how the postgres store retries transient failures
+	Retry RetryConfig `yaml:"retry"`
+
+	// RolePermissions maps a role name to the scopes granted to users holding it
+	RolePermissions map[string][]string `yaml:"role_permissions"`
+	// AllowedRoles restricts the roles users can be created with or given by UpdateUser and
+	// ChangeRole, any role is accepted when empty
+	AllowedRoles []string `yaml:"allowed_roles"`
 }
 
 type ColumnConfig struct {
@@ -21,8 +186,30 @@ type ColumnConfig struct {
 	Hidden     bool   `yaml:"hidden"`
 	IsPassword bool   `yaml:"is_password"`
 	JWTClaim   string `yaml:"jwt_claim"`
+
+	// Encrypted seals the claims taken from the column inside tokens, see token.JWTManager.WithClaimsEncryption
+	Encrypted bool `yaml:"encrypted"`
+
+	// IsRole marks the column looked up in RolePermissions, a column named "role" is used otherwise
+	IsRole bool `yaml:"is_role"`
+	// IsPermissions marks a column holding scopes granted directly to the user (space or comma separated)
+	IsPermissions bool `yaml:"is_permissions"`
+	// IsDisabled marks the bool column suspending an account, a dedicated "disabled" column is used otherwise
+	IsDisabled bool `yaml:"is_disabled"`
+	// Generator fills the column when a user is created without it, one of the Generator constants
+	Generator string `yaml:"generator"`
+	// MaxLength bounds the bytes of the column's values, text columns default to DefaultMaxLength, see ValidateInput
+	MaxLength int `yaml:"max_length"`
+	// Editable lets users change the column of their own profile, see FieldUpdater
+	Editable bool `yaml:"editable"`
 }
 
+// disabledColumn is the column managed by the store when no column is marked is_disabled
+const disabledColumn = "disabled"
+
+// tokenVersionColumn is the column managed by the store with token_versions enabled
+const tokenVersionColumn = "token_version"
+
 var allowedTypes = map[string]string{
 	"text":      "TEXT",
 	"int":       "INTEGER",
@@ -32,6 +219,144 @@ var allowedTypes = map[string]string{
 	"timestamp": "TIMESTAMP",
 }
 
+// Generators of ColumnConfig.Generator. UUIDs go in uuid or text columns, now in timestamp or
+// text columns and sequence, which numbers users from 1, in int columns.
+const (
+	GeneratorUUIDv4   = "uuid_v4"
+	GeneratorUUIDv7   = "uuid_v7"
+	GeneratorNow      = "now"
+	GeneratorSequence = "sequence"
+)
+
+// generatorTypes lists the column types each generator can fill
+var generatorTypes = map[string][]string{
+	GeneratorUUIDv4:   {"uuid", "text"},
+	GeneratorUUIDv7:   {"uuid", "text"},
+	GeneratorNow:      {"timestamp", "text"},
+	GeneratorSequence: {"int"},
+}
+
+// generate returns a value of a uuid_v4, uuid_v7 or now generator, sequences are numbered by the stores
+func (cfg ColumnConfig) generate() (any, error) {
+	switch cfg.Generator {
+	case GeneratorUUIDv4:
+		return newUUID()
+	case GeneratorUUIDv7:
+		return newUUIDv7()
+	case GeneratorNow:
+		return time.Now().UTC(), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrInvalidGenerator, cfg.Generator)
+}
+
+// generatorDefault returns the DDL letting postgres fill a generated column on its own, or an
+// empty string when postgres has no native equivalent of the generator, as for uuid_v7
+func (cfg ColumnConfig) generatorDefault() string {
+	switch cfg.Generator {
+	case GeneratorUUIDv4:
+		return " DEFAULT " + DefaultGenerateUUID
+	case GeneratorNow:
+		return " DEFAULT " + DefaultCurrentTimestamp
+	case GeneratorSequence:
+		return " GENERATED BY DEFAULT AS IDENTITY"
+	}
+	return ""
+}
+
+// Column defaults evaluated by the database on insert rather than stored as literals
+const (
+	DefaultGenerateUUID     = "gen_random_uuid()"
+	DefaultCurrentTimestamp = "now()"
+)
+
+// isGeneratedDefault reports whether a column default is a database function call
+func (cfg ColumnConfig) isGeneratedDefault() bool {
+	switch strings.ToLower(cfg.Default) {
+	case DefaultGenerateUUID, DefaultCurrentTimestamp, "current_timestamp":
+		return true
+	}
+	return false
+}
+
+// generateDefault synthesizes the value postgres would produce for a generated default,
+// used by stores without a database behind them.
+func (cfg ColumnConfig) generateDefault() (string, error) {
+	if strings.ToLower(cfg.Default) == DefaultGenerateUUID {
+		return newUUID()
+	}
+	return time.Now().UTC().Format(time.RFC3339Nano), nil
+}
+
+// newUUID returns a random (version 4) UUID in its canonical string form
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return formatUUID(b), nil
+}
+
+// newUUIDv7 returns a time-ordered (version 7) UUID, its first 48 bits are the current unix
+// time in milliseconds, so the ids of users sort like their creation
+func newUUIDv7() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	ms := uint64(time.Now().UnixMilli())
+	for i := range 6 {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	b[6] = (b[6] & 0x0f) | 0x70
+	b[8] = (b[8] & 0x3f) | 0x80
+	return formatUUID(b), nil
+}
+
+func formatUUID(b [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// visibleColumns returns the sorted names of the columns that are not hidden, the ones
+// CreateUser returns
+func (cfg StoreConfig) visibleColumns() []string {
+	var names []string
+	for name, col := range cfg.Columns {
+		if !col.Hidden {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// visibleFields returns the fields of user in columns that are not hidden
+func (cfg StoreConfig) visibleFields(user map[string]string) map[string]string {
+	fields := make(map[string]string, len(user))
+	for name, val := range user {
+		if col, ok := cfg.Columns[name]; ok && !col.Hidden {
+			fields[name] = val
+		}
+	}
+	return fields
+}
+
+// IdentifierColumn returns the name of the primary key column, which identifies users.
+func (cfg StoreConfig) IdentifierColumn() string {
+	return cfg.getIdentifierColumnName()
+}
+
+// checkExistsColumn reports whether column can be checked by ExistenceChecker: a unique or
+// primary key column, neither hidden nor a password
+func (cfg StoreConfig) checkExistsColumn(column string) error {
+	col, ok := cfg.Columns[column]
+	if !ok || !(col.Unique || col.PrimaryKey) || col.Hidden || col.IsPassword {
+		return fmt.Errorf("%w: %q", ErrColumnNotQueryable, column)
+	}
+	return nil
+}
+
 func (cfg StoreConfig) getIdentifierColumnName() string {
 	for name, cfg := range cfg.Columns {
 		if cfg.PrimaryKey {
@@ -49,3 +374,198 @@ func (cfg StoreConfig) getPasswordColumnName() string {
 	}
 	return ""
 }
+
+func (cfg StoreConfig) getRoleColumnName() string {
+	for name, cfg := range cfg.Columns {
+		if cfg.IsRole {
+			return name
+		}
+	}
+	return "role"
+}
+
+// validateRole checks that the store has a role column and that role may be assigned
+func (cfg StoreConfig) validateRole(role string) error {
+	column := cfg.getRoleColumnName()
+	if _, ok := cfg.Columns[column]; !ok {
+		return fmt.Errorf("%w: no %s column configured", ErrRolesNotSupported, column)
+	}
+	if role == "" || (len(cfg.AllowedRoles) > 0 && !slices.Contains(cfg.AllowedRoles, role)) {
+		return fmt.Errorf("%w: %q", ErrInvalidRole, role)
+	}
+	return nil
+}
+
+// checkRoleField validates the role column of user data passed to CreateUser or UpdateUser,
+// when present, against AllowedRoles. Data without a role is left to the column default.
+func (cfg StoreConfig) checkRoleField(data map[string]any) error {
+	if len(cfg.AllowedRoles) == 0 {
+		return nil
+	}
+	val, ok := data[cfg.getRoleColumnName()]
+	if !ok {
+		return nil
+	}
+	role, _ := val.(string)
+	if !slices.Contains(cfg.AllowedRoles, role) {
+		return fmt.Errorf("%w: %q", ErrInvalidRole, role)
+	}
+	return nil
+}
+
+// Validate checks the consistency of the config, so mistakes surface when it is loaded
+// rather than on the first write. Column generators must be known and fit the column type,
+// max_length must fit the password hasher, protected columns cannot be editable, and the default role must be one of AllowedRoles.
+func (cfg StoreConfig) Validate() error {
+	if cfg.PasswordHistory < 0 {
+		return fmt.Errorf("password_history must not be negative, got %d", cfg.PasswordHistory)
+	}
+	if cfg.MaxInputBytes < 0 {
+		return fmt.Errorf("max_input_bytes must not be negative, got %d", cfg.MaxInputBytes)
+	}
+	if err := cfg.AuditQueue.validate(); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Columns)) {
+		col := cfg.Columns[name]
+		if err := cfg.validateMaxLength(name, col); err != nil {
+			return err
+		}
+		if col.Editable && cfg.isProtectedColumn(name, col) {
+			return fmt.Errorf("%w: column %s is hidden, a primary key or holds credentials, roles or permissions, it cannot be editable", ErrFieldNotEditable, name)
+		}
+		if col.Generator == "" {
+			continue
+		}
+		types, ok := generatorTypes[col.Generator]
+		if !ok {
+			return fmt.Errorf("%w: %q for column %s", ErrInvalidGenerator, col.Generator, name)
+		}
+		if !slices.Contains(types, col.Type) {
+			return fmt.Errorf("%w: %s cannot fill the %s column %s", ErrInvalidGenerator, col.Generator, col.Type, name)
+		}
+	}
+
+	if len(cfg.AllowedRoles) == 0 {
+		return nil
+	}
+	col, ok := cfg.Columns[cfg.getRoleColumnName()]
+	if ok && col.Default != "" && !slices.Contains(cfg.AllowedRoles, col.Default) {
+		return fmt.Errorf("%w: default role %q is not in allowed_roles", ErrInvalidRole, col.Default)
+	}
+	return nil
+}
+
+// getDisabledColumnName returns the column flagging disabled users, and whether it is one of the configured columns
+func (cfg StoreConfig) getDisabledColumnName() (string, bool) {
+	for name, cfg := range cfg.Columns {
+		if cfg.IsDisabled {
+			return name, true
+		}
+	}
+	return disabledColumn, false
+}
+
+// isDisabledValue interprets a disabled column value, as decoded by pgx or stored as text
+func isDisabledValue(val any) bool {
+	switch v := val.(type) {
+	case bool:
+		return v
+	case string:
+		disabled, _ := strconv.ParseBool(v)
+		return disabled
+	}
+	return false
+}
+
+// tokenVersionValue interprets a token_version column value, as decoded by pgx or stored as text
+func tokenVersionValue(val any) int {
+	switch v := val.(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case string:
+		version, _ := strconv.Atoi(v)
+		return version
+	}
+	return 0
+}
+
+// ProfileFields renames the columns of a user returned by GetUserByUsername after their
+// jwt_claim, so profiles use the same field names as tokens. Hidden columns are dropped.
+func (cfg StoreConfig) ProfileFields(user map[string]string) map[string]string {
+	fields := make(map[string]string, len(user))
+	for name, val := range user {
+		col, ok := cfg.Columns[name]
+		if !ok || col.Hidden {
+			continue
+		}
+		if col.JWTClaim != "" {
+			name = col.JWTClaim
+		}
+		fields[name] = val
+	}
+	return fields
+}
+
+// RoleColumn returns the column holding the role of users, see ColumnConfig.IsRole
+func (cfg StoreConfig) RoleColumn() string {
+	return cfg.getRoleColumnName()
+}
+
+// PasswordColumn returns the column holding the password hash of users
+func (cfg StoreConfig) PasswordColumn() string {
+	return cfg.getPasswordColumnName()
+}
+
+// Role returns the role of a user, given the fields returned by GetUserInfo,
+// or an empty string when the user has none.
+func (cfg StoreConfig) Role(user map[string]any) string {
+	role, _ := user[cfg.getRoleColumnName()].(string)
+	return role
+}
+
+// Scopes returns the permissions granted to a user, given the fields returned by GetUserInfo.
+// It combines the scopes mapped to the user's role in RolePermissions with the ones
+// listed in the permissions column, without duplicates and in that order.
+func (cfg StoreConfig) Scopes(user map[string]any) []string {
+	var scopes []string
+	seen := make(map[string]bool)
+	add := func(scope string) {
+		if scope != "" && !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	for _, scope := range cfg.RolePermissions[cfg.Role(user)] {
+		add(scope)
+	}
+
+	for name, col := range cfg.Columns {
+		if !col.IsPermissions {
+			continue
+		}
+		switch val := user[name].(type) {
+		case string:
+			for _, scope := range strings.FieldsFunc(val, func(r rune) bool { return r == ' ' || r == ',' }) {
+				add(scope)
+			}
+		case []string:
+			for _, scope := range val {
+				add(scope)
+			}
+		case []any:
+			for _, scope := range val {
+				if s, ok := scope.(string); ok {
+					add(s)
+				}
+			}
+		}
+	}
+
+	return scopes
+}
@@ -0,0 +1,239 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Defaults of the ConnectOptions, used for their zero values. Without WithStartupRetries,
+// NewAuthifyDB tries once, as it always did.
+const (
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultRetryInterval  = time.Second
+
+	// maxRetryInterval caps the wait between two startup attempts, doubled after every one
+	maxRetryInterval = 30 * time.Second
+)
+
+// connectOptions controls how NewAuthifyDB and NewLazyAuthifyDB reach the database.
+type connectOptions struct {
+	timeout       time.Duration
+	retries       int
+	retryInterval time.Duration
+}
+
+// ConnectOption customizes how the database is reached by NewAuthifyDB and NewLazyAuthifyDB.
+type ConnectOption func(*connectOptions)
+
+// WithConnectTimeout bounds each attempt to reach the database, DefaultConnectTimeout by default.
+func WithConnectTimeout(d time.Duration) ConnectOption {
+	return func(o *connectOptions) {
+		o.timeout = d
+	}
+}
+
+// WithStartupRetries lets NewAuthifyDB retry n times before giving up, for servers
+// started before their database, as happens in docker-compose and Kubernetes.
+func WithStartupRetries(n int) ConnectOption {
+	return func(o *connectOptions) {
+		o.retries = n
+	}
+}
+
+// WithRetryInterval sets the wait before the first retry, doubled after every further one
+// up to 30s, DefaultRetryInterval by default. Lazy stores wait as long between two attempts.
+func WithRetryInterval(d time.Duration) ConnectOption {
+	return func(o *connectOptions) {
+		o.retryInterval = d
+	}
+}
+
+func newConnectOptions(opts []ConnectOption) connectOptions {
+	o := connectOptions{timeout: DefaultConnectTimeout, retryInterval: DefaultRetryInterval}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.timeout <= 0 {
+		o.timeout = DefaultConnectTimeout
+	}
+	if o.retryInterval <= 0 {
+		o.retryInterval = DefaultRetryInterval
+	}
+	o.retries = max(o.retries, 0)
+	return o
+}
+
+// connectPool opens a pool on connString and pings the database, retrying as set by o.
+// It fails with ErrStoreUnavailable once the attempts are exhausted, or ctx is done.
+func connectPool(ctx context.Context, connString string, o connectOptions) (*pgxpool.Pool, error) {
+	poolCfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+
+	interval := o.retryInterval
+	for attempt := 1; ; attempt++ {
+		pool, err := pingPool(ctx, poolCfg, o.timeout)
+		if err == nil {
+			return pool, nil
+		}
+		if attempt > o.retries || ctx.Err() != nil {
+			return nil, unavailableAfter(attempt, err)
+		}
+
+		log.Printf("Unable to connect to database (attempt %d of %d), retrying in %s: %v", attempt, o.retries+1, interval, err)
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, unavailableAfter(attempt, err)
+		case <-timer.C:
+		}
+		interval = min(interval*2, maxRetryInterval)
+	}
+}
+
+// unavailableAfter wraps ErrStoreUnavailable, not err, so the failure is not retried again as transient
+func unavailableAfter(attempts int, err error) error {
+	if attempts == 1 {
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	return fmt.Errorf("%w after %d attempts: %v", ErrStoreUnavailable, attempts, err)
+}
+
+// pingPool opens a pool and makes sure the database is reachable now, since pools connect lazily
+func pingPool(ctx context.Context, poolCfg *pgxpool.Config, timeout time.Duration) (*pgxpool.Pool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg.Copy())
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// NewLazyAuthifyDB returns a store without reaching the database, which is connected to,
+// and has its tables created, on first use. Until then, operations fail with ErrStoreUnavailable,
+// and attempts are made at most once per retry interval, so an absent database is not hammered.
+// Stores sharing the connection, such as NewSessionStore, create their tables when built,
+// so build them once the store is Ready.
+func NewLazyAuthifyDB(connString string, cfg StoreConfig, opts ...ConnectOption) (*AuthifyDB, error) {
+	if _, err := pgxpool.ParseConfig(connString); err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	o := newConnectOptions(opts)
+	o.retries = 0
+
+	lazy := &lazyConn{interval: o.retryInterval}
+	lazy.connect = func(ctx context.Context) (DBConn, error) {
+		pool, err := connectPool(ctx, connString, o)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := NewAuthifyDBFromConn(pool, cfg); err != nil {
+			pool.Close()
+			return nil, err
+		}
+		log.Println("Connection with database established")
+		return pool, nil
+	}
+
+	// the schema is prepared by connect, once the database is reached
+	lazyCfg := cfg
+	lazyCfg.AutoCreate, lazyCfg.AutoMigrate = false, false
+	db, err := NewAuthifyDBFromConn(lazy, lazyCfg)
+	if err != nil {
+		return nil, err
+	}
+	db.storeCfg = cfg
+	return db, nil
+}
+
+// lazyConn connects on the first statement, see NewLazyAuthifyDB
+type lazyConn struct {
+	mu          sync.RWMutex
+	conn        DBConn
+	connect     func(ctx context.Context) (DBConn, error)
+	interval    time.Duration
+	lastAttempt time.Time
+	lastErr     error
+}
+
+// get returns the connection, establishing it unless the last attempt is too recent
+func (l *lazyConn) get(ctx context.Context) (DBConn, error) {
+	l.mu.RLock()
+	conn := l.conn
+	l.mu.RUnlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		return l.conn, nil
+	}
+	if !l.lastAttempt.IsZero() && time.Since(l.lastAttempt) < l.interval {
+		return nil, l.lastErr
+	}
+	l.lastAttempt = time.Now()
+	conn, err := l.connect(ctx)
+	if err != nil {
+		// the cause is not wrapped, so retryConn does not retry what the interval guards against
+		if !errors.Is(err, ErrStoreUnavailable) {
+			err = unavailableAfter(1, err)
+		}
+		l.lastErr = err
+		return nil, err
+	}
+	l.conn = conn
+	return conn, nil
+}
+
+func (l *lazyConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	conn, err := l.get(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return conn.Exec(ctx, sql, args...)
+}
+
+func (l *lazyConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	conn, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Query(ctx, sql, args...)
+}
+
+// Close closes the pool, if it was established
+func (l *lazyConn) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if pool, ok := l.conn.(interface{ Close() }); ok {
+		pool.Close()
+	}
+}
+
+// Ready reports whether the database answers, failing with ErrStoreUnavailable when it does not.
+// Lazy stores are connected by their first call, see NewLazyAuthifyDB.
+func (db *AuthifyDB) Ready(ctx context.Context) error {
+	_, err := db.retry.current().Exec(ctx, "SELECT 1")
+	if err != nil && !errors.Is(err, ErrStoreUnavailable) {
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	return err
+}
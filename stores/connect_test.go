@@ -0,0 +1,165 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// closedAddr returns an address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func testConnString(addr string) string {
+	return fmt.Sprintf("postgres://authify@%s/authify?sslmode=disable", addr)
+}
+
+// listenPostgresAfter starts a fake postgres server on addr once delay elapsed, answering
+// the startup handshake and every simple query, as the database of a slow docker-compose would
+func listenPostgresAfter(t *testing.T, addr string, delay time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-time.After(delay):
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("failed to listen on %s: %v", addr, err)
+			return
+		}
+		go func() {
+			<-done
+			ln.Close()
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go servePostgres(conn)
+		}
+	}()
+}
+
+func servePostgres(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+	if _, err := backend.ReceiveStartupMessage(); err != nil {
+		return
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		switch msg.(type) {
+		case *pgproto3.Query:
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			if err := backend.Flush(); err != nil {
+				return
+			}
+		case *pgproto3.Terminate:
+			return
+		}
+	}
+}
+
+func TestNewAuthifyDBStartupRetries(t *testing.T) {
+	start := time.Now()
+	_, err := NewAuthifyDB(testConnString(closedAddr(t)), loadTestConfig("users"),
+		WithConnectTimeout(time.Second), WithStartupRetries(3), WithRetryInterval(20*time.Millisecond))
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("expected ErrStoreUnavailable, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "after 4 attempts") {
+		t.Errorf("expected the first try and 3 retries, got %v", err)
+	}
+	// the interval doubles after every retry: 20ms, 40ms, then 80ms
+	if elapsed < 140*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("expected the retries to back off for about 140ms, took %s", elapsed)
+	}
+}
+
+func TestNewAuthifyDBWithoutRetries(t *testing.T) {
+	_, err := NewAuthifyDB(testConnString(closedAddr(t)), loadTestConfig("users"))
+	if !errors.Is(err, ErrStoreUnavailable) || strings.Contains(err.Error(), "attempts") {
+		t.Errorf("expected a single attempt failing with ErrStoreUnavailable, got %v", err)
+	}
+}
+
+func TestNewAuthifyDBDelayedDatabase(t *testing.T) {
+	addr := closedAddr(t)
+	listenPostgresAfter(t, addr, 200*time.Millisecond)
+
+	db, err := NewAuthifyDB(testConnString(addr), loadTestConfig("users"),
+		WithStartupRetries(10), WithRetryInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("expected the store to connect once the database is up, got %v", err)
+	}
+	defer db.Close()
+	if err := db.Ready(context.Background()); err != nil {
+		t.Errorf("expected the store to be ready, got %v", err)
+	}
+}
+
+func TestNewLazyAuthifyDB(t *testing.T) {
+	addr := closedAddr(t)
+	start := time.Now()
+	db, err := NewLazyAuthifyDB(testConnString(addr), loadTestConfig("users"),
+		WithConnectTimeout(time.Second), WithRetryInterval(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create lazy store: %v", err)
+	}
+	defer db.Close()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected the lazy store to return at once, took %s", elapsed)
+	}
+
+	if err := db.Ready(context.Background()); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected ErrStoreUnavailable before the database is up, got %v", err)
+	}
+	if _, err := db.GetUserByUsername("alice"); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("expected operations to fail with ErrStoreUnavailable, got %v", err)
+	}
+
+	listenPostgresAfter(t, addr, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Ready(context.Background()) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lazy store to connect once the database is up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNewLazyAuthifyDBInvalidConnString(t *testing.T) {
+	if _, err := NewLazyAuthifyDB("postgres://%zz", loadTestConfig("users")); err == nil {
+		t.Error("expected an invalid connection string to be rejected at once")
+	}
+}
@@ -0,0 +1,95 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// countConn answers every query with a single count, recording the statements it ran
+type countConn struct {
+	count   int64
+	queries []string
+}
+
+func (c *countConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, errors.New("unexpected statement: " + sql)
+}
+
+func (c *countConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	c.queries = append(c.queries, sql)
+	return &countRows{count: c.count}, nil
+}
+
+type countRows struct {
+	count int64
+	read  bool
+}
+
+func (r *countRows) Close()                        {}
+func (r *countRows) Err() error                    { return nil }
+func (r *countRows) CommandTag() pgconn.CommandTag { return pgconn.CommandTag{} }
+func (r *countRows) RawValues() [][]byte           { return nil }
+func (r *countRows) Conn() *pgx.Conn               { return nil }
+func (r *countRows) Values() ([]any, error)        { return []any{r.count}, nil }
+
+func (r *countRows) FieldDescriptions() []pgconn.FieldDescription {
+	return []pgconn.FieldDescription{{Name: "count"}}
+}
+
+func (r *countRows) Next() bool {
+	if r.read {
+		return false
+	}
+	r.read = true
+	return true
+}
+
+func (r *countRows) Scan(dest ...any) error {
+	*dest[0].(*int64) = r.count
+	return nil
+}
+
+func TestCountUsers(t *testing.T) {
+	cfg := StoreConfig{
+		Name:       "users",
+		BcryptCost: 4,
+		Columns: map[string]ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, IsPassword: true},
+		},
+	}
+
+	mem := NewInMemoryUserStore(cfg)
+	for _, username := range []string{"alice", "bob"} {
+		if _, err := mem.CreateUser(map[string]any{"username": username, "password": "password123"}); err != nil {
+			t.Fatalf("failed to create %s: %v", username, err)
+		}
+	}
+	if count, err := mem.CountUsers(); err != nil || count != 2 {
+		t.Errorf("expected 2 users in memory, got %d (%v)", count, err)
+	}
+
+	for softDelete, want := range map[bool]string{
+		false: `SELECT COUNT(*) FROM "users"`,
+		true:  `SELECT COUNT(*) FROM "users" WHERE "deleted_at" IS NULL`,
+	} {
+		cfg.SoftDelete = softDelete
+		conn := &countConn{count: 42}
+		db, err := NewAuthifyDBFromConn(conn, cfg)
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+
+		count, err := db.CountUsers()
+		if err != nil || count != 42 {
+			t.Errorf("expected 42 users, got %d (%v)", count, err)
+		}
+		if len(conn.queries) != 1 || conn.queries[0] != want {
+			t.Errorf("soft_delete=%v: expected query %q, got %q", softDelete, want, conn.queries)
+		}
+	}
+}
@@ -9,7 +9,62 @@ var (
 	ErrUserExists      = errors.New("user already exists")
 	ErrUserNotFound    = errors.New("user not found")
 	ErrInvalidPassword = errors.New("invalid password for user")
+	ErrMissingField    = errors.New("missing required field")
+	ErrAccountDisabled = errors.New("account is disabled")
+	ErrFieldTooLong    = errors.New("field value is too long")
+	ErrInvalidRole     = errors.New("role is not allowed")
+	ErrPasswordReused  = errors.New("password was used recently, choose another one")
+
+	// ErrInvalidFieldValue is returned by StoreConfig.ValidateInput for values that are not valid UTF-8 or hold NUL bytes
+	ErrInvalidFieldValue = errors.New("field value must be valid UTF-8 without NUL bytes")
+
+	// ErrInvalidGenerator is returned by StoreConfig.Validate for unknown generators and ones that cannot fill their column
+	ErrInvalidGenerator = errors.New("invalid column generator")
+
+	// ErrFieldNotEditable and ErrFieldConflict are returned by FieldUpdater, in a FieldError naming the column
+	ErrFieldNotEditable = errors.New("field cannot be edited")
+	ErrFieldConflict    = errors.New("field value is already taken")
+
+	// ErrColumnNotQueryable is returned by ExistenceChecker for columns that are not unique
+	ErrColumnNotQueryable = errors.New("column cannot be checked for existence, only unique columns can")
 
 	// store errors
-	ErrStoreNotProvided = errors.New("store must be provided")
+	ErrStoreNotProvided      = errors.New("store must be provided")
+	ErrSoftDeleteDisabled    = errors.New("soft delete is not enabled for this store")
+	ErrDisablingNotSupported = errors.New("store does not support disabling users")
+	ErrLookupNotSupported    = errors.New("store does not support looking users up without a password")
+	ErrListingNotSupported   = errors.New("store does not support listing users")
+	ErrHashingBusy           = errors.New("too many concurrent password hashing requests, try again later")
+	ErrSessionsNotSupported  = errors.New("no session store configured")
+	ErrRolesNotSupported     = errors.New("store does not support changing roles")
+	ErrUpdatesNotSupported   = errors.New("store does not support updating users")
+	ErrTokenNotFound         = errors.New("token not found")
+	ErrUnsafeMigration       = errors.New("schema change requires a manual migration")
+	ErrTokenVersionsDisabled = errors.New("token versions are not enabled for this store")
+	ErrListenNotSupported    = errors.New("store connection cannot listen for notifications")
+
+	// ErrStoreUnavailable is returned while the database cannot be reached, see NewAuthifyDB and NewLazyAuthifyDB
+	ErrStoreUnavailable = errors.New("store is unavailable")
+
+	// service account errors
+	ErrServiceAccountsNotSupported = errors.New("no service account store configured")
+	ErrServiceAccountExists        = errors.New("service account already exists")
+	ErrServiceAccountNotFound      = errors.New("service account not found")
+	ErrInvalidClientCredentials    = errors.New("invalid client id or secret")
+
+	// token family errors, see TokenFamilyStore
+	ErrTokenFamiliesNotSupported = errors.New("no token family store configured")
+	ErrTokenFamilyNotFound       = errors.New("token family not found")
+	ErrRefreshTokenReused        = errors.New("refresh token was already used, its token family is revoked")
+
+	// invite errors, see InviteStore
+	ErrInvitesNotSupported = errors.New("no invite store configured")
+	ErrInviteNotFound      = errors.New("invite code is unknown")
+	ErrInviteExpired       = errors.New("invite has expired")
+	ErrInviteUsedUp        = errors.New("invite was already used as many times as it allows")
+
+	// challenge login errors
+	ErrChallengeNotSupported = errors.New("challenge login is not supported")
+	ErrNonceUsed             = errors.New("login challenge nonce is unknown or was already used")
+	ErrNonceExpired          = errors.New("login challenge nonce has expired")
 )
@@ -0,0 +1,166 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// FallbackStore combines a primary store with a secondary, legacy one, for migrating
+// users between them. Users are created in the primary store, unless the secondary one
+// already has them, and logins fall back to the secondary store for users the primary one
+// does not know. With migrateOnLogin, users logging in through the secondary store are
+// copied into the primary one, their password hashed again with the primary store's hasher,
+// so their next login no longer reaches the secondary store.
+//
+// The primary store wins whenever a user exists in both: its answer, including a wrong
+// password, is final. Hidden columns other than the password cannot be read back from
+// the secondary store, migrated users get the primary store's defaults for them.
+type FallbackStore struct {
+	primary        Store
+	secondary      Store
+	migrateOnLogin bool
+	migrations     atomic.Int64
+}
+
+// NewFallbackStore returns a store checking primary first and secondary second
+func NewFallbackStore(primary, secondary Store, migrateOnLogin bool) *FallbackStore {
+	return &FallbackStore{
+		primary:        primary,
+		secondary:      secondary,
+		migrateOnLogin: migrateOnLogin,
+	}
+}
+
+// CreateUser creates the user in the primary store, failing with ErrUserExists when the
+// secondary store has a user with the same identifier: as the primary store wins on lookup,
+// creating it would take the legacy user's account over.
+func (f *FallbackStore) CreateUser(data map[string]any) (map[string]string, error) {
+	if userIdentifier, ok := data[f.primary.StoreConfig().getIdentifierColumnName()]; ok {
+		exists, err := f.inSecondary(fmt.Sprint(userIdentifier))
+		if err != nil {
+			return nil, fmt.Errorf("secondary store: %w", err)
+		}
+		if exists {
+			return nil, fmt.Errorf("%w: %v", ErrUserExists, userIdentifier)
+		}
+	}
+	return f.primary.CreateUser(data)
+}
+
+// inSecondary reports whether the secondary store has a user identified by userIdentifier,
+// asking it as an ExistenceChecker, or else through a login, which tells unknown users apart.
+func (f *FallbackStore) inSecondary(userIdentifier string) (bool, error) {
+	if checker, ok := f.secondary.(ExistenceChecker); ok {
+		return checker.UserExists(context.Background(), f.secondary.StoreConfig().getIdentifierColumnName(), userIdentifier)
+	}
+	_, err := f.secondary.GetUserInfo(userIdentifier, "")
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return false, nil
+	case err == nil, errors.Is(err, ErrInvalidPassword), errors.Is(err, ErrAccountDisabled):
+		return true, nil
+	}
+	return false, err
+}
+
+// UserExists checks the primary store, and the secondary store when the primary one has no
+// such user, as values taken there are taken once its users are migrated too. Stores that are
+// not ExistenceCheckers fail with ErrLookupNotSupported.
+func (f *FallbackStore) UserExists(ctx context.Context, column, value string) (bool, error) {
+	for _, store := range []Store{f.primary, f.secondary} {
+		checker, ok := store.(ExistenceChecker)
+		if !ok {
+			return false, ErrLookupNotSupported
+		}
+		exists, err := checker.UserExists(ctx, column, value)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// GetUserInfo authenticates against the primary store, and against the secondary store
+// when the primary one has no such user
+func (f *FallbackStore) GetUserInfo(userIdentifier, password string) (map[string]any, error) {
+	user, err := f.primary.GetUserInfo(userIdentifier, password)
+	if !errors.Is(err, ErrUserNotFound) {
+		return user, err
+	}
+
+	user, err = f.secondary.GetUserInfo(userIdentifier, password)
+	if err != nil {
+		return nil, err
+	}
+	if f.migrateOnLogin {
+		f.migrate(userIdentifier, password, user)
+	}
+	return user, nil
+}
+
+// migrate copies a user authenticated by the secondary store into the primary one.
+// Failures are logged, the login itself already succeeded.
+func (f *FallbackStore) migrate(userIdentifier, password string, user map[string]any) {
+	cfg := f.primary.StoreConfig()
+	data := make(map[string]any, len(user)+2)
+	for name, val := range user {
+		data[name] = val
+	}
+	data[cfg.getIdentifierColumnName()] = userIdentifier
+	data[cfg.getPasswordColumnName()] = password
+
+	_, err := f.primary.CreateUser(data)
+	switch {
+	case errors.Is(err, ErrUserExists):
+		// created in the primary store since our lookup, which now takes precedence
+		log.Printf("warning: user %s exists in both stores, keeping the primary one", userIdentifier)
+	case err != nil:
+		log.Printf("failed to migrate user %s to the primary store: %v", userIdentifier, err)
+	default:
+		f.migrations.Add(1)
+		log.Printf("Migrated user %s to the primary store", userIdentifier)
+	}
+}
+
+// Migrations counts the users copied into the primary store since the store was created
+func (f *FallbackStore) Migrations() int64 {
+	return f.migrations.Load()
+}
+
+// CountUsers returns the sum of the users of both stores. Users not migrated yet are
+// counted once, migrated ones twice unless removed from the secondary store.
+func (f *FallbackStore) CountUsers() (int, error) {
+	primary, err := f.primary.CountUsers()
+	if err != nil {
+		return 0, err
+	}
+	secondary, err := f.secondary.CountUsers()
+	if err != nil {
+		return 0, fmt.Errorf("secondary store: %w", err)
+	}
+	return primary + secondary, nil
+}
+
+// StoreConfig returns the config of the primary store, which issued tokens follow
+func (f *FallbackStore) StoreConfig() StoreConfig {
+	return f.primary.StoreConfig()
+}
+
+// GetGlobalNotBefore returns the global not-before time of the primary store, which issues the tokens
+func (f *FallbackStore) GetGlobalNotBefore() (time.Time, error) {
+	return f.primary.GetGlobalNotBefore()
+}
+
+// SetGlobalNotBefore sets the global not-before time of the primary store
+func (f *FallbackStore) SetGlobalNotBefore(t time.Time) error {
+	return f.primary.SetGlobalNotBefore(t)
+}
+
+// Close closes both stores
+func (f *FallbackStore) Close() error {
+	return errors.Join(f.primary.Close(), f.secondary.Close())
+}
@@ -0,0 +1,135 @@
+package stores
+
+import (
+	"errors"
+	"testing"
+)
+
+// countingStore counts the logins reaching the store it wraps
+type countingStore struct {
+	Store
+	logins int
+}
+
+func (s *countingStore) GetUserInfo(userIdentifier, password string) (map[string]any, error) {
+	s.logins++
+	return s.Store.GetUserInfo(userIdentifier, password)
+}
+
+func newFallbackTestStore() *InMemoryUserStore {
+	return NewInMemoryUserStore(StoreConfig{
+		BcryptCost: 4,
+		Columns: map[string]ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+			"email":    {Type: "text"},
+		},
+	})
+}
+
+func TestFallbackStoreMigratesOnLogin(t *testing.T) {
+	primary := newFallbackTestStore()
+	secondary := &countingStore{Store: newFallbackTestStore()}
+	if _, err := secondary.CreateUser(map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"}); err != nil {
+		t.Fatalf("failed to create legacy user: %v", err)
+	}
+	store := NewFallbackStore(primary, secondary, true)
+
+	if _, err := store.GetUserInfo("alice", "wrong"); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("expected ErrInvalidPassword from the secondary store, got %v", err)
+	}
+	if store.Migrations() != 0 {
+		t.Errorf("expected failed logins not to migrate, got %d migrations", store.Migrations())
+	}
+
+	user, err := store.GetUserInfo("alice", "password123")
+	if err != nil || user["email"] != "alice@example.com" {
+		t.Fatalf("expected login through the secondary store, got %v (%v)", user, err)
+	}
+	if store.Migrations() != 1 {
+		t.Errorf("expected 1 migration, got %d", store.Migrations())
+	}
+	migrated, err := primary.GetUserInfo("alice", "password123")
+	if err != nil || migrated["email"] != "alice@example.com" {
+		t.Fatalf("expected the user in the primary store, got %v (%v)", migrated, err)
+	}
+
+	loginsBefore := secondary.logins
+	if _, err := store.GetUserInfo("alice", "password123"); err != nil {
+		t.Fatalf("failed to log in after migration: %v", err)
+	}
+	if secondary.logins != loginsBefore {
+		t.Errorf("expected the second login to be served by the primary store alone")
+	}
+}
+
+func TestFallbackStorePrefersPrimary(t *testing.T) {
+	primary := newFallbackTestStore()
+	secondary := &countingStore{Store: newFallbackTestStore()}
+	for _, s := range []Store{primary, secondary} {
+		if _, err := s.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+	}
+	if _, err := secondary.CreateUser(map[string]any{"username": "bob", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	store := NewFallbackStore(primary, secondary, false)
+
+	// the primary store's answer is final, even when the secondary one would accept the login
+	if err := primary.UpdateUser("alice", map[string]any{"password": "changed"}); err != nil {
+		t.Fatalf("failed to change password: %v", err)
+	}
+	if _, err := store.GetUserInfo("alice", "password123"); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("expected the primary store to reject the old password, got %v", err)
+	}
+	if secondary.logins != 0 {
+		t.Errorf("expected users of the primary store not to reach the secondary one")
+	}
+
+	// without migrateOnLogin, users stay in the secondary store
+	if _, err := store.GetUserInfo("bob", "password123"); err != nil {
+		t.Fatalf("expected login through the secondary store, got %v", err)
+	}
+	if _, err := primary.GetUserInfo("bob", "password123"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected bob not to be migrated, got %v", err)
+	}
+
+	if _, err := store.CreateUser(map[string]any{"username": "carol", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if _, err := primary.GetUserInfo("carol", "password123"); err != nil {
+		t.Errorf("expected new users in the primary store, got %v", err)
+	}
+	if count, err := store.CountUsers(); err != nil || count != 4 {
+		t.Errorf("expected 4 users across both stores, got %d (%v)", count, err)
+	}
+}
+
+func TestFallbackStoreRejectsLegacyUsernames(t *testing.T) {
+	primary := newFallbackTestStore()
+	legacy := newFallbackTestStore()
+	if _, err := legacy.CreateUser(map[string]any{"username": "bob", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create legacy user: %v", err)
+	}
+
+	testCases := map[string]Store{
+		"existence checker": legacy,
+		// a Store alone, which the fallback store asks through a login
+		"plain store": &countingStore{Store: legacy},
+	}
+	for name, secondary := range testCases {
+		t.Run(name, func(t *testing.T) {
+			store := NewFallbackStore(primary, secondary, false)
+			if _, err := store.CreateUser(map[string]any{"username": "bob", "password": "attacker"}); !errors.Is(err, ErrUserExists) {
+				t.Fatalf("expected ErrUserExists for a username of the secondary store, got %v", err)
+			}
+			if _, err := store.GetUserInfo("bob", "password123"); err != nil {
+				t.Errorf("expected the legacy user to keep their account, got %v", err)
+			}
+			if _, err := store.GetUserInfo("bob", "attacker"); !errors.Is(err, ErrInvalidPassword) {
+				t.Errorf("expected the registrant's password to be rejected, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package stores
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// TokenFamily is the chain of refresh tokens descending from a login: the first one is issued
+// by the login, and each refresh consumes the last one and issues its successor. Its ID is the
+// session ID of the login, carried by every refresh token of the family in its "sid" claim, and
+// its tokens are told apart by their "jti" claim.
+type TokenFamily struct {
+	ID             string `json:"id"`
+	UserIdentifier string `json:"user_identifier"`
+	// Device is the client of the login that created the family
+	Device    DeviceInfo `json:"device"`
+	CreatedAt time.Time  `json:"created_at"`
+	// ExpiresAt is when the refresh tokens of the family expire, rotations never extend it.
+	// Stores purge the families past it, zero keeps the family.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// Tokens are the refresh tokens of the family, oldest first
+	Tokens []FamilyToken `json:"tokens"`
+	// Compromise is set once a consumed refresh token of the family is used again, every token
+	// of the family is then revoked
+	Compromise *FamilyCompromise `json:"compromise,omitempty"`
+}
+
+// FamilyToken is a refresh token of a TokenFamily
+type FamilyToken struct {
+	JTI string `json:"jti"`
+	// IP is the address of the client of the login or refresh that issued the token
+	IP       string    `json:"ip"`
+	IssuedAt time.Time `json:"issued_at"`
+	// ConsumedAt is when a refresh traded the token for its successor
+	ConsumedAt time.Time `json:"consumed_at,omitzero"`
+	// RevokedAt is when the compromise of the family revoked the token, unless it was consumed
+	RevokedAt time.Time `json:"revoked_at,omitzero"`
+}
+
+// FamilyCompromise records the reuse of a consumed refresh token
+type FamilyCompromise struct {
+	// JTI is the refresh token used again, IP the address of the client that used it
+	JTI        string    `json:"jti"`
+	IP         string    `json:"ip"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// TokenFamilyStore records the families of rotated refresh tokens, see authify.WithTokenFamilies.
+// The session stores of this package implement it.
+type TokenFamilyStore interface {
+	// CreateTokenFamily records the family of a login, with the refresh token it issued,
+	// purging the families past their ExpiresAt first.
+	CreateTokenFamily(family TokenFamily) error
+	// RotateTokenFamily consumes the refresh token jti of a family and appends next, issued in
+	// its place. It fails with ErrRefreshTokenReused when jti was already consumed or revoked,
+	// or when the family is compromised, with ErrTokenNotFound when jti is not part of the
+	// family, and with ErrTokenFamilyNotFound for unknown families. Of concurrent rotations of
+	// the same token, one succeeds and the others fail with ErrRefreshTokenReused.
+	RotateTokenFamily(familyID, jti string, next FamilyToken) error
+	// CompromiseTokenFamily records the reuse of a refresh token of a family and revokes its
+	// tokens. Only the first compromise of a family is recorded.
+	CompromiseTokenFamily(familyID string, compromise FamilyCompromise) error
+	// GetTokenFamily returns a family with its tokens, or ErrTokenFamilyNotFound.
+	GetTokenFamily(familyID string) (*TokenFamily, error)
+	// ListTokenFamilies returns the families of a user with their tokens, oldest first.
+	ListTokenFamilies(username string) ([]TokenFamily, error)
+}
+
+// Check fails with ErrRefreshTokenReused unless jti is the last token of the family, neither
+// consumed nor revoked, and with ErrTokenNotFound when jti is not part of the family.
+func (f *TokenFamily) Check(jti string) error {
+	i := slices.IndexFunc(f.Tokens, func(t FamilyToken) bool { return t.JTI == jti })
+	if i < 0 {
+		return fmt.Errorf("%w: %s is not part of token family %s", ErrTokenNotFound, jti, f.ID)
+	}
+	current := f.Tokens[i]
+	if f.Compromise != nil || i != len(f.Tokens)-1 || !current.ConsumedAt.IsZero() || !current.RevokedAt.IsZero() {
+		return fmt.Errorf("%w: %s of token family %s", ErrRefreshTokenReused, jti, f.ID)
+	}
+	return nil
+}
+
+// rotate consumes the token jti, which must pass Check, and appends next
+func (f *TokenFamily) rotate(jti string, next FamilyToken) error {
+	if err := f.Check(jti); err != nil {
+		return err
+	}
+	f.Tokens[len(f.Tokens)-1].ConsumedAt = next.IssuedAt
+	f.Tokens = append(f.Tokens, next)
+	return nil
+}
+
+// compromise records the reuse of a token and revokes the tokens not consumed yet, it reports
+// whether the family changed
+func (f *TokenFamily) compromise(c FamilyCompromise) bool {
+	if f.Compromise != nil {
+		return false
+	}
+	f.Compromise = &c
+	for i := range f.Tokens {
+		if f.Tokens[i].ConsumedAt.IsZero() && f.Tokens[i].RevokedAt.IsZero() {
+			f.Tokens[i].RevokedAt = c.DetectedAt
+		}
+	}
+	return true
+}
+
+// clone returns a deep copy of the family
+func (f *TokenFamily) clone() *TokenFamily {
+	c := *f
+	c.Tokens = slices.Clone(f.Tokens)
+	if f.Compromise != nil {
+		compromise := *f.Compromise
+		c.Compromise = &compromise
+	}
+	return &c
+}
+
+// CreateTokenFamily records the family of a login, sanitizing its device info and purging the
+// families past their ExpiresAt first
+func (s *InMemorySessionStore) CreateTokenFamily(family TokenFamily) error {
+	now := time.Now()
+	family.Device = family.Device.Sanitize()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maps.DeleteFunc(s.families, func(_ string, f *TokenFamily) bool {
+		return !f.ExpiresAt.IsZero() && now.After(f.ExpiresAt)
+	})
+	s.families[family.ID] = family.clone()
+	return nil
+}
+
+// RotateTokenFamily consumes a refresh token of a family, see TokenFamilyStore
+func (s *InMemorySessionStore) RotateTokenFamily(familyID, jti string, next FamilyToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	family, ok := s.families[familyID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTokenFamilyNotFound, familyID)
+	}
+	return family.rotate(jti, next)
+}
+
+// CompromiseTokenFamily records the reuse of a refresh token of a family, see TokenFamilyStore
+func (s *InMemorySessionStore) CompromiseTokenFamily(familyID string, compromise FamilyCompromise) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	family, ok := s.families[familyID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTokenFamilyNotFound, familyID)
+	}
+	family.compromise(compromise)
+	return nil
+}
+
+// GetTokenFamily returns a family with its tokens
+func (s *InMemorySessionStore) GetTokenFamily(familyID string) (*TokenFamily, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	family, ok := s.families[familyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTokenFamilyNotFound, familyID)
+	}
+	return family.clone(), nil
+}
+
+// ListTokenFamilies returns the families of a user with their tokens, oldest first
+func (s *InMemorySessionStore) ListTokenFamilies(username string) ([]TokenFamily, error) {
+	s.mu.RLock()
+	var families []TokenFamily
+	for _, family := range s.families {
+		if family.UserIdentifier == username {
+			families = append(families, *family.clone())
+		}
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(families, func(a, b TokenFamily) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return families, nil
+}
@@ -0,0 +1,259 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// testTokenFamilyStore runs the checks every TokenFamilyStore passes
+func testTokenFamilyStore(t *testing.T, s TokenFamilyStore) {
+	start := time.Now().UTC().Truncate(time.Second)
+	family := TokenFamily{
+		ID:             fmt.Sprintf("family-%d", start.UnixNano()),
+		UserIdentifier: "alice",
+		Device:         DeviceInfo{IP: "10.0.0.1", UserAgent: "curl/8.0"},
+		CreatedAt:      start,
+		Tokens:         []FamilyToken{{JTI: "jti-0", IP: "10.0.0.1", IssuedAt: start}},
+	}
+	if err := s.CreateTokenFamily(family); err != nil {
+		t.Fatalf("failed to create token family: %v", err)
+	}
+
+	// three rotations, each consuming the token the previous one issued
+	for i := 1; i <= 3; i++ {
+		next := FamilyToken{JTI: fmt.Sprintf("jti-%d", i), IP: "10.0.0.2", IssuedAt: start.Add(time.Duration(i) * time.Minute)}
+		if err := s.RotateTokenFamily(family.ID, fmt.Sprintf("jti-%d", i-1), next); err != nil {
+			t.Fatalf("rotation %d failed: %v", i, err)
+		}
+	}
+	if err := s.RotateTokenFamily(family.ID, "jti-1", FamilyToken{JTI: "jti-x", IssuedAt: start}); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused for a consumed token, got %v", err)
+	}
+	if err := s.RotateTokenFamily(family.ID, "unknown", FamilyToken{JTI: "jti-x", IssuedAt: start}); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound for a token of another family, got %v", err)
+	}
+	if err := s.RotateTokenFamily("unknown", "jti-0", FamilyToken{JTI: "jti-x", IssuedAt: start}); !errors.Is(err, ErrTokenFamilyNotFound) {
+		t.Errorf("expected ErrTokenFamilyNotFound, got %v", err)
+	}
+
+	detected := start.Add(time.Hour)
+	if err := s.CompromiseTokenFamily(family.ID, FamilyCompromise{JTI: "jti-1", IP: "192.0.2.9", DetectedAt: detected}); err != nil {
+		t.Fatalf("failed to compromise token family: %v", err)
+	}
+	// only the first compromise is recorded
+	if err := s.CompromiseTokenFamily(family.ID, FamilyCompromise{JTI: "jti-2", IP: "192.0.2.10", DetectedAt: detected.Add(time.Minute)}); err != nil {
+		t.Fatalf("failed to compromise token family again: %v", err)
+	}
+	if err := s.RotateTokenFamily(family.ID, "jti-3", FamilyToken{JTI: "jti-4", IssuedAt: detected}); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("expected the current token of a compromised family to be refused, got %v", err)
+	}
+
+	got, err := s.GetTokenFamily(family.ID)
+	if err != nil {
+		t.Fatalf("failed to get token family: %v", err)
+	}
+	if got.UserIdentifier != "alice" || got.Device.UserAgent != "curl/8.0" || !got.CreatedAt.Equal(start) {
+		t.Errorf("unexpected token family %+v", got)
+	}
+	if len(got.Tokens) != 4 {
+		t.Fatalf("expected the login token and three rotations, got %+v", got.Tokens)
+	}
+	for i, tok := range got.Tokens {
+		if tok.JTI != fmt.Sprintf("jti-%d", i) {
+			t.Errorf("token %d: expected jti-%d, got %s", i, i, tok.JTI)
+		}
+		if i < 3 && !tok.ConsumedAt.Equal(got.Tokens[i+1].IssuedAt) {
+			t.Errorf("token %d: expected it consumed by the rotation issuing its successor, got %+v", i, tok)
+		}
+	}
+	if last := got.Tokens[3]; !last.ConsumedAt.IsZero() || !last.RevokedAt.Equal(detected) || last.IP != "10.0.0.2" {
+		t.Errorf("expected the current token revoked by the compromise, got %+v", last)
+	}
+	if c := got.Compromise; c == nil || c.JTI != "jti-1" || c.IP != "192.0.2.9" || !c.DetectedAt.Equal(detected) {
+		t.Errorf("expected the first compromise recorded, got %+v", c)
+	}
+	if _, err := s.GetTokenFamily("unknown"); !errors.Is(err, ErrTokenFamilyNotFound) {
+		t.Errorf("expected ErrTokenFamilyNotFound, got %v", err)
+	}
+
+	other := family
+	other.ID += "-2"
+	other.CreatedAt = start.Add(time.Second)
+	if err := s.CreateTokenFamily(other); err != nil {
+		t.Fatalf("failed to create token family: %v", err)
+	}
+	families, err := s.ListTokenFamilies("alice")
+	if err != nil {
+		t.Fatalf("failed to list token families: %v", err)
+	}
+	if len(families) != 2 || families[0].ID != family.ID || families[1].ID != other.ID {
+		t.Fatalf("expected both families, oldest first, got %+v", families)
+	}
+	if listed := families[0]; len(listed.Tokens) != 4 || listed.Compromise == nil || !listed.Tokens[3].IssuedAt.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("expected the family with its tokens, got %+v", listed)
+	}
+	if listed := families[1]; len(listed.Tokens) != 1 || listed.Compromise != nil {
+		t.Errorf("expected the family with its tokens, got %+v", listed)
+	}
+	if families, err := s.ListTokenFamilies("bob"); err != nil || len(families) != 0 {
+		t.Errorf("expected no families for bob, got %+v (%v)", families, err)
+	}
+
+	// creating a family purges the expired ones
+	expired := other
+	expired.ID += "-expired"
+	expired.ExpiresAt = start.Add(-time.Minute)
+	if err := s.CreateTokenFamily(expired); err != nil {
+		t.Fatalf("failed to create token family: %v", err)
+	}
+	if got, err := s.GetTokenFamily(expired.ID); err != nil || !got.ExpiresAt.Equal(expired.ExpiresAt) {
+		t.Errorf("expected the family to keep its expiry, got %+v (%v)", got, err)
+	}
+	fresh := other
+	fresh.ID += "-fresh"
+	fresh.ExpiresAt = start.Add(time.Hour)
+	if err := s.CreateTokenFamily(fresh); err != nil {
+		t.Fatalf("failed to create token family: %v", err)
+	}
+	if _, err := s.GetTokenFamily(expired.ID); !errors.Is(err, ErrTokenFamilyNotFound) {
+		t.Errorf("expected the expired family to be purged, got %v", err)
+	}
+	if _, err := s.GetTokenFamily(family.ID); err != nil {
+		t.Errorf("expected the families without expiry to be kept, got %v", err)
+	}
+}
+
+// testTokenFamilyRace checks that of concurrent rotations of the same token, only one succeeds
+func testTokenFamilyRace(t *testing.T, s TokenFamilyStore) {
+	now := time.Now().UTC()
+	family := TokenFamily{
+		ID:             fmt.Sprintf("race-%d", now.UnixNano()),
+		UserIdentifier: "alice",
+		CreatedAt:      now,
+		Tokens:         []FamilyToken{{JTI: "jti-0", IssuedAt: now}},
+	}
+	if err := s.CreateTokenFamily(family); err != nil {
+		t.Fatalf("failed to create token family: %v", err)
+	}
+
+	const rotations = 10
+	errs := make(chan error, rotations)
+	var wg sync.WaitGroup
+	for i := range rotations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.RotateTokenFamily(family.ID, "jti-0", FamilyToken{JTI: fmt.Sprintf("next-%d", i), IssuedAt: now})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	won := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, ErrRefreshTokenReused):
+			t.Errorf("expected ErrRefreshTokenReused for the losers, got %v", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("expected exactly one rotation, got %d", won)
+	}
+}
+
+func TestInMemoryTokenFamilyStore(t *testing.T) {
+	testTokenFamilyStore(t, NewInMemorySessionStore())
+}
+
+func TestInMemoryTokenFamilyRace(t *testing.T) {
+	testTokenFamilyRace(t, NewInMemorySessionStore())
+}
+
+// familyConn runs every statement, answering queries with no rows, and records them
+type familyConn struct {
+	statements []string
+}
+
+func (c *familyConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	c.statements = append(c.statements, sql)
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+func (c *familyConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	c.statements = append(c.statements, sql)
+	return &countRows{read: true}, nil
+}
+
+func TestPGTokenFamilyQueries(t *testing.T) {
+	conn := &familyConn{}
+	s, err := NewPGSessionStore(conn, "sessions")
+	if err != nil {
+		t.Fatalf("failed to create session store: %v", err)
+	}
+	if !slices.ContainsFunc(conn.statements, func(sql string) bool {
+		return strings.HasPrefix(sql, `CREATE INDEX IF NOT EXISTS "sessions_families_user_identifier_idx" ON "sessions_families" ("user_identifier")`)
+	}) {
+		t.Errorf("expected the families to be indexed by user, got %v", conn.statements)
+	}
+
+	// expired families are purged before a family is created along with its tokens
+	conn.statements = nil
+	family := TokenFamily{ID: "family", UserIdentifier: "alice", Tokens: []FamilyToken{{JTI: "jti-0"}}}
+	if err := s.CreateTokenFamily(family); err != nil {
+		t.Fatalf("failed to create token family: %v", err)
+	}
+	if len(conn.statements) != 2 || conn.statements[0] != `DELETE FROM "sessions_families" WHERE "expires_at" < now()` ||
+		!strings.Contains(conn.statements[1], `INSERT INTO "sessions_family_tokens"`) {
+		t.Errorf("expected a purge and a single insert, got %v", conn.statements)
+	}
+
+	// the families of a user are read with their tokens by a single query
+	conn.statements = nil
+	if _, err := s.ListTokenFamilies("alice"); err != nil {
+		t.Fatalf("failed to list token families: %v", err)
+	}
+	if len(conn.statements) != 1 || !strings.Contains(conn.statements[0], `FROM "sessions_family_tokens" t WHERE t."family_id"=f."id"`) {
+		t.Errorf("expected a single query, got %v", conn.statements)
+	}
+}
+
+func TestTokenFamilyStorePostgres(t *testing.T) {
+	connString := os.Getenv(testDatabaseURLEnv)
+	if connString == "" {
+		t.Skipf("%s is not set", testDatabaseURLEnv)
+	}
+
+	cfg := loadTestConfig(fmt.Sprintf("authify_families_%d", time.Now().UnixNano()))
+	cfg.AutoCreate = true
+	db, err := NewAuthifyDB(connString, cfg)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	sessions, err := db.NewSessionStore()
+	if err != nil {
+		t.Fatalf("failed to create session store: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, table := range []string{cfg.Name, sessions.table, sessions.tokens, sessions.nonces, sessions.familyTokens, sessions.families} {
+			if _, err := db.conn.Exec(context.Background(), `DROP TABLE IF EXISTS "`+table+`"`); err != nil {
+				t.Errorf("failed to drop %s: %v", table, err)
+			}
+		}
+		db.Close()
+	})
+
+	testTokenFamilyStore(t, sessions)
+	testTokenFamilyRace(t, sessions)
+}
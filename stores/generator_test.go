@@ -0,0 +1,187 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generatedTestConfig has a generated uuid primary key, with username as a mere unique column
+func generatedTestConfig(name string) StoreConfig {
+	return StoreConfig{
+		Name:       name,
+		AutoCreate: true,
+		BcryptCost: 4,
+		Columns: map[string]ColumnConfig{
+			"id":         {Type: "uuid", Required: true, PrimaryKey: true, Generator: GeneratorUUIDv4},
+			"username":   {Type: "text", Required: true, Unique: true},
+			"password":   {Type: "text", Required: true, Hidden: true, IsPassword: true},
+			"created_at": {Type: "timestamp", Required: true, Generator: GeneratorNow},
+			"number":     {Type: "int", Generator: GeneratorSequence},
+		},
+	}
+}
+
+// checkGeneratedIdentity checks the identity of the n-th user created in a generatedTestConfig
+// store, n is 0 for stores without the sequence
+func checkGeneratedIdentity(t *testing.T, identity map[string]string, username string, n int) {
+	t.Helper()
+	if len(identity["id"]) != 36 || identity["id"][14] != '4' {
+		t.Errorf("expected a generated version 4 uuid, got %q", identity["id"])
+	}
+	if identity["username"] != username {
+		t.Errorf("expected the unique username column, got %q", identity["username"])
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, identity["created_at"])
+	if err != nil || time.Since(createdAt) > time.Minute {
+		t.Errorf("expected a generated creation time, got %q: %v", identity["created_at"], err)
+	}
+	if n > 0 && identity["number"] != fmt.Sprint(n) {
+		t.Errorf("expected sequence number %d, got %q", n, identity["number"])
+	}
+	if _, ok := identity["password"]; ok {
+		t.Errorf("hidden password column must not be returned")
+	}
+}
+
+func TestGeneratedColumns(t *testing.T) {
+	m := NewInMemoryUserStore(generatedTestConfig("users"))
+
+	alice, err := m.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	checkGeneratedIdentity(t, alice, "alice", 1)
+	bob, err := m.CreateUser(map[string]any{"username": "bob", "password": "password123"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	checkGeneratedIdentity(t, bob, "bob", 2)
+	if alice["id"] == bob["id"] {
+		t.Errorf("expected distinct ids, got %q twice", alice["id"])
+	}
+
+	user, err := m.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if user["id"] != alice["id"] || user["created_at"] != alice["created_at"] {
+		t.Errorf("expected the generated values to be stored, got %v", user)
+	}
+
+	// values given by the caller are kept
+	carol, err := m.CreateUser(map[string]any{"username": "carol", "password": "password123", "id": "00000000-0000-4000-8000-000000000001"})
+	if err != nil || carol["id"] != "00000000-0000-4000-8000-000000000001" {
+		t.Errorf("expected the given id, got %v %v", carol, err)
+	}
+}
+
+func TestGeneratedColumnsDDL(t *testing.T) {
+	conn := &schemaConn{}
+	cfg := generatedTestConfig("users")
+	cfg.Columns["ref"] = ColumnConfig{Type: "uuid", Generator: GeneratorUUIDv7}
+	if _, err := NewAuthifyDBFromConn(conn, cfg); err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	create := conn.executed[0]
+	for _, want := range []string{
+		`"id" UUID NOT NULL  DEFAULT gen_random_uuid()`,
+		`"created_at" TIMESTAMP NOT NULL  DEFAULT now()`,
+		`"number" INTEGER GENERATED BY DEFAULT AS IDENTITY`,
+		`"ref" UUID,`,
+	} {
+		if !strings.Contains(create, want) {
+			t.Errorf("expected %s in %s", want, create)
+		}
+	}
+
+	// values the store can generate are inserted by the store, so tables created without
+	// the defaults work too, sequences are read back with RETURNING
+	delete(cfg.Columns, "number")
+	db, err := NewAuthifyDBFromConn(&schemaConn{}, cfg)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	identity, err := db.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	checkGeneratedIdentity(t, identity, "alice", 0)
+	if identity["ref"][14] != '7' {
+		t.Errorf("expected a version 7 uuid, got %q", identity["ref"])
+	}
+}
+
+func TestGeneratedColumnsPostgres(t *testing.T) {
+	connString := os.Getenv(testDatabaseURLEnv)
+	if connString == "" {
+		t.Skipf("%s is not set", testDatabaseURLEnv)
+	}
+
+	table := fmt.Sprintf("authify_generated_%d", time.Now().UnixNano())
+	db, err := NewAuthifyDB(connString, generatedTestConfig(table))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.conn.Exec(context.Background(), fmt.Sprintf(`DROP TABLE IF EXISTS "%s"`, table)); err != nil {
+			t.Errorf("failed to drop %s: %v", table, err)
+		}
+		db.Close()
+	})
+
+	for i, username := range []string{"alice", "bob"} {
+		identity, err := db.CreateUser(map[string]any{"username": username, "password": "password123"})
+		if err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		checkGeneratedIdentity(t, identity, username, i+1)
+
+		user, err := db.GetUserByUsername(identity["id"])
+		if err != nil {
+			t.Fatalf("failed to get user: %v", err)
+		}
+		if user["username"] != username || user["created_at"] == "" {
+			t.Errorf("expected the user to be stored with its generated values, got %v", user)
+		}
+	}
+}
+
+func TestValidateGenerators(t *testing.T) {
+	cases := map[string]ColumnConfig{
+		"unknown generator":   {Type: "uuid", Generator: "uuid_v5"},
+		"mismatched type":     {Type: "int", Generator: GeneratorUUIDv4},
+		"sequence not an int": {Type: "text", Generator: GeneratorSequence},
+	}
+	for name, col := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := generatedTestConfig("users")
+			cfg.Columns["id"] = col
+			if err := cfg.Validate(); !errors.Is(err, ErrInvalidGenerator) {
+				t.Errorf("expected ErrInvalidGenerator, got %v", err)
+			}
+		})
+	}
+	if err := generatedTestConfig("users").Validate(); err != nil {
+		t.Errorf("expected a valid config, got %v", err)
+	}
+}
+
+func TestNewUUIDv7(t *testing.T) {
+	first, err := newUUIDv7()
+	if err != nil {
+		t.Fatalf("failed to generate uuid: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	second, _ := newUUIDv7()
+	if len(first) != 36 || first[14] != '7' || !strings.ContainsAny(first[19:20], "89ab") {
+		t.Errorf("expected a version 7 uuid, got %q", first)
+	}
+	if first >= second {
+		t.Errorf("expected uuids to sort by creation, got %q then %q", first, second)
+	}
+}
@@ -0,0 +1,250 @@
+package stores
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords before they are persisted and compares
+// login attempts against stored hashes.
+// Hashes must be self-describing (carry their algorithm and parameters)
+// so that a store can verify passwords hashed by a different hasher.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Compare(hash, password string) error
+}
+
+const (
+	HasherBcrypt   = "bcrypt"
+	HasherArgon2id = "argon2id"
+
+	argon2idPrefix = "$argon2id$"
+)
+
+var ErrUnsupportedHasher = errors.New("unsupported password hasher")
+
+// RehashChecker is implemented by hashers that can tell when a stored hash was
+// produced with weaker parameters than the ones currently configured.
+type RehashChecker interface {
+	NeedsRehash(hash string) bool
+}
+
+// NewPasswordHasher returns the hasher registered under name,
+// an empty name selects bcrypt to keep existing deployments unchanged.
+func NewPasswordHasher(name string) (PasswordHasher, error) {
+	switch name {
+	case "", HasherBcrypt:
+		return BcryptHasher{}, nil
+	case HasherArgon2id:
+		return Argon2idHasher{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedHasher, name)
+	}
+}
+
+// hasherFromConfig selects the hasher named in the store config and applies its tuning.
+func hasherFromConfig(cfg StoreConfig) (PasswordHasher, error) {
+	hasher, err := NewPasswordHasher(cfg.PasswordHasher)
+	if err != nil {
+		return nil, err
+	}
+	if bcryptHasher, ok := hasher.(BcryptHasher); ok {
+		bcryptHasher.Cost = cfg.BcryptCost
+		hasher = bcryptHasher
+	}
+	if cfg.HashConcurrency > 0 {
+		hasher = NewLimitedHasher(hasher, cfg.HashConcurrency, cfg.HashQueue, cfg.HashTimeout)
+	}
+	return hasher, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt, Cost defaults to bcrypt.DefaultCost (10).
+// Documentation for bcrypt: https://pkg.go.dev/golang.org/x/crypto/bcrypt
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h BcryptHasher) Compare(hash, password string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// NeedsRehash reports whether hash is a bcrypt hash with a cost below the configured one.
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false
+	}
+	return cost < h.cost()
+}
+
+// Argon2idHasher hashes passwords with argon2id and encodes them in the PHC string
+// format ($argon2id$v=19$m=...,t=...,p=...$salt$hash). Zero values fall back to
+// the parameters recommended by the argon2 package documentation.
+// Documentation for argon2: https://pkg.go.dev/golang.org/x/crypto/argon2
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+func (h Argon2idHasher) withDefaults() Argon2idHasher {
+	if h.Time == 0 {
+		h.Time = 1
+	}
+	if h.Memory == 0 {
+		h.Memory = 64 * 1024
+	}
+	if h.Threads == 0 {
+		h.Threads = 4
+	}
+	if h.KeyLen == 0 {
+		h.KeyLen = 32
+	}
+	if h.SaltLen == 0 {
+		h.SaltLen = 16
+	}
+	return h
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	h = h.withDefaults()
+
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2.Version,
+		h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Compare verifies password using the parameters encoded in hash,
+// not the ones configured on h, so tuning them does not lock out existing users.
+func (h Argon2idHasher) Compare(hash, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != HasherArgon2id {
+		return ErrInvalidPassword
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return ErrInvalidPassword
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return ErrInvalidPassword
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return ErrInvalidPassword
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return ErrInvalidPassword
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, candidate) != 1 {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// rehashOnLogin transparently upgrades a user's password hash after a successful login,
+// when the store's hasher reports the stored hash as outdated.
+// It only runs for stores able to update users, failures are logged and never fail the login.
+func rehashOnLogin(store Store, hasher PasswordHasher, userIdentifier, hash, password string) {
+	checker, ok := hasher.(RehashChecker)
+	if !ok || !checker.NeedsRehash(hash) {
+		return
+	}
+	updater, ok := store.(UserUpdater)
+	if !ok {
+		return
+	}
+
+	passwordColumn := store.StoreConfig().getPasswordColumnName()
+	if err := updater.UpdateUser(userIdentifier, map[string]any{passwordColumn: password}); err != nil {
+		log.Printf("failed to upgrade password hash for %s: %v", userIdentifier, err)
+	}
+}
+
+// dummyPassword is hashed by dummyHash, its value does not matter
+const dummyPassword = "authify-dummy-password"
+
+// dummyHash makes logins of unknown users take as long as the ones with a wrong password,
+// so response times do not reveal which usernames exist. The hash is made with the
+// store's hasher, and its parameters, on the first unknown user.
+type dummyHash struct {
+	once sync.Once
+	hash string
+}
+
+// compare checks password against the dummy hash with hasher, discarding the result
+func (d *dummyHash) compare(hasher PasswordHasher, password string) {
+	d.once.Do(func() {
+		hash, err := hasher.Hash(dummyPassword)
+		if err != nil {
+			log.Printf("failed to hash the dummy password: %v", err)
+		}
+		d.hash = hash
+	})
+	_ = hasher.Compare(d.hash, password)
+}
+
+// comparePassword picks the hasher matching the stored hash's format,
+// falling back to the store's configured hasher for unknown formats.
+func comparePassword(fallback PasswordHasher, hash, password string) error {
+	if limited, ok := fallback.(*LimitedHasher); ok {
+		// limited.Compare calls back in here with the wrapped hasher once it holds a slot
+		return limited.Compare(hash, password)
+	}
+
+	switch {
+	case strings.HasPrefix(hash, argon2idPrefix):
+		return Argon2idHasher{}.Compare(hash, password)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return BcryptHasher{}.Compare(hash, password)
+	default:
+		return fallback.Compare(hash, password)
+	}
+}
@@ -0,0 +1,64 @@
+package stores
+
+import (
+	"errors"
+	"fmt"
+)
+
+// checkPasswordReuse fails with ErrPasswordReused when password matches one of hashes
+func checkPasswordReuse(hasher PasswordHasher, hashes []string, password string) error {
+	for _, hash := range hashes {
+		err := comparePassword(hasher, hash, password)
+		if err == nil {
+			return ErrPasswordReused
+		}
+		if errors.Is(err, ErrHashingBusy) {
+			return err
+		}
+	}
+	return nil
+}
+
+// previousPasswords is how many hashes of previous passwords are kept per user, the current
+// password being the last of the password_history ones refused by ReplacePassword
+func (cfg StoreConfig) previousPasswords() int {
+	return max(cfg.PasswordHistory-1, 0)
+}
+
+// ReplacePassword sets the password of a user, refusing the current one and the previous ones
+// kept with password_history, see PasswordHistorian
+func (m *InMemoryUserStore) ReplacePassword(username, newPassword string) error {
+	passwordColumn := m.storeCfg.getPasswordColumnName()
+	if m.storeCfg.PasswordHistory == 0 {
+		return m.UpdateUser(username, map[string]any{passwordColumn: newPassword})
+	}
+
+	m.mu.RLock()
+	user, exists := m.users[username]
+	var current string
+	var hashes []string
+	if exists {
+		current = user[passwordColumn]
+		hashes = append([]string{current}, m.passwordHistory[username]...)
+	}
+	m.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+
+	if err := checkPasswordReuse(m.hasher, hashes, newPassword); err != nil {
+		return fmt.Errorf("%w: %s", err, username)
+	}
+	if err := m.UpdateUser(username, map[string]any{passwordColumn: newPassword}); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.passwordHistory == nil {
+		m.passwordHistory = make(map[string][]string)
+	}
+	history := append([]string{current}, m.passwordHistory[username]...)
+	m.passwordHistory[username] = history[:min(len(history), m.storeCfg.previousPasswords())]
+	return m.persist()
+}
@@ -0,0 +1,130 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplacePasswordHistory(t *testing.T) {
+	cfg := loadTestConfig("users")
+	cfg.PasswordHistory = 3
+	store := NewInMemoryUserStore(cfg)
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "first"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	if err := store.ReplacePassword("alice", "first"); !errors.Is(err, ErrPasswordReused) {
+		t.Errorf("expected ErrPasswordReused for the current password, got %v", err)
+	}
+	for _, password := range []string{"second", "third"} {
+		if err := store.ReplacePassword("alice", password); err != nil {
+			t.Fatalf("failed to replace password with %s: %v", password, err)
+		}
+	}
+	for _, password := range []string{"first", "second", "third"} {
+		if err := store.ReplacePassword("alice", password); !errors.Is(err, ErrPasswordReused) {
+			t.Errorf("expected ErrPasswordReused for %s, got %v", password, err)
+		}
+	}
+
+	// only the last 3 passwords are refused, so the oldest one is allowed again
+	if err := store.ReplacePassword("alice", "fourth"); err != nil {
+		t.Fatalf("failed to replace password: %v", err)
+	}
+	if err := store.ReplacePassword("alice", "first"); err != nil {
+		t.Errorf("expected the pruned password to be accepted, got %v", err)
+	}
+	if _, err := store.GetUserInfo("alice", "first"); err != nil {
+		t.Errorf("failed to log in with the new password: %v", err)
+	}
+
+	if err := store.ReplacePassword("bob", "first"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestReplacePasswordWithoutHistory(t *testing.T) {
+	store := NewInMemoryUserStore(loadTestConfig("users"))
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "first"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if err := store.ReplacePassword("alice", "first"); err != nil {
+		t.Errorf("expected passwords to be reusable without password_history, got %v", err)
+	}
+}
+
+func TestPasswordHistoryTable(t *testing.T) {
+	cfg := loadTestConfig("users")
+	cfg.AutoCreate = true
+	cfg.PasswordHistory = 2
+	conn := &schemaConn{}
+	if _, err := NewAuthifyDBFromConn(conn, cfg); err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	created := false
+	for _, sql := range conn.executed {
+		if strings.HasPrefix(sql, `CREATE TABLE IF NOT EXISTS "users_password_history"`) {
+			created = true
+		}
+	}
+	if !created {
+		t.Errorf("expected the password history table to be created, got %v", conn.executed)
+	}
+
+	cfg.PasswordHistory = 1
+	conn = &schemaConn{}
+	if _, err := NewAuthifyDBFromConn(conn, cfg); err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	for _, sql := range conn.executed {
+		if strings.Contains(sql, "users_password_history") {
+			t.Errorf("expected no password history table when only the current password is refused, got %s", sql)
+		}
+	}
+}
+
+func TestPasswordHistoryPostgres(t *testing.T) {
+	connString := os.Getenv(testDatabaseURLEnv)
+	if connString == "" {
+		t.Skipf("%s is not set", testDatabaseURLEnv)
+	}
+
+	cfg := loadTestConfig(fmt.Sprintf("authify_history_%d", time.Now().UnixNano()))
+	cfg.AutoCreate = true
+	cfg.PasswordHistory = 2
+	db, err := NewAuthifyDB(connString, cfg)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, table := range []string{cfg.Name, db.passwordHistoryTable()} {
+			if _, err := db.conn.Exec(context.Background(), `DROP TABLE IF EXISTS "`+table+`"`); err != nil {
+				t.Errorf("failed to drop %s: %v", table, err)
+			}
+		}
+		db.Close()
+	})
+
+	if _, err := db.CreateUser(map[string]any{"username": "alice", "password": "first"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if err := db.ReplacePassword("alice", "second"); err != nil {
+		t.Fatalf("failed to replace password: %v", err)
+	}
+	for _, password := range []string{"first", "second"} {
+		if err := db.ReplacePassword("alice", password); !errors.Is(err, ErrPasswordReused) {
+			t.Errorf("expected ErrPasswordReused for %s, got %v", password, err)
+		}
+	}
+	if err := db.ReplacePassword("alice", "third"); err != nil {
+		t.Fatalf("failed to replace password: %v", err)
+	}
+	if err := db.ReplacePassword("alice", "first"); err != nil {
+		t.Errorf("expected the pruned password to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package stores
+
+import (
+	"context"
+	"sync"
+)
+
+// InvalidationKind tells what changed in the store, see Invalidation
+type InvalidationKind string
+
+const (
+	// InvalidatePassword is published when the password of a user changes
+	InvalidatePassword InvalidationKind = "password"
+	// InvalidateRole is published when the role of a user changes
+	InvalidateRole InvalidationKind = "role"
+	// InvalidateStatus is published when a user is disabled or enabled
+	InvalidateStatus InvalidationKind = "status"
+	// InvalidateTokenVersion is published when the token version of a user is bumped
+	InvalidateTokenVersion InvalidationKind = "token_version"
+	// InvalidateDeleted is published by applications deleting users from the store, which
+	// authify itself never does
+	InvalidateDeleted InvalidationKind = "deleted"
+	// InvalidateNotBefore is published when the global not-before time changes, for every user
+	InvalidateNotBefore InvalidationKind = "not_before"
+	// InvalidateAll asks subscribers to drop everything they cached, e.g. after notifications
+	// may have been missed
+	InvalidateAll InvalidationKind = "all"
+)
+
+// Invalidation is a message of an InvalidationBus: Username changed, Kind telling how.
+// Username is empty for InvalidateNotBefore and InvalidateAll, which concern every user.
+type Invalidation struct {
+	Kind     InvalidationKind `json:"kind"`
+	Username string           `json:"username,omitempty"`
+}
+
+// InvalidationBus carries the changes of the store to the caches of every replica sharing it,
+// so a replica does not keep serving what another one changed until its cache expires.
+// Subscribers are called one message at a time, and must not block.
+type InvalidationBus interface {
+	// Publish sends inv to the subscribers of every replica, this one included
+	Publish(ctx context.Context, inv Invalidation) error
+	// Subscribe calls fn with every message published from then on, until unsubscribe is called
+	Subscribe(fn func(Invalidation)) (unsubscribe func())
+	// Close stops delivering messages
+	Close() error
+}
+
+// LocalInvalidationBus delivers its messages to the subscribers of its own process only,
+// enough for a single replica, see PGInvalidationBus for more.
+type LocalInvalidationBus struct {
+	mu          sync.Mutex
+	subscribers map[int]func(Invalidation)
+	next        int
+}
+
+// NewLocalInvalidationBus returns a bus delivering messages within the process
+func NewLocalInvalidationBus() *LocalInvalidationBus {
+	return &LocalInvalidationBus{subscribers: make(map[int]func(Invalidation))}
+}
+
+// Publish calls the subscribers with inv before returning
+func (b *LocalInvalidationBus) Publish(ctx context.Context, inv Invalidation) error {
+	b.deliver(inv)
+	return nil
+}
+
+// Subscribe calls fn with every message published from then on, until unsubscribe is called
+func (b *LocalInvalidationBus) Subscribe(fn func(Invalidation)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// Close does nothing, messages are delivered as they are published
+func (b *LocalInvalidationBus) Close() error {
+	return nil
+}
+
+// deliver calls every subscriber with inv, one message at a time
+func (b *LocalInvalidationBus) deliver(inv Invalidation) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, fn := range b.subscribers {
+		fn(inv)
+	}
+}
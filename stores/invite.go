@@ -0,0 +1,150 @@
+package stores
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// inviteIDBytes is the size of invite IDs, which name invites in listings but grant nothing
+const inviteIDBytes = 8
+
+// Invite lets users sign up while registration requires invites, see authify.RegistrationInvite.
+// The code handed out to invitees is only returned when the invite is created, the store keeps
+// its SHA-256 hash, like the secrets of service accounts.
+type Invite struct {
+	ID string `json:"id"`
+	// CodeHash is the SHA-256 hash of the code, the code itself is never stored
+	CodeHash string `json:"-"`
+	// MaxUses is the number of users the invite can sign up, unlimited when zero
+	MaxUses int `json:"max_uses"`
+	Uses    int `json:"uses"`
+	// ExpiresAt is when the invite stops working, never when zero
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// check fails with ErrInviteExpired or ErrInviteUsedUp when the invite cannot be used at now
+func (i Invite) check(now time.Time) error {
+	if !i.ExpiresAt.IsZero() && !now.Before(i.ExpiresAt) {
+		return fmt.Errorf("%w: %s", ErrInviteExpired, i.ID)
+	}
+	if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+		return fmt.Errorf("%w: %s", ErrInviteUsedUp, i.ID)
+	}
+	return nil
+}
+
+// InviteStore keeps the invites of registrations. ConsumeInvite checks and uses an invite in a
+// single step, so concurrent sign ups never use an invite more than it allows: of two sign ups
+// racing for the last use of an invite, exactly one gets it.
+type InviteStore interface {
+	// CreateInvite records an invite usable maxUses times, unlimited when zero, until expiresAt,
+	// forever when zero, and returns its code.
+	CreateInvite(ctx context.Context, maxUses int, expiresAt time.Time) (code string, invite Invite, err error)
+	// ListInvites returns every invite, used up and expired ones included, by creation time.
+	ListInvites(ctx context.Context) ([]Invite, error)
+	// ConsumeInvite uses the invite of code once, failing with ErrInviteNotFound for unknown
+	// codes, ErrInviteExpired and ErrInviteUsedUp.
+	ConsumeInvite(ctx context.Context, code string) (Invite, error)
+	// ReleaseInvite gives back a use of the invite of id taken by ConsumeInvite, for sign ups
+	// failing afterwards. Unknown invites and invites without uses are left alone.
+	ReleaseInvite(ctx context.Context, id string) error
+}
+
+// newInvite returns an invite with a new ID and code, and the code
+func newInvite(maxUses int, expiresAt time.Time) (string, Invite, error) {
+	if maxUses < 0 {
+		return "", Invite{}, fmt.Errorf("%w: max_uses must not be negative", ErrMissingField)
+	}
+	id := make([]byte, inviteIDBytes)
+	if _, err := rand.Read(id); err != nil {
+		return "", Invite{}, err
+	}
+	// codes carry 256 bits of entropy like client secrets, so a fast hash is enough to store them
+	code, hash, err := newClientSecret()
+	if err != nil {
+		return "", Invite{}, err
+	}
+	invite := Invite{
+		ID:        hex.EncodeToString(id),
+		CodeHash:  hash,
+		MaxUses:   maxUses,
+		CreatedAt: time.Now().UTC(),
+	}
+	if !expiresAt.IsZero() {
+		invite.ExpiresAt = expiresAt.UTC()
+	}
+	return code, invite, nil
+}
+
+// InMemoryInviteStore keeps invites in memory, for tests and single instance deployments
+type InMemoryInviteStore struct {
+	mu      sync.Mutex
+	invites map[string]Invite // by code hash
+}
+
+func NewInMemoryInviteStore() *InMemoryInviteStore {
+	return &InMemoryInviteStore{invites: make(map[string]Invite)}
+}
+
+// CreateInvite records an invite and returns its code, see InviteStore
+func (s *InMemoryInviteStore) CreateInvite(ctx context.Context, maxUses int, expiresAt time.Time) (string, Invite, error) {
+	code, invite, err := newInvite(maxUses, expiresAt)
+	if err != nil {
+		return "", Invite{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invites[invite.CodeHash] = invite
+	return code, invite, nil
+}
+
+// ListInvites returns every invite by creation time
+func (s *InMemoryInviteStore) ListInvites(ctx context.Context) ([]Invite, error) {
+	s.mu.Lock()
+	invites := make([]Invite, 0, len(s.invites))
+	for _, invite := range s.invites {
+		invites = append(invites, invite)
+	}
+	s.mu.Unlock()
+	slices.SortFunc(invites, func(a, b Invite) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return invites, nil
+}
+
+// ConsumeInvite uses the invite of code once, see InviteStore
+func (s *InMemoryInviteStore) ConsumeInvite(ctx context.Context, code string) (Invite, error) {
+	hash := hashClientSecret(code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.invites[hash]
+	if !ok || code == "" {
+		return Invite{}, ErrInviteNotFound
+	}
+	if err := invite.check(time.Now()); err != nil {
+		return Invite{}, err
+	}
+	invite.Uses++
+	s.invites[hash] = invite
+	return invite, nil
+}
+
+// ReleaseInvite gives back a use of the invite of id, see InviteStore
+func (s *InMemoryInviteStore) ReleaseInvite(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, invite := range s.invites {
+		if invite.ID == id && invite.Uses > 0 {
+			invite.Uses--
+			s.invites[hash] = invite
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testInviteStore runs the checks every InviteStore passes
+func testInviteStore(t *testing.T, s InviteStore) {
+	ctx := context.Background()
+
+	code, invite, err := s.CreateInvite(ctx, 2, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	if code == "" || invite.ID == "" || invite.CodeHash == code {
+		t.Fatalf("expected a code kept as a hash, got %q and %+v", code, invite)
+	}
+	for i := 1; i <= 2; i++ {
+		used, err := s.ConsumeInvite(ctx, code)
+		if err != nil {
+			t.Fatalf("failed to consume invite: %v", err)
+		}
+		if used.ID != invite.ID || used.Uses != i {
+			t.Errorf("expected use %d of %s, got %+v", i, invite.ID, used)
+		}
+	}
+	if _, err := s.ConsumeInvite(ctx, code); !errors.Is(err, ErrInviteUsedUp) {
+		t.Errorf("expected ErrInviteUsedUp, got %v", err)
+	}
+	if err := s.ReleaseInvite(ctx, invite.ID); err != nil {
+		t.Fatalf("failed to release invite: %v", err)
+	}
+	if used, err := s.ConsumeInvite(ctx, code); err != nil || used.Uses != 2 {
+		t.Errorf("expected the released use to be usable again, got %+v (%v)", used, err)
+	}
+	if err := s.ReleaseInvite(ctx, "unknown"); err != nil {
+		t.Errorf("expected unknown invites to be left alone, got %v", err)
+	}
+	if _, err := s.ConsumeInvite(ctx, "unknown"); !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("expected ErrInviteNotFound, got %v", err)
+	}
+	if _, err := s.ConsumeInvite(ctx, ""); !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("expected ErrInviteNotFound for an empty code, got %v", err)
+	}
+
+	expiredCode, _, err := s.CreateInvite(ctx, 0, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	if _, err := s.ConsumeInvite(ctx, expiredCode); !errors.Is(err, ErrInviteExpired) {
+		t.Errorf("expected ErrInviteExpired, got %v", err)
+	}
+
+	unlimitedCode, _, err := s.CreateInvite(ctx, 0, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+	for range 3 {
+		if _, err := s.ConsumeInvite(ctx, unlimitedCode); err != nil {
+			t.Errorf("expected an unlimited invite to be usable, got %v", err)
+		}
+	}
+
+	if _, _, err := s.CreateInvite(ctx, -1, time.Time{}); !errors.Is(err, ErrMissingField) {
+		t.Errorf("expected ErrMissingField for negative max uses, got %v", err)
+	}
+
+	invites, err := s.ListInvites(ctx)
+	if err != nil {
+		t.Fatalf("failed to list invites: %v", err)
+	}
+	if len(invites) != 3 || invites[0].ID != invite.ID || invites[0].Uses != 2 || invites[2].Uses != 3 {
+		t.Errorf("expected the 3 invites by creation time, got %+v", invites)
+	}
+}
+
+// testInviteRace checks that of many sign ups racing for a single use invite, exactly one gets it
+func testInviteRace(t *testing.T, s InviteStore) {
+	code, _, err := s.CreateInvite(context.Background(), 1, time.Time{})
+	if err != nil {
+		t.Fatalf("failed to create invite: %v", err)
+	}
+
+	const racers = 20
+	errs := make(chan error, racers)
+	var wg sync.WaitGroup
+	for range racers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.ConsumeInvite(context.Background(), code)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	won := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, ErrInviteUsedUp):
+			t.Errorf("expected ErrInviteUsedUp for the losers, got %v", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("expected exactly one use of the invite, got %d", won)
+	}
+}
+
+func TestInMemoryInviteStore(t *testing.T) {
+	testInviteStore(t, NewInMemoryInviteStore())
+}
+
+func TestInMemoryInviteRace(t *testing.T) {
+	testInviteRace(t, NewInMemoryInviteStore())
+}
+
+func TestInviteStorePostgres(t *testing.T) {
+	connString := os.Getenv(testDatabaseURLEnv)
+	if connString == "" {
+		t.Skipf("%s is not set", testDatabaseURLEnv)
+	}
+
+	cfg := loadTestConfig(fmt.Sprintf("authify_invites_%d", time.Now().UnixNano()))
+	cfg.AutoCreate = true
+	db, err := NewAuthifyDB(connString, cfg)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	invites, err := db.NewInviteStore()
+	if err != nil {
+		t.Fatalf("failed to create invite store: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, table := range []string{cfg.Name, invites.table} {
+			if _, err := db.conn.Exec(context.Background(), `DROP TABLE IF EXISTS "`+table+`"`); err != nil {
+				t.Errorf("failed to drop %s: %v", table, err)
+			}
+		}
+		db.Close()
+	})
+
+	testInviteStore(t, invites)
+	testInviteRace(t, invites)
+}
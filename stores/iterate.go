@@ -0,0 +1,34 @@
+package stores
+
+import "context"
+
+// DefaultIterateBatchSize is the number of users IterateUsers fetches at a time when given
+// a batch size of zero or less
+const DefaultIterateBatchSize = 500
+
+// iterateUsers calls fn for every user of the pages returned by list, one page of batchSize
+// users at a time, so memory stays flat however large the table is
+func iterateUsers(ctx context.Context, batchSize int, list func(ctx context.Context, after string, limit int) ([]map[string]string, string, error), fn func(user map[string]string) error) error {
+	if batchSize <= 0 {
+		batchSize = DefaultIterateBatchSize
+	}
+	after := ""
+	for {
+		users, next, err := list(ctx, after, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		after = next
+	}
+}
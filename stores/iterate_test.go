@@ -0,0 +1,275 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// pageConn answers every query with no rows, recording the statements it ran and their arguments,
+// and fails the queries selecting its missing column like postgres does
+type pageConn struct {
+	queries []string
+	args    [][]any
+	missing string
+}
+
+func (c *pageConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, errors.New("unexpected statement: " + sql)
+}
+
+func (c *pageConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	c.queries = append(c.queries, sql)
+	c.args = append(c.args, args)
+	if c.missing != "" && strings.Contains(sql, `"`+c.missing+`"`) {
+		return nil, &pgconn.PgError{Code: pgUndefinedColumn, Message: fmt.Sprintf("column %q does not exist", c.missing)}
+	}
+	return &countRows{read: true}, nil
+}
+
+func newIterateStore(t testing.TB, usernames ...string) *InMemoryUserStore {
+	t.Helper()
+	m := NewInMemoryUserStore(loadTestConfig("users"))
+	for _, username := range usernames {
+		if _, err := m.CreateUser(map[string]any{"username": username, "password": "password123", "email": username + "@example.com"}); err != nil {
+			t.Fatalf("failed to create %s: %v", username, err)
+		}
+	}
+	return m
+}
+
+func TestIterateUsers(t *testing.T) {
+	m := newIterateStore(t, "erin", "alice", "dave", "carol", "bob", "frank", "grace")
+
+	var got []string
+	err := m.IterateUsers(context.Background(), 3, func(user map[string]string) error {
+		if _, ok := user["password"]; ok {
+			t.Errorf("expected the hidden password to be left out, got %v", user)
+		}
+		if user["email"] != user["username"]+"@example.com" {
+			t.Errorf("expected the visible columns, got %v", user)
+		}
+		got = append(got, user["username"])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestIterateUsersAbort(t *testing.T) {
+	m := newIterateStore(t, "alice", "bob", "carol", "dave", "erin")
+
+	errStop := errors.New("stop")
+	calls := 0
+	err := m.IterateUsers(context.Background(), 2, func(user map[string]string) error {
+		calls++
+		if calls == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) || calls != 3 {
+		t.Errorf("expected the iteration to stop with the callback's error after 3 users, got %v after %d", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = m.IterateUsers(ctx, 2, func(user map[string]string) error {
+		calls++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || calls != 2 {
+		t.Errorf("expected the iteration to stop after the cancelled batch, got %v after %d", err, calls)
+	}
+}
+
+func TestIterateUsersEmpty(t *testing.T) {
+	m := newIterateStore(t)
+	err := m.IterateUsers(context.Background(), 0, func(user map[string]string) error {
+		t.Errorf("expected no users, got %v", user)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users, next, err := m.ListUsers(context.Background(), "", 10); err != nil || len(users) != 0 || next != "" {
+		t.Errorf("expected an empty last page, got %v %q (%v)", users, next, err)
+	}
+}
+
+func TestListUsersPages(t *testing.T) {
+	m := newIterateStore(t, "carol", "alice", "bob")
+	if err := m.SetUserDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+
+	users, next, err := m.ListUsers(context.Background(), "", 2)
+	if err != nil || len(users) != 2 || users[0]["username"] != "alice" || users[1]["username"] != "bob" || next != "bob" {
+		t.Fatalf("unexpected first page %v %q (%v)", users, next, err)
+	}
+	if users[0]["disabled"] != "false" || users[1]["disabled"] != "true" {
+		t.Errorf("expected the disabled flags to be reported, got %v", users)
+	}
+	users, next, err = m.ListUsers(context.Background(), next, 2)
+	if err != nil || len(users) != 1 || users[0]["username"] != "carol" || next != "" {
+		t.Fatalf("unexpected last page %v %q (%v)", users, next, err)
+	}
+	// a full last page is known to be the last
+	if _, next, _ := m.ListUsers(context.Background(), "", 3); next != "" {
+		t.Errorf("expected no next page, got %q", next)
+	}
+}
+
+func TestListUsersQuery(t *testing.T) {
+	cfg := loadTestConfig("users")
+	cfg.SoftDelete = true
+	conn := &pageConn{}
+	db, err := NewAuthifyDBFromConn(conn, cfg)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if _, _, err := db.ListUsers(context.Background(), "", 50); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.ListUsers(context.Background(), "bob", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`SELECT "username","email","disabled" FROM "users" WHERE "deleted_at" IS NULL ORDER BY "username" LIMIT 51`,
+		`SELECT "username","email","disabled" FROM "users" WHERE "username" > $1 AND "deleted_at" IS NULL ORDER BY "username" LIMIT 51`,
+	}
+	if !slices.Equal(conn.queries, want) {
+		t.Errorf("expected keyset queries %q, got %q", want, conn.queries)
+	}
+	if len(conn.args[1]) != 1 || conn.args[1][0] != "bob" {
+		t.Errorf("expected the cursor as argument, got %v", conn.args[1])
+	}
+
+	cfg = StoreConfig{Name: "accounts", Columns: map[string]ColumnConfig{
+		"id":       {Type: "int", PrimaryKey: true},
+		"password": {Type: "text", Hidden: true, IsPassword: true},
+	}}
+	conn = &pageConn{}
+	db, err = NewAuthifyDBFromConn(conn, cfg)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	db.ListUsers(context.Background(), "10", 5)
+	if want := `SELECT "id","disabled" FROM "accounts" WHERE "id" > $1::text::int ORDER BY "id" LIMIT 6`; conn.queries[0] != want {
+		t.Errorf("expected the cursor to be cast to the key type, got %q", conn.queries[0])
+	}
+}
+
+func TestListUsersWithoutDisabledColumn(t *testing.T) {
+	conn := &pageConn{missing: "disabled"}
+	db, err := NewAuthifyDBFromConn(conn, loadTestConfig("users"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	for range 2 {
+		if _, _, err := db.ListUsers(context.Background(), "", 10); err != nil {
+			t.Fatalf("expected tables without the disabled column to be listed, got %v", err)
+		}
+	}
+	want := []string{
+		`SELECT "username","email","disabled" FROM "users" ORDER BY "username" LIMIT 11`,
+		`SELECT "username","email" FROM "users" ORDER BY "username" LIMIT 11`,
+		`SELECT "username","email" FROM "users" ORDER BY "username" LIMIT 11`,
+	}
+	if !slices.Equal(conn.queries, want) {
+		t.Errorf("expected the missing column to be left out from then on, got %q", conn.queries)
+	}
+
+	if _, err := db.IsUserDisabled("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected the user to be looked up without the column, got %v", err)
+	}
+}
+
+func TestIterateUsersPostgres(t *testing.T) {
+	connString := os.Getenv(testDatabaseURLEnv)
+	if connString == "" {
+		t.Skipf("%s is not set", testDatabaseURLEnv)
+	}
+
+	cfg := loadTestConfig(fmt.Sprintf("authify_iterate_%d", time.Now().UnixNano()))
+	cfg.AutoCreate = true
+	db, err := NewAuthifyDB(connString, cfg)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.conn.Exec(context.Background(), `DROP TABLE IF EXISTS "`+cfg.Name+`"`); err != nil {
+			t.Errorf("failed to drop %s: %v", cfg.Name, err)
+		}
+		db.Close()
+	})
+
+	if err := db.IterateUsers(context.Background(), 2, func(map[string]string) error {
+		return errors.New("expected no users")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"alice", "bob", "carol", "dave", "erin"}
+	for _, username := range slices.Backward(want) {
+		if _, err := db.CreateUser(map[string]any{"username": username, "password": "password123"}); err != nil {
+			t.Fatalf("failed to create %s: %v", username, err)
+		}
+	}
+
+	var got []string
+	err = db.IterateUsers(context.Background(), 2, func(user map[string]string) error {
+		if _, ok := user["password"]; ok {
+			t.Errorf("expected the hidden password to be left out, got %v", user)
+		}
+		got = append(got, user["username"])
+		return nil
+	})
+	if err != nil || !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v (%v)", want, got, err)
+	}
+}
+
+// BenchmarkIterateUsers goes through 10k and 100k synthetic users in batches of 1000. The users
+// are dropped by the callback, so the bytes allocated per user staying the same at both sizes
+// shows iteration only ever holds one batch, rather than a copy of the table.
+func BenchmarkIterateUsers(b *testing.B) {
+	for _, size := range []int{10_000, 100_000} {
+		m := newIterateStore(b)
+		for i := range size {
+			username := fmt.Sprintf("user%06d", i)
+			m.users[username] = map[string]string{"username": username, "password": "hash", "email": username + "@example.com"}
+		}
+
+		b.Run(fmt.Sprintf("users=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for b.Loop() {
+				count := 0
+				if err := m.IterateUsers(context.Background(), 1000, func(map[string]string) error {
+					count++
+					return nil
+				}); err != nil || count != size {
+					b.Fatalf("expected %d users, got %d (%v)", size, count, err)
+				}
+			}
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/float64(b.N*size), "B/user")
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ContextHasher is implemented by hashers that can give up on a password hash
+// once the caller's context is done.
+type ContextHasher interface {
+	HashContext(ctx context.Context, password string) (string, error)
+}
+
+// LimitedHasher bounds the number of concurrent hashing operations of the wrapped hasher,
+// so a burst of create-user or login requests cannot exhaust the CPU with expensive hashes.
+// At most concurrency hashes run at once and at most queue callers wait for a free slot,
+// any further caller fails right away with ErrHashingBusy. Callers waiting longer than
+// timeout, or whose context is done, stop waiting and get ErrHashingBusy as well.
+type LimitedHasher struct {
+	hasher     PasswordHasher
+	slots      chan struct{}
+	waiting    atomic.Int64
+	maxWaiting int64
+	timeout    time.Duration
+}
+
+// NewLimitedHasher wraps hasher in a pool of concurrency slots, a zero timeout waits
+// as long as the caller's context allows.
+func NewLimitedHasher(hasher PasswordHasher, concurrency, queue int, timeout time.Duration) *LimitedHasher {
+	return &LimitedHasher{
+		hasher:     hasher,
+		slots:      make(chan struct{}, concurrency),
+		maxWaiting: int64(queue),
+		timeout:    timeout,
+	}
+}
+
+func (l *LimitedHasher) Hash(password string) (string, error) {
+	return l.HashContext(context.Background(), password)
+}
+
+func (l *LimitedHasher) HashContext(ctx context.Context, password string) (string, error) {
+	var hash string
+	err := l.run(ctx, func() error {
+		var err error
+		hash, err = l.hasher.Hash(password)
+		return err
+	})
+	return hash, err
+}
+
+func (l *LimitedHasher) Compare(hash, password string) error {
+	return l.run(context.Background(), func() error {
+		return comparePassword(l.hasher, hash, password)
+	})
+}
+
+// NeedsRehash forwards to the wrapped hasher, if it supports rehash checks
+func (l *LimitedHasher) NeedsRehash(hash string) bool {
+	checker, ok := l.hasher.(RehashChecker)
+	return ok && checker.NeedsRehash(hash)
+}
+
+// run executes work once a slot is free. If ctx is done before work completes, run returns
+// immediately while work finishes in the background and only then frees its slot.
+func (l *LimitedHasher) run(ctx context.Context, work func() error) error {
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	if err := l.acquire(ctx); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-l.slots }()
+		done <- work()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrHashingBusy, ctx.Err())
+	}
+}
+
+func (l *LimitedHasher) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if l.waiting.Add(1) > l.maxWaiting {
+		l.waiting.Add(-1)
+		return ErrHashingBusy
+	}
+	defer l.waiting.Add(-1)
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrHashingBusy, ctx.Err())
+	}
+}
+
+// hashPassword hashes through the context aware path when the hasher supports it
+func hashPassword(ctx context.Context, hasher PasswordHasher, password string) (string, error) {
+	if ctxHasher, ok := hasher.(ContextHasher); ok {
+		return ctxHasher.HashContext(ctx, password)
+	}
+	return hasher.Hash(password)
+}
@@ -0,0 +1,91 @@
+package stores
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// memSnapshot is the content of the file of an InMemoryUserStore with persistence
+type memSnapshot struct {
+	Users           map[string]map[string]string `json:"users"`
+	Sequences       map[string]int               `json:"sequences,omitempty"`
+	GlobalNotBefore time.Time                    `json:"global_not_before,omitzero"`
+	PasswordHistory map[string][]string          `json:"password_history,omitempty"`
+}
+
+// WithPersistence keeps the users in the JSON file at path, so they survive restarts. The users
+// of an existing file are loaded now, replacing the ones of the store, and the whole file is
+// rewritten after every change, through a temporary file renamed over it so a crash never leaves
+// it half written. A change that cannot be written is kept in memory and its error returned.
+//
+// This is meant for local development, without a database: every write rewrites all the users,
+// and two stores must never share a file. Do not use it in production.
+func (m *InMemoryUserStore) WithPersistence(path string) (*InMemoryUserStore, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read users from %s: %w", path, err)
+	default:
+		var snapshot memSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("failed to read users from %s: %w", path, err)
+		}
+		m.users = snapshot.Users
+		if m.users == nil {
+			m.users = make(map[string]map[string]string)
+		}
+		m.sequences = snapshot.Sequences
+		m.globalNotBefore = snapshot.GlobalNotBefore
+		m.passwordHistory = snapshot.PasswordHistory
+	}
+	m.persistPath = path
+	return m, nil
+}
+
+// persist writes the users to the file of WithPersistence, if any, callers must hold the write lock
+func (m *InMemoryUserStore) persist() error {
+	if m.persistPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(memSnapshot{
+		Users:           m.users,
+		Sequences:       m.sequences,
+		GlobalNotBefore: m.globalNotBefore,
+		PasswordHistory: m.passwordHistory,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to persist users: %w", err)
+	}
+
+	// the temporary file is created next to the target, as renames do not cross file systems,
+	// and only readable by its owner since it holds password hashes
+	tmp, err := os.CreateTemp(filepath.Dir(m.persistPath), filepath.Base(m.persistPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to persist users: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to persist users: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to persist users: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to persist users: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.persistPath); err != nil {
+		return fmt.Errorf("failed to persist users: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package stores
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInMemoryPersistence(t *testing.T) {
+	cfg := loadTestConfig("users")
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := NewInMemoryUserStore(cfg).WithPersistence(path)
+	if err != nil {
+		t.Fatalf("expected a missing file to start empty, got %v", err)
+	}
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateUser(map[string]any{"username": "bob", "password": "password123"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateUser("alice", map[string]any{"password": "newpassword"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUserDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+	notBefore := time.Now().Truncate(time.Second)
+	if err := store.SetGlobalNotBefore(notBefore); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("expected the users to be written, got %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected the file to be private, got %v", perm)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected no temporary file to be left, got %d files", len(entries))
+	}
+
+	// a new store picks the users up where the previous one left them
+	restarted, err := NewInMemoryUserStore(cfg).WithPersistence(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.GetUserInfo("alice", "newpassword"); err != nil {
+		t.Errorf("expected alice to log in with the new password, got %v", err)
+	}
+	if disabled, err := restarted.IsUserDisabled("bob"); err != nil || !disabled {
+		t.Errorf("expected bob to stay disabled, got %v (%v)", disabled, err)
+	}
+	if got, _ := restarted.GetGlobalNotBefore(); !got.Equal(notBefore) {
+		t.Errorf("expected the global not before %v, got %v", notBefore, got)
+	}
+	if count, _ := restarted.CountUsers(); count != 2 {
+		t.Errorf("expected 2 users, got %d", count)
+	}
+}
+
+func TestInMemoryPersistenceCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewInMemoryUserStore(loadTestConfig("users")).WithPersistence(path); err == nil {
+		t.Error("expected an error for a corrupt file, rather than overwriting it")
+	}
+}
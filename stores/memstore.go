@@ -1,9 +1,13 @@
 package stores
 
 import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
 	"sync"
-
-	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
 // InMemoryUserStore is a config-driven, in-memory implementation of Store
@@ -11,14 +15,50 @@ type InMemoryUserStore struct {
 	mu       sync.RWMutex
 	users    map[string]map[string]string
 	storeCfg StoreConfig
+	hasher   PasswordHasher
+	dummy    dummyHash
+
+	// last value of each column filled by a sequence generator
+	sequences map[string]int
+
+	// tokens issued before it are rejected, see SetGlobalNotBefore
+	globalNotBefore time.Time
+
+	// hashes of the previous passwords of each user, the latest first, see ReplacePassword
+	passwordHistory map[string][]string
+
+	// file the users are written to after every change, see WithPersistence
+	persistPath string
 }
 
 // NewInMemoryUserStore initializes a new in-memory store using table config
+// It panics on an unknown password_hasher in the config, see NewInMemoryUserStoreChecked.
 func NewInMemoryUserStore(cfg StoreConfig) *InMemoryUserStore {
+	m, err := NewInMemoryUserStoreChecked(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// NewInMemoryUserStoreChecked is NewInMemoryUserStore for configs read at runtime: an unknown
+// password_hasher fails with ErrUnsupportedHasher, like it does for the postgres store.
+func NewInMemoryUserStoreChecked(cfg StoreConfig) (*InMemoryUserStore, error) {
+	hasher, err := hasherFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &InMemoryUserStore{
 		users:    make(map[string]map[string]string),
 		storeCfg: cfg,
-	}
+		hasher:   hasher,
+	}, nil
+}
+
+// WithPasswordHasher overrides the hasher selected by the store config
+func (m *InMemoryUserStore) WithPasswordHasher(h PasswordHasher) *InMemoryUserStore {
+	m.hasher = h
+	return m
 }
 
 // StoreConfig exposes the schema config
@@ -26,70 +66,372 @@ func (m *InMemoryUserStore) StoreConfig() StoreConfig {
 	return m.storeCfg
 }
 
-// CreateUser creates a user using dynamic fields defined in config
-func (m *InMemoryUserStore) CreateUser(data map[string]any) error {
+// Close does nothing, the users are kept in memory
+func (m *InMemoryUserStore) Close() error {
+	return nil
+}
+
+// GetGlobalNotBefore returns the time set by SetGlobalNotBefore, zero until it is called
+func (m *InMemoryUserStore) GetGlobalNotBefore() (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.globalNotBefore, nil
+}
+
+// SetGlobalNotBefore invalidates every token issued before t
+func (m *InMemoryUserStore) SetGlobalNotBefore(t time.Time) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.globalNotBefore = t
+	return m.persist()
+}
+
+// CreateUser creates a user using dynamic fields defined in config and returns its non-hidden
+// fields, with the values filled in for defaults and generators
+func (m *InMemoryUserStore) CreateUser(data map[string]any) (map[string]string, error) {
+	return m.CreateUserContext(context.Background(), data)
+}
 
+// CreateUserContext is CreateUser, giving up on password hashing once ctx is done. The user is
+// built, and its password hashed, before the write lock is taken, so a slow hash does not hold
+// up the logins reading the store.
+func (m *InMemoryUserStore) CreateUserContext(ctx context.Context, data map[string]any) (map[string]string, error) {
 	username, ok := data["username"].(string)
 	if !ok {
-		return ErrUserNotFound
+		return nil, fmt.Errorf("%w: username", ErrMissingField)
+	}
+	if err := m.storeCfg.ValidateInput(data); err != nil {
+		return nil, err
+	}
+	if m.exists(username) {
+		return nil, fmt.Errorf("%w: %s", ErrUserExists, username)
+	}
+	user, sequences, err := m.newUser(ctx, data)
+	if err != nil {
+		return nil, err
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// another call may have created the user while this one was hashing
 	if _, exists := m.users[username]; exists {
-		return ErrUserExists
+		return nil, fmt.Errorf("%w: %s", ErrUserExists, username)
+	}
+	for _, name := range sequences {
+		if m.sequences == nil {
+			m.sequences = make(map[string]int)
+		}
+		m.sequences[name]++
+		user[name] = strconv.Itoa(m.sequences[name])
+	}
+	m.users[username] = user
+	if err := m.persist(); err != nil {
+		return nil, err
+	}
+	return m.storeCfg.visibleFields(user), nil
+}
+
+// exists reports whether a user is stored under username
+func (m *InMemoryUserStore) exists(username string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.users[username]
+	return ok
+}
+
+// newUser returns the stored fields of a new user, its password hashed, and the columns left to
+// sequence generators, which are filled in under the write lock. It does not lock the store.
+func (m *InMemoryUserStore) newUser(ctx context.Context, data map[string]any) (map[string]string, []string, error) {
+	if err := m.storeCfg.checkRoleField(data); err != nil {
+		return nil, nil, err
 	}
 
 	user := make(map[string]string)
+	var sequences []string
 
 	for name, cfg := range m.storeCfg.Columns {
 		val, ok := data[name].(string)
 
-		if cfg.Required && !ok && cfg.Default == "" {
-			return ErrInvalidPassword
+		if cfg.Required && !ok && cfg.Default == "" && cfg.Generator == "" {
+			return nil, nil, fmt.Errorf("%w: %s", ErrMissingField, name)
 		}
 
 		if !ok {
-			if cfg.Default != "" {
+			switch {
+			case cfg.Generator == GeneratorSequence:
+				sequences = append(sequences, name)
+				continue
+			case cfg.Generator != "":
+				generated, err := cfg.generate()
+				if err != nil {
+					return nil, nil, err
+				}
+				val = formatColumnValue(generated)
+			case cfg.isGeneratedDefault():
+				generated, err := cfg.generateDefault()
+				if err != nil {
+					return nil, nil, err
+				}
+				val = generated
+			case cfg.Default != "":
 				val = cfg.Default
-			} else {
+			default:
 				continue
 			}
 		}
 
 		if name == "password" {
-			hash, err := bcrypt.GenerateFromPassword([]byte(val), bcrypt.DefaultCost)
+			hash, err := hashPassword(ctx, m.hasher, val)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
-			val = string(hash)
+			val = hash
 		}
 
 		user[name] = val
 	}
+	return user, sequences, nil
+}
 
-	m.users[username] = user
-	return nil
+// CreateUserReturning is CreateUser, which returns the created user since it is part of Store.
+func (m *InMemoryUserStore) CreateUserReturning(data map[string]any) (map[string]string, error) {
+	return m.CreateUser(data)
 }
 
-// GetUserInfo authenticates and returns non-hidden user fields
-func (m *InMemoryUserStore) GetUserInfo(username, password string) (map[string]any, error) {
+// UpdateUser overwrites the given fields of an existing user, hashing the password if present.
+// With token_versions enabled, a new password bumps the token version of the user.
+// The password is hashed before the write lock is taken, like by CreateUserContext.
+func (m *InMemoryUserStore) UpdateUser(username string, data map[string]any) error {
+	if !m.exists(username) {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if err := m.storeCfg.ValidateInput(data); err != nil {
+		return err
+	}
+	if err := m.storeCfg.checkRoleField(data); err != nil {
+		return err
+	}
+	var hash string
+	if password, ok := data["password"].(string); ok {
+		var err error
+		if hash, err = m.hasher.Hash(password); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+
+	for name, raw := range data {
+		if _, ok := m.storeCfg.Columns[name]; !ok {
+			continue
+		}
+		val, ok := raw.(string)
+		if !ok {
+			continue
+		}
+
+		if name == "password" {
+			val = hash
+			if m.storeCfg.TokenVersions {
+				bumpTokenVersion(user)
+			}
+		}
+
+		user[name] = val
+	}
+
+	return m.persist()
+}
+
+// TokenVersion returns the token version of a user, 0 until it is first bumped
+func (m *InMemoryUserStore) TokenVersion(username string) (int, error) {
+	if !m.storeCfg.TokenVersions {
+		return 0, ErrTokenVersionsDisabled
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	user, exists := m.users[username]
 	if !exists {
-		return nil, ErrUserNotFound
+		return 0, fmt.Errorf("%w: %s", ErrUserNotFound, username)
 	}
+	version, _ := strconv.Atoi(user[tokenVersionColumn])
+	return version, nil
+}
 
-	hashed, ok := user["password"]
-	if !ok {
-		return nil, ErrInvalidPassword
+// BumpTokenVersion increments the token version of a user, invalidating the tokens issued before
+func (m *InMemoryUserStore) BumpTokenVersion(username string) error {
+	if !m.storeCfg.TokenVersions {
+		return ErrTokenVersionsDisabled
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	bumpTokenVersion(user)
+	return m.persist()
+}
+
+func bumpTokenVersion(user map[string]string) {
+	version, _ := strconv.Atoi(user[tokenVersionColumn])
+	user[tokenVersionColumn] = strconv.Itoa(version + 1)
+}
+
+// ChangeRole updates the role column of a user alone, the role must be one of AllowedRoles when set
+func (m *InMemoryUserStore) ChangeRole(username, newRole string) error {
+	if err := m.storeCfg.validateRole(newRole); err != nil {
+		return err
 	}
+	return m.UpdateUser(username, map[string]any{m.storeCfg.getRoleColumnName(): newRole})
+}
+
+// GetUserByUsername returns the non-hidden fields of a user, without checking its password
+func (m *InMemoryUserStore) GetUserByUsername(username string) (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)); err != nil {
-		return nil, ErrInvalidPassword
+	user, exists := m.users[username]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
 	}
+	return m.visibleColumns(user), nil
+}
+
+// visibleColumns copies the non-hidden columns of a user
+func (m *InMemoryUserStore) visibleColumns(user map[string]string) map[string]string {
+	result := make(map[string]string)
+	for name, cfg := range m.storeCfg.Columns {
+		if val, ok := user[name]; ok && !cfg.Hidden {
+			result[name] = val
+		}
+	}
+	return result
+}
+
+// ListUsers returns a page of users in username order, see UserIterator. The page is picked in
+// a single pass over the users, and only its users are copied. Their disabled flag is reported
+// even without a column marked is_disabled.
+func (m *InMemoryUserStore) ListUsers(ctx context.Context, after string, limit int) ([]map[string]string, string, error) {
+	if limit <= 0 {
+		limit = DefaultIterateBatchSize
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// the limit+1 first usernames following after, the last one telling whether a page follows
+	page := make([]string, 0, limit+1)
+	for username := range m.users {
+		if after != "" && username <= after {
+			continue
+		}
+		if len(page) == limit+1 {
+			if username >= page[limit] {
+				continue
+			}
+			page = page[:limit]
+		}
+		i, _ := slices.BinarySearch(page, username)
+		page = slices.Insert(page, i, username)
+	}
+
+	next := ""
+	if len(page) > limit {
+		page = page[:limit]
+		next = page[limit-1]
+	}
+	users := make([]map[string]string, 0, len(page))
+	disabledColumn, configured := m.storeCfg.getDisabledColumnName()
+	for _, username := range page {
+		user := m.visibleColumns(m.users[username])
+		if !configured {
+			// like the column managed by AuthifyDB, reported for every user
+			user[disabledColumn] = strconv.FormatBool(m.isDisabled(m.users[username]))
+		}
+		users = append(users, user)
+	}
+	return users, next, nil
+}
+
+// IterateUsers calls fn for every user in username order, batchSize users at a time, see UserIterator
+func (m *InMemoryUserStore) IterateUsers(ctx context.Context, batchSize int, fn func(user map[string]string) error) error {
+	return iterateUsers(ctx, batchSize, m.ListUsers, fn)
+}
+
+// UserExists reports whether a user has value in column, which must be unique, see ExistenceChecker
+func (m *InMemoryUserStore) UserExists(ctx context.Context, column, value string) (bool, error) {
+	if err := m.storeCfg.checkExistsColumn(column); err != nil {
+		return false, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		if val, ok := user[column]; ok && val == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetUserDisabled suspends or reactivates a user, disabled users can no longer authenticate
+func (m *InMemoryUserStore) SetUserDisabled(username string, disabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+
+	column, _ := m.storeCfg.getDisabledColumnName()
+	user[column] = strconv.FormatBool(disabled)
+	return m.persist()
+}
+
+// IsUserDisabled reports whether the user was disabled with SetUserDisabled
+func (m *InMemoryUserStore) IsUserDisabled(username string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return false, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return m.isDisabled(user), nil
+}
+
+func (m *InMemoryUserStore) isDisabled(user map[string]string) bool {
+	column, _ := m.storeCfg.getDisabledColumnName()
+	return isDisabledValue(user[column])
+}
+
+// CountUsers returns the number of stored users
+func (m *InMemoryUserStore) CountUsers() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.users), nil
+}
+
+// GetUserInfo authenticates and returns non-hidden user fields
+// Disabled users are rejected with ErrAccountDisabled once their password checks out.
+// Outdated password hashes are upgraded after a successful login.
+// Unknown users cost a password comparison too, so timing does not reveal them.
+func (m *InMemoryUserStore) GetUserInfo(username, password string) (map[string]any, error) {
+	user, hashed, err := m.authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	rehashOnLogin(m, m.hasher, username, hashed, password)
 
 	result := make(map[string]any)
 	for name, cfg := range m.storeCfg.Columns {
@@ -103,3 +445,72 @@ func (m *InMemoryUserStore) GetUserInfo(username, password string) (map[string]a
 
 	return result, nil
 }
+
+// PasswordSettings returns the settings of the user's bcrypt hash for a login challenge,
+// made-up ones for unknown users, see ProofAuthenticator
+func (m *InMemoryUserStore) PasswordSettings(username string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return fakePasswordSettings(username, m.storeCfg.BcryptCost), nil
+	}
+	return PasswordSettings(user["password"])
+}
+
+// GetUserInfoWithProof authenticates with the proof answering a login challenge, see ChallengeProof,
+// and returns non-hidden user fields. Disabled users are rejected once their proof checks out.
+func (m *InMemoryUserStore) GetUserInfoWithProof(username, nonce, proof string) (map[string]any, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if err := checkChallengeProof(user["password"], nonce, proof); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, username)
+	}
+	if m.isDisabled(user) {
+		return nil, fmt.Errorf("%w: %s", ErrAccountDisabled, username)
+	}
+
+	result := make(map[string]any)
+	for name, cfg := range m.storeCfg.Columns {
+		if val, ok := user[name]; ok && !cfg.Hidden {
+			result[name] = val
+		}
+	}
+	return result, nil
+}
+
+// authenticate validates the password and returns a copy of the user along with its stored hash
+func (m *InMemoryUserStore) authenticate(username, password string) (map[string]string, string, error) {
+	// the password is compared once the lock is released, a pending write would otherwise hold
+	// up every other reader until the comparison ends
+	m.mu.RLock()
+	user, exists := m.users[username]
+	user = maps.Clone(user)
+	m.mu.RUnlock()
+
+	if !exists {
+		m.dummy.compare(m.hasher, password)
+		return nil, "", fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+
+	hashed, ok := user["password"]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrInvalidPassword, username)
+	}
+
+	if err := comparePassword(m.hasher, hashed, password); err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrInvalidPassword, username)
+	}
+
+	if m.isDisabled(user) {
+		return nil, "", fmt.Errorf("%w: %s", ErrAccountDisabled, username)
+	}
+
+	return user, hashed, nil
+}
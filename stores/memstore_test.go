@@ -0,0 +1,80 @@
+package stores
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// gatedHasher is a bcrypt hasher whose hashes wait for gate, like the ones waiting for a slot of
+// a saturated hashing pool, telling hashing once they started
+type gatedHasher struct {
+	BcryptHasher
+	hashing chan struct{}
+	gate    chan struct{}
+}
+
+func (h gatedHasher) Hash(password string) (string, error) {
+	h.hashing <- struct{}{}
+	<-h.gate
+	return h.BcryptHasher.Hash(password)
+}
+
+func TestCreateUserDoesNotBlockLogins(t *testing.T) {
+	store := NewInMemoryUserStore(StoreConfig{
+		BcryptCost: 4,
+		Columns: map[string]ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+		},
+	})
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	hasher := gatedHasher{BcryptHasher: BcryptHasher{Cost: 4}, hashing: make(chan struct{}), gate: make(chan struct{})}
+	store.WithPasswordHasher(hasher)
+	created := make(chan error, 1)
+	go func() {
+		_, err := store.CreateUser(map[string]any{"username": "bob", "password": "password123"})
+		created <- err
+	}()
+	<-hasher.hashing
+
+	loggedIn := make(chan error, 1)
+	go func() {
+		_, err := store.GetUserInfo("alice", "password123")
+		loggedIn <- err
+	}()
+	select {
+	case err := <-loggedIn:
+		if err != nil {
+			t.Errorf("expected alice to log in, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the login not to wait for the hash of the user being created")
+	}
+
+	close(hasher.gate)
+	if err := <-created; err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if _, err := store.GetUserInfo("bob", "password123"); err != nil {
+		t.Errorf("expected bob to log in, got %v", err)
+	}
+}
+
+func TestInMemoryUserStoreUnknownHasher(t *testing.T) {
+	cfg := loadTestConfig("users")
+	cfg.PasswordHasher = "md5"
+
+	if _, err := NewInMemoryUserStoreChecked(cfg); !errors.Is(err, ErrUnsupportedHasher) {
+		t.Errorf("expected ErrUnsupportedHasher, got %v", err)
+	}
+	defer func() {
+		if err, _ := recover().(error); !errors.Is(err, ErrUnsupportedHasher) {
+			t.Errorf("expected NewInMemoryUserStore to panic with ErrUnsupportedHasher, got %v", err)
+		}
+	}()
+	NewInMemoryUserStore(cfg)
+}
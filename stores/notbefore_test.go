@@ -0,0 +1,76 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// settinglessConn is a database where the settings table was never created
+type settinglessConn struct {
+	schemaConn
+}
+
+func (c *settinglessConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return nil, &pgconn.PgError{Code: pgUndefinedTable}
+}
+
+func TestGlobalNotBeforeWithoutTable(t *testing.T) {
+	conn := &settinglessConn{}
+	db, err := NewAuthifyDBFromConn(conn, loadTestConfig("users"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if notBefore, err := db.GetGlobalNotBefore(); err != nil || !notBefore.IsZero() {
+		t.Errorf("expected no global not-before time without the table, got %v (%v)", notBefore, err)
+	}
+
+	if err := db.SetGlobalNotBefore(time.Now()); err != nil {
+		t.Fatalf("failed to set the global not-before time: %v", err)
+	}
+	if len(conn.executed) != 2 || !strings.HasPrefix(conn.executed[0], `CREATE TABLE IF NOT EXISTS "users_settings"`) {
+		t.Errorf("expected the settings table to be created first, got %v", conn.executed)
+	}
+}
+
+func TestGlobalNotBeforePostgres(t *testing.T) {
+	connString := os.Getenv(testDatabaseURLEnv)
+	if connString == "" {
+		t.Skipf("%s is not set", testDatabaseURLEnv)
+	}
+
+	cfg := loadTestConfig(fmt.Sprintf("authify_not_before_%d", time.Now().UnixNano()))
+	cfg.AutoCreate = true
+	db, err := NewAuthifyDB(connString, cfg)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, table := range []string{cfg.Name, db.settingsTable()} {
+			if _, err := db.conn.Exec(context.Background(), `DROP TABLE IF EXISTS "`+table+`"`); err != nil {
+				t.Errorf("failed to drop %s: %v", table, err)
+			}
+		}
+		db.Close()
+	})
+
+	if notBefore, err := db.GetGlobalNotBefore(); err != nil || !notBefore.IsZero() {
+		t.Fatalf("expected no global not-before time, got %v (%v)", notBefore, err)
+	}
+	want := time.Now()
+	for range 2 {
+		if err := db.SetGlobalNotBefore(want); err != nil {
+			t.Fatalf("failed to set the global not-before time: %v", err)
+		}
+		if got, err := db.GetGlobalNotBefore(); err != nil || !got.Equal(want) {
+			t.Errorf("expected %v, got %v (%v)", want, got, err)
+		}
+		want = want.Add(time.Minute)
+	}
+}
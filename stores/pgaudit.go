@@ -0,0 +1,81 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// AuditTable is the table PGAuditLog writes to by default
+const AuditTable = "auth_events"
+
+// PGAuditLog writes authentication events to a postgres table.
+type PGAuditLog struct {
+	conn  DBConn
+	table string
+}
+
+// NewAuditLog returns an audit log sharing the connection of db, kept in the
+// AuditTable table, which is created if it does not exist.
+func (db *AuthifyDB) NewAuditLog() (*PGAuditLog, error) {
+	return NewPGAuditLog(db.conn, AuditTable)
+}
+
+// NewPGAuditLog builds an audit log on conn, creating table if it does not exist.
+func NewPGAuditLog(conn DBConn, table string) (*PGAuditLog, error) {
+	queries := []string{
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS "%s" ("id" BIGSERIAL PRIMARY KEY, "type" TEXT NOT NULL, "username" TEXT NOT NULL, "ip" TEXT NOT NULL, "success" BOOLEAN NOT NULL, "reason" TEXT NOT NULL, "created_at" TIMESTAMPTZ NOT NULL);`,
+			table,
+		),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_username_idx" ON "%s" ("username", "created_at");`, table, table),
+		// tables created before events carried request IDs
+		fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN IF NOT EXISTS "request_id" TEXT NOT NULL DEFAULT '';`, table),
+	}
+	for _, query := range queries {
+		if _, err := conn.Exec(context.Background(), query); err != nil {
+			return nil, fmt.Errorf("Unable to Create Table: %w", err)
+		}
+	}
+	return &PGAuditLog{conn: conn, table: table}, nil
+}
+
+var _ BatchAuditLogger = (*PGAuditLog)(nil)
+
+// LogEvent inserts event, logging the failure to do so. The insert is not cancelled
+// along with ctx, so events of requests the client gave up on are kept too.
+func (l *PGAuditLog) LogEvent(ctx context.Context, event AuthEvent) {
+	query := fmt.Sprintf(
+		`INSERT INTO "%s" ("type", "username", "ip", "success", "reason", "created_at", "request_id") VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		l.table,
+	)
+	_, err := l.conn.Exec(context.WithoutCancel(ctx), query,
+		string(event.Type), event.Username, event.IP, event.Success, event.Reason, event.Time, event.RequestID)
+	if err != nil {
+		log.Printf("failed to write %s audit event of %q: %v", event.Type, event.Username, err)
+	}
+}
+
+// LogEvents inserts events with a single statement, for AsyncAuditLog, which retries
+// them when it fails. Like LogEvent, it is not cancelled along with ctx.
+func (l *PGAuditLog) LogEvents(ctx context.Context, events []AuthEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var query strings.Builder
+	fmt.Fprintf(&query, `INSERT INTO "%s" ("type", "username", "ip", "success", "reason", "created_at", "request_id") VALUES `, l.table)
+	args := make([]any, 0, len(events)*7)
+	for i, event := range events {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7)
+		args = append(args, string(event.Type), event.Username, event.IP, event.Success, event.Reason, event.Time, event.RequestID)
+	}
+	if _, err := l.conn.Exec(context.WithoutCancel(ctx), query.String(), args...); err != nil {
+		return fmt.Errorf("failed to write %d audit events: %w", len(events), err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package stores
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// tokenFamilyQuery selects families, aliased "f", with their tokens aggregated in order, in the
+// columns scanTokenFamily reads. It takes the tokens and families tables, and a WHERE clause.
+const tokenFamilyQuery = `SELECT f."id", f."user_identifier", f."device", f."created_at", f."expires_at", f."compromise", ` +
+	`COALESCE((SELECT jsonb_agg(jsonb_build_object('jti', t."jti", 'ip', t."ip", 'issued_at', t."issued_at", 'consumed_at', t."consumed_at", 'revoked_at', t."revoked_at") ORDER BY t."position") ` +
+	`FROM "%s" t WHERE t."family_id"=f."id"), '[]') FROM "%s" f`
+
+// CreateTokenFamily records the family of a login, sanitizing its device info and purging the
+// families past their ExpiresAt, with their tokens, first
+func (s *PGSessionStore) CreateTokenFamily(family TokenFamily) error {
+	purge := fmt.Sprintf(`DELETE FROM "%s" WHERE "expires_at" < now()`, s.families)
+	if _, err := s.conn.Exec(s.ctx, purge); err != nil {
+		return err
+	}
+
+	device, err := json.Marshal(family.Device.Sanitize())
+	if err != nil {
+		return err
+	}
+	var head string
+	jtis := make([]string, len(family.Tokens))
+	ips := make([]string, len(family.Tokens))
+	issued := make([]time.Time, len(family.Tokens))
+	consumed := make([]*time.Time, len(family.Tokens))
+	revoked := make([]*time.Time, len(family.Tokens))
+	for i, t := range family.Tokens {
+		head = t.JTI
+		jtis[i], ips[i], issued[i] = t.JTI, t.IP, t.IssuedAt
+		consumed[i], revoked[i] = nullTime(t.ConsumedAt), nullTime(t.RevokedAt)
+	}
+
+	// the family and its tokens are inserted by a single statement, so neither is left without the other
+	query := fmt.Sprintf(
+		`WITH "family" AS (INSERT INTO "%s" ("id", "user_identifier", "device", "created_at", "expires_at", "head_jti") VALUES ($1, $2, $3, $4, $5, $6) RETURNING "id") `+
+			`INSERT INTO "%s" ("family_id", "position", "jti", "ip", "issued_at", "consumed_at", "revoked_at") `+
+			`SELECT "family"."id", t."position", t."jti", t."ip", t."issued_at", t."consumed_at", t."revoked_at" `+
+			`FROM "family", unnest($7::text[], $8::text[], $9::timestamptz[], $10::timestamptz[], $11::timestamptz[]) WITH ORDINALITY AS t("jti", "ip", "issued_at", "consumed_at", "revoked_at", "position")`,
+		s.families, s.familyTokens,
+	)
+	_, err = s.conn.Exec(s.ctx, query,
+		family.ID, family.UserIdentifier, string(device), family.CreatedAt, nullTime(family.ExpiresAt), head,
+		jtis, ips, issued, consumed, revoked)
+	return err
+}
+
+// RotateTokenFamily consumes a refresh token of a family, see TokenFamilyStore. The last token
+// of the family is moved, its row consumed and its successor inserted by a single statement,
+// conditioned on jti being the last token of the family, so of concurrent rotations of the same
+// token, only one updates the family and the others find it consumed.
+func (s *PGSessionStore) RotateTokenFamily(familyID, jti string, next FamilyToken) error {
+	query := fmt.Sprintf(
+		`WITH "head" AS (UPDATE "%s" SET "head_jti"=$3 WHERE "id"=$1 AND "head_jti"=$2 AND "compromise" IS NULL RETURNING "id"), `+
+			`"consumed" AS (UPDATE "%s" SET "consumed_at"=$5 WHERE "family_id" IN (SELECT "id" FROM "head") AND "jti"=$2 AND "consumed_at" IS NULL AND "revoked_at" IS NULL RETURNING "position") `+
+			`INSERT INTO "%s" ("family_id", "position", "jti", "ip", "issued_at") SELECT $1, "position"+1, $3, $4, $5 FROM "consumed"`,
+		s.families, s.familyTokens, s.familyTokens,
+	)
+	tag, err := s.conn.Exec(s.ctx, query, familyID, jti, next.JTI, next.IP, next.IssuedAt)
+	if err != nil || tag.RowsAffected() > 0 {
+		return err
+	}
+
+	// the family is unknown, or jti is not its current token
+	family, err := s.GetTokenFamily(familyID)
+	if err != nil {
+		return err
+	}
+	if err := family.Check(jti); err != nil {
+		return err
+	}
+	// another rotation consumed jti since
+	return fmt.Errorf("%w: %s of token family %s", ErrRefreshTokenReused, jti, familyID)
+}
+
+// CompromiseTokenFamily records the reuse of a refresh token of a family, see TokenFamilyStore.
+// The compromise is recorded and the tokens revoked by a single statement.
+func (s *PGSessionStore) CompromiseTokenFamily(familyID string, compromise FamilyCompromise) error {
+	buf, err := json.Marshal(compromise)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(
+		`WITH "family" AS (UPDATE "%s" SET "compromise"=$2 WHERE "id"=$1 AND "compromise" IS NULL RETURNING "id"), `+
+			`"revoked" AS (UPDATE "%s" SET "revoked_at"=$3 WHERE "family_id" IN (SELECT "id" FROM "family") AND "consumed_at" IS NULL AND "revoked_at" IS NULL) `+
+			`SELECT EXISTS (SELECT 1 FROM "%s" WHERE "id"=$1)`,
+		s.families, s.familyTokens, s.families,
+	)
+	rows, err := s.conn.Query(s.ctx, query, familyID, string(buf), compromise.DetectedAt)
+	if err != nil {
+		return err
+	}
+	exists, err := pgx.CollectOneRow(rows, pgx.RowTo[bool])
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTokenFamilyNotFound, familyID)
+	}
+	return nil
+}
+
+// GetTokenFamily returns a family with its tokens
+func (s *PGSessionStore) GetTokenFamily(familyID string) (*TokenFamily, error) {
+	query := fmt.Sprintf(tokenFamilyQuery+` WHERE f."id"=$1`, s.familyTokens, s.families)
+	rows, err := s.conn.Query(s.ctx, query, familyID)
+	if err != nil {
+		return nil, err
+	}
+	family, err := pgx.CollectOneRow(rows, scanTokenFamily)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrTokenFamilyNotFound, familyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &family, nil
+}
+
+// ListTokenFamilies returns the families of a user with their tokens, oldest first, read by a
+// single query
+func (s *PGSessionStore) ListTokenFamilies(username string) ([]TokenFamily, error) {
+	query := fmt.Sprintf(tokenFamilyQuery+` WHERE f."user_identifier"=$1 ORDER BY f."created_at", f."id"`, s.familyTokens, s.families)
+	rows, err := s.conn.Query(s.ctx, query, username)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanTokenFamily)
+}
+
+func scanTokenFamily(row pgx.CollectableRow) (TokenFamily, error) {
+	var family TokenFamily
+	var expiresAt *time.Time
+	var device, compromise, tokens []byte
+	if err := row.Scan(&family.ID, &family.UserIdentifier, &device, &family.CreatedAt, &expiresAt, &compromise, &tokens); err != nil {
+		return family, err
+	}
+	family.CreatedAt = family.CreatedAt.In(time.UTC)
+	if expiresAt != nil {
+		family.ExpiresAt = expiresAt.In(time.UTC)
+	}
+	if err := json.Unmarshal(device, &family.Device); err != nil {
+		return family, err
+	}
+	if err := json.Unmarshal(tokens, &family.Tokens); err != nil {
+		return family, err
+	}
+	for i := range family.Tokens {
+		t := &family.Tokens[i]
+		t.IssuedAt, t.ConsumedAt, t.RevokedAt = utcTime(t.IssuedAt), utcTime(t.ConsumedAt), utcTime(t.RevokedAt)
+	}
+	if compromise != nil {
+		family.Compromise = &FamilyCompromise{}
+		return family, json.Unmarshal(compromise, family.Compromise)
+	}
+	return family, nil
+}
+
+// utcTime returns t in UTC, leaving the zero time as it is
+func utcTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.In(time.UTC)
+}
@@ -0,0 +1,99 @@
+package stores
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// passwordHistoryTable returns the table keeping the hashes of previous passwords, keyed by
+// the identifier of their user
+func (db *AuthifyDB) passwordHistoryTable() string {
+	return db.storeCfg.Name + "_password_history"
+}
+
+// createPasswordHistoryTable creates the password history table if it does not exist
+func (db *AuthifyDB) createPasswordHistoryTable() error {
+	table := db.passwordHistoryTable()
+	create := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS "%s" ("id" BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY, "username" TEXT NOT NULL, "hash" TEXT NOT NULL, "created_at" TIMESTAMPTZ NOT NULL);`,
+		table,
+	)
+	if _, err := db.conn.Exec(db.ctx, create); err != nil {
+		return err
+	}
+	index := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_username_idx" ON "%s" ("username");`, table, table)
+	_, err := db.conn.Exec(db.ctx, index)
+	return err
+}
+
+// ReplacePassword takes in the user identifier and the new password, and sets it unless it
+// matches the current password or one of the previous ones kept in the "<name>_password_history"
+// table, see PasswordHistorian. The table is created with the users table by auto_create.
+func (db *AuthifyDB) ReplacePassword(userIdentifier, newPassword string) error {
+	passwordColumn := db.storeCfg.getPasswordColumnName()
+	if db.storeCfg.PasswordHistory == 0 {
+		return db.UpdateUser(userIdentifier, map[string]any{passwordColumn: newPassword})
+	}
+
+	userData, err := db.fetchUserData(userIdentifier)
+	if err != nil {
+		return err
+	}
+	current, _ := userData[passwordColumn].(string)
+	previous, err := db.previousPasswordHashes(userIdentifier)
+	if err != nil {
+		return err
+	}
+	if err := checkPasswordReuse(db.hasher, append([]string{current}, previous...), newPassword); err != nil {
+		return fmt.Errorf("%w: %s", err, userIdentifier)
+	}
+
+	if err := db.UpdateUser(userIdentifier, map[string]any{passwordColumn: newPassword}); err != nil {
+		return err
+	}
+	return db.recordPreviousPassword(userIdentifier, current)
+}
+
+// previousPasswordHashes returns the hashes of the previous passwords of a user, the latest first
+func (db *AuthifyDB) previousPasswordHashes(userIdentifier string) ([]string, error) {
+	keep := db.storeCfg.previousPasswords()
+	if keep == 0 {
+		return nil, nil
+	}
+	query := fmt.Sprintf(
+		`SELECT "hash" FROM "%s" WHERE "username"=$1 ORDER BY "id" DESC LIMIT %d`,
+		db.passwordHistoryTable(),
+		keep,
+	)
+	rows, err := db.conn.Query(db.ctx, query, userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// recordPreviousPassword adds hash to the password history of a user and prunes the hashes
+// beyond password_history
+func (db *AuthifyDB) recordPreviousPassword(userIdentifier, hash string) error {
+	keep := db.storeCfg.previousPasswords()
+	if keep == 0 {
+		return nil
+	}
+	table := db.passwordHistoryTable()
+
+	insert := fmt.Sprintf(`INSERT INTO "%s" ("username", "hash", "created_at") VALUES ($1, $2, $3)`, table)
+	if _, err := db.conn.Exec(db.ctx, insert, userIdentifier, hash, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	prune := fmt.Sprintf(
+		`DELETE FROM "%s" WHERE "username"=$1 AND "id" NOT IN (SELECT "id" FROM "%s" WHERE "username"=$1 ORDER BY "id" DESC LIMIT %d)`,
+		table,
+		table,
+		keep,
+	)
+	_, err := db.conn.Exec(db.ctx, prune, userIdentifier)
+	return err
+}
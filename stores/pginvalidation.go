@@ -0,0 +1,178 @@
+package stores
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxChannelLength is the longest identifier postgres keeps, longer channel names are truncated
+const maxChannelLength = 63
+
+// Delays between two attempts of a PGInvalidationBus to listen again, after losing its connection
+const (
+	listenRetryBackoff    = 100 * time.Millisecond
+	listenRetryMaxBackoff = 5 * time.Second
+)
+
+// notificationConn is the connection a PGInvalidationBus listens on, a *pgx.Conn taken out of the pool
+type notificationConn interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+	Close(ctx context.Context) error
+}
+
+// PGInvalidationBus is an InvalidationBus over postgres LISTEN/NOTIFY, for replicas sharing a
+// database. Messages are sent with pg_notify as JSON, see Invalidation, on a channel named
+// after the users table, and delivered by a connection of its own listening on it.
+//
+// When that connection is lost, the bus listens again on a new one, waiting up to 5 seconds
+// between attempts, and then delivers an InvalidateAll message, as the messages sent in the
+// meantime are lost. Subscribers thus never keep stale entries longer than the outage.
+type PGInvalidationBus struct {
+	conn    DBConn
+	channel string
+	dial    func(ctx context.Context) (notificationConn, error)
+	local   *LocalInvalidationBus
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewInvalidationBus returns a bus of the replicas sharing the users table of db, listening on a
+// connection of its pool. Stores built on a single connection with NewAuthifyDBFromConn
+// fail with ErrListenNotSupported. Close the bus before the store.
+func (db *AuthifyDB) NewInvalidationBus() (*PGInvalidationBus, error) {
+	pool, ok := db.retry.current().(*pgxpool.Pool)
+	if !ok {
+		return nil, ErrListenNotSupported
+	}
+	dial := func(ctx context.Context) (notificationConn, error) {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// the listening connection is never given back, so no other statement runs on it
+		return conn.Hijack(), nil
+	}
+	return newPGInvalidationBus(db.conn, InvalidationChannel(db.storeCfg.Name), dial)
+}
+
+// InvalidationChannel is the channel of the invalidations of table, truncated to the 63 bytes
+// of postgres identifiers
+func InvalidationChannel(table string) string {
+	channel := "authify_invalidations_" + table
+	return channel[:min(len(channel), maxChannelLength)]
+}
+
+// newPGInvalidationBus listens on a connection returned by dial and returns once it does,
+// publishing on conn
+func newPGInvalidationBus(conn DBConn, channel string, dial func(ctx context.Context) (notificationConn, error)) (*PGInvalidationBus, error) {
+	b := &PGInvalidationBus{
+		conn:    conn,
+		channel: channel,
+		dial:    dial,
+		local:   NewLocalInvalidationBus(),
+		done:    make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	listener, err := b.listen(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to listen on %s: %w", channel, err)
+	}
+	b.cancel = cancel
+	go b.run(ctx, listener)
+	return b, nil
+}
+
+// Publish sends inv to the replicas listening on the channel of the bus, this one included,
+// once the transaction of the statement commits
+func (b *PGInvalidationBus) Publish(ctx context.Context, inv Invalidation) error {
+	payload, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	if _, err := b.conn.Exec(ctx, `SELECT pg_notify($1, $2)`, b.channel, string(payload)); err != nil {
+		return fmt.Errorf("failed to publish invalidation: %w", err)
+	}
+	return nil
+}
+
+// Subscribe calls fn with every message received from then on, until unsubscribe is called
+func (b *PGInvalidationBus) Subscribe(fn func(Invalidation)) (unsubscribe func()) {
+	return b.local.Subscribe(fn)
+}
+
+// Close stops listening and closes the listening connection
+func (b *PGInvalidationBus) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
+
+// listen returns a new connection listening on the channel of the bus
+func (b *PGInvalidationBus) listen(ctx context.Context) (notificationConn, error) {
+	conn, err := b.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{b.channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// run delivers the notifications of conn until ctx is done, listening again whenever the
+// connection is lost
+func (b *PGInvalidationBus) run(ctx context.Context, conn notificationConn) {
+	defer close(b.done)
+	backoff := RetryConfig{InitialBackoff: listenRetryBackoff, MaxBackoff: listenRetryMaxBackoff}.withDefaults()
+	for {
+		err := b.receive(ctx, conn)
+		conn.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Lost the connection listening on %s, listening again: %v", b.channel, err)
+
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff.backoff(attempt)):
+			}
+			if conn, err = b.listen(ctx); err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to listen on %s: %v", b.channel, err)
+		}
+		b.local.deliver(Invalidation{Kind: InvalidateAll})
+	}
+}
+
+// receive delivers the notifications of conn until it fails
+func (b *PGInvalidationBus) receive(ctx context.Context, conn notificationConn) error {
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var inv Invalidation
+		if err := json.Unmarshal([]byte(notification.Payload), &inv); err != nil || inv.Kind == "" {
+			log.Printf("Ignoring invalid invalidation on %s: %q", b.channel, notification.Payload)
+			continue
+		}
+		b.local.deliver(inv)
+	}
+}
@@ -0,0 +1,211 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeNotifier stands for postgres: pg_notify statements are delivered to the connections
+// listening on their channel
+type fakeNotifier struct {
+	mu        sync.Mutex
+	listeners []*fakeListenConn
+	dials     int
+}
+
+func (n *fakeNotifier) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if !strings.HasPrefix(sql, "SELECT pg_notify") {
+		return pgconn.CommandTag{}, fmt.Errorf("unexpected statement %s", sql)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, l := range n.listeners {
+		if l.channel == args[0] {
+			l.notifications <- &pgconn.Notification{Channel: args[0].(string), Payload: args[1].(string)}
+		}
+	}
+	return pgconn.CommandTag{}, nil
+}
+
+func (n *fakeNotifier) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (n *fakeNotifier) dial(ctx context.Context) (notificationConn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.dials++
+	conn := &fakeListenConn{notifier: n, notifications: make(chan *pgconn.Notification, 16), lost: make(chan struct{})}
+	n.listeners = append(n.listeners, conn)
+	return conn, nil
+}
+
+// drop breaks every listening connection, as a database restart would
+func (n *fakeNotifier) drop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, l := range n.listeners {
+		close(l.lost)
+	}
+	n.listeners = nil
+}
+
+type fakeListenConn struct {
+	notifier      *fakeNotifier
+	channel       string
+	notifications chan *pgconn.Notification
+	lost          chan struct{}
+}
+
+func (c *fakeListenConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	channel, ok := strings.CutPrefix(sql, "LISTEN ")
+	if !ok {
+		return pgconn.CommandTag{}, fmt.Errorf("unexpected statement %s", sql)
+	}
+	c.notifier.mu.Lock()
+	defer c.notifier.mu.Unlock()
+	c.channel = strings.Trim(channel, `"`)
+	return pgconn.CommandTag{}, nil
+}
+
+func (c *fakeListenConn) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	select {
+	case n := <-c.notifications:
+		return n, nil
+	case <-c.lost:
+		return nil, errors.New("connection lost")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeListenConn) Close(ctx context.Context) error {
+	return nil
+}
+
+// receiveInvalidation waits for the next message of a subscription
+func receiveInvalidation(t *testing.T, received <-chan Invalidation) Invalidation {
+	t.Helper()
+	select {
+	case inv := <-received:
+		return inv
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an invalidation to be delivered")
+		return Invalidation{}
+	}
+}
+
+func subscribe(bus InvalidationBus) <-chan Invalidation {
+	received := make(chan Invalidation, 16)
+	bus.Subscribe(func(inv Invalidation) { received <- inv })
+	return received
+}
+
+func TestPGInvalidationBusReplicas(t *testing.T) {
+	notifier := &fakeNotifier{}
+	channel := InvalidationChannel("users")
+	replicaA, err := newPGInvalidationBus(notifier, channel, notifier.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaA.Close()
+	replicaB, err := newPGInvalidationBus(notifier, channel, notifier.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaB.Close()
+	received := subscribe(replicaB)
+
+	want := Invalidation{Kind: InvalidatePassword, Username: "alice"}
+	if err := replicaA.Publish(context.Background(), want); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveInvalidation(t, received); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// invalid payloads are skipped
+	notifier.Exec(context.Background(), "SELECT pg_notify($1, $2)", channel, "not json")
+	replicaA.Publish(context.Background(), Invalidation{Kind: InvalidateNotBefore})
+	if got := receiveInvalidation(t, received); got.Kind != InvalidateNotBefore {
+		t.Errorf("expected the invalid payload to be skipped, got %+v", got)
+	}
+}
+
+func TestPGInvalidationBusReconnects(t *testing.T) {
+	notifier := &fakeNotifier{}
+	bus, err := newPGInvalidationBus(notifier, InvalidationChannel("users"), notifier.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	received := subscribe(bus)
+
+	// messages may have been missed while the connection was down, so every cache is dropped
+	notifier.drop()
+	if got := receiveInvalidation(t, received); got.Kind != InvalidateAll {
+		t.Errorf("expected an InvalidateAll after listening again, got %+v", got)
+	}
+	want := Invalidation{Kind: InvalidateRole, Username: "bob"}
+	bus.Publish(context.Background(), want)
+	if got := receiveInvalidation(t, received); got != want {
+		t.Errorf("expected %+v once listening again, got %+v", want, got)
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	if notifier.dials != 2 {
+		t.Errorf("expected 2 connections, got %d", notifier.dials)
+	}
+}
+
+func TestInvalidationChannel(t *testing.T) {
+	if got := InvalidationChannel("users"); got != "authify_invalidations_users" {
+		t.Errorf("unexpected channel %q", got)
+	}
+	if got := InvalidationChannel(strings.Repeat("t", 63)); len(got) != 63 {
+		t.Errorf("expected the channel to be truncated to 63 bytes, got %d", len(got))
+	}
+}
+
+func TestPGInvalidationBusPostgres(t *testing.T) {
+	connString := os.Getenv(testDatabaseURLEnv)
+	if connString == "" {
+		t.Skipf("%s is not set", testDatabaseURLEnv)
+	}
+
+	cfg := loadTestConfig(fmt.Sprintf("authify_invalidation_%d", time.Now().UnixNano()))
+	var buses []*PGInvalidationBus
+	for range 2 {
+		db, err := NewAuthifyDB(connString, cfg)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		bus, err := db.NewInvalidationBus()
+		if err != nil {
+			t.Fatalf("failed to create invalidation bus: %v", err)
+		}
+		t.Cleanup(func() {
+			bus.Close()
+			db.Close()
+		})
+		buses = append(buses, bus)
+	}
+	received := subscribe(buses[1])
+
+	want := Invalidation{Kind: InvalidateStatus, Username: "alice"}
+	if err := buses[0].Publish(context.Background(), want); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveInvalidation(t, received); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,132 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PGInviteStore keeps invites in a postgres table next to the users table.
+type PGInviteStore struct {
+	conn  DBConn
+	table string
+}
+
+// NewInviteStore returns an invite store sharing the connection of db, kept in the
+// "<name>_invites" table, which is created if it does not exist.
+func (db *AuthifyDB) NewInviteStore() (*PGInviteStore, error) {
+	return NewPGInviteStore(db.conn, db.storeCfg.Name+"_invites")
+}
+
+// NewPGInviteStore builds an invite store on conn, creating table if it does not exist.
+func NewPGInviteStore(conn DBConn, table string) (*PGInviteStore, error) {
+	s := &PGInviteStore{conn: conn, table: table}
+
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS "%s" ("id" TEXT PRIMARY KEY, "code_hash" TEXT NOT NULL UNIQUE, "max_uses" INTEGER NOT NULL, "uses" INTEGER NOT NULL DEFAULT 0, "expires_at" TIMESTAMPTZ, "created_at" TIMESTAMPTZ NOT NULL);`,
+		table,
+	)
+	if _, err := conn.Exec(context.Background(), query); err != nil {
+		return nil, fmt.Errorf("Unable to Create Table: %w", err)
+	}
+	return s, nil
+}
+
+// CreateInvite records an invite and returns its code, see InviteStore
+func (s *PGInviteStore) CreateInvite(ctx context.Context, maxUses int, expiresAt time.Time) (string, Invite, error) {
+	code, invite, err := newInvite(maxUses, expiresAt)
+	if err != nil {
+		return "", Invite{}, err
+	}
+	query := fmt.Sprintf(
+		`INSERT INTO "%s" ("id", "code_hash", "max_uses", "expires_at", "created_at") VALUES ($1, $2, $3, $4, $5)`,
+		s.table,
+	)
+	if _, err := s.conn.Exec(ctx, query, invite.ID, invite.CodeHash, invite.MaxUses, nullTime(invite.ExpiresAt), invite.CreatedAt); err != nil {
+		return "", Invite{}, err
+	}
+	return code, invite, nil
+}
+
+// ListInvites returns every invite by creation time
+func (s *PGInviteStore) ListInvites(ctx context.Context) ([]Invite, error) {
+	query := fmt.Sprintf(`SELECT %s FROM "%s" ORDER BY "created_at", "id"`, inviteColumns, s.table)
+	rows, err := s.conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, scanInvite)
+}
+
+// ConsumeInvite uses the invite of code once, see InviteStore. The invite is checked and its
+// uses incremented by a single UPDATE, which postgres serializes with the ones of concurrent
+// sign ups, so the last use of an invite goes to one of them only.
+func (s *PGInviteStore) ConsumeInvite(ctx context.Context, code string) (Invite, error) {
+	if code == "" {
+		return Invite{}, ErrInviteNotFound
+	}
+	hash := hashClientSecret(code)
+	query := fmt.Sprintf(
+		`UPDATE "%s" SET "uses" = "uses" + 1 WHERE "code_hash"=$1 AND ("max_uses" = 0 OR "uses" < "max_uses") AND ("expires_at" IS NULL OR "expires_at" > $2) RETURNING %s`,
+		s.table, inviteColumns,
+	)
+	rows, err := s.conn.Query(ctx, query, hash, time.Now().UTC())
+	if err != nil {
+		return Invite{}, err
+	}
+	invite, err := pgx.CollectOneRow(rows, scanInvite)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return invite, err
+	}
+
+	// the invite is unknown, or cannot be used anymore: tell which
+	query = fmt.Sprintf(`SELECT %s FROM "%s" WHERE "code_hash"=$1`, inviteColumns, s.table)
+	rows, err = s.conn.Query(ctx, query, hash)
+	if err != nil {
+		return Invite{}, err
+	}
+	invite, err = pgx.CollectOneRow(rows, scanInvite)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Invite{}, ErrInviteNotFound
+	}
+	if err != nil {
+		return Invite{}, err
+	}
+	if err := invite.check(time.Now()); err != nil {
+		return Invite{}, err
+	}
+	// the last use went to a concurrent sign up, or the invite expired, between both queries
+	return Invite{}, fmt.Errorf("%w: %s", ErrInviteUsedUp, invite.ID)
+}
+
+// ReleaseInvite gives back a use of the invite of id, see InviteStore
+func (s *PGInviteStore) ReleaseInvite(ctx context.Context, id string) error {
+	query := fmt.Sprintf(`UPDATE "%s" SET "uses" = "uses" - 1 WHERE "id"=$1 AND "uses" > 0`, s.table)
+	_, err := s.conn.Exec(ctx, query, id)
+	return err
+}
+
+// inviteColumns are the columns scanInvite reads
+const inviteColumns = `"id", "code_hash", "max_uses", "uses", "expires_at", "created_at"`
+
+func scanInvite(row pgx.CollectableRow) (Invite, error) {
+	var invite Invite
+	var expiresAt *time.Time
+	err := row.Scan(&invite.ID, &invite.CodeHash, &invite.MaxUses, &invite.Uses, &expiresAt, &invite.CreatedAt)
+	if expiresAt != nil {
+		invite.ExpiresAt = expiresAt.In(time.UTC)
+	}
+	invite.CreatedAt = invite.CreatedAt.In(time.UTC)
+	return invite, err
+}
+
+// nullTime is t, or NULL when t is zero
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
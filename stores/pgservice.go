@@ -0,0 +1,118 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// PGServiceAccountStore keeps service accounts in a postgres table next to the users table.
+type PGServiceAccountStore struct {
+	conn  DBConn
+	ctx   context.Context
+	table string
+}
+
+// NewServiceAccountStore returns a service account store sharing the connection of db,
+// kept in the "<name>_service_accounts" table, which is created if it does not exist.
+func (db *AuthifyDB) NewServiceAccountStore() (*PGServiceAccountStore, error) {
+	return NewPGServiceAccountStore(db.conn, db.storeCfg.Name+"_service_accounts")
+}
+
+// NewPGServiceAccountStore builds a service account store on conn, creating table if it does not exist.
+func NewPGServiceAccountStore(conn DBConn, table string) (*PGServiceAccountStore, error) {
+	s := &PGServiceAccountStore{conn: conn, ctx: context.Background(), table: table}
+
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS "%s" ("client_id" TEXT PRIMARY KEY, "secret_hash" TEXT NOT NULL, "scopes" TEXT NOT NULL, "disabled" BOOLEAN NOT NULL DEFAULT false, "created_at" TIMESTAMPTZ NOT NULL);`,
+		table,
+	)
+	if _, err := conn.Exec(s.ctx, query); err != nil {
+		return nil, fmt.Errorf("Unable to Create Table: %w", err)
+	}
+	return s, nil
+}
+
+// CreateServiceAccount records a service account allowed the given scopes and returns its secret
+func (s *PGServiceAccountStore) CreateServiceAccount(clientID string, scopes []string) (string, error) {
+	if clientID == "" {
+		return "", fmt.Errorf("%w: client_id", ErrMissingField)
+	}
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		return "", err
+	}
+
+	query := fmt.Sprintf(
+		`INSERT INTO "%s" ("client_id", "secret_hash", "scopes", "created_at") VALUES ($1, $2, $3, $4)`,
+		s.table,
+	)
+	_, err = s.conn.Exec(s.ctx, query, clientID, hash, strings.Join(scopes, " "), time.Now().UTC())
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+		return "", fmt.Errorf("%w: %s", ErrServiceAccountExists, clientID)
+	}
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// RotateServiceAccountSecret replaces the secret of a service account, the previous one stops working at once
+func (s *PGServiceAccountStore) RotateServiceAccountSecret(clientID string) (string, error) {
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		return "", err
+	}
+	query := fmt.Sprintf(`UPDATE "%s" SET "secret_hash"=$2 WHERE "client_id"=$1`, s.table)
+	if err := s.execForAccount(query, clientID, hash); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// SetServiceAccountDisabled suspends or reinstates a service account
+func (s *PGServiceAccountStore) SetServiceAccountDisabled(clientID string, disabled bool) error {
+	query := fmt.Sprintf(`UPDATE "%s" SET "disabled"=$2 WHERE "client_id"=$1`, s.table)
+	return s.execForAccount(query, clientID, disabled)
+}
+
+// GetServiceAccount returns the service account with the given client ID
+func (s *PGServiceAccountStore) GetServiceAccount(clientID string) (ServiceAccount, error) {
+	query := fmt.Sprintf(
+		`SELECT "client_id", "secret_hash", "scopes", "disabled", "created_at" FROM "%s" WHERE "client_id"=$1`,
+		s.table,
+	)
+	rows, err := s.conn.Query(s.ctx, query, clientID)
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+	account, err := pgx.CollectOneRow(rows, func(row pgx.CollectableRow) (ServiceAccount, error) {
+		var account ServiceAccount
+		var scopes string
+		err := row.Scan(&account.ClientID, &account.SecretHash, &scopes, &account.Disabled, &account.CreatedAt)
+		account.Scopes = strings.Fields(scopes)
+		account.CreatedAt = account.CreatedAt.In(time.UTC)
+		return account, err
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ServiceAccount{}, fmt.Errorf("%w: %s", ErrServiceAccountNotFound, clientID)
+	}
+	return account, err
+}
+
+func (s *PGServiceAccountStore) execForAccount(query, clientID string, arg any) error {
+	tag, err := s.conn.Exec(s.ctx, query, clientID, arg)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrServiceAccountNotFound, clientID)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package stores
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PGSessionStore records sessions in a postgres table next to the users table,
+// the records of opaque tokens in a "<table>_tokens" table, the nonces of login
+// challenges in a "<table>_nonces" table and token families in a "<table>_families" table,
+// their refresh tokens in a "<table>_family_tokens" table.
+type PGSessionStore struct {
+	conn         DBConn
+	ctx          context.Context
+	table        string
+	tokens       string
+	nonces       string
+	families     string
+	familyTokens string
+}
+
+// NewSessionStore returns a session store sharing the connection of db,
+// kept in the "<name>_sessions" table, which is created if it does not exist.
+func (db *AuthifyDB) NewSessionStore() (*PGSessionStore, error) {
+	return NewPGSessionStore(db.conn, db.storeCfg.Name+"_sessions")
+}
+
+// NewPGSessionStore builds a session store on conn, creating table and its tokens, nonces,
+// families and family tokens tables if they do not exist.
+func NewPGSessionStore(conn DBConn, table string) (*PGSessionStore, error) {
+	s := &PGSessionStore{
+		conn:         conn,
+		ctx:          context.Background(),
+		table:        table,
+		tokens:       table + "_tokens",
+		nonces:       table + "_nonces",
+		families:     table + "_families",
+		familyTokens: table + "_family_tokens",
+	}
+
+	queries := []string{
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS "%s" ("id" TEXT PRIMARY KEY, "user_identifier" TEXT NOT NULL, "ip" TEXT NOT NULL, "user_agent" TEXT NOT NULL, "device_name" TEXT NOT NULL, "platform" TEXT NOT NULL, "created_at" TIMESTAMPTZ NOT NULL);`,
+			table,
+		),
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS "%s" ("hash" TEXT PRIMARY KEY, "kind" TEXT NOT NULL, "claims" JSONB NOT NULL, "expires_at" TIMESTAMPTZ NOT NULL);`,
+			s.tokens,
+		),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" ("nonce" TEXT PRIMARY KEY, "expires_at" TIMESTAMPTZ NOT NULL);`, s.nonces),
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS "%s" ("id" TEXT PRIMARY KEY, "user_identifier" TEXT NOT NULL, "device" JSONB NOT NULL, "created_at" TIMESTAMPTZ NOT NULL, "expires_at" TIMESTAMPTZ, "head_jti" TEXT NOT NULL, "compromise" JSONB);`,
+			s.families,
+		),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_user_identifier_idx" ON "%s" ("user_identifier");`, s.families, s.families),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_expires_at_idx" ON "%s" ("expires_at");`, s.families, s.families),
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS "%s" ("family_id" TEXT NOT NULL REFERENCES "%s" ("id") ON DELETE CASCADE, "position" INTEGER NOT NULL, "jti" TEXT NOT NULL, "ip" TEXT NOT NULL, "issued_at" TIMESTAMPTZ NOT NULL, "consumed_at" TIMESTAMPTZ, "revoked_at" TIMESTAMPTZ, PRIMARY KEY ("family_id", "position"), UNIQUE ("family_id", "jti"));`,
+			s.familyTokens, s.families,
+		),
+	}
+	for _, query := range queries {
+		if _, err := conn.Exec(s.ctx, query); err != nil {
+			return nil, fmt.Errorf("Unable to Create Table: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// CreateSession records session, sanitizing its device info
+func (s *PGSessionStore) CreateSession(session Session) error {
+	device := session.Device.Sanitize()
+	query := fmt.Sprintf(
+		`INSERT INTO "%s" ("id", "user_identifier", "ip", "user_agent", "device_name", "platform", "created_at") VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		s.table,
+	)
+
+	_, err := s.conn.Exec(s.ctx, query,
+		session.ID, session.UserIdentifier, device.IP, device.UserAgent, device.DeviceName, device.Platform, session.CreatedAt)
+	return err
+}
+
+// ListSessions returns the sessions of a user, oldest first
+func (s *PGSessionStore) ListSessions(userIdentifier string) ([]Session, error) {
+	query := fmt.Sprintf(
+		`SELECT "id", "user_identifier", "ip", "user_agent", "device_name", "platform", "created_at" FROM "%s" WHERE "user_identifier"=$1 ORDER BY "created_at"`,
+		s.table,
+	)
+
+	rows, err := s.conn.Query(s.ctx, query, userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Session, error) {
+		var session Session
+		err := row.Scan(
+			&session.ID,
+			&session.UserIdentifier,
+			&session.Device.IP,
+			&session.Device.UserAgent,
+			&session.Device.DeviceName,
+			&session.Device.Platform,
+			&session.CreatedAt,
+		)
+		session.CreatedAt = session.CreatedAt.In(time.UTC)
+		return session, err
+	})
+}
+
+// SaveToken records the token, purging the records past their ExpiresAt first
+func (s *PGSessionStore) SaveToken(record TokenRecord) error {
+	claims, err := json.Marshal(record.Claims)
+	if err != nil {
+		return err
+	}
+
+	purge := fmt.Sprintf(`DELETE FROM "%s" WHERE "expires_at" < now()`, s.tokens)
+	if _, err := s.conn.Exec(s.ctx, purge); err != nil {
+		return err
+	}
+	query := fmt.Sprintf(
+		`INSERT INTO "%s" ("hash", "kind", "claims", "expires_at") VALUES ($1, $2, $3, $4)`,
+		s.tokens,
+	)
+	_, err = s.conn.Exec(s.ctx, query, record.Hash, record.Kind, string(claims), record.ExpiresAt)
+	return err
+}
+
+// GetToken returns the record of the token with the given hash
+func (s *PGSessionStore) GetToken(hash string) (TokenRecord, error) {
+	query := fmt.Sprintf(`SELECT "hash", "kind", "claims", "expires_at" FROM "%s" WHERE "hash"=$1`, s.tokens)
+	rows, err := s.conn.Query(s.ctx, query, hash)
+	if err != nil {
+		return TokenRecord{}, err
+	}
+	record, err := pgx.CollectOneRow(rows, func(row pgx.CollectableRow) (TokenRecord, error) {
+		var record TokenRecord
+		var claims []byte
+		if err := row.Scan(&record.Hash, &record.Kind, &claims, &record.ExpiresAt); err != nil {
+			return record, err
+		}
+		return record, json.Unmarshal(claims, &record.Claims)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TokenRecord{}, ErrTokenNotFound
+	}
+	return record, err
+}
+
+// DeleteToken removes the record of the token with the given hash, unknown hashes are ignored
+func (s *PGSessionStore) DeleteToken(hash string) error {
+	query := fmt.Sprintf(`DELETE FROM "%s" WHERE "hash"=$1`, s.tokens)
+	_, err := s.conn.Exec(s.ctx, query, hash)
+	return err
+}
+
+// SaveNonce records a login challenge nonce, purging the expired ones first
+func (s *PGSessionStore) SaveNonce(nonce string, expiresAt time.Time) error {
+	purge := fmt.Sprintf(`DELETE FROM "%s" WHERE "expires_at" < now()`, s.nonces)
+	if _, err := s.conn.Exec(s.ctx, purge); err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`INSERT INTO "%s" ("nonce", "expires_at") VALUES ($1, $2)`, s.nonces)
+	_, err := s.conn.Exec(s.ctx, query, nonce, expiresAt)
+	return err
+}
+
+// ConsumeNonce removes a nonce, see NonceStore. The row is deleted and read in one statement,
+// so concurrent logins racing for the same nonce cannot both consume it.
+func (s *PGSessionStore) ConsumeNonce(nonce string) error {
+	query := fmt.Sprintf(`DELETE FROM "%s" WHERE "nonce"=$1 RETURNING "expires_at"`, s.nonces)
+	rows, err := s.conn.Query(s.ctx, query, nonce)
+	if err != nil {
+		return err
+	}
+	expiresAt, err := pgx.CollectOneRow(rows, pgx.RowTo[time.Time])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNonceUsed
+	}
+	if err != nil {
+		return err
+	}
+	if !time.Now().Before(expiresAt) {
+		return ErrNonceExpired
+	}
+	return nil
+}
@@ -8,32 +8,89 @@ import (
 	"maps"
 	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgx/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
+// deletedAtColumn marks soft-deleted users when soft_delete is enabled
+const deletedAtColumn = "deleted_at"
+
+// pgUniqueViolation is the SQLSTATE postgres reports when a unique or primary key constraint fails
+const pgUniqueViolation = "23505"
+
+// pgUndefinedTable is the SQLSTATE postgres reports when a queried table does not exist
+const pgUndefinedTable = "42P01"
+
+// pgUndefinedColumn is the SQLSTATE postgres reports when a queried column does not exist
+const pgUndefinedColumn = "42703"
+
+// DBConn is the subset of *pgx.Conn used by AuthifyDB.
+// It is satisfied by *pgx.Conn and *pgxpool.Pool, and lets tests substitute a fake connection.
+type DBConn interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
 type AuthifyDB struct {
-	conn     *pgx.Conn
+	conn     DBConn // retry, whose transient failures are retried
+	retry    *retryConn
 	ctx      context.Context
 	storeCfg StoreConfig
+	hasher   PasswordHasher
+	dummy    dummyHash
+	// noDisabledColumn is set once the table turned out to lack the disabled column managed
+	// by the store, which only auto_create and auto_migrate add
+	noDisabledColumn atomic.Bool
 }
 
 // This function takes in a connection string and a table name.
-// It initializes a connection with the database, and sets its context as context.Background()
+// It opens a pool of connections to the database, so concurrent requests each get their own,
+// and sets its context as context.Background(). The pool is sized with the pool_max_conns
+// parameter of the connection string (by default the greater of 4 and the number of CPUs),
+// and replaces broken connections on its own.
 // After that, it attempts to create table if it does not exist with the passed tablename and config in the store.yml file.
+// The database is tried once by default, with opts it can be retried with backoff, e.g. for
+// servers started before their database, and fails with ErrStoreUnavailable once it gave up.
+// See NewLazyAuthifyDB for a store connecting on first use.
 // Documentation for pgx package: https://pkg.go.dev/github.com/jackc/pgx/v5
-func NewAuthifyDB(connString string, cfg StoreConfig) (*AuthifyDB, error) {
-	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, connString)
+func NewAuthifyDB(connString string, cfg StoreConfig, opts ...ConnectOption) (*AuthifyDB, error) {
+	pool, err := connectPool(context.Background(), connString, newConnectOptions(opts))
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to database: %w", err)
+		return nil, err
 	}
 
+	db, err := NewAuthifyDBFromConn(pool, cfg)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	log.Println("Connection with database established")
+	return db, nil
+}
+
+// NewAuthifyDBFromConn builds the store on top of an already established connection,
+// creating the table if auto_create is set in the config and adding the missing columns
+// if auto_migrate is.
+// Transient failures are retried as configured in cfg.Retry, but the connection is only
+// re-established once WithReconnect provides a way to do so.
+func NewAuthifyDBFromConn(conn DBConn, cfg StoreConfig) (*AuthifyDB, error) {
+	hasher, err := hasherFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	retry := newRetryConn(conn, cfg.Retry)
 	db := &AuthifyDB{
-		conn:     conn,
+		conn:     retry,
+		retry:    retry,
 		ctx:      ctx,
 		storeCfg: cfg,
+		hasher:   hasher,
 	}
 
 	if cfg.AutoCreate {
@@ -41,8 +98,12 @@ func NewAuthifyDB(connString string, cfg StoreConfig) (*AuthifyDB, error) {
 			return nil, fmt.Errorf("Unable to Create Table: %w", err)
 		}
 	}
+	if cfg.AutoMigrate {
+		if err = db.autoMigrate(); err != nil {
+			return nil, err
+		}
+	}
 
-	log.Println("Connection with database established")
 	return db, nil
 }
 
@@ -50,48 +111,160 @@ func (db *AuthifyDB) StoreConfig() StoreConfig {
 	return db.storeCfg
 }
 
+// WithReconnect lets the store replace a dead connection with one returned by dial,
+// for stores built on a single connection with NewAuthifyDBFromConn; pools replace their own.
+func (db *AuthifyDB) WithReconnect(dial func(ctx context.Context) (DBConn, error)) *AuthifyDB {
+	db.retry.dial = dial
+	return db
+}
+
+// Close releases the connections of the store, including the ones used by its session store
+// and the other stores sharing its connection
+func (db *AuthifyDB) Close() error {
+	switch conn := db.retry.current().(type) {
+	case interface{ Close() }:
+		conn.Close()
+	case interface{ Close(context.Context) error }:
+		return conn.Close(db.ctx)
+	}
+	return nil
+}
+
+// Retries counts the statements retried after a transient failure since the store was created
+func (db *AuthifyDB) Retries() int64 {
+	return db.retry.retries.Load()
+}
+
+// WithPasswordHasher overrides the hasher selected by the password_hasher config key.
+// Existing hashes keep verifying since the stored format identifies its algorithm.
+func (db *AuthifyDB) WithPasswordHasher(h PasswordHasher) *AuthifyDB {
+	db.hasher = h
+	return db
+}
+
 // This function takes in username and password
 // It creates the username with hashed password and provided information, as per config in database
-// Noteworthy that the cost passed to GenerateFromPassword function is the default cost (10)
-// Documentation for bcrypt: https://pkg.go.dev/golang.org/x/crypto/bcrypt
-func (db *AuthifyDB) CreateUser(data map[string]any) error {
-	query, args, err := db.buildCreateUserQuery(data)
+// The password column is hashed with the store's PasswordHasher (bcrypt unless configured otherwise)
+// It returns the non-hidden columns of the user, the ones left to the database, such as defaults
+// and sequences, are read back with RETURNING.
+func (db *AuthifyDB) CreateUser(data map[string]any) (map[string]string, error) {
+	return db.CreateUserContext(db.ctx, data)
+}
+
+// CreateUserContext is CreateUser bound to ctx, which cancels both the password hashing and the insert
+func (db *AuthifyDB) CreateUserContext(ctx context.Context, data map[string]any) (map[string]string, error) {
+	query, args, values, err := db.buildCreateUserQuery(ctx, data)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	user := make(map[string]string)
+	var returning []string
+	for _, name := range db.storeCfg.visibleColumns() {
+		col := db.storeCfg.Columns[name]
+		if val, ok := values[name]; ok {
+			user[name] = formatColumnValue(val)
+		} else if col.Default != "" || col.Generator != "" {
+			returning = append(returning, fmt.Sprintf(`"%s"`, name))
+		}
+	}
+	if len(returning) == 0 {
+		_, err = db.conn.Exec(ctx, query, args...)
+		if err != nil {
+			return nil, insertError(err)
+		}
+		return user, nil
 	}
 
-	_, err = db.conn.Exec(db.ctx, query, args...)
+	rows, err := db.conn.Query(ctx, query+" RETURNING "+strings.Join(returning, ", "), args...)
+	if err != nil {
+		return nil, insertError(err)
+	}
+	row, err := pgx.CollectOneRow(rows, pgx.RowToMap)
+	if err != nil {
+		return nil, insertError(err)
+	}
+	for name, val := range row {
+		if val != nil {
+			user[name] = formatColumnValue(val)
+		}
+	}
+	return user, nil
+}
+
+// CreateUserReturning is CreateUser, which returns the created row since it is part of Store.
+func (db *AuthifyDB) CreateUserReturning(data map[string]any) (map[string]string, error) {
+	return db.CreateUser(data)
+}
+
+// insertError translates unique constraint violations into ErrUserExists
+func insertError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+		return fmt.Errorf("%w: %s", ErrUserExists, pgErr.Detail)
+	}
 	return err
 }
 
-func (db *AuthifyDB) buildCreateUserQuery(data map[string]any) (string, []any, error) {
+// formatColumnValue renders values decoded by pgx the way they are written in postgres
+func formatColumnValue(val any) string {
+	switch v := val.(type) {
+	case [16]byte:
+		return formatUUID(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// buildCreateUserQuery returns the INSERT statement of a new user, its arguments and the values
+// inserted by column. The values of generators are computed here, so they are inserted even in
+// tables created without the matching defaults, except for sequences, left to the database.
+func (db *AuthifyDB) buildCreateUserQuery(ctx context.Context, data map[string]any) (string, []any, map[string]any, error) {
+	if err := db.storeCfg.ValidateInput(data); err != nil {
+		return "", nil, nil, err
+	}
+	if err := db.storeCfg.checkRoleField(data); err != nil {
+		return "", nil, nil, err
+	}
+
 	cols := make([]string, 0, len(db.storeCfg.Columns))
 	args := make([]any, 0, len(db.storeCfg.Columns))
 	placeholders := make([]string, 0, len(db.storeCfg.Columns))
+	values := make(map[string]any, len(db.storeCfg.Columns))
 
 	i := 1
 	for name, cfg := range db.storeCfg.Columns {
 		val, ok := data[name]
 
-		if cfg.Required && !ok && cfg.Default == "" {
-			return "", nil, fmt.Errorf("missing required field: %s", name)
+		if cfg.Required && !ok && cfg.Default == "" && cfg.Generator == "" {
+			return "", nil, nil, fmt.Errorf("%w: %s", ErrMissingField, name)
 		}
 
-		if !ok {
+		if !ok && (cfg.Generator == "" || cfg.Generator == GeneratorSequence) {
 			continue
 		}
+		if !ok {
+			generated, err := cfg.generate()
+			if err != nil {
+				return "", nil, nil, err
+			}
+			val = generated
+		}
 
 		if cfg.IsPassword {
-			hash, err := bcrypt.GenerateFromPassword([]byte(val.(string)), bcrypt.DefaultCost)
+			hash, err := hashPassword(ctx, db.hasher, val.(string))
 			if err != nil {
-				return "", nil, err
+				return "", nil, nil, err
 			}
-			val = string(hash)
+			val = hash
 		}
 
 		cols = append(cols, fmt.Sprintf(`"%s"`, name))
 		args = append(args, val)
 		placeholders = append(placeholders, fmt.Sprintf("$%d", i))
+		values[name] = val
 		i++
 	}
 
@@ -102,118 +275,592 @@ func (db *AuthifyDB) buildCreateUserQuery(data map[string]any) (string, []any, e
 		strings.Join(placeholders, ", "),
 	)
 
-	return query, args, nil
+	return query, args, values, nil
+}
+
+// CountUsers returns the number of users in the table, leaving out soft-deleted ones.
+// Counting is left to postgres, which can answer from an index-only scan.
+func (db *AuthifyDB) CountUsers() (int, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, db.storeCfg.Name)
+	if db.storeCfg.SoftDelete {
+		query += fmt.Sprintf(` WHERE "%s" IS NULL`, deletedAtColumn)
+	}
+
+	rows, err := db.conn.Query(db.ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	count, err := pgx.CollectOneRow(rows, pgx.RowTo[int64])
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
 }
 
 // This function takes in the user identifier and password and returns info of user after password validation
-// uses bcrypt's CompareHashAndPassword function for password validation
+// disabled users are rejected with ErrAccountDisabled once their password checks out
+// uses the PasswordHasher matching the stored hash format for password validation
+// hashes created with a lower cost than the configured one are upgraded transparently
+// unknown users cost a password comparison too, so timing does not reveal them
 func (db *AuthifyDB) GetUserInfo(userIdentifier, password string) (map[string]any, error) {
 	userData, err := db.fetchUserData(userIdentifier)
 	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			db.dummy.compare(db.hasher, password)
+		}
 		return nil, err
 	}
 
 	passwordColumn := db.storeCfg.getPasswordColumnName()
-	err = db.validatePassword(userData[passwordColumn].(string), password)
+	hashed, _ := userData[passwordColumn].(string)
+	err = db.validatePassword(hashed, password)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, userIdentifier)
+	}
+
+	disabledColumn, _ := db.storeCfg.getDisabledColumnName()
+	if isDisabledValue(userData[disabledColumn]) {
+		return nil, fmt.Errorf("%w: %s", ErrAccountDisabled, userIdentifier)
+	}
+
+	rehashOnLogin(db, db.hasher, userIdentifier, hashed, password)
+
+	result := make(map[string]any, len(userData))
+	for name, val := range userData {
+		if cfg, ok := db.storeCfg.Columns[name]; ok && !cfg.Hidden {
+			result[name] = val
+		}
+	}
+
+	return result, nil
+}
+
+// PasswordSettings returns the settings of the user's bcrypt hash for a login challenge,
+// made-up ones for unknown users, see ProofAuthenticator
+func (db *AuthifyDB) PasswordSettings(userIdentifier string) (string, error) {
+	userData, err := db.fetchUserData(userIdentifier)
+	if errors.Is(err, ErrUserNotFound) {
+		return fakePasswordSettings(userIdentifier, db.storeCfg.BcryptCost), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hashed, _ := userData[db.storeCfg.getPasswordColumnName()].(string)
+	return PasswordSettings(hashed)
+}
+
+// GetUserInfoWithProof authenticates with the proof answering a login challenge, see ChallengeProof,
+// and returns the user's non-hidden columns. Disabled users are rejected once their proof checks out.
+func (db *AuthifyDB) GetUserInfoWithProof(userIdentifier, nonce, proof string) (map[string]any, error) {
+	userData, err := db.fetchUserData(userIdentifier)
 	if err != nil {
 		return nil, err
 	}
 
+	hashed, _ := userData[db.storeCfg.getPasswordColumnName()].(string)
+	if err := checkChallengeProof(hashed, nonce, proof); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, userIdentifier)
+	}
+
+	disabledColumn, _ := db.storeCfg.getDisabledColumnName()
+	if isDisabledValue(userData[disabledColumn]) {
+		return nil, fmt.Errorf("%w: %s", ErrAccountDisabled, userIdentifier)
+	}
+
 	result := make(map[string]any, len(userData))
 	for name, val := range userData {
 		if cfg, ok := db.storeCfg.Columns[name]; ok && !cfg.Hidden {
 			result[name] = val
 		}
 	}
+	return result, nil
+}
+
+// UserExists reports whether a user, soft-deleted ones included, has value in column,
+// which must be unique, see ExistenceChecker. Columns of other types than text are
+// compared as text, so values that do not parse as their type are simply not found.
+func (db *AuthifyDB) UserExists(ctx context.Context, column, value string) (bool, error) {
+	if err := db.storeCfg.checkExistsColumn(column); err != nil {
+		return false, err
+	}
+
+	target := fmt.Sprintf(`"%s"`, column)
+	if db.storeCfg.Columns[column].Type != "text" {
+		target += "::text"
+	}
+	query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM "%s" WHERE %s = $1)`, db.storeCfg.Name, target)
+
+	rows, err := db.conn.Query(ctx, query, value)
+	if err != nil {
+		return false, err
+	}
+	return pgx.CollectOneRow(rows, pgx.RowTo[bool])
+}
+
+// GetUserByUsername takes in the user identifier and returns the user's non-hidden columns,
+// without any password validation. NULL columns are left out.
+func (db *AuthifyDB) GetUserByUsername(userIdentifier string) (map[string]string, error) {
+	userData, err := db.fetchUserData(userIdentifier)
+	if err != nil {
+		return nil, err
+	}
 
+	result := make(map[string]string, len(userData))
+	for name, val := range userData {
+		if cfg, ok := db.storeCfg.Columns[name]; ok && !cfg.Hidden && val != nil {
+			result[name] = formatColumnValue(val)
+		}
+	}
 	return result, nil
 }
 
-func (db *AuthifyDB) validatePassword(userPassword, password string) error {
-	if err := bcrypt.CompareHashAndPassword(
-		[]byte(userPassword),
-		[]byte(password),
-	); err != nil {
-		return ErrInvalidPassword
+// ListUsers returns a page of users ordered by primary key, see UserIterator. Pages are fetched
+// with keyset pagination, WHERE key > after rather than OFFSET, so deep pages cost an index range
+// scan like the first one, and users created meanwhile do not shift the pages. NULL columns are
+// left out.
+func (db *AuthifyDB) ListUsers(ctx context.Context, after string, limit int) ([]map[string]string, string, error) {
+	if limit <= 0 {
+		limit = DefaultIterateBatchSize
+	}
+	identifierColumn := db.storeCfg.getIdentifierColumnName()
+	selectCols := []string{identifierColumn}
+	for _, name := range slices.Sorted(maps.Keys(db.storeCfg.Columns)) {
+		if name != identifierColumn && !db.storeCfg.Columns[name].Hidden {
+			selectCols = append(selectCols, name)
+		}
+	}
+
+	var conditions []string
+	var args []any
+	if after != "" {
+		// the cursor is sent as text and cast, so keys of any type compare in their own order
+		cursor := "$1"
+		if colType := db.storeCfg.Columns[identifierColumn].Type; colType != "text" {
+			cursor = "$1::text::" + colType
+		}
+		conditions = append(conditions, fmt.Sprintf(`"%s" > %s`, identifierColumn, cursor))
+		args = append(args, after)
+	}
+	if db.storeCfg.SoftDelete {
+		conditions = append(conditions, fmt.Sprintf(`"%s" IS NULL`, deletedAtColumn))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// one more row than asked tells whether a page follows
+	data, err := db.queryWithDisabled(ctx, func(cols []string) string {
+		return fmt.Sprintf(
+			`SELECT %s FROM "%s"%s ORDER BY "%s" LIMIT %d`,
+			`"`+strings.Join(cols, `","`)+`"`,
+			db.storeCfg.Name,
+			where,
+			identifierColumn,
+			limit+1,
+		)
+	}, selectCols, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(data) > limit {
+		data = data[:limit]
+		next = formatColumnValue(data[limit-1][identifierColumn])
+	}
+	users := make([]map[string]string, 0, len(data))
+	for _, row := range data {
+		user := make(map[string]string, len(row))
+		for name, val := range row {
+			if !db.storeCfg.Columns[name].Hidden && val != nil {
+				user[name] = formatColumnValue(val)
+			}
+		}
+		users = append(users, user)
+	}
+	return users, next, nil
+}
+
+// IterateUsers calls fn for every user ordered by primary key, fetching batchSize users at a
+// time, see UserIterator and ListUsers
+func (db *AuthifyDB) IterateUsers(ctx context.Context, batchSize int, fn func(user map[string]string) error) error {
+	return iterateUsers(ctx, batchSize, db.ListUsers, fn)
+}
+
+// UpdateUser takes in the user identifier and the columns to overwrite.
+// Unknown columns are ignored, and password columns are hashed just like in CreateUser.
+// With token_versions enabled, a new password bumps the token version of the user.
+func (db *AuthifyDB) UpdateUser(userIdentifier string, data map[string]any) error {
+	if err := db.storeCfg.ValidateInput(data); err != nil {
+		return err
+	}
+	if err := db.storeCfg.checkRoleField(data); err != nil {
+		return err
+	}
+
+	sets := make([]string, 0, len(data))
+	args := make([]any, 0, len(data)+1)
+
+	i := 1
+	for name, val := range data {
+		cfg, ok := db.storeCfg.Columns[name]
+		if !ok {
+			continue
+		}
+
+		if cfg.IsPassword {
+			hash, err := db.hasher.Hash(val.(string))
+			if err != nil {
+				return err
+			}
+			val = hash
+			if db.storeCfg.TokenVersions {
+				sets = append(sets, fmt.Sprintf(`"%s"="%s"+1`, tokenVersionColumn, tokenVersionColumn))
+			}
+		}
+
+		sets = append(sets, fmt.Sprintf(`"%s"=$%d`, name, i))
+		args = append(args, val)
+		i++
+	}
+
+	if len(sets) == 0 {
+		return nil
+	}
+
+	query := fmt.Sprintf(
+		`UPDATE "%s" SET %s WHERE "%s"=$%d%s`,
+		db.storeCfg.Name,
+		strings.Join(sets, ", "),
+		db.storeCfg.getIdentifierColumnName(),
+		i,
+		db.notDeletedFilter(),
+	)
+	args = append(args, userIdentifier)
+
+	tag, err := db.conn.Exec(db.ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, userIdentifier)
 	}
 	return nil
 }
 
-func (db *AuthifyDB) fetchUserData(userIdentifier string) (map[string]any, error) {
-	selectCols := slices.Collect(maps.Keys(db.storeCfg.Columns))
+// DeleteUser takes in the user identifier and removes the user.
+// With soft_delete enabled the row is kept and stamped with deleted_at instead,
+// which hides it from every lookup (so no tokens can be generated for it) until RestoreUser.
+// Its identifier and unique columns stay taken meanwhile: creating a user with them fails with
+// ErrUserExists on the unique constraint.
+func (db *AuthifyDB) DeleteUser(userIdentifier string) error {
 	identifierColumn := db.storeCfg.getIdentifierColumnName()
+
+	var query string
+	if db.storeCfg.SoftDelete {
+		query = fmt.Sprintf(
+			`UPDATE "%s" SET "%s"=now() WHERE "%s"=$1%s`,
+			db.storeCfg.Name,
+			deletedAtColumn,
+			identifierColumn,
+			db.notDeletedFilter(),
+		)
+	} else {
+		query = fmt.Sprintf(`DELETE FROM "%s" WHERE "%s"=$1`, db.storeCfg.Name, identifierColumn)
+	}
+
+	if err := db.execForUser(query, userIdentifier); err != nil {
+		return err
+	}
+	if db.storeCfg.SoftDelete || db.storeCfg.previousPasswords() == 0 {
+		return nil
+	}
+	// a user created later under the same identifier starts without history
+	_, err := db.conn.Exec(db.ctx, fmt.Sprintf(`DELETE FROM "%s" WHERE "username"=$1`, db.passwordHistoryTable()), userIdentifier)
+	return err
+}
+
+// ChangeRole takes in the user identifier and the new role, and updates the role column alone.
+// The role must be one of AllowedRoles when the store config lists them.
+func (db *AuthifyDB) ChangeRole(userIdentifier, newRole string) error {
+	if err := db.storeCfg.validateRole(newRole); err != nil {
+		return err
+	}
+	query := fmt.Sprintf(
+		`UPDATE "%s" SET "%s"=$2 WHERE "%s"=$1%s`,
+		db.storeCfg.Name,
+		db.storeCfg.getRoleColumnName(),
+		db.storeCfg.getIdentifierColumnName(),
+		db.notDeletedFilter(),
+	)
+
+	return db.execForUser(query, userIdentifier, newRole)
+}
+
+// SetUserDisabled takes in the user identifier and suspends or reactivates the user,
+// disabled users keep their data but can no longer authenticate.
+// Without a column marked is_disabled, the table needs the disabled column added by
+// auto_create or auto_migrate, otherwise ErrDisablingNotSupported is returned.
+func (db *AuthifyDB) SetUserDisabled(userIdentifier string, disabled bool) error {
+	disabledColumn, _ := db.storeCfg.getDisabledColumnName()
 	query := fmt.Sprintf(
-		`SELECT %s FROM "%s" WHERE %s=$1`,
-		`"`+strings.Join(selectCols, `","`)+`"`,
+		`UPDATE "%s" SET "%s"=$2 WHERE "%s"=$1%s`,
 		db.storeCfg.Name,
-		identifierColumn,
+		disabledColumn,
+		db.storeCfg.getIdentifierColumnName(),
+		db.notDeletedFilter(),
 	)
-	row, err := db.conn.Query(db.ctx, query, userIdentifier)
+
+	err := db.execForUser(query, userIdentifier, disabled)
+	if isUndefinedColumn(err, disabledColumn) {
+		db.noDisabledColumn.Store(true)
+		return fmt.Errorf("%w: table %s has no %s column, enable auto_migrate to add it", ErrDisablingNotSupported, db.storeCfg.Name, disabledColumn)
+	}
+	return err
+}
+
+// IsUserDisabled takes in the user identifier and reports whether the user is disabled.
+// Users of tables lacking the disabled column managed by the store are never disabled.
+func (db *AuthifyDB) IsUserDisabled(userIdentifier string) (bool, error) {
+	userData, err := db.fetchUserData(userIdentifier)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	data, err := pgx.CollectOneRow(
-		row,
-		pgx.RowToMap,
+	disabledColumn, _ := db.storeCfg.getDisabledColumnName()
+	return isDisabledValue(userData[disabledColumn]), nil
+}
+
+// TokenVersion takes in the user identifier and returns its token version, see TokenVersioner.
+func (db *AuthifyDB) TokenVersion(userIdentifier string) (int, error) {
+	if !db.storeCfg.TokenVersions {
+		return 0, ErrTokenVersionsDisabled
+	}
+
+	query := fmt.Sprintf(
+		`SELECT "%s" FROM "%s" WHERE "%s"=$1%s`,
+		tokenVersionColumn,
+		db.storeCfg.Name,
+		db.storeCfg.getIdentifierColumnName(),
+		db.notDeletedFilter(),
 	)
+
+	rows, err := db.conn.Query(db.ctx, query, userIdentifier)
+	if err != nil {
+		return 0, err
+	}
+	row, err := pgx.CollectOneRow(rows, pgx.RowToMap)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, ErrUserNotFound
+			return 0, fmt.Errorf("%w: %s", ErrUserNotFound, userIdentifier)
 		}
-		return nil, err
+		return 0, err
 	}
-	return data, nil
+	return tokenVersionValue(row[tokenVersionColumn]), nil
 }
 
-func (db *AuthifyDB) createTableIfNotExists() error {
-	if !db.storeCfg.AutoCreate {
-		return nil
+// BumpTokenVersion takes in the user identifier and increments its token version,
+// invalidating the tokens issued before.
+func (db *AuthifyDB) BumpTokenVersion(userIdentifier string) error {
+	if !db.storeCfg.TokenVersions {
+		return ErrTokenVersionsDisabled
 	}
 
-	cols, primaryKeys, err := db.constructColumnRowFromConfig(db.storeCfg.Columns)
+	query := fmt.Sprintf(
+		`UPDATE "%s" SET "%s"="%s"+1 WHERE "%s"=$1%s`,
+		db.storeCfg.Name,
+		tokenVersionColumn,
+		tokenVersionColumn,
+		db.storeCfg.getIdentifierColumnName(),
+		db.notDeletedFilter(),
+	)
+
+	return db.execForUser(query, userIdentifier)
+}
+
+// globalNotBeforeKey is the row of the "<name>_settings" table holding the global not-before time
+const globalNotBeforeKey = "global_not_before"
+
+// settingsTable returns the table of the store's settings, created by the first SetGlobalNotBefore
+func (db *AuthifyDB) settingsTable() string {
+	return db.storeCfg.Name + "_settings"
+}
+
+// GetGlobalNotBefore returns the time before which every token is rejected, read from the
+// "<name>_settings" table, and the zero time while the table or its row does not exist.
+func (db *AuthifyDB) GetGlobalNotBefore() (time.Time, error) {
+	query := fmt.Sprintf(`SELECT "value" FROM "%s" WHERE "key"=$1`, db.settingsTable())
+	rows, err := db.conn.Query(db.ctx, query, globalNotBeforeKey)
 	if err != nil {
-		return err
+		return time.Time{}, notBeforeError(err)
+	}
+	value, err := pgx.CollectOneRow(rows, pgx.RowTo[string])
+	if err != nil {
+		return time.Time{}, notBeforeError(err)
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// notBeforeError hides the errors of a global not-before time that was never set
+func notBeforeError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.Is(err, pgx.ErrNoRows) || (errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable) {
+		return nil
 	}
+	return err
+}
 
-	if len(primaryKeys) > 0 {
-		cols = append(cols, fmt.Sprintf("PRIMARY KEY (%s)",
-			strings.Join(primaryKeys, ", ")))
+// SetGlobalNotBefore invalidates every token issued before t, for every instance sharing the database
+func (db *AuthifyDB) SetGlobalNotBefore(t time.Time) error {
+	table := db.settingsTable()
+	create := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" ("key" TEXT PRIMARY KEY, "value" TEXT NOT NULL);`, table)
+	if _, err := db.conn.Exec(db.ctx, create); err != nil {
+		return fmt.Errorf("Unable to Create Table: %w", err)
 	}
 
 	query := fmt.Sprintf(
-		`CREATE TABLE IF NOT EXISTS "%s" (%s);`,
+		`INSERT INTO "%s" ("key", "value") VALUES ($1, $2) ON CONFLICT ("key") DO UPDATE SET "value"=EXCLUDED."value"`,
+		table,
+	)
+	_, err := db.conn.Exec(db.ctx, query, globalNotBeforeKey, t.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// RestoreUser takes in the user identifier of a soft-deleted user and clears its deleted_at mark.
+func (db *AuthifyDB) RestoreUser(userIdentifier string) error {
+	if !db.storeCfg.SoftDelete {
+		return ErrSoftDeleteDisabled
+	}
+
+	query := fmt.Sprintf(
+		`UPDATE "%s" SET "%s"=NULL WHERE "%s"=$1 AND "%s" IS NOT NULL`,
 		db.storeCfg.Name,
-		strings.Join(cols, ", "),
+		deletedAtColumn,
+		db.storeCfg.getIdentifierColumnName(),
+		deletedAtColumn,
 	)
 
-	_, err = db.conn.Exec(db.ctx, query)
-	return err
+	return db.execForUser(query, userIdentifier)
 }
 
-func (db *AuthifyDB) constructColumnRowFromConfig(columns map[string]ColumnConfig) (cols []string, primaryKeys []string, err error) {
-	for name, cfg := range db.storeCfg.Columns {
-		sqlType, ok := allowedTypes[cfg.Type]
-		if !ok {
-			err = errors.New(fmt.Sprintf("unsupported column type: %s", cfg.Type))
-			return
-		}
+// execForUser runs a statement targeting a single user ($1), reporting ErrUserNotFound if no row matched
+func (db *AuthifyDB) execForUser(query string, userIdentifier string, args ...any) error {
+	tag, err := db.conn.Exec(db.ctx, query, append([]any{userIdentifier}, args...)...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, userIdentifier)
+	}
+	return nil
+}
 
-		col := fmt.Sprintf(`"%s" %s`, name, sqlType)
-		if cfg.Required {
-			col += " NOT NULL "
-		}
-		if cfg.Unique {
-			col += " UNIQUE"
-		}
-		if cfg.Default != "" {
-			col += fmt.Sprintf(" DEFAULT '%s'", cfg.Default)
-		}
+// notDeletedFilter returns the WHERE clause suffix excluding soft-deleted users, if enabled
+func (db *AuthifyDB) notDeletedFilter() string {
+	if !db.storeCfg.SoftDelete {
+		return ""
+	}
+	return fmt.Sprintf(` AND "%s" IS NULL`, deletedAtColumn)
+}
 
-		cols = append(cols, col)
+func (db *AuthifyDB) validatePassword(userPassword, password string) error {
+	if err := comparePassword(db.hasher, userPassword, password); err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
 
-		if cfg.PrimaryKey {
-			primaryKeys = append(primaryKeys, fmt.Sprintf(`"%s"`, name))
+func (db *AuthifyDB) fetchUserData(userIdentifier string) (map[string]any, error) {
+	selectCols := slices.Collect(maps.Keys(db.storeCfg.Columns))
+	identifierColumn := db.storeCfg.getIdentifierColumnName()
+	data, err := db.queryWithDisabled(db.ctx, func(cols []string) string {
+		return fmt.Sprintf(
+			`SELECT %s FROM "%s" WHERE %s=$1%s`,
+			`"`+strings.Join(cols, `","`)+`"`,
+			db.storeCfg.Name,
+			identifierColumn,
+			db.notDeletedFilter(),
+		)
+	}, selectCols, userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, userIdentifier)
+	}
+	return data[0], nil
+}
+
+// queryWithDisabled runs the query build returns for cols plus the disabled column managed by
+// the store, unless a column is marked is_disabled, and collects its rows. Tables created
+// without auto_create may lack that column: the query is then run again without it, and the
+// store stops asking for it, so the users of such tables are never disabled.
+func (db *AuthifyDB) queryWithDisabled(ctx context.Context, build func(cols []string) string, cols []string, args ...any) ([]map[string]any, error) {
+	disabledColumn, configured := db.storeCfg.getDisabledColumnName()
+	if configured || db.noDisabledColumn.Load() {
+		return db.collectRows(ctx, build(cols), args...)
+	}
+
+	data, err := db.collectRows(ctx, build(append(slices.Clip(cols), disabledColumn)), args...)
+	if isUndefinedColumn(err, disabledColumn) {
+		log.Printf("Table %s has no %s column, users cannot be disabled until auto_migrate adds it\n", db.storeCfg.Name, disabledColumn)
+		db.noDisabledColumn.Store(true)
+		return db.collectRows(ctx, build(cols), args...)
+	}
+	return data, err
+}
+
+// isUndefinedColumn reports whether err is postgres complaining that column does not exist
+func isUndefinedColumn(err error, column string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUndefinedColumn && strings.Contains(pgErr.Message, `"`+column+`"`)
+}
+
+func (db *AuthifyDB) collectRows(ctx context.Context, query string, args ...any) ([]map[string]any, error) {
+	rows, err := db.conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToMap)
+}
+
+func (db *AuthifyDB) createTableIfNotExists() error {
+	if !db.storeCfg.AutoCreate {
+		return nil
+	}
+
+	query, err := db.createTableQuery()
+	if err != nil {
+		return err
+	}
+	if _, err = db.conn.Exec(db.ctx, query); err != nil {
+		return err
+	}
+
+	if disabledColumn, configured := db.storeCfg.getDisabledColumnName(); !configured {
+		// tables created before accounts could be disabled lack the dedicated column
+		_, err = db.conn.Exec(db.ctx, fmt.Sprintf(
+			`ALTER TABLE "%s" ADD COLUMN IF NOT EXISTS "%s" BOOLEAN NOT NULL DEFAULT false;`,
+			db.storeCfg.Name,
+			disabledColumn,
+		))
+		if err != nil {
+			return err
 		}
 	}
-	return
+	if db.storeCfg.TokenVersions {
+		// likewise for tables created before token_versions was enabled
+		_, err = db.conn.Exec(db.ctx, fmt.Sprintf(
+			`ALTER TABLE "%s" ADD COLUMN IF NOT EXISTS "%s" INTEGER NOT NULL DEFAULT 0;`,
+			db.storeCfg.Name,
+			tokenVersionColumn,
+		))
+		if err != nil {
+			return err
+		}
+	}
+	if db.storeCfg.previousPasswords() > 0 {
+		err = db.createPasswordHistoryTable()
+	}
+	return err
 }
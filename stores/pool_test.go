@@ -0,0 +1,308 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// testDatabaseURLEnv points the load test at a real postgres database, it is skipped otherwise
+const testDatabaseURLEnv = "AUTHIFY_TEST_DATABASE_URL"
+
+var errConnBusy = errors.New("conn busy")
+
+var (
+	loadInsertRe = regexp.MustCompile(`^INSERT INTO "\w+" \((.+)\) VALUES`)
+	loadSelectRe = regexp.MustCompile(`^SELECT (.+) FROM "\w+" WHERE`)
+)
+
+// loadTable is the users table shared by the connections of a loadPool
+type loadTable struct {
+	mu    sync.Mutex
+	users map[string]map[string]any
+}
+
+// loadConn is a single connection which, like *pgx.Conn, must not be used concurrently:
+// a statement issued while another one is in progress fails with errConnBusy
+type loadConn struct {
+	busy  atomic.Bool
+	table *loadTable
+}
+
+// acquire marks the connection busy for a statement, which takes a simulated round trip
+// so statements sharing a connection overlap
+func (c *loadConn) acquire() error {
+	if !c.busy.CompareAndSwap(false, true) {
+		return errConnBusy
+	}
+	time.Sleep(time.Millisecond)
+	return nil
+}
+
+func (c *loadConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if err := c.acquire(); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer c.busy.Store(false)
+
+	match := loadInsertRe.FindStringSubmatch(sql)
+	if match == nil {
+		// CREATE TABLE and the like
+		return pgconn.CommandTag{}, nil
+	}
+	row := make(map[string]any)
+	for i, col := range strings.Split(match[1], ", ") {
+		row[strings.Trim(col, `"`)] = args[i]
+	}
+
+	c.table.mu.Lock()
+	defer c.table.mu.Unlock()
+	username := row["username"].(string)
+	if _, exists := c.table.users[username]; exists {
+		return pgconn.CommandTag{}, &pgconn.PgError{Code: pgUniqueViolation}
+	}
+	c.table.users[username] = row
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+// Query keeps the connection busy until the returned rows are closed
+func (c *loadConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+
+	c.table.mu.Lock()
+	defer c.table.mu.Unlock()
+	if strings.HasPrefix(sql, "SELECT COUNT(*) ") {
+		return &loadRows{conn: c, cols: []string{"count"}, values: [][]any{{int64(len(c.table.users))}}}, nil
+	}
+	match := loadSelectRe.FindStringSubmatch(sql)
+	if match == nil {
+		c.busy.Store(false)
+		return nil, errors.New("unexpected query: " + sql)
+	}
+
+	rows := &loadRows{conn: c}
+	for _, col := range strings.Split(match[1], ",") {
+		rows.cols = append(rows.cols, strings.Trim(col, `"`))
+	}
+	if user, ok := c.table.users[args[0].(string)]; ok {
+		values := make([]any, len(rows.cols))
+		for i, col := range rows.cols {
+			values[i] = user[col]
+		}
+		rows.values = [][]any{values}
+	}
+	return rows, nil
+}
+
+// loadPool hands every statement an idle connection, like *pgxpool.Pool
+type loadPool struct {
+	idle chan *loadConn
+}
+
+func newLoadPool(size int) *loadPool {
+	table := &loadTable{users: make(map[string]map[string]any)}
+	p := &loadPool{idle: make(chan *loadConn, size)}
+	for range size {
+		p.idle <- &loadConn{table: table}
+	}
+	return p
+}
+
+func (p *loadPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	c := <-p.idle
+	defer func() { p.idle <- c }()
+	return c.Exec(ctx, sql, args...)
+}
+
+func (p *loadPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	c := <-p.idle
+	rows, err := c.Query(ctx, sql, args...)
+	if err != nil {
+		p.idle <- c
+		return nil, err
+	}
+	rows.(*loadRows).release = func() { p.idle <- c }
+	return rows, nil
+}
+
+type loadRows struct {
+	conn    *loadConn
+	release func()
+	closed  bool
+	cols    []string
+	values  [][]any
+	pos     int
+}
+
+func (r *loadRows) Close() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if r.conn != nil {
+		r.conn.busy.Store(false)
+	}
+	if r.release != nil {
+		r.release()
+	}
+}
+
+func (r *loadRows) Err() error                    { return nil }
+func (r *loadRows) CommandTag() pgconn.CommandTag { return pgconn.CommandTag{} }
+func (r *loadRows) RawValues() [][]byte           { return nil }
+func (r *loadRows) Conn() *pgx.Conn               { return nil }
+func (r *loadRows) Values() ([]any, error)        { return r.values[r.pos-1], nil }
+
+func (r *loadRows) FieldDescriptions() []pgconn.FieldDescription {
+	fds := make([]pgconn.FieldDescription, len(r.cols))
+	for i, col := range r.cols {
+		fds[i] = pgconn.FieldDescription{Name: col}
+	}
+	return fds
+}
+
+func (r *loadRows) Next() bool {
+	if r.pos >= len(r.values) {
+		r.Close()
+		return false
+	}
+	r.pos++
+	return true
+}
+
+func (r *loadRows) Scan(dest ...any) error {
+	if scanner, ok := dest[0].(pgx.RowScanner); ok {
+		return scanner.ScanRow(r)
+	}
+	*dest[0].(*int64) = r.values[r.pos-1][0].(int64)
+	return nil
+}
+
+func loadTestConfig(name string) StoreConfig {
+	return StoreConfig{
+		Name:       name,
+		BcryptCost: 4,
+		Columns: map[string]ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+			"email":    {Type: "text"},
+		},
+	}
+}
+
+// runLoad has workers goroutines create a user each, log in with it and count the users,
+// all at the same time, and checks every call succeeds with the expected result
+func runLoad(t *testing.T, db *AuthifyDB, workers int) {
+	t.Helper()
+	start := make(chan struct{})
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			username := fmt.Sprintf("user%d", i)
+			email := username + "@example.com"
+			if _, err := db.CreateUser(map[string]any{"username": username, "password": "password123", "email": email}); err != nil {
+				errs <- fmt.Errorf("create %s: %w", username, err)
+				return
+			}
+			for range 3 {
+				user, err := db.GetUserInfo(username, "password123")
+				if err != nil {
+					errs <- fmt.Errorf("login %s: %w", username, err)
+					return
+				}
+				if user["email"] != email {
+					errs <- fmt.Errorf("login %s: got the data of another user: %v", username, user)
+					return
+				}
+			}
+			if _, err := db.GetUserInfo(username, "wrong"); !errors.Is(err, ErrInvalidPassword) {
+				errs <- fmt.Errorf("login %s with a wrong password: expected ErrInvalidPassword, got %v", username, err)
+				return
+			}
+			if _, err := db.CountUsers(); err != nil {
+				errs <- fmt.Errorf("count: %w", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if count, err := db.CountUsers(); err != nil || count != workers {
+		t.Errorf("expected %d users after the load, got %d (%v)", workers, count, err)
+	}
+}
+
+func TestPGStoreConcurrentLoad(t *testing.T) {
+	db, err := NewAuthifyDBFromConn(newLoadPool(4), loadTestConfig("users"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	runLoad(t, db, 50)
+}
+
+// TestPGStoreConcurrentLoadPostgres runs the same load against a real database through
+// NewAuthifyDB, in a table of its own which is dropped afterwards
+func TestPGStoreConcurrentLoadPostgres(t *testing.T) {
+	connString := os.Getenv(testDatabaseURLEnv)
+	if connString == "" {
+		t.Skipf("%s is not set", testDatabaseURLEnv)
+	}
+
+	table := fmt.Sprintf("authify_load_%d", time.Now().UnixNano())
+	db, err := NewAuthifyDB(connString, loadTestConfig(table))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.conn.Exec(context.Background(), fmt.Sprintf(`DROP TABLE IF EXISTS "%s"`, table)); err != nil {
+			t.Errorf("failed to drop %s: %v", table, err)
+		}
+		db.Close()
+	})
+
+	runLoad(t, db, 50)
+}
+
+// closingConn is a single connection recording whether it was closed, like *pgx.Conn
+type closingConn struct {
+	schemaConn
+	closed bool
+	err    error
+}
+
+func (c *closingConn) Close(ctx context.Context) error {
+	c.closed = true
+	return c.err
+}
+
+func TestAuthifyDBClose(t *testing.T) {
+	errClose := errors.New("connection already closed")
+	conn := &closingConn{err: errClose}
+	db, err := NewAuthifyDBFromConn(conn, loadTestConfig("users"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if err := db.Close(); !conn.closed || !errors.Is(err, errClose) {
+		t.Errorf("expected the connection to be closed and its error returned, got closed=%v %v", conn.closed, err)
+	}
+}
@@ -0,0 +1,117 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// isProtectedColumn reports whether users may never edit col themselves: hidden and primary key
+// columns, and the ones holding credentials, roles, permissions or the account status
+func (cfg StoreConfig) isProtectedColumn(name string, col ColumnConfig) bool {
+	return col.Hidden || col.PrimaryKey || isPasswordColumn(name, col) || col.IsPermissions || col.IsDisabled ||
+		name == cfg.getRoleColumnName()
+}
+
+// checkEditableFields makes sure every field names an editable column, then validates the values
+func (cfg StoreConfig) checkEditableFields(fields map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		col, ok := cfg.Columns[name]
+		if !ok || !col.Editable || cfg.isProtectedColumn(name, col) {
+			return &FieldError{Field: name, Err: ErrFieldNotEditable}
+		}
+	}
+	data := make(map[string]any, len(fields))
+	for name, val := range fields {
+		data[name] = val
+	}
+	return cfg.ValidateInput(data)
+}
+
+// UpdateUserFields changes the editable columns of a user's own profile, see FieldUpdater
+func (m *InMemoryUserStore) UpdateUserFields(ctx context.Context, username string, fields map[string]string) error {
+	if err := m.storeCfg.checkEditableFields(fields); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, exists := m.users[username]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	for name, val := range fields {
+		if !m.storeCfg.Columns[name].Unique {
+			continue
+		}
+		for other, u := range m.users {
+			if other != username && u[name] == val {
+				return &FieldError{Field: name, Err: ErrFieldConflict}
+			}
+		}
+	}
+	maps.Copy(user, fields)
+	return m.persist()
+}
+
+// UpdateUserFields changes the editable columns of a user's own profile, see FieldUpdater
+func (db *AuthifyDB) UpdateUserFields(ctx context.Context, username string, fields map[string]string) error {
+	if err := db.storeCfg.checkEditableFields(fields); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	names := slices.Sorted(maps.Keys(fields))
+	sets := make([]string, len(names))
+	args := make([]any, len(names), len(names)+1)
+	for i, name := range names {
+		sets[i] = fmt.Sprintf(`"%s"=$%d`, name, i+1)
+		args[i] = fields[name]
+	}
+	query := fmt.Sprintf(
+		`UPDATE "%s" SET %s WHERE "%s"=$%d%s`,
+		db.storeCfg.Name,
+		strings.Join(sets, ", "),
+		db.storeCfg.getIdentifierColumnName(),
+		len(names)+1,
+		db.notDeletedFilter(),
+	)
+	args = append(args, username)
+
+	tag, err := db.conn.Exec(ctx, query, args...)
+	if err != nil {
+		return conflictError(err, names)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return nil
+}
+
+// uniqueKeyDetail extracts the column from the detail of unique violations, `Key (email)=(...) already exists.`
+var uniqueKeyDetail = regexp.MustCompile(`^Key \("?([^)",]+)"?\)=`)
+
+// conflictError translates unique constraint violations into ErrFieldConflict, naming the column
+// from the error detail, or the only updated column when postgres does not tell
+func conflictError(err error, columns []string) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != pgUniqueViolation {
+		return err
+	}
+	field := ""
+	if m := uniqueKeyDetail.FindStringSubmatch(pgErr.Detail); m != nil {
+		field = m[1]
+	} else if len(columns) == 1 {
+		field = columns[0]
+	}
+	return &FieldError{Field: field, Err: ErrFieldConflict}
+}
@@ -0,0 +1,107 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func profileTestConfig() StoreConfig {
+	cfg := loadTestConfig("users")
+	cfg.Columns["email"] = ColumnConfig{Type: "text", Unique: true, Editable: true}
+	cfg.Columns["display_name"] = ColumnConfig{Type: "text", Editable: true}
+	cfg.Columns["role"] = ColumnConfig{Type: "text", Default: "user"}
+	return cfg
+}
+
+func TestUpdateUserFields(t *testing.T) {
+	store := NewInMemoryUserStore(profileTestConfig())
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := store.CreateUser(map[string]any{"username": name, "password": "password123", "email": name + "@example.com"}); err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+	}
+	ctx := context.Background()
+
+	if err := store.UpdateUserFields(ctx, "alice", map[string]string{"display_name": "Alice", "email": "alice@example.org"}); err != nil {
+		t.Fatalf("failed to update editable fields: %v", err)
+	}
+	user, _ := store.GetUserByUsername("alice")
+	if user["display_name"] != "Alice" || user["email"] != "alice@example.org" {
+		t.Errorf("expected the fields to be updated, got %v", user)
+	}
+
+	cases := map[string]struct {
+		fields map[string]string
+		err    error
+		field  string
+	}{
+		"role":            {map[string]string{"display_name": "Root", "role": "admin"}, ErrFieldNotEditable, "role"},
+		"primary key":     {map[string]string{"username": "mallory"}, ErrFieldNotEditable, "username"},
+		"password":        {map[string]string{"password": "hunter2"}, ErrFieldNotEditable, "password"},
+		"unknown column":  {map[string]string{"phone": "555"}, ErrFieldNotEditable, "phone"},
+		"duplicate email": {map[string]string{"email": "bob@example.com"}, ErrFieldConflict, "email"},
+		"too long":        {map[string]string{"display_name": strings.Repeat("a", DefaultMaxLength+1)}, ErrFieldTooLong, "display_name"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := store.UpdateUserFields(ctx, "alice", tc.fields)
+			var fieldErr *FieldError
+			if !errors.Is(err, tc.err) || !errors.As(err, &fieldErr) || fieldErr.Field != tc.field {
+				t.Errorf("expected %v naming %s, got %v", tc.err, tc.field, err)
+			}
+		})
+	}
+	if user, _ := store.GetUserByUsername("alice"); user["display_name"] != "Alice" || user["role"] != "user" {
+		t.Errorf("expected rejected updates to change nothing, got %v", user)
+	}
+
+	if err := store.UpdateUserFields(ctx, "carol", map[string]string{"display_name": "Carol"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestUpdateUserFieldsPostgres(t *testing.T) {
+	ctx := context.Background()
+	conn := &schemaConn{}
+	db, err := NewAuthifyDBFromConn(conn, profileTestConfig())
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if err := db.UpdateUserFields(ctx, "alice", map[string]string{"role": "admin"}); !errors.Is(err, ErrFieldNotEditable) {
+		t.Errorf("expected ErrFieldNotEditable, got %v", err)
+	}
+	if len(conn.executed) != 0 {
+		t.Errorf("expected protected columns to never reach the database, got %v", conn.executed)
+	}
+
+	taken := &pgconn.PgError{Code: pgUniqueViolation, Detail: `Key (email)=(bob@example.com) already exists.`}
+	db = newRetryTestStore(t, &flakyConn{failures: 1, err: taken})
+	db.storeCfg = profileTestConfig()
+	err = db.UpdateUserFields(ctx, "alice", map[string]string{"email": "bob@example.com", "display_name": "Alice"})
+	var fieldErr *FieldError
+	if !errors.Is(err, ErrFieldConflict) || !errors.As(err, &fieldErr) || fieldErr.Field != "email" {
+		t.Errorf("expected ErrFieldConflict naming email, got %v", err)
+	}
+	if err := db.UpdateUserFields(ctx, "alice", map[string]string{"display_name": "Alice"}); err != nil {
+		t.Errorf("failed to update editable fields: %v", err)
+	}
+}
+
+func TestEditableProtectedColumns(t *testing.T) {
+	for _, name := range []string{"username", "password", "role"} {
+		cfg := profileTestConfig()
+		col := cfg.Columns[name]
+		col.Editable = true
+		cfg.Columns[name] = col
+		if err := cfg.Validate(); !errors.Is(err, ErrFieldNotEditable) {
+			t.Errorf("expected %s to be refused as editable, got %v", name, err)
+		}
+	}
+	if err := profileTestConfig().Validate(); err != nil {
+		t.Errorf("expected editable columns to be valid, got %v", err)
+	}
+}
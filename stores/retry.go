@@ -0,0 +1,214 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Defaults of RetryConfig, used for its zero fields
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 50 * time.Millisecond
+	defaultRetryMaxBackoff = 2 * time.Second
+)
+
+// RetryConfig controls how AuthifyDB retries statements failing with transient errors:
+// dropped connections, network timeouts, serialization failures and deadlocks.
+// Other errors, such as unique violations or authentication failures, are never retried.
+// Statements writing are only retried when they certainly did not take effect: after a
+// serialization failure or a deadlock, or a failure before they were sent. A dropped connection
+// or a timeout may come after the commit, replaying an insert would then report the user it
+// created as a duplicate, so the connection is re-established and the error returned.
+type RetryConfig struct {
+	// MaxAttempts bounds the tries of a statement, including the first one, 1 disables retries
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoff is the base wait before the first retry, doubled after every further one
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	// MaxBackoff caps the wait between two tries
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultRetryAttempts
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = defaultRetryBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = defaultRetryMaxBackoff
+	}
+	return c
+}
+
+// backoff returns the wait before retry n (starting at 1): exponential, capped, with full jitter
+func (c RetryConfig) backoff(n int) time.Duration {
+	d := c.MaxBackoff
+	if shift := n - 1; shift < 32 && c.InitialBackoff<<shift < c.MaxBackoff {
+		d = c.InitialBackoff << shift
+	}
+	return rand.N(d) + 1
+}
+
+// retryConn wraps the connection of AuthifyDB, retrying transient failures and
+// re-establishing the connection through dial once it is dead.
+type retryConn struct {
+	mu      sync.RWMutex
+	conn    DBConn
+	dial    func(ctx context.Context) (DBConn, error) // nil when the connection cannot be re-established
+	policy  RetryConfig
+	retries atomic.Int64
+	// set while a caller dials, the others keep going rather than waiting for it
+	reconnecting atomic.Bool
+}
+
+func newRetryConn(conn DBConn, policy RetryConfig) *retryConn {
+	return &retryConn{conn: conn, policy: policy.withDefaults()}
+}
+
+func (r *retryConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	var tag pgconn.CommandTag
+	err := r.do(ctx, sql, func(conn DBConn) (err error) {
+		tag, err = conn.Exec(ctx, sql, args...)
+		return err
+	})
+	return tag, err
+}
+
+func (r *retryConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	var rows pgx.Rows
+	err := r.do(ctx, sql, func(conn DBConn) (err error) {
+		rows, err = conn.Query(ctx, sql, args...)
+		return err
+	})
+	return rows, err
+}
+
+func (r *retryConn) current() DBConn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.conn
+}
+
+// do runs statement, the sql statement, retrying it while it fails with retryable errors
+func (r *retryConn) do(ctx context.Context, sql string, statement func(DBConn) error) error {
+	for attempt := 1; ; attempt++ {
+		conn := r.current()
+		err := statement(conn)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if isClosed(conn, err) {
+			r.reconnect(ctx, conn)
+		}
+		if attempt >= r.policy.MaxAttempts || !retryable(conn, sql, err) {
+			return err
+		}
+
+		r.retries.Add(1)
+		log.Printf("Retrying database statement after transient error (attempt %d of %d): %v", attempt+1, r.policy.MaxAttempts, err)
+
+		timer := time.NewTimer(r.policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// reconnect replaces dead with a new connection, unless another caller already did or is
+// dialing. The lock is only held to swap the connections, statements are not held up by a slow
+// dial: they keep failing on the dead connection until it is replaced.
+func (r *retryConn) reconnect(ctx context.Context, dead DBConn) {
+	if r.dial == nil || !r.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	defer r.reconnecting.Store(false)
+	if r.current() != dead {
+		return
+	}
+	if closer, ok := dead.(interface{ Close(context.Context) error }); ok {
+		closer.Close(ctx)
+	}
+
+	conn, err := r.dial(ctx)
+	if err != nil {
+		log.Printf("Unable to reconnect to database: %v", err)
+		return
+	}
+	r.mu.Lock()
+	r.conn = conn
+	r.mu.Unlock()
+	log.Println("Connection with database re-established")
+}
+
+// Transient SQLSTATEs: the statement was rolled back, or never ran, and may succeed if retried
+var transientPgCodes = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// retryable reports whether sql, which failed with err returned by conn, may run again: the
+// failure is transient, and the statement only reads or certainly did not take effect
+func retryable(conn DBConn, sql string, err error) bool {
+	return isTransient(conn, err) && (isRead(sql) || notApplied(err))
+}
+
+// notApplied reports whether a statement failing with err certainly did not take effect: it
+// failed before being sent, or was rolled back as a serialization failure or a deadlock
+func notApplied(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return pgconn.SafeToRetry(err)
+}
+
+// isRead reports whether sql is a plain query, which can be replayed whatever became of it
+func isRead(sql string) bool {
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(sql)), "SELECT")
+}
+
+// isTransient reports whether err, returned by conn, is worth retrying
+func isTransient(conn DBConn, err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// class 08 holds the connection exceptions
+		return transientPgCodes[pgErr.Code] || strings.HasPrefix(pgErr.Code, "08")
+	}
+	if pgconn.SafeToRetry(err) || pgconn.Timeout(err) || isClosed(conn, err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isClosed reports whether conn is dead and must be re-established
+func isClosed(conn DBConn, err error) bool {
+	if closed, ok := conn.(interface{ IsClosed() bool }); ok && closed.IsClosed() {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
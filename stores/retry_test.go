@@ -0,0 +1,228 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// flakyConn fails its first `failures` statements with err, then succeeds
+type flakyConn struct {
+	failures int
+	err      error
+	closed   bool
+	calls    int
+}
+
+func (c *flakyConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return pgconn.CommandTag{}, c.err
+	}
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+func (c *flakyConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, c.err
+	}
+	return &countRows{count: 1}, nil
+}
+
+func (c *flakyConn) IsClosed() bool { return c.closed }
+
+// unsentError is a failure before the statement was sent, which pgx reports as safe to retry
+type unsentError struct{ err error }
+
+func (e unsentError) Error() string     { return e.err.Error() }
+func (e unsentError) Unwrap() error     { return e.err }
+func (e unsentError) SafeToRetry() bool { return true }
+
+// committedConn commits its inserts, then fails the first one like a connection dropped before
+// the commit was acknowledged. Inserting a user again violates the primary key.
+type committedConn struct {
+	mu      sync.Mutex
+	inserts int
+	users   map[string]bool
+	closed  bool
+}
+
+func (c *committedConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inserts++
+	username := args[0].(string)
+	if c.users[username] {
+		return pgconn.CommandTag{}, &pgconn.PgError{Code: pgUniqueViolation}
+	}
+	c.users[username] = true
+	if c.inserts == 1 {
+		c.closed = true
+		return pgconn.CommandTag{}, io.ErrUnexpectedEOF
+	}
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+func (c *committedConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return nil, errors.New("unexpected query: " + sql)
+}
+
+func (c *committedConn) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func newRetryTestStore(t *testing.T, conn DBConn) *AuthifyDB {
+	t.Helper()
+	db, err := NewAuthifyDBFromConn(conn, StoreConfig{
+		Name:       "users",
+		BcryptCost: 4,
+		Columns: map[string]ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, IsPassword: true},
+		},
+		Retry: RetryConfig{MaxAttempts: 4, InitialBackoff: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	return db
+}
+
+var alice = map[string]any{"username": "alice", "password": "password123"}
+
+func TestRetryTransientErrors(t *testing.T) {
+	conn := &flakyConn{failures: 2, err: &pgconn.PgError{Code: "40001"}}
+	db := newRetryTestStore(t, conn)
+
+	if _, err := db.CreateUser(alice); err != nil {
+		t.Fatalf("expected the serialization failures to be retried, got %v", err)
+	}
+	if conn.calls != 3 || db.Retries() != 2 {
+		t.Errorf("expected 3 calls and 2 retries, got %d calls and %d retries", conn.calls, db.Retries())
+	}
+
+	// the budget bounds the tries of a statement
+	conn = &flakyConn{failures: 10, err: &pgconn.PgError{Code: "40P01"}}
+	db = newRetryTestStore(t, conn)
+	if _, err := db.CreateUser(alice); err == nil {
+		t.Fatal("expected an error once the retry budget is exhausted")
+	}
+	if conn.calls != 4 {
+		t.Errorf("expected 4 tries, got %d", conn.calls)
+	}
+}
+
+func TestRetryNeverRetriesPermanentErrors(t *testing.T) {
+	for name, err := range map[string]error{
+		"unique violation": &pgconn.PgError{Code: pgUniqueViolation},
+		"auth failure":     &pgconn.PgError{Code: "28P01"},
+	} {
+		conn := &flakyConn{failures: 1, err: err}
+		db := newRetryTestStore(t, conn)
+
+		_, err := db.CreateUser(alice)
+		if err == nil || conn.calls != 1 || db.Retries() != 0 {
+			t.Errorf("%s: expected a single failed call, got %d calls, %d retries and %v", name, conn.calls, db.Retries(), err)
+		}
+		if name == "unique violation" && !errors.Is(err, ErrUserExists) {
+			t.Errorf("expected ErrUserExists, got %v", err)
+		}
+	}
+}
+
+func TestRetryReconnects(t *testing.T) {
+	dead := &flakyConn{failures: 1, err: unsentError{io.EOF}, closed: true}
+	healthy := &flakyConn{}
+	dials := 0
+	db := newRetryTestStore(t, dead).WithReconnect(func(ctx context.Context) (DBConn, error) {
+		dials++
+		return healthy, nil
+	})
+
+	if _, err := db.CreateUser(alice); err != nil {
+		t.Fatalf("expected the statement to succeed on a new connection, got %v", err)
+	}
+	if dials != 1 || dead.calls != 1 || healthy.calls != 1 {
+		t.Errorf("expected one reconnection, got %d dials, %d calls on the dead and %d on the new connection", dials, dead.calls, healthy.calls)
+	}
+}
+
+func TestRetryNeverReplaysCommittedWrites(t *testing.T) {
+	conn := &committedConn{users: map[string]bool{}}
+	healthy := &flakyConn{}
+	dials := 0
+	db := newRetryTestStore(t, conn).WithReconnect(func(ctx context.Context) (DBConn, error) {
+		dials++
+		return healthy, nil
+	})
+
+	_, err := db.CreateUser(alice)
+	if err == nil || errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected the dropped connection to be reported, got %v", err)
+	}
+	if conn.inserts != 1 || db.Retries() != 0 {
+		t.Errorf("expected the insert not to be replayed, got %d inserts and %d retries", conn.inserts, db.Retries())
+	}
+	if dials != 1 {
+		t.Errorf("expected the connection to be re-established, got %d dials", dials)
+	}
+
+	// reads are replayed after the same failures
+	conn2 := &flakyConn{failures: 1, err: &pgconn.PgError{Code: "08006"}}
+	db = newRetryTestStore(t, conn2)
+	if count, err := db.CountUsers(); err != nil || count != 1 {
+		t.Errorf("expected the count to be retried, got %d (%v)", count, err)
+	}
+	if conn2.calls != 2 {
+		t.Errorf("expected 2 calls, got %d", conn2.calls)
+	}
+}
+
+func TestRetryReconnectDoesNotBlockStatements(t *testing.T) {
+	dead := &flakyConn{failures: 100, err: io.EOF, closed: true}
+	dialing, release := make(chan struct{}), make(chan struct{})
+	db := newRetryTestStore(t, dead).WithReconnect(func(ctx context.Context) (DBConn, error) {
+		close(dialing)
+		<-release
+		return &flakyConn{}, nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.CreateUser(alice)
+		done <- err
+	}()
+	<-dialing
+
+	// a statement issued during the dial fails on the dead connection rather than waiting
+	counted := make(chan error, 1)
+	go func() {
+		_, err := db.CountUsers()
+		counted <- err
+	}()
+	select {
+	case err := <-counted:
+		if err == nil {
+			t.Error("expected the statement to fail on the dead connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the statement not to wait for the dial")
+	}
+
+	close(release)
+	if err := <-done; err == nil {
+		t.Error("expected the insert on the dead connection to fail")
+	}
+	if _, err := db.CreateUser(alice); err != nil {
+		t.Errorf("expected statements to use the new connection, got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// columnSchema describes a column of the users table as the store config defines it
+type columnSchema struct {
+	definition string // used by CREATE TABLE and ADD COLUMN, e.g. "email" TEXT NOT NULL
+	sqlType    string
+}
+
+// columnsQuery lists the columns of the users table and their data_type
+const columnsQuery = `SELECT "column_name", "data_type" FROM information_schema.columns ` +
+	`WHERE "table_schema" = current_schema() AND "table_name" = $1`
+
+// constraintsQuery lists the columns of the users table covered by a unique or primary key
+// constraint, and the type of the constraint
+const constraintsQuery = `SELECT kcu."column_name", tc."constraint_type" FROM information_schema.table_constraints tc ` +
+	`JOIN information_schema.key_column_usage kcu ON kcu."constraint_name" = tc."constraint_name" AND kcu."table_schema" = tc."table_schema" ` +
+	`WHERE tc."table_schema" = current_schema() AND tc."table_name" = $1 AND tc."constraint_type" IN ('UNIQUE', 'PRIMARY KEY')`
+
+// informationSchemaTypes maps the SQL types of allowedTypes to the data_type
+// reported for them by information_schema.columns
+var informationSchemaTypes = map[string]string{
+	"TEXT":      "text",
+	"INTEGER":   "integer",
+	"BOOLEAN":   "boolean",
+	"UUID":      "uuid",
+	"JSONB":     "jsonb",
+	"TIMESTAMP": "timestamp without time zone",
+}
+
+// schemaColumns returns the columns of the users table, the configured ones plus the ones
+// managed by the store, along with the quoted names of the primary key columns
+func (db *AuthifyDB) schemaColumns() (map[string]columnSchema, []string, error) {
+	cols := make(map[string]columnSchema, len(db.storeCfg.Columns)+2)
+	var primaryKeys []string
+	for name, cfg := range db.storeCfg.Columns {
+		sqlType, ok := allowedTypes[cfg.Type]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported column type: %s", cfg.Type)
+		}
+
+		col := fmt.Sprintf(`"%s" %s`, name, sqlType)
+		if cfg.Required {
+			col += " NOT NULL "
+		}
+		if cfg.Unique {
+			col += " UNIQUE"
+		}
+		if cfg.isGeneratedDefault() {
+			col += fmt.Sprintf(" DEFAULT %s", cfg.Default)
+		} else if cfg.Default != "" {
+			col += fmt.Sprintf(" DEFAULT '%s'", cfg.Default)
+		} else {
+			col += cfg.generatorDefault()
+		}
+		cols[name] = columnSchema{definition: col, sqlType: sqlType}
+
+		if cfg.PrimaryKey {
+			primaryKeys = append(primaryKeys, fmt.Sprintf(`"%s"`, name))
+		}
+	}
+
+	if db.storeCfg.SoftDelete {
+		cols[deletedAtColumn] = columnSchema{definition: fmt.Sprintf(`"%s" TIMESTAMP`, deletedAtColumn), sqlType: "TIMESTAMP"}
+	}
+	if disabledColumn, configured := db.storeCfg.getDisabledColumnName(); !configured {
+		cols[disabledColumn] = columnSchema{definition: fmt.Sprintf(`"%s" BOOLEAN NOT NULL DEFAULT false`, disabledColumn), sqlType: "BOOLEAN"}
+	}
+	if db.storeCfg.TokenVersions {
+		cols[tokenVersionColumn] = columnSchema{definition: fmt.Sprintf(`"%s" INTEGER NOT NULL DEFAULT 0`, tokenVersionColumn), sqlType: "INTEGER"}
+	}
+	slices.Sort(primaryKeys)
+	return cols, primaryKeys, nil
+}
+
+// createTableQuery returns the CREATE TABLE IF NOT EXISTS statement of the users table
+func (db *AuthifyDB) createTableQuery() (string, error) {
+	cols, primaryKeys, err := db.schemaColumns()
+	if err != nil {
+		return "", err
+	}
+
+	defs := make([]string, 0, len(cols)+1)
+	for _, name := range slices.Sorted(maps.Keys(cols)) {
+		defs = append(defs, cols[name].definition)
+	}
+	if len(primaryKeys) > 0 {
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(primaryKeys, ", ")))
+	}
+
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (%s);`, db.storeCfg.Name, strings.Join(defs, ", ")), nil
+}
+
+// schemaChange is a DDL statement reconciling the users table with the store config
+type schemaChange struct {
+	statement string
+	// additive changes only create the table or add columns, they never touch existing data
+	additive bool
+}
+
+// DiffSchema compares the users table with the store config and returns the DDL statements
+// reconciling them, without running them: the CREATE TABLE statement when the table does not
+// exist, otherwise an ADD COLUMN per missing column and an ALTER COLUMN ... TYPE per column
+// whose type differs, ordered by column name. Columns unknown to the config are left alone.
+// No statements are returned when the table matches the config.
+func (db *AuthifyDB) DiffSchema() ([]string, error) {
+	changes, err := db.diffSchema()
+	if err != nil {
+		return nil, err
+	}
+	var statements []string
+	for _, change := range changes {
+		statements = append(statements, change.statement)
+	}
+	return statements, nil
+}
+
+func (db *AuthifyDB) diffSchema() ([]schemaChange, error) {
+	expected, _, err := db.schemaColumns()
+	if err != nil {
+		return nil, err
+	}
+
+	actual, err := db.queryPairs(db.ctx, columnsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(actual) == 0 {
+		query, err := db.createTableQuery()
+		if err != nil {
+			return nil, err
+		}
+		return []schemaChange{{statement: query, additive: true}}, nil
+	}
+
+	var changes []schemaChange
+	for _, name := range slices.Sorted(maps.Keys(expected)) {
+		col := expected[name]
+		dataType, exists := actual[name]
+		switch {
+		case !exists:
+			changes = append(changes, schemaChange{
+				statement: fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN %s;`, db.storeCfg.Name, strings.TrimSpace(col.definition)),
+				additive:  true,
+			})
+		case dataType != informationSchemaTypes[col.sqlType]:
+			changes = append(changes, schemaChange{statement: fmt.Sprintf(
+				`ALTER TABLE "%s" ALTER COLUMN "%s" TYPE %s USING "%s"::%s;`,
+				db.storeCfg.Name, name, col.sqlType, name, col.sqlType,
+			)})
+		}
+	}
+	return changes, nil
+}
+
+// autoMigrate applies the additive changes of DiffSchema, creating the table or adding the
+// missing columns, logging each statement. Nothing is applied when a column needs another
+// type: that takes a manual migration, and ErrUnsafeMigration names the statements to review.
+func (db *AuthifyDB) autoMigrate() error {
+	changes, err := db.diffSchema()
+	if err != nil {
+		return err
+	}
+
+	var unsafe []string
+	for _, change := range changes {
+		if !change.additive {
+			unsafe = append(unsafe, change.statement)
+		}
+	}
+	if len(unsafe) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnsafeMigration, strings.Join(unsafe, " "))
+	}
+
+	for _, change := range changes {
+		if _, err := db.conn.Exec(db.ctx, change.statement); err != nil {
+			return fmt.Errorf("migrating table %s: %w", db.storeCfg.Name, err)
+		}
+		log.Printf("Migrated table %s: %s\n", db.storeCfg.Name, change.statement)
+	}
+	return nil
+}
+
+// SchemaReport is how the users table differs from the store config, see VerifySchema.
+// Errors break the store, e.g. missing columns, while warnings may only break some values,
+// e.g. columns of another type than configured.
+type SchemaReport struct {
+	Table    string
+	Errors   []string
+	Warnings []string
+}
+
+// OK reports whether the table has no errors, warnings aside
+func (r SchemaReport) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// VerifySchema compares the users table, as information_schema describes it, with the store
+// config, without changing either. A missing table, missing columns and unique or primary key
+// columns without a constraint enforcing it are errors, columns of another type are warnings.
+// Columns unknown to the config are left alone.
+func (db *AuthifyDB) VerifySchema(ctx context.Context) (SchemaReport, error) {
+	report := SchemaReport{Table: db.storeCfg.Name}
+	expected, _, err := db.schemaColumns()
+	if err != nil {
+		return report, err
+	}
+	actual, err := db.queryPairs(ctx, columnsQuery)
+	if err != nil {
+		return report, err
+	}
+	if len(actual) == 0 {
+		report.Errors = append(report.Errors, fmt.Sprintf("table %q does not exist", db.storeCfg.Name))
+		return report, nil
+	}
+	constraints, err := db.queryPairs(ctx, constraintsQuery)
+	if err != nil {
+		return report, err
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(expected)) {
+		dataType, exists := actual[name]
+		if !exists {
+			report.Errors = append(report.Errors, fmt.Sprintf("column %q is missing", name))
+			continue
+		}
+		if want := informationSchemaTypes[expected[name].sqlType]; dataType != want {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("column %q is %s, the config expects %s", name, dataType, want))
+		}
+
+		col := db.storeCfg.Columns[name]
+		switch constraint := constraints[name]; {
+		case col.PrimaryKey && constraint != "PRIMARY KEY":
+			report.Errors = append(report.Errors, fmt.Sprintf("column %q is not the primary key", name))
+		case col.Unique && constraint == "":
+			report.Errors = append(report.Errors, fmt.Sprintf("column %q has no unique constraint", name))
+		}
+	}
+	return report, nil
+}
+
+// queryPairs runs columnsQuery or constraintsQuery on the users table and returns its rows,
+// pairs of strings, as a map
+func (db *AuthifyDB) queryPairs(ctx context.Context, query string) (map[string]string, error) {
+	rows, err := db.conn.Query(ctx, query, db.storeCfg.Name)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make(map[string]string)
+	var key, value string
+	_, err = pgx.ForEachRow(rows, []any{&key, &value}, func() error {
+		// a primary key column may also carry a unique constraint, the primary key wins
+		if pairs[key] != "PRIMARY KEY" {
+			pairs[key] = value
+		}
+		return nil
+	})
+	return pairs, err
+}
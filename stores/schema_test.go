@@ -0,0 +1,267 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// schemaConn answers information_schema queries with the columns of an existing table,
+// mapped to their data_type, and its constraints, mapped to their type, and records the
+// statements executed on it
+type schemaConn struct {
+	columns     map[string]string
+	constraints map[string]string
+	executed    []string
+}
+
+func (c *schemaConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	c.executed = append(c.executed, sql)
+	return pgconn.CommandTag{}, nil
+}
+
+func (c *schemaConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	pairs := c.columns
+	switch {
+	case args[0] != "users":
+		return nil, errors.New("unexpected table: " + args[0].(string))
+	case strings.Contains(sql, "information_schema.table_constraints"):
+		pairs = c.constraints
+	case !strings.Contains(sql, "information_schema.columns"):
+		return nil, errors.New("unexpected query: " + sql)
+	}
+	rows := &schemaRows{}
+	for name, value := range pairs {
+		rows.values = append(rows.values, [2]string{name, value})
+	}
+	return rows, nil
+}
+
+type schemaRows struct {
+	values [][2]string
+	pos    int
+}
+
+func (r *schemaRows) Close()                                       {}
+func (r *schemaRows) Err() error                                   { return nil }
+func (r *schemaRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (r *schemaRows) RawValues() [][]byte                          { return nil }
+func (r *schemaRows) Conn() *pgx.Conn                              { return nil }
+func (r *schemaRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *schemaRows) Values() ([]any, error)                       { return nil, nil }
+
+func (r *schemaRows) Next() bool {
+	if r.pos >= len(r.values) {
+		return false
+	}
+	r.pos++
+	return true
+}
+
+func (r *schemaRows) Scan(dest ...any) error {
+	*dest[0].(*string) = r.values[r.pos-1][0]
+	*dest[1].(*string) = r.values[r.pos-1][1]
+	return nil
+}
+
+var schemaTestConfig = StoreConfig{
+	Name:       "users",
+	SoftDelete: true,
+	Columns: map[string]ColumnConfig{
+		"username": {Type: "text", Required: true, PrimaryKey: true},
+		"password": {Type: "text", Required: true, IsPassword: true},
+		"age":      {Type: "int"},
+		"verified": {Type: "bool", Default: "false"},
+	},
+}
+
+func TestDiffSchema(t *testing.T) {
+	cases := []struct {
+		name    string
+		columns map[string]string
+		want    []string
+	}{
+		{
+			name: "up to date",
+			columns: map[string]string{
+				"username": "text", "password": "text", "age": "integer", "verified": "boolean",
+				"deleted_at": "timestamp without time zone", "disabled": "boolean",
+			},
+			want: nil,
+		},
+		{
+			name: "drift",
+			columns: map[string]string{
+				"username": "text", "password": "text", "age": "text",
+				"disabled": "boolean", "nickname": "text",
+			},
+			want: []string{
+				`ALTER TABLE "users" ALTER COLUMN "age" TYPE INTEGER USING "age"::INTEGER;`,
+				`ALTER TABLE "users" ADD COLUMN "deleted_at" TIMESTAMP;`,
+				`ALTER TABLE "users" ADD COLUMN "verified" BOOLEAN DEFAULT 'false';`,
+			},
+		},
+		{
+			name:    "missing table",
+			columns: nil,
+			want: []string{
+				`CREATE TABLE IF NOT EXISTS "users" ("age" INTEGER, "deleted_at" TIMESTAMP, "disabled" BOOLEAN NOT NULL DEFAULT false, ` +
+					`"password" TEXT NOT NULL , "username" TEXT NOT NULL , "verified" BOOLEAN DEFAULT 'false', PRIMARY KEY ("username"));`,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := NewAuthifyDBFromConn(&schemaConn{columns: tc.columns}, schemaTestConfig)
+			if err != nil {
+				t.Fatalf("failed to create store: %v", err)
+			}
+			got, err := db.DiffSchema()
+			if err != nil {
+				t.Fatalf("failed to diff schema: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected statements:\ngot  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAutoMigrate(t *testing.T) {
+	cfg := schemaTestConfig
+	cfg.AutoMigrate = true
+
+	t.Run("adds missing columns", func(t *testing.T) {
+		conn := &schemaConn{columns: map[string]string{
+			"username": "text", "password": "text", "age": "integer", "disabled": "boolean",
+		}}
+		if _, err := NewAuthifyDBFromConn(conn, cfg); err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		want := []string{
+			`ALTER TABLE "users" ADD COLUMN "deleted_at" TIMESTAMP;`,
+			`ALTER TABLE "users" ADD COLUMN "verified" BOOLEAN DEFAULT 'false';`,
+		}
+		if !reflect.DeepEqual(conn.executed, want) {
+			t.Errorf("unexpected statements:\ngot  %q\nwant %q", conn.executed, want)
+		}
+	})
+
+	t.Run("adds the token_version column", func(t *testing.T) {
+		cfg := cfg
+		cfg.TokenVersions = true
+		conn := &schemaConn{columns: map[string]string{
+			"username": "text", "password": "text", "age": "integer", "verified": "boolean",
+			"deleted_at": "timestamp without time zone", "disabled": "boolean",
+		}}
+		if _, err := NewAuthifyDBFromConn(conn, cfg); err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		want := []string{`ALTER TABLE "users" ADD COLUMN "token_version" INTEGER NOT NULL DEFAULT 0;`}
+		if !reflect.DeepEqual(conn.executed, want) {
+			t.Errorf("unexpected statements:\ngot  %q\nwant %q", conn.executed, want)
+		}
+	})
+
+	t.Run("refuses to retype columns", func(t *testing.T) {
+		conn := &schemaConn{columns: map[string]string{
+			"username": "text", "password": "text", "age": "text", "disabled": "boolean",
+		}}
+		_, err := NewAuthifyDBFromConn(conn, cfg)
+		if !errors.Is(err, ErrUnsafeMigration) || !strings.Contains(err.Error(), `ALTER COLUMN "age"`) {
+			t.Errorf("expected ErrUnsafeMigration naming the age column, got %v", err)
+		}
+		if len(conn.executed) > 0 {
+			t.Errorf("expected nothing to be applied, got %q", conn.executed)
+		}
+	})
+}
+
+func TestVerifySchema(t *testing.T) {
+	cfg := schemaTestConfig
+	cfg.Columns = map[string]ColumnConfig{
+		"username": {Type: "text", Required: true, PrimaryKey: true},
+		"password": {Type: "text", Required: true, IsPassword: true},
+		"email":    {Type: "text", Unique: true},
+		"age":      {Type: "int"},
+	}
+	upToDate := map[string]string{
+		"username": "text", "password": "text", "email": "text", "age": "integer",
+		"deleted_at": "timestamp without time zone", "disabled": "boolean",
+	}
+	constraints := map[string]string{"username": "PRIMARY KEY", "email": "UNIQUE"}
+	with := func(columns map[string]string, name, dataType string) map[string]string {
+		changed := maps.Clone(columns)
+		if dataType == "" {
+			delete(changed, name)
+		} else {
+			changed[name] = dataType
+		}
+		return changed
+	}
+
+	cases := []struct {
+		name        string
+		columns     map[string]string
+		constraints map[string]string
+		errors      []string
+		warnings    []string
+	}{
+		{name: "up to date", columns: upToDate, constraints: constraints},
+		{
+			name:        "missing column",
+			columns:     with(upToDate, "email", ""),
+			constraints: constraints,
+			errors:      []string{`column "email" is missing`},
+		},
+		{
+			name:        "wrong type",
+			columns:     with(upToDate, "age", "text"),
+			constraints: constraints,
+			warnings:    []string{`column "age" is text, the config expects integer`},
+		},
+		{
+			name:        "missing constraints",
+			columns:     upToDate,
+			constraints: map[string]string{"email": "UNIQUE"},
+			errors:      []string{`column "username" is not the primary key`},
+		},
+		{
+			name:        "missing unique constraint",
+			columns:     upToDate,
+			constraints: map[string]string{"username": "PRIMARY KEY"},
+			errors:      []string{`column "email" has no unique constraint`},
+		},
+		{name: "missing table", errors: []string{`table "users" does not exist`}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := &schemaConn{columns: tc.columns, constraints: tc.constraints}
+			db, err := NewAuthifyDBFromConn(conn, cfg)
+			if err != nil {
+				t.Fatalf("failed to create store: %v", err)
+			}
+			report, err := db.VerifySchema(context.Background())
+			if err != nil {
+				t.Fatalf("failed to verify schema: %v", err)
+			}
+			if !reflect.DeepEqual(report.Errors, tc.errors) || !reflect.DeepEqual(report.Warnings, tc.warnings) {
+				t.Errorf("unexpected report:\ngot  %q %q\nwant %q %q", report.Errors, report.Warnings, tc.errors, tc.warnings)
+			}
+			if report.OK() != (len(tc.errors) == 0) {
+				t.Errorf("expected OK to be %v", len(tc.errors) == 0)
+			}
+			if len(conn.executed) > 0 {
+				t.Errorf("expected no statements, got %q", conn.executed)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package stores
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// clientSecretBytes is the entropy of generated client secrets, 256 bits
+const clientSecretBytes = 32
+
+// ServiceAccount is a non-human client, such as a background job, obtaining tokens with its
+// client ID and secret instead of a username and password, see token.JWTManager.GenerateServiceToken.
+type ServiceAccount struct {
+	ClientID string `json:"client_id"`
+	// SecretHash is the SHA-256 hash of the client secret, the secret itself is never stored
+	SecretHash string    `json:"-"`
+	Scopes     []string  `json:"scopes"` // the most tokens of the account can be granted
+	Disabled   bool      `json:"disabled"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CheckSecret fails with ErrInvalidClientCredentials unless clientSecret is the account's
+// secret, and with ErrAccountDisabled when the account is disabled.
+func (a ServiceAccount) CheckSecret(clientSecret string) error {
+	hash := hashClientSecret(clientSecret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(a.SecretHash)) != 1 {
+		return ErrInvalidClientCredentials
+	}
+	if a.Disabled {
+		return fmt.Errorf("%w: %s", ErrAccountDisabled, a.ClientID)
+	}
+	return nil
+}
+
+// ServiceAccountStore keeps service accounts, enabled with service_accounts in the store config.
+// Secrets are generated by the store and only returned when created or rotated, unknown client
+// IDs fail with ErrServiceAccountNotFound.
+type ServiceAccountStore interface {
+	CreateServiceAccount(clientID string, scopes []string) (clientSecret string, err error)
+	RotateServiceAccountSecret(clientID string) (clientSecret string, err error)
+	SetServiceAccountDisabled(clientID string, disabled bool) error
+	GetServiceAccount(clientID string) (ServiceAccount, error)
+}
+
+// newClientSecret returns a random client secret along with its hash. Secrets carry 256 bits
+// of entropy, so unlike passwords a fast hash is enough to store them.
+func newClientSecret() (secret, hash string, err error) {
+	b := make([]byte, clientSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(b)
+	return secret, hashClientSecret(secret), nil
+}
+
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// InMemoryServiceAccountStore keeps service accounts in memory, for tests and single instance deployments
+type InMemoryServiceAccountStore struct {
+	mu       sync.RWMutex
+	accounts map[string]ServiceAccount
+}
+
+func NewInMemoryServiceAccountStore() *InMemoryServiceAccountStore {
+	return &InMemoryServiceAccountStore{accounts: make(map[string]ServiceAccount)}
+}
+
+// CreateServiceAccount records a service account allowed the given scopes and returns its secret
+func (s *InMemoryServiceAccountStore) CreateServiceAccount(clientID string, scopes []string) (string, error) {
+	if clientID == "" {
+		return "", fmt.Errorf("%w: client_id", ErrMissingField)
+	}
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[clientID]; ok {
+		return "", fmt.Errorf("%w: %s", ErrServiceAccountExists, clientID)
+	}
+	s.accounts[clientID] = ServiceAccount{
+		ClientID:   clientID,
+		SecretHash: hash,
+		Scopes:     slices.Clone(scopes),
+		CreatedAt:  time.Now().UTC(),
+	}
+	return secret, nil
+}
+
+// RotateServiceAccountSecret replaces the secret of a service account, the previous one stops working at once
+func (s *InMemoryServiceAccountStore) RotateServiceAccountSecret(clientID string) (string, error) {
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		return "", err
+	}
+	err = s.update(clientID, func(account *ServiceAccount) {
+		account.SecretHash = hash
+	})
+	return secret, err
+}
+
+// SetServiceAccountDisabled suspends or reinstates a service account
+func (s *InMemoryServiceAccountStore) SetServiceAccountDisabled(clientID string, disabled bool) error {
+	return s.update(clientID, func(account *ServiceAccount) {
+		account.Disabled = disabled
+	})
+}
+
+// GetServiceAccount returns the service account with the given client ID
+func (s *InMemoryServiceAccountStore) GetServiceAccount(clientID string) (ServiceAccount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	account, ok := s.accounts[clientID]
+	if !ok {
+		return ServiceAccount{}, fmt.Errorf("%w: %s", ErrServiceAccountNotFound, clientID)
+	}
+	account.Scopes = slices.Clone(account.Scopes)
+	return account, nil
+}
+
+func (s *InMemoryServiceAccountStore) update(clientID string, apply func(account *ServiceAccount)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[clientID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrServiceAccountNotFound, clientID)
+	}
+	apply(&account)
+	s.accounts[clientID] = account
+	return nil
+}
@@ -0,0 +1,49 @@
+package stores
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestInMemoryServiceAccountStore(t *testing.T) {
+	s := NewInMemoryServiceAccountStore()
+	secret, err := s.CreateServiceAccount("reports-job", []string{"reports:read"})
+	if err != nil {
+		t.Fatalf("failed to create service account: %v", err)
+	}
+	if _, err := s.CreateServiceAccount("reports-job", nil); !errors.Is(err, ErrServiceAccountExists) {
+		t.Errorf("expected ErrServiceAccountExists, got %v", err)
+	}
+
+	account, err := s.GetServiceAccount("reports-job")
+	if err != nil {
+		t.Fatalf("failed to get service account: %v", err)
+	}
+	if account.SecretHash == secret || account.CheckSecret(secret) != nil {
+		t.Errorf("expected the hash of the secret to be stored, got %q", account.SecretHash)
+	}
+	if err := account.CheckSecret("wrong"); !errors.Is(err, ErrInvalidClientCredentials) {
+		t.Errorf("expected ErrInvalidClientCredentials, got %v", err)
+	}
+
+	rotated, err := s.RotateServiceAccountSecret("reports-job")
+	if err != nil {
+		t.Fatalf("failed to rotate secret: %v", err)
+	}
+	account, _ = s.GetServiceAccount("reports-job")
+	if account.CheckSecret(rotated) != nil || account.CheckSecret(secret) == nil {
+		t.Errorf("expected only the rotated secret to be accepted")
+	}
+
+	if err := s.SetServiceAccountDisabled("reports-job", true); err != nil {
+		t.Fatalf("failed to disable service account: %v", err)
+	}
+	account, _ = s.GetServiceAccount("reports-job")
+	if err := account.CheckSecret(rotated); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("expected ErrAccountDisabled, got %v", err)
+	}
+
+	if _, err := s.RotateServiceAccountSecret("nobody"); !errors.Is(err, ErrServiceAccountNotFound) {
+		t.Errorf("expected ErrServiceAccountNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package stores
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxUserAgentLength bounds the user agents kept with sessions, longer ones are truncated
+	MaxUserAgentLength = 256
+	// maxDeviceFieldLength bounds the other DeviceInfo fields
+	maxDeviceFieldLength = 64
+)
+
+// DeviceInfo describes the client a user logged in from.
+type DeviceInfo struct {
+	IP         string `json:"ip"`
+	UserAgent  string `json:"user_agent"`
+	DeviceName string `json:"device_name"`
+	Platform   string `json:"platform"`
+	// DeviceID is a stable fingerprint the client sends to bind its refresh tokens to the
+	// device, see token.DeviceBinding. It is never recorded with sessions.
+	DeviceID string `json:"-"`
+}
+
+// Sanitize strips control characters from every field and truncates them,
+// the user agent to MaxUserAgentLength bytes. Sessions are recorded sanitized.
+func (d DeviceInfo) Sanitize() DeviceInfo {
+	return DeviceInfo{
+		IP:         sanitizeDeviceField(d.IP, maxDeviceFieldLength),
+		UserAgent:  sanitizeDeviceField(d.UserAgent, MaxUserAgentLength),
+		DeviceName: sanitizeDeviceField(d.DeviceName, maxDeviceFieldLength),
+		Platform:   sanitizeDeviceField(d.Platform, maxDeviceFieldLength),
+		DeviceID:   sanitizeDeviceField(d.DeviceID, maxDeviceFieldLength),
+	}
+}
+
+func (d DeviceInfo) String() string {
+	return fmt.Sprintf("ip=%s user_agent=%q device=%q platform=%q", d.IP, d.UserAgent, d.DeviceName, d.Platform)
+}
+
+// sanitizeDeviceField drops control characters and invalid UTF-8 from s,
+// and cuts it to at most max bytes without splitting a rune.
+func sanitizeDeviceField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) <= max {
+		return s
+	}
+	s = s[:max]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// Session is the record kept for every login, the refresh token issued
+// by that login carries its ID in the "sid" claim.
+type Session struct {
+	ID             string     `json:"id"`
+	UserIdentifier string     `json:"user_identifier"`
+	Device         DeviceInfo `json:"device"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// SessionStore records logins along with the device they came from.
+// It is optional and set on Authify with WithSessionStore.
+type SessionStore interface {
+	CreateSession(session Session) error
+	ListSessions(userIdentifier string) ([]Session, error)
+}
+
+// TokenRecord is the server-side state of an opaque token, see token.OpaqueTokenManager.
+// Records are found by the hash of their token, the token itself is never stored.
+type TokenRecord struct {
+	Hash   string         `json:"hash"`
+	Kind   string         `json:"kind"` // "access" or "refresh"
+	Claims map[string]any `json:"claims"`
+	// ExpiresAt is when the record may be purged, which can be later than the exp claim
+	// of its token, e.g. to let the claims of an expired access token be refreshed
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenStore keeps the records of opaque tokens, the session stores of this package implement it.
+// GetToken returns ErrTokenNotFound for unknown hashes.
+type TokenStore interface {
+	SaveToken(record TokenRecord) error
+	GetToken(hash string) (TokenRecord, error)
+	DeleteToken(hash string) error
+}
+
+// NewSessionID returns a random identifier for a new session
+func NewSessionID() (string, error) {
+	return newUUID()
+}
+
+// InMemorySessionStore keeps sessions in memory, for tests and single instance deployments
+type InMemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string][]Session
+	tokens   map[string]TokenRecord
+	nonces   map[string]time.Time
+	families map[string]*TokenFamily
+}
+
+func NewInMemorySessionStore() *InMemorySessionStore {
+	return &InMemorySessionStore{
+		sessions: make(map[string][]Session),
+		tokens:   make(map[string]TokenRecord),
+		nonces:   make(map[string]time.Time),
+		families: make(map[string]*TokenFamily),
+	}
+}
+
+// CreateSession records session, sanitizing its device info
+func (s *InMemorySessionStore) CreateSession(session Session) error {
+	session.Device = session.Device.Sanitize()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.UserIdentifier] = append(s.sessions[session.UserIdentifier], session)
+	return nil
+}
+
+// ListSessions returns the sessions of a user, oldest first
+func (s *InMemorySessionStore) ListSessions(userIdentifier string) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.sessions[userIdentifier]), nil
+}
+
+// SaveToken records the token, purging the records past their ExpiresAt first
+func (s *InMemorySessionStore) SaveToken(record TokenRecord) error {
+	now := time.Now()
+	record.Claims = maps.Clone(record.Claims)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maps.DeleteFunc(s.tokens, func(_ string, r TokenRecord) bool {
+		return now.After(r.ExpiresAt)
+	})
+	s.tokens[record.Hash] = record
+	return nil
+}
+
+// GetToken returns the record of the token with the given hash
+func (s *InMemorySessionStore) GetToken(hash string) (TokenRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.tokens[hash]
+	if !ok {
+		return TokenRecord{}, ErrTokenNotFound
+	}
+	record.Claims = maps.Clone(record.Claims)
+	return record, nil
+}
+
+// DeleteToken removes the record of the token with the given hash, unknown hashes are ignored
+func (s *InMemorySessionStore) DeleteToken(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, hash)
+	return nil
+}
+
+// SaveNonce records a login challenge nonce, purging the expired ones first
+func (s *InMemorySessionStore) SaveNonce(nonce string, expiresAt time.Time) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maps.DeleteFunc(s.nonces, func(_ string, expiresAt time.Time) bool {
+		return now.After(expiresAt)
+	})
+	s.nonces[nonce] = expiresAt
+	return nil
+}
+
+// ConsumeNonce removes a nonce, see NonceStore
+func (s *InMemorySessionStore) ConsumeNonce(nonce string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt, ok := s.nonces[nonce]
+	if !ok {
+		return ErrNonceUsed
+	}
+	delete(s.nonces, nonce)
+	if !time.Now().Before(expiresAt) {
+		return ErrNonceExpired
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var softDeleteSelectRe = regexp.MustCompile(`^SELECT (.+) FROM "\w+"`)
+
+// softDeleteConn keeps a users table with a deleted_at mark, honouring the "deleted_at" filters of
+// the statements it runs like postgres does, and records them
+type softDeleteConn struct {
+	users   map[string]map[string]any
+	deleted map[string]bool
+	stmts   []string
+}
+
+func newSoftDeleteConn() *softDeleteConn {
+	return &softDeleteConn{users: make(map[string]map[string]any), deleted: make(map[string]bool)}
+}
+
+func (c *softDeleteConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	c.stmts = append(c.stmts, sql)
+	if match := loadInsertRe.FindStringSubmatch(sql); match != nil {
+		row := map[string]any{"disabled": false}
+		for i, col := range strings.Split(match[1], ", ") {
+			row[strings.Trim(col, `"`)] = args[i]
+		}
+		username := row["username"].(string)
+		// the unique constraint covers soft-deleted rows too
+		if _, exists := c.users[username]; exists {
+			return pgconn.CommandTag{}, &pgconn.PgError{Code: pgUniqueViolation}
+		}
+		c.users[username] = row
+		return pgconn.NewCommandTag("INSERT 0 1"), nil
+	}
+
+	if !strings.HasPrefix(sql, "UPDATE ") {
+		return pgconn.CommandTag{}, errors.New("unexpected statement: " + sql)
+	}
+	username := args[0].(string)
+	if _, exists := c.users[username]; !exists {
+		return pgconn.NewCommandTag("UPDATE 0"), nil
+	}
+	switch {
+	case strings.Contains(sql, `SET "deleted_at"=now()`) && strings.HasSuffix(sql, `AND "deleted_at" IS NULL`):
+		if c.deleted[username] {
+			return pgconn.NewCommandTag("UPDATE 0"), nil
+		}
+		c.deleted[username] = true
+	case strings.Contains(sql, `SET "deleted_at"=NULL`) && strings.HasSuffix(sql, `AND "deleted_at" IS NOT NULL`):
+		if !c.deleted[username] {
+			return pgconn.NewCommandTag("UPDATE 0"), nil
+		}
+		delete(c.deleted, username)
+	default:
+		return pgconn.CommandTag{}, errors.New("unexpected statement: " + sql)
+	}
+	return pgconn.NewCommandTag("UPDATE 1"), nil
+}
+
+func (c *softDeleteConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	c.stmts = append(c.stmts, sql)
+	match := softDeleteSelectRe.FindStringSubmatch(sql)
+	if match == nil {
+		return nil, errors.New("unexpected query: " + sql)
+	}
+	visible := func(username string) bool {
+		return !c.deleted[username] || !strings.Contains(sql, `"deleted_at" IS NULL`)
+	}
+
+	var usernames []string
+	if strings.Contains(sql, "=$1") {
+		// a lookup by identifier
+		if _, ok := c.users[args[0].(string)]; ok {
+			usernames = []string{args[0].(string)}
+		}
+	} else {
+		usernames = slices.Sorted(maps.Keys(c.users))
+	}
+	usernames = slices.DeleteFunc(usernames, func(username string) bool { return !visible(username) })
+
+	if strings.HasPrefix(sql, "SELECT COUNT(*) ") {
+		return &loadRows{cols: []string{"count"}, values: [][]any{{int64(len(usernames))}}}, nil
+	}
+	rows := &loadRows{}
+	for _, col := range strings.Split(match[1], ",") {
+		rows.cols = append(rows.cols, strings.Trim(col, `"`))
+	}
+	for _, username := range usernames {
+		values := make([]any, len(rows.cols))
+		for i, col := range rows.cols {
+			values[i] = c.users[username][col]
+		}
+		rows.values = append(rows.values, values)
+	}
+	return rows, nil
+}
+
+func newSoftDeleteStore(t *testing.T, softDelete bool) (*AuthifyDB, *softDeleteConn) {
+	t.Helper()
+	conn := newSoftDeleteConn()
+	cfg := loadTestConfig("users")
+	cfg.SoftDelete = softDelete
+	db, err := NewAuthifyDBFromConn(conn, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if _, err := db.CreateUser(map[string]any{"username": username, "password": "password123", "email": username + "@example.com"}); err != nil {
+			t.Fatalf("failed to create %s: %v", username, err)
+		}
+	}
+	conn.stmts = nil
+	return db, conn
+}
+
+func TestSoftDeleteHidesUser(t *testing.T) {
+	db, conn := newSoftDeleteStore(t, true)
+
+	if err := db.DeleteUser("alice"); err != nil {
+		t.Fatalf("failed to delete alice: %v", err)
+	}
+	if want := `UPDATE "users" SET "deleted_at"=now() WHERE "username"=$1 AND "deleted_at" IS NULL`; !slices.Equal(conn.stmts, []string{want}) {
+		t.Errorf("expected the user to be stamped with %q, ran %q", want, conn.stmts)
+	}
+	if !conn.deleted["alice"] {
+		t.Fatal("expected the row of alice to be kept and marked deleted")
+	}
+
+	// tokens are generated for the users GetUserInfo returns
+	if _, err := db.GetUserInfo("alice", "password123"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected a soft-deleted user not to log in, got %v", err)
+	}
+	if _, err := db.GetUserByUsername("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected a soft-deleted user not to be found, got %v", err)
+	}
+	users, next, err := db.ListUsers(context.Background(), "", 10)
+	if err != nil || len(users) != 1 || users[0]["username"] != "bob" || next != "" {
+		t.Errorf("expected only bob to be listed, got %v %q (%v)", users, next, err)
+	}
+	if count, err := db.CountUsers(); err != nil || count != 1 {
+		t.Errorf("expected 1 user, got %d (%v)", count, err)
+	}
+	for _, stmt := range conn.stmts[1:] {
+		if !strings.Contains(stmt, `"deleted_at" IS NULL`) {
+			t.Errorf("expected every lookup to leave soft-deleted users out, ran %q", stmt)
+		}
+	}
+
+	if err := db.DeleteUser("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected deleting a soft-deleted user again to fail, got %v", err)
+	}
+	if _, err := db.GetUserInfo("bob", "password123"); err != nil {
+		t.Errorf("expected bob to log in, got %v", err)
+	}
+}
+
+func TestSoftDeleteKeepsUsernameReserved(t *testing.T) {
+	db, _ := newSoftDeleteStore(t, true)
+	if err := db.DeleteUser("alice"); err != nil {
+		t.Fatalf("failed to delete alice: %v", err)
+	}
+
+	_, err := db.CreateUser(map[string]any{"username": "alice", "password": "password123"})
+	if !errors.Is(err, ErrUserExists) {
+		t.Errorf("expected the username of a soft-deleted user to stay taken, got %v", err)
+	}
+}
+
+func TestRestoreUser(t *testing.T) {
+	db, conn := newSoftDeleteStore(t, true)
+	if err := db.DeleteUser("alice"); err != nil {
+		t.Fatalf("failed to delete alice: %v", err)
+	}
+	conn.stmts = nil
+
+	if err := db.RestoreUser("alice"); err != nil {
+		t.Fatalf("failed to restore alice: %v", err)
+	}
+	if want := `UPDATE "users" SET "deleted_at"=NULL WHERE "username"=$1 AND "deleted_at" IS NOT NULL`; !slices.Equal(conn.stmts, []string{want}) {
+		t.Errorf("expected the mark to be cleared with %q, ran %q", want, conn.stmts)
+	}
+	if _, err := db.GetUserInfo("alice", "password123"); err != nil {
+		t.Errorf("expected a restored user to log in, got %v", err)
+	}
+	if user, err := db.GetUserByUsername("alice"); err != nil || user["email"] != "alice@example.com" {
+		t.Errorf("expected a restored user to keep their columns, got %v (%v)", user, err)
+	}
+	if users, _, err := db.ListUsers(context.Background(), "", 10); err != nil || len(users) != 2 {
+		t.Errorf("expected both users to be listed, got %v (%v)", users, err)
+	}
+
+	if err := db.RestoreUser("bob"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected restoring a live user to fail with ErrUserNotFound, got %v", err)
+	}
+	if err := db.RestoreUser("carol"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected restoring an unknown user to fail with ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestRestoreUserWithoutSoftDelete(t *testing.T) {
+	db, conn := newSoftDeleteStore(t, false)
+
+	if err := db.RestoreUser("alice"); !errors.Is(err, ErrSoftDeleteDisabled) {
+		t.Errorf("expected ErrSoftDeleteDisabled, got %v", err)
+	}
+	if len(conn.stmts) != 0 {
+		t.Errorf("expected no statement, ran %q", conn.stmts)
+	}
+	if _, err := db.GetUserByUsername("alice"); err != nil {
+		t.Fatalf("failed to get alice: %v", err)
+	}
+	if strings.Contains(conn.stmts[0], "deleted_at") {
+		t.Errorf("expected lookups not to filter on deleted_at, ran %q", conn.stmts[0])
+	}
+}
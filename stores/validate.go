@@ -0,0 +1,121 @@
+package stores
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxLength bounds the values of text columns without a max_length
+	DefaultMaxLength = 256
+
+	// DefaultMaxInputBytes bounds the total size of the fields checked at once by ValidateInput
+	// when max_input_bytes is not set
+	DefaultMaxInputBytes = 8 << 10
+)
+
+// FieldError is an invalid input value, along with the field it was given for.
+// It wraps ErrFieldTooLong or ErrInvalidFieldValue.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Field)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// MaxLength returns the maximum number of bytes accepted in a column: its max_length, or for
+// text columns without one DefaultMaxLength, lowered to the 72 bytes bcrypt hashes for password
+// columns. Other columns are only bounded by max_input_bytes, and 0 is returned for them.
+func (cfg StoreConfig) MaxLength(column string) int {
+	col, ok := cfg.Columns[column]
+	if !ok {
+		return 0
+	}
+	if col.MaxLength > 0 {
+		return col.MaxLength
+	}
+	if col.Type != "text" {
+		return 0
+	}
+	if isPasswordColumn(column, col) && cfg.hashesWithBcrypt() {
+		return bcryptMaxPasswordLength
+	}
+	return DefaultMaxLength
+}
+
+// ValidateInput checks the string values of data before they reach the database or the password
+// hasher. Values must be valid UTF-8 without NUL bytes, and fit the MaxLength of their column,
+// otherwise a *FieldError naming the field is returned. All values together, unknown fields
+// included, must fit in max_input_bytes, ErrFieldTooLong is returned otherwise.
+func (cfg StoreConfig) ValidateInput(data map[string]any) error {
+	total := 0
+	for _, name := range slices.Sorted(maps.Keys(data)) {
+		val, ok := data[name].(string)
+		if !ok {
+			continue
+		}
+		total += len(name) + len(val)
+
+		if !utf8.ValidString(val) || strings.IndexByte(val, 0) >= 0 {
+			return &FieldError{Field: name, Err: ErrInvalidFieldValue}
+		}
+		if limit := cfg.MaxLength(name); limit > 0 && len(val) > limit {
+			return &FieldError{Field: name, Err: fmt.Errorf("%w, at most %d bytes", ErrFieldTooLong, limit)}
+		}
+	}
+
+	if limit := cfg.maxInputBytes(); total > limit {
+		return fmt.Errorf("%w: fields hold %d bytes, at most %d", ErrFieldTooLong, total, limit)
+	}
+	return nil
+}
+
+// CheckRequired fails with ErrMissingField when data lacks a required column, which has neither a
+// default nor a generator, as creating the user would. It lets callers reject such input before
+// spending anything on it, such as an invite.
+func (cfg StoreConfig) CheckRequired(data map[string]any) error {
+	for _, name := range slices.Sorted(maps.Keys(cfg.Columns)) {
+		col := cfg.Columns[name]
+		if _, ok := data[name]; !ok && col.Required && col.Default == "" && col.Generator == "" {
+			return fmt.Errorf("%w: %s", ErrMissingField, name)
+		}
+	}
+	return nil
+}
+
+func (cfg StoreConfig) maxInputBytes() int {
+	if cfg.MaxInputBytes > 0 {
+		return cfg.MaxInputBytes
+	}
+	return DefaultMaxInputBytes
+}
+
+// isPasswordColumn tells whether a column holds password hashes, the in-memory store
+// hashing the "password" column whether or not it is marked is_password
+func isPasswordColumn(name string, col ColumnConfig) bool {
+	return col.IsPassword || name == "password"
+}
+
+func (cfg StoreConfig) hashesWithBcrypt() bool {
+	return cfg.PasswordHasher == "" || cfg.PasswordHasher == HasherBcrypt
+}
+
+// validateMaxLength rejects negative max_length values, and ones above the 72 bytes bcrypt hashes
+func (cfg StoreConfig) validateMaxLength(name string, col ColumnConfig) error {
+	if col.MaxLength < 0 {
+		return fmt.Errorf("max_length of column %s must not be negative, got %d", name, col.MaxLength)
+	}
+	if col.MaxLength > bcryptMaxPasswordLength && isPasswordColumn(name, col) && cfg.hashesWithBcrypt() {
+		return fmt.Errorf("max_length of password column %s must not exceed the %d bytes bcrypt hashes, got %d", name, bcryptMaxPasswordLength, col.MaxLength)
+	}
+	return nil
+}
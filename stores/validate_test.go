@@ -0,0 +1,133 @@
+package stores
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateInput(t *testing.T) {
+	cfg := loadTestConfig("users")
+	cfg.Columns["bio"] = ColumnConfig{Type: "text", MaxLength: 1024}
+	cfg.Columns["age"] = ColumnConfig{Type: "int"}
+
+	testCases := map[string]struct {
+		data  map[string]any
+		err   error
+		field string
+	}{
+		"valid": {
+			data: map[string]any{"username": "alice", "password": "password123", "email": "alice@example.com"},
+		},
+		"1MB password": {
+			data:  map[string]any{"username": "alice", "password": strings.Repeat("a", 1<<20)},
+			err:   ErrFieldTooLong,
+			field: "password",
+		},
+		"password over the bcrypt limit": {
+			data:  map[string]any{"username": "alice", "password": strings.Repeat("a", bcryptMaxPasswordLength+1)},
+			err:   ErrFieldTooLong,
+			field: "password",
+		},
+		"text over the default": {
+			data:  map[string]any{"username": strings.Repeat("a", DefaultMaxLength+1)},
+			err:   ErrFieldTooLong,
+			field: "username",
+		},
+		"text within max_length": {
+			data: map[string]any{"bio": strings.Repeat("a", 1024)},
+		},
+		"invalid UTF-8 username": {
+			data:  map[string]any{"username": "al\xffice", "password": "password123"},
+			err:   ErrInvalidFieldValue,
+			field: "username",
+		},
+		"NUL in email": {
+			data:  map[string]any{"username": "alice", "email": "alice\x00@example.com"},
+			err:   ErrInvalidFieldValue,
+			field: "email",
+		},
+		"unknown fields count towards the total": {
+			data: map[string]any{"username": "alice", "extra": strings.Repeat("a", DefaultMaxInputBytes)},
+			err:  ErrFieldTooLong,
+		},
+		"columns without a default limit": {
+			data: map[string]any{"age": strings.Repeat("1", DefaultMaxLength+1)},
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := cfg.ValidateInput(tc.data)
+			if !errors.Is(err, tc.err) || (tc.err == nil) != (err == nil) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			var fieldErr *FieldError
+			if errors.As(err, &fieldErr) != (tc.field != "") || (fieldErr != nil && fieldErr.Field != tc.field) {
+				t.Errorf("expected the error to name %q, got %v", tc.field, err)
+			}
+		})
+	}
+
+	cfg.PasswordHasher = HasherArgon2id
+	if err := cfg.ValidateInput(map[string]any{"password": strings.Repeat("a", bcryptMaxPasswordLength+1)}); err != nil {
+		t.Errorf("expected argon2id passwords to be bounded by DefaultMaxLength only, got %v", err)
+	}
+}
+
+func TestValidateMaxLength(t *testing.T) {
+	cfg := loadTestConfig("users")
+	cfg.Columns["email"] = ColumnConfig{Type: "text", MaxLength: -1}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected a negative max_length to be rejected")
+	}
+
+	cfg = loadTestConfig("users")
+	cfg.Columns["password"] = ColumnConfig{Type: "text", IsPassword: true, MaxLength: 100}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected a max_length above the bcrypt limit to be rejected")
+	}
+	cfg.PasswordHasher = HasherArgon2id
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected argon2id to accept longer passwords, got %v", err)
+	}
+}
+
+func TestCheckRequired(t *testing.T) {
+	cfg := loadTestConfig("users")
+	cfg.Columns["id"] = ColumnConfig{Type: "text", Required: true, Generator: GeneratorUUIDv4}
+	cfg.Columns["plan"] = ColumnConfig{Type: "text", Required: true, Default: "'free'"}
+
+	if err := cfg.CheckRequired(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Errorf("expected generated and defaulted columns to be optional, got %v", err)
+	}
+	if err := cfg.CheckRequired(map[string]any{"username": "alice"}); !errors.Is(err, ErrMissingField) || !strings.Contains(err.Error(), "password") {
+		t.Errorf("expected ErrMissingField naming password, got %v", err)
+	}
+}
+
+func TestStoresValidateInput(t *testing.T) {
+	conn := &schemaConn{}
+	db, err := NewAuthifyDBFromConn(conn, loadTestConfig("users"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	mem := NewInMemoryUserStore(loadTestConfig("users"))
+	if _, err := mem.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	for name, store := range map[string]UserUpdater{"memstore": mem, "pgstore": db} {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.(Store).CreateUser(map[string]any{"username": "bob", "password": strings.Repeat("a", 1<<20)})
+			if !errors.Is(err, ErrFieldTooLong) {
+				t.Errorf("expected ErrFieldTooLong for a 1MB password, got %v", err)
+			}
+			if err := store.UpdateUser("alice", map[string]any{"email": "alice\x00@example.com"}); !errors.Is(err, ErrInvalidFieldValue) {
+				t.Errorf("expected ErrInvalidFieldValue for a NUL byte, got %v", err)
+			}
+		})
+	}
+	if len(conn.executed) != 0 {
+		t.Errorf("expected invalid input to never reach the database, got %v", conn.executed)
+	}
+}
@@ -0,0 +1,111 @@
+package token
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// VerifyResult is the outcome of the verification of one of the tokens of VerifyTokens.
+// Username and Role are read from the claims of valid tokens, Err is set for invalid ones.
+type VerifyResult struct {
+	Username string
+	Role     string
+	Claims   jwt.MapClaims
+	Err      error
+}
+
+// WithVerifyWorkers sets how many tokens VerifyTokens verifies at once, the number of CPUs
+// by default. Values below 1 restore the default.
+func (m *JWTManager) WithVerifyWorkers(n int) *JWTManager {
+	m.verifyWorkers = n
+	return m
+}
+
+// VerifyTokens verifies access tokens like VerifyAccessToken, in parallel on at most
+// WithVerifyWorkers goroutines, e.g. the delegated tokens of a request reaching a gateway.
+// The result of each token is at its index. The store lookups are shared by the batch: the
+// global not-before time is read at most once, and in strict mode the state of each user once,
+// however many of the tokens belong to them.
+func (m *JWTManager) VerifyTokens(tokens []string) []VerifyResult {
+	results := make([]VerifyResult, len(tokens))
+	workers := m.verifyWorkers
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(tokens))
+
+	users := &userStates{states: make(map[string]*userState)}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = m.verifyBatchToken(tokens[i], users)
+			}
+		}()
+	}
+	for i := range tokens {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// verifyBatchToken is VerifyAccessToken for a token of VerifyTokens
+func (m *JWTManager) verifyBatchToken(tokenStr string, users *userStates) VerifyResult {
+	claims, err := m.verifyAccessTokenClaims(tokenStr, users)
+	if err != nil {
+		return VerifyResult{Err: err}
+	}
+	username, _ := m.UserIdentifier(claims)
+	return VerifyResult{Username: username, Role: m.Role(claims), Claims: claims}
+}
+
+// userStates keeps the state of the users of a batch of tokens, read from the store on first use
+type userStates struct {
+	mu     sync.Mutex
+	states map[string]*userState
+}
+
+// userState is what strict verification reads from the store about a user
+type userState struct {
+	once       sync.Once
+	activeErr  error
+	version    int
+	versionErr error
+}
+
+// check is checkAccountActive and checkTokenVersion, with the lookups of userIdentifier made once
+func (u *userStates) check(store stores.Store, claims jwt.MapClaims, userIdentifier string) error {
+	u.mu.Lock()
+	state, ok := u.states[userIdentifier]
+	if !ok {
+		state = &userState{}
+		u.states[userIdentifier] = state
+	}
+	u.mu.Unlock()
+
+	versioner, versioned := tokenVersioner(store)
+	state.once.Do(func() {
+		state.activeErr = checkAccountActive(store, userIdentifier)
+		if state.activeErr == nil && versioned {
+			state.version, state.versionErr = versioner.TokenVersion(userIdentifier)
+		}
+	})
+	if state.activeErr != nil {
+		return state.activeErr
+	}
+	if !versioned {
+		return nil
+	}
+	if state.versionErr != nil {
+		return state.versionErr
+	}
+	return compareTokenVersion(claims, state.version, userIdentifier)
+}
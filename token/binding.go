@@ -0,0 +1,90 @@
+package token
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// BindingMode selects what refresh tokens are bound to, see JWTManager.WithBindingMode.
+type BindingMode int
+
+const (
+	// NoBinding lets refresh tokens be used from anywhere, the default
+	NoBinding BindingMode = iota
+	// IPBinding binds refresh tokens to the IP address of the login, the "ip" entry of the
+	// request data. Too strict for mobile clients, whose address changes with the network.
+	IPBinding
+	// DeviceBinding binds refresh tokens to the fingerprint the client sent at login,
+	// the RequestDeviceID entry of the request data
+	DeviceBinding
+)
+
+// RequestDeviceID is the request data entry holding the device fingerprint of the client,
+// the authify-device-id header over HTTP and the device_id of DeviceInfo over gRPC
+const RequestDeviceID = "device_id"
+
+func (b BindingMode) String() string {
+	switch b {
+	case NoBinding:
+		return "none"
+	case IPBinding:
+		return "ip"
+	case DeviceBinding:
+		return "device"
+	}
+	return fmt.Sprintf("BindingMode(%d)", int(b))
+}
+
+// ParseBindingMode parses the names returned by BindingMode.String, an empty name is NoBinding.
+func ParseBindingMode(name string) (BindingMode, error) {
+	for _, mode := range []BindingMode{NoBinding, IPBinding, DeviceBinding} {
+		if name == mode.String() {
+			return mode, nil
+		}
+	}
+	if name == "" {
+		return NoBinding, nil
+	}
+	return NoBinding, fmt.Errorf("unknown binding mode %q, expected none, ip or device", name)
+}
+
+// bindingID returns the hash of the request data entry tokens are bound to in mode,
+// empty when there is none. Only the hash is kept in the bind claim, so tokens do not
+// carry device fingerprints.
+func bindingID(mode BindingMode, requestData map[string]any) string {
+	var key string
+	switch mode {
+	case IPBinding:
+		key = "ip"
+	case DeviceBinding:
+		key = RequestDeviceID
+	default:
+		return ""
+	}
+	val, _ := requestData[key].(string)
+	if val == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(mode.String() + ":" + val))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkBinding compares the bind claim of a refresh token with the binding ID of the refresh.
+// Tokens without the claim were issued unbound, before binding was enabled or to a client
+// sending no binding ID, and can be refreshed from anywhere.
+func checkBinding(mode BindingMode, refreshClaims jwt.MapClaims, requestData map[string]any) error {
+	bound, ok := refreshClaims[ClaimBinding]
+	if !ok || mode == NoBinding {
+		return nil
+	}
+	want, ok := bound.(string)
+	got := bindingID(mode, requestData)
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(got)) != 1 {
+		return ErrBindingMismatch
+	}
+	return nil
+}
@@ -5,28 +5,55 @@ import (
 )
 
 type TokenConfig struct {
-	Issuer       string            `yaml:"issuer"`
-	AccessToken  AccessTokenConfig `yaml:"access_token"`
+	Issuer       string             `yaml:"issuer"`
+	AccessToken  AccessTokenConfig  `yaml:"access_token"`
 	RefreshToken RefreshTokenConfig `yaml:"refresh_token"`
+	Exchange     ExchangeConfig     `yaml:"exchange"`
+	ServiceToken ServiceTokenConfig `yaml:"service_token"`
 }
 
 type AccessTokenConfig struct {
 	Duration      time.Duration          `yaml:"duration"`
 	SigningMethod string                 `yaml:"signing_method"`
 	Claims        map[string]ClaimConfig `yaml:"claims"`
+	// Audience is the "aud" claim of access tokens, the resource servers meant to accept them
+	Audience []string `yaml:"audience"`
+	// RoleDurations overrides Duration for the users of the listed roles, e.g. {admin: 5m}
+	RoleDurations map[string]time.Duration `yaml:"role_durations"`
+	// MaxDuration caps the lifetimes asked of GenerateTokenWithExpiry, DefaultMaxTokenDuration when unset
+	MaxDuration time.Duration `yaml:"max_duration"`
 }
 
 type RefreshTokenConfig struct {
 	Duration         time.Duration          `yaml:"duration"`
 	AbsoluteDuration time.Duration          `yaml:"absolute_duration"`
 	Claims           map[string]ClaimConfig `yaml:"claims"`
+	// RoleDurations overrides Duration for the users of the listed roles
+	RoleDurations map[string]time.Duration `yaml:"role_durations"`
+}
+
+// ExchangeConfig controls token exchange (RFC 8693), where a service trades a user's
+// access token for a short-lived one acting on the user's behalf.
+type ExchangeConfig struct {
+	// ActorRoles lists the roles allowed to act on behalf of users, none when empty
+	ActorRoles []string `yaml:"actor_roles"`
+	// MaxDuration caps the lifetime of exchanged tokens, 5 minutes when unset
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// AllowChained lets exchanged tokens be exchanged again, nesting the previous actor
+	AllowChained bool `yaml:"allow_chained"`
+}
+
+// ServiceTokenConfig controls the tokens of service accounts, see JWTManager.GenerateServiceToken.
+type ServiceTokenConfig struct {
+	// Duration is the lifetime of service tokens, 5 minutes when unset
+	Duration time.Duration `yaml:"duration"`
 }
 
 type ClaimConfig struct {
-	Source string `yaml:"source"` // db | request | system
-	Column string `yaml:"column,omitempty"`
-	Header string `yaml:"header,omitempty"`
-	Type   string `yaml:"type,omitempty"`
-	Value  any    `yaml:"value,omitempty"`
+	Source       string `yaml:"source"` // db | request | system
+	Column       string `yaml:"column,omitempty"`
+	Header       string `yaml:"header,omitempty"`
+	Type         string `yaml:"type,omitempty"`
+	Value        any    `yaml:"value,omitempty"`
 	IsIdentifier bool   `yaml:"is_identifier,omitempty"`
 }
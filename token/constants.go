@@ -1,20 +1,46 @@
 package token
 
 import (
-	"time"
 	"github.com/golang-jwt/jwt/v5"
+	"time"
 )
 
 const (
 	defaultAccessTokenDuration = 15 * time.Minute
+	defaultExchangeDuration    = 5 * time.Minute
+	defaultServiceDuration     = 5 * time.Minute
 	authifyIssuer              = "authify-issuer"
-	ClaimIssuer = "iss"
-	ClaimExpiry = "exp"
-	ClaimIssued = "iat"
+	ClaimIssuer                = "iss"
+	ClaimExpiry                = "exp"
+	ClaimIssued                = "iat"
+	ClaimNotBefore             = "nbf"
+	ClaimScope                 = "scope"
+	ClaimSessionID             = "sid"
+	ClaimTokenID               = "jti"
+	ClaimAudience              = "aud"
+	ClaimSubject               = "sub"
+	ClaimActor                 = "act"    // marks exchanged tokens, holding the service acting for the subject (RFC 8693)
+	ClaimTokenVersion          = "tv"     // token version of the user when the token was issued, see stores.TokenVersioner
+	ClaimTokenFormat           = "tkv"    // format version of the token's claims, see CurrentTokenVersion
+	ClaimBinding               = "bind"   // hash of what a refresh token is bound to, see BindingMode
+	ClaimEncrypted             = "enc"    // claims of encrypted columns, see JWTManager.WithClaimsEncryption
+	ClaimSessionExpiry         = "sxp"    // expiry of the refresh token of an access token's session, see JWTManager.WithSlidingExpiration
+	ClaimTenant                = "tenant" // tenant of GenerateTokensRequest.Tenant, carried over by refreshes
+
+	// ClaimTokenUse tells the kind of an access token, TokenUseService for the tokens of
+	// service accounts, see TokenUse
+	ClaimTokenUse   = "token_use"
+	TokenUseUser    = "user"
+	TokenUseService = "service"
+
+	// refresh tokens are always signed with HS256, whatever the access token uses
+	refreshSigningMethod = "HS256"
+
+	// MaxTokenLength bounds the tokens handed to the JWT parser, issued tokens are far shorter
+	MaxTokenLength = 8 << 10
 )
 
 var signingMethods = map[string]jwt.SigningMethod{
 	"HS256": jwt.SigningMethodHS256,
 	"HS512": jwt.SigningMethodHS512,
 }
-
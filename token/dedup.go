@@ -0,0 +1,100 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultRefreshDedupWindow is how long the access token minted by a refresh is handed to
+// duplicates of that refresh, see JWTManager.WithRefreshDedupWindow
+const defaultRefreshDedupWindow = 10 * time.Second
+
+// refreshDedup mints a single access token for concurrent refreshes of the same tokens,
+// e.g. the requests of a browser tab whose access token just expired, and hands it to
+// the duplicates arriving within window of the refresh as well
+type refreshDedup struct {
+	window       time.Duration
+	group        singleflight.Group
+	deduplicated atomic.Int64
+
+	mu      sync.Mutex
+	results map[string]refreshResult
+}
+
+type refreshResult struct {
+	token   string
+	claims  jwt.MapClaims
+	expires time.Time
+}
+
+// refreshKey identifies a refresh by the tokens it was called with, their hash
+// keeps the tokens themselves out of memory once they are no longer needed
+func refreshKey(accessTokenStr, refreshTokenStr string) string {
+	sum := sha256.Sum256([]byte(refreshTokenStr + "\x00" + accessTokenStr))
+	return hex.EncodeToString(sum[:])
+}
+
+// do returns the result of mint, called once for the refreshes of key in flight or
+// made within the window. Errors are shared with the calls in flight, but not kept.
+func (d *refreshDedup) do(key string, mint func() (string, jwt.MapClaims, error)) (string, jwt.MapClaims, error) {
+	if d.window <= 0 {
+		return mint()
+	}
+
+	minted := false
+	val, err, _ := d.group.Do(key, func() (any, error) {
+		if res, ok := d.cached(key); ok {
+			return res, nil
+		}
+		minted = true
+		token, claims, err := mint()
+		if err != nil {
+			return nil, err
+		}
+		res := refreshResult{token: token, claims: claims, expires: time.Now().Add(d.window)}
+		d.store(key, res)
+		return res, nil
+	})
+	if !minted {
+		d.deduplicated.Add(1)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	res := val.(refreshResult)
+	// every caller gets its own claims, callers may modify them
+	return res.token, maps.Clone(res.claims), nil
+}
+
+func (d *refreshDedup) cached(key string) (refreshResult, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res, ok := d.results[key]
+	if !ok || time.Now().After(res.expires) {
+		return refreshResult{}, false
+	}
+	return res, true
+}
+
+// store records res, purging the results past their window
+func (d *refreshDedup) store(key string, res refreshResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.results == nil {
+		d.results = make(map[string]refreshResult)
+	}
+	now := time.Now()
+	for k, r := range d.results {
+		if now.After(r.expires) {
+			delete(d.results, k)
+		}
+	}
+	d.results[key] = res
+}
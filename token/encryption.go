@@ -0,0 +1,145 @@
+package token
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// claimsKey is an AES-GCM key of claims encryption. Its ID, derived from the key, prefixes
+// the ciphertexts it seals, so tokens sealed before a rotation find their key.
+type claimsKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// claimsCipher seals the claims of encrypted columns into the ClaimEncrypted claim, with the
+// current key, keys[0], and opens the claims sealed with any of the keys.
+type claimsCipher struct {
+	keys []claimsKey
+}
+
+// newClaimsCipher builds the cipher of the current key, followed by the previous ones.
+// Keys must be 16, 24 or 32 bytes long, for AES-128, AES-192 or AES-256.
+func newClaimsCipher(current []byte, previous [][]byte) (*claimsCipher, error) {
+	c := &claimsCipher{}
+	for _, key := range append([][]byte{current}, previous...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidEncryptionKey, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidEncryptionKey, err)
+		}
+		sum := sha256.Sum256(key)
+		c.keys = append(c.keys, claimsKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+	}
+	return c, nil
+}
+
+// seal returns a copy of claims in which the claims named in names are replaced by a
+// ClaimEncrypted claim, "<key ID>.<base64url nonce and ciphertext>" of their JSON.
+func (c *claimsCipher) seal(claims jwt.MapClaims, names []string) (jwt.MapClaims, error) {
+	sealed := make(jwt.MapClaims, len(claims))
+	secret := make(map[string]any)
+	for name, val := range claims {
+		sealed[name] = val
+	}
+	for _, name := range names {
+		if val, ok := sealed[name]; ok {
+			secret[name] = val
+			delete(sealed, name)
+		}
+	}
+	if len(secret) == 0 {
+		return claims, nil
+	}
+
+	plaintext, err := json.Marshal(secret)
+	if err != nil {
+		return nil, err
+	}
+	key := c.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ciphertext := key.aead.Seal(nonce, nonce, plaintext, []byte(key.id))
+	sealed[ClaimEncrypted] = key.id + "." + base64.RawURLEncoding.EncodeToString(ciphertext)
+	return sealed, nil
+}
+
+// open replaces the ClaimEncrypted claim of claims, if any, with the claims it seals.
+// Claims sealed with an unknown key, or tampered with, fail with ErrInvalidToken.
+func (c *claimsCipher) open(claims jwt.MapClaims) error {
+	enc, ok := claims[ClaimEncrypted]
+	if !ok {
+		return nil
+	}
+	str, _ := enc.(string)
+	id, payload, _ := strings.Cut(str, ".")
+	ciphertext, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return fmt.Errorf("%w: malformed encrypted claims", ErrInvalidToken)
+	}
+
+	for _, key := range c.keys {
+		if key.id != id || len(ciphertext) < key.aead.NonceSize() {
+			continue
+		}
+		nonce, sealed := ciphertext[:key.aead.NonceSize()], ciphertext[key.aead.NonceSize():]
+		plaintext, err := key.aead.Open(nil, nonce, sealed, []byte(key.id))
+		if err != nil {
+			break
+		}
+		var secret map[string]any
+		if err := json.Unmarshal(plaintext, &secret); err != nil {
+			break
+		}
+		delete(claims, ClaimEncrypted)
+		for name, val := range secret {
+			claims[name] = val
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: encrypted claims cannot be decrypted", ErrInvalidToken)
+}
+
+// encryptedClaims returns the names of the claims taken from columns marked encrypted in the
+// store config, in the access and refresh token configs.
+func (m *JWTManager) encryptedClaims() []string {
+	if m.store == nil {
+		return nil
+	}
+	columns := m.store.StoreConfig().Columns
+	var names []string
+	for _, claims := range []map[string]ClaimConfig{m.cfg.AccessToken.Claims, m.cfg.RefreshToken.Claims} {
+		for name, c := range claims {
+			if c.Source == "db" && columns[c.Column].Encrypted {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// openClaims decrypts the encrypted claims of a verified token. Tokens carrying some while
+// the manager has no claims encryption key are rejected, as their claims cannot be checked.
+func (m *JWTManager) openClaims(claims jwt.MapClaims) error {
+	if m.claimsCipher == nil {
+		if _, ok := claims[ClaimEncrypted]; ok {
+			return fmt.Errorf("%w: token has encrypted claims and no claims encryption key is set", ErrInvalidToken)
+		}
+		return nil
+	}
+	return m.claimsCipher.open(claims)
+}
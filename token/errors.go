@@ -3,18 +3,40 @@ package token
 import (
 	"errors"
 
+	"github.com/HassanAli101/authify/verifier"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 var (
 	// JWT-related errors
 	ErrTokenExpired                  = jwt.ErrTokenExpired
-	ErrUnexpectedSigningMethod       = errors.New("unexpected signing method")
-	ErrInvalidToken                  = errors.New("token is invalid")
-	ErrClaimsInvalid                 = errors.New("invalid claims")
-	ErrMissingUserIdentifier              = errors.New("user identifier missing in token")
+	ErrTokenNotValidYet              = jwt.ErrTokenNotValidYet
+	ErrUnexpectedSigningMethod       = verifier.ErrUnexpectedSigningMethod
+	ErrInvalidToken                  = verifier.ErrInvalidToken
+	ErrClaimsInvalid                 = verifier.ErrClaimsInvalid
+	ErrMissingUserIdentifier         = errors.New("user identifier missing in token")
 	ErrMissingRole                   = errors.New("role missing in token")
+	ErrInsufficientScope             = errors.New("token is missing a required scope")
+	ErrAudienceMismatch              = verifier.ErrAudienceMismatch
 	ErrRefreshTokenExpired           = errors.New("refresh token is expired, cannot do refresh, please log in again")
+	ErrExchangeForbidden             = errors.New("actor is not allowed to exchange tokens")
+	ErrTokenNotExchangeable          = errors.New("token was obtained by exchange and cannot be exchanged again")
 	ErrAccessTokenSecretNotProvided  = errors.New("access token secret not provided")
 	ErrRefreshTokenSecretNotProvided = errors.New("refresh token secret not provided")
+	ErrTokenConfigNotProvided        = errors.New("token config not provided, see WithConfig")
+	ErrUnsupportedSigningMethod      = verifier.ErrUnsupportedSigningMethod
+	ErrMissingVerificationKey        = verifier.ErrMissingVerificationKey
+	ErrInvalidDuration               = errors.New("token durations must be positive")
+	ErrTokenDurationTooLong          = errors.New("token duration exceeds the maximum token duration")
+	ErrTokenVersionMismatch          = errors.New("token was revoked by a newer token version of its user")
+	ErrTokenVersionTooOld            = errors.New("token format version is no longer accepted, please log in again")
+	ErrRevocationNotSupported        = errors.New("token manager cannot revoke single tokens")
+	ErrBindingMismatch               = errors.New("refresh token is bound to another device")
+	ErrInvalidEncryptionKey          = errors.New("claims encryption keys must be 16, 24 or 32 bytes long")
+	ErrInvalidScope                  = errors.New("requested scope is not granted to the client")
+	ErrTokenUseMismatch              = errors.New("token is not of the kind this endpoint accepts")
+	ErrTokenInvalidatedGlobally      = errors.New("token was invalidated along with every token issued before it")
+	ErrRotationNotSupported          = errors.New("token manager cannot rotate its secrets")
+	ErrNotImplemented                = errors.New("token manager does not implement this method")
+	ErrRequestNotSupported           = errors.New("token manager does not support a field of the request")
 )
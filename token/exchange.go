@@ -0,0 +1,85 @@
+package token
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ExchangeToken implements on-behalf-of token exchange (RFC 8693): a service authenticates
+// as actorUsername and trades the access token of a user, subjectToken, for a new access
+// token carrying the user's claims plus an "act" claim naming the service.
+//
+// The actor's role must be listed in the exchange config's actor_roles, otherwise
+// ErrExchangeForbidden is returned. audience, when set, becomes the token's "aud" claim.
+// The token lives for ttl, capped by the exchange config's max_duration and by the expiry
+// of the subject token, a ttl of zero takes the cap. Exchanged tokens cannot be exchanged
+// again (ErrTokenNotExchangeable) unless allow_chained is set, in which case the previous
+// actor is nested in the new "act" claim.
+func (m *JWTManager) ExchangeToken(subjectToken, actorUsername, actorPassword, audience string, ttl time.Duration) (string, error) {
+	if m.store == nil {
+		return "", stores.ErrStoreNotProvided
+	}
+
+	subjectClaims, err := m.VerifyAccessToken(subjectToken)
+	if err != nil {
+		return "", err
+	}
+	previousActor, exchanged := subjectClaims[ClaimActor]
+	if exchanged && !m.cfg.Exchange.AllowChained {
+		return "", ErrTokenNotExchangeable
+	}
+
+	// Authenticate the actor, disabled accounts are rejected by the store
+	actor, err := m.store.GetUserInfo(actorUsername, actorPassword)
+	if err != nil {
+		return "", err
+	}
+	role := m.store.StoreConfig().Role(actor)
+	if role == "" || !slices.Contains(m.cfg.Exchange.ActorRoles, role) {
+		return "", fmt.Errorf("%w: role %q cannot act on behalf of users", ErrExchangeForbidden, role)
+	}
+
+	claims := jwt.MapClaims{}
+	for k, v := range subjectClaims {
+		claims[k] = v
+	}
+	act := map[string]any{ClaimSubject: actorUsername}
+	if exchanged {
+		act[ClaimActor] = previousActor
+	}
+	claims[ClaimActor] = act
+	delete(claims, ClaimAudience)
+	if audience != "" {
+		claims[ClaimAudience] = audience
+	}
+
+	m.setRegisteredClaims(claims, m.exchangeDuration(ttl))
+	// the claims are copied as is, so the token keeps the format version of the subject token
+	if version, ok := subjectClaims[ClaimTokenFormat]; ok {
+		claims[ClaimTokenFormat] = version
+	} else {
+		delete(claims, ClaimTokenFormat)
+	}
+	// an exchanged token never outlives the one it was obtained from
+	if expiry, err := subjectClaims.GetExpirationTime(); err == nil && expiry != nil && expiry.Unix() < claims[ClaimExpiry].(int64) {
+		claims[ClaimExpiry] = expiry.Unix()
+	}
+
+	return m.signToken(claims, m.accessSigningSecret(), m.cfg.AccessToken.SigningMethod)
+}
+
+// exchangeDuration caps ttl to the configured lifetime of exchanged tokens
+func (m *JWTManager) exchangeDuration(ttl time.Duration) time.Duration {
+	limit := m.cfg.Exchange.MaxDuration
+	if limit <= 0 {
+		limit = defaultExchangeDuration
+	}
+	if ttl <= 0 || ttl > limit {
+		return limit
+	}
+	return ttl
+}
@@ -0,0 +1,82 @@
+package token
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+)
+
+// DefaultMaxTokenDuration is the longest lifetime GenerateTokenWithExpiry grants when no
+// maximum is configured, see WithMaxTokenDuration
+const DefaultMaxTokenDuration = 24 * time.Hour
+
+var _ ExpiryIssuer = (*JWTManager)(nil)
+
+// WithMaxTokenDuration sets the longest lifetime GenerateTokenWithExpiry grants, in place of
+// the max_duration of the access token config. It must be positive, Build fails with
+// ErrInvalidDuration otherwise.
+func (m *JWTManager) WithMaxTokenDuration(d time.Duration) *JWTManager {
+	if d <= 0 {
+		m.setBuildErr(fmt.Errorf("%w, got %v", ErrInvalidDuration, d))
+		return m
+	}
+	m.maxTokenDuration = d
+	return m
+}
+
+// GenerateTokenWithExpiry is GenerateAccessToken for a token living for d rather than the
+// configured lifetime of the user's role, such as a long-lived token of a service. d must be
+// positive, and no longer than the maximum token duration, see WithMaxTokenDuration, the call
+// fails with ErrInvalidDuration or ErrTokenDurationTooLong otherwise. The access tokens minted
+// by refreshing the token get the configured lifetime again.
+func (m *JWTManager) GenerateTokenWithExpiry(username, password string, d time.Duration) (string, error) {
+	if err := checkTokenDuration(d, m.maxTokenDuration); err != nil {
+		return "", err
+	}
+	if m.store == nil {
+		return "", stores.ErrStoreNotProvided
+	}
+	userData, err := m.store.GetUserInfo(username, password)
+	if err != nil {
+		return "", err
+	}
+	return m.issueAccessToken(username, userData, nil, d)
+}
+
+// WithMaxTokenDuration sets the longest lifetime GenerateTokenWithExpiry grants,
+// DefaultMaxTokenDuration when zero or less.
+func (m *OpaqueTokenManager) WithMaxTokenDuration(d time.Duration) *OpaqueTokenManager {
+	m.maxTokenDuration = d
+	return m
+}
+
+// GenerateTokenWithExpiry is JWTManager.GenerateTokenWithExpiry for opaque tokens.
+func (m *OpaqueTokenManager) GenerateTokenWithExpiry(username, password string, d time.Duration) (string, error) {
+	if err := checkTokenDuration(d, m.maxTokenDuration); err != nil {
+		return "", err
+	}
+	if m.store == nil {
+		return "", stores.ErrStoreNotProvided
+	}
+	userData, err := m.store.GetUserInfo(username, password)
+	if err != nil {
+		return "", err
+	}
+	return m.issueAccessToken(username, userData, nil, d)
+}
+
+// checkTokenDuration checks a lifetime asked of GenerateTokenWithExpiry against limit,
+// DefaultMaxTokenDuration when zero or less
+func checkTokenDuration(d, limit time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("%w, got %v", ErrInvalidDuration, d)
+	}
+	if limit <= 0 {
+		limit = DefaultMaxTokenDuration
+	}
+	if d > limit {
+		return fmt.Errorf("%w: %v is over %v", ErrTokenDurationTooLong, d, limit)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package token
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// CurrentTokenVersion is the format version written to the tkv claim of issued tokens.
+// Tokens without the claim, issued before it existed, are version 0.
+const CurrentTokenVersion = 1
+
+// claimValidator checks the configured claims of a token of one format version
+type claimValidator func(claimConfig map[string]ClaimConfig, claims jwt.MapClaims) error
+
+// tokenVersions maps every format version to the validation of its claims,
+// verification dispatches on the tkv claim of the token.
+var tokenVersions = map[int]claimValidator{
+	// static booleans were written as strings ("True") before version 1
+	0: func(claimConfig map[string]ClaimConfig, claims jwt.MapClaims) error {
+		return validateClaims(claimConfig, claims, staticClaimMatches)
+	},
+	1: func(claimConfig map[string]ClaimConfig, claims jwt.MapClaims) error {
+		return validateClaims(claimConfig, claims, staticClaimEquals)
+	},
+}
+
+// tokenVersion returns the format version of a token, 0 when it has no tkv claim
+func tokenVersion(claims jwt.MapClaims) (int, error) {
+	val, ok := claims[ClaimTokenFormat]
+	if !ok {
+		return 0, nil
+	}
+	version, ok := val.(float64)
+	if !ok || version != float64(int(version)) {
+		return 0, fmt.Errorf("%w: malformed token version %v", ErrInvalidToken, val)
+	}
+	return int(version), nil
+}
+
+// checkTokenFormat validates claims with the rules of their format version, rejecting
+// versions below minimum with ErrTokenVersionTooOld and unknown ones as invalid
+func checkTokenFormat(claimConfig map[string]ClaimConfig, claims jwt.MapClaims, minimum int) error {
+	version, err := tokenVersion(claims)
+	if err != nil {
+		return err
+	}
+	validate, ok := tokenVersions[version]
+	if !ok {
+		return fmt.Errorf("%w: unknown token version %d", ErrInvalidToken, version)
+	}
+	if version < minimum {
+		return fmt.Errorf("%w: version %d, at least %d is required", ErrTokenVersionTooOld, version, minimum)
+	}
+	return validate(claimConfig, claims)
+}
+
+// validateClaims checks that a token carries its configured claims, static ones holding
+// their configured value as compared by matches. The exp claim is validated by the parser.
+func validateClaims(claimConfig map[string]ClaimConfig, claims jwt.MapClaims, matches func(want, got any) bool) error {
+	for name, cfg := range claimConfig {
+		val, exists := claims[name]
+		if !exists && cfg.Source != "system" && cfg.Source != "static" {
+			// Only system/static claims can be optional
+			return fmt.Errorf("missing claim: %s", name)
+		}
+
+		if cfg.Source == "static" && exists && !matches(cfg.Value, val) {
+			return fmt.Errorf("%w: unexpected value for claim %s", ErrClaimsInvalid, name)
+		}
+	}
+	return nil
+}
+
+// staticClaimMatches compares a static claim of a version 0 token with its configured value.
+// Boolean claims are compared as booleans, version 0 tokens serialized them as strings ("True", "true").
+func staticClaimMatches(want, got any) bool {
+	if wantBool, ok := want.(bool); ok {
+		switch v := got.(type) {
+		case bool:
+			return v == wantBool
+		case string:
+			gotBool, err := strconv.ParseBool(v)
+			return err == nil && gotBool == wantBool
+		}
+		return false
+	}
+	return fmt.Sprint(want) == fmt.Sprint(got)
+}
+
+// staticClaimEquals compares a static claim with its configured value, booleans must be JSON booleans
+func staticClaimEquals(want, got any) bool {
+	if wantBool, ok := want.(bool); ok {
+		gotBool, ok := got.(bool)
+		return ok && gotBool == wantBool
+	}
+	return fmt.Sprint(want) == fmt.Sprint(got)
+}
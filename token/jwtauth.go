@@ -4,8 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/HassanAli101/authify/secrets"
+	"github.com/HassanAli101/authify/stores"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -14,25 +19,60 @@ import (
 // username, role, and an expiry timestamp.
 // Returns a signed token string or an error if authentication fails.
 func (m *JWTManager) GenerateAccessToken(userIdentifier, password string) (string, error) {
+	if m.store == nil {
+		return "", stores.ErrStoreNotProvided
+	}
+
 	// Fetch user info and validate password
 	userData, err := m.store.GetUserInfo(userIdentifier, password)
 	if err != nil {
 		return "", err
 	}
+	return m.IssueAccessToken(userIdentifier, userData)
+}
+
+// IssueAccessToken signs an access token for a user the caller already authenticated,
+// built from the fields the store returned for them like GenerateAccessToken does.
+func (m *JWTManager) IssueAccessToken(userIdentifier string, userData map[string]any) (string, error) {
+	return m.issueAccessToken(userIdentifier, userData, nil, 0)
+}
+
+// issueAccessToken is IssueAccessToken, adding the claims of extra the token does not already
+// carry. The token lives for duration, or the lifetime of the user's role when zero.
+func (m *JWTManager) issueAccessToken(userIdentifier string, userData map[string]any, extra jwt.MapClaims, duration time.Duration) (string, error) {
+	if m.store == nil {
+		return "", stores.ErrStoreNotProvided
+	}
 
 	// Build claims dynamically
 	claims := m.buildClaims(m.cfg.AccessToken.Claims, userData, nil)
+	role := userData[m.store.StoreConfig().RoleColumn()]
+	m.setIdentityClaims(claims, userIdentifier, role)
+	if scopes := m.scopes(m.store, userData); len(scopes) > 0 {
+		claims[ClaimScope] = strings.Join(scopes, " ")
+	}
+	if err := stampTokenVersion(m.store, claims, userIdentifier); err != nil {
+		return "", err
+	}
 
-	// Always include issuer and expiry
-	now := time.Now()
-	claims[ClaimIssuer] = m.cfg.Issuer
-	claims[ClaimExpiry] = now.Add(m.cfg.AccessToken.Duration).Unix()
-	claims[ClaimIssued] = now.Unix()
+	// Always include issuer, issue time and expiry, the lifetime depending on the role
+	roleName, _ := role.(string)
+	if duration == 0 {
+		duration = m.accessDurationFor(roleName)
+	}
+	m.setRegisteredClaims(claims, duration)
+	m.setAudience(claims)
+	// the refresh token of the login is issued right after, with the lifetime of the role
+	m.stampSessionExpiry(claims, time.Now().Add(m.refreshDurationFor(roleName)))
+	addExtraClaims(claims, extra)
 
-	return m.signToken(claims, m.accessTokenSecretKey, m.cfg.AccessToken.SigningMethod)
+	return m.signToken(claims, m.accessSigningSecret(), m.cfg.AccessToken.SigningMethod)
 }
 
-// GenerateRefreshToken issues a refresh token with request metadata
+// GenerateRefreshToken issues a refresh token with request metadata.
+// A ClaimSessionID ("sid") entry of requestData ties the token to the session recorded at login,
+// a ClaimTokenID ("jti") entry is stamped as the ID of the token, and its "ip" or
+// RequestDeviceID entry binds the token with WithBindingMode.
 func (m *JWTManager) GenerateRefreshToken(username string, requestData map[string]any) (string, error) {
 	// Create a minimal user map to satisfy claims
 	userData := map[string]any{
@@ -40,44 +80,243 @@ func (m *JWTManager) GenerateRefreshToken(username string, requestData map[strin
 	}
 
 	claims := m.buildClaims(m.cfg.RefreshToken.Claims, userData, requestData)
+	for _, name := range []string{ClaimSessionID, ClaimTokenID} {
+		if val, ok := requestData[name].(string); ok && val != "" {
+			claims[name] = val
+		}
+	}
+	if binding := bindingID(m.bindingMode, requestData); binding != "" {
+		claims[ClaimBinding] = binding
+	}
+	if err := stampTokenVersion(m.store, claims, username); err != nil {
+		return "", err
+	}
+	duration, err := m.refreshTokenDuration(username)
+	if err != nil {
+		return "", err
+	}
 
-	// Always include issuer and expiry
-	now := time.Now()
-	claims[ClaimIssuer] = m.cfg.Issuer
-	claims[ClaimExpiry] = now.Add(m.cfg.RefreshToken.Duration).Unix()
-	claims[ClaimIssued] = now.Unix()
+	// Always include issuer, issue time and expiry
+	m.setRegisteredClaims(claims, duration)
 
-	return m.signToken(claims, m.refreshTokenSecretKey, "HS256") // Refresh uses HS256
+	return m.signToken(claims, m.refreshSigningSecret(), refreshSigningMethod)
 }
 
-
 // VerifyAccessToken verifies an access token against the config.
 // Returns claims map if valid, or error if invalid/expired.
+// In strict mode, tokens of disabled users are rejected with stores.ErrAccountDisabled, and
+// tokens issued before a bump of their user's token version with ErrTokenVersionMismatch.
+// Tokens issued before the global not-before time of the store, see InvalidateAllTokens, fail
+// with ErrTokenInvalidatedGlobally, a lookup cached for a few seconds. Without strict mode
+// verification makes no other store lookup. The tokens of service accounts, see
+// GenerateServiceToken, are verified without the claims configured for users, and in strict
+// mode rejected once their account is disabled. Tokens passing these checks are then handed
+// to the validators of WithClaimValidator.
 func (m *JWTManager) VerifyAccessToken(tokenStr string) (jwt.MapClaims, error) {
-	return m.verifyToken(tokenStr, m.accessTokenSecretKey, m.cfg.AccessToken.Claims, false)
+	return m.verifyAccessTokenClaims(tokenStr, nil)
+}
+
+// verifyAccessTokenClaims is VerifyAccessToken, reading the state of users through users, see verifyAccessToken
+func (m *JWTManager) verifyAccessTokenClaims(tokenStr string, users *userStates) (jwt.MapClaims, error) {
+	claims, err := m.verifyAccessToken(tokenStr, users)
+	if err != nil {
+		return nil, err
+	}
+	for _, validate := range m.claimValidators {
+		if err := validate(claims); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrClaimsInvalid, err)
+		}
+	}
+	return claims, nil
+}
+
+// verifyAccessToken runs the checks of VerifyAccessToken but its claim validators. In strict mode,
+// the state of the token's user is read through users when it is not nil, see VerifyTokens.
+func (m *JWTManager) verifyAccessToken(tokenStr string, users *userStates) (jwt.MapClaims, error) {
+	claims, err := m.verifyToken(tokenStr, m.accessSecrets(), m.accessClaims, false)
+	if err == nil {
+		err = m.checkGlobalNotBefore(claims)
+	}
+	if err == nil && TokenUse(claims) == TokenUseService {
+		return m.verifyServiceToken(claims)
+	}
+	if err == nil {
+		err = m.checkRole(claims)
+	}
+	if err != nil || !m.strict {
+		return claims, err
+	}
+
+	userIdentifier, err := m.UserIdentifier(claims)
+	if err != nil {
+		return nil, err
+	}
+	if users != nil {
+		if err := users.check(m.store, claims, userIdentifier); err != nil {
+			return nil, err
+		}
+		return claims, nil
+	}
+	if err := checkAccountActive(m.store, userIdentifier); err != nil {
+		return nil, err
+	}
+	if err := checkTokenVersion(m.store, claims, userIdentifier); err != nil {
+		return nil, err
+	}
+	return claims, nil
 }
 
 // VerifyRefreshToken verifies a refresh token against the config.
-// Returns claims map if valid, or error if invalid/expired.
+// Returns claims map if valid, or error if invalid/expired. Refresh tokens issued before the
+// global not-before time fail with ErrTokenInvalidatedGlobally, so that refreshing cannot
+// bring back the sessions ended by InvalidateAllTokens.
 func (m *JWTManager) VerifyRefreshToken(tokenStr string) (jwt.MapClaims, error) {
-	return m.verifyToken(tokenStr, m.refreshTokenSecretKey, m.cfg.RefreshToken.Claims, true)
+	claims, err := m.verifyToken(tokenStr, m.refreshSecrets(), m.cfg.RefreshToken.Claims, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkGlobalNotBefore(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// VerifyTokenWithScope verifies an access token and checks that it grants every required scope.
+// Returns ErrInsufficientScope if any of them is missing.
+func (m *JWTManager) VerifyTokenWithScope(tokenStr string, requiredScopes ...string) error {
+	claims, err := m.VerifyAccessToken(tokenStr)
+	if err != nil {
+		return err
+	}
+	if !HasScopes(claims, requiredScopes...) {
+		return ErrInsufficientScope
+	}
+	return nil
+}
+
+// UserIdentifier returns the user a token was issued to, read from the claim marked is_identifier.
+func (m *JWTManager) UserIdentifier(claims jwt.MapClaims) (string, error) {
+	userIdentifier, ok := claims[m.identifierClaim()].(string)
+	if !ok || userIdentifier == "" {
+		return "", ErrMissingUserIdentifier
+	}
+	return userIdentifier, nil
+}
+
+// Role returns the role of a token's user, read from the role claim, see WithRoleClaim,
+// or an empty string when the token carries no role.
+func (m *JWTManager) Role(claims jwt.MapClaims) string {
+	name, _ := m.roleClaimName()
+	role, _ := claims[name].(string)
+	return role
 }
 
-func (m *JWTManager) verifyToken(tokenStr string, secret string, claimConfig map[string]ClaimConfig, isRefresh bool) (jwt.MapClaims, error) {
+// ScopesFromClaims splits the space-delimited scope claim (RFC 8693) of a token.
+// Scope claims issued by other servers as an array of strings are accepted too.
+func ScopesFromClaims(claims jwt.MapClaims) []string {
+	switch scope := claims[ClaimScope].(type) {
+	case string:
+		return strings.Fields(scope)
+	case []string:
+		return scope
+	case []any:
+		scopes := make([]string, 0, len(scope))
+		for _, s := range scope {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+		return scopes
+	}
+	return nil
+}
+
+// HasScopes reports whether claims grant all of the required scopes
+func HasScopes(claims jwt.MapClaims, requiredScopes ...string) bool {
+	granted := ScopesFromClaims(claims)
+	for _, required := range requiredScopes {
+		if !slices.Contains(granted, required) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasAudience reports whether the "aud" claim of claims, a string or an array, names audience
+func HasAudience(claims jwt.MapClaims, audience string) bool {
+	aud, err := claims.GetAudience()
+	return err == nil && slices.Contains(aud, audience)
+}
+
+// parseWithSecrets parses tokenStr once and checks its signature with the current secret,
+// keys[0], falling back to the previous ones only when it does not match. Unless
+// skipClaimsValidation is set, its exp, nbf and iat claims are then validated.
+// Oversized or malformed tokens are rejected before reaching the JWT parser, and tokens
+// signed with any algorithm but method fail with ErrUnexpectedSigningMethod, so a token
+// cannot pick how its signature is checked.
+func (m *JWTManager) parseWithSecrets(tokenStr, method string, keys []secrets.SecretString, skipClaimsValidation bool) (*jwt.Token, error) {
+	if len(tokenStr) > MaxTokenLength || strings.Count(tokenStr, ".") != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	token, _, err := m.parser.ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || token.Method.Alg() != method {
+		return nil, ErrUnexpectedSigningMethod
+	}
+	dot := strings.LastIndexByte(tokenStr, '.')
+	if token.Signature, err = m.parser.DecodeSegment(tokenStr[dot+1:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", jwt.ErrTokenMalformed, err)
+	}
+
+	err = jwt.ErrTokenSignatureInvalid
+	for i, secret := range keys {
+		key := []byte(secret.Reveal())
+		err = token.Method.Verify(tokenStr[:dot], token.Signature, key)
+		secrets.Zero(key)
+		if err == nil {
+			if i > 0 {
+				m.previousSecretHits.Add(1)
+			}
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", jwt.ErrTokenSignatureInvalid, err)
+	}
+
+	if !skipClaimsValidation {
+		if err := m.validator.Validate(token.Claims); err != nil {
+			return nil, err
+		}
+	}
+	token.Valid = true
+	return token, nil
+}
+
+func (m *JWTManager) verifyToken(tokenStr string, keys []secrets.SecretString, claimConfig map[string]ClaimConfig, isRefresh bool) (jwt.MapClaims, error) {
 	if tokenStr == "" {
 		return nil, ErrInvalidToken
 	}
 
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+	method := m.cfg.AccessToken.SigningMethod
+	if isRefresh {
+		method = refreshSigningMethod
+	}
+
+	token, err := m.parseWithSecrets(tokenStr, method, keys, false)
+	if err != nil {
+		if errors.Is(err, ErrUnexpectedSigningMethod) {
 			return nil, ErrUnexpectedSigningMethod
 		}
-		return []byte(secret), nil
-	})
-	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
 			return nil, ErrTokenExpired
 		}
+		if errors.Is(err, jwt.ErrTokenNotValidYet) {
+			return nil, ErrTokenNotValidYet
+		}
 		return nil, ErrInvalidToken
 	}
 
@@ -85,30 +324,32 @@ func (m *JWTManager) verifyToken(tokenStr string, secret string, claimConfig map
 	if !ok || !token.Valid {
 		return nil, ErrClaimsInvalid
 	}
+	if m.cfg.Issuer != "" && claims[ClaimIssuer] != m.cfg.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %v", ErrInvalidToken, claims[ClaimIssuer])
+	}
 
-	// Validate all configured claims
-	for name, cfg := range claimConfig {
-		val, exists := claims[name]
-		if !exists && cfg.Source != "system" && cfg.Source != "static" {
-			// Only system/static claims can be optional
-			return nil, fmt.Errorf("missing claim: %s", name)
-		}
+	if err := m.openClaims(claims); err != nil {
+		return nil, err
+	}
+	// service tokens carry none of the claims configured for the tokens of users
+	if !isRefresh && TokenUse(claims) == TokenUseService {
+		claimConfig = nil
+	}
 
-		// Expiration check if configured as "exp"
-		if cfg.Type == "exp" {
-			if expFloat, ok := val.(float64); ok {
-				if time.Now().After(time.Unix(int64(expFloat), 0)) {
-					return nil, ErrTokenExpired
-				}
-			}
-		}
+	// Validate all configured claims, with the rules of the token's format version
+	if err := checkTokenFormat(claimConfig, claims, m.minimumVersion); err != nil {
+		return nil, err
 	}
 
 	return claims, nil
 }
 
 // RefreshToken issues a new access token based on a valid refresh token
-// and optionally an expired access token (claims reuse)
+// and optionally an expired access token (claims reuse).
+// Refreshes of the same tokens made concurrently, or within the dedup window of each
+// other, get the same access token, see WithRefreshDedupWindow. Each of them is still
+// verified, and checked against the status and token version of the user, and against the
+// binding of the refresh token, see WithBindingMode.
 func (m *JWTManager) RefreshToken(accessTokenStr, refreshTokenStr string, requestData map[string]any) (string, jwt.MapClaims, error) {
 	// 1️⃣ Verify refresh token first
 	refreshClaims, err := m.VerifyRefreshToken(refreshTokenStr)
@@ -126,36 +367,133 @@ func (m *JWTManager) RefreshToken(accessTokenStr, refreshTokenStr string, reques
 		return "", nil, ErrMissingUserIdentifier
 	}
 
+	// Disabled users must log in again once re-enabled, as must users whose token version was bumped
+	if err := checkAccountActive(m.store, userIdentifier); err != nil {
+		return "", nil, err
+	}
+	if err := checkTokenVersion(m.store, refreshClaims, userIdentifier); err != nil {
+		return "", nil, err
+	}
+	if err := checkBinding(m.bindingMode, refreshClaims, requestData); err != nil {
+		return "", nil, err
+	}
+
+	var refreshExpiry time.Time
+	if exp, _ := refreshClaims.GetExpirationTime(); exp != nil {
+		refreshExpiry = exp.Time
+	}
+
+	return m.refreshes.do(refreshKey(accessTokenStr, refreshTokenStr), func() (string, jwt.MapClaims, error) {
+		return m.mintRefreshedToken(accessTokenStr, userIdentifier, requestData, refreshExpiry)
+	})
+}
+
+// rotateRefreshToken issues the replacement of a refresh token, with its claims and expiry, so
+// rotations never extend a session, stamped with jti and the current issue time
+func (m *JWTManager) rotateRefreshToken(refreshTokenStr, jti string) (string, error) {
+	claims, err := m.VerifyRefreshToken(refreshTokenStr)
+	if err != nil {
+		return "", err
+	}
+	claims = maps.Clone(claims)
+	claims[ClaimTokenID] = jti
+	claims[ClaimIssued] = time.Now().Unix()
+	return m.signToken(claims, m.refreshSigningSecret(), refreshSigningMethod)
+}
+
+// mintRefreshedToken issues the access token of a refresh for userIdentifier. Its claims are
+// resolved from the store when it can look users up, so a role changed since the login is
+// reflected, and otherwise carried over from the previous access token. refreshExpiry is when
+// the refresh token expires.
+func (m *JWTManager) mintRefreshedToken(accessTokenStr, userIdentifier string, requestData map[string]any, refreshExpiry time.Time) (string, jwt.MapClaims, error) {
+	idClaim := m.identifierClaim()
+
 	// 3️⃣ Optionally verify access token (ignore expiry)
 	var accessClaims jwt.MapClaims
 	if accessTokenStr != "" {
-		accessClaims, _ = m.parseTokenWithoutExpiry(accessTokenStr, m.accessTokenSecretKey)
+		accessClaims, _ = m.parseTokenWithoutExpiry(accessTokenStr, m.accessSecrets())
+	}
+	if err := checkReusedClaims(accessClaims, idClaim, userIdentifier); err != nil {
+		return "", nil, err
+	}
+	stored, err := m.storeUser(userIdentifier)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// 4️⃣ Build new claims for access token
+	// 4️⃣ Build new claims for access token, the store's values winning over the old claims
 	userData := map[string]any{
 		idClaim: userIdentifier,
 	}
-	if accessClaims != nil {
-		// Include old claims like role/email
-		for k, v := range accessClaims {
-			userData[k] = v
-		}
-	}
+	maps.Copy(userData, accessClaims)
+	maps.Copy(userData, stored)
 
 	newClaims := m.buildClaims(m.cfg.AccessToken.Claims, userData, requestData)
-	now := time.Now()
-	newClaims[ClaimIssuer] = m.cfg.Issuer
-	newClaims[ClaimIssued] = now.Unix()
-	newClaims[ClaimExpiry] = now.Add(m.cfg.AccessToken.Duration).Unix()
+	roleClaim, _ := m.roleClaimName()
+	role := accessClaims[roleClaim]
+	if stored != nil {
+		role = stored[m.store.StoreConfig().RoleColumn()]
+	}
+	m.setIdentityClaims(newClaims, userIdentifier, role)
+	if val, ok := accessClaims[ClaimTenant]; ok {
+		newClaims[ClaimTenant] = val
+	}
+	if scope := m.refreshedScope(stored, accessClaims); scope != "" {
+		newClaims[ClaimScope] = scope
+	}
+	if err := stampTokenVersion(m.store, newClaims, userIdentifier); err != nil {
+		return "", nil, err
+	}
+	duration, err := m.refreshedAccessDuration(userIdentifier, role)
+	if err != nil {
+		return "", nil, err
+	}
+	m.setRegisteredClaims(newClaims, duration)
+	m.setAudience(newClaims)
+	m.stampSessionExpiry(newClaims, refreshExpiry)
 
-	token, err := m.signToken(newClaims, m.accessTokenSecretKey, m.cfg.AccessToken.SigningMethod)
+	token, err := m.signToken(newClaims, m.accessSigningSecret(), m.cfg.AccessToken.SigningMethod)
 	return token, newClaims, err
 }
 
-func (m *JWTManager) parseTokenWithoutExpiry(tokenStr string, secret string) (jwt.MapClaims, error) {
-	parser := new(jwt.Parser)
-	token, _, err := parser.ParseUnverified(tokenStr, jwt.MapClaims{})
+// refreshedScope returns the scope claim of a refreshed access token: the scopes stored grants
+// like at login, or the ones of the previous token without stored.
+func (m *JWTManager) refreshedScope(stored map[string]any, accessClaims jwt.MapClaims) string {
+	if stored == nil {
+		scope, _ := accessClaims[ClaimScope].(string)
+		return scope
+	}
+	return strings.Join(m.scopes(m.store, stored), " ")
+}
+
+// setRegisteredClaims stamps the token version, issuer, issue time and expiry on claims,
+// plus a not-before time when the manager was built WithNotBefore.
+func (m *JWTManager) setRegisteredClaims(claims jwt.MapClaims, duration time.Duration) {
+	now := m.now()
+	claims[ClaimTokenFormat] = CurrentTokenVersion
+	claims[ClaimIssuer] = m.cfg.Issuer
+	claims[ClaimIssued] = now.Unix()
+	claims[ClaimExpiry] = now.Add(duration).Unix()
+	if m.notBefore > 0 {
+		claims[ClaimNotBefore] = now.Add(m.notBefore).Unix()
+	}
+}
+
+// setAudience stamps the configured audience of access tokens on claims, if any
+func (m *JWTManager) setAudience(claims jwt.MapClaims) {
+	switch aud := m.cfg.AccessToken.Audience; len(aud) {
+	case 0:
+	case 1:
+		claims[ClaimAudience] = aud[0]
+	default:
+		claims[ClaimAudience] = aud
+	}
+}
+
+// parseTokenWithoutExpiry verifies the signature of tokenStr but not its time based claims,
+// so the claims of an expired access token can be carried over by RefreshToken.
+func (m *JWTManager) parseTokenWithoutExpiry(tokenStr string, keys []secrets.SecretString) (jwt.MapClaims, error) {
+	token, err := m.parseWithSecrets(tokenStr, m.cfg.AccessToken.SigningMethod, keys, true)
 	if err != nil {
 		return nil, err
 	}
@@ -163,9 +501,35 @@ func (m *JWTManager) parseTokenWithoutExpiry(tokenStr string, secret string) (jw
 	if !ok {
 		return nil, ErrClaimsInvalid
 	}
+	if err := m.openClaims(claims); err != nil {
+		return nil, err
+	}
 	return claims, nil
 }
 
+// checkReusedClaims makes sure the claims of a previous access token can be carried over:
+// it must belong to the refresh token's user, not to a service account, and its scope,
+// if any, must be a string.
+func checkReusedClaims(accessClaims jwt.MapClaims, idClaim, userIdentifier string) error {
+	if accessClaims == nil {
+		return nil
+	}
+	if TokenUse(accessClaims) == TokenUseService {
+		return fmt.Errorf("%w: service tokens cannot be refreshed", ErrClaimsInvalid)
+	}
+	if id, exists := accessClaims[idClaim]; exists {
+		if s, ok := id.(string); !ok || s != userIdentifier {
+			return fmt.Errorf("%w: access token was not issued to %s", ErrClaimsInvalid, userIdentifier)
+		}
+	}
+	if scope, exists := accessClaims[ClaimScope]; exists {
+		if _, ok := scope.(string); !ok {
+			return fmt.Errorf("%w: unexpected type for claim %s", ErrClaimsInvalid, ClaimScope)
+		}
+	}
+	return nil
+}
+
 // buildClaims dynamically builds JWT claims based on config
 func (m *JWTManager) buildClaims(cfg map[string]ClaimConfig, userData map[string]any, requestData map[string]any) jwt.MapClaims {
 	claims := jwt.MapClaims{}
@@ -199,12 +563,23 @@ func (m *JWTManager) buildClaims(cfg map[string]ClaimConfig, userData map[string
 	return claims
 }
 
-func (m *JWTManager) signToken(claims jwt.MapClaims, secretKey string, method string) (string, error) {
+// signToken signs claims, with the claims of encrypted columns sealed when the manager was
+// built WithClaimsEncryption. claims itself is left as is.
+func (m *JWTManager) signToken(claims jwt.MapClaims, secretKey secrets.SecretString, method string) (string, error) {
 	signMethod, ok := signingMethods[method]
 	if !ok {
 		return "", fmt.Errorf("unsupported signing method: %s", method)
 	}
+	if m.claimsCipher != nil {
+		sealed, err := m.claimsCipher.seal(claims, m.encryptedClaims())
+		if err != nil {
+			return "", err
+		}
+		claims = sealed
+	}
 
 	token := jwt.NewWithClaims(signMethod, claims)
-	return token.SignedString([]byte(secretKey))
-}
\ No newline at end of file
+	key := []byte(secretKey.Reveal())
+	defer secrets.Zero(key)
+	return token.SignedString(key)
+}
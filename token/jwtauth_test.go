@@ -0,0 +1,60 @@
+package token
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+)
+
+func TestNotBeforeWindow(t *testing.T) {
+	store := stores.NewInMemoryUserStore(stores.StoreConfig{
+		BcryptCost: 4,
+		Columns: map[string]stores.ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+		},
+	})
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	m, err := NewJWTManager().
+		WithAccessSecret("supersecret").
+		WithRefreshSecret("supersecret2").
+		WithStore(store).
+		WithConfig(&TokenConfig{
+			AccessToken: AccessTokenConfig{
+				Duration:      time.Minute,
+				SigningMethod: "HS256",
+				Claims: map[string]ClaimConfig{
+					"username": {Source: "db", Column: "username", IsIdentifier: true},
+				},
+			},
+			RefreshToken: RefreshTokenConfig{Duration: time.Hour},
+		}).
+		WithNotBefore(2 * time.Second).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build manager: %v", err)
+	}
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	tokenStr, err := m.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	if _, err := m.VerifyAccessToken(tokenStr); !errors.Is(err, ErrTokenNotValidYet) {
+		t.Fatalf("expected ErrTokenNotValidYet before nbf, got %v", err)
+	}
+
+	now = now.Add(3 * time.Second)
+	claims, err := m.VerifyAccessToken(tokenStr)
+	if err != nil {
+		t.Fatalf("failed to verify token after nbf: %v", err)
+	}
+	if _, ok := claims[ClaimIssued]; !ok {
+		t.Errorf("expected iat claim to be present: %v", claims)
+	}
+}
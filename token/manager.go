@@ -1,33 +1,198 @@
 package token
 
 import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/HassanAli101/authify/secrets"
 	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/verifier"
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// TokenManager issues, verifies and refreshes the tokens of authify.
+//
+// IssueTokens, RefreshTokens and VerifyToken take request structs, which grow with new features
+// without breaking implementations. New implementations only need these and can embed
+// UnimplementedTokenManager for the narrow methods, authify.Authify uses the request methods for
+// logins, refreshes and authentication. The narrow methods are kept for existing callers and
+// implementations, and are served by the JWT and opaque managers as before.
 type TokenManager interface {
+	// IssueTokens checks the credentials of req and issues an access and a refresh token.
+	IssueTokens(ctx context.Context, req GenerateTokensRequest) (*TokenPair, error)
+	// RefreshTokens issues a new access token for the refresh token of req.
+	RefreshTokens(ctx context.Context, req RefreshTokensRequest) (*TokenPair, error)
+	// VerifyToken verifies the access or refresh token of req and returns its claims.
+	VerifyToken(ctx context.Context, req VerifyTokenRequest) (*VerifyTokenResponse, error)
+
+	// Deprecated: use IssueTokens, which checks the credentials once for both tokens and
+	// returns their expiries. GenerateAccessToken(u, p) is the AccessToken of
+	// IssueTokens(ctx, GenerateTokensRequest{Username: u, Password: p}).
 	GenerateAccessToken(userIdentifier, password string) (string, error)
+	// Deprecated: use IssueTokens, with the device and session of requestData in the Device
+	// and SessionID of GenerateTokensRequest, see RequestData.
 	GenerateRefreshToken(username string, requestData map[string]any) (string, error)
+	// VerifyAccessToken is VerifyToken(ctx, VerifyTokenRequest{Token: tokenStr}) without a
+	// context, kept for the hot paths that only need the claims.
 	VerifyAccessToken(tokenStr string) (jwt.MapClaims, error)
+	// VerifyRefreshToken is VerifyToken with VerifyTokenRequest.Refresh set, without a context.
 	VerifyRefreshToken(tokenStr string) (jwt.MapClaims, error)
-	RefreshToken(accessTokenStr, refreshTokenStr string, requestData map[string]any) (string, jwt.MapClaims, error) 
+	// Deprecated: use RefreshTokens, with the device of requestData in RefreshTokensRequest.Device.
+	// The claims of the new access token are in TokenPair.AccessClaims.
+	RefreshToken(accessTokenStr, refreshTokenStr string, requestData map[string]any) (string, jwt.MapClaims, error)
+	// Deprecated: use VerifyToken with the scopes in VerifyTokenRequest.Scopes.
+	VerifyTokenWithScope(tokenStr string, requiredScopes ...string) error
+	UserIdentifier(claims jwt.MapClaims) (string, error)
+	ExchangeToken(subjectToken, actorUsername, actorPassword, audience string, ttl time.Duration) (string, error)
+}
+
+// ClaimValidator checks the claims of a verified access token, see JWTManager.WithClaimValidator.
+type ClaimValidator func(claims jwt.MapClaims) error
+
+// PreauthenticatedIssuer is implemented by token managers that can issue an access token for a
+// user authenticated by the caller, such as a challenge login, given the user fields returned
+// by the store. The JWT and opaque managers implement it.
+type PreauthenticatedIssuer interface {
+	IssueAccessToken(userIdentifier string, userData map[string]any) (string, error)
+}
+
+// ExpiryIssuer is implemented by token managers that can issue an access token with a lifetime
+// of its own, such as a long-lived token of a service, in place of the configured one. The JWT
+// and opaque managers implement it.
+type ExpiryIssuer interface {
+	GenerateTokenWithExpiry(username, password string, d time.Duration) (string, error)
+}
+
+// Revoker is implemented by token managers that can revoke single tokens before they expire,
+// such as the opaque manager. JWTs can only be revoked all at once, see stores.TokenVersioner.
+type Revoker interface {
+	RevokeToken(tokenStr string) error
+}
+
+// GlobalInvalidator is implemented by token managers that can invalidate every token issued
+// so far at once, such as the JWT manager, see JWTManager.InvalidateAllTokens.
+type GlobalInvalidator interface {
+	InvalidateAllTokens() (time.Time, error)
+}
+
+// SecretRotator is implemented by token managers whose signing secrets can be replaced while
+// they serve requests, such as the JWT manager, see JWTManager.RotateSecrets.
+type SecretRotator interface {
+	RotateSecrets(newAccess, newRefresh string, keepOld bool) error
+}
+
+// ServiceTokenIssuer is implemented by token managers that can issue access tokens to service
+// accounts, such as the JWT manager built WithServiceAccounts.
+type ServiceTokenIssuer interface {
+	GenerateServiceToken(clientID, clientSecret string, scopes []string) (string, error)
+}
+
+// SlidingVerifier is implemented by token managers that extend sessions on use, such as the JWT
+// manager built WithSlidingExpiration. replacement is empty unless the token was replaced.
+type SlidingVerifier interface {
+	VerifyAccessTokenSliding(tokenStr string) (claims jwt.MapClaims, replacement string, err error)
+}
+
+// RoleReporter is implemented by token managers that can read the role of a token's user from
+// its claims, such as the ones returned by RefreshToken. The JWT and opaque managers implement it.
+type RoleReporter interface {
+	Role(claims jwt.MapClaims) string
+}
+
+// RoleFromClaims returns the role m reads from claims, or an empty string when m is not a RoleReporter.
+func RoleFromClaims(m TokenManager, claims jwt.MapClaims) string {
+	if reporter, ok := m.(RoleReporter); ok {
+		return reporter.Role(claims)
+	}
+	return ""
 }
 
 // JWTManager is responsible for creating, verifying, and refreshing JWT tokens.
 // It stores a secret key, token duration, and store interface.
 type JWTManager struct {
-	cfg *TokenConfig
-	accessTokenSecretKey  string
-	refreshTokenSecretKey string
+	cfg                   *TokenConfig
+	accessTokenSecretKey  secrets.SecretString
+	refreshTokenSecretKey secrets.SecretString
 	store                 stores.Store
+	serviceAccounts       stores.ServiceAccountStore
+	notBefore             time.Duration
+	strict                bool
+	refreshOnly           bool
+	minimumVersion        int
+	bindingMode           BindingMode
+
+	// claim names overriding the ones found in the token config, see WithUsernameClaim
+	usernameClaim string
+	roleClaim     string
+	optionalRole  bool
+
+	// run by VerifyAccessToken after its own checks, see WithClaimValidator
+	claimValidators []ClaimValidator
+
+	// tokens VerifyTokens verifies at once, see WithVerifyWorkers
+	verifyWorkers int
+
+	// remaining lifetime below which access tokens are replaced on use, see WithSlidingExpiration
+	slidingThreshold time.Duration
+
+	// secrets replaced by a rotation, still accepted for verification only
+	previousAccessSecrets  []secrets.SecretString
+	previousRefreshSecrets []secrets.SecretString
+	previousSecretHits     atomic.Int64
+
+	// secrets replaced by RotateSecrets, accepted for verification until their grace window
+	// ends. secretsMu guards every secret field, which RotateSecrets swaps while tokens are verified.
+	secretsMu             sync.RWMutex
+	rotatedAccessSecrets  []rotatedSecret
+	rotatedRefreshSecrets []rotatedSecret
+	secretGracePeriod     time.Duration
+
+	// keys of claims encryption, turned into claimsCipher by Build
+	claimsKey          []byte
+	previousClaimsKeys [][]byte
+	claimsCipher       *claimsCipher
+
+	// set up by Build, shared by every verification rather than configured on each call
+	parser       *jwt.Parser
+	validator    *jwt.Validator
+	accessClaims map[string]ClaimConfig
+
+	// clock of issuing and verifying tokens, replaced by tests
+	now func() time.Time
+
+	// refreshes of the same tokens share the access token they mint
+	refreshes refreshDedup
+
+	// tokens issued before the store's global not-before time are rejected, see InvalidateAllTokens
+	globalNotBefore notBeforeCache
+
+	// lifetime of access tokens overriding the token config, see WithTokenDuration
+	tokenDuration time.Duration
+	// longest lifetime of GenerateTokenWithExpiry, see WithMaxTokenDuration
+	maxTokenDuration time.Duration
+	// lifetimes of the tokens of some roles, see WithRoleTokenDurations and WithRoleRefreshDurations
+	roleAccessDurations  map[string]time.Duration
+	roleRefreshDurations map[string]time.Duration
+	// first error of the builder methods, returned by Build
+	buildErr error
+
+	// replaced at runtime by a config reload, see Reloadable
+	durations atomic.Pointer[tokenDurations]
+	reloadableScopes
 }
 
 // NewJWTManager initializes a JWTManager with the given secret key, token expiry duration,
 // and database store reference for user validation.
 // all of these follow the builder pattern while making the jwt manager.
 func NewJWTManager() *JWTManager {
-	return &JWTManager{}
+	m := &JWTManager{now: time.Now}
+	m.refreshes.window = defaultRefreshDedupWindow
+	m.globalNotBefore.ttl = DefaultGlobalNotBeforeTTL
+	return m
 }
 
 func (m *JWTManager) WithConfig(cfg *TokenConfig) *JWTManager {
@@ -36,38 +201,462 @@ func (m *JWTManager) WithConfig(cfg *TokenConfig) *JWTManager {
 }
 
 func (m *JWTManager) WithAccessSecret(secret string) *JWTManager {
+	return m.WithAccessSecretString(secrets.SecretString(secret))
+}
+
+// WithAccessSecretString is WithAccessSecret for a secret read as a secrets.SecretString,
+// such as the ones of lib.Config. Secrets are held as such, so they never show up when
+// the manager is printed.
+func (m *JWTManager) WithAccessSecretString(secret secrets.SecretString) *JWTManager {
 	m.accessTokenSecretKey = secret
 	return m
 }
 
 func (m *JWTManager) WithRefreshSecret(secret string) *JWTManager {
+	return m.WithRefreshSecretString(secrets.SecretString(secret))
+}
+
+// WithRefreshSecretString is WithRefreshSecret for a secrets.SecretString.
+func (m *JWTManager) WithRefreshSecretString(secret secrets.SecretString) *JWTManager {
 	m.refreshTokenSecretKey = secret
 	return m
 }
 
+// WithPreviousAccessSecret keeps accepting access tokens signed with a rotated out secret,
+// new tokens are always signed with the current one. It can be called once per old secret,
+// and should be dropped once the tokens it signed have expired. Empty secrets are ignored.
+func (m *JWTManager) WithPreviousAccessSecret(secret string) *JWTManager {
+	return m.WithPreviousAccessSecretString(secrets.SecretString(secret))
+}
+
+// WithPreviousAccessSecretString is WithPreviousAccessSecret for a secrets.SecretString.
+func (m *JWTManager) WithPreviousAccessSecretString(secret secrets.SecretString) *JWTManager {
+	if secret != "" {
+		m.previousAccessSecrets = append(m.previousAccessSecrets, secret)
+	}
+	return m
+}
+
+// WithAdditionalVerifySecrets is WithPreviousAccessSecret for several secrets, tried in order
+// once the current one does not match, like verifier.Verifier.WithAdditionalVerifySecrets. It
+// allows rotating the secret without downtime: deploy the verifiers with both secrets, then the
+// issuers with the new one, then drop the old one. Empty secrets are ignored.
+func (m *JWTManager) WithAdditionalVerifySecrets(extra ...string) *JWTManager {
+	for _, secret := range extra {
+		m.WithPreviousAccessSecret(secret)
+	}
+	return m
+}
+
+// WithPreviousRefreshSecret is the refresh token counterpart of WithPreviousAccessSecret.
+func (m *JWTManager) WithPreviousRefreshSecret(secret string) *JWTManager {
+	return m.WithPreviousRefreshSecretString(secrets.SecretString(secret))
+}
+
+// WithPreviousRefreshSecretString is WithPreviousRefreshSecret for a secrets.SecretString.
+func (m *JWTManager) WithPreviousRefreshSecretString(secret secrets.SecretString) *JWTManager {
+	if secret != "" {
+		m.previousRefreshSecrets = append(m.previousRefreshSecrets, secret)
+	}
+	return m
+}
+
+// WithClaimsEncryption encrypts the claims taken from columns marked encrypted in the store
+// config with AES-GCM and key, which must be 16, 24 or 32 bytes long. They are sealed together
+// into a single ClaimEncrypted claim, so tokens passing through logs do not reveal them, and
+// verification decrypts them transparently. Tokens issued before encryption was enabled keep
+// being accepted. Verification of tokens carrying encrypted claims needs the key they were
+// sealed with, see WithPreviousClaimsEncryptionKey for rotations.
+func (m *JWTManager) WithClaimsEncryption(key []byte) *JWTManager {
+	m.claimsKey = key
+	return m
+}
+
+// WithPreviousClaimsEncryptionKey keeps decrypting the claims of tokens sealed with a rotated
+// out key, new tokens are always sealed with the key of WithClaimsEncryption. Like previous
+// secrets, it can be called once per old key. Empty keys are ignored.
+func (m *JWTManager) WithPreviousClaimsEncryptionKey(key []byte) *JWTManager {
+	if len(key) > 0 {
+		m.previousClaimsKeys = append(m.previousClaimsKeys, key)
+	}
+	return m
+}
+
 func (m *JWTManager) WithStore(store stores.Store) *JWTManager {
 	m.store = store
 	return m
 }
 
+// WithServiceAccounts lets the service accounts kept in accounts obtain access tokens with
+// GenerateServiceToken. Strict verification then rejects the tokens of disabled accounts too.
+func (m *JWTManager) WithServiceAccounts(accounts stores.ServiceAccountStore) *JWTManager {
+	m.serviceAccounts = accounts
+	return m
+}
+
+// WithTokenDuration sets the lifetime of access tokens, in place of the duration of the token
+// config. It must be positive, Build fails with ErrInvalidDuration otherwise. SetDurations
+// still replaces it at runtime.
+func (m *JWTManager) WithTokenDuration(d time.Duration) *JWTManager {
+	if d <= 0 {
+		m.setBuildErr(fmt.Errorf("%w, got %v", ErrInvalidDuration, d))
+		return m
+	}
+	m.tokenDuration = d
+	return m
+}
+
+// WithTokenDurationString is WithTokenDuration for a Go duration string such as "15m" or "2h30m",
+// as read from YAML or the environment. Strings that do not parse make Build fail, so the builder
+// chain needs no error check of its own.
+func (m *JWTManager) WithTokenDurationString(s string) *JWTManager {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		m.setBuildErr(fmt.Errorf("%w, got %q: %w", ErrInvalidDuration, s, err))
+		return m
+	}
+	return m.WithTokenDuration(d)
+}
+
+// setBuildErr keeps the first error of the builder methods, for Build to return
+func (m *JWTManager) setBuildErr(err error) {
+	if m.buildErr == nil {
+		m.buildErr = err
+	}
+}
+
+// WithNotBefore delays the validity of every issued token by d,
+// tokens carry nbf = iat + d and are rejected by verification until then.
+func (m *JWTManager) WithNotBefore(d time.Duration) *JWTManager {
+	m.notBefore = d
+	return m
+}
+
+// WithStrictVerification makes VerifyAccessToken look the token's user up in the store,
+// rejecting tokens of disabled or removed users before they expire.
+// Refreshing always performs this check, regardless of strict mode.
+func (m *JWTManager) WithStrictVerification(strict bool) *JWTManager {
+	m.strict = strict
+	return m
+}
+
+// WithRefreshOnly lets Build succeed without a store, for services that only reissue tokens.
+// In this mode GenerateRefreshToken, VerifyAccessToken, VerifyRefreshToken, VerifyTokenWithScope
+// and RefreshToken work as usual, while GenerateAccessToken, which validates passwords against
+// the store, fails with stores.ErrStoreNotProvided. Refreshing then skips the account status
+// check, and strict verification has no effect, unless a store is provided anyway.
+// Services that only verify tokens should use the verifier package instead, which needs
+// neither a store nor a refresh secret.
+func (m *JWTManager) WithRefreshOnly() *JWTManager {
+	m.refreshOnly = true
+	return m
+}
+
+// WithMinimumTokenVersion rejects tokens whose format version, the tkv claim, is below n with
+// ErrTokenVersionTooOld. Tokens without the claim are version 0, and keep being verified with
+// the lenient rules of that version until n is raised above 0. n cannot exceed CurrentTokenVersion.
+func (m *JWTManager) WithMinimumTokenVersion(n int) *JWTManager {
+	m.minimumVersion = n
+	return m
+}
+
+// WithBindingMode binds the refresh tokens issued from then on to the client's IP address or
+// device fingerprint, taken from the request data of GenerateRefreshToken. RefreshToken then
+// fails with ErrBindingMismatch unless its request data carries the same one. Tokens issued
+// without one, or with NoBinding, stay unbound. Changing the mode unbinds nothing, but tokens
+// bound in another mode no longer match, their users have to log in again.
+func (m *JWTManager) WithBindingMode(mode BindingMode) *JWTManager {
+	m.bindingMode = mode
+	return m
+}
+
+// WithRefreshDedupWindow sets how long the access token minted by a refresh is returned to
+// other refreshes with the same refresh and access tokens, 10s by default, refreshes in flight
+// sharing it too. Duplicates then get the same token instead of racing for several, e.g. the
+// requests a browser tab sends as its access token expires. Zero disables deduplication.
+func (m *JWTManager) WithRefreshDedupWindow(d time.Duration) *JWTManager {
+	m.refreshes.window = d
+	return m
+}
+
+// WithUsernameClaim names the claim carrying the user identifier, in place of the claim marked
+// is_identifier in the token config. Access tokens carry it even when the config lists no such claim.
+func (m *JWTManager) WithUsernameClaim(name string) *JWTManager {
+	m.usernameClaim = name
+	return m
+}
+
+// WithRoleClaim names the claim carrying the user's role, in place of the db claim of the store's
+// role column. Access tokens carry it, taken from the role column, even when the config lists no
+// such claim.
+func (m *JWTManager) WithRoleClaim(name string) *JWTManager {
+	m.roleClaim = name
+	return m
+}
+
+// WithRequireRole(false) accepts access tokens without a role claim, for schemas without roles,
+// Role then returns an empty string. By default, access tokens must carry the role claim when
+// one is configured, and fail verification with ErrMissingRole otherwise.
+func (m *JWTManager) WithRequireRole(require bool) *JWTManager {
+	m.optionalRole = !require
+	return m
+}
+
+// WithClaimValidator adds a check of the claims of access tokens, run by VerifyAccessToken once
+// the standard checks passed, for rules of the application such as requiring a tenant claim.
+// Validators run in the order they were added, the first error is returned wrapped in
+// ErrClaimsInvalid, so errors.Is matches both.
+func (m *JWTManager) WithClaimValidator(validate ClaimValidator) *JWTManager {
+	if validate != nil {
+		m.claimValidators = append(m.claimValidators, validate)
+	}
+	return m
+}
+
 func (m *JWTManager) Build() (*JWTManager, error) {
+	if m.buildErr != nil {
+		return nil, m.buildErr
+	}
+	if m.cfg == nil {
+		return nil, ErrTokenConfigNotProvided
+	}
+	if err := verifier.CheckSigningMethod(m.cfg.AccessToken.SigningMethod); err != nil {
+		return nil, fmt.Errorf("%w, see signing_method in the token config", err)
+	}
 	if m.accessTokenSecretKey == "" {
-		return nil, ErrAccessTokenSecretNotProvided
+		return nil, fmt.Errorf("%w: it signs and verifies access tokens, see WithAccessSecret", ErrAccessTokenSecretNotProvided)
+	}
+	if m.refreshTokenSecretKey == "" && m.store == nil && !m.refreshOnly {
+		// no refresh secret nor store: a service set up to verify tokens only
+		return nil, fmt.Errorf("%w: a JWTManager issues tokens, services only verifying them can use the verifier package, which needs the access secret only", ErrRefreshTokenSecretNotProvided)
 	}
 	if m.refreshTokenSecretKey == "" {
-		return nil, ErrRefreshTokenSecretNotProvided
+		return nil, fmt.Errorf("%w: it signs and verifies refresh tokens, see WithRefreshSecret", ErrRefreshTokenSecretNotProvided)
 	}
-	if m.store == nil {
-		return nil, stores.ErrStoreNotProvided
+	if m.store == nil && !m.refreshOnly {
+		return nil, fmt.Errorf("%w: see WithStore, or WithRefreshOnly for services only reissuing tokens", stores.ErrStoreNotProvided)
+	}
+	if m.minimumVersion > CurrentTokenVersion {
+		return nil, fmt.Errorf("minimum token version %d is above the current version %d", m.minimumVersion, CurrentTokenVersion)
 	}
+	if m.claimsKey != nil {
+		cipher, err := newClaimsCipher(m.claimsKey, m.previousClaimsKeys)
+		if err != nil {
+			return nil, err
+		}
+		m.claimsCipher = cipher
+	}
+	if m.maxTokenDuration == 0 {
+		if m.cfg.AccessToken.MaxDuration < 0 {
+			return nil, fmt.Errorf("%w, got max_duration %v", ErrInvalidDuration, m.cfg.AccessToken.MaxDuration)
+		}
+		m.maxTokenDuration = m.cfg.AccessToken.MaxDuration
+	}
+	if m.roleAccessDurations == nil {
+		if err := checkRoleDurations(m.cfg.AccessToken.RoleDurations); err != nil {
+			return nil, err
+		}
+		m.roleAccessDurations = m.cfg.AccessToken.RoleDurations
+	}
+	if m.roleRefreshDurations == nil {
+		if err := checkRoleDurations(m.cfg.RefreshToken.RoleDurations); err != nil {
+			return nil, err
+		}
+		m.roleRefreshDurations = m.cfg.RefreshToken.RoleDurations
+	}
+	m.parser = jwt.NewParser()
+	m.validator = jwt.NewValidator(jwt.WithTimeFunc(func() time.Time { return m.now() }))
+	m.accessClaims = m.accessClaimsToVerify()
 	return m, nil
 }
 
+// PreviousSecretVerifications counts the tokens verified with a previous secret since the
+// manager was built. Once it stops growing, the previous secrets can be removed.
+func (m *JWTManager) PreviousSecretVerifications() int64 {
+	return m.previousSecretHits.Load()
+}
+
+// DeduplicatedRefreshes counts the refreshes answered with the access token minted by
+// another refresh of the same tokens since the manager was built.
+func (m *JWTManager) DeduplicatedRefreshes() int64 {
+	return m.refreshes.deduplicated.Load()
+}
+
+// accessSecrets returns the secret signing access tokens, followed by the ones still accepted
+func (m *JWTManager) accessSecrets() []secrets.SecretString {
+	m.secretsMu.RLock()
+	defer m.secretsMu.RUnlock()
+	accepted := append([]secrets.SecretString{m.accessTokenSecretKey}, m.previousAccessSecrets...)
+	return appendUnexpired(accepted, m.rotatedAccessSecrets, time.Now())
+}
+
+// refreshSecrets returns the secret signing refresh tokens, followed by the ones still accepted
+func (m *JWTManager) refreshSecrets() []secrets.SecretString {
+	m.secretsMu.RLock()
+	defer m.secretsMu.RUnlock()
+	accepted := append([]secrets.SecretString{m.refreshTokenSecretKey}, m.previousRefreshSecrets...)
+	return appendUnexpired(accepted, m.rotatedRefreshSecrets, time.Now())
+}
+
+func (m *JWTManager) accessSigningSecret() secrets.SecretString {
+	m.secretsMu.RLock()
+	defer m.secretsMu.RUnlock()
+	return m.accessTokenSecretKey
+}
+
+func (m *JWTManager) refreshSigningSecret() secrets.SecretString {
+	m.secretsMu.RLock()
+	defer m.secretsMu.RUnlock()
+	return m.refreshTokenSecretKey
+}
+
+// checkAccountActive fails with stores.ErrAccountDisabled if the store reports the user as disabled,
+// stores that cannot disable users accept everyone.
+func checkAccountActive(store stores.Store, userIdentifier string) error {
+	disabler, ok := store.(stores.UserDisabler)
+	if !ok {
+		return nil
+	}
+	disabled, err := disabler.IsUserDisabled(userIdentifier)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		return fmt.Errorf("%w: %s", stores.ErrAccountDisabled, userIdentifier)
+	}
+	return nil
+}
+
+// tokenVersioner returns the store as a stores.TokenVersioner when it has token_versions enabled
+func tokenVersioner(store stores.Store) (stores.TokenVersioner, bool) {
+	if store == nil || !store.StoreConfig().TokenVersions {
+		return nil, false
+	}
+	versioner, ok := store.(stores.TokenVersioner)
+	return versioner, ok
+}
+
+// stampTokenVersion sets the tv claim to the current token version of the user,
+// when the store keeps token versions
+func stampTokenVersion(store stores.Store, claims jwt.MapClaims, userIdentifier string) error {
+	versioner, ok := tokenVersioner(store)
+	if !ok {
+		return nil
+	}
+	version, err := versioner.TokenVersion(userIdentifier)
+	if err != nil {
+		return err
+	}
+	claims[ClaimTokenVersion] = version
+	return nil
+}
+
+// checkTokenVersion fails with ErrTokenVersionMismatch when the tv claim is not the current
+// token version of the user, tokens issued before token_versions was enabled count as version 0.
+// Stores without token versions accept every token.
+func checkTokenVersion(store stores.Store, claims jwt.MapClaims, userIdentifier string) error {
+	versioner, ok := tokenVersioner(store)
+	if !ok {
+		return nil
+	}
+	version, err := versioner.TokenVersion(userIdentifier)
+	if err != nil {
+		return err
+	}
+	return compareTokenVersion(claims, version, userIdentifier)
+}
+
+// compareTokenVersion fails with ErrTokenVersionMismatch unless the tv claim is version
+func compareTokenVersion(claims jwt.MapClaims, version int, userIdentifier string) error {
+	var claimed int
+	switch v := claims[ClaimTokenVersion].(type) {
+	case float64:
+		claimed = int(v)
+	case int:
+		claimed = v
+	}
+	if claimed != version {
+		return fmt.Errorf("%w: %s", ErrTokenVersionMismatch, userIdentifier)
+	}
+	return nil
+}
+
+// identifierClaim returns the claim carrying the user identifier: the one named WithUsernameClaim,
+// the claim marked is_identifier, or the jwt_claim of the store's identifier column.
 func (m *JWTManager) identifierClaim() string {
+	if m.usernameClaim != "" {
+		return m.usernameClaim
+	}
 	for name, cfg := range m.cfg.AccessToken.Claims {
 		if cfg.IsIdentifier {
 			return name
 		}
 	}
-	return ""
+	if m.store == nil {
+		return ""
+	}
+	cfg := m.store.StoreConfig()
+	return cfg.Columns[cfg.IdentifierColumn()].JWTClaim
+}
+
+// roleClaimName returns the claim carrying the user's role: the one named WithRoleClaim, the db
+// claim of the store's role column, or the jwt_claim of that column. configured reports whether
+// it was named or listed in the token config, which tokens must then carry.
+func (m *JWTManager) roleClaimName() (name string, configured bool) {
+	if m.roleClaim != "" {
+		return m.roleClaim, true
+	}
+	column := "role"
+	if m.store != nil {
+		column = m.store.StoreConfig().RoleColumn()
+	}
+	for name, cfg := range m.cfg.AccessToken.Claims {
+		if cfg.Source == "db" && cfg.Column == column {
+			return name, true
+		}
+	}
+	if m.store == nil {
+		return "", false
+	}
+	return m.store.StoreConfig().Columns[column].JWTClaim, false
+}
+
+// setIdentityClaims stamps the username and role claims on access token claims, when the
+// token config does not already fill them. An empty role leaves the role claim out.
+func (m *JWTManager) setIdentityClaims(claims jwt.MapClaims, userIdentifier string, role any) {
+	if name := m.identifierClaim(); name != "" {
+		if _, ok := claims[name]; !ok {
+			claims[name] = userIdentifier
+		}
+	}
+	if name, _ := m.roleClaimName(); name != "" && role != nil && role != "" {
+		if _, ok := claims[name]; !ok {
+			claims[name] = role
+		}
+	}
+}
+
+// accessClaimsToVerify returns the configured access token claims verification requires,
+// leaving the role claim to checkRole
+func (m *JWTManager) accessClaimsToVerify() map[string]ClaimConfig {
+	name, _ := m.roleClaimName()
+	if _, ok := m.cfg.AccessToken.Claims[name]; !ok {
+		return m.cfg.AccessToken.Claims
+	}
+	claims := maps.Clone(m.cfg.AccessToken.Claims)
+	delete(claims, name)
+	return claims
+}
+
+// checkRole fails with ErrMissingRole when claims lack the configured role claim, unless
+// the manager was built WithRequireRole(false)
+func (m *JWTManager) checkRole(claims jwt.MapClaims) error {
+	name, configured := m.roleClaimName()
+	if !configured || m.optionalRole {
+		return nil
+	}
+	if _, ok := claims[name]; !ok {
+		return fmt.Errorf("%w: %w", ErrInvalidToken, ErrMissingRole)
+	}
+	return nil
 }
@@ -0,0 +1,107 @@
+package token
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultGlobalNotBeforeTTL is how long the global not-before time of the store is cached
+// by a JWTManager, see WithGlobalNotBeforeTTL
+const DefaultGlobalNotBeforeTTL = 5 * time.Second
+
+// notBeforeCache keeps the global not-before time of the store for ttl, so verifications
+// only read the store once in a while
+type notBeforeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	value   time.Time
+	expires time.Time
+}
+
+// get returns the global not-before time of store, from the cache while it is fresh
+func (c *notBeforeCache) get(store stores.Store) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(c.expires) {
+		return c.value, nil
+	}
+	value, err := store.GetGlobalNotBefore()
+	if err != nil {
+		return time.Time{}, err
+	}
+	c.value, c.expires = value, now.Add(c.ttl)
+	return value, nil
+}
+
+// reset drops the cached time, the next verification reads the store again
+func (c *notBeforeCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expires = time.Time{}
+}
+
+// WithGlobalNotBeforeTTL sets how long the global not-before time of the store is cached,
+// DefaultGlobalNotBeforeTTL by default. Other instances sharing the store notice a call to
+// InvalidateAllTokens within ttl, 0 reads the store on every verification.
+func (m *JWTManager) WithGlobalNotBeforeTTL(ttl time.Duration) *JWTManager {
+	m.globalNotBefore.ttl = ttl
+	return m
+}
+
+// ResetGlobalNotBeforeCache drops the cached global not-before time, so the next verification
+// reads it from the store, e.g. once another instance reports a call to InvalidateAllTokens.
+func (m *JWTManager) ResetGlobalNotBeforeCache() {
+	m.globalNotBefore.reset()
+}
+
+// WithInvalidationBus drops the cached global not-before time as soon as bus reports a change,
+// e.g. a call to InvalidateAllTokens through another replica, rather than after the cache TTL.
+// Authify.WithInvalidationBus publishes these changes.
+func (m *JWTManager) WithInvalidationBus(bus stores.InvalidationBus) *JWTManager {
+	bus.Subscribe(func(inv stores.Invalidation) {
+		if inv.Kind == stores.InvalidateNotBefore || inv.Kind == stores.InvalidateAll {
+			m.ResetGlobalNotBeforeCache()
+		}
+	})
+	return m
+}
+
+// InvalidateAllTokens sets the global not-before time of the store to now and returns it.
+// Every access and refresh token issued until then is rejected with ErrTokenInvalidatedGlobally,
+// at once by this manager and within the cache TTL by the others sharing the store. The iat
+// claim having a precision of a second, tokens issued during the second of the call are
+// rejected too. Managers built WithRefreshOnly without a store fail with stores.ErrStoreNotProvided.
+func (m *JWTManager) InvalidateAllTokens() (time.Time, error) {
+	if m.store == nil {
+		return time.Time{}, stores.ErrStoreNotProvided
+	}
+	now := time.Now()
+	if err := m.store.SetGlobalNotBefore(now); err != nil {
+		return time.Time{}, err
+	}
+	m.ResetGlobalNotBeforeCache()
+	return now, nil
+}
+
+// checkGlobalNotBefore fails with ErrTokenInvalidatedGlobally when claims were issued no later
+// than the second of the global not-before time, managers without a store check nothing
+func (m *JWTManager) checkGlobalNotBefore(claims jwt.MapClaims) error {
+	if m.store == nil {
+		return nil
+	}
+	notBefore, err := m.globalNotBefore.get(m.store)
+	if err != nil || notBefore.IsZero() {
+		return err
+	}
+	issued, err := claims.GetIssuedAt()
+	if err != nil || issued == nil || issued.Unix() <= notBefore.Unix() {
+		return fmt.Errorf("%w: issued before %s", ErrTokenInvalidatedGlobally, notBefore.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
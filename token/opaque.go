@@ -0,0 +1,334 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	opaqueAccessKind  = "access"
+	opaqueRefreshKind = "refresh"
+
+	// claims of opaque tokens, named like the ones Authify reads from JWTs
+	opaqueIdentifierClaim = "username"
+	opaqueRoleClaim       = "role"
+
+	// opaqueTokenBytes is the entropy of opaque tokens, 256 bits
+	opaqueTokenBytes = 32
+)
+
+var (
+	_ TokenManager           = (*OpaqueTokenManager)(nil)
+	_ PreauthenticatedIssuer = (*OpaqueTokenManager)(nil)
+	_ ExpiryIssuer           = (*OpaqueTokenManager)(nil)
+)
+
+// OpaqueTokenManager issues opaque tokens instead of JWTs: random strings carrying nothing
+// decodable. The claims of a token, its user's username, role and scopes plus its expiry,
+// live server-side in a stores.TokenStore under the SHA-256 hash of the token, so a token
+// is revoked the moment its record is deleted and the store never holds usable tokens.
+//
+// It implements TokenManager and can replace a JWTManager, except for ExchangeToken,
+// which opaque tokens do not support. Every verification costs a lookup in the token store.
+type OpaqueTokenManager struct {
+	tokens    stores.TokenStore
+	store     stores.Store
+	durations atomic.Pointer[tokenDurations]
+	// longest lifetime of GenerateTokenWithExpiry, see WithMaxTokenDuration
+	maxTokenDuration time.Duration
+	reloadableScopes
+}
+
+// NewOpaqueTokenManager returns a manager keeping its tokens in tokens, such as a session store,
+// with access tokens lasting accessTTL, 15 minutes when zero, and refresh tokens refreshTTL.
+// Users are authenticated against the store set with WithStore.
+func NewOpaqueTokenManager(tokens stores.TokenStore, accessTTL, refreshTTL time.Duration) *OpaqueTokenManager {
+	if accessTTL == 0 {
+		accessTTL = defaultAccessTokenDuration
+	}
+	m := &OpaqueTokenManager{tokens: tokens}
+	m.durations.Store(&tokenDurations{access: accessTTL, refresh: refreshTTL})
+	return m
+}
+
+func (m *OpaqueTokenManager) WithStore(store stores.Store) *OpaqueTokenManager {
+	m.store = store
+	return m
+}
+
+// GenerateAccessToken validates user identifier/password using the store and issues
+// an access token recorded with the username, role and scopes of the user.
+func (m *OpaqueTokenManager) GenerateAccessToken(userIdentifier, password string) (string, error) {
+	if m.store == nil {
+		return "", stores.ErrStoreNotProvided
+	}
+
+	userData, err := m.store.GetUserInfo(userIdentifier, password)
+	if err != nil {
+		return "", err
+	}
+	return m.IssueAccessToken(userIdentifier, userData)
+}
+
+// IssueAccessToken issues an access token for a user the caller already authenticated,
+// recorded with the role and scopes read from the fields the store returned for them.
+func (m *OpaqueTokenManager) IssueAccessToken(userIdentifier string, userData map[string]any) (string, error) {
+	return m.issueAccessToken(userIdentifier, userData, nil, 0)
+}
+
+// issueAccessToken is IssueAccessToken, recording the claims of extra the token does not already
+// carry. The token lives for ttl, or the configured lifetime of access tokens when zero.
+func (m *OpaqueTokenManager) issueAccessToken(userIdentifier string, userData map[string]any, extra jwt.MapClaims, ttl time.Duration) (string, error) {
+	if m.store == nil {
+		return "", stores.ErrStoreNotProvided
+	}
+
+	cfg := m.store.StoreConfig()
+	claims := jwt.MapClaims{opaqueIdentifierClaim: userIdentifier}
+	if role := cfg.Role(userData); role != "" {
+		claims[opaqueRoleClaim] = role
+	}
+	if scopes := m.scopes(m.store, userData); len(scopes) > 0 {
+		claims[ClaimScope] = strings.Join(scopes, " ")
+	}
+	addExtraClaims(claims, extra)
+
+	// the record outlives the token, so an expired access token can still be refreshed
+	durations := m.durations.Load()
+	if ttl == 0 {
+		ttl = durations.access
+	}
+	return m.issue(opaqueAccessKind, claims, ttl, durations.refresh)
+}
+
+// GenerateRefreshToken issues a refresh token for username.
+// A ClaimSessionID ("sid") entry of requestData ties the token to the session recorded at login,
+// and a ClaimTokenID ("jti") entry is recorded as the ID of the token.
+func (m *OpaqueTokenManager) GenerateRefreshToken(username string, requestData map[string]any) (string, error) {
+	claims := jwt.MapClaims{opaqueIdentifierClaim: username}
+	for _, name := range []string{ClaimSessionID, ClaimTokenID} {
+		if val, ok := requestData[name].(string); ok && val != "" {
+			claims[name] = val
+		}
+	}
+	return m.issue(opaqueRefreshKind, claims, m.durations.Load().refresh, 0)
+}
+
+// VerifyAccessToken looks an access token up in the token store and returns its claims,
+// failing with ErrInvalidToken for unknown or revoked tokens and ErrTokenExpired for expired ones.
+func (m *OpaqueTokenManager) VerifyAccessToken(tokenStr string) (jwt.MapClaims, error) {
+	return m.verify(tokenStr, opaqueAccessKind)
+}
+
+// VerifyRefreshToken is VerifyAccessToken for refresh tokens.
+func (m *OpaqueTokenManager) VerifyRefreshToken(tokenStr string) (jwt.MapClaims, error) {
+	return m.verify(tokenStr, opaqueRefreshKind)
+}
+
+// VerifyTokenWithScope verifies an access token and checks that it grants every required scope.
+// Returns ErrInsufficientScope if any of them is missing.
+func (m *OpaqueTokenManager) VerifyTokenWithScope(tokenStr string, requiredScopes ...string) error {
+	claims, err := m.VerifyAccessToken(tokenStr)
+	if err != nil {
+		return err
+	}
+	if !HasScopes(claims, requiredScopes...) {
+		return ErrInsufficientScope
+	}
+	return nil
+}
+
+// UserIdentifier returns the user a token was issued to, read from its "username" claim.
+func (m *OpaqueTokenManager) UserIdentifier(claims jwt.MapClaims) (string, error) {
+	userIdentifier, ok := claims[opaqueIdentifierClaim].(string)
+	if !ok || userIdentifier == "" {
+		return "", ErrMissingUserIdentifier
+	}
+	return userIdentifier, nil
+}
+
+// Role returns the role of a token's user, read from its "role" claim, or an empty string
+// when the user has none.
+func (m *OpaqueTokenManager) Role(claims jwt.MapClaims) string {
+	role, _ := claims[opaqueRoleClaim].(string)
+	return role
+}
+
+// RefreshToken issues a new access token based on a valid refresh token. The role and scopes
+// are resolved from the store when it can look users up, and otherwise carried over from the
+// previous access token, which may be expired, along with its tenant. The previous token is
+// revoked. The refresh token itself stays valid until it expires, as RefreshToken cannot return
+// a replacement, RefreshTokens rotates it.
+func (m *OpaqueTokenManager) RefreshToken(accessTokenStr, refreshTokenStr string, requestData map[string]any) (string, jwt.MapClaims, error) {
+	refreshClaims, err := m.VerifyRefreshToken(refreshTokenStr)
+	if err != nil {
+		if errors.Is(err, ErrTokenExpired) {
+			return "", nil, ErrRefreshTokenExpired
+		}
+		return "", nil, err
+	}
+	userIdentifier, err := m.UserIdentifier(refreshClaims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Disabled users must log in again once re-enabled
+	if err := checkAccountActive(m.store, userIdentifier); err != nil {
+		return "", nil, err
+	}
+
+	claims := jwt.MapClaims{opaqueIdentifierClaim: userIdentifier}
+	var previous string
+	if accessTokenStr != "" {
+		hash := hashOpaqueToken(accessTokenStr)
+		record, err := m.tokens.GetToken(hash)
+		if err == nil && record.Kind == opaqueAccessKind {
+			if err := checkReusedClaims(record.Claims, opaqueIdentifierClaim, userIdentifier); err != nil {
+				return "", nil, err
+			}
+			for _, name := range []string{opaqueRoleClaim, ClaimScope, ClaimTenant} {
+				if val, ok := record.Claims[name]; ok {
+					claims[name] = val
+				}
+			}
+			previous = hash
+		}
+	}
+
+	stored, err := lookupUser(m.store, userIdentifier)
+	if err != nil {
+		return "", nil, err
+	}
+	if stored != nil {
+		delete(claims, opaqueRoleClaim)
+		delete(claims, ClaimScope)
+		if role := m.store.StoreConfig().Role(stored); role != "" {
+			claims[opaqueRoleClaim] = role
+		}
+		if scopes := m.scopes(m.store, stored); len(scopes) > 0 {
+			claims[ClaimScope] = strings.Join(scopes, " ")
+		}
+	}
+
+	durations := m.durations.Load()
+	tokenStr, err := m.issue(opaqueAccessKind, claims, durations.access, durations.refresh)
+	if err != nil {
+		return "", nil, err
+	}
+	if previous != "" {
+		if err := m.tokens.DeleteToken(previous); err != nil {
+			log.Printf("failed to revoke refreshed access token of %s: %v", userIdentifier, err)
+		}
+	}
+	return tokenStr, claims, nil
+}
+
+// rotateRefreshToken replaces a refresh token by a new one with the same claims and expiry, so
+// rotations never extend a session, and revokes it. A non-empty jti is recorded as the ID of the
+// new token, and the replaced one is then kept, see RefreshTokensRequest.RefreshTokenID.
+func (m *OpaqueTokenManager) rotateRefreshToken(refreshTokenStr, jti string) (string, error) {
+	claims, err := m.VerifyRefreshToken(refreshTokenStr)
+	if err != nil {
+		return "", err
+	}
+	expiry, err := claims.GetExpirationTime()
+	if err != nil || expiry == nil {
+		return "", ErrClaimsInvalid
+	}
+	claims = maps.Clone(claims)
+	if jti != "" {
+		claims[ClaimTokenID] = jti
+	}
+	tokenStr, err := m.issue(opaqueRefreshKind, claims, time.Until(expiry.Time), 0)
+	if err != nil {
+		return "", err
+	}
+	if jti != "" {
+		return tokenStr, nil
+	}
+	if err := m.tokens.DeleteToken(hashOpaqueToken(refreshTokenStr)); err != nil {
+		log.Printf("failed to revoke rotated refresh token: %v", err)
+	}
+	return tokenStr, nil
+}
+
+// ExchangeToken is not supported by opaque tokens and always fails with ErrExchangeForbidden.
+func (m *OpaqueTokenManager) ExchangeToken(subjectToken, actorUsername, actorPassword, audience string, ttl time.Duration) (string, error) {
+	return "", fmt.Errorf("%w: opaque tokens cannot be exchanged", ErrExchangeForbidden)
+}
+
+// RevokeToken deletes the record of an access or refresh token, which is rejected from then on.
+func (m *OpaqueTokenManager) RevokeToken(tokenStr string) error {
+	return m.tokens.DeleteToken(hashOpaqueToken(tokenStr))
+}
+
+// issue records claims, stamped with the issue time and an expiry ttl from now, under the hash
+// of a new random token, and returns the token. The record is kept for grace past the expiry.
+func (m *OpaqueTokenManager) issue(kind string, claims jwt.MapClaims, ttl, grace time.Duration) (string, error) {
+	buf := make([]byte, opaqueTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	tokenStr := base64.RawURLEncoding.EncodeToString(buf)
+
+	// numeric claims are float64, as decoded from JSON, whatever the token store
+	now := time.Now()
+	claims[ClaimIssued] = float64(now.Unix())
+	claims[ClaimExpiry] = float64(now.Add(ttl).Unix())
+
+	err := m.tokens.SaveToken(stores.TokenRecord{
+		Hash:      hashOpaqueToken(tokenStr),
+		Kind:      kind,
+		Claims:    claims,
+		ExpiresAt: now.Add(ttl + grace),
+	})
+	if err != nil {
+		return "", err
+	}
+	return tokenStr, nil
+}
+
+func (m *OpaqueTokenManager) verify(tokenStr, kind string) (jwt.MapClaims, error) {
+	if tokenStr == "" || len(tokenStr) > MaxTokenLength {
+		return nil, ErrInvalidToken
+	}
+
+	record, err := m.tokens.GetToken(hashOpaqueToken(tokenStr))
+	if errors.Is(err, stores.ErrTokenNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.Kind != kind {
+		return nil, ErrInvalidToken
+	}
+
+	claims := jwt.MapClaims(record.Claims)
+	expiry, err := claims.GetExpirationTime()
+	if err != nil || expiry == nil {
+		return nil, ErrClaimsInvalid
+	}
+	if !time.Now().Before(expiry.Time) {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// hashOpaqueToken returns the key of a token in the token store
+func hashOpaqueToken(tokenStr string) string {
+	sum := sha256.Sum256([]byte(tokenStr))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,151 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+)
+
+func newOpaqueTestManager(t *testing.T) (*OpaqueTokenManager, *stores.InMemorySessionStore) {
+	t.Helper()
+	store := stores.NewInMemoryUserStore(stores.StoreConfig{
+		BcryptCost: 4,
+		Columns: map[string]stores.ColumnConfig{
+			"username": {Type: "text", Required: true, PrimaryKey: true},
+			"password": {Type: "text", Required: true, Hidden: true, IsPassword: true},
+			"role":     {Type: "text", Default: "user"},
+		},
+	})
+	if _, err := store.CreateUser(map[string]any{"username": "alice", "password": "password123"}); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	sessions := stores.NewInMemorySessionStore()
+	return NewOpaqueTokenManager(sessions, time.Minute, time.Hour).WithStore(store), sessions
+}
+
+func TestOpaqueTokensAreStoredHashed(t *testing.T) {
+	m, sessions := newOpaqueTestManager(t)
+	accessToken, err := m.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+
+	// 32 random bytes, nothing decodable
+	if len(accessToken) != 43 || strings.Contains(accessToken, ".") {
+		t.Errorf("expected an opaque 256-bit token, got %q", accessToken)
+	}
+	if _, err := sessions.GetToken(accessToken); !errors.Is(err, stores.ErrTokenNotFound) {
+		t.Errorf("expected the token not to be stored as is, got %v", err)
+	}
+	record, err := sessions.GetToken(hashOpaqueToken(accessToken))
+	if err != nil || record.Claims["username"] != "alice" || record.Claims["role"] != "user" {
+		t.Errorf("expected alice's claims under the token hash, got %v (%v)", record, err)
+	}
+}
+
+func TestOpaqueTokenRevocation(t *testing.T) {
+	m, _ := newOpaqueTestManager(t)
+	accessToken, err := m.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	refreshToken, err := m.GenerateRefreshToken("alice", nil)
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+
+	// refreshing revokes the previous access token
+	newToken, _, err := m.RefreshToken(accessToken, refreshToken, nil)
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	if _, err := m.VerifyAccessToken(accessToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected the refreshed access token to be revoked, got %v", err)
+	}
+	if _, err := m.VerifyAccessToken(newToken); err != nil {
+		t.Fatalf("failed to verify the new token: %v", err)
+	}
+
+	for _, tokenStr := range []string{newToken, refreshToken} {
+		if err := m.RevokeToken(tokenStr); err != nil {
+			t.Fatalf("failed to revoke: %v", err)
+		}
+	}
+	if _, err := m.VerifyAccessToken(newToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected the revoked access token to be rejected, got %v", err)
+	}
+	if _, _, err := m.RefreshToken("", refreshToken, nil); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected the revoked refresh token to be rejected, got %v", err)
+	}
+}
+
+func TestOpaqueTokensCannotBeExchanged(t *testing.T) {
+	m, _ := newOpaqueTestManager(t)
+	accessToken, err := m.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	if _, err := m.ExchangeToken(accessToken, "alice", "password123", "", 0); !errors.Is(err, ErrExchangeForbidden) {
+		t.Errorf("expected ErrExchangeForbidden, got %v", err)
+	}
+}
+
+func TestOpaqueIssueTokens(t *testing.T) {
+	m, _ := newOpaqueTestManager(t)
+	ctx := context.Background()
+
+	pair, err := m.IssueTokens(ctx, GenerateTokensRequest{Username: "alice", Password: "password123", Tenant: "acme"})
+	if err != nil {
+		t.Fatalf("failed to issue tokens: %v", err)
+	}
+	if pair.AccessClaims[ClaimTenant] != "acme" || pair.AccessExpiresAt.IsZero() || pair.RefreshExpiresAt.IsZero() {
+		t.Errorf("expected the tenant and the expiries, got %+v", pair)
+	}
+	refreshed, err := m.RefreshTokens(ctx, RefreshTokensRequest{AccessToken: pair.AccessToken, RefreshToken: pair.RefreshToken})
+	if err != nil {
+		t.Fatalf("failed to refresh: %v", err)
+	}
+	verified, err := m.VerifyToken(ctx, VerifyTokenRequest{Token: refreshed.AccessToken})
+	if err != nil || verified.Claims[ClaimTenant] != "acme" {
+		t.Errorf("expected the tenant to be carried over, got %+v (%v)", verified, err)
+	}
+	if _, err := m.VerifyToken(ctx, VerifyTokenRequest{Token: pair.RefreshToken}); err == nil {
+		t.Error("expected a refresh token not to verify as an access token")
+	}
+
+	// the refresh token is rotated, without extending the session
+	if refreshed.RefreshToken == pair.RefreshToken || refreshed.RefreshExpiresAt.Sub(pair.RefreshExpiresAt).Abs() > time.Second {
+		t.Errorf("expected a new refresh token expiring at %v, got %+v", pair.RefreshExpiresAt, refreshed)
+	}
+	if _, err := m.RefreshTokens(ctx, RefreshTokensRequest{RefreshToken: pair.RefreshToken}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected the rotated refresh token to be revoked, got %v", err)
+	}
+	if _, err := m.RefreshTokens(ctx, RefreshTokensRequest{AccessToken: refreshed.AccessToken, RefreshToken: refreshed.RefreshToken}); err != nil {
+		t.Errorf("expected the new refresh token to refresh, got %v", err)
+	}
+}
+
+func TestOpaqueTokenWithExpiry(t *testing.T) {
+	m, _ := newOpaqueTestManager(t)
+	m.WithMaxTokenDuration(48 * time.Hour)
+
+	before := time.Now().Unix()
+	accessToken, err := m.GenerateTokenWithExpiry("alice", "password123", 36*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	claims, err := m.VerifyAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("failed to verify token: %v", err)
+	}
+	if exp, _ := claims.GetExpirationTime(); exp == nil || exp.Unix() < before+36*3600 || exp.Unix() > before+36*3600+2 {
+		t.Errorf("expected the token to live 36 hours, got %v", claims[ClaimExpiry])
+	}
+	if _, err := m.GenerateTokenWithExpiry("alice", "password123", 49*time.Hour); !errors.Is(err, ErrTokenDurationTooLong) {
+		t.Errorf("expected ErrTokenDurationTooLong, got %v", err)
+	}
+}
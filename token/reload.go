@@ -0,0 +1,122 @@
+package token
+
+import (
+	"maps"
+	"sync/atomic"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+)
+
+// Reloadable is implemented by token managers whose token lifetimes and role permissions can be
+// replaced while they serve requests, as lib.Reloader does when the config files change.
+// Tokens issued before a change keep the lifetime and scopes they were issued with.
+type Reloadable interface {
+	// SetDurations replaces the lifetimes of access and refresh tokens, both must be positive
+	SetDurations(access, refresh time.Duration) error
+	// SetRolePermissions replaces the role_permissions of the store config when granting scopes
+	SetRolePermissions(permissions map[string][]string)
+}
+
+var (
+	_ Reloadable = (*JWTManager)(nil)
+	_ Reloadable = (*OpaqueTokenManager)(nil)
+)
+
+// tokenDurations are the lifetimes of issued tokens, swapped as a whole
+type tokenDurations struct {
+	access  time.Duration
+	refresh time.Duration
+}
+
+func newTokenDurations(access, refresh time.Duration) (*tokenDurations, error) {
+	if access <= 0 || refresh <= 0 {
+		return nil, ErrInvalidDuration
+	}
+	return &tokenDurations{access: access, refresh: refresh}, nil
+}
+
+// reloadableScopes grants scopes with the store config, or with the role permissions
+// set by SetRolePermissions once it was called
+type reloadableScopes struct {
+	rolePermissions atomic.Pointer[map[string][]string]
+}
+
+func (r *reloadableScopes) SetRolePermissions(permissions map[string][]string) {
+	permissions = maps.Clone(permissions)
+	r.rolePermissions.Store(&permissions)
+}
+
+func (r *reloadableScopes) scopes(store stores.Store, userData map[string]any) []string {
+	cfg := store.StoreConfig()
+	if permissions := r.rolePermissions.Load(); permissions != nil {
+		cfg.RolePermissions = *permissions
+	}
+	return cfg.Scopes(userData)
+}
+
+// SetDurations replaces the lifetimes of the tokens issued from now on, the ones of the token config,
+// or WithTokenDuration, are used until it is called.
+func (m *JWTManager) SetDurations(access, refresh time.Duration) error {
+	durations, err := newTokenDurations(access, refresh)
+	if err != nil {
+		return err
+	}
+	m.durations.Store(durations)
+	return nil
+}
+
+func (m *JWTManager) accessDuration() time.Duration {
+	if durations := m.durations.Load(); durations != nil {
+		return durations.access
+	}
+	if m.tokenDuration > 0 {
+		return m.tokenDuration
+	}
+	return m.cfg.AccessToken.Duration
+}
+
+func (m *JWTManager) refreshDuration() time.Duration {
+	if durations := m.durations.Load(); durations != nil {
+		return durations.refresh
+	}
+	return m.cfg.RefreshToken.Duration
+}
+
+// SetDurations replaces the lifetimes of the tokens issued from now on.
+func (m *OpaqueTokenManager) SetDurations(access, refresh time.Duration) error {
+	durations, err := newTokenDurations(access, refresh)
+	if err != nil {
+		return err
+	}
+	m.durations.Store(durations)
+	return nil
+}
+
+// Lifetimes are the lifetimes of the tokens a manager issues, before the role_durations of the token config
+type Lifetimes struct {
+	Access  time.Duration
+	Refresh time.Duration
+}
+
+// LifetimeReporter is implemented by token managers that can tell the lifetimes of the tokens they
+// issue, such as the JWT and opaque managers. The lifetimes follow SetDurations.
+type LifetimeReporter interface {
+	Lifetimes() Lifetimes
+}
+
+var (
+	_ LifetimeReporter = (*JWTManager)(nil)
+	_ LifetimeReporter = (*OpaqueTokenManager)(nil)
+)
+
+// Lifetimes returns the lifetimes of the tokens issued from now on
+func (m *JWTManager) Lifetimes() Lifetimes {
+	return Lifetimes{Access: m.accessDuration(), Refresh: m.refreshDuration()}
+}
+
+// Lifetimes returns the lifetimes of the tokens issued from now on
+func (m *OpaqueTokenManager) Lifetimes() Lifetimes {
+	durations := m.durations.Load()
+	return Lifetimes{Access: durations.access, Refresh: durations.refresh}
+}
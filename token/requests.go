@@ -0,0 +1,320 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenPair is the access and refresh token of a login, along with when they expire.
+type TokenPair struct {
+	AccessToken      string    `json:"access_token"`
+	RefreshToken     string    `json:"refresh_token"`
+	AccessExpiresAt  time.Time `json:"access_expires_at"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+	// AccessClaims are the verified claims of AccessToken, they are never serialized
+	AccessClaims jwt.MapClaims `json:"-"`
+}
+
+// GenerateTokensRequest is a login of IssueTokens. Fields are added here rather than as new
+// parameters, so implementations keep compiling as features grow. Managers fail with
+// ErrRequestNotSupported for a field set in a request they cannot honour, rather than
+// silently ignoring it.
+type GenerateTokensRequest struct {
+	Username string
+	Password string
+	// Device fills the "ip", "user_agent" and device ID request data of the refresh token,
+	// which binds it with WithBindingMode
+	Device stores.DeviceInfo
+	// RememberMe asks for a session outliving the usual refresh token lifetime
+	RememberMe bool
+	// Tenant is stamped on the access token in the ClaimTenant claim, and carried over by refreshes
+	Tenant string
+	// ExtraClaims are added to the access token of the login. They never replace a claim set by
+	// the manager, such as the identifier, the role, the scopes or the registered claims.
+	ExtraClaims map[string]any
+	// SessionID ties the refresh token to a session recorded by the caller, in its ClaimSessionID claim
+	SessionID string
+	// RefreshTokenID is stamped on the refresh token in its ClaimTokenID claim, which tells the
+	// tokens of a refresh token family apart, see authify.WithTokenFamilies
+	RefreshTokenID string
+}
+
+// RefreshTokensRequest is a refresh of RefreshTokens. AccessToken, which may be expired, is
+// optional, its claims are carried over when set.
+type RefreshTokensRequest struct {
+	AccessToken  string
+	RefreshToken string
+	// Device must be the one the refresh token is bound to, see WithBindingMode
+	Device stores.DeviceInfo
+	// RefreshTokenID rotates the refresh token when set: the pair carries a replacement, with the
+	// claims and expiry of RefreshToken, stamped with RefreshTokenID in its ClaimTokenID claim.
+	// RefreshToken is left valid, the caller tracks which tokens were consumed.
+	RefreshTokenID string
+}
+
+// VerifyTokenRequest is a verification of VerifyToken.
+type VerifyTokenRequest struct {
+	Token string
+	// Refresh verifies Token as a refresh token rather than an access token
+	Refresh bool
+	// Scopes must all be granted by the token, which fails with ErrInsufficientScope otherwise
+	Scopes []string
+}
+
+// VerifyTokenResponse is the result of VerifyToken.
+type VerifyTokenResponse struct {
+	Claims    jwt.MapClaims
+	ExpiresAt time.Time
+}
+
+// RequestData returns the request data of the narrow methods for device, the "ip", "user_agent"
+// and RequestDeviceID entries, plus the ClaimSessionID entry unless sessionID is empty. The
+// ClaimTokenID entry, stamped on refresh tokens, is left for the caller to add.
+func RequestData(device stores.DeviceInfo, sessionID string) map[string]any {
+	requestData := map[string]any{
+		"ip":            device.IP,
+		"user_agent":    device.UserAgent,
+		RequestDeviceID: device.DeviceID,
+	}
+	if sessionID != "" {
+		requestData[ClaimSessionID] = sessionID
+	}
+	return requestData
+}
+
+// UnimplementedTokenManager is embedded by TokenManager implementations written against
+// IssueTokens, RefreshTokens and VerifyToken only. It provides the narrow methods, which fail
+// with ErrNotImplemented, except UserIdentifier, which reads the "username" claim, or the
+// "sub" claim when there is none. authify.Authify serves logins, refreshes and authentication
+// through the request methods, so such an implementation needs nothing more.
+type UnimplementedTokenManager struct{}
+
+func (UnimplementedTokenManager) GenerateAccessToken(userIdentifier, password string) (string, error) {
+	return "", fmt.Errorf("%w: GenerateAccessToken", ErrNotImplemented)
+}
+
+func (UnimplementedTokenManager) GenerateRefreshToken(username string, requestData map[string]any) (string, error) {
+	return "", fmt.Errorf("%w: GenerateRefreshToken", ErrNotImplemented)
+}
+
+func (UnimplementedTokenManager) VerifyAccessToken(tokenStr string) (jwt.MapClaims, error) {
+	return nil, fmt.Errorf("%w: VerifyAccessToken", ErrNotImplemented)
+}
+
+func (UnimplementedTokenManager) VerifyRefreshToken(tokenStr string) (jwt.MapClaims, error) {
+	return nil, fmt.Errorf("%w: VerifyRefreshToken", ErrNotImplemented)
+}
+
+func (UnimplementedTokenManager) RefreshToken(accessTokenStr, refreshTokenStr string, requestData map[string]any) (string, jwt.MapClaims, error) {
+	return "", nil, fmt.Errorf("%w: RefreshToken", ErrNotImplemented)
+}
+
+func (UnimplementedTokenManager) VerifyTokenWithScope(tokenStr string, requiredScopes ...string) error {
+	return fmt.Errorf("%w: VerifyTokenWithScope", ErrNotImplemented)
+}
+
+func (UnimplementedTokenManager) UserIdentifier(claims jwt.MapClaims) (string, error) {
+	for _, name := range []string{"username", ClaimSubject} {
+		if userIdentifier, ok := claims[name].(string); ok && userIdentifier != "" {
+			return userIdentifier, nil
+		}
+	}
+	return "", ErrMissingUserIdentifier
+}
+
+func (UnimplementedTokenManager) ExchangeToken(subjectToken, actorUsername, actorPassword, audience string, ttl time.Duration) (string, error) {
+	return "", fmt.Errorf("%w: ExchangeToken", ErrNotImplemented)
+}
+
+// verifyRequest serves VerifyToken with the narrow verification methods of a manager
+func verifyRequest(m TokenManager, req VerifyTokenRequest) (*VerifyTokenResponse, error) {
+	verify := m.VerifyAccessToken
+	if req.Refresh {
+		verify = m.VerifyRefreshToken
+	}
+	claims, err := verify(req.Token)
+	if err != nil {
+		return nil, err
+	}
+	if !HasScopes(claims, req.Scopes...) {
+		return nil, ErrInsufficientScope
+	}
+	resp := &VerifyTokenResponse{Claims: claims}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		resp.ExpiresAt = exp.UTC()
+	}
+	return resp, nil
+}
+
+// newTokenPair pairs freshly issued tokens of m with their expiries, read off their verified claims
+func newTokenPair(m TokenManager, accessToken, refreshToken string) (*TokenPair, error) {
+	access, err := verifyRequest(m, VerifyTokenRequest{Token: accessToken})
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := verifyRequest(m, VerifyTokenRequest{Token: refreshToken, Refresh: true})
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		AccessExpiresAt:  access.ExpiresAt,
+		RefreshExpiresAt: refresh.ExpiresAt,
+		AccessClaims:     access.Claims,
+	}, nil
+}
+
+// refreshedTokenPair pairs the access token minted by a refresh, with its claims, and the refresh
+// token it was minted with. The claims are not verified again: a refresh made without the
+// previous access token, with a store that cannot look users up, mints one without role, which
+// verification would reject.
+func refreshedTokenPair(m TokenManager, accessToken string, claims jwt.MapClaims, refreshToken string) (*TokenPair, error) {
+	refresh, err := verifyRequest(m, VerifyTokenRequest{Token: refreshToken, Refresh: true})
+	if err != nil {
+		return nil, err
+	}
+	pair := &TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refresh.ExpiresAt,
+		AccessClaims:     claims,
+	}
+	// the claims are the ones just signed, with an int64 expiry rather than a decoded float64
+	if exp, ok := claims[ClaimExpiry].(int64); ok {
+		pair.AccessExpiresAt = time.Unix(exp, 0).UTC()
+	} else if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		pair.AccessExpiresAt = exp.UTC()
+	}
+	return pair, nil
+}
+
+// extraClaims returns the claims of req added to the access token, nil when there are none
+func extraClaims(req GenerateTokensRequest) jwt.MapClaims {
+	if len(req.ExtraClaims) == 0 && req.Tenant == "" {
+		return nil
+	}
+	extra := jwt.MapClaims(maps.Clone(req.ExtraClaims))
+	if extra == nil {
+		extra = jwt.MapClaims{}
+	}
+	if req.Tenant != "" {
+		extra[ClaimTenant] = req.Tenant
+	}
+	return extra
+}
+
+// loginRequestData returns the request data of the refresh token of a login
+func loginRequestData(req GenerateTokensRequest) map[string]any {
+	requestData := RequestData(req.Device, req.SessionID)
+	if req.RefreshTokenID != "" {
+		requestData[ClaimTokenID] = req.RefreshTokenID
+	}
+	return requestData
+}
+
+// addExtraClaims adds the claims of extra claims does not already carry
+func addExtraClaims(claims, extra jwt.MapClaims) {
+	for name, val := range extra {
+		if _, ok := claims[name]; !ok {
+			claims[name] = val
+		}
+	}
+}
+
+// IssueTokens checks the credentials of req and issues an access and a refresh token, the
+// access token carrying the tenant and extra claims of req, see GenerateTokensRequest.
+// RememberMe is not supported, refresh tokens last the configured duration of the user's role.
+func (m *JWTManager) IssueTokens(ctx context.Context, req GenerateTokensRequest) (*TokenPair, error) {
+	if req.RememberMe {
+		return nil, fmt.Errorf("%w: RememberMe", ErrRequestNotSupported)
+	}
+	if m.store == nil {
+		return nil, stores.ErrStoreNotProvided
+	}
+	userData, err := m.store.GetUserInfo(req.Username, req.Password)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := m.issueAccessToken(req.Username, userData, extraClaims(req), 0)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := m.GenerateRefreshToken(req.Username, loginRequestData(req))
+	if err != nil {
+		return nil, err
+	}
+	return newTokenPair(m, accessToken, refreshToken)
+}
+
+// RefreshTokens issues a new access token for the refresh token of req, see RefreshToken.
+// The refresh token itself is returned as is, unless req.RefreshTokenID rotates it.
+func (m *JWTManager) RefreshTokens(ctx context.Context, req RefreshTokensRequest) (*TokenPair, error) {
+	accessToken, claims, err := m.RefreshToken(req.AccessToken, req.RefreshToken, RequestData(req.Device, ""))
+	if err != nil {
+		return nil, err
+	}
+	refreshToken := req.RefreshToken
+	if req.RefreshTokenID != "" {
+		if refreshToken, err = m.rotateRefreshToken(req.RefreshToken, req.RefreshTokenID); err != nil {
+			return nil, err
+		}
+	}
+	return refreshedTokenPair(m, accessToken, claims, refreshToken)
+}
+
+// VerifyToken verifies the access or refresh token of req like VerifyAccessToken and
+// VerifyRefreshToken do, and checks the scopes of req.
+func (m *JWTManager) VerifyToken(ctx context.Context, req VerifyTokenRequest) (*VerifyTokenResponse, error) {
+	return verifyRequest(m, req)
+}
+
+// IssueTokens is JWTManager.IssueTokens for opaque tokens, the tenant and extra claims being
+// recorded along with the access token.
+func (m *OpaqueTokenManager) IssueTokens(ctx context.Context, req GenerateTokensRequest) (*TokenPair, error) {
+	if req.RememberMe {
+		return nil, fmt.Errorf("%w: RememberMe", ErrRequestNotSupported)
+	}
+	if m.store == nil {
+		return nil, stores.ErrStoreNotProvided
+	}
+	userData, err := m.store.GetUserInfo(req.Username, req.Password)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := m.issueAccessToken(req.Username, userData, extraClaims(req), 0)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := m.GenerateRefreshToken(req.Username, loginRequestData(req))
+	if err != nil {
+		return nil, err
+	}
+	return newTokenPair(m, accessToken, refreshToken)
+}
+
+// RefreshTokens is JWTManager.RefreshTokens for opaque tokens, except that the refresh token is
+// always rotated: the pair carries a new one, expiring with the one of req, which is revoked.
+// With req.RefreshTokenID, the one of req is left valid for the caller, which tracks the
+// tokens consumed, to detect its reuse.
+func (m *OpaqueTokenManager) RefreshTokens(ctx context.Context, req RefreshTokensRequest) (*TokenPair, error) {
+	accessToken, claims, err := m.RefreshToken(req.AccessToken, req.RefreshToken, RequestData(req.Device, ""))
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := m.rotateRefreshToken(req.RefreshToken, req.RefreshTokenID)
+	if err != nil {
+		return nil, err
+	}
+	return refreshedTokenPair(m, accessToken, claims, refreshToken)
+}
+
+// VerifyToken is JWTManager.VerifyToken for opaque tokens.
+func (m *OpaqueTokenManager) VerifyToken(ctx context.Context, req VerifyTokenRequest) (*VerifyTokenResponse, error) {
+	return verifyRequest(m, req)
+}
@@ -0,0 +1,142 @@
+package token
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+)
+
+// WithRoleTokenDurations sets the lifetime of the access tokens of users of the listed roles,
+// e.g. {"admin": 5 * time.Minute}, in place of the role_durations of the access token config.
+// Users of other roles get the default lifetime. Durations must be positive, Build fails with
+// ErrInvalidDuration otherwise.
+func (m *JWTManager) WithRoleTokenDurations(durations map[string]time.Duration) *JWTManager {
+	if err := checkRoleDurations(durations); err != nil {
+		m.setBuildErr(err)
+		return m
+	}
+	m.roleAccessDurations = durations
+	return m
+}
+
+// WithRoleRefreshDurations is WithRoleTokenDurations for refresh tokens, in place of the
+// role_durations of the refresh token config. The role of a user is looked up in the store
+// when their refresh token is issued, stores that cannot look users up get the default lifetime.
+func (m *JWTManager) WithRoleRefreshDurations(durations map[string]time.Duration) *JWTManager {
+	if err := checkRoleDurations(durations); err != nil {
+		m.setBuildErr(err)
+		return m
+	}
+	m.roleRefreshDurations = durations
+	return m
+}
+
+func checkRoleDurations(durations map[string]time.Duration) error {
+	for role, d := range durations {
+		if d <= 0 {
+			return fmt.Errorf("%w, got %v for role %s", ErrInvalidDuration, d, role)
+		}
+	}
+	return nil
+}
+
+// accessDurationFor returns the lifetime of the access tokens of role
+func (m *JWTManager) accessDurationFor(role string) time.Duration {
+	if d, ok := m.roleAccessDurations[role]; ok {
+		return d
+	}
+	return m.accessDuration()
+}
+
+// refreshDurationFor returns the lifetime of the refresh tokens of role
+func (m *JWTManager) refreshDurationFor(role string) time.Duration {
+	if d, ok := m.roleRefreshDurations[role]; ok {
+		return d
+	}
+	return m.refreshDuration()
+}
+
+// longestAccessDuration returns the longest lifetime of access tokens, of any role
+func (m *JWTManager) longestAccessDuration() time.Duration {
+	longest := m.accessDuration()
+	for _, d := range m.roleAccessDurations {
+		longest = max(longest, d)
+	}
+	return longest
+}
+
+// longestRefreshDuration returns the longest lifetime of refresh tokens, of any role
+func (m *JWTManager) longestRefreshDuration() time.Duration {
+	longest := m.refreshDuration()
+	for _, d := range m.roleRefreshDurations {
+		longest = max(longest, d)
+	}
+	return longest
+}
+
+// refreshedAccessDuration returns the lifetime of the access token minted by a refresh. The role
+// is read from the store, as the previous access token may have expired and its role may be out
+// of date. The token is never given a longer lifetime than the role it carries, claimedRole,
+// which differs from the stored one when the store cannot look users up.
+func (m *JWTManager) refreshedAccessDuration(userIdentifier string, claimedRole any) (time.Duration, error) {
+	if len(m.roleAccessDurations) == 0 {
+		return m.accessDuration(), nil
+	}
+	role, err := m.storeRole(userIdentifier)
+	if err != nil {
+		return 0, err
+	}
+	duration := m.accessDurationFor(role)
+	if claimed, ok := claimedRole.(string); ok && claimed != role {
+		duration = min(duration, m.accessDurationFor(claimed))
+	}
+	return duration, nil
+}
+
+// refreshTokenDuration returns the lifetime of the refresh token of userIdentifier, whose role
+// is only looked up when refresh lifetimes depend on it
+func (m *JWTManager) refreshTokenDuration(userIdentifier string) (time.Duration, error) {
+	if len(m.roleRefreshDurations) == 0 {
+		return m.refreshDuration(), nil
+	}
+	role, err := m.storeRole(userIdentifier)
+	if err != nil {
+		return 0, err
+	}
+	return m.refreshDurationFor(role), nil
+}
+
+// storeRole returns the role the store holds for userIdentifier, empty when the store cannot look users up
+func (m *JWTManager) storeRole(userIdentifier string) (string, error) {
+	user, err := m.storeUser(userIdentifier)
+	if err != nil {
+		return "", err
+	}
+	role, _ := user[m.store.StoreConfig().RoleColumn()].(string)
+	return role, nil
+}
+
+// storeUser returns the non-hidden columns the store holds for userIdentifier, nil when the
+// store cannot look users up
+func (m *JWTManager) storeUser(userIdentifier string) (map[string]any, error) {
+	return lookupUser(m.store, userIdentifier)
+}
+
+// lookupUser returns the non-hidden columns store holds for userIdentifier, nil when store
+// is not a stores.UserGetter
+func lookupUser(store stores.Store, userIdentifier string) (map[string]any, error) {
+	getter, ok := store.(stores.UserGetter)
+	if !ok {
+		return nil, nil
+	}
+	user, err := getter.GetUserByUsername(userIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]any, len(user))
+	for name, val := range user {
+		data[name] = val
+	}
+	return data, nil
+}
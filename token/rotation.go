@@ -0,0 +1,81 @@
+package token
+
+import (
+	"time"
+
+	"github.com/HassanAli101/authify/secrets"
+)
+
+var _ SecretRotator = (*JWTManager)(nil)
+
+// rotatedSecret is a secret replaced by RotateSecrets, accepted until expiresAt
+type rotatedSecret struct {
+	secret    secrets.SecretString
+	expiresAt time.Time
+}
+
+// appendUnexpired appends the rotated secrets whose grace window has not ended at now
+func appendUnexpired(accepted []secrets.SecretString, rotated []rotatedSecret, now time.Time) []secrets.SecretString {
+	for _, r := range rotated {
+		if now.Before(r.expiresAt) {
+			accepted = append(accepted, r.secret)
+		}
+	}
+	return accepted
+}
+
+// WithSecretGracePeriod sets how long the secrets replaced by RotateSecrets with keepOld stay
+// accepted. By default they are accepted for the lifetime of the tokens they signed, the longest
+// access token duration of any role for the access secret and the longest refresh token duration
+// for the refresh secret, so every token issued before the rotation remains valid until it expires.
+func (m *JWTManager) WithSecretGracePeriod(d time.Duration) *JWTManager {
+	m.secretGracePeriod = d
+	return m
+}
+
+// RotateSecrets replaces the secrets signing access and refresh tokens while the manager serves
+// requests, e.g. in response to an incident, and is safe for concurrent use. Tokens are signed
+// with the new secrets right away. With keepOld, the replaced secrets keep verifying the tokens
+// they signed during the grace window, see WithSecretGracePeriod. Without it, only the new
+// secrets are accepted from now on: the secrets set with WithPreviousAccessSecret and
+// WithPreviousRefreshSecret and the ones of earlier rotations are dropped too, which logs
+// every user out. Rotations only affect this manager, other instances need their own.
+func (m *JWTManager) RotateSecrets(newAccess, newRefresh string, keepOld bool) error {
+	if newAccess == "" {
+		return ErrAccessTokenSecretNotProvided
+	}
+	if newRefresh == "" {
+		return ErrRefreshTokenSecretNotProvided
+	}
+
+	m.secretsMu.Lock()
+	defer m.secretsMu.Unlock()
+	if !keepOld {
+		m.previousAccessSecrets = nil
+		m.previousRefreshSecrets = nil
+		m.rotatedAccessSecrets = nil
+		m.rotatedRefreshSecrets = nil
+	} else {
+		now := time.Now()
+		m.rotatedAccessSecrets = m.keepRotated(m.rotatedAccessSecrets, m.accessTokenSecretKey, now, m.longestAccessDuration())
+		m.rotatedRefreshSecrets = m.keepRotated(m.rotatedRefreshSecrets, m.refreshTokenSecretKey, now, m.longestRefreshDuration())
+	}
+	m.accessTokenSecretKey = secrets.SecretString(newAccess)
+	m.refreshTokenSecretKey = secrets.SecretString(newRefresh)
+	return nil
+}
+
+// keepRotated adds secret to the rotated secrets, dropping the ones whose grace window ended
+func (m *JWTManager) keepRotated(rotated []rotatedSecret, secret secrets.SecretString, now time.Time, lifetime time.Duration) []rotatedSecret {
+	grace := m.secretGracePeriod
+	if grace <= 0 {
+		grace = lifetime
+	}
+	kept := []rotatedSecret{{secret: secret, expiresAt: now.Add(grace)}}
+	for _, r := range rotated {
+		if now.Before(r.expiresAt) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
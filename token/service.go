@@ -0,0 +1,102 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/HassanAli101/authify/stores"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// GenerateServiceToken authenticates a service account with its client ID and secret and issues
+// it an access token, with the client ID as "sub" claim and a ClaimTokenUse claim of
+// TokenUseService. No refresh token comes with it, service accounts ask for a new token once
+// theirs expires, after the service_token duration of the token config.
+//
+// The token is granted scopes, which must all be allowed to the account or ErrInvalidScope is
+// returned, or every scope allowed to the account when scopes is empty. Unknown client IDs and
+// wrong secrets alike fail with stores.ErrInvalidClientCredentials, disabled accounts with
+// stores.ErrAccountDisabled.
+func (m *JWTManager) GenerateServiceToken(clientID, clientSecret string, scopes []string) (string, error) {
+	if m.serviceAccounts == nil {
+		return "", stores.ErrServiceAccountsNotSupported
+	}
+
+	account, err := m.serviceAccounts.GetServiceAccount(clientID)
+	if errors.Is(err, stores.ErrServiceAccountNotFound) {
+		return "", stores.ErrInvalidClientCredentials
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := account.CheckSecret(clientSecret); err != nil {
+		return "", err
+	}
+
+	granted := account.Scopes
+	if len(scopes) > 0 {
+		for _, scope := range scopes {
+			if !slices.Contains(account.Scopes, scope) {
+				return "", fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+			}
+		}
+		granted = scopes
+	}
+
+	claims := jwt.MapClaims{
+		ClaimSubject:  clientID,
+		ClaimTokenUse: TokenUseService,
+	}
+	if len(granted) > 0 {
+		claims[ClaimScope] = strings.Join(granted, " ")
+	}
+	m.setRegisteredClaims(claims, m.serviceDuration())
+	m.setAudience(claims)
+
+	return m.signToken(claims, m.accessSigningSecret(), m.cfg.AccessToken.SigningMethod)
+}
+
+// TokenUse returns the kind of an access token, TokenUseService for the tokens of service
+// accounts and TokenUseUser for every other one.
+func TokenUse(claims jwt.MapClaims) string {
+	if claims[ClaimTokenUse] == TokenUseService {
+		return TokenUseService
+	}
+	return TokenUseUser
+}
+
+// verifyServiceToken completes the verification of a service token, which carries none of the
+// claims configured for user tokens: its client ID must be set and, in strict mode, its service
+// account must still be active.
+func (m *JWTManager) verifyServiceToken(claims jwt.MapClaims) (jwt.MapClaims, error) {
+	clientID, ok := claims[ClaimSubject].(string)
+	if !ok || clientID == "" {
+		return nil, fmt.Errorf("%w: service token without a client id", ErrInvalidToken)
+	}
+	if !m.strict {
+		return claims, nil
+	}
+
+	if m.serviceAccounts == nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, stores.ErrServiceAccountsNotSupported)
+	}
+	account, err := m.serviceAccounts.GetServiceAccount(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if account.Disabled {
+		return nil, fmt.Errorf("%w: %s", stores.ErrAccountDisabled, clientID)
+	}
+	return claims, nil
+}
+
+// serviceDuration returns the lifetime of service tokens
+func (m *JWTManager) serviceDuration() time.Duration {
+	if m.cfg.ServiceToken.Duration > 0 {
+		return m.cfg.ServiceToken.Duration
+	}
+	return defaultServiceDuration
+}
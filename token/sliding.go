@@ -0,0 +1,81 @@
+package token
+
+import (
+	"log"
+	"maps"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// WithSlidingExpiration extends sessions while they are used: VerifyAccessTokenSliding replaces
+// the access tokens expiring within threshold with fresh ones, so active clients go on without a
+// refresh round-trip. Replacements never outlive the refresh token of their session, whose expiry
+// access tokens carry in the ClaimSessionExpiry claim once sliding is enabled. Tokens without it,
+// issued before or by ExchangeToken, and the tokens of service accounts are never replaced.
+// Zero, the default, disables sliding.
+func (m *JWTManager) WithSlidingExpiration(threshold time.Duration) *JWTManager {
+	m.slidingThreshold = threshold
+	return m
+}
+
+// VerifyAccessTokenSliding verifies an access token like VerifyAccessToken and, when it expires
+// within the threshold of WithSlidingExpiration, also returns its replacement: the same claims,
+// issued now and lasting the access token duration of its role, cut short at the expiry of the
+// session. replacement is empty when the token is not due, or cannot last any longer.
+func (m *JWTManager) VerifyAccessTokenSliding(tokenStr string) (claims jwt.MapClaims, replacement string, err error) {
+	claims, err = m.VerifyAccessToken(tokenStr)
+	if err != nil {
+		return nil, "", err
+	}
+	replacement, err = m.slide(claims)
+	if err != nil {
+		// the token itself is valid, it is just not replaced
+		log.Printf("failed to replace access token near expiry: %v", err)
+	}
+	return claims, replacement, nil
+}
+
+// slide signs the replacement of a verified access token, or returns an empty string when it
+// is not due for one
+func (m *JWTManager) slide(claims jwt.MapClaims) (string, error) {
+	if m.slidingThreshold <= 0 || TokenUse(claims) == TokenUseService {
+		return "", nil
+	}
+	expiry, err := claims.GetExpirationTime()
+	if err != nil || expiry == nil || time.Until(expiry.Time) >= m.slidingThreshold {
+		return "", nil
+	}
+	sessionExpiry, ok := sessionExpiry(claims)
+	if !ok {
+		return "", nil
+	}
+
+	now := time.Now()
+	duration := min(m.accessDurationFor(m.Role(claims)), sessionExpiry.Sub(now))
+	if now.Add(duration).Unix() <= expiry.Unix() {
+		return "", nil
+	}
+	replaced := maps.Clone(claims)
+	m.setRegisteredClaims(replaced, duration)
+	return m.signToken(replaced, m.accessSigningSecret(), m.cfg.AccessToken.SigningMethod)
+}
+
+// stampSessionExpiry records on the claims of an access token when the refresh token of its
+// session expires, if sliding is enabled
+func (m *JWTManager) stampSessionExpiry(claims jwt.MapClaims, expiry time.Time) {
+	if m.slidingThreshold > 0 {
+		claims[ClaimSessionExpiry] = expiry.Unix()
+	}
+}
+
+// sessionExpiry reads the ClaimSessionExpiry claim of a token
+func sessionExpiry(claims jwt.MapClaims) (time.Time, bool) {
+	switch v := claims[ClaimSessionExpiry].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case int64:
+		return time.Unix(v, 0), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,258 @@
+package authify
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/HassanAli101/authify/secrets"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/token"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// tokenExpiryLeeway renews cached access tokens this long before they expire,
+// so they do not expire on their way to the server
+const tokenExpiryLeeway = 10 * time.Second
+
+// TokenSource supplies the access tokens a transport built by NewTokenTransport attaches to requests.
+type TokenSource interface {
+	// Token returns the access token to send, minting or refreshing one when needed
+	Token(ctx context.Context) (string, error)
+	// Refresh returns a token replacing rejected, one a server answered 401 to.
+	// Sources that cannot replace tokens return rejected as is.
+	Refresh(ctx context.Context, rejected string) (string, error)
+}
+
+// NewTokenTransport returns a RoundTripper sending requests through base, nil meaning
+// http.DefaultTransport, with an "Authorization: Bearer" header holding the token of source.
+// A request answered with 401 is retried once after forcing a refresh of the token, unless
+// its body cannot be sent again. The transport is safe for concurrent use as long as
+// source is, which PasswordTokenSource and StaticTokenSource are.
+func NewTokenTransport(base http.RoundTripper, source TokenSource) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tokenTransport{base: base, source: source}
+}
+
+type tokenTransport struct {
+	base   http.RoundTripper
+	source TokenSource
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	accessToken, err := t.source.Token(req.Context())
+	if err != nil {
+		closeRequestBody(req)
+		return nil, fmt.Errorf("getting access token: %w", err)
+	}
+	resp, err := t.base.RoundTrip(withBearer(req, accessToken))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// the body was consumed by the first attempt, it can only be replayed through GetBody
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	refreshed, err := t.source.Refresh(req.Context(), accessToken)
+	if err != nil {
+		discardBody(resp)
+		return nil, fmt.Errorf("refreshing access token: %w", err)
+	}
+	if refreshed == accessToken {
+		return resp, nil
+	}
+
+	retry := withBearer(req, refreshed)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			discardBody(resp)
+			return nil, err
+		}
+		retry.Body = body
+	}
+	discardBody(resp)
+	return t.base.RoundTrip(retry)
+}
+
+// withBearer returns a copy of req carrying accessToken, RoundTrippers must not modify their request
+func withBearer(req *http.Request, accessToken string) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return req
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// discardBody drains and closes the body of a response that is not returned, so its connection can be reused
+func discardBody(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+}
+
+// StaticTokenSource always supplies the same access token, e.g. a long-lived one from
+// the environment. Its tokens are never refreshed.
+type StaticTokenSource string
+
+func (s StaticTokenSource) Token(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+func (s StaticTokenSource) Refresh(ctx context.Context, rejected string) (string, error) {
+	return rejected, nil
+}
+
+// TokenMinter issues the tokens of a PasswordTokenSource. Authify.TokenSource mints them
+// in process, client.Client.TokenSource through the HTTP API of a server.
+type TokenMinter interface {
+	Login(ctx context.Context, username, password string) (accessToken, refreshToken string, err error)
+	Refresh(ctx context.Context, accessToken, refreshToken string) (string, error)
+}
+
+// RotatingTokenMinter is implemented by minters that report the refresh token to use after a
+// refresh, which replaces refreshToken when the token manager rotates refresh tokens. The
+// minters of this module implement it, PasswordTokenSource refreshes with it when available.
+type RotatingTokenMinter interface {
+	RefreshTokens(ctx context.Context, accessToken, refreshToken string) (newAccessToken, newRefreshToken string, err error)
+}
+
+// PasswordTokenSource logs a user in with its password and caches the access token until it
+// expires, or a server rejects it. Expired tokens are renewed with the refresh token, the user
+// logging in again once the refresh token is rejected as well. Concurrent renewals share a
+// single call to the minter.
+type PasswordTokenSource struct {
+	minter   TokenMinter
+	username string
+	password secrets.SecretString
+
+	renewals singleflight.Group
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiry       time.Time // zero when the access token does not tell, e.g. opaque tokens
+}
+
+// NewPasswordTokenSource returns a source logging username in through minter.
+// No call is made before the first token is needed.
+func NewPasswordTokenSource(minter TokenMinter, username, password string) *PasswordTokenSource {
+	return &PasswordTokenSource{minter: minter, username: username, password: secrets.SecretString(password)}
+}
+
+// TokenSource returns a PasswordTokenSource minting the tokens of username with a.
+func (a *Authify) TokenSource(username, password string) *PasswordTokenSource {
+	return NewPasswordTokenSource(localMinter{a}, username, password)
+}
+
+func (s *PasswordTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	accessToken, expiry := s.accessToken, s.expiry
+	s.mu.Unlock()
+
+	if accessToken != "" && (expiry.IsZero() || time.Now().Add(tokenExpiryLeeway).Before(expiry)) {
+		return accessToken, nil
+	}
+	return s.Refresh(ctx, accessToken)
+}
+
+func (s *PasswordTokenSource) Refresh(ctx context.Context, rejected string) (string, error) {
+	// the renewal outlives the caller that started it, the other callers wait for it too
+	renewal := s.renewals.DoChan("", func() (any, error) {
+		return s.renew(context.WithoutCancel(ctx), rejected)
+	})
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res := <-renewal:
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	}
+}
+
+// renew replaces the cached access token when it is still rejected
+func (s *PasswordTokenSource) renew(ctx context.Context, rejected string) (string, error) {
+	s.mu.Lock()
+	accessToken, refreshToken := s.accessToken, s.refreshToken
+	s.mu.Unlock()
+	if accessToken != rejected {
+		// renewed since rejected was handed out
+		return accessToken, nil
+	}
+
+	if refreshToken != "" {
+		if accessToken, refreshToken, err := s.refresh(ctx, accessToken, refreshToken); err == nil {
+			s.store(accessToken, refreshToken)
+			return accessToken, nil
+		}
+		// the refresh token expired or was revoked, log in again
+	}
+	accessToken, refreshToken, err := s.minter.Login(ctx, s.username, s.password.Reveal())
+	if err != nil {
+		return "", err
+	}
+	s.store(accessToken, refreshToken)
+	return accessToken, nil
+}
+
+// refresh refreshes the tokens with the minter, returning the refresh token to use from then on
+func (s *PasswordTokenSource) refresh(ctx context.Context, accessToken, refreshToken string) (string, string, error) {
+	if rotating, ok := s.minter.(RotatingTokenMinter); ok {
+		return rotating.RefreshTokens(ctx, accessToken, refreshToken)
+	}
+	accessToken, err := s.minter.Refresh(ctx, accessToken, refreshToken)
+	return accessToken, refreshToken, err
+}
+
+func (s *PasswordTokenSource) store(accessToken, refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessToken, s.refreshToken, s.expiry = accessToken, refreshToken, tokenExpiry(accessToken)
+}
+
+// tokenExpiry reads the expiry of a JWT without verifying it, the zero time for other tokens
+func tokenExpiry(accessToken string) time.Time {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(accessToken, claims); err != nil {
+		return time.Time{}
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return time.Time{}
+	}
+	return exp.Time
+}
+
+// localMinter mints tokens with an Authify instance of the same process
+type localMinter struct {
+	a *Authify
+}
+
+func (m localMinter) Login(ctx context.Context, username, password string) (string, string, error) {
+	return m.a.Login(username, password, stores.DeviceInfo{})
+}
+
+func (m localMinter) Refresh(ctx context.Context, accessToken, refreshToken string) (string, error) {
+	accessToken, _, err := m.RefreshTokens(ctx, accessToken, refreshToken)
+	return accessToken, err
+}
+
+func (m localMinter) RefreshTokens(ctx context.Context, accessToken, refreshToken string) (string, string, error) {
+	pair, err := m.a.RefreshTokens(ctx, token.RefreshTokensRequest{AccessToken: accessToken, RefreshToken: refreshToken})
+	if err != nil {
+		return "", "", err
+	}
+	return pair.AccessToken, pair.RefreshToken, nil
+}
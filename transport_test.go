@@ -0,0 +1,186 @@
+package authify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingMinter issues numbered tokens, counting logins and refreshes
+type countingMinter struct {
+	issued     atomic.Int64
+	logins     atomic.Int64
+	refreshes  atomic.Int64
+	refreshErr error
+}
+
+func (m *countingMinter) Login(ctx context.Context, username, password string) (string, string, error) {
+	m.logins.Add(1)
+	return fmt.Sprintf("access-%d", m.issued.Add(1)), "refresh", nil
+}
+
+func (m *countingMinter) Refresh(ctx context.Context, accessToken, refreshToken string) (string, error) {
+	m.refreshes.Add(1)
+	if m.refreshErr != nil {
+		return "", m.refreshErr
+	}
+	return fmt.Sprintf("access-%d", m.issued.Add(1)), nil
+}
+
+// expiringServer answers 401 to requests without a bearer token or with one marked expired
+type expiringServer struct {
+	mu      sync.Mutex
+	expired map[string]bool
+	calls   atomic.Int64
+}
+
+func (s *expiringServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.calls.Add(1)
+	accessToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	expired := s.expired[accessToken]
+	s.mu.Unlock()
+	if !ok || expired {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "%s %s", accessToken, body)
+}
+
+func (s *expiringServer) expire(accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired[accessToken] = true
+}
+
+func newExpiringServer(t *testing.T) (*expiringServer, *httptest.Server) {
+	s := &expiringServer{expired: map[string]bool{}}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Errorf("request failed: %v", err)
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestTokenTransportRefreshesOnce(t *testing.T) {
+	api, srv := newExpiringServer(t)
+	minter := &countingMinter{}
+	client := &http.Client{Transport: NewTokenTransport(nil, NewPasswordTokenSource(minter, "alice", "password123"))}
+
+	if status, body := get(t, client, srv.URL); status != http.StatusOK || body != "access-1 " {
+		t.Fatalf("expected the first token to be accepted, got %d %q", status, body)
+	}
+
+	api.expire("access-1")
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, body := get(t, client, srv.URL); status != http.StatusOK || body != "access-2 " {
+				t.Errorf("expected the refreshed token to be accepted, got %d %q", status, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if logins, refreshes := minter.logins.Load(), minter.refreshes.Load(); logins != 1 || refreshes != 1 {
+		t.Errorf("expected 1 login and 1 refresh, got %d and %d", logins, refreshes)
+	}
+}
+
+func TestTokenTransportLogsInAgain(t *testing.T) {
+	api, srv := newExpiringServer(t)
+	minter := &countingMinter{refreshErr: errors.New("refresh token expired")}
+	client := &http.Client{Transport: NewTokenTransport(nil, NewPasswordTokenSource(minter, "alice", "password123"))}
+
+	get(t, client, srv.URL)
+	api.expire("access-1")
+	if status, body := get(t, client, srv.URL); status != http.StatusOK || body != "access-2 " {
+		t.Errorf("expected a token from a new login, got %d %q", status, body)
+	}
+	if logins := minter.logins.Load(); logins != 2 {
+		t.Errorf("expected a second login once the refresh failed, got %d logins", logins)
+	}
+}
+
+func TestTokenTransportReplaysBody(t *testing.T) {
+	api, srv := newExpiringServer(t)
+	client := &http.Client{Transport: NewTokenTransport(nil, NewPasswordTokenSource(&countingMinter{}, "alice", "password123"))}
+
+	get(t, client, srv.URL)
+	api.expire("access-1")
+	resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("report"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "access-2 report" {
+		t.Errorf("expected the retry to send the body again, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestAuthifyTokenSource(t *testing.T) {
+	a := setupAuthify()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accessToken, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		claims, err := a.Tokens.VerifyAccessToken(accessToken)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, claims["username"])
+	}))
+	defer srv.Close()
+
+	source := a.TokenSource("alice", "password123")
+	client := &http.Client{Transport: NewTokenTransport(nil, source)}
+	if status, body := get(t, client, srv.URL); status != http.StatusOK || body != "alice" {
+		t.Fatalf("expected a token of alice, got %d %q", status, body)
+	}
+
+	first, _ := source.Token(context.Background())
+	if second, _ := source.Token(context.Background()); second != first {
+		t.Errorf("expected the access token to be cached until it expires")
+	}
+	if _, err := a.TokenSource("alice", "wrong").Token(context.Background()); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected ErrInvalidCredentials for a wrong password, got %v", err)
+	}
+}
+
+func TestStaticTokenSource(t *testing.T) {
+	api, srv := newExpiringServer(t)
+	client := &http.Client{Transport: NewTokenTransport(nil, StaticTokenSource("service-token"))}
+
+	if status, body := get(t, client, srv.URL); status != http.StatusOK || body != "service-token " {
+		t.Fatalf("expected the static token to be sent, got %d %q", status, body)
+	}
+
+	api.expire("service-token")
+	calls := api.calls.Load()
+	if status, _ := get(t, client, srv.URL); status != http.StatusUnauthorized {
+		t.Errorf("expected the 401 to be returned, got %d", status)
+	}
+	if retries := api.calls.Load() - calls - 1; retries != 0 {
+		t.Errorf("expected no retry with a static token, got %d", retries)
+	}
+}
@@ -0,0 +1,28 @@
+// Command verifyonly verifies the access token given as its second argument with the secret
+// given as its first, importing nothing of authify but the verifier package.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/HassanAli101/authify/verifier"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: verifyonly <access secret> <access token>")
+		os.Exit(2)
+	}
+	v, err := verifier.New().WithAccessSecret(os.Args[1]).Build()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	claims, err := v.VerifyTokenClaims(os.Args[2])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(claims["username"])
+}
@@ -0,0 +1,218 @@
+// Package verifier verifies the JWTs issued by authify without a store, for services that only
+// need to check the tokens of their callers. It depends on neither the stores nor the token
+// package, so programs importing it alone do not link the postgres driver.
+package verifier
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/HassanAli101/authify/secrets"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnexpectedSigningMethod = errors.New("unexpected signing method")
+	ErrInvalidToken            = errors.New("token is invalid")
+	ErrClaimsInvalid           = errors.New("invalid claims")
+	ErrAudienceMismatch        = errors.New("token was not issued for this audience")
+	ErrSecretNotProvided       = errors.New("access token secret not provided")
+
+	// ErrMissingVerificationKey is returned by Build without the secret access tokens are signed
+	// with, it matches ErrSecretNotProvided too
+	ErrMissingVerificationKey = fmt.Errorf("%w: verifying access tokens needs the secret they are signed with, see WithAccessSecret", ErrSecretNotProvided)
+	// ErrUnsupportedSigningMethod is returned by Build for signing methods other than HS256 and HS512
+	ErrUnsupportedSigningMethod = errors.New("unsupported signing method")
+)
+
+const (
+	// refresh tokens are always signed with HS256, like the token package does
+	refreshSigningMethod = "HS256"
+
+	// MaxTokenLength bounds the tokens handed to the JWT parser, issued tokens are far shorter
+	MaxTokenLength = 8 << 10
+)
+
+// Verifier checks the signature, expiry, not-before time and, when configured, the issuer and
+// audience of tokens. It makes no store lookup, so it cannot reject the tokens of disabled
+// users before they expire, and it does not check the claims configured in the token config
+// nor decrypt encrypted claims, see token.JWTManager for those.
+type Verifier struct {
+	accessSecrets  []secrets.SecretString
+	refreshSecrets []secrets.SecretString
+	signingMethod  string
+	issuer         string
+	audience       string
+}
+
+// New returns a builder of Verifier, accepting tokens signed with HS256 until
+// WithSigningMethod says otherwise.
+func New() *Verifier {
+	return &Verifier{signingMethod: "HS256"}
+}
+
+// WithAccessSecret sets the secret access tokens are signed with, the one of the issuing JWTManager.
+func (v *Verifier) WithAccessSecret(secret string) *Verifier {
+	return v.WithAccessSecretString(secrets.SecretString(secret))
+}
+
+// WithAccessSecretString is WithAccessSecret for a secrets.SecretString.
+func (v *Verifier) WithAccessSecretString(secret secrets.SecretString) *Verifier {
+	if secret != "" {
+		v.accessSecrets = append([]secrets.SecretString{secret}, v.accessSecrets...)
+	}
+	return v
+}
+
+// WithPreviousAccessSecret keeps accepting access tokens signed with a rotated out secret,
+// like JWTManager.WithPreviousAccessSecret. Empty secrets are ignored.
+func (v *Verifier) WithPreviousAccessSecret(secret string) *Verifier {
+	if secret != "" {
+		v.accessSecrets = append(v.accessSecrets, secrets.SecretString(secret))
+	}
+	return v
+}
+
+// WithAdditionalVerifySecrets accepts access tokens signed with any of extra, tried in order once
+// the secret of WithAccessSecret does not match. It allows rotating the secret without downtime:
+// deploy the verifiers with both secrets, then the issuers with the new one, then drop the old one.
+// Empty secrets are ignored.
+func (v *Verifier) WithAdditionalVerifySecrets(extra ...string) *Verifier {
+	for _, secret := range extra {
+		v.WithPreviousAccessSecret(secret)
+	}
+	return v
+}
+
+// WithRefreshSecret sets the secret refresh tokens are signed with, needed by VerifyRefreshToken only.
+func (v *Verifier) WithRefreshSecret(secret string) *Verifier {
+	if secret != "" {
+		v.refreshSecrets = append([]secrets.SecretString{secrets.SecretString(secret)}, v.refreshSecrets...)
+	}
+	return v
+}
+
+// WithSigningMethod sets the algorithm access tokens are signed with, HS256 or HS512,
+// the signing_method of the token config.
+func (v *Verifier) WithSigningMethod(method string) *Verifier {
+	v.signingMethod = method
+	return v
+}
+
+// WithIssuer rejects tokens whose "iss" claim is not issuer.
+func (v *Verifier) WithIssuer(issuer string) *Verifier {
+	v.issuer = issuer
+	return v
+}
+
+// WithAudience rejects access tokens whose "aud" claim does not name audience with ErrAudienceMismatch.
+func (v *Verifier) WithAudience(audience string) *Verifier {
+	v.audience = audience
+	return v
+}
+
+// Build checks the verifier can verify access tokens, failing with ErrMissingVerificationKey
+// without an access secret and ErrUnsupportedSigningMethod, see CheckSigningMethod.
+func (v *Verifier) Build() (*Verifier, error) {
+	if err := CheckSigningMethod(v.signingMethod); err != nil {
+		return nil, err
+	}
+	if len(v.accessSecrets) == 0 {
+		return nil, ErrMissingVerificationKey
+	}
+	return v, nil
+}
+
+// CheckSigningMethod fails with ErrUnsupportedSigningMethod unless method is HS256 or HS512,
+// the methods authify signs access tokens with. Tokens are signed and verified with a shared
+// secret, so asymmetric methods such as RS256 or ES256 are rejected with a message saying so.
+func CheckSigningMethod(method string) error {
+	switch {
+	case method == "HS256" || method == "HS512":
+		return nil
+	case method == "":
+		return fmt.Errorf("%w: none is set, use HS256 or HS512", ErrUnsupportedSigningMethod)
+	case strings.HasPrefix(method, "RS"), strings.HasPrefix(method, "PS"), strings.HasPrefix(method, "ES"), method == "EdDSA":
+		return fmt.Errorf("%w %q: tokens are signed with a shared secret rather than a key pair, use HS256 or HS512", ErrUnsupportedSigningMethod, method)
+	}
+	return fmt.Errorf("%w %q, use HS256 or HS512", ErrUnsupportedSigningMethod, method)
+}
+
+// VerifyToken verifies an access token, see VerifyTokenClaims.
+func (v *Verifier) VerifyToken(tokenStr string) error {
+	_, err := v.VerifyTokenClaims(tokenStr)
+	return err
+}
+
+// VerifyTokenClaims verifies an access token and returns its claims. Expired tokens fail with
+// jwt.ErrTokenExpired, like token.ErrTokenExpired, and other invalid ones with ErrInvalidToken.
+func (v *Verifier) VerifyTokenClaims(tokenStr string) (jwt.MapClaims, error) {
+	claims, err := v.verify(tokenStr, v.signingMethod, v.accessSecrets)
+	if err != nil {
+		return nil, err
+	}
+	if v.audience != "" {
+		aud, err := claims.GetAudience()
+		if err != nil || !slices.Contains(aud, v.audience) {
+			return nil, ErrAudienceMismatch
+		}
+	}
+	return claims, nil
+}
+
+// AuthenticateClaims is VerifyTokenClaims, it lets the verifier protect routes with the
+// middleware package in place of an authify.Authify.
+func (v *Verifier) AuthenticateClaims(tokenStr string) (jwt.MapClaims, error) {
+	return v.VerifyTokenClaims(tokenStr)
+}
+
+// VerifyRefreshToken verifies a refresh token and returns its claims,
+// it fails with ErrSecretNotProvided without WithRefreshSecret.
+func (v *Verifier) VerifyRefreshToken(tokenStr string) (jwt.MapClaims, error) {
+	if len(v.refreshSecrets) == 0 {
+		return nil, ErrSecretNotProvided
+	}
+	return v.verify(tokenStr, refreshSigningMethod, v.refreshSecrets)
+}
+
+// verify parses tokenStr with the first of keys whose signature matches
+func (v *Verifier) verify(tokenStr, method string, keys []secrets.SecretString) (jwt.MapClaims, error) {
+	if tokenStr == "" || len(tokenStr) > MaxTokenLength || strings.Count(tokenStr, ".") != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	var token *jwt.Token
+	var err error
+	for _, secret := range keys {
+		key := []byte(secret.Reveal())
+		token, err = jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || token.Method.Alg() != method {
+				return nil, ErrUnexpectedSigningMethod
+			}
+			return key, nil
+		})
+		secrets.Zero(key)
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			break
+		}
+	}
+	switch {
+	case errors.Is(err, ErrUnexpectedSigningMethod):
+		return nil, ErrUnexpectedSigningMethod
+	case errors.Is(err, jwt.ErrTokenExpired), errors.Is(err, jwt.ErrTokenNotValidYet):
+		return nil, err
+	case err != nil:
+		return nil, ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrClaimsInvalid
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %v", ErrInvalidToken, claims["iss"])
+	}
+	return claims, nil
+}
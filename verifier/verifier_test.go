@@ -0,0 +1,144 @@
+package verifier_test
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HassanAli101/authify/authifytest"
+	"github.com/HassanAli101/authify/stores"
+	"github.com/HassanAli101/authify/verifier"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestVerifier(t *testing.T) *verifier.Verifier {
+	t.Helper()
+	v, err := verifier.New().
+		WithAccessSecret(authifytest.AccessSecret).
+		WithRefreshSecret(authifytest.RefreshSecret).
+		Build()
+	if err != nil {
+		t.Fatalf("failed to build verifier: %v", err)
+	}
+	return v
+}
+
+func TestVerifier(t *testing.T) {
+	a := authifytest.NewTestAuthify(t)
+	authifytest.CreateUser(t, a, "alice", "password123", "user")
+	accessToken, refreshToken, err := a.Login("alice", "password123", stores.DeviceInfo{})
+	if err != nil {
+		t.Fatalf("failed to generate tokens: %v", err)
+	}
+
+	otherSecretToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": "alice"}).SignedString([]byte("other-secret"))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	v := newTestVerifier(t)
+	claims, err := v.VerifyTokenClaims(accessToken)
+	if err != nil || claims["username"] != "alice" {
+		t.Fatalf("expected the token of the manager to be accepted, got %v %v", claims, err)
+	}
+	if _, err := v.VerifyRefreshToken(refreshToken); err != nil {
+		t.Errorf("expected the refresh token to be accepted, got %v", err)
+	}
+	if err := v.VerifyToken(refreshToken); !errors.Is(err, verifier.ErrInvalidToken) {
+		t.Errorf("expected a refresh token to be rejected as access token, got %v", err)
+	}
+
+	cases := map[string]struct {
+		verifier *verifier.Verifier
+		token    string
+		want     error
+	}{
+		"wrong secret":  {v, otherSecretToken, verifier.ErrInvalidToken},
+		"expired":       {v, authifytest.ExpiredAccessToken(t, "alice", "user"), jwt.ErrTokenExpired},
+		"garbage":       {v, "garbage", verifier.ErrInvalidToken},
+		"wrong method":  {verifier.New().WithAccessSecret(authifytest.AccessSecret).WithSigningMethod("HS512"), accessToken, verifier.ErrUnexpectedSigningMethod},
+		"wrong issuer":  {verifier.New().WithAccessSecret(authifytest.AccessSecret).WithIssuer("https://auth.example.com"), accessToken, verifier.ErrInvalidToken},
+		"issuer":        {verifier.New().WithAccessSecret(authifytest.AccessSecret).WithIssuer("https://auth.example.com"), authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithClaim("iss", "https://auth.example.com")), nil},
+		"no audience":   {verifier.New().WithAccessSecret(authifytest.AccessSecret).WithAudience("billing"), accessToken, verifier.ErrAudienceMismatch},
+		"audience":      {verifier.New().WithAccessSecret(authifytest.AccessSecret).WithAudience("billing"), authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithAudience("billing")), nil},
+		"previous":      {verifier.New().WithAccessSecret("new").WithPreviousAccessSecret(authifytest.AccessSecret), accessToken, nil},
+		"additional":    {verifier.New().WithAccessSecret("new").WithAdditionalVerifySecrets("", "other", authifytest.AccessSecret), accessToken, nil},
+		"no additional": {verifier.New().WithAccessSecret("new").WithAdditionalVerifySecrets("other"), accessToken, verifier.ErrInvalidToken},
+		"not yet valid": {v, authifytest.SignedAccessToken(t, "alice", "user", authifytest.WithClaim("nbf", time.Now().Add(time.Hour).Unix())), jwt.ErrTokenNotValidYet},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := tc.verifier.VerifyToken(tc.token); !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	testCases := map[string]struct {
+		verifier *verifier.Verifier
+		want     error
+	}{
+		"no secret":         {verifier.New(), verifier.ErrMissingVerificationKey},
+		"refresh secret":    {verifier.New().WithRefreshSecret("secret"), verifier.ErrMissingVerificationKey},
+		"asymmetric method": {verifier.New().WithAccessSecret("secret").WithSigningMethod("RS256"), verifier.ErrUnsupportedSigningMethod},
+		"unknown method":    {verifier.New().WithAccessSecret("secret").WithSigningMethod("HS384"), verifier.ErrUnsupportedSigningMethod},
+		"no method":         {verifier.New().WithAccessSecret("secret").WithSigningMethod(""), verifier.ErrUnsupportedSigningMethod},
+		"HS512":             {verifier.New().WithAccessSecret("secret").WithSigningMethod("HS512"), nil},
+		"previous secret":   {verifier.New().WithPreviousAccessSecret("secret"), nil},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := tc.verifier.Build(); !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+	if _, err := verifier.New().Build(); !errors.Is(err, verifier.ErrSecretNotProvided) {
+		t.Errorf("expected ErrMissingVerificationKey to match ErrSecretNotProvided, got %v", err)
+	}
+	if err := verifier.CheckSigningMethod("ES256"); err == nil || !strings.Contains(err.Error(), "key pair") {
+		t.Errorf("expected asymmetric methods to be explained, got %v", err)
+	}
+	if _, err := newTestVerifier(t).WithRefreshSecret("").VerifyRefreshToken("a.b.c"); errors.Is(err, verifier.ErrSecretNotProvided) {
+		t.Errorf("expected the refresh secret to be kept, got %v", err)
+	}
+	if _, err := verifier.New().WithAccessSecret("secret").VerifyRefreshToken("a.b.c"); !errors.Is(err, verifier.ErrSecretNotProvided) {
+		t.Errorf("expected ErrSecretNotProvided without a refresh secret, got %v", err)
+	}
+}
+
+// TestVerifyOnlyProgram builds a program importing the verifier alone, checks it does not link
+// the postgres driver, and that it accepts the tokens of a full JWTManager.
+func TestVerifyOnlyProgram(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a program")
+	}
+	goBin := filepath.Join(runtime.GOROOT(), "bin", "go")
+
+	deps, err := exec.Command(goBin, "list", "-deps", "./testdata/verifyonly").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to list dependencies: %v: %s", err, deps)
+	}
+	for _, pkg := range strings.Fields(string(deps)) {
+		if strings.HasPrefix(pkg, "github.com/jackc/pgx") || pkg == "github.com/HassanAli101/authify/stores" {
+			t.Errorf("verifier program must not depend on %s", pkg)
+		}
+	}
+
+	a := authifytest.NewTestAuthify(t)
+	authifytest.CreateUser(t, a, "alice", "password123", "user")
+	accessToken, err := a.Tokens.GenerateAccessToken("alice", "password123")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	out, err := exec.Command(goBin, "run", "./testdata/verifyonly", authifytest.AccessSecret, accessToken).CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != "alice" {
+		t.Errorf("expected the program to accept the token, got %v: %s", err, out)
+	}
+}